@@ -0,0 +1,1673 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.9
+// 	protoc        (unknown)
+// source: mcpwebui/v1/chat.proto
+
+package mcpwebuiv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Chat struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Title string                 `protobuf:"bytes,2,opt,name=title,proto3" json:"title,omitempty"`
+	// The dominant programming language of the code of the chat, like "Go" or "Python", empty if it doesn't
+	// have enough code.
+	Language string `protobuf:"bytes,3,opt,name=language,proto3" json:"language,omitempty"`
+	// The users invited into the chat by the user who created it, making it a collaborative chat.
+	Members []string `protobuf:"bytes,4,rep,name=members,proto3" json:"members,omitempty"`
+	// The labels of the chat, set when it's created.
+	Tags []string `protobuf:"bytes,5,rep,name=tags,proto3" json:"tags,omitempty"`
+	// The system prompt replacing the configured one of the LLM in the chat, empty to keep the configured one.
+	SystemPrompt  string `protobuf:"bytes,6,opt,name=system_prompt,json=systemPrompt,proto3" json:"system_prompt,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Chat) Reset() {
+	*x = Chat{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Chat) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Chat) ProtoMessage() {}
+
+func (x *Chat) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Chat.ProtoReflect.Descriptor instead.
+func (*Chat) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Chat) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Chat) GetTitle() string {
+	if x != nil {
+		return x.Title
+	}
+	return ""
+}
+
+func (x *Chat) GetLanguage() string {
+	if x != nil {
+		return x.Language
+	}
+	return ""
+}
+
+func (x *Chat) GetMembers() []string {
+	if x != nil {
+		return x.Members
+	}
+	return nil
+}
+
+func (x *Chat) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Chat) GetSystemPrompt() string {
+	if x != nil {
+		return x.SystemPrompt
+	}
+	return ""
+}
+
+type Content struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// One of "text", "call_tool" or "tool_result".
+	Type     string `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Text     string `protobuf:"bytes,2,opt,name=text,proto3" json:"text,omitempty"`
+	ToolName string `protobuf:"bytes,3,opt,name=tool_name,json=toolName,proto3" json:"tool_name,omitempty"`
+	// JSON-encoded tool input.
+	ToolInput string `protobuf:"bytes,4,opt,name=tool_input,json=toolInput,proto3" json:"tool_input,omitempty"`
+	// JSON-encoded tool result, or the error of the tool call.
+	ToolResult     string `protobuf:"bytes,5,opt,name=tool_result,json=toolResult,proto3" json:"tool_result,omitempty"`
+	CallToolId     string `protobuf:"bytes,6,opt,name=call_tool_id,json=callToolId,proto3" json:"call_tool_id,omitempty"`
+	CallToolFailed bool   `protobuf:"varint,7,opt,name=call_tool_failed,json=callToolFailed,proto3" json:"call_tool_failed,omitempty"`
+	// Names of the instruction-like patterns found in the tool result by the prompt injection guard.
+	SuspiciousPatterns []string `protobuf:"bytes,8,rep,name=suspicious_patterns,json=suspiciousPatterns,proto3" json:"suspicious_patterns,omitempty"`
+	// Note sent to the LLM after the tool result, like to stop calling a tool failing repeatedly.
+	ToolNote string `protobuf:"bytes,9,opt,name=tool_note,json=toolNote,proto3" json:"tool_note,omitempty"`
+	// Whether the text is the structured output of a response, a JSON value expected to follow the response
+	// schema.
+	Structured bool `protobuf:"varint,10,opt,name=structured,proto3" json:"structured,omitempty"`
+	// Violations of the response schema by the structured output.
+	SchemaViolations []string `protobuf:"bytes,11,rep,name=schema_violations,json=schemaViolations,proto3" json:"schema_violations,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *Content) Reset() {
+	*x = Content{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Content) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Content) ProtoMessage() {}
+
+func (x *Content) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Content.ProtoReflect.Descriptor instead.
+func (*Content) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Content) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Content) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *Content) GetToolName() string {
+	if x != nil {
+		return x.ToolName
+	}
+	return ""
+}
+
+func (x *Content) GetToolInput() string {
+	if x != nil {
+		return x.ToolInput
+	}
+	return ""
+}
+
+func (x *Content) GetToolResult() string {
+	if x != nil {
+		return x.ToolResult
+	}
+	return ""
+}
+
+func (x *Content) GetCallToolId() string {
+	if x != nil {
+		return x.CallToolId
+	}
+	return ""
+}
+
+func (x *Content) GetCallToolFailed() bool {
+	if x != nil {
+		return x.CallToolFailed
+	}
+	return false
+}
+
+func (x *Content) GetSuspiciousPatterns() []string {
+	if x != nil {
+		return x.SuspiciousPatterns
+	}
+	return nil
+}
+
+func (x *Content) GetToolNote() string {
+	if x != nil {
+		return x.ToolNote
+	}
+	return ""
+}
+
+func (x *Content) GetStructured() bool {
+	if x != nil {
+		return x.Structured
+	}
+	return false
+}
+
+func (x *Content) GetSchemaViolations() []string {
+	if x != nil {
+		return x.SchemaViolations
+	}
+	return nil
+}
+
+type Message struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// One of "user" or "assistant".
+	Role      string                 `protobuf:"bytes,2,opt,name=role,proto3" json:"role,omitempty"`
+	Contents  []*Content             `protobuf:"bytes,3,rep,name=contents,proto3" json:"contents,omitempty"`
+	Timestamp *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// Latency statistics of the generation of an assistant message, unset if it didn't complete.
+	Stats *MessageStats `protobuf:"bytes,5,opt,name=stats,proto3" json:"stats,omitempty"`
+	// Reason the LLM gave for ending an assistant message: "stop", "length" for the maximum output tokens,
+	// "tool_use", "content_filter", "refusal", or the reason of the provider if it has no equivalent. Empty if
+	// the provider gave none.
+	FinishReason string `protobuf:"bytes,6,opt,name=finish_reason,json=finishReason,proto3" json:"finish_reason,omitempty"`
+	// Error that interrupted the generation of an assistant message after a part of its text, which can be
+	// resumed in the UI. Empty if it wasn't interrupted.
+	Interruption string `protobuf:"bytes,7,opt,name=interruption,proto3" json:"interruption,omitempty"`
+	// ID of the earlier message this one replies to in a thread of the chat, started in the UI. Empty for the
+	// messages of the main line, which the messages sent with the API are added to.
+	ParentId string `protobuf:"bytes,8,opt,name=parent_id,json=parentId,proto3" json:"parent_id,omitempty"`
+	// User who sent a user message. Empty for the assistant messages, and the messages sent before the senders
+	// were recorded.
+	UserId        string `protobuf:"bytes,9,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Message) Reset() {
+	*x = Message{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Message) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Message) ProtoMessage() {}
+
+func (x *Message) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Message.ProtoReflect.Descriptor instead.
+func (*Message) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Message) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Message) GetRole() string {
+	if x != nil {
+		return x.Role
+	}
+	return ""
+}
+
+func (x *Message) GetContents() []*Content {
+	if x != nil {
+		return x.Contents
+	}
+	return nil
+}
+
+func (x *Message) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *Message) GetStats() *MessageStats {
+	if x != nil {
+		return x.Stats
+	}
+	return nil
+}
+
+func (x *Message) GetFinishReason() string {
+	if x != nil {
+		return x.FinishReason
+	}
+	return ""
+}
+
+func (x *Message) GetInterruption() string {
+	if x != nil {
+		return x.Interruption
+	}
+	return ""
+}
+
+func (x *Message) GetParentId() string {
+	if x != nil {
+		return x.ParentId
+	}
+	return ""
+}
+
+func (x *Message) GetUserId() string {
+	if x != nil {
+		return x.UserId
+	}
+	return ""
+}
+
+type MessageStats struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	TimeToFirstTokenMs int32                  `protobuf:"varint,1,opt,name=time_to_first_token_ms,json=timeToFirstTokenMs,proto3" json:"time_to_first_token_ms,omitempty"`
+	// Estimated number of tokens of the generated text.
+	OutputTokens    int32   `protobuf:"varint,2,opt,name=output_tokens,json=outputTokens,proto3" json:"output_tokens,omitempty"`
+	TokensPerSecond float64 `protobuf:"fixed64,3,opt,name=tokens_per_second,json=tokensPerSecond,proto3" json:"tokens_per_second,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *MessageStats) Reset() {
+	*x = MessageStats{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MessageStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MessageStats) ProtoMessage() {}
+
+func (x *MessageStats) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MessageStats.ProtoReflect.Descriptor instead.
+func (*MessageStats) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *MessageStats) GetTimeToFirstTokenMs() int32 {
+	if x != nil {
+		return x.TimeToFirstTokenMs
+	}
+	return 0
+}
+
+func (x *MessageStats) GetOutputTokens() int32 {
+	if x != nil {
+		return x.OutputTokens
+	}
+	return 0
+}
+
+func (x *MessageStats) GetTokensPerSecond() float64 {
+	if x != nil {
+		return x.TokensPerSecond
+	}
+	return 0
+}
+
+type Tool struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Name        string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Description string                 `protobuf:"bytes,2,opt,name=description,proto3" json:"description,omitempty"`
+	// JSON schema of the tool input.
+	InputSchema   string `protobuf:"bytes,3,opt,name=input_schema,json=inputSchema,proto3" json:"input_schema,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Tool) Reset() {
+	*x = Tool{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Tool) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Tool) ProtoMessage() {}
+
+func (x *Tool) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Tool.ProtoReflect.Descriptor instead.
+func (*Tool) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Tool) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Tool) GetDescription() string {
+	if x != nil {
+		return x.Description
+	}
+	return ""
+}
+
+func (x *Tool) GetInputSchema() string {
+	if x != nil {
+		return x.InputSchema
+	}
+	return ""
+}
+
+type ListChatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListChatsRequest) Reset() {
+	*x = ListChatsRequest{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListChatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListChatsRequest) ProtoMessage() {}
+
+func (x *ListChatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListChatsRequest.ProtoReflect.Descriptor instead.
+func (*ListChatsRequest) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{5}
+}
+
+type ListChatsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Chats         []*Chat                `protobuf:"bytes,1,rep,name=chats,proto3" json:"chats,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListChatsResponse) Reset() {
+	*x = ListChatsResponse{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListChatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListChatsResponse) ProtoMessage() {}
+
+func (x *ListChatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListChatsResponse.ProtoReflect.Descriptor instead.
+func (*ListChatsResponse) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ListChatsResponse) GetChats() []*Chat {
+	if x != nil {
+		return x.Chats
+	}
+	return nil
+}
+
+type CreateChatRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The title is generated from the first message if it's empty.
+	Title string   `protobuf:"bytes,1,opt,name=title,proto3" json:"title,omitempty"`
+	Tags  []string `protobuf:"bytes,2,rep,name=tags,proto3" json:"tags,omitempty"`
+	// The system prompt replacing the configured one of the LLM in the chat, empty to keep it.
+	SystemPrompt  string `protobuf:"bytes,3,opt,name=system_prompt,json=systemPrompt,proto3" json:"system_prompt,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateChatRequest) Reset() {
+	*x = CreateChatRequest{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateChatRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateChatRequest) ProtoMessage() {}
+
+func (x *CreateChatRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateChatRequest.ProtoReflect.Descriptor instead.
+func (*CreateChatRequest) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *CreateChatRequest) GetTitle() string {
+	if x != nil {
+		return x.Title
+	}
+	return ""
+}
+
+func (x *CreateChatRequest) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *CreateChatRequest) GetSystemPrompt() string {
+	if x != nil {
+		return x.SystemPrompt
+	}
+	return ""
+}
+
+type ListMessagesRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	ChatId string                 `protobuf:"bytes,1,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	// Only the messages at or after since are returned, if it's set.
+	Since         *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=since,proto3" json:"since,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListMessagesRequest) Reset() {
+	*x = ListMessagesRequest{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListMessagesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListMessagesRequest) ProtoMessage() {}
+
+func (x *ListMessagesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListMessagesRequest.ProtoReflect.Descriptor instead.
+func (*ListMessagesRequest) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *ListMessagesRequest) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+func (x *ListMessagesRequest) GetSince() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Since
+	}
+	return nil
+}
+
+type ListMessagesResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Messages      []*Message             `protobuf:"bytes,1,rep,name=messages,proto3" json:"messages,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListMessagesResponse) Reset() {
+	*x = ListMessagesResponse{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListMessagesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListMessagesResponse) ProtoMessage() {}
+
+func (x *ListMessagesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListMessagesResponse.ProtoReflect.Descriptor instead.
+func (*ListMessagesResponse) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *ListMessagesResponse) GetMessages() []*Message {
+	if x != nil {
+		return x.Messages
+	}
+	return nil
+}
+
+type SendMessageRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	ChatId string                 `protobuf:"bytes,1,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	Text   string                 `protobuf:"bytes,2,opt,name=text,proto3" json:"text,omitempty"`
+	// JSON schema the response must follow, overriding the response schema of the chat for this message.
+	ResponseSchema string `protobuf:"bytes,3,opt,name=response_schema,json=responseSchema,proto3" json:"response_schema,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *SendMessageRequest) Reset() {
+	*x = SendMessageRequest{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SendMessageRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SendMessageRequest) ProtoMessage() {}
+
+func (x *SendMessageRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SendMessageRequest.ProtoReflect.Descriptor instead.
+func (*SendMessageRequest) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *SendMessageRequest) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+func (x *SendMessageRequest) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *SendMessageRequest) GetResponseSchema() string {
+	if x != nil {
+		return x.ResponseSchema
+	}
+	return ""
+}
+
+type SendMessageResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Response:
+	//
+	//	*SendMessageResponse_Chunk
+	//	*SendMessageResponse_Message
+	//	*SendMessageResponse_Error
+	Response      isSendMessageResponse_Response `protobuf_oneof:"response"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SendMessageResponse) Reset() {
+	*x = SendMessageResponse{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SendMessageResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SendMessageResponse) ProtoMessage() {}
+
+func (x *SendMessageResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SendMessageResponse.ProtoReflect.Descriptor instead.
+func (*SendMessageResponse) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *SendMessageResponse) GetResponse() isSendMessageResponse_Response {
+	if x != nil {
+		return x.Response
+	}
+	return nil
+}
+
+func (x *SendMessageResponse) GetChunk() *Content {
+	if x != nil {
+		if x, ok := x.Response.(*SendMessageResponse_Chunk); ok {
+			return x.Chunk
+		}
+	}
+	return nil
+}
+
+func (x *SendMessageResponse) GetMessage() *Message {
+	if x != nil {
+		if x, ok := x.Response.(*SendMessageResponse_Message); ok {
+			return x.Message
+		}
+	}
+	return nil
+}
+
+func (x *SendMessageResponse) GetError() string {
+	if x != nil {
+		if x, ok := x.Response.(*SendMessageResponse_Error); ok {
+			return x.Error
+		}
+	}
+	return ""
+}
+
+type isSendMessageResponse_Response interface {
+	isSendMessageResponse_Response()
+}
+
+type SendMessageResponse_Chunk struct {
+	// A chunk of the assistant response. Consecutive text chunks are parts of the same text content.
+	Chunk *Content `protobuf:"bytes,1,opt,name=chunk,proto3,oneof"`
+}
+
+type SendMessageResponse_Message struct {
+	// The complete assistant message, sent once the generation is finished.
+	Message *Message `protobuf:"bytes,2,opt,name=message,proto3,oneof"`
+}
+
+type SendMessageResponse_Error struct {
+	// The error that aborted the generation.
+	Error string `protobuf:"bytes,3,opt,name=error,proto3,oneof"`
+}
+
+func (*SendMessageResponse_Chunk) isSendMessageResponse_Response() {}
+
+func (*SendMessageResponse_Message) isSendMessageResponse_Response() {}
+
+func (*SendMessageResponse_Error) isSendMessageResponse_Response() {}
+
+type ListToolsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListToolsRequest) Reset() {
+	*x = ListToolsRequest{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListToolsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListToolsRequest) ProtoMessage() {}
+
+func (x *ListToolsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListToolsRequest.ProtoReflect.Descriptor instead.
+func (*ListToolsRequest) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{12}
+}
+
+type ListToolsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Tools         []*Tool                `protobuf:"bytes,1,rep,name=tools,proto3" json:"tools,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListToolsResponse) Reset() {
+	*x = ListToolsResponse{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListToolsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListToolsResponse) ProtoMessage() {}
+
+func (x *ListToolsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListToolsResponse.ProtoReflect.Descriptor instead.
+func (*ListToolsResponse) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *ListToolsResponse) GetTools() []*Tool {
+	if x != nil {
+		return x.Tools
+	}
+	return nil
+}
+
+type Batch struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Id        string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name      string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Template  string                 `protobuf:"bytes,3,opt,name=template,proto3" json:"template,omitempty"`
+	Columns   []string               `protobuf:"bytes,4,rep,name=columns,proto3" json:"columns,omitempty"`
+	CreatedAt *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	// Whether all the rows are done or failed.
+	Finished      bool        `protobuf:"varint,6,opt,name=finished,proto3" json:"finished,omitempty"`
+	Rows          []*BatchRow `protobuf:"bytes,7,rep,name=rows,proto3" json:"rows,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Batch) Reset() {
+	*x = Batch{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Batch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Batch) ProtoMessage() {}
+
+func (x *Batch) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Batch.ProtoReflect.Descriptor instead.
+func (*Batch) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *Batch) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Batch) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Batch) GetTemplate() string {
+	if x != nil {
+		return x.Template
+	}
+	return ""
+}
+
+func (x *Batch) GetColumns() []string {
+	if x != nil {
+		return x.Columns
+	}
+	return nil
+}
+
+func (x *Batch) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *Batch) GetFinished() bool {
+	if x != nil {
+		return x.Finished
+	}
+	return false
+}
+
+func (x *Batch) GetRows() []*BatchRow {
+	if x != nil {
+		return x.Rows
+	}
+	return nil
+}
+
+type BatchRow struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Position of the row in the batch, from 1.
+	Row    int32             `protobuf:"varint,1,opt,name=row,proto3" json:"row,omitempty"`
+	Inputs map[string]string `protobuf:"bytes,2,rep,name=inputs,proto3" json:"inputs,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Prompt string            `protobuf:"bytes,3,opt,name=prompt,proto3" json:"prompt,omitempty"`
+	// One of "queued", "running", "done" or "failed".
+	Status string `protobuf:"bytes,4,opt,name=status,proto3" json:"status,omitempty"`
+	// Final text of the response, after the tool calls.
+	Output        string `protobuf:"bytes,5,opt,name=output,proto3" json:"output,omitempty"`
+	Error         string `protobuf:"bytes,6,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchRow) Reset() {
+	*x = BatchRow{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchRow) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchRow) ProtoMessage() {}
+
+func (x *BatchRow) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchRow.ProtoReflect.Descriptor instead.
+func (*BatchRow) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *BatchRow) GetRow() int32 {
+	if x != nil {
+		return x.Row
+	}
+	return 0
+}
+
+func (x *BatchRow) GetInputs() map[string]string {
+	if x != nil {
+		return x.Inputs
+	}
+	return nil
+}
+
+func (x *BatchRow) GetPrompt() string {
+	if x != nil {
+		return x.Prompt
+	}
+	return ""
+}
+
+func (x *BatchRow) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *BatchRow) GetOutput() string {
+	if x != nil {
+		return x.Output
+	}
+	return ""
+}
+
+func (x *BatchRow) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type BatchInput struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Values of the input, keyed by their column.
+	Values        map[string]string `protobuf:"bytes,1,rep,name=values,proto3" json:"values,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchInput) Reset() {
+	*x = BatchInput{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchInput) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchInput) ProtoMessage() {}
+
+func (x *BatchInput) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchInput.ProtoReflect.Descriptor instead.
+func (*BatchInput) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *BatchInput) GetValues() map[string]string {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+type CreateBatchRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The name is generated from the creation time if it's empty.
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// Prompt template, with the {{column}} placeholders filled by the values of the inputs.
+	Template      string        `protobuf:"bytes,2,opt,name=template,proto3" json:"template,omitempty"`
+	Inputs        []*BatchInput `protobuf:"bytes,3,rep,name=inputs,proto3" json:"inputs,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateBatchRequest) Reset() {
+	*x = CreateBatchRequest{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateBatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateBatchRequest) ProtoMessage() {}
+
+func (x *CreateBatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateBatchRequest.ProtoReflect.Descriptor instead.
+func (*CreateBatchRequest) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *CreateBatchRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *CreateBatchRequest) GetTemplate() string {
+	if x != nil {
+		return x.Template
+	}
+	return ""
+}
+
+func (x *CreateBatchRequest) GetInputs() []*BatchInput {
+	if x != nil {
+		return x.Inputs
+	}
+	return nil
+}
+
+type GetBatchRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	BatchId       string                 `protobuf:"bytes,1,opt,name=batch_id,json=batchId,proto3" json:"batch_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetBatchRequest) Reset() {
+	*x = GetBatchRequest{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetBatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetBatchRequest) ProtoMessage() {}
+
+func (x *GetBatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetBatchRequest.ProtoReflect.Descriptor instead.
+func (*GetBatchRequest) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *GetBatchRequest) GetBatchId() string {
+	if x != nil {
+		return x.BatchId
+	}
+	return ""
+}
+
+type CaptureContentRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// URL of the page, fetched by the server if text is empty.
+	Url string `protobuf:"bytes,1,opt,name=url,proto3" json:"url,omitempty"`
+	// Text selected in the page.
+	Text string `protobuf:"bytes,2,opt,name=text,proto3" json:"text,omitempty"`
+	// Title of the new chat, the title of the fetched page if it's empty.
+	Title string `protobuf:"bytes,3,opt,name=title,proto3" json:"title,omitempty"`
+	// Question about the content, the content is summarized if it's empty.
+	Prompt string `protobuf:"bytes,4,opt,name=prompt,proto3" json:"prompt,omitempty"`
+	// Chat the content is appended to, a new chat is started if it's empty.
+	ChatId        string `protobuf:"bytes,5,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CaptureContentRequest) Reset() {
+	*x = CaptureContentRequest{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CaptureContentRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CaptureContentRequest) ProtoMessage() {}
+
+func (x *CaptureContentRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CaptureContentRequest.ProtoReflect.Descriptor instead.
+func (*CaptureContentRequest) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *CaptureContentRequest) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+func (x *CaptureContentRequest) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *CaptureContentRequest) GetTitle() string {
+	if x != nil {
+		return x.Title
+	}
+	return ""
+}
+
+func (x *CaptureContentRequest) GetPrompt() string {
+	if x != nil {
+		return x.Prompt
+	}
+	return ""
+}
+
+func (x *CaptureContentRequest) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+type CaptureContentResponse struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	ChatId string                 `protobuf:"bytes,1,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	// ID of the user message holding the captured content.
+	MessageId string `protobuf:"bytes,2,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	// ID of the assistant message being generated.
+	ResponseId    string `protobuf:"bytes,3,opt,name=response_id,json=responseId,proto3" json:"response_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CaptureContentResponse) Reset() {
+	*x = CaptureContentResponse{}
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CaptureContentResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CaptureContentResponse) ProtoMessage() {}
+
+func (x *CaptureContentResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_mcpwebui_v1_chat_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CaptureContentResponse.ProtoReflect.Descriptor instead.
+func (*CaptureContentResponse) Descriptor() ([]byte, []int) {
+	return file_mcpwebui_v1_chat_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *CaptureContentResponse) GetChatId() string {
+	if x != nil {
+		return x.ChatId
+	}
+	return ""
+}
+
+func (x *CaptureContentResponse) GetMessageId() string {
+	if x != nil {
+		return x.MessageId
+	}
+	return ""
+}
+
+func (x *CaptureContentResponse) GetResponseId() string {
+	if x != nil {
+		return x.ResponseId
+	}
+	return ""
+}
+
+var File_mcpwebui_v1_chat_proto protoreflect.FileDescriptor
+
+const file_mcpwebui_v1_chat_proto_rawDesc = "" +
+	"\n" +
+	"\x16mcpwebui/v1/chat.proto\x12\vmcpwebui.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\x9b\x01\n" +
+	"\x04Chat\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x14\n" +
+	"\x05title\x18\x02 \x01(\tR\x05title\x12\x1a\n" +
+	"\blanguage\x18\x03 \x01(\tR\blanguage\x12\x18\n" +
+	"\amembers\x18\x04 \x03(\tR\amembers\x12\x12\n" +
+	"\x04tags\x18\x05 \x03(\tR\x04tags\x12#\n" +
+	"\rsystem_prompt\x18\x06 \x01(\tR\fsystemPrompt\"\xf5\x02\n" +
+	"\aContent\x12\x12\n" +
+	"\x04type\x18\x01 \x01(\tR\x04type\x12\x12\n" +
+	"\x04text\x18\x02 \x01(\tR\x04text\x12\x1b\n" +
+	"\ttool_name\x18\x03 \x01(\tR\btoolName\x12\x1d\n" +
+	"\n" +
+	"tool_input\x18\x04 \x01(\tR\ttoolInput\x12\x1f\n" +
+	"\vtool_result\x18\x05 \x01(\tR\n" +
+	"toolResult\x12 \n" +
+	"\fcall_tool_id\x18\x06 \x01(\tR\n" +
+	"callToolId\x12(\n" +
+	"\x10call_tool_failed\x18\a \x01(\bR\x0ecallToolFailed\x12/\n" +
+	"\x13suspicious_patterns\x18\b \x03(\tR\x12suspiciousPatterns\x12\x1b\n" +
+	"\ttool_note\x18\t \x01(\tR\btoolNote\x12\x1e\n" +
+	"\n" +
+	"structured\x18\n" +
+	" \x01(\bR\n" +
+	"structured\x12+\n" +
+	"\x11schema_violations\x18\v \x03(\tR\x10schemaViolations\"\xc9\x02\n" +
+	"\aMessage\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
+	"\x04role\x18\x02 \x01(\tR\x04role\x120\n" +
+	"\bcontents\x18\x03 \x03(\v2\x14.mcpwebui.v1.ContentR\bcontents\x128\n" +
+	"\ttimestamp\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12/\n" +
+	"\x05stats\x18\x05 \x01(\v2\x19.mcpwebui.v1.MessageStatsR\x05stats\x12#\n" +
+	"\rfinish_reason\x18\x06 \x01(\tR\ffinishReason\x12\"\n" +
+	"\finterruption\x18\a \x01(\tR\finterruption\x12\x1b\n" +
+	"\tparent_id\x18\b \x01(\tR\bparentId\x12\x17\n" +
+	"\auser_id\x18\t \x01(\tR\x06userId\"\x93\x01\n" +
+	"\fMessageStats\x122\n" +
+	"\x16time_to_first_token_ms\x18\x01 \x01(\x05R\x12timeToFirstTokenMs\x12#\n" +
+	"\routput_tokens\x18\x02 \x01(\x05R\foutputTokens\x12*\n" +
+	"\x11tokens_per_second\x18\x03 \x01(\x01R\x0ftokensPerSecond\"_\n" +
+	"\x04Tool\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12 \n" +
+	"\vdescription\x18\x02 \x01(\tR\vdescription\x12!\n" +
+	"\finput_schema\x18\x03 \x01(\tR\vinputSchema\"\x12\n" +
+	"\x10ListChatsRequest\"<\n" +
+	"\x11ListChatsResponse\x12'\n" +
+	"\x05chats\x18\x01 \x03(\v2\x11.mcpwebui.v1.ChatR\x05chats\"b\n" +
+	"\x11CreateChatRequest\x12\x14\n" +
+	"\x05title\x18\x01 \x01(\tR\x05title\x12\x12\n" +
+	"\x04tags\x18\x02 \x03(\tR\x04tags\x12#\n" +
+	"\rsystem_prompt\x18\x03 \x01(\tR\fsystemPrompt\"`\n" +
+	"\x13ListMessagesRequest\x12\x17\n" +
+	"\achat_id\x18\x01 \x01(\tR\x06chatId\x120\n" +
+	"\x05since\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\x05since\"H\n" +
+	"\x14ListMessagesResponse\x120\n" +
+	"\bmessages\x18\x01 \x03(\v2\x14.mcpwebui.v1.MessageR\bmessages\"j\n" +
+	"\x12SendMessageRequest\x12\x17\n" +
+	"\achat_id\x18\x01 \x01(\tR\x06chatId\x12\x12\n" +
+	"\x04text\x18\x02 \x01(\tR\x04text\x12'\n" +
+	"\x0fresponse_schema\x18\x03 \x01(\tR\x0eresponseSchema\"\x99\x01\n" +
+	"\x13SendMessageResponse\x12,\n" +
+	"\x05chunk\x18\x01 \x01(\v2\x14.mcpwebui.v1.ContentH\x00R\x05chunk\x120\n" +
+	"\amessage\x18\x02 \x01(\v2\x14.mcpwebui.v1.MessageH\x00R\amessage\x12\x16\n" +
+	"\x05error\x18\x03 \x01(\tH\x00R\x05errorB\n" +
+	"\n" +
+	"\bresponse\"\x12\n" +
+	"\x10ListToolsRequest\"<\n" +
+	"\x11ListToolsResponse\x12'\n" +
+	"\x05tools\x18\x01 \x03(\v2\x11.mcpwebui.v1.ToolR\x05tools\"\xe3\x01\n" +
+	"\x05Batch\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12\x1a\n" +
+	"\btemplate\x18\x03 \x01(\tR\btemplate\x12\x18\n" +
+	"\acolumns\x18\x04 \x03(\tR\acolumns\x129\n" +
+	"\n" +
+	"created_at\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x12\x1a\n" +
+	"\bfinished\x18\x06 \x01(\bR\bfinished\x12)\n" +
+	"\x04rows\x18\a \x03(\v2\x15.mcpwebui.v1.BatchRowR\x04rows\"\xf0\x01\n" +
+	"\bBatchRow\x12\x10\n" +
+	"\x03row\x18\x01 \x01(\x05R\x03row\x129\n" +
+	"\x06inputs\x18\x02 \x03(\v2!.mcpwebui.v1.BatchRow.InputsEntryR\x06inputs\x12\x16\n" +
+	"\x06prompt\x18\x03 \x01(\tR\x06prompt\x12\x16\n" +
+	"\x06status\x18\x04 \x01(\tR\x06status\x12\x16\n" +
+	"\x06output\x18\x05 \x01(\tR\x06output\x12\x14\n" +
+	"\x05error\x18\x06 \x01(\tR\x05error\x1a9\n" +
+	"\vInputsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x84\x01\n" +
+	"\n" +
+	"BatchInput\x12;\n" +
+	"\x06values\x18\x01 \x03(\v2#.mcpwebui.v1.BatchInput.ValuesEntryR\x06values\x1a9\n" +
+	"\vValuesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"u\n" +
+	"\x12CreateBatchRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x1a\n" +
+	"\btemplate\x18\x02 \x01(\tR\btemplate\x12/\n" +
+	"\x06inputs\x18\x03 \x03(\v2\x17.mcpwebui.v1.BatchInputR\x06inputs\",\n" +
+	"\x0fGetBatchRequest\x12\x19\n" +
+	"\bbatch_id\x18\x01 \x01(\tR\abatchId\"\x84\x01\n" +
+	"\x15CaptureContentRequest\x12\x10\n" +
+	"\x03url\x18\x01 \x01(\tR\x03url\x12\x12\n" +
+	"\x04text\x18\x02 \x01(\tR\x04text\x12\x14\n" +
+	"\x05title\x18\x03 \x01(\tR\x05title\x12\x16\n" +
+	"\x06prompt\x18\x04 \x01(\tR\x06prompt\x12\x17\n" +
+	"\achat_id\x18\x05 \x01(\tR\x06chatId\"q\n" +
+	"\x16CaptureContentResponse\x12\x17\n" +
+	"\achat_id\x18\x01 \x01(\tR\x06chatId\x12\x1d\n" +
+	"\n" +
+	"message_id\x18\x02 \x01(\tR\tmessageId\x12\x1f\n" +
+	"\vresponse_id\x18\x03 \x01(\tR\n" +
+	"responseId2\xec\x04\n" +
+	"\vChatService\x12J\n" +
+	"\tListChats\x12\x1d.mcpwebui.v1.ListChatsRequest\x1a\x1e.mcpwebui.v1.ListChatsResponse\x12?\n" +
+	"\n" +
+	"CreateChat\x12\x1e.mcpwebui.v1.CreateChatRequest\x1a\x11.mcpwebui.v1.Chat\x12S\n" +
+	"\fListMessages\x12 .mcpwebui.v1.ListMessagesRequest\x1a!.mcpwebui.v1.ListMessagesResponse\x12R\n" +
+	"\vSendMessage\x12\x1f.mcpwebui.v1.SendMessageRequest\x1a .mcpwebui.v1.SendMessageResponse0\x01\x12J\n" +
+	"\tListTools\x12\x1d.mcpwebui.v1.ListToolsRequest\x1a\x1e.mcpwebui.v1.ListToolsResponse\x12B\n" +
+	"\vCreateBatch\x12\x1f.mcpwebui.v1.CreateBatchRequest\x1a\x12.mcpwebui.v1.Batch\x12<\n" +
+	"\bGetBatch\x12\x1c.mcpwebui.v1.GetBatchRequest\x1a\x12.mcpwebui.v1.Batch\x12Y\n" +
+	"\x0eCaptureContent\x12\".mcpwebui.v1.CaptureContentRequest\x1a#.mcpwebui.v1.CaptureContentResponseBEZCgithub.com/MegaGrindStone/mcp-web-ui/api/gen/mcpwebui/v1;mcpwebuiv1b\x06proto3"
+
+var (
+	file_mcpwebui_v1_chat_proto_rawDescOnce sync.Once
+	file_mcpwebui_v1_chat_proto_rawDescData []byte
+)
+
+func file_mcpwebui_v1_chat_proto_rawDescGZIP() []byte {
+	file_mcpwebui_v1_chat_proto_rawDescOnce.Do(func() {
+		file_mcpwebui_v1_chat_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_mcpwebui_v1_chat_proto_rawDesc), len(file_mcpwebui_v1_chat_proto_rawDesc)))
+	})
+	return file_mcpwebui_v1_chat_proto_rawDescData
+}
+
+var file_mcpwebui_v1_chat_proto_msgTypes = make([]protoimpl.MessageInfo, 23)
+var file_mcpwebui_v1_chat_proto_goTypes = []any{
+	(*Chat)(nil),                   // 0: mcpwebui.v1.Chat
+	(*Content)(nil),                // 1: mcpwebui.v1.Content
+	(*Message)(nil),                // 2: mcpwebui.v1.Message
+	(*MessageStats)(nil),           // 3: mcpwebui.v1.MessageStats
+	(*Tool)(nil),                   // 4: mcpwebui.v1.Tool
+	(*ListChatsRequest)(nil),       // 5: mcpwebui.v1.ListChatsRequest
+	(*ListChatsResponse)(nil),      // 6: mcpwebui.v1.ListChatsResponse
+	(*CreateChatRequest)(nil),      // 7: mcpwebui.v1.CreateChatRequest
+	(*ListMessagesRequest)(nil),    // 8: mcpwebui.v1.ListMessagesRequest
+	(*ListMessagesResponse)(nil),   // 9: mcpwebui.v1.ListMessagesResponse
+	(*SendMessageRequest)(nil),     // 10: mcpwebui.v1.SendMessageRequest
+	(*SendMessageResponse)(nil),    // 11: mcpwebui.v1.SendMessageResponse
+	(*ListToolsRequest)(nil),       // 12: mcpwebui.v1.ListToolsRequest
+	(*ListToolsResponse)(nil),      // 13: mcpwebui.v1.ListToolsResponse
+	(*Batch)(nil),                  // 14: mcpwebui.v1.Batch
+	(*BatchRow)(nil),               // 15: mcpwebui.v1.BatchRow
+	(*BatchInput)(nil),             // 16: mcpwebui.v1.BatchInput
+	(*CreateBatchRequest)(nil),     // 17: mcpwebui.v1.CreateBatchRequest
+	(*GetBatchRequest)(nil),        // 18: mcpwebui.v1.GetBatchRequest
+	(*CaptureContentRequest)(nil),  // 19: mcpwebui.v1.CaptureContentRequest
+	(*CaptureContentResponse)(nil), // 20: mcpwebui.v1.CaptureContentResponse
+	nil,                            // 21: mcpwebui.v1.BatchRow.InputsEntry
+	nil,                            // 22: mcpwebui.v1.BatchInput.ValuesEntry
+	(*timestamppb.Timestamp)(nil),  // 23: google.protobuf.Timestamp
+}
+var file_mcpwebui_v1_chat_proto_depIdxs = []int32{
+	1,  // 0: mcpwebui.v1.Message.contents:type_name -> mcpwebui.v1.Content
+	23, // 1: mcpwebui.v1.Message.timestamp:type_name -> google.protobuf.Timestamp
+	3,  // 2: mcpwebui.v1.Message.stats:type_name -> mcpwebui.v1.MessageStats
+	0,  // 3: mcpwebui.v1.ListChatsResponse.chats:type_name -> mcpwebui.v1.Chat
+	23, // 4: mcpwebui.v1.ListMessagesRequest.since:type_name -> google.protobuf.Timestamp
+	2,  // 5: mcpwebui.v1.ListMessagesResponse.messages:type_name -> mcpwebui.v1.Message
+	1,  // 6: mcpwebui.v1.SendMessageResponse.chunk:type_name -> mcpwebui.v1.Content
+	2,  // 7: mcpwebui.v1.SendMessageResponse.message:type_name -> mcpwebui.v1.Message
+	4,  // 8: mcpwebui.v1.ListToolsResponse.tools:type_name -> mcpwebui.v1.Tool
+	23, // 9: mcpwebui.v1.Batch.created_at:type_name -> google.protobuf.Timestamp
+	15, // 10: mcpwebui.v1.Batch.rows:type_name -> mcpwebui.v1.BatchRow
+	21, // 11: mcpwebui.v1.BatchRow.inputs:type_name -> mcpwebui.v1.BatchRow.InputsEntry
+	22, // 12: mcpwebui.v1.BatchInput.values:type_name -> mcpwebui.v1.BatchInput.ValuesEntry
+	16, // 13: mcpwebui.v1.CreateBatchRequest.inputs:type_name -> mcpwebui.v1.BatchInput
+	5,  // 14: mcpwebui.v1.ChatService.ListChats:input_type -> mcpwebui.v1.ListChatsRequest
+	7,  // 15: mcpwebui.v1.ChatService.CreateChat:input_type -> mcpwebui.v1.CreateChatRequest
+	8,  // 16: mcpwebui.v1.ChatService.ListMessages:input_type -> mcpwebui.v1.ListMessagesRequest
+	10, // 17: mcpwebui.v1.ChatService.SendMessage:input_type -> mcpwebui.v1.SendMessageRequest
+	12, // 18: mcpwebui.v1.ChatService.ListTools:input_type -> mcpwebui.v1.ListToolsRequest
+	17, // 19: mcpwebui.v1.ChatService.CreateBatch:input_type -> mcpwebui.v1.CreateBatchRequest
+	18, // 20: mcpwebui.v1.ChatService.GetBatch:input_type -> mcpwebui.v1.GetBatchRequest
+	19, // 21: mcpwebui.v1.ChatService.CaptureContent:input_type -> mcpwebui.v1.CaptureContentRequest
+	6,  // 22: mcpwebui.v1.ChatService.ListChats:output_type -> mcpwebui.v1.ListChatsResponse
+	0,  // 23: mcpwebui.v1.ChatService.CreateChat:output_type -> mcpwebui.v1.Chat
+	9,  // 24: mcpwebui.v1.ChatService.ListMessages:output_type -> mcpwebui.v1.ListMessagesResponse
+	11, // 25: mcpwebui.v1.ChatService.SendMessage:output_type -> mcpwebui.v1.SendMessageResponse
+	13, // 26: mcpwebui.v1.ChatService.ListTools:output_type -> mcpwebui.v1.ListToolsResponse
+	14, // 27: mcpwebui.v1.ChatService.CreateBatch:output_type -> mcpwebui.v1.Batch
+	14, // 28: mcpwebui.v1.ChatService.GetBatch:output_type -> mcpwebui.v1.Batch
+	20, // 29: mcpwebui.v1.ChatService.CaptureContent:output_type -> mcpwebui.v1.CaptureContentResponse
+	22, // [22:30] is the sub-list for method output_type
+	14, // [14:22] is the sub-list for method input_type
+	14, // [14:14] is the sub-list for extension type_name
+	14, // [14:14] is the sub-list for extension extendee
+	0,  // [0:14] is the sub-list for field type_name
+}
+
+func init() { file_mcpwebui_v1_chat_proto_init() }
+func file_mcpwebui_v1_chat_proto_init() {
+	if File_mcpwebui_v1_chat_proto != nil {
+		return
+	}
+	file_mcpwebui_v1_chat_proto_msgTypes[11].OneofWrappers = []any{
+		(*SendMessageResponse_Chunk)(nil),
+		(*SendMessageResponse_Message)(nil),
+		(*SendMessageResponse_Error)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_mcpwebui_v1_chat_proto_rawDesc), len(file_mcpwebui_v1_chat_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   23,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_mcpwebui_v1_chat_proto_goTypes,
+		DependencyIndexes: file_mcpwebui_v1_chat_proto_depIdxs,
+		MessageInfos:      file_mcpwebui_v1_chat_proto_msgTypes,
+	}.Build()
+	File_mcpwebui_v1_chat_proto = out.File
+	file_mcpwebui_v1_chat_proto_goTypes = nil
+	file_mcpwebui_v1_chat_proto_depIdxs = nil
+}
@@ -0,0 +1,5 @@
+// Package api holds the protocol buffers definitions of the chat API, with their Go code generated in gen by
+// protoc, protoc-gen-go and protoc-gen-go-grpc.
+package api
+
+//go:generate protoc -I proto --go_out=gen --go_opt=paths=source_relative --go-grpc_out=gen --go-grpc_opt=paths=source_relative mcpwebui/v1/chat.proto
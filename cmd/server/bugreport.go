@@ -0,0 +1,286 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	mcpwebui "github.com/MegaGrindStone/mcp-web-ui"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/handlers"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/services"
+)
+
+// bugReport captures a run of the server for a bug report: the requests sent to the LLM providers and their
+// responses are recorded by a cassette, and the messages exchanged with the MCP servers by a traffic
+// inspector. On shutdown, they're written to a zip file with the transcripts of the chats updated during the
+// run and the version info, the secrets of the config being redacted.
+type bugReport struct {
+	path        string
+	cassetteDir string
+	startedAt   time.Time
+}
+
+// bugReportInfo is the version info of a bug report.
+type bugReportInfo struct {
+	Version    string    `json:"version"`
+	Revision   string    `json:"revision,omitempty"`
+	GoVersion  string    `json:"goVersion"`
+	Platform   string    `json:"platform"`
+	LLM        string    `json:"llm"`
+	CompareLLM string    `json:"compareLLM,omitempty"`
+	MCPServers []string  `json:"mcpServers"`
+	StartedAt  time.Time `json:"startedAt"`
+	EndedAt    time.Time `json:"endedAt"`
+}
+
+// bugReportChat is the transcript of a chat in a bug report, without the users of the chat and its messages.
+type bugReportChat struct {
+	ID       string           `json:"id"`
+	Title    string           `json:"title"`
+	Messages []models.Message `json:"messages"`
+}
+
+const (
+	redactedSecret = "[REDACTED]"
+	// minSecretLength is the length of the shortest value redacted, so the short values of the secret
+	// fields, like placeholders, don't redact the other occurrences of their text.
+	minSecretLength = 8
+)
+
+// secretFieldSuffixes are the suffixes of the YAML names of the config fields holding secrets.
+var secretFieldSuffixes = []string{"key", "keyid", "secret", "token", "password"}
+
+// startBugReport starts the capture of a bug report written to path, or returns nil if path is empty.
+func startBugReport(path string) *bugReport {
+	if path == "" {
+		return nil
+	}
+	dir, err := os.MkdirTemp("", "mcpwebui-bug-report-")
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to create the directory of the bug report: %w", err))
+	}
+	return &bugReport{path: path, cassetteDir: dir, startedAt: time.Now()}
+}
+
+// providerOptions returns the options of the LLM providers recording their requests and responses, replacing
+// the cassette of the config.
+func (b *bugReport) providerOptions() ([]services.ProviderOption, error) {
+	cassette, err := services.NewCassette(b.cassetteDir, services.CassetteRecord, nil)
+	if err != nil {
+		return nil, err
+	}
+	return []services.ProviderOption{services.WithCassette(cassette)}, nil
+}
+
+// finish writes the bug report once the server is shut down, and exits if it fails.
+func (b *bugReport) finish(cfg config, opts mcpwebui.Options, mcpClients []*mcp.Client) {
+	if err := b.write(context.Background(), cfg, opts, mcpClients); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Bug report written to %s", b.path)
+}
+
+// write writes the bug report of the run of the server with opts and mcpClients, configured by cfg, and
+// removes the recordings of the providers.
+func (b *bugReport) write(ctx context.Context, cfg config, opts mcpwebui.Options, mcpClients []*mcp.Client) error {
+	defer os.RemoveAll(b.cassetteDir)
+
+	files := map[string][]byte{}
+	var err error
+	if files["version.json"], err = json.MarshalIndent(b.info(opts, mcpClients), "", "  "); err != nil {
+		return fmt.Errorf("failed to encode the version info: %w", err)
+	}
+	if files["transcript.json"], err = b.transcript(ctx, opts.Store); err != nil {
+		return err
+	}
+	if opts.TrafficInspector != nil {
+		var buf bytes.Buffer
+		if err := opts.TrafficInspector.WriteJSON(&buf); err != nil {
+			return fmt.Errorf("failed to encode the MCP traffic: %w", err)
+		}
+		files["mcp-traffic.json"] = buf.Bytes()
+	}
+	recordings, err := os.ReadDir(b.cassetteDir)
+	if err != nil {
+		return fmt.Errorf("failed to read the provider recordings: %w", err)
+	}
+	for _, entry := range recordings {
+		if files["providers/"+entry.Name()], err = os.ReadFile(filepath.Join(b.cassetteDir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to read the provider recordings: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(b.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create the bug report: %w", err)
+	}
+	defer f.Close()
+	secrets := configSecrets(reflect.ValueOf(cfg), "", envSecrets())
+	zw := zip.NewWriter(f)
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		w, err := zw.Create(name)
+		if err != nil {
+			return fmt.Errorf("failed to write the bug report: %w", err)
+		}
+		if _, err := w.Write(redactSecrets(files[name], secrets)); err != nil {
+			return fmt.Errorf("failed to write the bug report: %w", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to write the bug report: %w", err)
+	}
+	return f.Close()
+}
+
+// info returns the version info of the run of the server with opts and mcpClients.
+func (b *bugReport) info(opts mcpwebui.Options, mcpClients []*mcp.Client) bugReportInfo {
+	info := bugReportInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		LLM:       llmInfo(opts.LLM),
+		StartedAt: b.startedAt,
+		EndedAt:   time.Now(),
+	}
+	if opts.CompareLLM != nil {
+		info.CompareLLM = llmInfo(opts.CompareLLM)
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			if setting.Key == "vcs.revision" {
+				info.Revision = setting.Value
+			}
+		}
+	}
+	for _, cli := range mcpClients {
+		server := cli.ServerInfo()
+		info.MCPServers = append(info.MCPServers, strings.TrimSpace(server.Name+" "+server.Version))
+	}
+	return info
+}
+
+// transcript returns the transcripts of the chats of store with messages sent during the run, as JSON.
+func (b *bugReport) transcript(ctx context.Context, store mcpwebui.Store) ([]byte, error) {
+	chats, err := store.Chats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chats: %w", err)
+	}
+	transcript := []bugReportChat{}
+	for _, c := range chats {
+		messages, err := store.Messages(ctx, c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get messages of chat %s: %w", c.ID, err)
+		}
+		if !slices.ContainsFunc(messages, func(msg models.Message) bool { return !msg.Timestamp.Before(b.startedAt) }) {
+			continue
+		}
+		for i := range messages {
+			messages[i].UserID = ""
+		}
+		transcript = append(transcript, bugReportChat{ID: c.ID, Title: c.Title, Messages: messages})
+	}
+	data, err := json.MarshalIndent(transcript, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the transcript: %w", err)
+	}
+	return data, nil
+}
+
+// llmInfo describes llm by its type and its model.
+func llmInfo(llm handlers.LLM) string {
+	info := fmt.Sprintf("%T", llm)
+	if mn, ok := llm.(interface{ Model() string }); ok && mn.Model() != "" {
+		info += " " + mn.Model()
+	}
+	return info
+}
+
+// configSecrets appends to secrets the literal values of the secretValue fields of v, and the values of its
+// other fields whose YAML name, name for v itself, ends with one of the secretFieldSuffixes and of its headers
+// and env maps, which carry the credentials of the MCP servers. The secrets of the external secret stores
+// aren't fetched again.
+func configSecrets(v reflect.Value, name string, secrets []string) []string {
+	if s, ok := v.Interface().(secretValue); ok {
+		return appendSecret(secrets, s.Value)
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			secrets = configSecrets(v.Elem(), name, secrets)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			fieldName, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			secrets = configSecrets(v.Field(i), fieldName, secrets)
+		}
+	case reflect.Map:
+		secretValues := name == "headers" || name == "env"
+		for iter := v.MapRange(); iter.Next(); {
+			if secretValues && iter.Value().Kind() == reflect.String {
+				secrets = appendSecret(secrets, iter.Value().String())
+				continue
+			}
+			secrets = configSecrets(iter.Value(), "", secrets)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range v.Len() {
+			secrets = configSecrets(v.Index(i), name, secrets)
+		}
+	case reflect.String:
+		lower := strings.ToLower(name)
+		if slices.ContainsFunc(secretFieldSuffixes, func(suffix string) bool { return strings.HasSuffix(lower, suffix) }) {
+			secrets = appendSecret(secrets, v.String())
+		}
+	}
+	return secrets
+}
+
+// envSecrets returns the values of the environment variables whose name ends with one of the
+// secretFieldSuffixes, like ANTHROPIC_API_KEY, which the providers may read instead of the config.
+func envSecrets() []string {
+	var secrets []string
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		name = strings.ToLower(strings.ReplaceAll(name, "_", ""))
+		if slices.ContainsFunc(secretFieldSuffixes, func(suffix string) bool { return strings.HasSuffix(name, suffix) }) {
+			secrets = appendSecret(secrets, value)
+		}
+	}
+	return secrets
+}
+
+func appendSecret(secrets []string, secret string) []string {
+	if len(secret) < minSecretLength || slices.Contains(secrets, secret) {
+		return secrets
+	}
+	return append(secrets, secret)
+}
+
+// redactSecrets returns data with the occurrences of secrets replaced, the longest secrets first so the ones
+// containing others are redacted whole.
+func redactSecrets(data []byte, secrets []string) []byte {
+	secrets = slices.Clone(secrets)
+	slices.SortFunc(secrets, func(a, b string) int { return len(b) - len(a) })
+	for _, secret := range secrets {
+		data = bytes.ReplaceAll(data, []byte(secret), []byte(redactedSecret))
+	}
+	return data
+}
@@ -1,18 +1,33 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/MegaGrindStone/mcp-web-ui/internal/handlers"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/secrets"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/services"
 	"gopkg.in/yaml.v3"
 )
 
 type llmConfig interface {
-	llm(string, *slog.Logger) (handlers.LLM, error)
-	titleGen(string, *slog.Logger) (handlers.TitleGenerator, error)
+	llm(string, *slog.Logger, ...services.ProviderOption) (handlers.LLM, error)
+	titleGen(string, *slog.Logger, ...services.ProviderOption) (handlers.TitleGenerator, error)
+}
+
+// keyedLLMConfig is implemented by the configurations of the providers with an API key, which is rotated at
+// runtime.
+type keyedLLMConfig interface {
+	llmConfig
+	withAPIKey(apiKey string) llmConfig
 }
 
 // BaseLLMConfig contains the common fields for all LLM configurations.
@@ -20,18 +35,334 @@ type BaseLLMConfig struct {
 	Provider   string                 `yaml:"provider"`
 	Model      string                 `yaml:"model"`
 	Parameters services.LLMParameters `yaml:"parameters"`
+	HTTP       providerHTTPConfig     `yaml:"http"`
+	// SystemRole is the placement of the system prompt for the models refusing the system messages: system,
+	// developer or prepend-to-user. The Anthropic API takes the system prompt apart, ignoring it.
+	SystemRole string `yaml:"systemRole"`
+	// ToolEmulation emulates the tool calls for the models without native function calling, ignored by
+	// Anthropic.
+	ToolEmulation bool `yaml:"toolEmulation"`
+}
+
+type providerHTTPConfig struct {
+	Timeout               time.Duration `yaml:"timeout"`
+	ConnectTimeout        time.Duration `yaml:"connectTimeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"responseHeaderTimeout"`
+	ReadTimeout           time.Duration `yaml:"readTimeout"`
+	IdleConnTimeout       time.Duration `yaml:"idleConnTimeout"`
+	MaxIdleConnsPerHost   int           `yaml:"maxIdleConnsPerHost"`
+	ProxyURL              string        `yaml:"proxyURL"`
+	CAFile                string        `yaml:"caFile"`
 }
 
 type config struct {
 	Port                 string                          `yaml:"port"`
+	GRPCPort             string                          `yaml:"grpcPort"`
 	LogLevel             string                          `yaml:"logLevel"`
 	LogMode              string                          `yaml:"logMode"`
+	DevMode              bool                            `yaml:"devMode"`
+	DebugMode            bool                            `yaml:"debugMode"`
+	TemplatesDir         string                          `yaml:"templatesDir"`
+	StaticDir            string                          `yaml:"staticDir"`
+	DataDir              string                          `yaml:"dataDir"`
 	SystemPrompt         string                          `yaml:"systemPrompt"`
 	TitleGeneratorPrompt string                          `yaml:"titleGeneratorPrompt"`
 	LLM                  llmConfig                       `yaml:"llm"`
 	GenTitleLLM          llmConfig                       `yaml:"genTitleLLM"`
+	CompareLLM           llmConfig                       `yaml:"compareLLM"`
 	MCPSSEServers        map[string]mcpSSEServerConfig   `yaml:"mcpSSEServers"`
 	MCPStdIOServers      map[string]mcpStdIOServerConfig `yaml:"mcpStdIOServers"`
+	Auth                 authConfig                      `yaml:"auth"`
+	Security             securityConfig                  `yaml:"security"`
+	CORS                 corsConfig                      `yaml:"cors"`
+	SSE                  sseConfig                       `yaml:"sse"`
+	ToolResultGuard      toolResultGuardConfig           `yaml:"toolResultGuard"`
+	ToolFailureLimit     int                             `yaml:"toolFailureLimit"`
+	ToolCache            toolCacheConfig                 `yaml:"toolCache"`
+	ToolOverrides        map[string]toolOverrideConfig   `yaml:"toolOverrides"`
+	CapabilitiesCache    capabilitiesCacheConfig         `yaml:"capabilitiesCache"`
+	TrafficInspector     trafficInspectorConfig          `yaml:"trafficInspector"`
+	ServerInstructions   serverInstructionsConfig        `yaml:"serverInstructions"`
+	Memory               memoryConfig                    `yaml:"memory"`
+	ResponseLimit        responseLimitConfig             `yaml:"responseLimit"`
+	Batch                batchConfig                     `yaml:"batch"`
+	TitleGeneration      titleGenerationConfig           `yaml:"titleGeneration"`
+	Eval                 evalConfig                      `yaml:"eval"`
+	Pricing              pricingConfig                   `yaml:"pricing"`
+	Budgets              map[string]budgetConfig         `yaml:"budgets"`
+	Store                storeConfig                     `yaml:"store"`
+	Retention            retentionConfig                 `yaml:"retention"`
+	Maintenance          maintenanceConfig               `yaml:"maintenance"`
+	Backup               backupConfig                    `yaml:"backup"`
+	Quotas               quotasConfig                    `yaml:"quotas"`
+	Webhooks             []webhookConfig                 `yaml:"webhooks"`
+	Observability        observabilityConfig             `yaml:"observability"`
+	Cassette             cassetteConfig                  `yaml:"cassette"`
+	Egress               egressConfig                    `yaml:"egress"`
+	Capture              captureConfig                   `yaml:"capture"`
+	Bridges              bridgesConfig                   `yaml:"bridges"`
+	Welcome              welcomeConfig                   `yaml:"welcome"`
+	ChatListPageSize     int                             `yaml:"chatListPageSize"`
+	LLMMiddlewares       llmMiddlewaresConfig            `yaml:"llmMiddlewares"`
+	Schedules            []scheduleConfig                `yaml:"schedules"`
+}
+
+type webhookConfig struct {
+	URL        string   `yaml:"url"`
+	Events     []string `yaml:"events"`
+	Secret     string   `yaml:"secret"`
+	MaxRetries *int     `yaml:"maxRetries"`
+}
+
+type cassetteConfig struct {
+	Mode string `yaml:"mode"`
+	Dir  string `yaml:"dir"`
+}
+
+type egressConfig struct {
+	AllowedHosts []string `yaml:"allowedHosts"`
+	DenyPrivate  bool     `yaml:"denyPrivate"`
+}
+
+type captureConfig struct {
+	FetchPages   bool          `yaml:"fetchPages"`
+	AllowedHosts []string      `yaml:"allowedHosts"`
+	Timeout      time.Duration `yaml:"timeout"`
+	MaxBytes     int64         `yaml:"maxBytes"`
+	MaxChars     int           `yaml:"maxChars"`
+}
+
+type bridgesConfig struct {
+	Telegram *telegramBridgeConfig `yaml:"telegram"`
+}
+
+type telegramBridgeConfig struct {
+	Token        secretValue   `yaml:"token"`
+	AllowedUsers []string      `yaml:"allowedUsers"`
+	PollTimeout  time.Duration `yaml:"pollTimeout"`
+	APIURL       string        `yaml:"apiURL"`
+}
+
+type welcomeConfig struct {
+	Title       string                    `yaml:"title"`
+	Message     string                    `yaml:"message"`
+	Suggestions []welcomeSuggestionConfig `yaml:"suggestions"`
+	ShowTools   bool                      `yaml:"showTools"`
+}
+
+type welcomeSuggestionConfig struct {
+	Label  string   `yaml:"label"`
+	Prompt string   `yaml:"prompt"`
+	Tools  []string `yaml:"tools"`
+}
+
+type llmMiddlewaresConfig struct {
+	Logging         bool         `yaml:"logging"`
+	Retry           *retryConfig `yaml:"retry"`
+	TokenCounting   bool         `yaml:"tokenCounting"`
+	ProfanityFilter []string     `yaml:"profanityFilter"`
+	CurrentDate     bool         `yaml:"currentDate"`
+}
+
+type retryConfig struct {
+	MaxRetries int           `yaml:"maxRetries"`
+	Backoff    time.Duration `yaml:"backoff"`
+}
+
+type observabilityConfig struct {
+	Langfuse *langfuseConfig `yaml:"langfuse"`
+	OTLP     *otlpConfig     `yaml:"otlp"`
+}
+
+type langfuseConfig struct {
+	Host      string      `yaml:"host"`
+	PublicKey string      `yaml:"publicKey"`
+	SecretKey secretValue `yaml:"secretKey"`
+}
+
+type otlpConfig struct {
+	Endpoint string            `yaml:"endpoint"`
+	Headers  map[string]string `yaml:"headers"`
+}
+
+type scheduleConfig struct {
+	Name   string `yaml:"name"`
+	Cron   string `yaml:"cron"`
+	Prompt string `yaml:"prompt"`
+	Review bool   `yaml:"review"`
+}
+
+type authConfig struct {
+	UserHeader       string            `yaml:"userHeader"`
+	RequireAPITokens bool              `yaml:"requireAPITokens"`
+	Roles            map[string]string `yaml:"roles"`
+	DefaultRole      string            `yaml:"defaultRole"`
+	Sessions         sessionsConfig    `yaml:"sessions"`
+	Lockout          lockoutConfig     `yaml:"lockout"`
+	TrustedProxies   []string          `yaml:"trustedProxies"`
+}
+
+type lockoutConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	MaxFailures int           `yaml:"maxFailures"`
+	Window      time.Duration `yaml:"window"`
+	Duration    time.Duration `yaml:"duration"`
+}
+
+type sessionsConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+}
+
+type securityConfig struct {
+	ContentSecurityPolicy string `yaml:"contentSecurityPolicy"`
+	FrameOptions          string `yaml:"frameOptions"`
+	SecureCookies         bool   `yaml:"secureCookies"`
+	DisableCSRF           bool   `yaml:"disableCSRF"`
+}
+
+type corsConfig struct {
+	AllowedOrigins   []string      `yaml:"allowedOrigins"`
+	AllowedMethods   []string      `yaml:"allowedMethods"`
+	AllowedHeaders   []string      `yaml:"allowedHeaders"`
+	AllowCredentials bool          `yaml:"allowCredentials"`
+	MaxAge           time.Duration `yaml:"maxAge"`
+}
+
+type toolResultGuardConfig struct {
+	Enabled  bool     `yaml:"enabled"`
+	Patterns []string `yaml:"patterns"`
+}
+
+type storeConfig struct {
+	EncryptionKey secretValue       `yaml:"encryptionKey"`
+	Redis         *redisStoreConfig `yaml:"redis"`
+	Timeout       time.Duration     `yaml:"timeout"`
+}
+
+type redisStoreConfig struct {
+	URL       secretValue `yaml:"url"`
+	KeyPrefix string      `yaml:"keyPrefix"`
+}
+
+// secretValue is a secret given either literally, or as a reference to an external secret store with the
+// secretRef syntax:
+//
+//	apiKey:
+//	  secretRef: vault://secret/data/mcpwebui#anthropic
+type secretValue struct {
+	Value     string
+	SecretRef string
+}
+
+type sseConfig struct {
+	KeepAlive time.Duration `yaml:"keepAlive"`
+	Retry     time.Duration `yaml:"retry"`
+	Authorize bool          `yaml:"authorize"`
+}
+
+type toolCacheConfig struct {
+	Tools []string      `yaml:"tools"`
+	TTL   time.Duration `yaml:"ttl"`
+}
+
+type toolOverrideConfig struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+}
+
+type capabilitiesCacheConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	MaxAge  time.Duration `yaml:"maxAge"`
+}
+
+type trafficInspectorConfig struct {
+	Enabled  bool `yaml:"enabled"`
+	Capacity int  `yaml:"capacity"`
+}
+
+type serverInstructionsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Servers are the names of the MCP servers whose instructions are appended to the system prompt, every
+	// server if it's empty.
+	Servers []string `yaml:"servers"`
+}
+
+type memoryConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+type responseLimitConfig struct {
+	Tokens int `yaml:"tokens"`
+}
+
+type batchConfig struct {
+	Concurrency int `yaml:"concurrency"`
+	MaxRows     int `yaml:"maxRows"`
+}
+
+type titleGenerationConfig struct {
+	Concurrency int    `yaml:"concurrency"`
+	QueueSize   int    `yaml:"queueSize"`
+	Language    string `yaml:"language"`
+	// Privacy keeps the messages from the cloud title models: local requires a local genTitleLLM, and
+	// heuristic derives the titles from the first Words words of the messages, without a model.
+	Privacy      string        `yaml:"privacy"`
+	Words        int           `yaml:"words"`
+	RetryBackoff time.Duration `yaml:"retryBackoff"`
+}
+
+type evalConfig struct {
+	Suite string `yaml:"suite"`
+}
+
+type pricingConfig struct {
+	InputPerMillionTokens float64 `yaml:"inputPerMillionTokens"`
+}
+
+type budgetConfig struct {
+	InputPerMillionTokens  float64   `yaml:"inputPerMillionTokens"`
+	OutputPerMillionTokens float64   `yaml:"outputPerMillionTokens"`
+	Daily                  float64   `yaml:"daily"`
+	Monthly                float64   `yaml:"monthly"`
+	Thresholds             []float64 `yaml:"thresholds"`
+	HardStop               bool      `yaml:"hardStop"`
+}
+
+type retentionConfig struct {
+	RetainDays int    `yaml:"retainDays"`
+	MaxChats   int    `yaml:"maxChats"`
+	ArchiveDir string `yaml:"archiveDir"`
+}
+
+type maintenanceConfig struct {
+	Cron string `yaml:"cron"`
+}
+
+type backupConfig struct {
+	Cron string          `yaml:"cron"`
+	Keep int             `yaml:"keep"`
+	Dir  string          `yaml:"dir"`
+	S3   *backupS3Config `yaml:"s3"`
+}
+
+type backupS3Config struct {
+	Endpoint        string      `yaml:"endpoint"`
+	Region          string      `yaml:"region"`
+	Bucket          string      `yaml:"bucket"`
+	Prefix          string      `yaml:"prefix"`
+	AccessKeyID     string      `yaml:"accessKeyId"`
+	SecretAccessKey secretValue `yaml:"secretAccessKey"`
+}
+
+type quotaConfig struct {
+	MessagesPerDay int `yaml:"messagesPerDay"`
+	TokensPerDay   int `yaml:"tokensPerDay"`
+}
+
+type quotasConfig struct {
+	quotaConfig `yaml:",inline"`
+	Users       map[string]quotaConfig `yaml:"users"`
 }
 
 type ollamaConfig struct {
@@ -41,41 +372,104 @@ type ollamaConfig struct {
 
 type anthropicConfig struct {
 	BaseLLMConfig `yaml:",inline"`
-	APIKey        string `yaml:"apiKey"`
-	MaxTokens     int    `yaml:"maxTokens"`
+	APIKey        secretValue `yaml:"apiKey"`
+	MaxTokens     int         `yaml:"maxTokens"`
 }
 
 type openaiConfig struct {
 	BaseLLMConfig `yaml:",inline"`
-	APIKey        string `yaml:"apiKey"`
+	APIKey        secretValue `yaml:"apiKey"`
 }
 
 type openrouterConfig struct {
 	BaseLLMConfig `yaml:",inline"`
-	APIKey        string `yaml:"apiKey"`
+	APIKey        secretValue `yaml:"apiKey"`
+}
+
+type mockConfig struct {
+	BaseLLMConfig `yaml:",inline"`
+	Fixture       string        `yaml:"fixture"`
+	ChunkDelay    time.Duration `yaml:"chunkDelay"`
+}
+
+type mockFixture struct {
+	Responses []services.MockResponse `yaml:"responses"`
 }
 
 type mcpSSEServerConfig struct {
 	URL            string `yaml:"url"`
-	MaxPayloadSize int    `yaml:"maxPayloadSize"`
+	MaxPayloadSize int    `yaml:"maxPayloadSize,omitempty"`
 }
 
 type mcpStdIOServerConfig struct {
-	Command string   `yaml:"command"`
-	Args    []string `yaml:"args"`
+	Command string `yaml:"command,omitempty"`
+	// Package runs a package with its runtime's launcher instead of Command, like
+	// "npx @modelcontextprotocol/server-filesystem@2025.1.14" or "uvx mcp-server-fetch@2025.1.17".
+	Package string   `yaml:"package,omitempty"`
+	Args    []string `yaml:"args,omitempty"`
+	// Env are the environment variables added to the ones of the server's process.
+	Env map[string]string `yaml:"env,omitempty"`
+}
+
+// packageRunner is a launcher of the packages of a runtime, which installs them on their first run.
+type packageRunner struct {
+	runtime string
+	args    []string
+	// versionSeparators separate the name of the package from its version.
+	versionSeparators []string
 }
 
 func (c *config) UnmarshalYAML(value *yaml.Node) error {
 	var rawConfig struct {
 		Port                 string                          `yaml:"port"`
+		GRPCPort             string                          `yaml:"grpcPort"`
 		LogLevel             string                          `yaml:"logLevel"`
 		LogMode              string                          `yaml:"logMode"`
+		DevMode              bool                            `yaml:"devMode"`
+		DebugMode            bool                            `yaml:"debugMode"`
+		TemplatesDir         string                          `yaml:"templatesDir"`
+		StaticDir            string                          `yaml:"staticDir"`
+		DataDir              string                          `yaml:"dataDir"`
 		SystemPrompt         string                          `yaml:"systemPrompt"`
 		TitleGeneratorPrompt string                          `yaml:"titleGeneratorPrompt"`
 		LLM                  map[string]any                  `yaml:"llm"`
 		GenTitleLLM          map[string]any                  `yaml:"genTitleLLM"`
+		CompareLLM           map[string]any                  `yaml:"compareLLM"`
 		MCPSSEServers        map[string]mcpSSEServerConfig   `yaml:"mcpSSEServers"`
 		MCPStdIOServers      map[string]mcpStdIOServerConfig `yaml:"mcpStdIOServers"`
+		Auth                 authConfig                      `yaml:"auth"`
+		Security             securityConfig                  `yaml:"security"`
+		CORS                 corsConfig                      `yaml:"cors"`
+		SSE                  sseConfig                       `yaml:"sse"`
+		ToolResultGuard      toolResultGuardConfig           `yaml:"toolResultGuard"`
+		ToolFailureLimit     int                             `yaml:"toolFailureLimit"`
+		ToolCache            toolCacheConfig                 `yaml:"toolCache"`
+		ToolOverrides        map[string]toolOverrideConfig   `yaml:"toolOverrides"`
+		CapabilitiesCache    capabilitiesCacheConfig         `yaml:"capabilitiesCache"`
+		TrafficInspector     trafficInspectorConfig          `yaml:"trafficInspector"`
+		ServerInstructions   serverInstructionsConfig        `yaml:"serverInstructions"`
+		Memory               memoryConfig                    `yaml:"memory"`
+		ResponseLimit        responseLimitConfig             `yaml:"responseLimit"`
+		Batch                batchConfig                     `yaml:"batch"`
+		TitleGeneration      titleGenerationConfig           `yaml:"titleGeneration"`
+		Eval                 evalConfig                      `yaml:"eval"`
+		Pricing              pricingConfig                   `yaml:"pricing"`
+		Budgets              map[string]budgetConfig         `yaml:"budgets"`
+		Store                storeConfig                     `yaml:"store"`
+		Retention            retentionConfig                 `yaml:"retention"`
+		Maintenance          maintenanceConfig               `yaml:"maintenance"`
+		Backup               backupConfig                    `yaml:"backup"`
+		Quotas               quotasConfig                    `yaml:"quotas"`
+		Webhooks             []webhookConfig                 `yaml:"webhooks"`
+		Observability        observabilityConfig             `yaml:"observability"`
+		Cassette             cassetteConfig                  `yaml:"cassette"`
+		Egress               egressConfig                    `yaml:"egress"`
+		Capture              captureConfig                   `yaml:"capture"`
+		Bridges              bridgesConfig                   `yaml:"bridges"`
+		Welcome              welcomeConfig                   `yaml:"welcome"`
+		ChatListPageSize     int                             `yaml:"chatListPageSize"`
+		LLMMiddlewares       llmMiddlewaresConfig            `yaml:"llmMiddlewares"`
+		Schedules            []scheduleConfig                `yaml:"schedules"`
 	}
 
 	if err := value.Decode(&rawConfig); err != nil {
@@ -83,8 +477,14 @@ func (c *config) UnmarshalYAML(value *yaml.Node) error {
 	}
 
 	c.Port = rawConfig.Port
+	c.GRPCPort = rawConfig.GRPCPort
 	c.LogLevel = rawConfig.LogLevel
 	c.LogMode = rawConfig.LogMode
+	c.DevMode = rawConfig.DevMode
+	c.DebugMode = rawConfig.DebugMode
+	c.TemplatesDir = rawConfig.TemplatesDir
+	c.StaticDir = rawConfig.StaticDir
+	c.DataDir = rawConfig.DataDir
 	c.SystemPrompt = rawConfig.SystemPrompt
 	c.TitleGeneratorPrompt = rawConfig.TitleGeneratorPrompt
 
@@ -102,77 +502,728 @@ func (c *config) UnmarshalYAML(value *yaml.Node) error {
 		return err
 	}
 
-	var llm llmConfig
-	switch llmProvider {
-	case "ollama":
-		llm = &ollamaConfig{}
-	case "anthropic":
-		llm = &anthropicConfig{}
-	case "openai":
-		llm = &openaiConfig{}
-	case "openrouter":
-		llm = &openrouterConfig{}
-	default:
-		return fmt.Errorf("unknown llm provider: %s", llmProvider)
+	llm, err := newLLMConfig(llmProvider)
+	if err != nil {
+		return err
 	}
 
 	if err := yaml.Unmarshal(llmRawYAML, llm); err != nil {
 		return err
 	}
 
-	var genTitleLLM llmConfig
-	useSameLLM := true
-	genTitleLLM = llm
-	genTitleLLMProvider, ok := rawConfig.GenTitleLLM["provider"].(string)
-	if ok {
-		useSameLLM = false
-		switch genTitleLLMProvider {
-		case "ollama":
-			genTitleLLM = &ollamaConfig{}
-		case "anthropic":
-			genTitleLLM = &anthropicConfig{}
-		case "openai":
-			genTitleLLM = &openaiConfig{}
-		case "openrouter":
-			genTitleLLM = &openrouterConfig{}
+	// The title generator defaults to the same LLM as the main LLM.
+	genTitleLLM := llm
+	if genTitleLLMProvider, ok := rawConfig.GenTitleLLM["provider"].(string); ok {
+		genTitleLLM, err = newLLMConfig(genTitleLLMProvider)
+		if err != nil {
+			return fmt.Errorf("genTitleLLM: %w", err)
+		}
+		if err := yaml.Unmarshal(genTitleLLMRawYAML, genTitleLLM); err != nil {
+			return err
 		}
 	}
 
-	if !useSameLLM {
-		if err := yaml.Unmarshal(genTitleLLMRawYAML, genTitleLLM); err != nil {
+	// The compare LLM is optional, the compare mode is disabled if it's not configured.
+	var compareLLM llmConfig
+	if compareLLMProvider, ok := rawConfig.CompareLLM["provider"].(string); ok {
+		compareLLM, err = newLLMConfig(compareLLMProvider)
+		if err != nil {
+			return fmt.Errorf("compareLLM: %w", err)
+		}
+		compareLLMRawYAML, err := yaml.Marshal(rawConfig.CompareLLM)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(compareLLMRawYAML, compareLLM); err != nil {
 			return err
 		}
 	}
 
+	if err := rawConfig.TitleGeneration.validate(genTitleLLM); err != nil {
+		return fmt.Errorf("titleGeneration: %w", err)
+	}
+
 	c.LLM = llm
 	c.GenTitleLLM = genTitleLLM
+	c.CompareLLM = compareLLM
 	c.MCPSSEServers = rawConfig.MCPSSEServers
 	c.MCPStdIOServers = rawConfig.MCPStdIOServers
+	c.Auth = rawConfig.Auth
+	c.Security = rawConfig.Security
+	c.CORS = rawConfig.CORS
+	c.SSE = rawConfig.SSE
+	c.ToolResultGuard = rawConfig.ToolResultGuard
+	c.ToolFailureLimit = rawConfig.ToolFailureLimit
+	c.ToolCache = rawConfig.ToolCache
+	c.ToolOverrides = rawConfig.ToolOverrides
+	c.CapabilitiesCache = rawConfig.CapabilitiesCache
+	c.TrafficInspector = rawConfig.TrafficInspector
+	c.ServerInstructions = rawConfig.ServerInstructions
+	c.Memory = rawConfig.Memory
+	c.ResponseLimit = rawConfig.ResponseLimit
+	c.Batch = rawConfig.Batch
+	c.TitleGeneration = rawConfig.TitleGeneration
+	c.Eval = rawConfig.Eval
+	c.Pricing = rawConfig.Pricing
+	c.Budgets = rawConfig.Budgets
+	c.Store = rawConfig.Store
+	c.Retention = rawConfig.Retention
+	c.Maintenance = rawConfig.Maintenance
+	c.Backup = rawConfig.Backup
+	c.Quotas = rawConfig.Quotas
+	c.Webhooks = rawConfig.Webhooks
+	c.Observability = rawConfig.Observability
+	c.Cassette = rawConfig.Cassette
+	c.Egress = rawConfig.Egress
+	c.Capture = rawConfig.Capture
+	c.Bridges = rawConfig.Bridges
+	c.Welcome = rawConfig.Welcome
+	c.ChatListPageSize = rawConfig.ChatListPageSize
+	c.LLMMiddlewares = rawConfig.LLMMiddlewares
+	c.Schedules = rawConfig.Schedules
 
 	return nil
 }
 
-func (o ollamaConfig) newOllama(systemPrompt string, logger *slog.Logger) (services.Ollama, error) {
+func (s *secretValue) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&s.Value)
+	}
+
+	var ref struct {
+		SecretRef string `yaml:"secretRef"`
+	}
+	if err := value.Decode(&ref); err != nil {
+		return err
+	}
+	if ref.SecretRef == "" {
+		return fmt.Errorf("secretRef is required")
+	}
+	s.SecretRef = ref.SecretRef
+	return nil
+}
+
+// resolve returns the literal value, or fetches the referenced secret. If the secret is not set, it falls
+// back to the given environment variable.
+func (s secretValue) resolve(envName string) (string, error) {
+	if s.SecretRef != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return secrets.Resolve(ctx, s.SecretRef)
+	}
+	if s.Value != "" {
+		return s.Value, nil
+	}
+	return os.Getenv(envName), nil
+}
+
+var packageRunners = map[string]packageRunner{
+	// -y skips the confirmation of the installation, which would wait on the stdin of the server.
+	"npx": {runtime: "Node.js", args: []string{"-y"}, versionSeparators: []string{"@"}},
+	"uvx": {runtime: "uv", versionSeparators: []string{"@", "=="}},
+}
+
+// command returns the command and the arguments running the server, resolved from Package if it's set.
+// The packages must be pinned to a version, or to latest explicitly, and their launcher must be installed.
+func (m mcpStdIOServerConfig) command() (string, []string, error) {
+	if m.Package == "" {
+		if m.Command == "" {
+			return "", nil, fmt.Errorf("command or package is required")
+		}
+		return m.Command, m.Args, nil
+	}
+	if m.Command != "" {
+		return "", nil, fmt.Errorf("command and package can't be both set")
+	}
+
+	fields := strings.Fields(m.Package)
+	if len(fields) != 2 {
+		return "", nil, fmt.Errorf("invalid package %q, it must be like \"npx <package>@<version>\" or "+
+			"\"uvx <package>@<version>\"", m.Package)
+	}
+	launcher, pkg := fields[0], fields[1]
+	runner, ok := packageRunners[launcher]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown package launcher %s, it must be npx or uvx", launcher)
+	}
+
+	// The scope of the npm packages starts with @ too, like @modelcontextprotocol/server-filesystem.
+	name := strings.TrimPrefix(pkg, "@")
+	pinned := false
+	for _, sep := range runner.versionSeparators {
+		if i := strings.Index(name, sep); i > 0 && i+len(sep) < len(name) {
+			pinned = true
+		}
+	}
+	if !pinned {
+		return "", nil, fmt.Errorf("package %s isn't pinned to a version, use %s@<version>, or %s@latest to "+
+			"always run the latest version", pkg, pkg, pkg)
+	}
+
+	path, err := exec.LookPath(launcher)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s is required to run package %s, install %s: %w", launcher, pkg, runner.runtime, err)
+	}
+
+	args := make([]string, 0, len(runner.args)+1+len(m.Args))
+	args = append(args, runner.args...)
+	args = append(args, pkg)
+	args = append(args, m.Args...)
+	return path, args, nil
+}
+
+// access returns the access control of the roles, nil if no role is configured.
+func (a authConfig) access() *handlers.Access {
+	if len(a.Roles) == 0 && a.DefaultRole == "" {
+		return nil
+	}
+	access := handlers.Access{
+		Roles:       make(map[string]handlers.UserRole, len(a.Roles)),
+		DefaultRole: handlers.UserRole(a.DefaultRole),
+	}
+	for userID, role := range a.Roles {
+		access.Roles[userID] = handlers.UserRole(role)
+	}
+	return &access
+}
+
+// keyRotation re-instantiates the providers with an API key with a rotated key, like they're at the start.
+func (c *config) keyRotation(
+	systemPrompt, titleGenPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) handlers.KeyRotation {
+	var rotation handlers.KeyRotation
+	if llm, ok := c.LLM.(keyedLLMConfig); ok {
+		rotation.LLM = func(apiKey string) (handlers.LLM, error) {
+			return llm.withAPIKey(apiKey).llm(systemPrompt, logger, options...)
+		}
+	}
+	if titleGen, ok := c.GenTitleLLM.(keyedLLMConfig); ok {
+		rotation.TitleGenerator = func(apiKey string) (handlers.TitleGenerator, error) {
+			return titleGen.withAPIKey(apiKey).titleGen(titleGenPrompt, logger, options...)
+		}
+	}
+	if compareLLM, ok := c.CompareLLM.(keyedLLMConfig); ok {
+		rotation.CompareLLM = func(apiKey string) (handlers.LLM, error) {
+			return compareLLM.withAPIKey(apiKey).llm(systemPrompt, logger, options...)
+		}
+	}
+	return rotation
+}
+
+// lockout returns the lockout of the clients failing to authenticate, nil if it's disabled.
+func (l lockoutConfig) lockout() *handlers.Lockout {
+	if !l.Enabled {
+		return nil
+	}
+	return &handlers.Lockout{
+		MaxFailures: l.MaxFailures,
+		Window:      l.Window,
+		Duration:    l.Duration,
+	}
+}
+
+func (s sessionsConfig) sessions() handlers.Sessions {
+	return handlers.Sessions{
+		Enabled:     s.Enabled,
+		IdleTimeout: s.IdleTimeout,
+	}
+}
+
+func (s securityConfig) security() handlers.Security {
+	return handlers.Security{
+		ContentSecurityPolicy: s.ContentSecurityPolicy,
+		FrameOptions:          s.FrameOptions,
+		SecureCookies:         s.SecureCookies,
+		DisableCSRF:           s.DisableCSRF,
+	}
+}
+
+func (c corsConfig) cors() handlers.CORS {
+	return handlers.CORS{
+		AllowedOrigins:   c.AllowedOrigins,
+		AllowedMethods:   c.AllowedMethods,
+		AllowedHeaders:   c.AllowedHeaders,
+		AllowCredentials: c.AllowCredentials,
+		MaxAge:           c.MaxAge,
+	}
+}
+
+func (w welcomeConfig) welcome() handlers.Welcome {
+	welcome := handlers.Welcome{
+		Title:     w.Title,
+		Message:   w.Message,
+		ShowTools: w.ShowTools,
+	}
+	for _, s := range w.Suggestions {
+		welcome.Suggestions = append(welcome.Suggestions, handlers.WelcomeSuggestion{
+			Label:  s.Label,
+			Prompt: s.Prompt,
+			Tools:  s.Tools,
+		})
+	}
+	return welcome
+}
+
+// encryptionKey decodes the base64 encryption key of the store, falling back to the
+// MCPWEBUI_STORE_ENCRYPTION_KEY environment variable. It returns nil if neither is set.
+func (t toolResultGuardConfig) toolResultGuard() handlers.ToolResultGuard {
+	return handlers.ToolResultGuard{
+		Enabled:  t.Enabled,
+		Patterns: t.Patterns,
+	}
+}
+
+func (s storeConfig) encryptionKey() ([]byte, error) {
+	encoded, err := s.EncryptionKey.resolve("MCPWEBUI_STORE_ENCRYPTION_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store encryption key, it must be base64 encoded: %w", err)
+	}
+	return key, nil
+}
+
+// redisURL returns the URL of the Redis server of the store, from the MCPWEBUI_REDIS_URL environment variable
+// by default.
+func (r redisStoreConfig) redisURL() (string, error) {
+	url, err := r.URL.resolve("MCPWEBUI_REDIS_URL")
+	if err != nil {
+		return "", fmt.Errorf("failed to get redis url: %w", err)
+	}
+	if url == "" {
+		return "", fmt.Errorf("redis url is required")
+	}
+	return url, nil
+}
+
+func (s sseConfig) keepAlive() handlers.SSEKeepAlive {
+	return handlers.SSEKeepAlive{
+		Interval: s.KeepAlive,
+		Retry:    s.Retry,
+	}
+}
+
+func (t toolCacheConfig) toolCache() handlers.ToolCache {
+	return handlers.ToolCache{
+		Tools: t.Tools,
+		TTL:   t.TTL,
+	}
+}
+
+func (t toolOverrideConfig) toolOverride() handlers.ToolOverride {
+	return handlers.ToolOverride{
+		Name:        t.Name,
+		Description: t.Description,
+	}
+}
+
+func (b budgetConfig) budget() handlers.Budget {
+	return handlers.Budget{
+		InputPerMillionTokens:  b.InputPerMillionTokens,
+		OutputPerMillionTokens: b.OutputPerMillionTokens,
+		Daily:                  b.Daily,
+		Monthly:                b.Monthly,
+		Thresholds:             b.Thresholds,
+		HardStop:               b.HardStop,
+	}
+}
+
+func (c capabilitiesCacheConfig) capabilitiesCache() handlers.CapabilitiesCache {
+	return handlers.CapabilitiesCache{
+		Enabled: c.Enabled,
+		MaxAge:  c.MaxAge,
+	}
+}
+
+func (r responseLimitConfig) responseLimit() handlers.ResponseLimit {
+	return handlers.ResponseLimit{
+		Tokens: r.Tokens,
+	}
+}
+
+func (b batchConfig) batches() handlers.Batches {
+	return handlers.Batches{
+		Concurrency: b.Concurrency,
+		MaxRows:     b.MaxRows,
+	}
+}
+
+// validate checks the privacy mode of the title generation, a local one requiring genTitleLLM to run on a
+// local server, which the Ollama and mock providers do.
+func (t titleGenerationConfig) validate(genTitleLLM llmConfig) error {
+	switch t.Privacy {
+	case "", "heuristic":
+		return nil
+	case "local":
+		switch genTitleLLM.(type) {
+		case *ollamaConfig, *mockConfig:
+			return nil
+		}
+		return fmt.Errorf("the local privacy requires a genTitleLLM with the ollama provider")
+	default:
+		return fmt.Errorf("unknown privacy: %s, must be local or heuristic", t.Privacy)
+	}
+}
+
+func (t titleGenerationConfig) titleGeneration() handlers.TitleGeneration {
+	return handlers.TitleGeneration{
+		Concurrency:    t.Concurrency,
+		QueueSize:      t.QueueSize,
+		Language:       t.Language,
+		Heuristic:      t.Privacy == "heuristic",
+		HeuristicWords: t.Words,
+		RetryBackoff:   t.RetryBackoff,
+	}
+}
+
+func (r retentionConfig) retention() handlers.Retention {
+	return handlers.Retention{
+		RetainDays: r.RetainDays,
+		MaxChats:   r.MaxChats,
+		ArchiveDir: r.ArchiveDir,
+	}
+}
+
+func (m maintenanceConfig) maintenance() handlers.Maintenance {
+	return handlers.Maintenance{
+		Cron: m.Cron,
+	}
+}
+
+// backup returns the backup configuration, without destination if neither the directory nor the S3 bucket
+// is configured. The secret access key falls back to the AWS_SECRET_ACCESS_KEY environment variable.
+func (b backupConfig) backup() (handlers.Backup, error) {
+	backup := handlers.Backup{
+		Cron: b.Cron,
+		Keep: b.Keep,
+	}
+	switch {
+	case b.Dir != "" && b.S3 != nil:
+		return handlers.Backup{}, fmt.Errorf("backup: only one of dir and s3 can be set")
+	case b.Dir != "":
+		dest, err := services.NewLocalBackupDestination(b.Dir)
+		if err != nil {
+			return handlers.Backup{}, fmt.Errorf("backup: %w", err)
+		}
+		backup.Destination = dest
+	case b.S3 != nil:
+		secretAccessKey, err := b.S3.SecretAccessKey.resolve("AWS_SECRET_ACCESS_KEY")
+		if err != nil {
+			return handlers.Backup{}, fmt.Errorf("backup: %w", err)
+		}
+		dest, err := services.NewS3BackupDestination(services.S3BackupConfig{
+			Endpoint:        b.S3.Endpoint,
+			Region:          b.S3.Region,
+			Bucket:          b.S3.Bucket,
+			Prefix:          b.S3.Prefix,
+			AccessKeyID:     b.S3.AccessKeyID,
+			SecretAccessKey: secretAccessKey,
+		})
+		if err != nil {
+			return handlers.Backup{}, fmt.Errorf("backup: %w", err)
+		}
+		backup.Destination = dest
+	}
+	return backup, nil
+}
+
+func (q quotaConfig) quota() handlers.Quota {
+	return handlers.Quota{
+		MessagesPerDay: q.MessagesPerDay,
+		TokensPerDay:   q.TokensPerDay,
+	}
+}
+
+func (q quotasConfig) quotas() handlers.Quotas {
+	users := make(map[string]handlers.Quota, len(q.Users))
+	for userID, quota := range q.Users {
+		users[userID] = quota.quota()
+	}
+	return handlers.Quotas{
+		Default: q.quota(),
+		Users:   users,
+	}
+}
+
+func (w webhookConfig) webhook() (services.Webhook, error) {
+	if w.URL == "" {
+		return services.Webhook{}, fmt.Errorf("url is required")
+	}
+
+	events := make([]models.EventType, len(w.Events))
+	for i, event := range w.Events {
+		events[i] = models.EventType(event)
+	}
+
+	// We retry three times by default, as most webhook targets are expected to be available most of the time.
+	maxRetries := 3
+	if w.MaxRetries != nil {
+		maxRetries = *w.MaxRetries
+	}
+
+	return services.Webhook{
+		URL:        w.URL,
+		Events:     events,
+		Secret:     w.Secret,
+		MaxRetries: maxRetries,
+	}, nil
+}
+
+// providerOptions returns the options of the LLM providers recording or replaying their requests with a
+// cassette, if it's enabled by the config or the MCPWEBUI_CASSETTE_MODE environment variable. The
+// recordings are kept in the cassettes directory of dataDir by default, so the config directory can be
+// read-only.
+func (c cassetteConfig) providerOptions(dataDir string) ([]services.ProviderOption, error) {
+	mode := c.Mode
+	if env := os.Getenv("MCPWEBUI_CASSETTE_MODE"); env != "" {
+		mode = env
+	}
+	if mode == "" || mode == "off" {
+		return nil, nil
+	}
+	dir := c.Dir
+	if env := os.Getenv("MCPWEBUI_CASSETTE_DIR"); env != "" {
+		dir = env
+	}
+	if dir == "" {
+		dir = filepath.Join(dataDir, "cassettes")
+	}
+
+	cassette, err := services.NewCassette(dir, services.CassetteMode(mode), nil)
+	if err != nil {
+		return nil, err
+	}
+	return []services.ProviderOption{services.WithCassette(cassette)}, nil
+}
+
+// providerOptions prepends the HTTP client tuned by the config to the options of a provider.
+func (h providerHTTPConfig) providerOptions(options []services.ProviderOption) ([]services.ProviderOption, error) {
+	client, err := services.NewHTTPClient(services.HTTPSettings{
+		Timeout:               h.Timeout,
+		ConnectTimeout:        h.ConnectTimeout,
+		ResponseHeaderTimeout: h.ResponseHeaderTimeout,
+		ReadTimeout:           h.ReadTimeout,
+		IdleConnTimeout:       h.IdleConnTimeout,
+		MaxIdleConnsPerHost:   h.MaxIdleConnsPerHost,
+		ProxyURL:              h.ProxyURL,
+		CAFile:                h.CAFile,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid http config: %w", err)
+	}
+	return append([]services.ProviderOption{services.WithHTTPClient(client)}, options...), nil
+}
+
+// providerOptions returns options with the HTTP client, the system role and the tool emulation of the config.
+func (b BaseLLMConfig) providerOptions(options []services.ProviderOption) ([]services.ProviderOption, error) {
+	options, err := b.HTTP.providerOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	switch role := services.SystemRole(b.SystemRole); role {
+	case "":
+	case services.SystemRoleSystem, services.SystemRoleDeveloper, services.SystemRolePrepend:
+		options = append(options, services.WithSystemRole(role))
+	default:
+		return nil, fmt.Errorf("invalid systemRole %q, expected system, developer or prepend-to-user", b.SystemRole)
+	}
+	if b.ToolEmulation {
+		options = append(options, services.WithToolEmulation())
+	}
+	return options, nil
+}
+
+// policy returns the egress policy of the LLM providers and the SSE MCP servers, or nil if the config doesn't
+// restrict their hosts.
+func (e egressConfig) policy() (*services.EgressPolicy, error) {
+	if len(e.AllowedHosts) == 0 && !e.DenyPrivate {
+		return nil, nil
+	}
+	policy, err := services.NewEgressPolicy(e.AllowedHosts, e.DenyPrivate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress config: %w", err)
+	}
+	return policy, nil
+}
+
+// capture returns the capture endpoint config. The pages are fetched by a client denying the private
+// addresses, restricted to the allowed hosts if any, as their URLs are given by the clients.
+func (c captureConfig) capture() (handlers.Capture, error) {
+	capture := handlers.Capture{MaxBytes: c.MaxBytes, MaxChars: c.MaxChars}
+	if !c.FetchPages {
+		return capture, nil
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	client, err := services.NewHTTPClient(services.HTTPSettings{Timeout: timeout})
+	if err != nil {
+		return handlers.Capture{}, fmt.Errorf("invalid capture config: %w", err)
+	}
+	policy, err := services.NewEgressPolicy(c.AllowedHosts, true)
+	if err != nil {
+		return handlers.Capture{}, fmt.Errorf("invalid capture config: %w", err)
+	}
+	capture.Client = policy.Client(client)
+	return capture, nil
+}
+
+// bridges returns the configured bridges, none by default.
+func (b bridgesConfig) bridges(logger *slog.Logger) ([]handlers.Bridge, error) {
+	var bridges []handlers.Bridge
+	if t := b.Telegram; t != nil {
+		token, err := t.Token.resolve("TELEGRAM_BOT_TOKEN")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get telegram bot token: %w", err)
+		}
+		bridge, err := services.NewTelegramBridge(services.TelegramConfig{
+			Token:        token,
+			AllowedUsers: t.AllowedUsers,
+			PollTimeout:  t.PollTimeout,
+			APIURL:       t.APIURL,
+		}, logger)
+		if err != nil {
+			return nil, fmt.Errorf("invalid telegram bridge config: %w", err)
+		}
+		bridges = append(bridges, bridge)
+	}
+	return bridges, nil
+}
+
+func (o observabilityConfig) exporters(logger *slog.Logger) ([]handlers.GenerationExporter, error) {
+	var exporters []handlers.GenerationExporter
+	if l := o.Langfuse; l != nil {
+		host := l.Host
+		if host == "" {
+			host = "https://cloud.langfuse.com"
+		}
+		publicKey := l.PublicKey
+		if publicKey == "" {
+			publicKey = os.Getenv("LANGFUSE_PUBLIC_KEY")
+		}
+		secretKey, err := l.SecretKey.resolve("LANGFUSE_SECRET_KEY")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get langfuse secret key: %w", err)
+		}
+		if publicKey == "" || secretKey == "" {
+			return nil, fmt.Errorf("langfuse public and secret keys are required")
+		}
+		exporters = append(exporters, services.NewLangfuse(host, publicKey, secretKey, logger))
+	}
+	if o := o.OTLP; o != nil {
+		if o.Endpoint == "" {
+			return nil, fmt.Errorf("otlp endpoint is required")
+		}
+		exporters = append(exporters, services.NewOTLP(o.Endpoint, o.Headers, logger))
+	}
+	return exporters, nil
+}
+
+func (l llmMiddlewaresConfig) middlewares(logger *slog.Logger) []handlers.LLMMiddleware {
+	var middlewares []handlers.LLMMiddleware
+	if l.Logging {
+		middlewares = append(middlewares, handlers.LoggingMiddleware(logger))
+	}
+	if r := l.Retry; r != nil {
+		backoff := r.Backoff
+		if backoff == 0 {
+			backoff = time.Second
+		}
+		middlewares = append(middlewares, handlers.RetryMiddleware(r.MaxRetries, backoff))
+	}
+	if l.TokenCounting {
+		middlewares = append(middlewares, handlers.TokenCountingMiddleware(
+			func(ctx context.Context, inputTokens, outputTokens int) {
+				logger.InfoContext(ctx, "LLM tokens",
+					slog.Int("inputTokens", inputTokens),
+					slog.Int("outputTokens", outputTokens))
+			}))
+	}
+	if len(l.ProfanityFilter) > 0 {
+		middlewares = append(middlewares, handlers.ProfanityFilterMiddleware(l.ProfanityFilter))
+	}
+	if l.CurrentDate {
+		middlewares = append(middlewares, handlers.CurrentDateMiddleware(nil))
+	}
+	return middlewares
+}
+
+func (s scheduleConfig) schedule() handlers.ScheduledPrompt {
+	return handlers.ScheduledPrompt{
+		Name:   s.Name,
+		Cron:   s.Cron,
+		Prompt: s.Prompt,
+		Review: s.Review,
+	}
+}
+
+func newLLMConfig(provider string) (llmConfig, error) {
+	switch provider {
+	case "ollama":
+		return &ollamaConfig{}, nil
+	case "anthropic":
+		return &anthropicConfig{}, nil
+	case "openai":
+		return &openaiConfig{}, nil
+	case "openrouter":
+		return &openrouterConfig{}, nil
+	case "mock":
+		return &mockConfig{}, nil
+	default:
+		return nil, fmt.Errorf("unknown llm provider: %s", provider)
+	}
+}
+
+func (o ollamaConfig) newOllama(
+	systemPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (services.Ollama, error) {
 	if o.Model == "" {
 		return services.Ollama{}, fmt.Errorf("model is required")
 	}
 
+	options, err := o.providerOptions(options)
+	if err != nil {
+		return services.Ollama{}, err
+	}
 	host := o.Host
 	if host == "" {
 		host = os.Getenv("OLLAMA_HOST")
 	}
-	return services.NewOllama(host, o.Model, systemPrompt, o.Parameters, logger), nil
+	return services.NewOllama(host, o.Model, systemPrompt, o.Parameters, logger, options...), nil
 }
 
-func (o ollamaConfig) llm(systemPrompt string, logger *slog.Logger) (handlers.LLM, error) {
-	return o.newOllama(systemPrompt, logger)
+func (o ollamaConfig) llm(
+	systemPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (handlers.LLM, error) {
+	return o.newOllama(systemPrompt, logger, options...)
 }
 
-func (o ollamaConfig) titleGen(systemPrompt string, logger *slog.Logger) (handlers.TitleGenerator, error) {
-	return o.newOllama(systemPrompt, logger)
+func (o ollamaConfig) titleGen(
+	systemPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (handlers.TitleGenerator, error) {
+	return o.newOllama(systemPrompt, logger, options...)
 }
 
-func (a anthropicConfig) newAnthropic(systemPrompt string, _ *slog.Logger) (services.Anthropic, error) {
+func (a anthropicConfig) newAnthropic(
+	systemPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (services.Anthropic, error) {
 	if a.Model == "" {
 		return services.Anthropic{}, fmt.Errorf("model is required")
 	}
@@ -180,58 +1231,147 @@ func (a anthropicConfig) newAnthropic(systemPrompt string, _ *slog.Logger) (serv
 		return services.Anthropic{}, fmt.Errorf("max_tokens is required")
 	}
 
-	apiKey := a.APIKey
-	if apiKey == "" {
-		apiKey = os.Getenv("ANTHROPIC_API_KEY")
+	apiKey, err := a.APIKey.resolve("ANTHROPIC_API_KEY")
+	if err != nil {
+		return services.Anthropic{}, fmt.Errorf("failed to get api key: %w", err)
+	}
+	options, err = a.HTTP.providerOptions(options)
+	if err != nil {
+		return services.Anthropic{}, err
 	}
 
-	return services.NewAnthropic(apiKey, a.Model, systemPrompt, a.MaxTokens, a.Parameters), nil
+	return services.NewAnthropic(apiKey, a.Model, systemPrompt, a.MaxTokens, a.Parameters, logger, options...), nil
 }
 
-func (a anthropicConfig) llm(systemPrompt string, logger *slog.Logger) (handlers.LLM, error) {
-	return a.newAnthropic(systemPrompt, logger)
+func (a anthropicConfig) withAPIKey(apiKey string) llmConfig {
+	a.APIKey = secretValue{Value: apiKey}
+	return a
 }
 
-func (a anthropicConfig) titleGen(systemPrompt string, logger *slog.Logger) (handlers.TitleGenerator, error) {
-	return a.newAnthropic(systemPrompt, logger)
+func (a anthropicConfig) llm(
+	systemPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (handlers.LLM, error) {
+	return a.newAnthropic(systemPrompt, logger, options...)
 }
 
-func (o openaiConfig) newOpenAI(systemPrompt string, logger *slog.Logger) (services.OpenAI, error) {
+func (a anthropicConfig) titleGen(
+	systemPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (handlers.TitleGenerator, error) {
+	return a.newAnthropic(systemPrompt, logger, options...)
+}
+
+func (o openaiConfig) newOpenAI(
+	systemPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (services.OpenAI, error) {
 	if o.Model == "" {
 		return services.OpenAI{}, fmt.Errorf("model is required")
 	}
 
-	apiKey := o.APIKey
-	if apiKey == "" {
-		apiKey = os.Getenv("OPENAI_API_KEY")
+	apiKey, err := o.APIKey.resolve("OPENAI_API_KEY")
+	if err != nil {
+		return services.OpenAI{}, fmt.Errorf("failed to get api key: %w", err)
 	}
-	return services.NewOpenAI(apiKey, o.Model, systemPrompt, o.Parameters, logger), nil
+	options, err = o.providerOptions(options)
+	if err != nil {
+		return services.OpenAI{}, err
+	}
+	return services.NewOpenAI(apiKey, o.Model, systemPrompt, o.Parameters, logger, options...), nil
 }
 
-func (o openaiConfig) llm(systemPrompt string, logger *slog.Logger) (handlers.LLM, error) {
-	return o.newOpenAI(systemPrompt, logger)
+func (o openaiConfig) withAPIKey(apiKey string) llmConfig {
+	o.APIKey = secretValue{Value: apiKey}
+	return o
 }
 
-func (o openaiConfig) titleGen(systemPrompt string, logger *slog.Logger) (handlers.TitleGenerator, error) {
-	return o.newOpenAI(systemPrompt, logger)
+func (o openaiConfig) llm(
+	systemPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (handlers.LLM, error) {
+	return o.newOpenAI(systemPrompt, logger, options...)
 }
 
-func (o openrouterConfig) newOpenRouter(systemPrompt string, logger *slog.Logger) (services.OpenRouter, error) {
+func (o openaiConfig) titleGen(
+	systemPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (handlers.TitleGenerator, error) {
+	return o.newOpenAI(systemPrompt, logger, options...)
+}
+
+func (o openrouterConfig) newOpenRouter(
+	systemPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (services.OpenRouter, error) {
 	if o.Model == "" {
 		return services.OpenRouter{}, fmt.Errorf("model is required")
 	}
 
-	apiKey := o.APIKey
-	if apiKey == "" {
-		apiKey = os.Getenv("OPENROUTER_API_KEY")
+	apiKey, err := o.APIKey.resolve("OPENROUTER_API_KEY")
+	if err != nil {
+		return services.OpenRouter{}, fmt.Errorf("failed to get api key: %w", err)
+	}
+	options, err = o.providerOptions(options)
+	if err != nil {
+		return services.OpenRouter{}, err
+	}
+	return services.NewOpenRouter(apiKey, o.Model, systemPrompt, o.Parameters, logger, options...), nil
+}
+
+func (o openrouterConfig) withAPIKey(apiKey string) llmConfig {
+	o.APIKey = secretValue{Value: apiKey}
+	return o
+}
+
+func (o openrouterConfig) llm(
+	systemPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (handlers.LLM, error) {
+	return o.newOpenRouter(systemPrompt, logger, options...)
+}
+
+func (o openrouterConfig) titleGen(
+	systemPrompt string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (handlers.TitleGenerator, error) {
+	return o.newOpenRouter(systemPrompt, logger, options...)
+}
+
+func (m mockConfig) newMock(logger *slog.Logger) (services.Mock, error) {
+	var fixture mockFixture
+	if m.Fixture != "" {
+		bs, err := os.ReadFile(m.Fixture)
+		if err != nil {
+			return services.Mock{}, fmt.Errorf("failed to read fixture: %w", err)
+		}
+		if err := yaml.Unmarshal(bs, &fixture); err != nil {
+			return services.Mock{}, fmt.Errorf("failed to parse fixture: %w", err)
+		}
 	}
-	return services.NewOpenRouter(apiKey, o.Model, systemPrompt, o.Parameters, logger), nil
+	return services.NewMock(fixture.Responses, m.ChunkDelay, logger), nil
 }
 
-func (o openrouterConfig) llm(systemPrompt string, logger *slog.Logger) (handlers.LLM, error) {
-	return o.newOpenRouter(systemPrompt, logger)
+func (m mockConfig) llm(
+	_ string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (handlers.LLM, error) {
+	return m.newMock(logger)
 }
 
-func (o openrouterConfig) titleGen(systemPrompt string, logger *slog.Logger) (handlers.TitleGenerator, error) {
-	return o.newOpenRouter(systemPrompt, logger)
+func (m mockConfig) titleGen(
+	_ string,
+	logger *slog.Logger,
+	options ...services.ProviderOption,
+) (handlers.TitleGenerator, error) {
+	return m.newMock(logger)
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// rename renames the files moved to the data directory, replaced by the tests to fail like across file systems.
+var rename = os.Rename
+
+// resolveDataDir returns the directory of the data of the server, the store and the log: dir, from the
+// -data-dir flag or the dataDir setting, or the data directory of the user. The directory is created if needed,
+// and the store kept in the config directory cfgPath by the previous versions is moved to it.
+func resolveDataDir(dir, cfgPath string) (string, error) {
+	if dir == "" {
+		var err error
+		if dir, err = userDataDir(); err != nil {
+			return "", fmt.Errorf("error getting user data dir: %w", err)
+		}
+		dir = filepath.Join(dir, "mcpwebui")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating data directory: %w", err)
+	}
+	if err := migrateDataDir(cfgPath, dir); err != nil {
+		return "", fmt.Errorf("error moving the data to the data directory: %w", err)
+	}
+	return dir, nil
+}
+
+// userDataDir returns the default root directory of the data of the user, like os.UserConfigDir does for the
+// configuration: $XDG_DATA_HOME or $HOME/.local/share on Unix, %LocalAppData% on Windows, and the config
+// directory on macOS and Plan 9, which don't tell them apart.
+func userDataDir() (string, error) {
+	switch runtime.GOOS {
+	case "windows":
+		if dir := os.Getenv("LocalAppData"); dir != "" {
+			return dir, nil
+		}
+		return "", errors.New("%LocalAppData% is not defined")
+	case "darwin", "ios", "plan9":
+		return os.UserConfigDir()
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share"), nil
+}
+
+// migrateDataDir moves the store and its upgrade backups from cfgPath to dataDir, unless dataDir already has
+// them. The log is created again on every start, so it isn't moved.
+func migrateDataDir(cfgPath, dataDir string) error {
+	if filepath.Clean(cfgPath) == filepath.Clean(dataDir) {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(cfgPath, "store.db*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		target := filepath.Join(dataDir, filepath.Base(path))
+		if _, err := os.Stat(target); err == nil {
+			log.Printf("Keeping %s, %s is already in the data directory", path, target)
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := moveFile(path, target); err != nil {
+			return err
+		}
+		log.Printf("Moved %s to %s", path, target)
+	}
+	return nil
+}
+
+// moveFile moves the file of src to dst, copying it if they're on different file systems. The copy is kept if
+// src can't be removed, like in a read-only mount of the config directory.
+func moveFile(src, dst string) error {
+	if err := rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// The copy is written aside and renamed, so a failed copy doesn't leave a partial store in dst.
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Remove(src); err != nil {
+		log.Printf("Failed to remove %s after copying it to %s: %v", src, dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMigrateDataDir(t *testing.T) {
+	cfgDir, dataDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(cfgDir, "store.db"), "store")
+	writeFile(t, filepath.Join(cfgDir, "store.db.bak-v1"), "backup")
+	writeFile(t, filepath.Join(cfgDir, "mcpwebui.log"), "log")
+	writeFile(t, filepath.Join(cfgDir, "config.yaml"), "config")
+
+	if err := migrateDataDir(cfgDir, dataDir); err != nil {
+		t.Fatalf("migrateDataDir() error = %v", err)
+	}
+	for name, want := range map[string]string{"store.db": "store", "store.db.bak-v1": "backup"} {
+		if got := readFile(t, filepath.Join(dataDir, name)); got != want {
+			t.Errorf("%s in the data directory = %q, want %q", name, got, want)
+		}
+		if _, err := os.Stat(filepath.Join(cfgDir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s is still in the config directory, err = %v", name, err)
+		}
+	}
+	// The log is created again on every start, and the config stays with the config.
+	for _, name := range []string{"mcpwebui.log", "config.yaml"} {
+		if _, err := os.Stat(filepath.Join(dataDir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s is moved to the data directory, err = %v", name, err)
+		}
+	}
+
+	// The next starts find the store in the data directory.
+	if err := migrateDataDir(cfgDir, dataDir); err != nil {
+		t.Fatalf("migrateDataDir() again error = %v", err)
+	}
+	if got := readFile(t, filepath.Join(dataDir, "store.db")); got != "store" {
+		t.Errorf("store.db after another start = %q, want %q", got, "store")
+	}
+}
+
+func TestMigrateDataDirExisting(t *testing.T) {
+	cfgDir, dataDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(cfgDir, "store.db"), "old store")
+	writeFile(t, filepath.Join(dataDir, "store.db"), "current store")
+
+	if err := migrateDataDir(cfgDir, dataDir); err != nil {
+		t.Fatalf("migrateDataDir() error = %v", err)
+	}
+	if got := readFile(t, filepath.Join(dataDir, "store.db")); got != "current store" {
+		t.Errorf("store.db in the data directory = %q, want it kept", got)
+	}
+	if got := readFile(t, filepath.Join(cfgDir, "store.db")); got != "old store" {
+		t.Errorf("store.db in the config directory = %q, want it left in place", got)
+	}
+}
+
+func TestMoveFileAcrossDevices(t *testing.T) {
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	defer func() { rename = os.Rename }()
+
+	src, dst := filepath.Join(t.TempDir(), "store.db"), filepath.Join(t.TempDir(), "store.db")
+	writeFile(t, src, "store")
+	if err := moveFile(src, dst); err != nil {
+		t.Fatalf("moveFile() error = %v", err)
+	}
+	if got := readFile(t, dst); got != "store" {
+		t.Errorf("copied store = %q, want %q", got, "store")
+	}
+	if _, err := os.Stat(src); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("source is kept after the copy, err = %v", err)
+	}
+	if _, err := os.Stat(dst + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary copy is left, err = %v", err)
+	}
+
+	// A missing source fails without leaving a copy.
+	if err := moveFile(src, dst+"-missing"); err == nil {
+		t.Error("moveFile() of a missing file should return an error")
+	}
+	if _, err := os.Stat(dst + "-missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("copy of a missing file is created, err = %v", err)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
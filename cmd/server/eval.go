@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	mcpwebui "github.com/MegaGrindStone/mcp-web-ui"
+)
+
+// runEvalSuite runs the eval suite of ui, writing the result of every case to w, and the report with the
+// transcripts of the responses as JSON to the file at reportPath if it's not empty. It returns an error if
+// any case failed, for the command to exit with a failure in the CI pipelines.
+func runEvalSuite(ctx context.Context, ui *mcpwebui.Handler, reportPath string, w io.Writer) error {
+	report, err := ui.RunEvalSuite(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, res := range report.Results {
+		status := "PASS"
+		if !res.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%s %s (%s)\n", status, res.Case, res.Duration.Round(time.Millisecond))
+		if res.Error != "" {
+			fmt.Fprintf(w, "    error: %s\n", res.Error)
+		}
+		for _, failure := range res.Failures {
+			fmt.Fprintf(w, "    - %s\n", failure)
+		}
+	}
+	passed := report.PassedCount()
+	fmt.Fprintf(w, "%d/%d cases passed\n", passed, len(report.Results))
+
+	if reportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode eval report: %w", err)
+		}
+		if err := os.WriteFile(reportPath, data, 0o600); err != nil {
+			return fmt.Errorf("failed to write eval report: %w", err)
+		}
+	}
+
+	if passed < len(report.Results) {
+		return fmt.Errorf("%d of %d eval cases failed", len(report.Results)-passed, len(report.Results))
+	}
+	return nil
+}
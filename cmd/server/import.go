@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// importedConfig is the part of the config files of the other MCP clients listing their servers: mcpServers
+// in Claude Desktop's claude_desktop_config.json, and servers in VS Code's mcp.json.
+type importedConfig struct {
+	MCPServers map[string]importedServer `json:"mcpServers"`
+	Servers    map[string]importedServer `json:"servers"`
+}
+
+// importedServer is a server of importedConfig. Type is only set by VS Code, to "stdio", "sse" or "http",
+// the servers of Claude Desktop being stdio servers, unless they have a URL.
+type importedServer struct {
+	Type    string            `json:"type"`
+	Command string            `json:"command"`
+	Args    []string          `json:"args"`
+	Env     map[string]string `json:"env"`
+	URL     string            `json:"url"`
+}
+
+type importedMCPServers struct {
+	MCPSSEServers   map[string]mcpSSEServerConfig   `yaml:"mcpSSEServers,omitempty"`
+	MCPStdIOServers map[string]mcpStdIOServerConfig `yaml:"mcpStdIOServers,omitempty"`
+}
+
+// importMCPServers converts the MCP servers of the Claude Desktop or VS Code config file at path into the
+// mcpSSEServers and mcpStdIOServers sections of config.yaml, written to w. The servers that can't be
+// converted are skipped, with a warning written to warnings.
+func importMCPServers(path string, w, warnings io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var cfg importedConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse %s, it must be a JSON file without comments: %w", path, err)
+	}
+	servers := cfg.MCPServers
+	if len(servers) == 0 {
+		servers = cfg.Servers
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("no MCP servers in %s, under mcpServers or servers", path)
+	}
+
+	imported := importedMCPServers{
+		MCPSSEServers:   make(map[string]mcpSSEServerConfig),
+		MCPStdIOServers: make(map[string]mcpStdIOServerConfig),
+	}
+	for _, name := range slices.Sorted(maps.Keys(servers)) {
+		srv := servers[name]
+		switch {
+		case srv.Type == "http":
+			fmt.Fprintf(warnings, "Skipping %s: the streamable HTTP servers aren't supported\n", name)
+			continue
+		case srv.URL != "":
+			imported.MCPSSEServers[name] = mcpSSEServerConfig{URL: srv.URL}
+		case srv.Command != "":
+			imported.MCPStdIOServers[name] = mcpStdIOServerConfig{
+				Command: srv.Command,
+				Args:    srv.Args,
+				Env:     srv.Env,
+			}
+		default:
+			fmt.Fprintf(warnings, "Skipping %s: it has neither a command nor a URL\n", name)
+			continue
+		}
+		// The VS Code variables, like ${input:api-key}, are resolved by VS Code only.
+		if strings.Contains(fmt.Sprint(srv.Command, srv.Args, srv.Env, srv.URL), "${") {
+			fmt.Fprintf(warnings, "Check %s: it uses variables, like ${input:...}, that must be replaced\n", name)
+		}
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(imported); err != nil {
+		return fmt.Errorf("failed to encode the MCP servers: %w", err)
+	}
+	return enc.Close()
+}
@@ -2,36 +2,94 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"io/fs"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
+	// The timezones of the users are loaded from the embedded database, as the containers may lack one.
+	_ "time/tzdata"
 
 	"github.com/MegaGrindStone/go-mcp"
 	mcpwebui "github.com/MegaGrindStone/mcp-web-ui"
-	"github.com/MegaGrindStone/mcp-web-ui/internal/handlers"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/logging"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/services"
+	"github.com/tmaxmax/go-sse"
+	"google.golang.org/grpc"
 	"gopkg.in/yaml.v3"
 )
 
+// version is the version of the web UI, given to the MCP servers and in the bug reports.
+const version = "0.1.0"
+
 func main() {
+	importPath := flag.String("import-mcp-servers", "",
+		"print the MCP servers of a Claude Desktop or VS Code config `file` as YAML for config.yaml, and exit")
+	evalPath := flag.String("eval", "",
+		"run the eval suite of the YAML `file` against the configured LLM and MCP servers, print the results, and exit")
+	evalReportPath := flag.String("eval-report", "",
+		"write the report of -eval with the transcripts of the responses as JSON to `file`")
+	bugReportPath := flag.String("capture-bug-report", "",
+		"record the provider requests and responses and the MCP traffic, and write them with the transcripts and "+
+			"the version info to the zip `file` on shutdown, the secrets of the config redacted")
+	dataDirFlag := flag.String("data-dir", "",
+		"keep the store and the log in `dir` instead of the dataDir of the config or the user data directory")
+	flag.Parse()
+	if *importPath != "" {
+		if err := importMCPServers(*importPath, os.Stdout, os.Stderr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	cfg, cfgDir := loadConfig()
+	if *evalPath != "" {
+		cfg.Eval.Suite = *evalPath
+	}
+	if *dataDirFlag != "" {
+		cfg.DataDir = *dataDirFlag
+	}
+	dataDir, err := resolveDataDir(cfg.DataDir, filepath.Join(cfgDir, "mcpwebui"))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	logger, logFile := initLogger(cfg, cfgDir)
+	logger, logFile := initLogger(cfg, dataDir)
 	defer logFile.Close()
 
 	sysPrompt := cfg.SystemPrompt
 	if sysPrompt == "" {
 		sysPrompt = "You are a helpful assistant."
 	}
-	llm, err := cfg.LLM.llm(sysPrompt, logger)
+	report := startBugReport(*bugReportPath)
+	providerOpts, err := cfg.Cassette.providerOptions(dataDir)
+	if report != nil {
+		// The requests are recorded by the cassette of the bug report instead of the configured one.
+		providerOpts, err = report.providerOptions()
+	}
+	if err != nil {
+		panic(err)
+	}
+	egressPolicy, err := cfg.Egress.policy()
+	if err != nil {
+		panic(err)
+	}
+	if egressPolicy != nil {
+		providerOpts = append(providerOpts, services.WithEgressPolicy(egressPolicy))
+	}
+	capture, err := cfg.Capture.capture()
+	if err != nil {
+		panic(err)
+	}
+	llm, err := cfg.LLM.llm(sysPrompt, logger, providerOpts...)
 	if err != nil {
 		panic(err)
 	}
@@ -39,122 +97,173 @@ func main() {
 	if titleGenPrompt == "" {
 		titleGenPrompt = "Generate a title for this chat with only one sentence with maximum 5 words."
 	}
-	titleGen, err := cfg.GenTitleLLM.titleGen(titleGenPrompt, logger)
+	titleGen, err := cfg.GenTitleLLM.titleGen(titleGenPrompt, logger, providerOpts...)
 	if err != nil {
 		panic(err)
 	}
 
-	dbPath := filepath.Join(cfgDir, "/mcpwebui/store.db")
-	boltDB, err := services.NewBoltDB(dbPath)
-	if err != nil {
-		panic(err)
+	opts := mcpwebui.Options{
+		LLM:               llm,
+		TitleGenerator:    titleGen,
+		Logger:            logger,
+		UserHeader:        cfg.Auth.UserHeader,
+		RequireAPITokens:  cfg.Auth.RequireAPITokens,
+		Access:            cfg.Auth.access(),
+		Sessions:          cfg.Auth.Sessions.sessions(),
+		Lockout:           cfg.Auth.Lockout.lockout(),
+		TrustedProxies:    cfg.Auth.TrustedProxies,
+		Quotas:            cfg.Quotas.quotas(),
+		Security:          cfg.Security.security(),
+		CORS:              cfg.CORS.cors(),
+		Capture:           capture,
+		Welcome:           cfg.Welcome.welcome(),
+		ChatListPageSize:  cfg.ChatListPageSize,
+		SSEKeepAlive:      cfg.SSE.keepAlive(),
+		SSEAuthorization:  cfg.SSE.Authorize,
+		ToolResultGuard:   cfg.ToolResultGuard.toolResultGuard(),
+		ToolFailureLimit:  cfg.ToolFailureLimit,
+		ToolCache:         cfg.ToolCache.toolCache(),
+		CapabilitiesCache: cfg.CapabilitiesCache.capabilitiesCache(),
+		Memory:            cfg.Memory.Enabled,
+		ResponseLimit:     cfg.ResponseLimit.responseLimit(),
+		Batches:           cfg.Batch.batches(),
+		TitleGeneration:   cfg.TitleGeneration.titleGeneration(),
+		StoreTimeout:      cfg.Store.Timeout,
+		EvalSuite:         cfg.Eval.Suite,
+		InputPrice:        cfg.Pricing.InputPerMillionTokens,
+		Retention:         cfg.Retention.retention(),
+		Maintenance:       cfg.Maintenance.maintenance(),
+		TemplateReload:    cfg.DevMode,
+		DebugMode:         cfg.DebugMode,
+		KeyRotation:       cfg.keyRotation(sysPrompt, titleGenPrompt, logger, providerOpts...),
+	}
+	if cfg.TemplatesDir != "" {
+		opts.Templates = os.DirFS(cfg.TemplatesDir)
+	}
+	if cfg.StaticDir != "" {
+		opts.Static = os.DirFS(cfg.StaticDir)
+	}
+	if cfg.CompareLLM != nil {
+		opts.CompareLLM, err = cfg.CompareLLM.llm(sysPrompt, logger, providerOpts...)
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	mcpClientInfo := mcp.Info{
-		Name:    "mcp-web-ui",
-		Version: "0.1.0",
+	// closeWebhooks abandons the webhook deliveries still retried on shutdown.
+	closeWebhooks := func() {}
+	if len(cfg.Webhooks) > 0 {
+		webhooks := make([]services.Webhook, len(cfg.Webhooks))
+		for i, whCfg := range cfg.Webhooks {
+			webhooks[i], err = whCfg.webhook()
+			if err != nil {
+				panic(fmt.Errorf("invalid webhook at index %d: %w", i, err))
+			}
+		}
+		notifier := services.NewWebhooks(webhooks, logger)
+		opts.Notifier = notifier
+		closeWebhooks = notifier.Close
 	}
 
-	mcpClients, stdIOCmds := populateMCPClients(cfg, mcpClientInfo)
+	opts.GenerationExporters, err = cfg.Observability.exporters(logger)
+	if err != nil {
+		panic(err)
+	}
 
-	for i, cli := range mcpClients {
-		logger.Info("Connecting to MCP server", slog.Int("index", i))
+	opts.LLMMiddlewares = cfg.LLMMiddlewares.middlewares(logger)
 
-		connectCtx, connectCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	opts.Bridges, err = cfg.Bridges.bridges(logger)
+	if err != nil {
+		panic(err)
+	}
 
-		if err := cli.Connect(connectCtx); err != nil {
-			connectCancel()
-			logger.Error("Error connecting to MCP server", slog.Int("index", i), slog.String("err", err.Error()))
-			continue
-		}
-		connectCancel()
+	for _, sCfg := range cfg.Schedules {
+		opts.Schedules = append(opts.Schedules, sCfg.schedule())
+	}
 
-		mcpClients[i] = cli
+	opts.ToolOverrides = make(map[string]mcpwebui.ToolOverride, len(cfg.ToolOverrides))
+	for tool, oCfg := range cfg.ToolOverrides {
+		opts.ToolOverrides[tool] = oCfg.toolOverride()
+	}
 
-		logger.Info("Connected to MCP server", slog.String("name", mcpClients[i].ServerInfo().Name))
+	opts.Budgets = make(map[string]mcpwebui.Budget, len(cfg.Budgets))
+	for provider, bCfg := range cfg.Budgets {
+		opts.Budgets[provider] = bCfg.budget()
 	}
 
-	m, err := handlers.NewMain(llm, titleGen, boltDB, mcpClients, logger)
+	opts.Store, opts.SSEProvider, err = openStore(cfg, dataDir, logger)
+	if err != nil {
+		panic(err)
+	}
+	opts.Backup, err = cfg.Backup.backup()
 	if err != nil {
 		panic(err)
 	}
 
-	// Serve static files
-	staticFS, err := fs.Sub(mcpwebui.StaticFS, "static")
+	mcpClientInfo := mcp.Info{
+		Name:    "mcp-web-ui",
+		Version: version,
+	}
+
+	if cfg.TrafficInspector.Enabled || report != nil {
+		opts.TrafficInspector = mcpwebui.NewTrafficInspector(cfg.TrafficInspector.Capacity)
+	}
+	if cfg.ServerInstructions.Enabled {
+		opts.ServerInstructions = mcpwebui.NewServerInstructions(cfg.ServerInstructions.Servers)
+	}
+	mcpClients, stdIOCmds := populateMCPClients(cfg, mcpClientInfo, opts, egressPolicy)
+
+	connectMCPClients(mcpClients, logger)
+	opts.MCPClients = mcpClients
+
+	ui, err := mcpwebui.New(opts)
 	if err != nil {
 		panic(err)
 	}
-	fileServer := http.FileServer(http.FS(staticFS))
 
-	// Create custom mux
-	mux := http.NewServeMux()
-	mux.Handle("/static/", http.StripPrefix("/static/", fileServer))
-	mux.HandleFunc("/", m.HandleHome)
-	mux.HandleFunc("/chats", m.HandleChats)
-	mux.HandleFunc("/sse/messages", m.HandleSSE)
-	mux.HandleFunc("/sse/chats", m.HandleSSE)
+	if *evalPath != "" {
+		evalErr := runEvalSuite(context.Background(), ui, *evalReportPath, os.Stdout)
+		closeMCPClients(mcpClients, stdIOCmds, logger)
+		closeWebhooks()
+		if err := ui.Shutdown(context.Background()); err != nil {
+			logger.Error("Failed to shutdown sse server", slog.String("err", err.Error()))
+		}
+		if evalErr != nil {
+			log.Fatal(evalErr)
+		}
+		return
+	}
 
 	// Create custom server
 	srv := &http.Server{
 		Addr:              ":" + cfg.Port,
-		Handler:           mux,
+		Handler:           ui,
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
 	srv.RegisterOnShutdown(func() {
-		for _, cli := range mcpClients {
-			disconnectCtx, disconnectCancel := context.WithTimeout(context.Background(), 30*time.Second)
-			if err := cli.Disconnect(disconnectCtx); err != nil {
-				logger.Error("Failed to disconnect from MCP server", slog.String("err", err.Error()))
-			}
-			disconnectCancel()
-		}
-
-		for _, cmd := range stdIOCmds {
-			if err := cmd.Process.Kill(); err != nil {
-				logger.Error("Failed to kill stdIO command", slog.String("err", err.Error()))
-			}
-			_ = cmd.Wait()
-		}
+		closeMCPClients(mcpClients, stdIOCmds, logger)
+		closeWebhooks()
 
-		if err := m.Shutdown(context.Background()); err != nil {
+		if err := ui.Shutdown(context.Background()); err != nil {
 			logger.Error("Failed to shutdown sse server", slog.String("err", err.Error()))
 		}
 	})
 
-	// Channel to listen for errors coming from the listener
-	serverErrors := make(chan error, 1)
-
-	// Start server in goroutine
-	go func() {
-		logger.Info("Server starting on", slog.String("port", cfg.Port))
-		serverErrors <- srv.ListenAndServe()
-	}()
-
-	// Channel to listen for interrupt/terminate signals
-	shutdown := make(chan os.Signal, 1)
-	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
-
-	// Blocking select waiting for either interrupt or server error
-	select {
-	case err := <-serverErrors:
-		logger.Error("Server error", slog.String("err", err.Error()))
-
-	case sig := <-shutdown:
-		logger.Info("Start shutdown", slog.String("signal", sig.String()))
+	var grpcSrv *grpc.Server
+	if cfg.GRPCPort != "" {
+		if grpcSrv, err = serveGRPC(ui, cfg.GRPCPort, logger); err != nil {
+			panic(err)
+		}
+	}
 
-		// Create context with timeout for shutdown
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+	serve(srv, logger)
 
-		// Gracefully shutdown the server
-		if err := srv.Shutdown(ctx); err != nil {
-			logger.Error("Graceful shutdown failed", slog.String("err", err.Error()))
-			logger.Info("Forcing server close")
-			if err := srv.Close(); err != nil {
-				logger.Error("Failed to forcing server close", slog.String("err", err.Error()))
-			}
-		}
+	if grpcSrv != nil {
+		stopGRPC(grpcSrv)
+	}
+	if report != nil {
+		report.finish(cfg, opts, mcpClients)
 	}
 }
 
@@ -182,7 +291,7 @@ func loadConfig() (config, string) {
 	return cfg, cfgDir
 }
 
-func initLogger(cfg config, cfgDir string) (*slog.Logger, *os.File) {
+func initLogger(cfg config, dataDir string) (*slog.Logger, *os.File) {
 	logLevel := new(slog.LevelVar)
 	switch cfg.LogLevel {
 	case "debug":
@@ -198,7 +307,7 @@ func initLogger(cfg config, cfgDir string) (*slog.Logger, *os.File) {
 		logLevel.Set(slog.LevelInfo)
 	}
 
-	logFile, err := os.Create(filepath.Join(cfgDir, "mcpwebui/mcpwebui.log"))
+	logFile, err := os.Create(filepath.Join(dataDir, "mcpwebui.log"))
 	if err != nil {
 		log.Fatalf("Error creating log file: %v", err)
 	}
@@ -206,9 +315,9 @@ func initLogger(cfg config, cfgDir string) (*slog.Logger, *os.File) {
 	var lg *slog.Logger
 	switch cfg.LogMode {
 	case "json":
-		lg = slog.New(slog.NewJSONHandler(logFile, &slog.HandlerOptions{Level: logLevel}))
+		lg = slog.New(logging.NewHandler(slog.NewJSONHandler(logFile, &slog.HandlerOptions{Level: logLevel})))
 	default:
-		lg = slog.New(slog.NewTextHandler(logFile, &slog.HandlerOptions{Level: logLevel}))
+		lg = slog.New(logging.NewHandler(slog.NewTextHandler(logFile, &slog.HandlerOptions{Level: logLevel})))
 	}
 
 	// llmJSON, err := json.Marshal(cfg.LLM)
@@ -224,8 +333,14 @@ func initLogger(cfg config, cfgDir string) (*slog.Logger, *os.File) {
 	logger := lg.With(
 		slog.Group("config",
 			slog.String("port", cfg.Port),
+			slog.String("grpcPort", cfg.GRPCPort),
 			slog.String("logLevel", cfg.LogLevel),
 			slog.String("logMode", cfg.LogMode),
+			slog.Bool("devMode", cfg.DevMode),
+			slog.Bool("debugMode", cfg.DebugMode),
+			slog.String("templatesDir", cfg.TemplatesDir),
+			slog.String("staticDir", cfg.StaticDir),
+			slog.String("dataDir", dataDir),
 
 			// These two configuration can be very long, and would potenially fill up the log file.
 			// slog.String("systemPrompt", cfg.SystemPrompt),
@@ -243,19 +358,202 @@ func initLogger(cfg config, cfgDir string) (*slog.Logger, *os.File) {
 	return logger, logFile
 }
 
-func populateMCPClients(cfg config, mcpClientInfo mcp.Info) ([]*mcp.Client, []*exec.Cmd) {
+// serve runs srv until it fails, or the process is interrupted or terminated, in which case srv is shut
+// down gracefully.
+func serve(srv *http.Server, logger *slog.Logger) {
+	// Channel to listen for errors coming from the listener
+	serverErrors := make(chan error, 1)
+
+	// Start server in goroutine
+	go func() {
+		logger.Info("Server starting on", slog.String("port", strings.TrimPrefix(srv.Addr, ":")))
+		serverErrors <- srv.ListenAndServe()
+	}()
+
+	// Channel to listen for interrupt/terminate signals
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+
+	// Blocking select waiting for either interrupt or server error
+	select {
+	case err := <-serverErrors:
+		logger.Error("Server error", slog.String("err", err.Error()))
+
+	case sig := <-shutdown:
+		logger.Info("Start shutdown", slog.String("signal", sig.String()))
+
+		// Create context with timeout for shutdown
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// Gracefully shutdown the server
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Error("Graceful shutdown failed", slog.String("err", err.Error()))
+			logger.Info("Forcing server close")
+			if err := srv.Close(); err != nil {
+				logger.Error("Failed to forcing server close", slog.String("err", err.Error()))
+			}
+		}
+	}
+}
+
+// serveGRPC serves the ChatService of ui over gRPC on port in the background, until the returned server is
+// stopped.
+func serveGRPC(ui *mcpwebui.Handler, port string, logger *slog.Logger) (*grpc.Server, error) {
+	lis, err := (&net.ListenConfig{}).Listen(context.Background(), "tcp", ":"+port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on gRPC port %s: %w", port, err)
+	}
+	srv := grpc.NewServer()
+	ui.RegisterChatService(srv)
+	go func() {
+		logger.Info("gRPC server starting on", slog.String("port", port))
+		if err := srv.Serve(lis); err != nil {
+			logger.Error("gRPC server error", slog.String("err", err.Error()))
+		}
+	}()
+	return srv, nil
+}
+
+// stopGRPC stops srv gracefully, closing the calls still running after 10 seconds, like the streams of
+// SendMessage.
+func stopGRPC(srv *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		srv.Stop()
+	}
+}
+
+// openStore opens the store of the chats, encrypted with the key of the store configuration if any. It's
+// the Redis server of the configuration, with the SSE provider fanning the events out to the replicas
+// sharing it, or the BoltDB store in dataDir otherwise, without SSE provider.
+func openStore(cfg config, dataDir string, logger *slog.Logger) (mcpwebui.Store, sse.Provider, error) {
+	encryptionKey, err := cfg.Store.encryptionKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if r := cfg.Store.Redis; r != nil {
+		url, err := r.redisURL()
+		if err != nil {
+			return nil, nil, err
+		}
+		var storeOpts []services.RedisOption
+		if r.KeyPrefix != "" {
+			storeOpts = append(storeOpts, services.WithRedisKeyPrefix(r.KeyPrefix))
+		}
+		if encryptionKey != nil {
+			storeOpts = append(storeOpts, services.WithRedisEncryptionKey(encryptionKey))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		store, err := services.NewRedis(ctx, url, storeOpts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		provider, err := store.NewSSEProvider(ctx, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, provider, nil
+	}
+
+	dbPath := filepath.Join(dataDir, "store.db")
+	var storeOpts []services.BoltDBOption
+	if encryptionKey != nil {
+		storeOpts = append(storeOpts, services.WithBoltDBEncryptionKey(encryptionKey))
+	}
+	store, err := services.NewBoltDB(dbPath, storeOpts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, nil, nil
+}
+
+// connectMCPClients connects mcpClients to their servers, logging the ones that fail to connect.
+func connectMCPClients(mcpClients []*mcp.Client, logger *slog.Logger) {
+	for i, cli := range mcpClients {
+		logger.Info("Connecting to MCP server", slog.Int("index", i))
+
+		connectCtx, connectCancel := context.WithTimeout(context.Background(), 30*time.Second)
+
+		if err := cli.Connect(connectCtx); err != nil {
+			connectCancel()
+			logger.Error("Error connecting to MCP server", slog.Int("index", i), slog.String("err", err.Error()))
+			continue
+		}
+		connectCancel()
+
+		logger.Info("Connected to MCP server", slog.String("name", cli.ServerInfo().Name))
+	}
+}
+
+// closeMCPClients disconnects mcpClients, and kills the commands of the stdio servers.
+func closeMCPClients(mcpClients []*mcp.Client, stdIOCmds []*exec.Cmd, logger *slog.Logger) {
+	for _, cli := range mcpClients {
+		disconnectCtx, disconnectCancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := cli.Disconnect(disconnectCtx); err != nil {
+			logger.Error("Failed to disconnect from MCP server", slog.String("err", err.Error()))
+		}
+		disconnectCancel()
+	}
+
+	for _, cmd := range stdIOCmds {
+		if err := cmd.Process.Kill(); err != nil {
+			logger.Error("Failed to kill stdIO command", slog.String("err", err.Error()))
+		}
+		_ = cmd.Wait()
+	}
+}
+
+func populateMCPClients(
+	cfg config, mcpClientInfo mcp.Info, opts mcpwebui.Options, egressPolicy *services.EgressPolicy,
+) ([]*mcp.Client, []*exec.Cmd) {
 	var mcpClients []*mcp.Client
 
-	for _, mcpSSEServerConfig := range cfg.MCPSSEServers {
-		sseClient := mcp.NewSSEClient(mcpSSEServerConfig.URL, nil,
+	// The transports are wrapped to record their messages if the traffic inspector is enabled, and to
+	// collect the instructions of the servers if they're appended to the system prompt.
+	transport := func(name string, t mcp.ClientTransport) mcp.ClientTransport {
+		if opts.ServerInstructions != nil {
+			t = opts.ServerInstructions.Transport(name, t)
+		}
+		if opts.TrafficInspector != nil {
+			t = opts.TrafficInspector.Transport(name, t)
+		}
+		return t
+	}
+
+	// The SSE MCP servers use the default HTTP client, unless the egress policy restricts their hosts.
+	var sseHTTPClient *http.Client
+	if egressPolicy != nil {
+		sseHTTPClient = egressPolicy.Client(&http.Client{})
+	}
+	for name, mcpSSEServerConfig := range cfg.MCPSSEServers {
+		sseClient := mcp.NewSSEClient(mcpSSEServerConfig.URL, sseHTTPClient,
 			mcp.WithSSEClientMaxPayloadSize(mcpSSEServerConfig.MaxPayloadSize))
-		cli := mcp.NewClient(mcpClientInfo, sseClient)
+		cli := mcp.NewClient(mcpClientInfo, transport(name, sseClient))
 		mcpClients = append(mcpClients, cli)
 	}
 
 	cmds := make([]*exec.Cmd, 0, len(cfg.MCPStdIOServers))
-	for _, mcpStdIOServerConfig := range cfg.MCPStdIOServers {
-		cmd := exec.Command(mcpStdIOServerConfig.Command, mcpStdIOServerConfig.Args...)
+	for name, mcpStdIOServerConfig := range cfg.MCPStdIOServers {
+		command, args, err := mcpStdIOServerConfig.command()
+		if err != nil {
+			panic(fmt.Errorf("invalid stdio MCP server %s: %w", name, err))
+		}
+		cmd := exec.Command(command, args...)
+		if len(mcpStdIOServerConfig.Env) > 0 {
+			cmd.Env = os.Environ()
+			for k, v := range mcpStdIOServerConfig.Env {
+				cmd.Env = append(cmd.Env, k+"="+v)
+			}
+		}
 		cmds = append(cmds, cmd)
 
 		in, err := cmd.StdinPipe()
@@ -272,7 +570,7 @@ func populateMCPClients(cfg config, mcpClientInfo mcp.Info) ([]*mcp.Client, []*e
 
 		cliStdIO := mcp.NewStdIO(out, in)
 
-		cli := mcp.NewClient(mcpClientInfo, cliStdIO)
+		cli := mcp.NewClient(mcpClientInfo, transport(name, cliStdIO))
 		mcpClients = append(mcpClients, cli)
 	}
 
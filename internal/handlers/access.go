@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// UserRole is the role of a user in the access control of WithAccess, granting them a set of permissions.
+type UserRole string
+
+const (
+	// UserRoleAdmin is granted every permission: the administration pages, the management of the MCP servers
+	// and the view of the chats of the other users, besides the permissions of the members.
+	UserRoleAdmin UserRole = "admin"
+	// UserRoleMember chats with the assistant, changes the model settings of the chats and calls the tools by
+	// hand in the tools playground. They only see the chats they created or were invited into.
+	UserRoleMember UserRole = "member"
+	// UserRoleViewer only reads the chats they created or were invited into, without sending messages or
+	// changing them.
+	UserRoleViewer UserRole = "viewer"
+)
+
+// Access configures the role-based access control of WithAccess.
+type Access struct {
+	// Roles are the roles of the users, keyed by their ID given by the user header or their API token.
+	Roles map[string]UserRole
+	// DefaultRole is the role of the users missing from Roles, UserRoleMember if it's empty.
+	DefaultRole UserRole
+}
+
+// permission is an action granted by the roles of the users.
+type permission int
+
+const (
+	// permChat sends the messages and changes the chats.
+	permChat permission = iota
+	permModelSettings
+	permToolCalls
+	permManageServers
+	// permViewChats sees the chats of the other users, besides the ones the user participates in.
+	permViewChats
+	permAdmin
+)
+
+// permissionActions describes the permissions in the errors refusing them.
+var permissionActions = map[permission]string{
+	permChat:          "send messages or change the chats",
+	permModelSettings: "change the model settings",
+	permToolCalls:     "call the tools",
+	permManageServers: "manage the MCP servers",
+	permViewChats:     "view the chats of the other users",
+	permAdmin:         "administrate the web UI",
+}
+
+var rolePermissions = map[UserRole][]permission{
+	UserRoleAdmin:  {permChat, permModelSettings, permToolCalls, permManageServers, permViewChats, permAdmin},
+	UserRoleMember: {permChat, permModelSettings, permToolCalls},
+	UserRoleViewer: {},
+}
+
+// routePermissions are the permissions required by the routes, matched by their path or its prefix if it
+// ends with a slash, in order. The other routes require permChat for the requests other than GET, HEAD and
+// OPTIONS, except the readOnlyRoutes.
+var routePermissions = []struct {
+	path       string
+	permission permission
+}{
+	{"/admin/", permAdmin},
+	{"/schedules/run", permAdmin},
+	{"/schedules/review", permAdmin},
+	{"/tools/refresh", permManageServers},
+	{"/tools/call", permToolCalls},
+	{"/chats/parameters", permModelSettings},
+}
+
+// readOnlyRoutes are the routes changing nothing but the data of the user, like their read receipts or
+// their settings, open to all the roles.
+var readOnlyRoutes = []string{"/chats/read", "/chats/unread", "/settings/"}
+
+// WithAccess enables the role-based access control of the users, identified by the header of
+// WithUserHeader or their API token, enforced by the AccessControl middleware and the handlers. Without it,
+// every user has every permission. NewMain returns an error if a role is unknown.
+func WithAccess(access Access) MainOption {
+	return func(m *Main) {
+		m.access = access
+		m.accessControl = true
+	}
+}
+
+func (m *Main) parseAccess() error {
+	if !m.accessControl {
+		return nil
+	}
+	if m.access.DefaultRole == "" {
+		m.access.DefaultRole = UserRoleMember
+	}
+	if _, ok := rolePermissions[m.access.DefaultRole]; !ok {
+		return fmt.Errorf("unknown default role %q, expected admin, member or viewer", m.access.DefaultRole)
+	}
+	for userID, role := range m.access.Roles {
+		if _, ok := rolePermissions[role]; !ok {
+			return fmt.Errorf("unknown role %q of user %s, expected admin, member or viewer", role, userID)
+		}
+	}
+	return nil
+}
+
+// AccessControl is a middleware refusing the requests whose route requires a permission the role of their
+// user doesn't grant, with a 403 Forbidden. It must wrap the routes inside APIAuth, which identifies the
+// users of the API tokens. The handlers check that the user sees the chat of the request on their side.
+func (m *Main) AccessControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := routePermission(r)
+		if !m.accessControl || !ok || m.allowed(r, p) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		msg := fmt.Sprintf("The %s role isn't allowed to %s", m.userRole(m.userID(r)), permissionActions[p])
+		m.logger.WarnContext(r.Context(), "Access denied",
+			slog.String("userID", m.userID(r)),
+			slog.String("path", r.URL.Path))
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			m.writeAPIError(w, http.StatusForbidden, msg)
+			return
+		}
+		m.renderError(w, http.StatusForbidden, msg)
+	})
+}
+
+func routePermission(r *http.Request) (permission, bool) {
+	matches := func(path string) bool {
+		if strings.HasSuffix(path, "/") {
+			return strings.HasPrefix(r.URL.Path, path)
+		}
+		return r.URL.Path == path
+	}
+	for _, route := range routePermissions {
+		if matches(route.path) {
+			return route.permission, true
+		}
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return 0, false
+	}
+	if slices.ContainsFunc(readOnlyRoutes, matches) {
+		return 0, false
+	}
+	return permChat, true
+}
+
+// userRole returns the role of userID, every user being an admin without WithAccess.
+func (m *Main) userRole(userID string) UserRole {
+	if !m.accessControl {
+		return UserRoleAdmin
+	}
+	if role, ok := m.access.Roles[userID]; ok {
+		return role
+	}
+	return m.access.DefaultRole
+}
+
+func (m *Main) roleAllows(userID string, p permission) bool {
+	return slices.Contains(rolePermissions[m.userRole(userID)], p)
+}
+
+// allowed reports whether the role of the user of r grants p.
+func (m *Main) allowed(r *http.Request, p permission) bool {
+	return m.roleAllows(m.userID(r), p)
+}
+
+// chatVisible reports whether userID sees c: the users see the chats they created or were invited into,
+// and all of them with permViewChats.
+func (m *Main) chatVisible(userID string, c models.Chat) bool {
+	return m.roleAllows(userID, permViewChats) || chatOwner(c, userID) || c.Participant(userID)
+}
+
+// visibleChats returns the chats the user of r sees.
+func (m *Main) visibleChats(r *http.Request, chats []models.Chat) []models.Chat {
+	return m.userVisibleChats(m.userID(r), chats)
+}
+
+// userVisibleChats returns the chats userID sees.
+func (m *Main) userVisibleChats(userID string, chats []models.Chat) []models.Chat {
+	if m.roleAllows(userID, permViewChats) {
+		return chats
+	}
+	return slices.DeleteFunc(slices.Clone(chats), func(c models.Chat) bool { return !m.chatVisible(userID, c) })
+}
+
+// findUserChat returns the chat of chatID if the user of r sees it, or errChatNotFound.
+func (m *Main) findUserChat(r *http.Request, chatID string) (models.Chat, error) {
+	return m.findVisibleChat(r.Context(), m.userID(r), chatID)
+}
+
+// findVisibleChat returns the chat of chatID if userID sees it, or errChatNotFound.
+func (m *Main) findVisibleChat(ctx context.Context, userID, chatID string) (models.Chat, error) {
+	c, err := m.findChat(ctx, chatID)
+	if err != nil {
+		return models.Chat{}, err
+	}
+	if !m.chatVisible(userID, c) {
+		return models.Chat{}, errChatNotFound
+	}
+	return c, nil
+}
+
+// chatHidden reports whether the chat of chatID exists, but the user of r doesn't see it. The handlers
+// treat the hidden chats like the missing ones.
+func (m *Main) chatHidden(r *http.Request, chatID string) (bool, error) {
+	if chatID == "" || m.allowed(r, permViewChats) {
+		return false, nil
+	}
+	c, err := m.findChat(r.Context(), chatID)
+	if errors.Is(err, errChatNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !m.chatVisible(m.userID(r), c), nil
+}
+
+// authorizeChat reports whether the user of r sees the chat of chatID, if it exists. It responds with 404
+// Not Found otherwise, as if the chat didn't exist.
+func (m *Main) authorizeChat(w http.ResponseWriter, r *http.Request, chatID string) bool {
+	hidden, err := m.chatHidden(r, chatID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if hidden {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// sseChatVisible reports whether the user of the SSE connection of r sees the chat it follows, by its
+// chat_id, or by the message_id of one of its responses being generated.
+func (m *Main) sseChatVisible(r *http.Request) bool {
+	if m.allowed(r, permViewChats) {
+		return true
+	}
+	if _, ok := m.observerTopic(r); ok {
+		return true
+	}
+	query := r.URL.Query()
+	chatID := query.Get("chat_id")
+	if messageID := query.Get("message_id"); messageID != "" {
+		m.messageTopics.mu.Lock()
+		topic, ok := m.messageTopics.items[messageID]
+		m.messageTopics.mu.Unlock()
+		if !ok {
+			return false
+		}
+		chatID = topic.chatID
+	}
+	hidden, err := m.chatHidden(r, chatID)
+	return err == nil && !hidden
+}
+
+// publishUserChats publishes to the user topic of every participant of chats who doesn't see all of them
+// the first page of the list of the chats they see, as they don't subscribe to the chats SSE topic.
+func (m *Main) publishUserChats(ctx context.Context, chats []models.Chat) error {
+	if !m.accessControl {
+		return nil
+	}
+	var users []string
+	for _, c := range chats {
+		for _, userID := range append([]string{chatOwnerID(c)}, c.Members...) {
+			if !slices.Contains(users, userID) && !m.roleAllows(userID, permViewChats) {
+				users = append(users, userID)
+			}
+		}
+	}
+	for _, userID := range users {
+		visible := slices.DeleteFunc(slices.Clone(chats), func(c models.Chat) bool {
+			return !m.chatVisible(userID, c)
+		})
+		divs, err := m.chatDivs(visible)
+		if err != nil {
+			return err
+		}
+		if err := m.publish(ctx, chatsEventType, divs, userTopic(userID)); err != nil {
+			return fmt.Errorf("failed to publish chats of user %s: %w", userID, err)
+		}
+	}
+	return nil
+}
+
+// participantTopics returns the user topics of the participants of c who don't see all the chats, which get
+// the changes of c there, as they don't subscribe to the chats SSE topic.
+func (m *Main) participantTopics(c models.Chat) []string {
+	if !m.accessControl {
+		return nil
+	}
+	var topics []string
+	for _, userID := range append([]string{chatOwnerID(c)}, c.Members...) {
+		if topic := userTopic(userID); !slices.Contains(topics, topic) && !m.roleAllows(userID, permViewChats) {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
@@ -0,0 +1,629 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/logging"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// The types below are the proto3 JSON mapping of the messages in api/proto/mcpwebui/v1/chat.proto.
+
+type apiChat struct {
+	ID           string   `json:"id"`
+	Title        string   `json:"title"`
+	Language     string   `json:"language,omitempty"`
+	Members      []string `json:"members,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	SystemPrompt string   `json:"systemPrompt,omitempty"`
+}
+
+type apiContent struct {
+	Type           string `json:"type"`
+	Text           string `json:"text,omitempty"`
+	ToolName       string `json:"toolName,omitempty"`
+	ToolInput      string `json:"toolInput,omitempty"`
+	ToolResult     string `json:"toolResult,omitempty"`
+	CallToolID     string `json:"callToolId,omitempty"`
+	CallToolFailed bool   `json:"callToolFailed,omitempty"`
+
+	SuspiciousPatterns []string `json:"suspiciousPatterns,omitempty"`
+	ToolNote           string   `json:"toolNote,omitempty"`
+	Structured         bool     `json:"structured,omitempty"`
+	SchemaViolations   []string `json:"schemaViolations,omitempty"`
+}
+
+type apiMessage struct {
+	ID           string           `json:"id"`
+	Role         string           `json:"role"`
+	Contents     []apiContent     `json:"contents"`
+	Timestamp    time.Time        `json:"timestamp"`
+	Stats        *apiMessageStats `json:"stats,omitempty"`
+	FinishReason string           `json:"finishReason,omitempty"`
+	Interruption string           `json:"interruption,omitempty"`
+	ParentID     string           `json:"parentId,omitempty"`
+	UserID       string           `json:"userId,omitempty"`
+}
+
+type apiMessageStats struct {
+	TimeToFirstTokenMs int64   `json:"timeToFirstTokenMs"`
+	OutputTokens       int     `json:"outputTokens"`
+	TokensPerSecond    float64 `json:"tokensPerSecond"`
+}
+
+type apiTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema string `json:"inputSchema,omitempty"`
+}
+
+type apiListChatsResponse struct {
+	Chats []apiChat `json:"chats"`
+}
+
+type apiListMessagesResponse struct {
+	Messages []apiMessage `json:"messages"`
+}
+
+type apiCreateChatRequest struct {
+	Title        string   `json:"title"`
+	Tags         []string `json:"tags"`
+	SystemPrompt string   `json:"systemPrompt"`
+}
+
+type apiSendMessageRequest struct {
+	Text           string `json:"text"`
+	ResponseSchema string `json:"responseSchema"`
+}
+
+type apiSendMessageResponse struct {
+	Chunk   *apiContent `json:"chunk,omitempty"`
+	Message *apiMessage `json:"message,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+type apiListToolsResponse struct {
+	Tools []apiTool `json:"tools"`
+}
+
+type apiBatch struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Template  string        `json:"template"`
+	Columns   []string      `json:"columns"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Finished  bool          `json:"finished,omitempty"`
+	Rows      []apiBatchRow `json:"rows"`
+}
+
+type apiBatchRow struct {
+	Row    int               `json:"row"`
+	Inputs map[string]string `json:"inputs"`
+	Prompt string            `json:"prompt"`
+	Status string            `json:"status"`
+	Output string            `json:"output,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+type apiCreateBatchRequest struct {
+	Name     string          `json:"name"`
+	Template string          `json:"template"`
+	Inputs   []apiBatchInput `json:"inputs"`
+}
+
+type apiBatchInput struct {
+	Values map[string]string `json:"values"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func newAPIChat(c models.Chat) apiChat {
+	return apiChat{
+		ID:           c.ID,
+		Title:        c.Title,
+		Language:     c.Language,
+		Members:      c.Members,
+		Tags:         c.Tags,
+		SystemPrompt: c.SystemPrompt,
+	}
+}
+
+func newAPIContent(c models.Content) apiContent {
+	return apiContent{
+		Type:           string(c.Type),
+		Text:           c.Text,
+		ToolName:       c.ToolName,
+		ToolInput:      string(c.ToolInput),
+		ToolResult:     string(c.ToolResult),
+		CallToolID:     c.CallToolID,
+		CallToolFailed: c.CallToolFailed,
+
+		SuspiciousPatterns: c.SuspiciousPatterns,
+		ToolNote:           c.ToolNote,
+		Structured:         c.Structured,
+		SchemaViolations:   c.SchemaViolations,
+	}
+}
+
+func newAPIMessage(msg models.Message) apiMessage {
+	contents := make([]apiContent, 0, len(msg.Contents))
+	for _, c := range msg.Contents {
+		// The generation starts every LLM turn with an empty text content, which carries nothing.
+		if c.Type == models.ContentTypeText && c.Text == "" {
+			continue
+		}
+		contents = append(contents, newAPIContent(c))
+	}
+	res := apiMessage{
+		ID:           msg.ID,
+		Role:         string(msg.Role),
+		Contents:     contents,
+		Timestamp:    msg.Timestamp,
+		FinishReason: string(msg.FinishReason),
+		Interruption: msg.Interruption,
+		ParentID:     msg.ParentID,
+		UserID:       msg.UserID,
+	}
+	if s := msg.Stats; s != nil {
+		res.Stats = &apiMessageStats{
+			TimeToFirstTokenMs: s.TimeToFirstToken.Milliseconds(),
+			OutputTokens:       s.OutputTokens,
+			TokensPerSecond:    s.TokensPerSecond,
+		}
+	}
+	return res
+}
+
+func newAPIBatch(b batch) apiBatch {
+	res := apiBatch{
+		ID:        b.ID,
+		Name:      b.Name,
+		Template:  b.Template,
+		Columns:   b.Columns,
+		CreatedAt: b.CreatedAt,
+		Finished:  b.Finished(),
+		Rows:      make([]apiBatchRow, len(b.Rows)),
+	}
+	for i := range b.Rows {
+		res.Rows[i] = newAPIBatchRow(b, i)
+	}
+	return res
+}
+
+func newAPIBatchRow(b batch, idx int) apiBatchRow {
+	row := b.Rows[idx]
+	inputs := make(map[string]string, len(b.Columns))
+	for i, column := range b.Columns {
+		inputs[column] = row.Inputs[i]
+	}
+	return apiBatchRow{
+		Row:    row.Number,
+		Inputs: inputs,
+		Prompt: row.Prompt,
+		Status: row.Status,
+		Output: row.Output,
+		Error:  row.Error,
+	}
+}
+
+func newAPITool(tool mcp.Tool) apiTool {
+	return apiTool{
+		Name:        tool.Name,
+		Description: tool.Description,
+		InputSchema: string(tool.InputSchema),
+	}
+}
+
+// contentChunks returns the contents added to next since prev, where the growth of the last text content
+// of prev is returned as a text chunk with only the added text.
+func contentChunks(prev, next models.Message) []models.Content {
+	var chunks []models.Content
+	for i, c := range next.Contents {
+		if i >= len(prev.Contents) {
+			if c.Type != models.ContentTypeText || c.Text != "" {
+				chunks = append(chunks, c)
+			}
+			continue
+		}
+		if c.Type == models.ContentTypeText && len(c.Text) > len(prev.Contents[i].Text) {
+			c.Text = strings.TrimPrefix(c.Text, prev.Contents[i].Text)
+			chunks = append(chunks, c)
+		}
+	}
+	return chunks
+}
+
+func (m *Main) writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		m.logger.Error("Failed to encode API response", slog.String(errLoggerKey, err.Error()))
+	}
+}
+
+func (m *Main) writeAPIError(w http.ResponseWriter, status int, msg string) {
+	m.writeAPIJSON(w, status, apiError{Error: msg})
+}
+
+// HandleAPIChats serves the ListChats (GET) and CreateChat (POST) methods of the chat API. CreateChat
+// expects an optional JSON body with the chat's title, tags and system prompt override, the title is
+// generated from the first message of the chat if it's empty.
+func (m *Main) HandleAPIChats(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		chats, err := m.apiChats(r.Context(), m.userID(r))
+		if err != nil {
+			m.writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		res := apiListChatsResponse{Chats: make([]apiChat, len(chats))}
+		for i, c := range chats {
+			res.Chats[i] = newAPIChat(c)
+		}
+		m.writeAPIJSON(w, http.StatusOK, res)
+	case http.MethodPost:
+		var req apiCreateChatRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				m.writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err))
+				return
+			}
+		}
+		c, err := m.createAPIChat(r.Context(), m.userID(r), req)
+		if err != nil {
+			m.writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		m.writeAPIJSON(w, http.StatusCreated, newAPIChat(c))
+	default:
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		m.writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// HandleAPIMessages serves the ListMessages (GET) and SendMessage (POST) methods of the chat API on
+// /api/v1/chats/{chatID}/messages. ListMessages returns the chat's messages sorted by timestamp, only the
+// ones at or after the optional "since" RFC 3339 query parameter. SendMessage expects the message's text
+// in a JSON body. Unlike HandleChats, the response is generated within the request, and streamed as
+// newline-delimited JSON: a chunk object for every piece of the response, followed by either the complete
+// assistant message or an error. The response is published to the web UI's SSE topics as well, so the
+// chat stays live in open browsers.
+func (m *Main) HandleAPIMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		m.listAPIMessages(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		m.writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req apiSendMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		m.writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err))
+		return
+	}
+	g, status, err := m.startAPIMessage(r.Context(), m.userID(r), r.PathValue("chatID"), req)
+	if err != nil {
+		m.writeAPIError(w, status, err.Error())
+		return
+	}
+
+	w.Header().Set(generationIDHeader, logging.GenerationID(g.ctx))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	write := func(res apiSendMessageResponse) {
+		// The client may have gone away, but the generation goes on to keep the chat consistent.
+		if err := enc.Encode(res); err != nil {
+			m.logger.DebugContext(r.Context(), "Failed to write API response", slog.String(errLoggerKey, err.Error()))
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	aiMsg, err := m.runAPIGeneration(g, func(c models.Content) {
+		chunk := newAPIContent(c)
+		write(apiSendMessageResponse{Chunk: &chunk})
+	})
+	if err != nil {
+		write(apiSendMessageResponse{Error: err.Error()})
+		return
+	}
+	final := newAPIMessage(aiMsg)
+	write(apiSendMessageResponse{Message: &final})
+}
+
+// HandleAPITools serves the ListTools method of the chat API, listing the tools of all the connected MCP
+// servers that are offered to the LLM.
+func (m *Main) HandleAPITools(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		m.writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	tools := m.capabilities().tools
+	res := apiListToolsResponse{Tools: make([]apiTool, len(tools))}
+	for i, tool := range tools {
+		res.Tools[i] = newAPITool(tool)
+	}
+	m.writeAPIJSON(w, http.StatusOK, res)
+}
+
+// HandleAPIBatches serves the CreateBatch method of the chat API, running the template of the JSON body
+// against its inputs in the background, like the batches of the web UI. The columns of the batch are the
+// names of the values of the inputs, an input without a value of a column gets an empty one. It responds
+// with the queued batch, to poll with GetBatch.
+func (m *Main) HandleAPIBatches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		m.writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req apiCreateBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		m.writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err))
+		return
+	}
+	inputs := make([]map[string]string, len(req.Inputs))
+	for i, input := range req.Inputs {
+		inputs[i] = input.Values
+	}
+
+	b, status, err := m.createAPIBatch(r.Context(), m.userID(r), req.Name, req.Template, inputs)
+	if err != nil {
+		m.writeAPIError(w, status, err.Error())
+		return
+	}
+	m.writeAPIJSON(w, http.StatusAccepted, newAPIBatch(b))
+}
+
+// HandleAPIBatch serves the GetBatch method of the chat API on /api/v1/batches/{batchID}, returning the
+// batch with the current status of its rows.
+func (m *Main) HandleAPIBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		m.writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	b, err := m.batches.get(m.userID(r), r.PathValue("batchID"))
+	if err != nil {
+		m.writeAPIError(w, http.StatusNotFound, "Batch not found")
+		return
+	}
+	m.writeAPIJSON(w, http.StatusOK, newAPIBatch(b))
+}
+
+func (m *Main) listAPIMessages(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			m.writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid since: %s", err))
+			return
+		}
+	}
+
+	messages, status, err := m.apiMessages(r.Context(), m.userID(r), r.PathValue("chatID"), since)
+	if err != nil {
+		m.writeAPIError(w, status, err.Error())
+		return
+	}
+	res := apiListMessagesResponse{Messages: make([]apiMessage, len(messages))}
+	for i, msg := range messages {
+		res.Messages[i] = newAPIMessage(msg)
+	}
+	m.writeAPIJSON(w, http.StatusOK, res)
+}
+
+// The methods below implement the chat API for both of its transports, the JSON handlers above and the
+// gRPC ChatService. The ones failing with a status of the request return it with their error, the
+// transports mapping it to their own.
+
+// apiChats returns the chats userID sees.
+func (m *Main) apiChats(ctx context.Context, userID string) ([]models.Chat, error) {
+	chats, err := m.store.Chats(ctx)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to get chats", slog.String(errLoggerKey, err.Error()))
+		return nil, err
+	}
+	return m.userVisibleChats(userID, chats), nil
+}
+
+// createAPIChat creates the chat of req for userID.
+func (m *Main) createAPIChat(ctx context.Context, userID string, req apiCreateChatRequest) (models.Chat, error) {
+	c := models.Chat{
+		Title:        strings.TrimSpace(req.Title),
+		UserID:       userID,
+		Tags:         normalizeTags(req.Tags),
+		SystemPrompt: strings.TrimSpace(req.SystemPrompt),
+	}
+	chatID, err := m.newChat(ctx, c)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to create new chat", slog.String(errLoggerKey, err.Error()))
+		return models.Chat{}, err
+	}
+	c.ID = chatID
+	return c, nil
+}
+
+// apiMessages returns the messages of the chat of chatID at or after since, if userID sees it.
+func (m *Main) apiMessages(ctx context.Context, userID, chatID string, since time.Time) ([]models.Message, int, error) {
+	chats, err := m.apiChats(ctx, userID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if !slices.ContainsFunc(chats, func(c models.Chat) bool { return c.ID == chatID }) {
+		return nil, http.StatusNotFound, errChatNotFound
+	}
+
+	messages, err := m.store.MessagesSince(ctx, chatID, since)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to get messages", slog.String(errLoggerKey, err.Error()))
+		return nil, http.StatusInternalServerError, err
+	}
+	return withoutDrafts(messages), http.StatusOK, nil
+}
+
+// apiGeneration is the generation of the response to a message sent with the chat API, started by
+// startAPIMessage and run by runAPIGeneration.
+type apiGeneration struct {
+	// ctx is the context of the generation, outliving the request.
+	ctx      context.Context
+	userID   string
+	chatID   string
+	messages []models.Message
+}
+
+// startAPIMessage adds the user message of req to the chat of chatID, and the assistant message of its
+// response, returning the generation of the response to run.
+func (m *Main) startAPIMessage(
+	ctx context.Context,
+	userID, chatID string,
+	req apiSendMessageRequest,
+) (apiGeneration, int, error) {
+	if req.Text == "" {
+		return apiGeneration{}, http.StatusBadRequest, errors.New("text is required")
+	}
+	responseSchema, err := parseResponseSchema(req.ResponseSchema)
+	if err != nil {
+		return apiGeneration{}, http.StatusBadRequest, err
+	}
+
+	chats, err := m.apiChats(ctx, userID)
+	if err != nil {
+		return apiGeneration{}, http.StatusInternalServerError, err
+	}
+	idx := slices.IndexFunc(chats, func(c models.Chat) bool { return c.ID == chatID })
+	if idx < 0 {
+		return apiGeneration{}, http.StatusNotFound, errChatNotFound
+	}
+
+	if status, err := m.quotaStatus(ctx, userID); err != nil {
+		return apiGeneration{}, status, err
+	}
+
+	if err := m.continueChat(ctx, chatID); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to continue chat", slog.String(errLoggerKey, err.Error()))
+		return apiGeneration{}, http.StatusInternalServerError, err
+	}
+
+	um := models.Message{
+		ID:   uuid.New().String(),
+		Role: models.RoleUser,
+		Contents: []models.Content{
+			{
+				Type: models.ContentTypeText,
+				Text: req.Text,
+			},
+		},
+		Timestamp: time.Now(),
+		UserID:    userID,
+	}
+	if um.ID, err = m.store.AddMessage(ctx, chatID, um); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to add user message",
+			slog.String("message", fmt.Sprintf("%+v", um)),
+			slog.String(errLoggerKey, err.Error()))
+		return apiGeneration{}, http.StatusInternalServerError, err
+	}
+	m.recordUsage(ctx, userID, 1, 0)
+
+	am := models.Message{
+		ID:        uuid.New().String(),
+		Role:      models.RoleAssistant,
+		Timestamp: time.Now(),
+	}
+	if am.ID, err = m.store.AddMessage(ctx, chatID, am); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to add AI message",
+			slog.String("message", fmt.Sprintf("%+v", am)),
+			slog.String(errLoggerKey, err.Error()))
+		return apiGeneration{}, http.StatusInternalServerError, err
+	}
+
+	messages, err := m.store.MessagePath(ctx, chatID, am.ID)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to get messages",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		return apiGeneration{}, http.StatusInternalServerError, err
+	}
+
+	m.publishChatMessages(ctx, chatID, um, am)
+
+	if chats[idx].Title == "" {
+		m.queueChatTitle(ctx, chatID, req.Text)
+	}
+
+	genCtx := m.generationContext(ctx, userID)
+	if responseSchema != nil {
+		genCtx = models.WithResponseSchema(genCtx, responseSchema)
+	}
+	return apiGeneration{ctx: genCtx, userID: userID, chatID: chatID, messages: messages}, 0, nil
+}
+
+// runAPIGeneration generates the response of g, calling chunk with every piece of it, and returns the
+// complete assistant message.
+func (m *Main) runAPIGeneration(g apiGeneration, chunk func(models.Content)) (models.Message, error) {
+	ctx, messages := g.ctx, g.messages
+	prev := messages[len(messages)-1]
+	aiMsg, err := m.generate(ctx, g.chatID, m.llm, messages, func(msg models.Message) error {
+		if err := m.store.UpdateMessage(ctx, g.chatID, msg); err != nil {
+			return err
+		}
+		for _, c := range contentChunks(prev, msg) {
+			chunk(c)
+		}
+		// The generation appends to the texts in place, so we keep our own copy of the contents.
+		prev = msg
+		prev.Contents = slices.Clone(msg.Contents)
+		return nil
+	})
+	m.recordUsage(ctx, g.userID, 0,
+		estimateTokens(messages[:len(messages)-1])+estimateTokens([]models.Message{aiMsg}))
+	m.publishCompletion(ctx, g.chatID, aiMsg, err)
+	return aiMsg, err
+}
+
+// createAPIBatch queues the batch of template against inputs, whose columns are the names of their values.
+func (m *Main) createAPIBatch(
+	ctx context.Context,
+	userID, name, template string,
+	inputs []map[string]string,
+) (batch, int, error) {
+	var columns []string
+	for _, input := range inputs {
+		for column := range input {
+			if !slices.Contains(columns, column) {
+				columns = append(columns, column)
+			}
+		}
+	}
+	slices.Sort(columns)
+	rows := make([][]string, len(inputs))
+	for i, input := range inputs {
+		rows[i] = make([]string, len(columns))
+		for j, column := range columns {
+			rows[i][j] = input[column]
+		}
+	}
+	return m.startBatch(ctx, userID, name, template, columns, rows)
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/MegaGrindStone/go-mcp"
+)
+
+// maxAutocompleteValues is the maximum number of values suggested for an argument, which is also the
+// maximum number of values an MCP server returns for a completion.
+const maxAutocompleteValues = 100
+
+// HandleAutocomplete proxies the completion of an argument of a prompt or a resource template to its MCP
+// server, for the argument forms to suggest the values while the user types. It accepts GET requests with
+// the ref parameter, "prompt" or "resource", the name parameter with the name of the prompt or the URI
+// template of the resource template, and the argument parameter. The value being typed is read from the
+// field of the argument in the forms, arg_<name> for the prompts and var_<name> for the resource
+// templates. It renders the suggested values as the options of a datalist, none if the server fails to
+// complete the argument.
+func (m *Main) HandleAutocomplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("name")
+	argument := r.FormValue("argument")
+	caps := m.capabilities()
+
+	params := mcp.CompletesCompletionParams{Argument: mcp.CompletionArgument{Name: argument}}
+	var complete func(context.Context, mcp.CompletesCompletionParams) (mcp.CompletionResult, error)
+	switch r.FormValue("ref") {
+	case "prompt":
+		params.Ref = mcp.CompletionRef{Type: "ref/prompt", Name: name}
+		params.Argument.Value = r.FormValue("arg_" + argument)
+		if clientIdx, ok := caps.promptsMap[name]; ok {
+			complete = m.mcpClients[clientIdx].CompletesPrompt
+		}
+	case "resource":
+		params.Ref = mcp.CompletionRef{Type: "ref/resource", URI: name}
+		params.Argument.Value = r.FormValue("var_" + argument)
+		if clientIdx, ok := caps.resourceTemplatesMap[name]; ok {
+			complete = m.mcpClients[clientIdx].CompletesResourceTemplate
+		}
+	default:
+		http.Error(w, "Invalid ref", http.StatusBadRequest)
+		return
+	}
+	if complete == nil {
+		http.Error(w, "Prompt or resource template not found", http.StatusNotFound)
+		return
+	}
+
+	var values []string
+	res, err := complete(r.Context(), params)
+	if err != nil {
+		// The servers not supporting the completions fail every time, which isn't worth more than a warning.
+		m.logger.WarnContext(r.Context(), "Failed to complete argument",
+			slog.String("ref", params.Ref.Type),
+			slog.String("name", name),
+			slog.String("argument", argument),
+			slog.String(errLoggerKey, err.Error()))
+	} else {
+		values = res.Completion.Values
+		if len(values) > maxAutocompleteValues {
+			values = values[:maxAutocompleteValues]
+		}
+	}
+
+	if err := m.templates.ExecuteTemplate(w, "autocomplete_options", values); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute autocomplete_options template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Backup schedules the backups of the store, written as gzip-compressed snapshots to a destination.
+type Backup struct {
+	// Cron is a standard five-field cron expression of the backups, evaluated in the server's local time.
+	// The backups are only run at /admin/backup if it's empty.
+	Cron string
+	// Destination is where the backups are written, like a local directory or an S3-compatible bucket.
+	Destination BackupDestination
+	// Keep is the number of the latest backups kept in Destination, the older ones being deleted after
+	// every backup. All the backups are kept if it's zero.
+	Keep int
+}
+
+// BackupDestination stores the backups of the store, named by their time, so their names sort in the
+// order they were made.
+type BackupDestination interface {
+	// Put writes the size bytes of r as the backup with the given name.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// List returns the names of the backups.
+	List(ctx context.Context) ([]string, error)
+	// Delete deletes the backup with the given name.
+	Delete(ctx context.Context, name string) error
+}
+
+// Snapshotter is implemented by the stores that can write a consistent snapshot of all their data, like
+// the BoltDB store, whose snapshot is a copy of its database file.
+type Snapshotter interface {
+	Snapshot(ctx context.Context, w io.Writer) error
+}
+
+type backupResult struct {
+	Name    string   `json:"name"`
+	Size    int64    `json:"size"`
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+const (
+	backupPrefix = "mcpwebui-"
+	backupSuffix = ".db.gz"
+)
+
+// WithBackup enables the backups of the store to the destination of backup, on its schedule and at
+// /admin/backup. NewMain returns an error if the cron expression is invalid, or the store doesn't implement
+// Snapshotter.
+func WithBackup(backup Backup) MainOption {
+	return func(m *Main) {
+		m.backup = backup
+	}
+}
+
+func (m *Main) parseBackup() error {
+	if m.backup.Destination == nil {
+		return nil
+	}
+	if _, ok := m.storeBackend.(Snapshotter); !ok {
+		return fmt.Errorf("store doesn't support backups")
+	}
+	if m.backup.Cron == "" {
+		return nil
+	}
+	c, err := parseCron(m.backup.Cron)
+	if err != nil {
+		return fmt.Errorf("invalid cron expression of backup: %w", err)
+	}
+	m.backupCron = c
+	return nil
+}
+
+// runBackupScheduler wakes up at the start of every minute and backs up the store if the schedule of the
+// backups matches it, until Main is shut down.
+func (m *Main) runBackupScheduler() {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-m.backgroundDone:
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		if m.backupCron.matches(next) {
+			ctx := context.Background()
+			if _, err := m.backUp(ctx); err != nil {
+				m.logger.ErrorContext(ctx, "Failed to back up store", slog.String(errLoggerKey, err.Error()))
+			}
+		}
+	}
+}
+
+// backUp writes a compressed snapshot of the store to the destination, then deletes the backups beyond the
+// ones to keep. The snapshot is compressed to a temporary file first, as the destinations need its size.
+func (m *Main) backUp(ctx context.Context) (backupResult, error) {
+	s, ok := m.storeBackend.(Snapshotter)
+	if !ok {
+		return backupResult{}, fmt.Errorf("store doesn't support backups")
+	}
+
+	f, err := os.CreateTemp("", "mcpwebui-backup-*")
+	if err != nil {
+		return backupResult{}, fmt.Errorf("failed to create backup file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	zw := gzip.NewWriter(f)
+	if err := s.Snapshot(ctx, zw); err != nil {
+		return backupResult{}, fmt.Errorf("failed to snapshot store: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return backupResult{}, fmt.Errorf("failed to compress backup: %w", err)
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return backupResult{}, fmt.Errorf("failed to get backup size: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return backupResult{}, fmt.Errorf("failed to rewind backup file: %w", err)
+	}
+
+	res := backupResult{
+		Name: backupPrefix + time.Now().UTC().Format("20060102T150405Z") + backupSuffix,
+		Size: size,
+	}
+	if err := m.backup.Destination.Put(ctx, res.Name, f, size); err != nil {
+		return res, fmt.Errorf("failed to write backup: %w", err)
+	}
+	if res.Deleted, err = m.pruneBackups(ctx); err != nil {
+		return res, err
+	}
+
+	m.logger.InfoContext(ctx, "Store backup completed",
+		slog.String("name", res.Name),
+		slog.Int64("size", res.Size),
+		slog.Int("deleted", len(res.Deleted)))
+	return res, nil
+}
+
+// pruneBackups deletes the oldest backups beyond the ones to keep, and returns their names. The other files
+// of the destination are left untouched.
+func (m *Main) pruneBackups(ctx context.Context) ([]string, error) {
+	if m.backup.Keep <= 0 {
+		return nil, nil
+	}
+	names, err := m.backup.Destination.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	names = slices.DeleteFunc(names, func(name string) bool {
+		return !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix)
+	})
+	if len(names) <= m.backup.Keep {
+		return nil, nil
+	}
+
+	slices.Sort(names)
+	var deleted []string
+	for _, name := range names[:len(names)-m.backup.Keep] {
+		if err := m.backup.Destination.Delete(ctx, name); err != nil {
+			return deleted, fmt.Errorf("failed to delete backup %s: %w", name, err)
+		}
+		deleted = append(deleted, name)
+	}
+	return deleted, nil
+}
+
+// HandleBackup backs up the store immediately, regardless of the schedule of the backups, and responds
+// with the name and size of the backup, and the old backups deleted, as JSON. It responds with 404 Not
+// Found if the backups are disabled.
+func (m *Main) HandleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		m.writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if m.backup.Destination == nil {
+		m.writeAPIError(w, http.StatusNotFound, "Backups are disabled")
+		return
+	}
+
+	res, err := m.backUp(r.Context())
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to back up store", slog.String(errLoggerKey, err.Error()))
+		m.writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	m.writeAPIJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,512 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// Batches configures the batch runner, which runs a prompt template against every row of inputs of a CSV
+// file through the same pipeline as the chats, MCP tools included, like for the evaluation tasks.
+type Batches struct {
+	// Concurrency is the number of rows generated at the same time, across all the batches. It defaults to 2.
+	Concurrency int
+	// MaxRows is the maximum number of rows of a batch. It defaults to 1000.
+	MaxRows int
+}
+
+// batches holds the batches run since the server started, the oldest first. The rows of the batches are
+// guarded by mu too, as the workers update them.
+type batches struct {
+	mu    sync.Mutex
+	items []*batch
+}
+
+// batch is a run of a prompt template against rows of inputs, whose values fill the {{column}} placeholders
+// of the template.
+type batch struct {
+	ID        string
+	UserID    string
+	Name      string
+	Template  string
+	Columns   []string
+	CreatedAt time.Time
+	Rows      []batchRow
+}
+
+type batchRow struct {
+	// Number is the position of the row in the batch, from 1.
+	Number int
+	// Inputs are the values of the row, in the order of the columns of the batch.
+	Inputs []string
+	Prompt string
+	Status string
+	// Output is the final text of the response, after the tool calls.
+	Output     string
+	Error      string
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// batchJob is the generation of a row of a batch, queued for the workers.
+type batchJob struct {
+	batch *batch
+	row   int
+}
+
+type batchesPageData struct {
+	Batches []batch
+	// Batch is the batch shown in details, nil if none is selected.
+	Batch *batch
+}
+
+const (
+	defaultBatchConcurrency = 2
+	defaultBatchMaxRows     = 1000
+
+	// maxBatchesKept is the number of finished batches kept in memory, the oldest ones being dropped.
+	maxBatchesKept = 50
+	// maxBatchUploadSize is the maximum size of the form uploading a CSV file of inputs.
+	maxBatchUploadSize = 10 << 20
+
+	batchRowQueued  = "queued"
+	batchRowRunning = "running"
+	batchRowDone    = "done"
+	batchRowFailed  = "failed"
+)
+
+var (
+	// batchPlaceholderPattern matches a {{column}} placeholder of a batch template, with the column name.
+	batchPlaceholderPattern = regexp.MustCompile(`\{\{\s*([^{}]*?)\s*\}\}`)
+
+	errBatchNotFound  = errors.New("batch not found")
+	errBatchQueueFull = errors.New("too many rows are queued, try again once the running batches are finished")
+)
+
+// WithBatches configures the batch runner. Without it, the batch runner uses its defaults.
+func WithBatches(b Batches) MainOption {
+	return func(m *Main) {
+		m.batchRunner = b
+	}
+}
+
+func (m *Main) parseBatches() {
+	if m.batchRunner.Concurrency <= 0 {
+		m.batchRunner.Concurrency = defaultBatchConcurrency
+	}
+	if m.batchRunner.MaxRows <= 0 {
+		m.batchRunner.MaxRows = defaultBatchMaxRows
+	}
+	m.batches = &batches{}
+	// The queue holds the rows of several full batches, the ones beyond are rejected rather than blocking the
+	// requests.
+	m.batchQueue = make(chan batchJob, 10*m.batchRunner.MaxRows)
+}
+
+// HandleBatches renders the batches page of the current user on GET, with the details of the batch given by
+// the "id" query parameter, if any. On POST, it runs the template of the "template" form field against the
+// rows of the CSV file of the "inputs" field, whose first row names the columns, and redirects to the
+// details of the new batch.
+func (m *Main) HandleBatches(w http.ResponseWriter, r *http.Request) {
+	userID := m.userID(r)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxBatchUploadSize)
+		file, _, err := r.FormFile("inputs")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read the inputs file: %s", err), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		columns, rows, err := parseBatchCSV(file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		b, status, err := m.startBatch(r.Context(), userID, r.FormValue("name"), r.FormValue("template"), columns, rows)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		http.Redirect(w, r, "/batches?id="+b.ID, http.StatusSeeOther)
+		return
+	default:
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := batchesPageData{Batches: m.batches.list(userID)}
+	if batchID := r.URL.Query().Get("id"); batchID != "" {
+		b, err := m.batches.get(userID, batchID)
+		if err != nil {
+			http.Error(w, "Batch not found", http.StatusNotFound)
+			return
+		}
+		data.Batch = &b
+	}
+
+	if err := m.renderPage(w, "batches.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute batches template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleBatchResults downloads the rows of the batch given by the "id" query parameter, with their prompts,
+// statuses and outputs, as CSV, or as JSON lines if the "format" query parameter is "jsonl".
+func (m *Main) HandleBatchResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := m.batches.get(m.userID(r), r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "csv":
+		format = "csv"
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	default:
+		http.Error(w, fmt.Sprintf("Unknown format %s, expected csv or jsonl", format), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="batch-%s.%s"`, b.ID, format))
+
+	if format == "jsonl" {
+		enc := json.NewEncoder(w)
+		for i := range b.Rows {
+			if err := enc.Encode(newAPIBatchRow(b, i)); err != nil {
+				m.logger.ErrorContext(r.Context(), "Failed to write batch results", slog.String(errLoggerKey, err.Error()))
+				return
+			}
+		}
+		return
+	}
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write(slices.Concat(b.Columns, []string{"prompt", "status", "output", "error"}))
+	for _, row := range b.Rows {
+		_ = cw.Write(slices.Concat(row.Inputs, []string{row.Prompt, row.Status, row.Output, row.Error}))
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to write batch results", slog.String(errLoggerKey, err.Error()))
+	}
+}
+
+// parseBatchCSV returns the columns named by the first row of the CSV of r, and the rows of values below.
+func parseBatchCSV(r io.Reader) ([]string, [][]string, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CSV file: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, nil, errors.New("the CSV file is empty")
+	}
+	columns := records[0]
+	// Spreadsheets often save their CSV files with a byte order mark.
+	columns[0] = strings.TrimPrefix(columns[0], "\ufeff")
+	return columns, records[1:], nil
+}
+
+// startBatch queues a batch of userID running template against rows, whose values are in the order of
+// columns. It returns the batch, or the error and the HTTP status of the request starting it.
+func (m *Main) startBatch(
+	ctx context.Context,
+	userID, name, template string,
+	columns []string,
+	rows [][]string,
+) (batch, int, error) {
+	b, err := m.newBatch(userID, name, template, columns, rows)
+	if err != nil {
+		return batch{}, http.StatusBadRequest, err
+	}
+
+	if status, err := m.quotaStatus(ctx, userID); err != nil {
+		return batch{}, status, err
+	}
+
+	if err := m.batches.add(b, m.batchQueue); err != nil {
+		return batch{}, http.StatusServiceUnavailable, err
+	}
+	m.logger.InfoContext(ctx, "Batch queued",
+		slog.String("batchID", b.ID),
+		slog.Int("rows", len(b.Rows)))
+	return b.clone(), 0, nil
+}
+
+// newBatch returns a batch of template against rows, checking that every placeholder of the template is a
+// column, and that every row has a value for every column.
+func (m *Main) newBatch(userID, name, template string, columns []string, rows [][]string) (*batch, error) {
+	if strings.TrimSpace(template) == "" {
+		return nil, errors.New("template is required")
+	}
+	columns = slices.Clone(columns)
+	for i, column := range columns {
+		columns[i] = strings.TrimSpace(column)
+		if columns[i] == "" {
+			return nil, fmt.Errorf("column %d has no name", i+1)
+		}
+		if slices.Contains(columns[:i], columns[i]) {
+			return nil, fmt.Errorf("duplicated column %s", columns[i])
+		}
+	}
+	for _, match := range batchPlaceholderPattern.FindAllStringSubmatch(template, -1) {
+		if !slices.Contains(columns, match[1]) {
+			return nil, fmt.Errorf("unknown column %s in the template, the columns are: %s", match[1],
+				strings.Join(columns, ", "))
+		}
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("at least one row of inputs is required")
+	}
+	if len(rows) > m.batchRunner.MaxRows {
+		return nil, fmt.Errorf("too many rows, a batch has at most %d rows", m.batchRunner.MaxRows)
+	}
+
+	b := &batch{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Name:      strings.TrimSpace(name),
+		Template:  template,
+		Columns:   columns,
+		CreatedAt: time.Now(),
+		Rows:      make([]batchRow, len(rows)),
+	}
+	if b.Name == "" {
+		b.Name = "Batch of " + b.CreatedAt.Format("2006-01-02 15:04")
+	}
+	for i, inputs := range rows {
+		if len(inputs) != len(columns) {
+			return nil, fmt.Errorf("row %d has %d values, expected %d", i+1, len(inputs), len(columns))
+		}
+		b.Rows[i] = batchRow{
+			Number: i + 1,
+			Inputs: inputs,
+			Prompt: b.prompt(inputs),
+			Status: batchRowQueued,
+		}
+	}
+	return b, nil
+}
+
+// prompt returns the template of the batch with its placeholders filled with inputs.
+func (b batch) prompt(inputs []string) string {
+	return batchPlaceholderPattern.ReplaceAllStringFunc(b.Template, func(placeholder string) string {
+		column := batchPlaceholderPattern.FindStringSubmatch(placeholder)[1]
+		return inputs[slices.Index(b.Columns, column)]
+	})
+}
+
+// runBatchWorker generates the queued rows of the batches one at a time, until the background work is
+// stopped.
+func (m *Main) runBatchWorker() {
+	for {
+		select {
+		case <-m.backgroundDone:
+			return
+		case job := <-m.batchQueue:
+			m.runBatchRow(job)
+		}
+	}
+}
+
+// runBatchRow generates the response of a row of a batch on behalf of the user of the batch, outside of any
+// chat, and records its output or its error.
+func (m *Main) runBatchRow(job batchJob) {
+	b := job.batch
+	ctx := m.generationContext(context.Background(), b.UserID)
+	prompt := m.batches.start(job)
+
+	reason, err := m.exceededQuota(ctx, b.UserID)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to check quota", slog.String(errLoggerKey, err.Error()))
+		m.batches.finish(job, "", err)
+		return
+	}
+	if reason != "" {
+		m.batches.finish(job, "", errors.New(reason))
+		return
+	}
+
+	now := time.Now()
+	messages := []models.Message{
+		{
+			ID:        uuid.New().String(),
+			Role:      models.RoleUser,
+			Contents:  []models.Content{{Type: models.ContentTypeText, Text: prompt}},
+			Timestamp: now,
+		},
+		{
+			ID:        uuid.New().String(),
+			Role:      models.RoleAssistant,
+			Timestamp: now,
+		},
+	}
+	m.recordUsage(ctx, b.UserID, 1, 0)
+	aiMsg, err := m.generate(ctx, "", m.llm, messages, func(models.Message) error { return nil })
+	m.recordUsage(ctx, b.UserID, 0, estimateTokens(messages[:1])+estimateTokens([]models.Message{aiMsg}))
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to generate batch row",
+			slog.String("batchID", b.ID),
+			slog.Int("row", job.row+1),
+			slog.String(errLoggerKey, err.Error()))
+	}
+	m.batches.finish(job, batchOutput(aiMsg), err)
+}
+
+// batchOutput returns the last text of the response, the answer following the tool calls, if any.
+func batchOutput(aiMsg models.Message) string {
+	for _, content := range slices.Backward(aiMsg.Contents) {
+		if content.Type == models.ContentTypeText && strings.TrimSpace(content.Text) != "" {
+			return strings.TrimSpace(content.Text)
+		}
+	}
+	return ""
+}
+
+// add adds b and queues its rows, unless queue can't hold them all. The oldest finished batches beyond
+// maxBatchesKept are dropped.
+func (bs *batches) add(b *batch, queue chan<- batchJob) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	// The workers only take from the queue, so the sends below don't block once there's room for all the rows.
+	if cap(queue)-len(queue) < len(b.Rows) {
+		return errBatchQueueFull
+	}
+	for i := range b.Rows {
+		queue <- batchJob{batch: b, row: i}
+	}
+
+	bs.items = append(bs.items, b)
+	finished := 0
+	for _, item := range bs.items {
+		if item.Finished() {
+			finished++
+		}
+	}
+	for i := 0; finished > maxBatchesKept && i < len(bs.items); {
+		if bs.items[i].Finished() {
+			bs.items = slices.Delete(bs.items, i, i+1)
+			finished--
+			continue
+		}
+		i++
+	}
+	return nil
+}
+
+// list returns copies of the batches of userID, the newest first.
+func (bs *batches) list(userID string) []batch {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	var res []batch
+	for _, b := range slices.Backward(bs.items) {
+		if b.UserID == userID {
+			res = append(res, b.clone())
+		}
+	}
+	return res
+}
+
+// deleteUser drops the batches of userID, and returns their number. The rows of the running ones are still
+// generated, but no longer listed.
+func (bs *batches) deleteUser(userID string) int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	n := len(bs.items)
+	bs.items = slices.DeleteFunc(bs.items, func(b *batch) bool { return b.UserID == userID })
+	return n - len(bs.items)
+}
+
+// get returns a copy of the batch of batchID, if it's a batch of userID.
+func (bs *batches) get(userID, batchID string) (batch, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	for _, b := range bs.items {
+		if b.ID == batchID && b.UserID == userID {
+			return b.clone(), nil
+		}
+	}
+	return batch{}, errBatchNotFound
+}
+
+// start marks the row of job as running, and returns its prompt.
+func (bs *batches) start(job batchJob) string {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	row := &job.batch.Rows[job.row]
+	row.Status = batchRowRunning
+	row.StartedAt = time.Now()
+	return row.Prompt
+}
+
+// finish records the output of the row of job, or its error.
+func (bs *batches) finish(job batchJob, output string, err error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	row := &job.batch.Rows[job.row]
+	row.FinishedAt = time.Now()
+	row.Output = output
+	row.Status = batchRowDone
+	if err != nil {
+		row.Status = batchRowFailed
+		row.Error = err.Error()
+	}
+}
+
+func (b batch) clone() batch {
+	b.Rows = slices.Clone(b.Rows)
+	return b
+}
+
+// Count returns the number of rows of the batch with status.
+func (b batch) Count(status string) int {
+	count := 0
+	for _, row := range b.Rows {
+		if row.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Progress returns the number of rows of the batch generated, successfully or not.
+func (b batch) Progress() int {
+	return b.Count(batchRowDone) + b.Count(batchRowFailed)
+}
+
+// Finished reports whether all the rows of the batch are generated.
+func (b batch) Finished() bool {
+	return b.Progress() == len(b.Rows)
+}
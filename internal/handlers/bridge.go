@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// Bridge connects an external messaging service, like a chat bot or a mailbox, to the chats. Every external
+// conversation is mapped to a chat, created on its first message, and the responses of the LLM are streamed
+// back to it, with the same tools, memories and quotas as the chats of the web UI.
+type Bridge interface {
+	// Name identifies the bridge, like telegram. The users of the bridge are named "<name>:<user>" in the
+	// chats and the quotas, and its conversations "<name>:<conversation>".
+	Name() string
+	// Receive blocks until the next messages of the conversations are received, or ctx is done.
+	Receive(ctx context.Context) ([]models.BridgeMessage, error)
+	// Reply sends reply to its conversation, or updates the message of reply if it has an ID, and returns the
+	// ID of the message.
+	Reply(ctx context.Context, reply models.BridgeReply) (string, error)
+}
+
+// bridgeLocks serializes the messages of every external conversation, so a message is answered after the
+// previous one.
+type bridgeLocks struct {
+	mu    sync.Mutex
+	items map[string]*bridgeLock
+}
+
+type bridgeLock struct {
+	sync.Mutex
+	waiting int
+}
+
+const (
+	// bridgeNewChatCommand starts a new chat for the conversation it's sent in.
+	bridgeNewChatCommand = "/new"
+
+	// bridgeUpdateInterval is the minimum interval between the updates of a streamed reply, as the messaging
+	// services limit their rate.
+	bridgeUpdateInterval = time.Second
+	// bridgeRetryDelay is the delay before receiving the messages again after a failure.
+	bridgeRetryDelay = 5 * time.Second
+)
+
+// WithBridges connects the bridges to the chats. NewMain returns an error if a bridge has an invalid or a
+// duplicated name.
+func WithBridges(bridges ...Bridge) MainOption {
+	return func(m *Main) {
+		m.bridges = append(m.bridges, bridges...)
+	}
+}
+
+func (m *Main) parseBridges() error {
+	var names []string
+	for _, b := range m.bridges {
+		name := b.Name()
+		if name == "" || strings.Contains(name, ":") {
+			return fmt.Errorf("bridge name %q must not be empty or contain ':'", name)
+		}
+		if slices.Contains(names, name) {
+			return fmt.Errorf("duplicated bridge name %s", name)
+		}
+		names = append(names, name)
+	}
+	return nil
+}
+
+// runBridge receives the messages of b and answers them, until the background tasks are stopped.
+func (m *Main) runBridge(b Bridge) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.backgroundDone
+		cancel()
+	}()
+
+	for {
+		msgs, err := b.Receive(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			m.logger.WarnContext(ctx, "Failed to receive bridge messages",
+				slog.String("bridge", b.Name()),
+				slog.String(errLoggerKey, err.Error()))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(bridgeRetryDelay):
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			go m.handleBridgeMessage(b, msg)
+		}
+	}
+}
+
+// handleBridgeMessage answers msg in its conversation, after the previous messages of the conversation.
+func (m *Main) handleBridgeMessage(b Bridge, msg models.BridgeMessage) {
+	userID := b.Name() + ":" + msg.User
+	conversation := b.Name() + ":" + msg.Conversation
+	ctx := m.generationContext(context.Background(), userID)
+
+	unlock := m.bridgeLocks.lock(conversation)
+	defer unlock()
+
+	reply := models.BridgeReply{Conversation: msg.Conversation}
+	text, err := m.answerBridgeMessage(ctx, b, userID, conversation, msg, &reply)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to answer bridge message",
+			slog.String("bridge", b.Name()),
+			slog.String("conversation", conversation),
+			slog.String(errLoggerKey, err.Error()))
+		text = "Sorry, the message couldn't be answered. Please try again later."
+	}
+	reply.Text, reply.Final = text, true
+	if _, err := b.Reply(ctx, reply); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to send bridge reply",
+			slog.String("bridge", b.Name()),
+			slog.String("conversation", conversation),
+			slog.String(errLoggerKey, err.Error()))
+	}
+}
+
+// answerBridgeMessage adds msg to the chat of its conversation, and returns the text of the response, whose
+// parts are sent to reply as it's streamed.
+func (m *Main) answerBridgeMessage(
+	ctx context.Context,
+	b Bridge,
+	userID, conversation string,
+	msg models.BridgeMessage,
+	reply *models.BridgeReply,
+) (string, error) {
+	text := strings.TrimSpace(msg.Text)
+	if text == bridgeNewChatCommand {
+		if err := m.detachBridgeChat(ctx, conversation); err != nil {
+			return "", err
+		}
+		return "Started a new chat, the next message will be its first one.", nil
+	}
+
+	reason, err := m.exceededQuota(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to check quota: %w", err)
+	}
+	if reason != "" {
+		return reason, nil
+	}
+
+	chatID, isNewChat, err := m.bridgeChat(ctx, userID, conversation, text)
+	if err != nil {
+		return "", err
+	}
+	um := models.Message{
+		ID:        uuid.New().String(),
+		Role:      models.RoleUser,
+		Contents:  []models.Content{{Type: models.ContentTypeText, Text: text}},
+		Timestamp: time.Now(),
+		UserID:    userID,
+	}
+	if um.ID, err = m.store.AddMessage(ctx, chatID, um); err != nil {
+		return "", fmt.Errorf("failed to add user message: %w", err)
+	}
+	m.recordUsage(ctx, userID, 1, 0)
+	am := models.Message{
+		ID:        uuid.New().String(),
+		Role:      models.RoleAssistant,
+		Timestamp: time.Now(),
+	}
+	if am.ID, err = m.store.AddMessage(ctx, chatID, am); err != nil {
+		return "", fmt.Errorf("failed to add AI message: %w", err)
+	}
+	messages, err := m.store.MessagePath(ctx, chatID, am.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get messages: %w", err)
+	}
+	if !isNewChat {
+		m.publishChatMessages(ctx, chatID, um, am)
+	}
+
+	m.claimMessageTopic(chatID, am.ID, userID)
+	var lastUpdate time.Time
+	aiMsg, err := m.chatWithUpdates(ctx, userID, chatID, messages, func(msg models.Message) {
+		partial := bridgeText(msg)
+		if partial == "" || time.Since(lastUpdate) < bridgeUpdateInterval {
+			return
+		}
+		lastUpdate = time.Now()
+		reply.Text = partial
+		id, err := b.Reply(ctx, *reply)
+		if err != nil {
+			// The final reply is still sent, the partial ones only show the progress.
+			m.logger.WarnContext(ctx, "Failed to update bridge reply", slog.String(errLoggerKey, err.Error()))
+			return
+		}
+		reply.ID = id
+	})
+	if err != nil {
+		return "", err
+	}
+	if text := bridgeText(aiMsg); text != "" {
+		return text, nil
+	}
+	return "The assistant didn't respond with any text.", nil
+}
+
+// bridgeChat returns the chat of conversation, creating it for userID with text as its first message if it
+// doesn't exist, and whether it's created.
+func (m *Main) bridgeChat(ctx context.Context, userID, conversation, text string) (string, bool, error) {
+	chats, err := m.store.Chats(ctx)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get chats: %w", err)
+	}
+	if idx := slices.IndexFunc(chats, func(c models.Chat) bool {
+		return c.BridgeConversation == conversation
+	}); idx >= 0 {
+		if err := m.continueChat(ctx, chats[idx].ID); err != nil {
+			return "", false, fmt.Errorf("failed to continue chat: %w", err)
+		}
+		return chats[idx].ID, false, nil
+	}
+
+	chatID, err := m.newChat(ctx, models.Chat{UserID: userID, BridgeConversation: conversation})
+	if err != nil {
+		return "", false, err
+	}
+	m.queueChatTitle(ctx, chatID, text)
+	return chatID, true, nil
+}
+
+// detachBridgeChat unmaps the chat of conversation, if any, so its next message starts a new chat. The chat
+// is kept.
+func (m *Main) detachBridgeChat(ctx context.Context, conversation string) error {
+	chats, err := m.store.Chats(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get chats: %w", err)
+	}
+	for _, c := range chats {
+		if c.BridgeConversation != conversation {
+			continue
+		}
+		c.BridgeConversation = ""
+		if err := m.store.UpdateChat(ctx, c); err != nil {
+			return fmt.Errorf("failed to update chat: %w", err)
+		}
+	}
+	return nil
+}
+
+// bridgeText returns the text of the response aiMsg as it's sent to the external conversations, the tool
+// calls being summarized by their names.
+func bridgeText(aiMsg models.Message) string {
+	var parts []string
+	for _, content := range aiMsg.Contents {
+		switch content.Type {
+		case models.ContentTypeText:
+			if text := strings.TrimSpace(content.Text); text != "" {
+				parts = append(parts, text)
+			}
+		case models.ContentTypeCallTool:
+			parts = append(parts, fmt.Sprintf("[Calling tool %s]", content.ToolName))
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// lock locks the conversation of key, and returns the function unlocking it.
+func (l *bridgeLocks) lock(key string) func() {
+	l.mu.Lock()
+	bl, ok := l.items[key]
+	if !ok {
+		bl = &bridgeLock{}
+		l.items[key] = bl
+	}
+	bl.waiting++
+	l.mu.Unlock()
+
+	bl.Lock()
+	return func() {
+		bl.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if bl.waiting--; bl.waiting == 0 {
+			delete(l.items, key)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// Budget is the spend budget of an LLM provider of WithBudgets. The spend is the cost of the tokens of the
+// generations of the provider, estimated like the usage of the users, at the prices of the budget.
+type Budget struct {
+	// InputPerMillionTokens and OutputPerMillionTokens are the prices of a million input and output tokens, in
+	// the currency of the limits.
+	InputPerMillionTokens  float64
+	OutputPerMillionTokens float64
+	// Daily and Monthly limit the spend of a day and of a month, in UTC. Zero means no limit.
+	Daily   float64
+	Monthly float64
+	// Thresholds are the fractions of the limits whose crossing shows a banner in the UI and notifies the
+	// Notifier, 0.8 and 1 if it's empty.
+	Thresholds []float64
+	// HardStop rejects the new generations of the provider once one of its limits is reached.
+	HardStop bool
+}
+
+// budgetedLLM records the spend of the generations of an LLM provider with a budget, and refuses them once
+// the budget is exhausted with a hard stop.
+type budgetedLLM struct {
+	LLM
+	main     *Main
+	provider string
+}
+
+// budgetPeriod is a period of a budget, with its spend.
+type budgetPeriod struct {
+	name  string
+	limit float64
+	spent float64
+}
+
+var defaultBudgetThresholds = []float64{0.8, 1}
+
+// WithBudgets sets the spend budgets of the LLM providers, keyed by "llm" or "compareLLM". NewMain returns an
+// error if a provider is unknown, or a price, limit or threshold is negative.
+func WithBudgets(budgets map[string]Budget) MainOption {
+	return func(m *Main) {
+		m.budgets = maps.Clone(budgets)
+	}
+}
+
+func (m *Main) parseBudgets() error {
+	for provider, budget := range m.budgets {
+		if provider != providerLLM && provider != providerCompareLLM {
+			return fmt.Errorf("unknown budget provider %q, expected llm or compareLLM", provider)
+		}
+		if budget.InputPerMillionTokens < 0 || budget.OutputPerMillionTokens < 0 ||
+			budget.Daily < 0 || budget.Monthly < 0 {
+			return fmt.Errorf("the prices and limits of the %s budget must not be negative", provider)
+		}
+		if slices.ContainsFunc(budget.Thresholds, func(t float64) bool { return t <= 0 }) {
+			return fmt.Errorf("the thresholds of the %s budget must be positive", provider)
+		}
+		if len(budget.Thresholds) == 0 {
+			budget.Thresholds = defaultBudgetThresholds
+		}
+		slices.Sort(budget.Thresholds)
+		m.budgets[provider] = budget
+	}
+	return nil
+}
+
+// budgetLLM wraps llm to record the spend of provider, if it has a budget.
+func (m *Main) budgetLLM(provider string, llm LLM) LLM {
+	if _, ok := m.budgets[provider]; !ok || llm == nil {
+		return llm
+	}
+	return budgetedLLM{LLM: llm, main: m, provider: provider}
+}
+
+// Chat implements LLM, refusing the generation if the budget is exhausted with a hard stop, and recording
+// the spend of the request and its response once it ends.
+func (b budgetedLLM) Chat(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+) iter.Seq2[models.Content, error] {
+	return func(yield func(models.Content, error) bool) {
+		reason, err := b.main.exhaustedBudget(ctx, b.provider)
+		if err != nil {
+			b.main.logger.ErrorContext(ctx, "Failed to check budget", slog.String(errLoggerKey, err.Error()))
+		}
+		if reason != "" {
+			yield(models.Content{}, errors.New(reason))
+			return
+		}
+
+		response := models.Message{Role: models.RoleAssistant}
+		for content, err := range b.LLM.Chat(ctx, messages, tools) {
+			if err == nil {
+				response.Contents = append(response.Contents, content)
+			}
+			if !yield(content, err) {
+				break
+			}
+		}
+		b.main.recordSpend(ctx, b.provider, estimateTokens(messages), estimateTokens([]models.Message{response}))
+	}
+}
+
+// Model returns the model of the wrapped LLM.
+func (b budgetedLLM) Model() string {
+	return modelName(b.LLM)
+}
+
+// budgetPeriods returns the periods of the budget of provider with a limit, with their spend at now.
+func (m *Main) budgetPeriods(ctx context.Context, provider string, now time.Time) ([]budgetPeriod, error) {
+	budget := m.budgets[provider]
+	if budget.Daily == 0 && budget.Monthly == 0 {
+		return nil, nil
+	}
+	day := usageDay(now)
+	spends, err := m.store.Spends(ctx, provider, day[:len("2006-01")])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get spends: %w", err)
+	}
+	var daily, monthly float64
+	for _, spend := range spends {
+		monthly += spend.Cost
+		if spend.Day == day {
+			daily += spend.Cost
+		}
+	}
+
+	var periods []budgetPeriod
+	if budget.Daily > 0 {
+		periods = append(periods, budgetPeriod{name: "daily", limit: budget.Daily, spent: daily})
+	}
+	if budget.Monthly > 0 {
+		periods = append(periods, budgetPeriod{name: "monthly", limit: budget.Monthly, spent: monthly})
+	}
+	return periods, nil
+}
+
+// exhaustedBudget returns the reason to refuse the generations of provider if it has a hard stop and one of
+// its limits is reached, or an empty string.
+func (m *Main) exhaustedBudget(ctx context.Context, provider string) (string, error) {
+	if !m.budgets[provider].HardStop {
+		return "", nil
+	}
+	periods, err := m.budgetPeriods(ctx, provider, time.Now())
+	if err != nil {
+		return "", err
+	}
+	for _, p := range periods {
+		if p.spent >= p.limit {
+			return fmt.Sprintf("The %s budget of the %s is exhausted, new responses are refused.", p.name,
+				providerLabel(provider)), nil
+		}
+	}
+	return "", nil
+}
+
+// recordSpend adds the cost of the tokens of a generation to the spend of provider, and notifies the
+// thresholds of its budget the spend crossed. The failures are logged only, as they don't fail the
+// generation.
+func (m *Main) recordSpend(ctx context.Context, provider string, inputTokens, outputTokens int) {
+	budget := m.budgets[provider]
+	now := time.Now()
+	spend := models.Spend{
+		Provider:     provider,
+		Day:          usageDay(now),
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+		Cost: (float64(inputTokens)*budget.InputPerMillionTokens +
+			float64(outputTokens)*budget.OutputPerMillionTokens) / 1e6,
+	}
+
+	// The spend is read and added under the lock, so a crossed threshold is notified once.
+	m.spendMu.Lock()
+	defer m.spendMu.Unlock()
+
+	periods, err := m.budgetPeriods(ctx, provider, now)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to get budget", slog.String(errLoggerKey, err.Error()))
+	}
+	if err := m.store.AddSpend(ctx, spend); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to add spend",
+			slog.String("spend", fmt.Sprintf("%+v", spend)),
+			slog.String(errLoggerKey, err.Error()))
+		return
+	}
+
+	for _, p := range periods {
+		for _, threshold := range budget.Thresholds {
+			limit := threshold * p.limit
+			if p.spent >= limit || p.spent+spend.Cost < limit {
+				continue
+			}
+			m.logger.WarnContext(ctx, "Budget threshold crossed",
+				slog.String("provider", provider),
+				slog.String("period", p.name),
+				slog.Float64("threshold", threshold))
+			m.notify(ctx, models.Event{
+				Type: models.EventBudgetThreshold,
+				Data: map[string]any{
+					"provider":  provider,
+					"period":    p.name,
+					"threshold": threshold,
+					"spent":     p.spent + spend.Cost,
+					"limit":     p.limit,
+				},
+			})
+		}
+	}
+}
+
+// budgetAlerts returns the banners of the budgets whose spend crossed one of their thresholds.
+func (m *Main) budgetAlerts(ctx context.Context) []string {
+	var alerts []string
+	for _, provider := range []string{providerLLM, providerCompareLLM} {
+		budget, ok := m.budgets[provider]
+		if !ok {
+			continue
+		}
+		periods, err := m.budgetPeriods(ctx, provider, time.Now())
+		if err != nil {
+			m.logger.ErrorContext(ctx, "Failed to get budget", slog.String(errLoggerKey, err.Error()))
+			continue
+		}
+		for _, p := range periods {
+			if p.spent < budget.Thresholds[0]*p.limit {
+				continue
+			}
+			alert := fmt.Sprintf("The %s budget of the %s is %.0f%% spent (%.2f of %.2f).", p.name,
+				providerLabel(provider), 100*p.spent/p.limit, p.spent, p.limit)
+			if budget.HardStop && p.spent >= p.limit {
+				alert += " New responses are refused until the next period."
+			}
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts
+}
@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// CapabilitiesCache configures the cache of the capabilities of the MCP servers in the store, so the tools,
+// resources and prompts of the servers are offered right after a restart, without waiting for the servers to
+// list them.
+type CapabilitiesCache struct {
+	Enabled bool
+	// MaxAge is how long the cached capabilities of a server are trusted after they're listed. The older ones
+	// are used at the start, and listed again in the background, replacing them if they changed. They're
+	// always listed again in the background if it's zero.
+	MaxAge time.Duration
+}
+
+// capabilities are the servers, tools, resources and prompts offered by the MCP clients of Main. They are
+// never modified after they're listed, a refresh lists them again and replaces them as a whole, so a copy
+// taken under Main's lock stays consistent without holding it.
+type capabilities struct {
+	servers           []mcp.Info
+	tools             []mcp.Tool
+	resources         []mcp.Resource
+	resourceTemplates []mcp.ResourceTemplate
+	prompts           []mcp.Prompt
+
+	toolsMap             map[string]int // Map of tool names to mcpClients index.
+	resourcesMap         map[string]int // Map of resource URIs to mcpClients index.
+	resourceTemplatesMap map[string]int // Map of resource URI templates to mcpClients index.
+	promptsMap           map[string]int // Map of prompt names to mcpClients index.
+
+	// toolNames maps the names of the renamed tools to their names on the servers.
+	toolNames map[string]string
+
+	// byServer are the capabilities of every server, in the order of mcpClients.
+	byServer []serverCapabilities
+}
+
+// serverCapabilities are the capabilities of a single MCP server, negotiated and listed when it's connected,
+// or read from the cache. They're stored as JSON in the MCPServerState of the server.
+type serverCapabilities struct {
+	ToolsSupported     bool                   `json:"toolsSupported"`
+	ResourcesSupported bool                   `json:"resourcesSupported"`
+	PromptsSupported   bool                   `json:"promptsSupported"`
+	Tools              []mcp.Tool             `json:"tools,omitempty"`
+	Resources          []mcp.Resource         `json:"resources,omitempty"`
+	ResourceTemplates  []mcp.ResourceTemplate `json:"resourceTemplates,omitempty"`
+	Prompts            []mcp.Prompt           `json:"prompts,omitempty"`
+}
+
+// WithCapabilitiesCache caches the capabilities of the MCP servers in the store, and uses the cached ones of
+// the servers whose name and version didn't change at the start, instead of listing them.
+func WithCapabilitiesCache(cache CapabilitiesCache) MainOption {
+	return func(m *Main) {
+		m.capsCache = cache
+	}
+}
+
+// RefreshCapabilities lists the tools, resources, resource templates and prompts of the MCP servers again,
+// so their changes are offered in the next chats without restarting. The chats being generated keep the
+// tools they started with. The previous capabilities are kept if any of the servers fails to list them, and
+// the new ones are cached if the cache is enabled.
+func (m *Main) RefreshCapabilities(ctx context.Context) error {
+	caps, err := listCapabilities(ctx, m.mcpClients, m.toolOverrides)
+	if err != nil {
+		return err
+	}
+
+	m.capsMu.Lock()
+	m.caps = caps
+	m.capsMu.Unlock()
+
+	if m.capsCache.Enabled {
+		for i := range m.mcpClients {
+			if _, err := m.saveServerState(ctx, i, caps.byServer[i]); err != nil {
+				m.logger.ErrorContext(ctx, "Failed to cache MCP server capabilities",
+					slog.String("server", caps.servers[i].Name),
+					slog.String(errLoggerKey, err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+// capabilities returns the current capabilities, which must not be modified.
+func (m *Main) capabilities() capabilities {
+	m.capsMu.RLock()
+	defer m.capsMu.RUnlock()
+	return m.caps
+}
+
+// parseCapabilities lists the capabilities of the MCP servers, or reads them from the cache, and returns the
+// indexes of the servers whose cached capabilities are to be listed again in the background.
+func (m *Main) parseCapabilities() ([]int, error) {
+	caps, stale, err := m.loadCapabilities(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	m.caps = caps
+	return stale, nil
+}
+
+// loadCapabilities lists the capabilities of the MCP servers, using the cached ones of the servers with the
+// same name and version as when they were cached if the cache is enabled. It returns the indexes of the
+// servers whose cached capabilities are to be listed again.
+func (m *Main) loadCapabilities(ctx context.Context) (capabilities, []int, error) {
+	var cached map[string]models.MCPServerState
+	if m.capsCache.Enabled {
+		states, err := m.store.MCPServerStates(ctx)
+		if err != nil {
+			return capabilities{}, nil, fmt.Errorf("failed to get MCP server states: %w", err)
+		}
+		cached = make(map[string]models.MCPServerState, len(states))
+		for _, s := range states {
+			cached[s.Key] = s
+		}
+	}
+
+	byServer := make([]serverCapabilities, len(m.mcpClients))
+	var stale []int
+	for i, cli := range m.mcpClients {
+		if sc, fresh, ok := cachedServerCapabilities(cli, cached[serverStateKey(i, cli)], m.capsCache.MaxAge); ok {
+			byServer[i] = sc
+			if !fresh {
+				stale = append(stale, i)
+			}
+			continue
+		}
+
+		var err error
+		if byServer[i], err = listServerCapabilities(ctx, cli); err != nil {
+			return capabilities{}, nil, err
+		}
+		if m.capsCache.Enabled {
+			if _, err := m.saveServerState(ctx, i, byServer[i]); err != nil {
+				return capabilities{}, nil, fmt.Errorf("failed to cache capabilities of server %s: %w",
+					cli.ServerInfo().Name, err)
+			}
+		}
+	}
+	return newCapabilities(m.mcpClients, byServer, m.toolOverrides), stale, nil
+}
+
+// revalidateCapabilities lists the capabilities of the servers of stale again, and replaces the cached ones
+// they were started with if they changed, like a request with an ETag.
+func (m *Main) revalidateCapabilities(stale []int) {
+	ctx := context.Background()
+	for _, i := range stale {
+		cli := m.mcpClients[i]
+		sc, err := listServerCapabilities(ctx, cli)
+		if err != nil {
+			m.logger.ErrorContext(ctx, "Failed to revalidate MCP server capabilities",
+				slog.String("server", cli.ServerInfo().Name),
+				slog.String(errLoggerKey, err.Error()))
+			continue
+		}
+
+		changed, err := m.saveServerState(ctx, i, sc)
+		if err != nil {
+			m.logger.ErrorContext(ctx, "Failed to cache MCP server capabilities",
+				slog.String("server", cli.ServerInfo().Name),
+				slog.String(errLoggerKey, err.Error()))
+		}
+		if !changed {
+			continue
+		}
+
+		m.capsMu.Lock()
+		byServer := make([]serverCapabilities, len(m.caps.byServer))
+		copy(byServer, m.caps.byServer)
+		byServer[i] = sc
+		m.caps = newCapabilities(m.mcpClients, byServer, m.toolOverrides)
+		m.capsMu.Unlock()
+		m.logger.InfoContext(ctx, "MCP server capabilities changed since they were cached",
+			slog.String("server", cli.ServerInfo().Name))
+	}
+}
+
+// saveServerState caches sc as the capabilities of the server of index i, and reports whether they changed
+// since they were cached, by their ETag.
+func (m *Main) saveServerState(ctx context.Context, i int, sc serverCapabilities) (bool, error) {
+	data, err := json.Marshal(sc)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal capabilities: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	etag := hex.EncodeToString(sum[:16])
+
+	cli := m.mcpClients[i]
+	key := serverStateKey(i, cli)
+	states, err := m.store.MCPServerStates(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get MCP server states: %w", err)
+	}
+	changed := true
+	for _, s := range states {
+		if s.Key == key {
+			changed = s.ETag != etag
+		}
+	}
+
+	info := cli.ServerInfo()
+	err = m.store.SaveMCPServerState(ctx, models.MCPServerState{
+		Key:          key,
+		Name:         info.Name,
+		Version:      info.Version,
+		Capabilities: data,
+		ETag:         etag,
+		ListedAt:     time.Now(),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to save MCP server state: %w", err)
+	}
+	return changed, nil
+}
+
+// serverStateKey is the key of the cached state of the server of cli, at index i of the MCP clients. The
+// index tells apart the servers of the same name, like a server configured twice with different arguments.
+func serverStateKey(i int, cli *mcp.Client) string {
+	return fmt.Sprintf("%d/%s", i, cli.ServerInfo().Name)
+}
+
+// cachedServerCapabilities returns the capabilities of state, if they're the ones of the server of cli, and
+// whether they're younger than maxAge.
+func cachedServerCapabilities(
+	cli *mcp.Client,
+	state models.MCPServerState,
+	maxAge time.Duration,
+) (serverCapabilities, bool, bool) {
+	info := cli.ServerInfo()
+	if state.Key == "" || state.Name != info.Name || state.Version != info.Version {
+		return serverCapabilities{}, false, false
+	}
+	var sc serverCapabilities
+	if err := json.Unmarshal(state.Capabilities, &sc); err != nil {
+		return serverCapabilities{}, false, false
+	}
+	// The capabilities negotiated at the connection must be the cached ones, as the lists depend on them.
+	if sc.ToolsSupported != cli.ToolServerSupported() || sc.ResourcesSupported != cli.ResourceServerSupported() ||
+		sc.PromptsSupported != cli.PromptServerSupported() {
+		return serverCapabilities{}, false, false
+	}
+	return sc, maxAge > 0 && time.Since(state.ListedAt) < maxAge, true
+}
+
+func listCapabilities(
+	ctx context.Context,
+	mcpClients []*mcp.Client,
+	overrides map[string]ToolOverride,
+) (capabilities, error) {
+	byServer := make([]serverCapabilities, len(mcpClients))
+	for i := range mcpClients {
+		var err error
+		if byServer[i], err = listServerCapabilities(ctx, mcpClients[i]); err != nil {
+			return capabilities{}, err
+		}
+	}
+	return newCapabilities(mcpClients, byServer, overrides), nil
+}
+
+func listServerCapabilities(ctx context.Context, cli *mcp.Client) (serverCapabilities, error) {
+	serverName := cli.ServerInfo().Name
+	sc := serverCapabilities{
+		ToolsSupported:     cli.ToolServerSupported(),
+		ResourcesSupported: cli.ResourceServerSupported(),
+		PromptsSupported:   cli.PromptServerSupported(),
+	}
+
+	if sc.ToolsSupported {
+		listTools, err := cli.ListTools(ctx, mcp.ListToolsParams{})
+		if err != nil {
+			return serverCapabilities{}, fmt.Errorf("failed to list tools from server %s: %w", serverName, err)
+		}
+		sc.Tools = listTools.Tools
+	}
+
+	if sc.ResourcesSupported {
+		listResources, err := cli.ListResources(ctx, mcp.ListResourcesParams{})
+		if err != nil {
+			return serverCapabilities{}, fmt.Errorf("failed to list resources from server %s: %w", serverName, err)
+		}
+		sc.Resources = listResources.Resources
+
+		listTemplates, err := cli.ListResourceTemplates(ctx, mcp.ListResourceTemplatesParams{})
+		if err != nil {
+			return serverCapabilities{}, fmt.Errorf("failed to list resource templates from server %s: %w",
+				serverName, err)
+		}
+		sc.ResourceTemplates = listTemplates.Templates
+	}
+
+	if sc.PromptsSupported {
+		listPrompts, err := cli.ListPrompts(ctx, mcp.ListPromptsParams{})
+		if err != nil {
+			return serverCapabilities{}, fmt.Errorf("failed to list prompts from server %s: %w", serverName, err)
+		}
+		sc.Prompts = listPrompts.Prompts
+	}
+	return sc, nil
+}
+
+// newCapabilities merges the capabilities of the servers of mcpClients, given in byServer, their tools being
+// presented with overrides.
+func newCapabilities(
+	mcpClients []*mcp.Client,
+	byServer []serverCapabilities,
+	overrides map[string]ToolOverride,
+) capabilities {
+	caps := capabilities{
+		servers:              make([]mcp.Info, len(mcpClients)),
+		tools:                make([]mcp.Tool, 0, len(mcpClients)),
+		resources:            make([]mcp.Resource, 0, len(mcpClients)),
+		resourceTemplates:    make([]mcp.ResourceTemplate, 0, len(mcpClients)),
+		prompts:              make([]mcp.Prompt, 0, len(mcpClients)),
+		toolsMap:             make(map[string]int),
+		toolNames:            make(map[string]string),
+		resourcesMap:         make(map[string]int),
+		resourceTemplatesMap: make(map[string]int),
+		promptsMap:           make(map[string]int),
+		byServer:             byServer,
+	}
+	for i, sc := range byServer {
+		caps.servers[i] = mcpClients[i].ServerInfo()
+		for _, tool := range sc.Tools {
+			presented, renamed := overrideTool(tool, overrides)
+			if renamed {
+				caps.toolNames[presented.Name] = tool.Name
+			}
+			caps.toolsMap[presented.Name] = i
+			caps.tools = append(caps.tools, presented)
+		}
+		for _, res := range sc.Resources {
+			caps.resourcesMap[res.URI] = i
+		}
+		caps.resources = append(caps.resources, sc.Resources...)
+		for _, tmpl := range sc.ResourceTemplates {
+			caps.resourceTemplatesMap[tmpl.URITemplate] = i
+		}
+		caps.resourceTemplates = append(caps.resourceTemplates, sc.ResourceTemplates...)
+		for _, prompt := range sc.Prompts {
+			caps.promptsMap[prompt.Name] = i
+		}
+		caps.prompts = append(caps.prompts, sc.Prompts...)
+	}
+	return caps
+}
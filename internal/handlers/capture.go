@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Capture configures the capture endpoint of the chat API, which starts a chat about a web page or the text
+// selected in it, sent by a browser extension or a bookmarklet.
+type Capture struct {
+	// Client fetches the pages of the captured URLs. The pages aren't fetched if it's nil, only the selected
+	// texts are captured. As the URLs are given by the clients, it should deny the private addresses, like
+	// the clients of an EgressPolicy.
+	Client *http.Client
+	// MaxBytes limits the size of a fetched page, 2 MiB if it's zero.
+	MaxBytes int64
+	// MaxChars limits the length in characters of the captured text added to the chat, the rest being cut,
+	// 20000 if it's zero.
+	MaxChars int
+}
+
+type apiCaptureRequest struct {
+	URL    string `json:"url"`
+	Text   string `json:"text"`
+	Title  string `json:"title"`
+	Prompt string `json:"prompt"`
+	ChatID string `json:"chatId"`
+}
+
+type apiCaptureResponse struct {
+	ChatID     string `json:"chatId"`
+	MessageID  string `json:"messageId"`
+	ResponseID string `json:"responseId"`
+}
+
+// capturedPage is the cleaned text of a captured page.
+type capturedPage struct {
+	Title string
+	Text  string
+}
+
+const (
+	defaultCaptureMaxBytes = 2 << 20
+	defaultCaptureMaxChars = 20000
+
+	defaultCapturePrompt = "Summarize this page."
+)
+
+// captureSkippedElements are the elements of a page whose text isn't part of its content.
+var captureSkippedElements = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true, atom.Svg: true,
+	atom.Iframe: true, atom.Nav: true, atom.Header: true, atom.Footer: true, atom.Aside: true,
+	atom.Form: true, atom.Button: true, atom.Select: true, atom.Head: true,
+}
+
+// captureBlockElements are the elements whose text is separated from the text around them by a line break.
+var captureBlockElements = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Br: true, atom.Li: true, atom.Tr: true, atom.Section: true,
+	atom.Article: true, atom.Main: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true,
+	atom.H5: true, atom.H6: true, atom.Pre: true, atom.Blockquote: true, atom.Table: true, atom.Ul: true,
+	atom.Ol: true, atom.Dl: true, atom.Dt: true, atom.Dd: true, atom.Figcaption: true, atom.Hr: true,
+}
+
+// WithCapture configures the capture endpoint of the chat API.
+func WithCapture(capture Capture) MainOption {
+	return func(m *Main) {
+		m.capture = capture
+	}
+}
+
+func (m *Main) parseCapture() error {
+	if m.capture.MaxBytes < 0 || m.capture.MaxChars < 0 {
+		return errors.New("the limits of the captured pages must not be negative")
+	}
+	if m.capture.MaxBytes == 0 {
+		m.capture.MaxBytes = defaultCaptureMaxBytes
+	}
+	if m.capture.MaxChars == 0 {
+		m.capture.MaxChars = defaultCaptureMaxChars
+	}
+	return nil
+}
+
+// HandleAPICapture serves the CaptureContent method of the chat API on /api/v1/capture. It expects a JSON
+// body with the URL of a page, the text selected in it, or both, and adds a user message with the prompt
+// of the body, or a request to summarize the page, and the captured text to the chat of chatId, or to a new
+// chat titled after the page. The page of the URL is fetched and cleaned by the server when no text is
+// selected. Like HandleChats, the response is generated in the background and streamed to the web UI, and
+// the request is answered with 202 Accepted and the IDs of the chat and its new messages. The requests must
+// be authenticated, by an API token or the user header.
+func (m *Main) HandleAPICapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		m.writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !m.authenticated(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		m.writeAPIError(w, http.StatusUnauthorized, "An API token or the user header is required")
+		return
+	}
+
+	var req apiCaptureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		m.writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err))
+		return
+	}
+	res, status, err := m.captureContent(r.Context(), m.userID(r), req)
+	if err != nil {
+		m.writeAPIError(w, status, err.Error())
+		return
+	}
+	m.writeAPIJSON(w, http.StatusAccepted, res)
+}
+
+// captureContent captures the page of req for userID, fetching it if req has no text. It returns the status
+// of the error if it fails.
+func (m *Main) captureContent(
+	ctx context.Context,
+	userID string,
+	req apiCaptureRequest,
+) (apiCaptureResponse, int, error) {
+	if req.URL == "" && strings.TrimSpace(req.Text) == "" {
+		return apiCaptureResponse{}, http.StatusBadRequest, errors.New("URL or text is required")
+	}
+	if req.URL != "" {
+		if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return apiCaptureResponse{}, http.StatusBadRequest, errors.New("URL must be an absolute http or https URL")
+		}
+	}
+
+	page := capturedPage{Title: req.Title, Text: req.Text}
+	if strings.TrimSpace(page.Text) == "" {
+		if m.capture.Client == nil {
+			return apiCaptureResponse{}, http.StatusBadRequest,
+				errors.New("fetching the pages is disabled, the selected text is required")
+		}
+		fetched, err := m.fetchPage(ctx, req.URL)
+		if err != nil {
+			m.logger.WarnContext(ctx, "Failed to fetch captured page",
+				slog.String("url", req.URL), slog.String(errLoggerKey, err.Error()))
+			return apiCaptureResponse{}, http.StatusBadGateway, fmt.Errorf("failed to fetch %s: %w", req.URL, err)
+		}
+		if page.Title == "" {
+			page.Title = fetched.Title
+		}
+		page.Text = fetched.Text
+		if strings.TrimSpace(page.Text) == "" {
+			return apiCaptureResponse{}, http.StatusUnprocessableEntity, fmt.Errorf("page %s has no text", req.URL)
+		}
+	}
+
+	if status, err := m.quotaStatus(ctx, userID); err != nil {
+		return apiCaptureResponse{}, status, err
+	}
+	res, status, err := m.startCapture(ctx, userID, req, page)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to capture content", slog.String(errLoggerKey, err.Error()))
+		return apiCaptureResponse{}, status, err
+	}
+	return res, 0, nil
+}
+
+// authenticated reports whether the user of r is authenticated, by an API token or the user header.
+func (m *Main) authenticated(r *http.Request) bool {
+	if _, ok := r.Context().Value(apiTokenUserKey{}).(string); ok {
+		return true
+	}
+	return m.userHeader != "" && r.Header.Get(m.userHeader) != ""
+}
+
+// startCapture adds the message of the captured page to its chat, and starts the generation of the response.
+// It returns the status of the error if it fails.
+func (m *Main) startCapture(
+	ctx context.Context,
+	userID string,
+	req apiCaptureRequest,
+	page capturedPage,
+) (apiCaptureResponse, int, error) {
+	chatID := req.ChatID
+	if chatID == "" {
+		title := strings.TrimSpace(page.Title)
+		if title == "" {
+			title = req.URL
+		}
+		var err error
+		if chatID, err = m.newChat(ctx, models.Chat{Title: title, UserID: userID}); err != nil {
+			return apiCaptureResponse{}, http.StatusInternalServerError, fmt.Errorf("failed to create chat: %w", err)
+		}
+		if title == "" {
+			m.queueChatTitle(ctx, chatID, page.Text)
+		}
+	} else {
+		if _, err := m.findVisibleChat(ctx, userID, chatID); err != nil {
+			return apiCaptureResponse{}, http.StatusNotFound, errors.New("chat not found")
+		}
+		if err := m.continueChat(ctx, chatID); err != nil {
+			return apiCaptureResponse{}, http.StatusInternalServerError, fmt.Errorf("failed to continue chat: %w", err)
+		}
+	}
+
+	prompt := strings.TrimSpace(req.Prompt)
+	if prompt == "" {
+		prompt = defaultCapturePrompt
+	}
+	attachment := m.captureAttachment(req.URL, page)
+	um := models.Message{
+		ID:   uuid.New().String(),
+		Role: models.RoleUser,
+		Contents: []models.Content{
+			{
+				Type:    models.ContentTypeText,
+				Text:    withAttachments(prompt, []string{attachment}),
+				Sources: m.capabilities().attachmentSources([]string{attachment}),
+			},
+		},
+		Timestamp: time.Now(),
+		UserID:    userID,
+	}
+	var err error
+	if um.ID, err = m.store.AddMessage(ctx, chatID, um); err != nil {
+		return apiCaptureResponse{}, http.StatusInternalServerError, fmt.Errorf("failed to add user message: %w", err)
+	}
+	m.recordUsage(ctx, userID, 1, 0)
+
+	am := models.Message{
+		ID:        uuid.New().String(),
+		Role:      models.RoleAssistant,
+		Timestamp: time.Now(),
+	}
+	if am.ID, err = m.store.AddMessage(ctx, chatID, am); err != nil {
+		return apiCaptureResponse{}, http.StatusInternalServerError, fmt.Errorf("failed to add AI message: %w", err)
+	}
+	messages, err := m.store.MessagePath(ctx, chatID, am.ID)
+	if err != nil {
+		return apiCaptureResponse{}, http.StatusInternalServerError, fmt.Errorf("failed to get messages: %w", err)
+	}
+	if req.ChatID != "" {
+		m.publishChatMessages(ctx, chatID, um, am)
+	}
+
+	genCtx := m.generationContext(ctx, userID)
+	m.claimMessageTopic(chatID, am.ID, userID)
+	go func() {
+		// The error is already logged and published to the clients by the generation.
+		_ = m.chat(genCtx, userID, chatID, messages)
+	}()
+	return apiCaptureResponse{ChatID: chatID, MessageID: um.ID, ResponseID: am.ID}, 0, nil
+}
+
+// captureAttachment returns the captured text of page as an attached resource, cut at the maximum length.
+func (m *Main) captureAttachment(pageURL string, page capturedPage) string {
+	text := strings.TrimSpace(page.Text)
+	if runes := []rune(text); len(runes) > m.capture.MaxChars {
+		text = string(runes[:m.capture.MaxChars]) + "\n[…]"
+	}
+	if pageURL == "" {
+		return fmt.Sprintf("<captured-text>\n%s\n</captured-text>", text)
+	}
+	return fmt.Sprintf("<resource uri=%q>\n%s\n</resource>", pageURL, text)
+}
+
+// fetchPage fetches the page of pageURL with the client of Capture, and returns its cleaned text. The plain
+// text pages are returned as is.
+func (m *Main) fetchPage(ctx context.Context, pageURL string) (capturedPage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return capturedPage{}, err
+	}
+	req.Header.Set("Accept", "text/html, text/plain;q=0.9")
+	req.Header.Set("User-Agent", "mcp-web-ui")
+	res, err := m.capture.Client.Do(req)
+	if err != nil {
+		return capturedPage{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return capturedPage{}, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, m.capture.MaxBytes+1))
+	if err != nil {
+		return capturedPage{}, err
+	}
+	if int64(len(body)) > m.capture.MaxBytes {
+		return capturedPage{}, fmt.Errorf("the page exceeds %d bytes", m.capture.MaxBytes)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/plain", "text/markdown":
+		return capturedPage{Text: string(body)}, nil
+	case "", "text/html", "application/xhtml+xml":
+		return pageText(string(body))
+	default:
+		return capturedPage{}, fmt.Errorf("unsupported content type %s", mediaType)
+	}
+}
+
+// pageText returns the title and the readable text of the HTML page doc. The text is taken from the article
+// or main element of the page if it has one, leaving out the navigation, the scripts and the forms.
+func pageText(doc string) (capturedPage, error) {
+	root, err := html.Parse(strings.NewReader(doc))
+	if err != nil {
+		return capturedPage{}, fmt.Errorf("failed to parse page: %w", err)
+	}
+
+	var page capturedPage
+	var content *html.Node
+	var find func(n *html.Node)
+	find = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.DataAtom {
+			case atom.Title:
+				if page.Title == "" && n.FirstChild != nil {
+					page.Title = strings.TrimSpace(n.FirstChild.Data)
+				}
+			case atom.Article, atom.Main:
+				if content == nil {
+					content = n
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			find(c)
+		}
+	}
+	find(root)
+	if content == nil {
+		content = root
+	}
+
+	var sb strings.Builder
+	writeText(&sb, content)
+	lines := strings.Split(sb.String(), "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			kept = append(kept, line)
+		}
+	}
+	page.Text = strings.Join(kept, "\n")
+	return page, nil
+}
+
+func writeText(sb *strings.Builder, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		sb.WriteString(n.Data)
+		return
+	case html.ElementNode:
+		if captureSkippedElements[n.DataAtom] {
+			return
+		}
+	}
+	block := n.Type == html.ElementNode && captureBlockElements[n.DataAtom]
+	if block {
+		sb.WriteString("\n")
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		writeText(sb, c)
+	}
+	if block {
+		sb.WriteString("\n")
+	}
+}
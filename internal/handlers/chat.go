@@ -3,21 +3,25 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/logging"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
 	"github.com/google/uuid"
-	"github.com/tmaxmax/go-sse"
 )
 
 type chat struct {
-	ID    string
-	Title string
+	ID       string
+	Title    string
+	Language string
+	Tags     []string
 
 	Active bool
 }
@@ -27,16 +31,34 @@ type message struct {
 	Role      string
 	Content   string
 	Timestamp time.Time
+	// Stats is the stats line of an assistant message.
+	Stats string
+	// LengthLimited reports whether the generation of an assistant message was stopped at the length limit,
+	// showing the button to continue it.
+	LengthLimited bool
+	// Truncated reports whether the LLM stopped the generation of an assistant message at its maximum
+	// output tokens, showing the button to continue it.
+	Truncated bool
+	// FinishNote explains why the LLM ended an assistant message, if it's not its natural end.
+	FinishNote string
+	// Interruption is the error that interrupted the generation of an assistant message, showing the button
+	// to resume it.
+	Interruption string
+	// ParentID is the ID of the message a reply of a thread replies to, linked from the reply, and ReplyTo the
+	// excerpt of its text.
+	ParentID string
+	ReplyTo  string
+	// Depth is the nesting level of a message of a thread in the threaded view, zero for the main line.
+	Depth int
+	// Sender is the user who sent a user message of a collaborative chat, shown with the message.
+	Sender string
+	// Inspectable reports whether the requests sent to the LLM provider for an assistant message were
+	// recorded in the debug mode, showing the button to inspect them.
+	Inspectable bool
 
 	StreamingState string
 }
 
-// SSE event types for real-time updates.
-var (
-	chatsSSEType    = sse.Type("chats")
-	messagesSSEType = sse.Type("messages")
-)
-
 func callToolError(err error) json.RawMessage {
 	contents := []mcp.Content{
 		{
@@ -53,43 +75,71 @@ func callToolError(err error) json.RawMessage {
 // managing both new chat creation and message handling. It accepts user messages through form data,
 // creates appropriate chat contexts, and initiates asynchronous processing for AI responses and chat title generation.
 //
-// The handler expects a "message" form field and an optional "chat_id" field.
+// The handler expects a "message" form field, an optional "chat_id" field, the optional "attachment"
+// fields of the resources attached to the message, which are appended to it, and the optional "image" fields
+// of the images pasted into the form, uploaded by HandleImageUpload. A new chat takes the optional
+// "title", comma-separated "tags" and "system_prompt" fields, its title being generated only if it's empty.
+// An optional "parent_id" field makes the message a reply to an earlier message of the chat, starting or
+// continuing a thread whose response is given the path of the reply only, not the rest of the chat.
 // If no chat_id is provided, it creates a new chat session. The handler streams AI responses through
-// Server-Sent Events (SSE) and updates the UI accordingly through template rendering.
+// Server-Sent Events (SSE) and updates the UI accordingly through template rendering. A request repeating the
+// Idempotency-Key header or "idempotency_key" field of a previous request is ignored with 204 No Content.
 //
 // The function returns appropriate HTTP error responses for invalid methods, missing required fields,
 // or internal processing errors. For successful requests, it renders either a complete chatbox template
 // for new chats or individual message templates for existing chats.
-func (m Main) HandleChats(w http.ResponseWriter, r *http.Request) {
+func (m *Main) HandleChats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	msg := r.FormValue("message")
 	if msg == "" {
-		m.logger.Error("Message is required")
+		m.logger.ErrorContext(r.Context(), "Message is required")
 		http.Error(w, "Message is required", http.StatusBadRequest)
 		return
 	}
+	attachments := r.PostForm["attachment"]
+	msg = withAttachments(msg, attachments)
 
-	var err error
+	userID := m.userID(r)
+	claim, ok := m.claimIdempotencyKey(w, r, userID)
+	if !ok {
+		return
+	}
+	defer claim.release()
+	if !m.checkQuota(w, r, userID) {
+		return
+	}
 
 	chatID := r.FormValue("chat_id")
+	if !m.authorizeChat(w, r, chatID) {
+		return
+	}
+	contents, ok := m.userContents(w, r, userID, msg, attachments)
+	if !ok {
+		return
+	}
+	parent, ok := m.replyParent(w, r, chatID)
+	if !ok {
+		return
+	}
 	// We track if this is a new chat to determine the appropriate template rendering strategy
 	isNewChat := false
+	var err error
 	if chatID == "" {
-		chatID, err = m.newChat()
+		chatID, err = m.newChat(r.Context(), newChatFromForm(r, userID))
 		if err != nil {
-			m.logger.Error("Failed to create new chat", slog.String(errLoggerKey, err.Error()))
+			m.logger.ErrorContext(r.Context(), "Failed to create new chat", slog.String(errLoggerKey, err.Error()))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		isNewChat = true
 	} else {
 		if err := m.continueChat(r.Context(), chatID); err != nil {
-			m.logger.Error("Failed to continue chat", slog.String(errLoggerKey, err.Error()))
+			m.logger.ErrorContext(r.Context(), "Failed to continue chat", slog.String(errLoggerKey, err.Error()))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -97,94 +147,76 @@ func (m Main) HandleChats(w http.ResponseWriter, r *http.Request) {
 
 	// We create two messages: user's input and a placeholder for AI response
 	um := models.Message{
-		ID:   uuid.New().String(),
-		Role: models.RoleUser,
-		Contents: []models.Content{
-			{
-				Type: models.ContentTypeText,
-				Text: msg,
-			},
-		},
+		ID:        uuid.New().String(),
+		Role:      models.RoleUser,
+		Contents:  contents,
 		Timestamp: time.Now(),
+		ParentID:  parent.ID,
+		UserID:    userID,
 	}
 	userMsgID, err := m.store.AddMessage(r.Context(), chatID, um)
 	if err != nil {
-		m.logger.Error("Failed to add user message",
+		m.logger.ErrorContext(r.Context(), "Failed to add user message",
 			slog.String("message", fmt.Sprintf("%+v", um)),
 			slog.String(errLoggerKey, err.Error()))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Initialize empty AI message to be streamed later
+	claim.keep()
+	m.recordUsage(r.Context(), userID, 1, 0)
+
+	// Initialize empty AI message to be streamed later, continuing the thread of the user message if any
 	am := models.Message{
 		ID:        uuid.New().String(),
 		Role:      models.RoleAssistant,
 		Timestamp: time.Now(),
 	}
+	if parent.ID != "" {
+		am.ParentID = userMsgID
+	}
 	aiMsgID, err := m.store.AddMessage(r.Context(), chatID, am)
 	if err != nil {
-		m.logger.Error("Failed to add AI message",
+		m.logger.ErrorContext(r.Context(), "Failed to add AI message",
 			slog.String("message", fmt.Sprintf("%+v", am)),
 			slog.String(errLoggerKey, err.Error()))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	messages, err := m.store.Messages(r.Context(), chatID)
+	messages, err := m.store.MessagePath(r.Context(), chatID, aiMsgID)
 	if err != nil {
-		m.logger.Error("Failed to get messages",
+		m.logger.ErrorContext(r.Context(), "Failed to get messages",
 			slog.String("chatID", chatID),
 			slog.String(errLoggerKey, err.Error()))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if !isNewChat {
+		um.ID, am.ID = userMsgID, aiMsgID
+		m.publishChatMessages(r.Context(), chatID, um, am)
+	}
+
 	// Start async processes for chat response and title generation
-	go m.chat(chatID, messages)
+	genCtx := m.generationContext(r.Context(), userID)
+	w.Header().Set(generationIDHeader, logging.GenerationID(genCtx))
+	m.claimMessageTopic(chatID, aiMsgID, userID)
+	go func() {
+		// The error is already logged and published to the client by the generation.
+		_ = m.chat(genCtx, userID, chatID, messages)
+	}()
 
 	if isNewChat {
-		go m.generateChatTitle(chatID, msg)
-
-		// For new chats, we prepare all messages with appropriate streaming states
-		msgs := make([]message, len(messages))
-		for i := range messages {
-			// Mark only the AI message as "loading", others as "ended"
-			streamingState := "ended"
-			if messages[i].ID == aiMsgID {
-				streamingState = "loading"
-			}
-			content, err := models.RenderContents(messages[i].Contents)
-			if err != nil {
-				m.logger.Error("Failed to render contents",
-					slog.String("message", fmt.Sprintf("%+v", messages[i])),
-					slog.String(errLoggerKey, err.Error()))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			msgs[i] = message{
-				ID:             messages[i].ID,
-				Role:           string(messages[i].Role),
-				Content:        content,
-				Timestamp:      messages[i].Timestamp,
-				StreamingState: streamingState,
-			}
-		}
+		m.queueChatTitle(r.Context(), chatID, msg)
 
-		data := homePageData{
-			CurrentChatID: chatID,
-			Messages:      msgs,
-		}
-		err = m.templates.ExecuteTemplate(w, "chatbox", data)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		m.renderNewChat(w, r, chatID, aiMsgID, messages)
 		return
 	}
 
 	userContent, err := models.RenderContents(um.Contents)
 	if err != nil {
-		m.logger.Error("Failed to render contents",
+		m.logger.ErrorContext(r.Context(), "Failed to render contents",
 			slog.String("message", fmt.Sprintf("%+v", um)),
 			slog.String(errLoggerKey, err.Error()))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -194,7 +226,10 @@ func (m Main) HandleChats(w http.ResponseWriter, r *http.Request) {
 		ID:             userMsgID,
 		Role:           string(um.Role),
 		Content:        userContent,
-		Timestamp:      um.Timestamp,
+		Timestamp:      um.Timestamp.In(userLocation(r)),
+		ParentID:       parent.ID,
+		ReplyTo:        replyExcerpt(parent),
+		Sender:         m.messageSender(r.Context(), chatID, um),
 		StreamingState: "ended",
 	})
 	if err != nil {
@@ -204,7 +239,7 @@ func (m Main) HandleChats(w http.ResponseWriter, r *http.Request) {
 
 	aiContent, err := models.RenderContents(am.Contents)
 	if err != nil {
-		m.logger.Error("Failed to render contents",
+		m.logger.ErrorContext(r.Context(), "Failed to render contents",
 			slog.String("message", fmt.Sprintf("%+v", am)),
 			slog.String(errLoggerKey, err.Error()))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -214,7 +249,8 @@ func (m Main) HandleChats(w http.ResponseWriter, r *http.Request) {
 		ID:             aiMsgID,
 		Role:           string(am.Role),
 		Content:        aiContent,
-		Timestamp:      am.Timestamp,
+		Timestamp:      am.Timestamp.In(userLocation(r)),
+		ParentID:       am.ParentID,
 		StreamingState: "loading",
 	})
 	if err != nil {
@@ -222,31 +258,95 @@ func (m Main) HandleChats(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (m Main) newChat() (string, error) {
-	newChat := models.Chat{
-		ID: uuid.New().String(),
+// renderNewChat renders the chatbox of a new chat, with the AI message of aiMsgID marked as loading.
+func (m *Main) renderNewChat(
+	w http.ResponseWriter,
+	r *http.Request,
+	chatID, aiMsgID string,
+	messages []models.Message,
+) {
+	// For new chats, we prepare all messages with appropriate streaming states
+	msgs := make([]message, len(messages))
+	for i := range messages {
+		// Mark only the AI message as "loading", others as "ended"
+		streamingState := "ended"
+		if messages[i].ID == aiMsgID {
+			streamingState = "loading"
+		}
+		content, err := models.RenderContents(messages[i].Contents)
+		if err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to render contents",
+				slog.String("message", fmt.Sprintf("%+v", messages[i])),
+				slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		msgs[i] = message{
+			ID:             messages[i].ID,
+			Role:           string(messages[i].Role),
+			Content:        content,
+			Timestamp:      messages[i].Timestamp.In(userLocation(r)),
+			StreamingState: streamingState,
+		}
+	}
+
+	data := homePageData{
+		CurrentChatID:  chatID,
+		Messages:       msgs,
+		CompareEnabled: m.compareLLM != nil,
+		Parameters:     m.newChatParameters(models.Chat{ID: chatID}),
+		Mounts:         m.newChatMounts(chatID, nil),
+		Members:        newChatMembers(models.Chat{ID: chatID, UserID: m.userID(r)}, m.userID(r)),
+		Observer:       newChatObserver(models.Chat{ID: chatID, UserID: m.userID(r)}, m.userID(r)),
+		Share:          newChatShare(models.Chat{ID: chatID, UserID: m.userID(r)}, m.userID(r)),
+	}
+	if err := m.templates.ExecuteTemplate(w, "chatbox", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
-	newChatID, err := m.store.AddChat(context.Background(), newChat)
+}
+
+// newChat adds newChat with a new ID, like a chat with its title and user, and publishes it to the chat list.
+func (m *Main) newChat(ctx context.Context, newChat models.Chat) (string, error) {
+	newChat.ID = uuid.New().String()
+	newChatID, err := m.store.AddChat(ctx, newChat)
 	if err != nil {
 		return "", fmt.Errorf("failed to add chat: %w", err)
 	}
 	newChat.ID = newChatID
 
-	divs, err := m.chatDivs(newChat.ID)
-	if err != nil {
-		return "", fmt.Errorf("failed to create chat divs: %w", err)
+	if err := m.publishChat(ctx, newChat.ID, chatAddedEventType); err != nil {
+		return "", err
 	}
 
-	msg := sse.Message{
-		Type: chatsSSEType,
-	}
-	msg.AppendData(divs)
+	m.notify(ctx, models.Event{
+		Type:   models.EventChatCreated,
+		ChatID: newChat.ID,
+	})
 
-	if err := m.sseSrv.Publish(&msg, chatsSSETopic); err != nil {
-		return "", fmt.Errorf("failed to publish chats: %w", err)
+	return newChat.ID, nil
+}
+
+// newChatFromForm returns the new chat of userID with the optional title, comma-separated tags and system
+// prompt override of the form of r.
+func newChatFromForm(r *http.Request, userID string) models.Chat {
+	return models.Chat{
+		Title:        strings.TrimSpace(r.FormValue("title")),
+		UserID:       userID,
+		Tags:         normalizeTags(strings.Split(r.FormValue("tags"), ",")),
+		SystemPrompt: strings.TrimSpace(r.FormValue("system_prompt")),
 	}
+}
 
-	return newChat.ID, nil
+// normalizeTags returns tags trimmed, without the empty and the duplicate ones, in their order.
+func normalizeTags(tags []string) []string {
+	var res []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !slices.Contains(res, tag) {
+			res = append(res, tag)
+		}
+	}
+	return res
 }
 
 // continueChat continues chat with given chatID.
@@ -254,7 +354,7 @@ func (m Main) newChat() (string, error) {
 // If the last content of the last message is not a CallTool type, it will do nothing.
 // But if it is, as it may happen due to the corrupted data, this function will call the tool,
 // then append the result to the chat.
-func (m Main) continueChat(ctx context.Context, chatID string) error {
+func (m *Main) continueChat(ctx context.Context, chatID string) error {
 	messages, err := m.store.Messages(ctx, chatID)
 	if err != nil {
 		return fmt.Errorf("failed to get messages: %w", err)
@@ -278,7 +378,7 @@ func (m Main) continueChat(ctx context.Context, chatID string) error {
 		return nil
 	}
 
-	toolRes, success := m.callTool(mcp.CallToolParams{
+	toolRes, success := m.callTool(ctx, mcp.CallToolParams{
 		Name:      lastMessage.Contents[len(lastMessage.Contents)-1].ToolName,
 		Arguments: lastMessage.Contents[len(lastMessage.Contents)-1].ToolInput,
 	})
@@ -290,6 +390,8 @@ func (m Main) continueChat(ctx context.Context, chatID string) error {
 
 	lastMessage.Contents[len(lastMessage.Contents)-1].ToolResult = toolRes
 	lastMessage.Contents[len(lastMessage.Contents)-1].CallToolFailed = !success
+	m.guardToolResult(ctx, lastMessage.Contents[len(lastMessage.Contents)-2].ToolName,
+		&lastMessage.Contents[len(lastMessage.Contents)-1])
 
 	err = m.store.UpdateMessage(ctx, chatID, lastMessage)
 	if err != nil {
@@ -299,16 +401,32 @@ func (m Main) continueChat(ctx context.Context, chatID string) error {
 	return nil
 }
 
-func (m Main) callTool(params mcp.CallToolParams) (json.RawMessage, bool) {
-	clientIdx, ok := m.toolsMap[params.Name]
+func (m *Main) callTool(ctx context.Context, params mcp.CallToolParams) (json.RawMessage, bool) {
+	caps := m.capabilities()
+	clientIdx, ok := caps.toolsMap[params.Name]
 	if !ok {
-		m.logger.Error("Tool not found", slog.String("toolName", params.Name))
+		m.logger.ErrorContext(ctx, "Tool not found", slog.String("toolName", params.Name))
 		return callToolError(fmt.Errorf("tool %s is not found", params.Name)), false
 	}
 
-	toolRes, err := m.mcpClients[clientIdx].CallTool(context.Background(), params)
+	// We validate the input before calling the server, so the LLM is told what to fix instead of the server
+	// receiving an input it may not report clearly.
+	if idx := slices.IndexFunc(caps.tools, func(t mcp.Tool) bool { return t.Name == params.Name }); idx >= 0 {
+		if err := validateToolInput(params.Name, caps.tools[idx].InputSchema, params.Arguments); err != nil {
+			m.logger.WarnContext(ctx, "Invalid tool input",
+				slog.String("toolName", params.Name),
+				slog.String(errLoggerKey, err.Error()))
+			return callToolError(err), false
+		}
+	}
+
+	// The renamed tools are called with their names on the server.
+	if name, ok := caps.toolNames[params.Name]; ok {
+		params.Name = name
+	}
+	toolRes, err := m.mcpClients[clientIdx].CallTool(ctx, params)
 	if err != nil {
-		m.logger.Error("Tool call failed",
+		m.logger.ErrorContext(ctx, "Tool call failed",
 			slog.String("toolName", params.Name),
 			slog.String(errLoggerKey, err.Error()))
 		return callToolError(fmt.Errorf("tool call failed: %w", err)), false
@@ -316,53 +434,175 @@ func (m Main) callTool(params mcp.CallToolParams) (json.RawMessage, bool) {
 
 	resContent, err := json.Marshal(toolRes.Content)
 	if err != nil {
-		m.logger.Error("Failed to marshal tool result content",
+		m.logger.ErrorContext(ctx, "Failed to marshal tool result content",
 			slog.String("toolName", params.Name),
 			slog.String(errLoggerKey, err.Error()))
 		return callToolError(fmt.Errorf("failed to marshal content: %w", err)), false
 	}
 
-	m.logger.Debug("Tool result content",
+	m.logger.DebugContext(ctx, "Tool result content",
 		slog.String("toolName", params.Name),
 		slog.String("toolResult", string(resContent)))
 
 	return resContent, !toolRes.IsError
 }
 
-func (m Main) chat(chatID string, messages []models.Message) {
+func (m *Main) chat(ctx context.Context, userID, chatID string, messages []models.Message) error {
+	_, err := m.chatWithUpdates(ctx, userID, chatID, messages, nil)
+	return err
+}
+
+// chatWithUpdates generates the response of the chat of chatID like chat, calling update, if it's not nil,
+// with the response every time it's saved, and returns the response.
+func (m *Main) chatWithUpdates(
+	ctx context.Context,
+	userID, chatID string,
+	messages []models.Message,
+	update func(models.Message),
+) (models.Message, error) {
+	ctx = withResponseLimit(ctx)
+	aiMsg, err := m.generate(ctx, chatID, m.llm, messages, func(msg models.Message) error {
+		if update != nil {
+			update(msg)
+		}
+		return m.store.UpdateMessage(ctx, chatID, msg)
+	})
+	m.recordUsage(ctx, userID, 0, estimateTokens(messages[:len(messages)-1])+estimateTokens([]models.Message{aiMsg}))
+	if err == nil {
+		m.updateChatLanguage(ctx, chatID, append(slices.Clone(messages[:len(messages)-1]), aiMsg))
+	}
+	// The completion of a draft is published once it's approved.
+	if !aiMsg.Draft {
+		m.publishCompletion(ctx, chatID, aiMsg, err)
+	}
+	return aiMsg, err
+}
+
+// generationContext returns a context for a generation started by a request with ctx on behalf of userID,
+// carrying a new generation ID. The context outlives the request, as the generation continues in the
+// background.
+func (m *Main) generationContext(ctx context.Context, userID string) context.Context {
+	ctx = context.WithValue(context.WithoutCancel(ctx), generationUserKey{}, userID)
+	return logging.WithGenerationID(ctx, uuid.New().String())
+}
+
+// generationUser returns the user a generation is made on behalf of, or the default user if ctx isn't a
+// context of generationContext.
+func generationUser(ctx context.Context) string {
+	if userID, ok := ctx.Value(generationUserKey{}).(string); ok {
+		return userID
+	}
+	return defaultUserID
+}
+
+// generationRequest is what a generation sends to the LLM, besides the system prompt and the parameters
+// carried by its context: the messages and the tools, with the sources the LLM is asked to cite and the
+// response schema, nil if the response is free text.
+type generationRequest struct {
+	messages       []models.Message
+	tools          []mcp.Tool
+	sources        []models.Source
+	responseSchema json.RawMessage
+}
+
+// generationRequest returns the context and the request of a generation of the chat of chatID for messages,
+// with the parameters, memories, citations, response schema and mounted resources of the chat, and the
+// instructions of the MCP servers.
+func (m *Main) generationRequest(
+	ctx context.Context,
+	chatID string,
+	messages []models.Message,
+) (context.Context, generationRequest) {
+	messages = append(withoutDrafts(messages[:len(messages)-1]), messages[len(messages)-1])
+	ctx = m.withChatParameters(ctx, chatID)
+	ctx = m.withServerInstructions(ctx)
+	ctx, memoryActive := m.withMemories(ctx, chatID)
+	req := generationRequest{sources: m.generationSources(ctx, chatID, messages)}
+	ctx = withCitations(ctx, req.sources)
+	ctx, req.responseSchema = m.withResponseSchema(ctx, chatID)
+	req.messages = m.withMountedResources(ctx, chatID, messages)
+	ctx, req.messages = m.withSpeakers(ctx, chatID, req.messages)
+
+	req.tools = m.capabilities().tools
+	if memoryActive {
+		req.tools = withMemoryTool(req.tools)
+	}
+	return ctx, req
+}
+
+// generate streams the response of llm for the last message in messages, which must be the assistant
+// message of chatID to be filled. Every time the message changes, save is called with the latest state of
+// the message before the rendered content is published to the message's SSE topic. The states that fail to
+// be saved are kept in memory and retried, the generation failing only if its final state can't be saved.
+// It returns the final state of the assistant message, and the error that aborted the generation, if any.
+func (m *Main) generate(
+	ctx context.Context,
+	chatID string,
+	llm LLM,
+	messages []models.Message,
+	save func(models.Message) error,
+) (aiMsg models.Message, err error) {
+	aiMsg = messages[len(messages)-1]
+	ctx, req := m.generationRequest(ctx, chatID, messages)
+	messages, tools, sources, responseSchema := req.messages, req.tools, req.sources, req.responseSchema
+	ctx = m.recordRequests(ctx, &aiMsg)
+
+	startedAt := time.Now()
+	stats := newStreamStats(startedAt)
+	defer func() {
+		m.exportGeneration(ctx, chatID, llm, messages, aiMsg, startedAt, err)
+	}()
+
 	// Ensure SSE connection cleanup on function exit
 	defer func() {
-		e := &sse.Message{Type: sse.Type("closeMessage")}
-		e.AppendData("bye")
-		_ = m.sseSrv.Publish(e)
+		_ = m.publish(ctx, closeMessageEventType, "bye", messageIDTopic(aiMsg.ID))
+		m.releaseMessageTopic(aiMsg.ID)
 	}()
 
-	aiMsg := messages[len(messages)-1]
-	contentIdx := -1
+	writes := newMessageWrites(ctx, save, m.logger)
+	save = writes.write
+	// The state kept in memory by a failed write is saved even if the generation is aborted.
+	defer writes.flushPending()
+
+	// A continued message keeps its contents, the new ones being appended.
+	contentIdx := len(aiMsg.Contents) - 1
+	toolFailures := make(map[string]int)
+	limit, limited := m.newResponseLimit(ctx, aiMsg, responseSchema != nil)
 
 	for {
-		it := m.llm.Chat(context.Background(), messages, m.tools)
-		aiMsg.Contents = append(aiMsg.Contents, models.Content{
-			Type: models.ContentTypeText,
-			Text: "",
-		})
-		contentIdx++
+		it := llm.Chat(ctx, messages, tools)
+		aiMsg.FinishReason = ""
+		// A continued message ending with a text resumes it, instead of starting a new one.
+		if contentIdx < 0 || aiMsg.Contents[contentIdx].Type != models.ContentTypeText {
+			aiMsg.Contents = append(aiMsg.Contents, models.Content{
+				Type:    models.ContentTypeText,
+				Text:    "",
+				Sources: sources,
+			})
+			contentIdx++
+		}
 		callTool := false
-		badToolInputFlag := false
-		badToolInput := json.RawMessage("{}")
+		var badToolInput json.RawMessage
 
 		for content, err := range it {
-			msg := sse.Message{
-				Type: messagesSSEType,
-			}
 			if err != nil {
-				m.logger.Error("Error from llm provider", slog.String(errLoggerKey, err.Error()))
-				msg.AppendData(err.Error())
-				_ = m.sseSrv.Publish(&msg, messageIDTopic(aiMsg.ID))
-				return
+				m.logger.ErrorContext(ctx, "Error from llm provider", slog.String(errLoggerKey, err.Error()))
+				if textLength(aiMsg.Contents) > 0 {
+					aiMsg = m.interruptGeneration(ctx, aiMsg, stats, err, save)
+				} else {
+					_ = m.publish(ctx, messagesEventType, err.Error(), messageIDTopic(aiMsg.ID))
+				}
+				m.notify(ctx, models.Event{
+					Type:      models.EventGenerationFailed,
+					ChatID:    chatID,
+					MessageID: aiMsg.ID,
+					Data:      map[string]any{"error": err.Error()},
+				})
+				return aiMsg, fmt.Errorf("error from llm provider: %w", err)
 			}
+			stats.chunk()
 
-			m.logger.Debug("LLM response", slog.String("content", fmt.Sprintf("%+v", content)))
+			m.logger.DebugContext(ctx, "LLM response", slog.String("content", fmt.Sprintf("%+v", content)))
 
 			switch content.Type {
 			case models.ContentTypeText:
@@ -374,7 +614,6 @@ func (m Main) chat(chatID string, messages []models.Message) {
 				// empty json string.
 				_, err := json.Marshal(content.ToolInput)
 				if err != nil {
-					badToolInputFlag = true
 					badToolInput = content.ToolInput
 					content.ToolInput = []byte("{}")
 				}
@@ -382,125 +621,238 @@ func (m Main) chat(chatID string, messages []models.Message) {
 				aiMsg.Contents = append(aiMsg.Contents, content)
 				contentIdx++
 			case models.ContentTypeToolResult:
-				m.logger.Error("Content type tool results is not allowed")
-				return
+				m.logger.ErrorContext(ctx, "Content type tool results is not allowed")
+				return aiMsg, errors.New("content type tool results is not allowed")
+			case models.ContentTypeFinish:
+				aiMsg.FinishReason = content.FinishReason
+			case models.ContentTypeCallToolDelta:
+				// The partial input of a tool call is shown until the call is complete, without being saved.
+				if err := m.publishToolCallDelta(ctx, aiMsg, content); err != nil {
+					m.logger.ErrorContext(ctx, "Failed to publish tool call delta", slog.String(errLoggerKey, err.Error()))
+					return aiMsg, err
+				}
+				continue
 			}
 
-			if err := m.store.UpdateMessage(context.Background(), chatID, aiMsg); err != nil {
-				m.logger.Error("Failed to update message",
+			if err := save(aiMsg); err != nil {
+				m.logger.ErrorContext(ctx, "Failed to update message",
 					slog.String("message", fmt.Sprintf("%+v", aiMsg)),
 					slog.String(errLoggerKey, err.Error()))
-				return
+				return aiMsg, fmt.Errorf("failed to update message: %w", err)
 			}
 
 			rc, err := models.RenderContents(aiMsg.Contents)
 			if err != nil {
-				m.logger.Error("Failed to render contents",
+				m.logger.ErrorContext(ctx, "Failed to render contents",
 					slog.String("message", fmt.Sprintf("%+v", aiMsg)),
 					slog.String(errLoggerKey, err.Error()))
-				return
+				return aiMsg, fmt.Errorf("failed to render contents: %w", err)
 			}
-			m.logger.Debug("Render contents",
+			m.logger.DebugContext(ctx, "Render contents",
 				slog.String("origMsg", fmt.Sprintf("%+v", aiMsg.Contents)),
 				slog.String("renderedMsg", rc))
-			msg.AppendData(rc)
-			if err := m.sseSrv.Publish(&msg, messageIDTopic(aiMsg.ID)); err != nil {
-				m.logger.Error("Failed to publish message",
+			if limited {
+				length, err := m.renderLength(limit, aiMsg)
+				if err != nil {
+					m.logger.ErrorContext(ctx, "Failed to render message length", slog.String(errLoggerKey, err.Error()))
+					return aiMsg, err
+				}
+				rc += length
+			}
+			if err := m.publish(ctx, messagesEventType, rc, messageIDTopic(aiMsg.ID)); err != nil {
+				m.logger.ErrorContext(ctx, "Failed to publish message",
 					slog.String("message", fmt.Sprintf("%+v", aiMsg)),
 					slog.String(errLoggerKey, err.Error()))
-				return
+				return aiMsg, fmt.Errorf("failed to publish message: %w", err)
 			}
 
 			if callTool {
 				break
 			}
+			// The soft limit stops the generation, the user choosing whether to continue it.
+			if limited && limit.reached(aiMsg) {
+				aiMsg.LengthLimited = true
+				break
+			}
 		}
+		stats.endTurn()
 
 		if !callTool {
 			break
 		}
 
 		callToolContent := aiMsg.Contents[len(aiMsg.Contents)-1]
-
-		toolResContent := models.Content{
-			Type:       models.ContentTypeToolResult,
-			CallToolID: callToolContent.CallToolID,
-		}
-
-		if badToolInputFlag {
-			toolResContent.ToolResult = callToolError(fmt.Errorf("tool input %s is not valid json", string(badToolInput)))
-			toolResContent.CallToolFailed = true
-			aiMsg.Contents = append(aiMsg.Contents, toolResContent)
-			contentIdx++
-			messages[len(messages)-1] = aiMsg
-			continue
-		}
-
-		toolResult, success := m.callTool(mcp.CallToolParams{
-			Name:      callToolContent.ToolName,
-			Arguments: callToolContent.ToolInput,
-		})
-
-		toolResContent.ToolResult = toolResult
-		toolResContent.CallToolFailed = !success
+		toolResContent := m.toolCallResult(ctx, chatID, aiMsg.ID, callToolContent, badToolInput)
+		m.trackToolFailure(ctx, callToolContent.ToolName, &toolResContent, toolFailures)
 		aiMsg.Contents = append(aiMsg.Contents, toolResContent)
 		contentIdx++
 		messages[len(messages)-1] = aiMsg
 	}
+
+	if responseSchema != nil {
+		markStructuredOutput(aiMsg.Contents, responseSchema)
+	}
+	aiMsg.Stats = stats.stats(aiMsg)
+	if err := writes.flush(aiMsg); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to update message", slog.String(errLoggerKey, err.Error()))
+		return aiMsg, fmt.Errorf("failed to update message: %w", err)
+	}
+	m.publishStats(ctx, aiMsg)
+
+	// A draft is notified once it's approved.
+	if !aiMsg.Draft {
+		m.notifyCompletion(ctx, chatID, aiMsg, nil)
+	}
+	return aiMsg, nil
 }
 
-func (m Main) generateChatTitle(chatID string, message string) {
-	title, err := m.titleGenerator.GenerateTitle(context.Background(), message)
+// publishToolCallDelta publishes aiMsg rendered with the tool call being prepared of delta after its contents,
+// showing the input of the call as it's streamed.
+func (m *Main) publishToolCallDelta(ctx context.Context, aiMsg models.Message, delta models.Content) error {
+	rc, err := models.RenderContents(append(slices.Clone(aiMsg.Contents), delta))
 	if err != nil {
-		m.logger.Error("Error generating chat title",
-			slog.String("message", message),
-			slog.String(errLoggerKey, err.Error()))
-		return
+		return fmt.Errorf("failed to render contents: %w", err)
 	}
+	if err := m.publish(ctx, messagesEventType, rc, messageIDTopic(aiMsg.ID)); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+	return nil
+}
+
+// notifyCompletion notifies the completion of the assistant message aiMsg of chatID, with its text and data.
+func (m *Main) notifyCompletion(ctx context.Context, chatID string, aiMsg models.Message, data map[string]any) {
+	var text strings.Builder
+	for _, ct := range aiMsg.Contents {
+		text.WriteString(ct.Text)
+	}
+	if data == nil {
+		data = make(map[string]any)
+	}
+	data["text"] = text.String()
+	m.notify(ctx, models.Event{
+		Type:      models.EventGenerationCompleted,
+		ChatID:    chatID,
+		MessageID: aiMsg.ID,
+		Data:      data,
+	})
+}
 
-	updatedChat := models.Chat{
-		ID:    chatID,
-		Title: title,
+// toolCallResult calls the tool of call, a call tool content of the assistant message of messageID in
+// chatID, and returns the content of its result. The result of a cached tool is taken from the cache if the
+// tool was called with the same input recently. If badInput isn't nil, it's the input of the call, which
+// isn't valid JSON, and the call fails without calling the tool.
+func (m *Main) toolCallResult(
+	ctx context.Context,
+	chatID, messageID string,
+	call models.Content,
+	badInput json.RawMessage,
+) models.Content {
+	res := models.Content{
+		Type:       models.ContentTypeToolResult,
+		CallToolID: call.CallToolID,
 	}
-	if err := m.store.UpdateChat(context.Background(), updatedChat); err != nil {
-		m.logger.Error("Failed to update chat title",
-			slog.String(errLoggerKey, err.Error()))
-		return
+
+	if badInput != nil {
+		res.ToolResult = callToolError(fmt.Errorf("tool input %s is not valid json", string(badInput)))
+		res.CallToolFailed = true
+		return res
 	}
 
-	divs, err := m.chatDivs(chatID)
-	if err != nil {
-		m.logger.Error("Failed to generate chat divs",
-			slog.String(errLoggerKey, err.Error()))
-		return
+	if m.isMemoryToolCall(ctx, chatID, call.ToolName) {
+		var success bool
+		res.ToolResult, success = m.saveMemory(ctx, call.ToolInput)
+		res.CallToolFailed = !success
+		return res
 	}
 
-	msg := sse.Message{
-		Type: chatsSSEType,
+	cacheKey, cacheable := m.toolCacheKey(call.ToolName, call.ToolInput)
+	if cacheable {
+		if cached, ok := m.toolResults.get(cacheKey, time.Now()); ok {
+			m.logger.DebugContext(ctx, "Tool result served from the cache", slog.String("toolName", call.ToolName))
+			res.ToolResult = cached
+			m.guardToolResult(ctx, call.ToolName, &res)
+			return res
+		}
+	}
+
+	toolResult, success := m.callTool(ctx, mcp.CallToolParams{
+		Name:      call.ToolName,
+		Arguments: call.ToolInput,
+	})
+	if cacheable && success {
+		m.toolResults.put(cacheKey, toolResult, time.Now(), m.toolCache.TTL)
+	}
+
+	res.ToolResult = toolResult
+	res.CallToolFailed = !success
+	m.guardToolResult(ctx, call.ToolName, &res)
+
+	if !success {
+		m.notify(ctx, models.Event{
+			Type:      models.EventToolCallFailed,
+			ChatID:    chatID,
+			MessageID: messageID,
+			Data: map[string]any{
+				"toolName": call.ToolName,
+				"result":   toolResult,
+			},
+		})
 	}
-	msg.AppendData(divs)
-	if err := m.sseSrv.Publish(&msg, chatsSSETopic); err != nil {
-		m.logger.Error("Failed to publish chats",
+	return res
+}
+
+func (m *Main) generateChatTitle(ctx context.Context, chatID string, message string) {
+	if m.titleGeneration.Heuristic {
+		if title := heuristicTitle(message, m.titleGeneration.HeuristicWords); title != "" {
+			m.updateChatTitle(ctx, chatID, message, title, false)
+		}
+		return
+	}
+	language := m.titleLanguage(message)
+	title, err := m.titleGenerator.GenerateTitle(ctx, message, language)
+	if err != nil {
+		retryIn := m.queuedTitles.fail(chatID, time.Now(), m.titleGeneration.RetryBackoff)
+		m.logger.ErrorContext(ctx, "Error generating chat title",
+			slog.String("message", message),
+			slog.String("language", language),
+			slog.Duration("retryIn", retryIn),
 			slog.String(errLoggerKey, err.Error()))
+		// The chat is titled with the first words of the message until the title generator is back.
+		if title := heuristicTitle(message, m.titleGeneration.HeuristicWords); title != "" {
+			m.updateChatTitle(ctx, chatID, message, title, true)
+		}
+		return
 	}
+	m.queuedTitles.succeed(chatID)
+	m.updateChatTitle(ctx, chatID, message, title, false)
 }
 
-func (m Main) chatDivs(activeID string) (string, error) {
-	chats, err := m.store.Chats(context.Background())
+// updateChatTitle sets the title of the chat of chatID generated from its first message, a fallback title if
+// the title generator failed, and publishes the chat to the chat list.
+func (m *Main) updateChatTitle(ctx context.Context, chatID, message, title string, fallback bool) {
+	// The chat is read again to keep its parameters, which may be set while the title is generated.
+	updatedChat, err := m.findChat(ctx, chatID)
 	if err != nil {
-		return "", fmt.Errorf("failed to get chats: %w", err)
+		m.logger.ErrorContext(ctx, "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		return
+	}
+	updatedChat.Title = title
+	updatedChat.TitleFallback = fallback
+	// The language of the code of the message labels the chat along its title, before the response.
+	if language := detectLanguage([]models.Message{{
+		Role:     models.RoleUser,
+		Contents: []models.Content{{Type: models.ContentTypeText, Text: message}},
+	}}); language != "" && updatedChat.Language == "" {
+		updatedChat.Language = language
+	}
+	if err := m.store.UpdateChat(ctx, updatedChat); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to update chat title",
+			slog.String(errLoggerKey, err.Error()))
+		return
 	}
 
-	var sb strings.Builder
-	for _, ch := range chats {
-		err := m.templates.ExecuteTemplate(&sb, "chat_title", chat{
-			ID:     ch.ID,
-			Title:  ch.Title,
-			Active: ch.ID == activeID,
-		})
-		if err != nil {
-			return "", fmt.Errorf("failed to execute chat_title template: %w", err)
-		}
+	if err := m.publishChat(ctx, chatID, chatUpdatedEventType); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to publish chat",
+			slog.String(errLoggerKey, err.Error()))
 	}
-	return sb.String(), nil
 }
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// HandleChatInfo renders the info panel of the chat of the chat_id query parameter, with the statistics of
+// its transcript aggregated by the store: the numbers of messages, tool calls, words and characters, the
+// tokens used by its generations and the times of its first and last messages, to follow the growth of the
+// context given to the LLM.
+func (m *Main) HandleChatInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chatID := r.URL.Query().Get("chat_id")
+	if chatID == "" {
+		http.Error(w, "Chat ID is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := m.findUserChat(r, chatID); err != nil {
+		if errors.Is(err, errChatNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		m.logger.ErrorContext(r.Context(), "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stats, err := m.store.ChatStats(r.Context(), chatID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get chat stats",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	loc := userLocation(r)
+	stats.FirstMessageAt = stats.FirstMessageAt.In(loc)
+	stats.LastMessageAt = stats.LastMessageAt.In(loc)
+
+	if err := m.templates.ExecuteTemplate(w, "chat_info", stats); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute chat_info template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
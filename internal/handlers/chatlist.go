@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// chatListPage is a page of the chat list of the sidebar, rendered by the chat_list template. Next is the ID
+// of its last chat, the cursor of the next page, if there are more chats, and ActiveID is the chat shown by
+// the page, carried to the next pages to mark it as active.
+type chatListPage struct {
+	Chats    []chat
+	Next     string
+	ActiveID string
+}
+
+// defaultChatListPageSize is the number of chats of a page of the chat list.
+const defaultChatListPageSize = 50
+
+// WithChatListPageSize sets the number of chats of a page of the chat list of the sidebar, whose next pages
+// are loaded as it's scrolled, so the installations with thousands of chats don't render them all. It
+// defaults to 50, and NewMain returns an error if it's negative.
+func WithChatListPageSize(size int) MainOption {
+	return func(m *Main) {
+		m.chatListPageSize = size
+	}
+}
+
+func (m *Main) parseChatListPageSize() error {
+	if m.chatListPageSize < 0 {
+		return errors.New("the page size of the chat list must not be negative")
+	}
+	if m.chatListPageSize == 0 {
+		m.chatListPageSize = defaultChatListPageSize
+	}
+	return nil
+}
+
+// HandleChatList renders the page of the chat list following the chat of the "after" query parameter, with
+// the chat of the "chat_id" query parameter marked as active, using the chat_list template. The page is empty
+// if the chat of "after" isn't listed anymore, like a deleted chat.
+func (m *Main) HandleChatList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cs, err := m.store.Chats(r.Context())
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get chats", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cs = m.visibleChats(r, cs)
+
+	activeID := r.URL.Query().Get("chat_id")
+	page := chatListPage{ActiveID: activeID}
+	after := r.URL.Query().Get("after")
+	if idx := slices.IndexFunc(cs, func(c models.Chat) bool { return c.ID == after }); idx >= 0 {
+		page = newChatListPage(cs[idx+1:], m.chatListPageSize, activeID)
+	}
+	if err := m.templates.ExecuteTemplate(w, "chat_list", page); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute chat_list template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// newChatListPage returns the page of the first size chats, with the chat of activeID marked as active.
+func newChatListPage(chats []models.Chat, size int, activeID string) chatListPage {
+	page := chatListPage{ActiveID: activeID}
+	if size < len(chats) {
+		chats = chats[:size]
+		page.Next = chats[size-1].ID
+	}
+	page.Chats = make([]chat, len(chats))
+	for i, c := range chats {
+		page.Chats[i] = newChatView(c)
+		page.Chats[i].Active = c.ID == activeID
+	}
+	return page
+}
+
+// firstChatListPageSize returns the size of the first page of the chat list of chats shown with the chat of
+// activeID, which holds the pages up to the one of the active chat, so it's listed.
+func (m *Main) firstChatListPageSize(chats []models.Chat, activeID string) int {
+	idx := slices.IndexFunc(chats, func(c models.Chat) bool { return c.ID == activeID })
+	return (max(idx, 0)/m.chatListPageSize + 1) * m.chatListPageSize
+}
+
+func newChatView(c models.Chat) chat {
+	return chat{
+		ID:       c.ID,
+		Title:    c.Title,
+		Language: c.Language,
+		Tags:     c.Tags,
+	}
+}
+
+// publishChat publishes the chat of chatID alone, rather than the chat list, to the chats SSE topic and to the
+// user topics of its participants who don't see all the chats, so the pages don't render thousands of chats
+// again. The event of eventType is chatAddedEventType for a new chat, listed first by the pages, or
+// chatUpdatedEventType for a changed chat, replaced by the pages listing it.
+func (m *Main) publishChat(ctx context.Context, chatID, eventType string) error {
+	c, err := m.findChat(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	if err := m.templates.ExecuteTemplate(&sb, "chat_title", newChatView(c)); err != nil {
+		return fmt.Errorf("failed to execute chat_title template: %w", err)
+	}
+	topics := append([]string{chatsSSETopic}, m.participantTopics(c)...)
+	if err := m.publish(ctx, eventType, sb.String(), topics...); err != nil {
+		return fmt.Errorf("failed to publish chat: %w", err)
+	}
+	return nil
+}
+
+// publishChats publishes the first page of the chat list to the chats SSE topic, and the first page of the
+// chats they see to the users who don't see all of them. It's meant for the changes of many chats at once, like
+// a purge, the changes of a single chat being published by publishChat.
+func (m *Main) publishChats(ctx context.Context) error {
+	chats, err := m.store.Chats(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get chats: %w", err)
+	}
+	divs, err := m.chatDivs(chats)
+	if err != nil {
+		return err
+	}
+
+	if err := m.publish(ctx, chatsEventType, divs, chatsSSETopic); err != nil {
+		return fmt.Errorf("failed to publish chats: %w", err)
+	}
+	return m.publishUserChats(ctx, chats)
+}
+
+// chatDivs renders the first page of the chat list of chats.
+func (m *Main) chatDivs(chats []models.Chat) (string, error) {
+	var sb strings.Builder
+	page := newChatListPage(chats, m.chatListPageSize, "")
+	if err := m.templates.ExecuteTemplate(&sb, "chat_list", page); err != nil {
+		return "", fmt.Errorf("failed to execute chat_list template: %w", err)
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// attachedResourcePattern matches the beginning of a resource attachment, with the quoted URI of the resource.
+var attachedResourcePattern = regexp.MustCompile(`^<resource uri=("(?:[^"\\]|\\.)*")>`)
+
+// HandleResourceView serves the current text of a resource of the MCP servers as plain text, for the
+// citations of the resources in the messages to link to. It accepts GET requests with the uri parameter.
+func (m *Main) HandleResourceView(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	uri := r.URL.Query().Get("uri")
+	clientIdx, ok := m.capabilities().resourceClient(uri)
+	if !ok {
+		http.Error(w, "Resource not found", http.StatusNotFound)
+		return
+	}
+	res, err := m.mcpClients[clientIdx].ReadResource(r.Context(), mcp.ReadResourceParams{URI: uri})
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to read resource",
+			slog.String("uri", uri),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, fmt.Sprintf("Failed to read resource %s: %s", uri, err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(resourceText(res.Contents)))
+}
+
+// attachmentSources returns the sources of the resources in attachments, the attached prompts having none.
+func (caps capabilities) attachmentSources(attachments []string) []models.Source {
+	var sources []models.Source
+	for _, attachment := range attachments {
+		match := attachedResourcePattern.FindStringSubmatch(attachment)
+		if match == nil {
+			continue
+		}
+		if uri, err := strconv.Unquote(match[1]); err == nil {
+			sources = append(sources, caps.source(uri))
+		}
+	}
+	return sources
+}
+
+// source returns the source of the resource of uri, named after the resource or the resource template it
+// expands if the servers list them. The web resources are linked directly, the other ones are served by
+// HandleResourceView.
+func (caps capabilities) source(uri string) models.Source {
+	source := models.Source{URI: uri, URL: "/resources/view?uri=" + url.QueryEscape(uri)}
+	if u, err := url.Parse(uri); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		source.URL = uri
+	}
+
+	if idx := slices.IndexFunc(caps.resources, func(r mcp.Resource) bool { return r.URI == uri }); idx >= 0 {
+		source.Name = caps.resources[idx].Name
+		return source
+	}
+	for _, t := range caps.resourceTemplates {
+		if matchesURITemplate(t.URITemplate, uri) {
+			source.Name = t.Name
+			break
+		}
+	}
+	return source
+}
+
+// generationSources returns the sources given to the LLM in a generation of the chat of chatID, numbered by
+// their position: the resources attached to the user messages, followed by the resources mounted in the
+// chat. A resource given several times is only listed once.
+func (m *Main) generationSources(ctx context.Context, chatID string, messages []models.Message) []models.Source {
+	var sources []models.Source
+	add := func(source models.Source) {
+		if !slices.ContainsFunc(sources, func(s models.Source) bool { return s.URI == source.URI }) {
+			sources = append(sources, source)
+		}
+	}
+
+	for _, msg := range messages {
+		if msg.Role != models.RoleUser {
+			continue
+		}
+		for _, content := range msg.Contents {
+			for _, source := range content.Sources {
+				add(source)
+			}
+		}
+	}
+	if c, err := m.findChat(ctx, chatID); err == nil {
+		caps := m.capabilities()
+		for _, uri := range c.MountedResources {
+			add(caps.source(uri))
+		}
+	}
+	return sources
+}
+
+// withCitations returns a copy of ctx carrying the instructions to cite sources in the system prompt, or ctx
+// as is if there are none.
+func withCitations(ctx context.Context, sources []models.Source) context.Context {
+	if len(sources) == 0 {
+		return ctx
+	}
+
+	var sb strings.Builder
+	sb.WriteString("The resources given in this chat are numbered as follows:\n")
+	for i, source := range sources {
+		sb.WriteString(fmt.Sprintf("[%d] %s\n", i+1, source.URI))
+	}
+	sb.WriteString("\nWhen you use the content of a resource, cite it with its number in brackets, like [1].")
+	return models.WithSystemPrompt(ctx, sb.String())
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// WithTrustedProxies sets the reverse proxies, by their IP address or CIDR range, whose X-Forwarded-For
+// header identifies the clients, for the lockout, the sessions and the audit log. The header of the other
+// requests is ignored, as any client can set it, and their clients are identified by the address of their
+// connection. NewMain returns an error if an address or a range is invalid.
+func WithTrustedProxies(proxies []string) MainOption {
+	return func(m *Main) {
+		m.trustedProxies = proxies
+	}
+}
+
+func (m *Main) parseTrustedProxies() error {
+	for _, proxy := range m.trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy range %q: %w", proxy, err)
+			}
+			m.proxyPrefixes = append(m.proxyPrefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		m.proxyPrefixes = append(m.proxyPrefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return nil
+}
+
+// clientIP returns the IP address of the client of r: the address of the connection, or, if it's a trusted
+// proxy, the last address of the X-Forwarded-For header that isn't a trusted proxy, as the addresses before
+// it are set by the client.
+func (m *Main) clientIP(r *http.Request) string {
+	return m.forwardedClientIP(r.RemoteAddr, r.Header.Values("X-Forwarded-For"))
+}
+
+// forwardedClientIP returns the IP address of the client of a connection from remoteAddr, with the values of
+// its X-Forwarded-For header, like clientIP.
+func (m *Main) forwardedClientIP(remoteAddr string, forwardedFor []string) string {
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+	if !m.trustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(forwardedFor, ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !m.trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// trustedProxy reports whether ip is the address of a trusted proxy.
+func (m *Main) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range m.proxyPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
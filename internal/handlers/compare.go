@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// comparison holds the two candidate responses of a single user message in compare mode. The candidates
+// are kept in memory until the user picks one of them, and only the picked candidate is stored in the chat.
+type comparison struct {
+	chatID string
+	// userID is the user who started the comparison, the only one picking its candidate.
+	userID     string
+	candidates [2]models.Message
+	done       [2]bool
+	// expiresAt is when the comparison is dropped if none of its candidates is picked: comparisonTTL after
+	// both of them are generated, or comparisonMaxAge after it started if they're never generated.
+	expiresAt time.Time
+}
+
+// comparisons holds the comparisons waiting for a pick. The comparisons never picked, like the ones of a
+// closed tab, are dropped once they expire, or once a new comparison is started in their chat.
+type comparisons struct {
+	mu    sync.Mutex
+	items map[string]*comparison
+}
+
+const (
+	// comparisonTTL is how long the candidates of a comparison are kept once they're generated, waiting for a
+	// pick.
+	comparisonTTL = time.Hour
+	// comparisonMaxAge is how long a comparison is kept at most, even if its candidates are still being
+	// generated, like a generation stuck on a tool call.
+	comparisonMaxAge = 24 * time.Hour
+)
+
+type compareData struct {
+	ID          string
+	UserMessage message
+	Candidates  []message
+}
+
+// HandleCompare processes a user message in compare mode through HTTP POST requests. The message is
+// stored in the chat as usual, but the response is generated concurrently by both the main LLM and the
+// compare LLM. Both responses are streamed side-by-side through Server-Sent Events (SSE), and none of
+// them are stored in the chat until the user picks one through HandleCompareChoice.
+//
+// The handler expects "message" and "chat_id" form fields, compare mode is only available for existing
+// chats. It returns http.StatusNotFound if the compare LLM is not configured.
+func (m *Main) HandleCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if m.compareLLM == nil {
+		m.logger.ErrorContext(r.Context(), "Compare mode is not configured")
+		http.Error(w, "Compare mode is not configured", http.StatusNotFound)
+		return
+	}
+
+	msg := r.FormValue("message")
+	if msg == "" {
+		m.logger.ErrorContext(r.Context(), "Message is required")
+		http.Error(w, "Message is required", http.StatusBadRequest)
+		return
+	}
+
+	chatID := r.FormValue("chat_id")
+	if chatID == "" {
+		m.logger.ErrorContext(r.Context(), "Chat ID is required")
+		http.Error(w, "Chat ID is required", http.StatusBadRequest)
+		return
+	}
+	if !m.authorizeChat(w, r, chatID) {
+		return
+	}
+
+	userID := m.userID(r)
+	if !m.checkQuota(w, r, userID) {
+		return
+	}
+
+	if err := m.continueChat(r.Context(), chatID); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to continue chat", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	um := models.Message{
+		ID:   uuid.New().String(),
+		Role: models.RoleUser,
+		Contents: []models.Content{
+			{
+				Type: models.ContentTypeText,
+				Text: msg,
+			},
+		},
+		Timestamp: time.Now(),
+		UserID:    userID,
+	}
+	userMsgID, err := m.store.AddMessage(r.Context(), chatID, um)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to add user message",
+			slog.String("message", fmt.Sprintf("%+v", um)),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	um.ID = userMsgID
+	m.recordUsage(r.Context(), userID, 1, 0)
+
+	history, err := m.store.MessagePath(r.Context(), chatID, userMsgID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get messages",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cmp := &comparison{chatID: chatID, userID: userID, expiresAt: time.Now().Add(comparisonMaxAge)}
+	for i := range cmp.candidates {
+		cmp.candidates[i] = models.Message{
+			ID:        uuid.New().String(),
+			Role:      models.RoleAssistant,
+			Timestamp: time.Now(),
+		}
+	}
+	compareID := uuid.New().String()
+	// The candidates are rendered in their initial state, which their generations update concurrently.
+	candidates := cmp.candidates
+
+	m.comparisons.add(compareID, cmp, time.Now())
+
+	for i, llm := range []LLM{m.llm, m.compareLLM} {
+		messages := append(slices.Clone(history), cmp.candidates[i])
+		ctx := m.generationContext(r.Context(), userID)
+		m.claimMessageTopic(chatID, cmp.candidates[i].ID, userID)
+		go func() {
+			// The error is already logged and published to the client by the generation.
+			aiMsg, _ := m.generate(ctx, chatID, llm, messages, func(msg models.Message) error {
+				m.comparisons.mu.Lock()
+				defer m.comparisons.mu.Unlock()
+				cmp.candidates[i] = msg
+				return nil
+			})
+			m.comparisons.mu.Lock()
+			cmp.done[i] = true
+			if cmp.ended() {
+				cmp.expiresAt = time.Now().Add(comparisonTTL)
+			}
+			m.comparisons.mu.Unlock()
+			m.recordUsage(ctx, userID, 0, estimateTokens(history)+estimateTokens([]models.Message{aiMsg}))
+		}()
+	}
+
+	userContent, err := models.RenderContents(um.Contents)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to render contents",
+			slog.String("message", fmt.Sprintf("%+v", um)),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := compareData{
+		ID: compareID,
+		UserMessage: message{
+			ID:             um.ID,
+			Role:           string(um.Role),
+			Content:        userContent,
+			Timestamp:      um.Timestamp.In(userLocation(r)),
+			StreamingState: "ended",
+		},
+	}
+	for _, c := range candidates {
+		data.Candidates = append(data.Candidates, message{
+			ID:             c.ID,
+			Role:           string(c.Role),
+			Timestamp:      c.Timestamp.In(userLocation(r)),
+			StreamingState: "loading",
+		})
+	}
+
+	if err := m.templates.ExecuteTemplate(w, "compare_messages", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute compare_messages template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleCompareChoice stores the candidate response picked by the user in compare mode as the assistant
+// message of the chat, and discards the other one. The handler expects "compare_id" and "choice" form
+// fields, where choice is the zero-based index of the picked candidate. Only the user who started the
+// comparison picks its candidate, while they still see its chat.
+//
+// It returns http.StatusConflict if the picked candidate is still being generated, and renders the
+// stored message as a regular ai_message otherwise.
+func (m *Main) HandleCompareChoice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	compareID := r.FormValue("compare_id")
+	choice, err := strconv.Atoi(r.FormValue("choice"))
+	if err != nil || choice < 0 || choice > 1 {
+		m.logger.ErrorContext(r.Context(), "Invalid choice", slog.String("choice", r.FormValue("choice")))
+		http.Error(w, "Invalid choice", http.StatusBadRequest)
+		return
+	}
+
+	m.comparisons.mu.Lock()
+	cmp, ok := m.comparisons.items[compareID]
+	if ok && cmp.expired(time.Now()) {
+		delete(m.comparisons.items, compareID)
+		ok = false
+	}
+	// The comparisons of the other users are treated like the missing ones.
+	ok = ok && cmp.userID == m.userID(r)
+	m.comparisons.mu.Unlock()
+	if !ok {
+		m.logger.ErrorContext(r.Context(), "Comparison not found", slog.String("compareID", compareID))
+		http.Error(w, "Comparison not found", http.StatusNotFound)
+		return
+	}
+	if !m.authorizeChat(w, r, cmp.chatID) {
+		return
+	}
+
+	m.comparisons.mu.Lock()
+	if m.comparisons.items[compareID] != cmp {
+		// Another request of the user picked a candidate in the meantime.
+		m.comparisons.mu.Unlock()
+		http.Error(w, "Comparison not found", http.StatusNotFound)
+		return
+	}
+	if !cmp.done[choice] {
+		m.comparisons.mu.Unlock()
+		http.Error(w, "Response is still being generated", http.StatusConflict)
+		return
+	}
+	picked := cmp.candidates[choice]
+	delete(m.comparisons.items, compareID)
+	m.comparisons.mu.Unlock()
+
+	msgID, err := m.store.AddMessage(r.Context(), cmp.chatID, picked)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to add AI message",
+			slog.String("message", fmt.Sprintf("%+v", picked)),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	content, err := models.RenderContents(picked.Contents)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to render contents",
+			slog.String("message", fmt.Sprintf("%+v", picked)),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = m.templates.ExecuteTemplate(w, "ai_message", message{
+		ID:             msgID,
+		Role:           string(picked.Role),
+		Content:        content,
+		Timestamp:      picked.Timestamp.In(userLocation(r)),
+		StreamingState: "ended",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// add adds cmp, dropping the expired comparisons, and the comparisons of the chat of cmp whose candidates are
+// generated, as the chat moved on without them.
+func (c *comparisons) add(id string, cmp *comparison, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for item, other := range c.items {
+		if other.expired(now) || (other.chatID == cmp.chatID && other.ended()) {
+			delete(c.items, item)
+		}
+	}
+	c.items[id] = cmp
+}
+
+// ended reports whether both candidates are generated. The caller must hold the lock of the comparisons.
+func (c *comparison) ended() bool {
+	return c.done[0] && c.done[1]
+}
+
+// expired reports whether the comparison expired at now. The caller must hold the lock of the comparisons.
+func (c *comparison) expired(now time.Time) bool {
+	return now.After(c.expiresAt)
+}
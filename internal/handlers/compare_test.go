@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComparisonsAdd(t *testing.T) {
+	now := time.Now()
+	started := func(chatID string, at time.Time) *comparison {
+		return &comparison{chatID: chatID, expiresAt: at.Add(comparisonMaxAge)}
+	}
+	generated := func(chatID string, at time.Time) *comparison {
+		return &comparison{chatID: chatID, done: [2]bool{true, true}, expiresAt: at.Add(comparisonTTL)}
+	}
+	c := comparisons{items: map[string]*comparison{
+		"running":           started("1", now.Add(-time.Hour)),
+		"stuck":             started("2", now.Add(-comparisonMaxAge-time.Minute)),
+		"generated":         generated("2", now.Add(-time.Minute)),
+		"generated expired": generated("3", now.Add(-comparisonTTL-time.Minute)),
+		"generated in chat": generated("1", now.Add(-time.Minute)),
+	}}
+
+	c.add("new", started("1", now), now)
+
+	for _, id := range []string{"running", "generated", "new"} {
+		if _, ok := c.items[id]; !ok {
+			t.Errorf("comparison %q is dropped, want it kept", id)
+		}
+	}
+	for _, id := range []string{"stuck", "generated expired", "generated in chat"} {
+		if _, ok := c.items[id]; ok {
+			t.Errorf("comparison %q is kept, want it dropped", id)
+		}
+	}
+}
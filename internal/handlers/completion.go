@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// completion is the event published to the topic of a chat when a generation of the chat finishes, so the
+// pages showing other chats, or in a background tab, can mark the chat as unread and notify the user.
+type completion struct {
+	ChatID    string `json:"chatId"`
+	MessageID string `json:"messageId"`
+	Title     string `json:"title"`
+	// Preview is the beginning of the response's text, or the error if the generation failed.
+	Preview string `json:"preview"`
+	Failed  bool   `json:"failed"`
+}
+
+// completionPreviewLength is the maximum length in runes of the preview of a completion.
+const completionPreviewLength = 120
+
+func chatIDTopic(chatID string) string {
+	return "chat-" + chatID
+}
+
+// chatTopics returns the topics of all the chats the user of r sees, which the chat list connections
+// subscribe to.
+func (m *Main) chatTopics(r *http.Request) []string {
+	ctx := r.Context()
+	chats, err := m.store.Chats(ctx)
+	if err != nil {
+		m.logger.WarnContext(ctx, "Failed to get chats of SSE session", slog.String(errLoggerKey, err.Error()))
+		return nil
+	}
+	chats = m.visibleChats(r, chats)
+	topics := make([]string, len(chats))
+	for i, c := range chats {
+		topics[i] = chatIDTopic(c.ID)
+	}
+	return topics
+}
+
+// publishCompletion publishes the completion of aiMsg in the chat of chatID, failed with genErr if it's
+// not nil, to the chat's topic.
+func (m *Main) publishCompletion(ctx context.Context, chatID string, aiMsg models.Message, genErr error) {
+	c := completion{
+		ChatID:    chatID,
+		MessageID: aiMsg.ID,
+		Failed:    genErr != nil,
+	}
+	if chat, err := m.findChat(ctx, chatID); err == nil {
+		c.Title = chat.Title
+	}
+	if genErr != nil {
+		c.Preview = genErr.Error()
+	} else {
+		var text strings.Builder
+		for _, ct := range aiMsg.Contents {
+			text.WriteString(ct.Text)
+		}
+		c.Preview = strings.TrimSpace(text.String())
+	}
+	if runes := []rune(c.Preview); len(runes) > completionPreviewLength {
+		c.Preview = string(runes[:completionPreviewLength-1]) + "…"
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to marshal completion", slog.String(errLoggerKey, err.Error()))
+		return
+	}
+	if err := m.publish(ctx, completionEventType, string(data), chatIDTopic(chatID)); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to publish completion", slog.String(errLoggerKey, err.Error()))
+	}
+}
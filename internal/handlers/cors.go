@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS configures the cross-origin requests to the chat API and the SSE streams, allowed by the CORS
+// middleware, so a separately hosted web app or a browser extension talks to the server. The pages of the UI
+// are never shared cross-origin.
+type CORS struct {
+	// AllowedOrigins are the origins allowed to send the requests, like https://app.example.com, or "*" for any
+	// origin. The cross-origin requests are denied if it's empty.
+	AllowedOrigins []string
+	// AllowedMethods are the methods of the requests, GET, POST and OPTIONS if it's empty.
+	AllowedMethods []string
+	// AllowedHeaders are the headers the requests send besides the CORS-safelisted ones. The Authorization,
+	// Content-Type, Idempotency-Key, X-Request-ID and Last-Event-ID headers are allowed if it's empty.
+	AllowedHeaders []string
+	// AllowCredentials lets the requests send the cookies and the credentials of the browser, like the
+	// cookies of an authenticating proxy. It requires explicit origins.
+	AllowCredentials bool
+	// MaxAge is how long the browsers cache the responses to the preflight requests, their own default if
+	// it's zero.
+	MaxAge time.Duration
+}
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodOptions}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", idempotencyKeyHeader, requestIDHeader, "Last-Event-ID"}
+	// corsExposedHeaders are the headers of the responses readable by the cross-origin clients.
+	corsExposedHeaders = []string{requestIDHeader, generationIDHeader}
+)
+
+// WithCORS allows the cross-origin requests of cors to the chat API and the SSE streams.
+func WithCORS(cors CORS) MainOption {
+	return func(m *Main) {
+		m.cors = cors
+	}
+}
+
+func (m *Main) parseCORS() error {
+	for _, origin := range m.cors.AllowedOrigins {
+		if origin == "*" {
+			if m.cors.AllowCredentials {
+				return errors.New("the credentials can't be allowed for any origin, the origins must be listed")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("invalid allowed origin %q, expected a scheme and a host like https://example.com", origin)
+		}
+	}
+	if m.cors.MaxAge < 0 {
+		return errors.New("the max age of the preflight requests must not be negative")
+	}
+	if len(m.cors.AllowedMethods) == 0 {
+		m.cors.AllowedMethods = defaultCORSMethods
+	}
+	if len(m.cors.AllowedHeaders) == 0 {
+		m.cors.AllowedHeaders = defaultCORSHeaders
+	}
+	return nil
+}
+
+// CORS is a middleware that allows the cross-origin requests of WithCORS to the chat API, under /api/, and
+// to the SSE streams, under /sse/. It answers the preflight requests itself, before they're authenticated,
+// as the browsers send them without credentials. The other requests are passed through, the browsers
+// hiding the responses of the denied origins from their clients.
+func (m *Main) CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(m.cors.AllowedOrigins) == 0 ||
+			(!strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/sse/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		allowed := m.allowsOrigin(origin)
+		if allowed {
+			if slices.Contains(m.cors.AllowedOrigins, "*") {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if m.cors.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			if allowed {
+				h.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		if !allowed {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(m.cors.AllowedMethods, ", "))
+		h.Set("Access-Control-Allow-Headers", strings.Join(m.cors.AllowedHeaders, ", "))
+		if m.cors.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(m.cors.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (m *Main) allowsOrigin(origin string) bool {
+	for _, allowed := range m.cors.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
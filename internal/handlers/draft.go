@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// draftView is a response awaiting its review in the schedules page, with the prompt it answers.
+type draftView struct {
+	ChatID    string
+	MessageID string
+	Prompt    string
+	Content   string
+	Error     string
+	Timestamp string
+}
+
+var errDraftNotFound = errors.New("draft not found")
+
+// withoutDrafts returns messages without the drafts, approved or not, in a new slice.
+func withoutDrafts(messages []models.Message) []models.Message {
+	return slices.DeleteFunc(slices.Clone(messages), func(msg models.Message) bool { return msg.Draft })
+}
+
+// drafts returns the drafts of the chat of chatID awaiting their review, the oldest first.
+func (m *Main) drafts(r *http.Request, chatID string) ([]draftView, error) {
+	messages, err := m.store.Messages(r.Context(), chatID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages: %w", err)
+	}
+	loc := userLocation(r)
+	var drafts []draftView
+	for i, msg := range messages {
+		if !msg.Draft || msg.Rejected {
+			continue
+		}
+		rc, err := models.RenderContents(msg.Contents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render contents of message %s: %w", msg.ID, err)
+		}
+		view := draftView{
+			ChatID:    chatID,
+			MessageID: msg.ID,
+			Content:   rc,
+			Error:     msg.Interruption,
+			Timestamp: msg.Timestamp.In(loc).Format("2006-01-02 15:04:05"),
+		}
+		if i > 0 && messages[i-1].Role == models.RoleUser {
+			view.Prompt, _ = models.RenderContents(messages[i-1].Contents)
+		}
+		drafts = append(drafts, view)
+	}
+	return drafts, nil
+}
+
+// HandleScheduleReview reviews the draft of the "message_id" form field in the chat of the "chat_id" field,
+// and redirects back to the schedules page. The "approve" action shows the draft in the chat and notifies
+// its completion, like any other response, and the "reject" action keeps it hidden for good.
+func (m *Main) HandleScheduleReview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	action := r.FormValue("action")
+	if action != "approve" && action != "reject" {
+		http.Error(w, "Action must be approve or reject", http.StatusBadRequest)
+		return
+	}
+	chatID := r.FormValue("chat_id")
+	draft, err := m.findDraft(r, chatID, r.FormValue("message_id"))
+	if errors.Is(err, errDraftNotFound) {
+		http.Error(w, "Draft not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get draft", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if action == "approve" {
+		draft.Draft = false
+	} else {
+		draft.Rejected = true
+	}
+	if err := m.store.UpdateMessage(r.Context(), chatID, draft); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to update draft", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.logger.InfoContext(r.Context(), "Reviewed draft",
+		slog.String("chatID", chatID),
+		slog.String("messageID", draft.ID),
+		slog.String("action", action))
+
+	if !draft.Draft {
+		m.publishCompletion(r.Context(), chatID, draft, nil)
+		m.notifyCompletion(r.Context(), chatID, draft, map[string]any{"approvedBy": m.userID(r)})
+	}
+	http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+}
+
+// findDraft returns the draft of messageID awaiting its review in the chat of chatID, or errDraftNotFound.
+func (m *Main) findDraft(r *http.Request, chatID, messageID string) (models.Message, error) {
+	messages, err := m.store.Messages(r.Context(), chatID)
+	if err != nil {
+		return models.Message{}, err
+	}
+	idx := slices.IndexFunc(messages, func(msg models.Message) bool {
+		return msg.ID == messageID && msg.Draft && !msg.Rejected
+	})
+	if idx < 0 {
+		return models.Message{}, errDraftNotFound
+	}
+	return messages[idx], nil
+}
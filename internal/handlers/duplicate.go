@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// HandleChatDuplicate duplicates the chat of the "chat_id" form field with its messages, parameters and
+// mounted resources, so the conversation can be continued in two directions, and redirects to the copy.
+// The copy is read by the user who duplicated it, and isn't shared with the members or the observers of the
+// chat.
+func (m *Main) HandleChatDuplicate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chatID := r.FormValue("chat_id")
+	c, err := m.findUserChat(r, chatID)
+	if errors.Is(err, errChatNotFound) {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	copyID, err := m.duplicateChat(r, c)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to duplicate chat",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/?chat_id="+copyID, http.StatusSeeOther)
+}
+
+// duplicateChat copies c with its messages into a new chat of the user of r, read by them, publishes it to the chat
+// list and returns the ID of the copy.
+func (m *Main) duplicateChat(r *http.Request, c models.Chat) (string, error) {
+	ctx := r.Context()
+	copied := c
+	copied.ID = uuid.New().String()
+	copied.UserID = m.userID(r)
+	copied.BridgeConversation = ""
+	copied.Members = nil
+	copied.ObserverToken = ""
+	copied.Share = nil
+	copied.Title = "Copy of " + c.Title
+	if c.Title == "" {
+		copied.Title = "Copy of New Chat"
+	}
+	// The copy keeps its title, even a fallback one.
+	copied.TitleFallback = false
+	copyID, err := m.store.CopyChat(ctx, c.ID, copied)
+	if err != nil {
+		return "", fmt.Errorf("failed to copy chat: %w", err)
+	}
+
+	messages, err := m.store.Messages(ctx, copyID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get messages: %w", err)
+	}
+	if len(messages) > 0 {
+		receipt := models.ReadReceipt{
+			UserID:    m.userID(r),
+			ChatID:    copyID,
+			MessageID: messages[len(messages)-1].ID,
+			ReadAt:    time.Now(),
+		}
+		if err := m.store.SaveReadReceipt(ctx, receipt); err != nil {
+			return "", fmt.Errorf("failed to save read receipt: %w", err)
+		}
+	}
+
+	if err := m.publishChat(ctx, copyID, chatAddedEventType); err != nil {
+		return "", err
+	}
+	m.notify(ctx, models.Event{
+		Type:   models.EventChatCreated,
+		ChatID: copyID,
+	})
+	return copyID, nil
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// tokenCounter is implemented by the LLMs that count the input tokens of a request with the tokenizer of
+// their provider.
+type tokenCounter interface {
+	CountTokens(ctx context.Context, messages []models.Message, tools []mcp.Tool) int
+}
+
+type chatEstimate struct {
+	Tokens int
+	// Cost is the cost of the input tokens in the currency of the configured price, zero if it's not set.
+	Cost float64
+}
+
+// WithInputPrice sets the price of a million input tokens of the LLM, in any currency, shown with the
+// estimate of the tokens of the pending message.
+func WithInputPrice(perMillionTokens float64) MainOption {
+	return func(m *Main) {
+		m.inputPrice = perMillionTokens
+	}
+}
+
+// HandleChatEstimate renders the estimate of the input tokens and cost of sending the pending message of
+// the chat form: the history of the chat, the system prompt, the tools and the message with its
+// attachments, as the generation would send them. It accepts the same form fields as HandleChats, the
+// message being optional.
+func (m *Main) HandleChatEstimate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chatID := r.FormValue("chat_id")
+	if !m.authorizeChat(w, r, chatID) {
+		return
+	}
+	var messages []models.Message
+	if chatID != "" {
+		var err error
+		messages, err = m.store.Messages(r.Context(), chatID)
+		if err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to get messages",
+				slog.String("chatID", chatID),
+				slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// A reply is sent with the transcript of the message it replies to, instead of the main line.
+		if parentID := r.FormValue("parent_id"); parentID != "" {
+			messages = models.MessagePath(messages, parentID)
+		} else {
+			messages = models.MainLine(messages)
+		}
+	}
+	if msg := r.FormValue("message"); msg != "" {
+		attachments := r.PostForm["attachment"]
+		messages = append(messages, models.Message{
+			Role: models.RoleUser,
+			Contents: []models.Content{
+				{
+					Type:    models.ContentTypeText,
+					Text:    withAttachments(msg, attachments),
+					Sources: m.capabilities().attachmentSources(attachments),
+				},
+			},
+			Timestamp: time.Now(),
+		})
+	}
+	messages = append(messages, models.Message{Role: models.RoleAssistant, Timestamp: time.Now()})
+
+	ctx := m.generationContext(r.Context(), m.userID(r))
+	ctx, req := m.generationRequest(ctx, chatID, messages)
+	tokens := m.countTokens(ctx, req.messages, req.tools)
+
+	estimate := chatEstimate{Tokens: tokens, Cost: float64(tokens) * m.inputPrice / 1e6}
+	if err := m.templates.ExecuteTemplate(w, "chat_estimate", estimate); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute chat_estimate template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// countTokens counts the input tokens of a request of messages and tools with the tokenizer of the LLM, or
+// estimates them like the usage of the generations if the LLM doesn't provide one.
+func (m *Main) countTokens(ctx context.Context, messages []models.Message, tools []mcp.Tool) int {
+	if m.tokenCounter != nil {
+		return m.tokenCounter.CountTokens(ctx, messages, tools)
+	}
+	chars := len(models.SystemPrompt(ctx, ""))
+	for _, tool := range tools {
+		chars += len(tool.Name) + len(tool.Description) + len(tool.InputSchema)
+	}
+	return estimateTokens(messages) + (chars+3)/4
+}
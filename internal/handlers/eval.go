@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// EvalCase is a test case of the eval suite: a prompt sent to the LLM, with the MCP tools, outside of any
+// chat, and the assertions its response must pass.
+type EvalCase struct {
+	Name       string          `yaml:"name"`
+	Input      string          `yaml:"input"`
+	Assertions []EvalAssertion `yaml:"assertions"`
+}
+
+// EvalAssertion is an assertion on the response of an eval case. Exactly one of its fields must be set.
+type EvalAssertion struct {
+	// Contains is a text the response must contain.
+	Contains string `yaml:"contains"`
+	// NotContains is a text the response must not contain.
+	NotContains string `yaml:"notContains"`
+	// Matches is a regular expression the response must match.
+	Matches string `yaml:"matches"`
+	// ToolCalled is the name of a tool the LLM must call.
+	ToolCalled string `yaml:"toolCalled"`
+	// ToolNotCalled is the name of a tool the LLM must not call.
+	ToolNotCalled string `yaml:"toolNotCalled"`
+}
+
+// EvalReport is the report of a run of the eval suite.
+type EvalReport struct {
+	StartedAt  time.Time    `json:"startedAt"`
+	FinishedAt time.Time    `json:"finishedAt"`
+	Results    []EvalResult `json:"results"`
+}
+
+// EvalResult is the result of an eval case, with the transcript of its response for review.
+type EvalResult struct {
+	Case     string        `json:"case"`
+	Input    string        `json:"input"`
+	Passed   bool          `json:"passed"`
+	Duration time.Duration `json:"duration"`
+	// Failures are the assertions the response failed.
+	Failures []string `json:"failures,omitempty"`
+	// Error is the error that aborted the generation of the response, the case failing.
+	Error      string         `json:"error,omitempty"`
+	Transcript models.Message `json:"transcript"`
+}
+
+// evals holds the reports of the last runs of the eval suite, the newest first.
+type evals struct {
+	mu      sync.Mutex
+	running bool
+	reports []EvalReport
+}
+
+type evalsPageData struct {
+	Suite   string
+	Running bool
+	Reports []evalReportView
+}
+
+type evalReportView struct {
+	EvalReport
+	Results []evalResultView
+}
+
+type evalResultView struct {
+	EvalResult
+	RenderedTranscript string
+}
+
+type evalSuite struct {
+	Cases []EvalCase `yaml:"cases"`
+}
+
+const (
+	// evalUserID is the user ID the usage of the eval suite is recorded to.
+	evalUserID = "eval"
+
+	maxEvalReportsKept = 10
+)
+
+var errEvalRunning = errors.New("the eval suite is already running")
+
+// WithEvalSuite enables the eval suite of the YAML file at path, run at /admin/evals or by RunEvalSuite.
+// The file is read at every run, so the cases can be edited without restarting the server.
+func WithEvalSuite(path string) MainOption {
+	return func(m *Main) {
+		m.evalSuite = path
+	}
+}
+
+// ParseEvalSuite parses the eval cases of the YAML document of r, under its "cases" key, checking that
+// every case has a name, an input and valid assertions.
+func ParseEvalSuite(r io.Reader) ([]EvalCase, error) {
+	var suite evalSuite
+	if err := yaml.NewDecoder(r).Decode(&suite); err != nil {
+		return nil, fmt.Errorf("invalid eval suite: %w", err)
+	}
+	if len(suite.Cases) == 0 {
+		return nil, errors.New("the eval suite has no cases")
+	}
+
+	for i, c := range suite.Cases {
+		if c.Name == "" || c.Input == "" {
+			return nil, fmt.Errorf("eval case %d: name and input are required", i+1)
+		}
+		for j, a := range c.Assertions {
+			set := 0
+			for _, v := range []string{a.Contains, a.NotContains, a.Matches, a.ToolCalled, a.ToolNotCalled} {
+				if v != "" {
+					set++
+				}
+			}
+			if set != 1 {
+				return nil, fmt.Errorf("eval case %s: assertion %d must set exactly one of contains, notContains, "+
+					"matches, toolCalled or toolNotCalled", c.Name, j+1)
+			}
+			if a.Matches != "" {
+				if _, err := regexp.Compile(a.Matches); err != nil {
+					return nil, fmt.Errorf("eval case %s: invalid matches pattern of assertion %d: %w", c.Name, j+1, err)
+				}
+			}
+		}
+	}
+	return suite.Cases, nil
+}
+
+// RunEvalSuite runs every case of the eval suite in order against the LLM and the tools of the MCP servers,
+// and returns the report, also shown at /admin/evals. It returns an error if the eval suite isn't enabled,
+// can't be read, or is already running.
+func (m *Main) RunEvalSuite(ctx context.Context) (EvalReport, error) {
+	if m.evalSuite == "" {
+		return EvalReport{}, errors.New("the eval suite is disabled")
+	}
+	cases, err := m.loadEvalSuite()
+	if err != nil {
+		return EvalReport{}, err
+	}
+	if !m.evals.start() {
+		return EvalReport{}, errEvalRunning
+	}
+	return m.runEvalSuite(ctx, cases), nil
+}
+
+func (m *Main) loadEvalSuite() ([]EvalCase, error) {
+	f, err := os.Open(m.evalSuite)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open eval suite: %w", err)
+	}
+	defer f.Close()
+	return ParseEvalSuite(f)
+}
+
+// runEvalSuite runs cases once the run is started in evals, and records the report.
+func (m *Main) runEvalSuite(ctx context.Context, cases []EvalCase) EvalReport {
+	report := EvalReport{StartedAt: time.Now()}
+	ctx = m.generationContext(ctx, evalUserID)
+	m.logger.InfoContext(ctx, "Running eval suite", slog.Int("cases", len(cases)))
+	for _, c := range cases {
+		report.Results = append(report.Results, m.runEvalCase(ctx, c))
+	}
+	report.FinishedAt = time.Now()
+	m.evals.finish(report)
+	return report
+}
+
+// runEvalCase generates the response of c like the batch rows, and checks it against the assertions of c.
+func (m *Main) runEvalCase(ctx context.Context, c EvalCase) EvalResult {
+	startedAt := time.Now()
+	messages := []models.Message{
+		{
+			ID:        uuid.New().String(),
+			Role:      models.RoleUser,
+			Contents:  []models.Content{{Type: models.ContentTypeText, Text: c.Input}},
+			Timestamp: startedAt,
+		},
+		{
+			ID:        uuid.New().String(),
+			Role:      models.RoleAssistant,
+			Timestamp: startedAt,
+		},
+	}
+	m.recordUsage(ctx, evalUserID, 1, 0)
+	aiMsg, err := m.generate(ctx, "", m.llm, messages, func(models.Message) error { return nil })
+	m.recordUsage(ctx, evalUserID, 0, estimateTokens(messages[:1])+estimateTokens([]models.Message{aiMsg}))
+
+	res := EvalResult{
+		Case:       c.Name,
+		Input:      c.Input,
+		Duration:   time.Since(startedAt),
+		Transcript: aiMsg,
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Failures = evalFailures(c.Assertions, aiMsg)
+	res.Passed = len(res.Failures) == 0
+	return res
+}
+
+// evalFailures returns the descriptions of the assertions failed by the response aiMsg, whose texts are
+// checked together.
+func evalFailures(assertions []EvalAssertion, aiMsg models.Message) []string {
+	var texts, tools []string
+	for _, content := range aiMsg.Contents {
+		switch content.Type {
+		case models.ContentTypeText:
+			texts = append(texts, content.Text)
+		case models.ContentTypeCallTool:
+			tools = append(tools, content.ToolName)
+		}
+	}
+	text := strings.Join(texts, "\n")
+
+	var failures []string
+	for _, a := range assertions {
+		switch {
+		case a.Contains != "" && !strings.Contains(text, a.Contains):
+			failures = append(failures, fmt.Sprintf("response doesn't contain %q", a.Contains))
+		case a.NotContains != "" && strings.Contains(text, a.NotContains):
+			failures = append(failures, fmt.Sprintf("response contains %q", a.NotContains))
+		case a.Matches != "" && !regexp.MustCompile(a.Matches).MatchString(text):
+			failures = append(failures, fmt.Sprintf("response doesn't match %q", a.Matches))
+		case a.ToolCalled != "" && !slices.Contains(tools, a.ToolCalled):
+			failures = append(failures, fmt.Sprintf("tool %s isn't called", a.ToolCalled))
+		case a.ToolNotCalled != "" && slices.Contains(tools, a.ToolNotCalled):
+			failures = append(failures, fmt.Sprintf("tool %s is called", a.ToolNotCalled))
+		}
+	}
+	return failures
+}
+
+// HandleEvals renders the evals page on GET, with the reports of the last runs of the eval suite and the
+// transcripts of their responses. On POST, it starts a run in the background, and redirects back to the
+// page.
+func (m *Main) HandleEvals(w http.ResponseWriter, r *http.Request) {
+	if m.evalSuite == "" {
+		http.Error(w, "Eval suite is disabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		// The suite is read before the run, for its errors to be reported to the user.
+		cases, err := m.loadEvalSuite()
+		if err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to load eval suite", slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if !m.evals.start() {
+			http.Error(w, "Eval suite is already running", http.StatusConflict)
+			return
+		}
+		go m.runEvalSuite(context.WithoutCancel(r.Context()), cases)
+		http.Redirect(w, r, "/admin/evals", http.StatusSeeOther)
+		return
+	default:
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := evalsPageData{Suite: m.evalSuite}
+	var reports []EvalReport
+	data.Running, reports = m.evals.state()
+	for _, report := range reports {
+		view := evalReportView{EvalReport: report}
+		for _, res := range report.Results {
+			rendered, err := models.RenderContents(res.Transcript.Contents)
+			if err != nil {
+				rendered = err.Error()
+			}
+			view.Results = append(view.Results, evalResultView{EvalResult: res, RenderedTranscript: rendered})
+		}
+		data.Reports = append(data.Reports, view)
+	}
+
+	if err := m.renderPage(w, "evals.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute evals template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// PassedCount returns the number of cases of the report that passed.
+func (r EvalReport) PassedCount() int {
+	count := 0
+	for _, res := range r.Results {
+		if res.Passed {
+			count++
+		}
+	}
+	return count
+}
+
+func (e *evals) start() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.running {
+		return false
+	}
+	e.running = true
+	return true
+}
+
+// finish records report, dropping the reports beyond maxEvalReportsKept.
+func (e *evals) finish(report EvalReport) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.running = false
+	e.reports = slices.Insert(e.reports, 0, report)
+	if len(e.reports) > maxEvalReportsKept {
+		e.reports = e.reports[:maxEvalReportsKept]
+	}
+}
+
+func (e *evals) state() (bool, []EvalReport) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.running, slices.Clone(e.reports)
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/tmaxmax/go-sse"
+)
+
+// UIEvent is an update of the pages published on the event bus, such as a chunk of a streamed response, the
+// refreshed chat list or the typing indicator of another page. Data is the HTML or JSON swapped in by the
+// pages, and Topics are the topics of the pages it's meant for: "chats" for the chat list, "chat-<id>" and
+// "chat-messages-<id>" for the pages of a chat, "message-<id>" for the stream of a response and
+// "user-<id>" for the pages of a user.
+type UIEvent struct {
+	Type   string
+	Data   string
+	Topics []string
+}
+
+// EventSubscriber receives the events published on the event bus, like the SSE server streaming them to the
+// pages. HandleEvent is called from the chat processing, in the order of the events, so the implementations
+// should not block the caller. Its error fails the publishing, which ends a streamed response, so the
+// subscribers delivering the events to optional systems should handle their errors themselves.
+type EventSubscriber interface {
+	HandleEvent(ctx context.Context, event UIEvent) error
+}
+
+// EventSubscriberFunc is an adapter to use a function as an EventSubscriber.
+type EventSubscriberFunc func(ctx context.Context, event UIEvent) error
+
+// eventBus publishes the events of the chats to its subscribers, decoupling the chat processing from the
+// transports delivering them. The heartbeats and the close messages of the SSE connections aren't events,
+// they're sent by the SSE server itself.
+type eventBus struct {
+	subscribers []EventSubscriber
+}
+
+// sseSubscriber publishes the events to the SSE connections of the server.
+type sseSubscriber struct {
+	server *sse.Server
+}
+
+// Event types of the updates of the pages.
+const (
+	chatsEventType        = "chats"
+	chatAddedEventType    = "chatAdded"
+	chatUpdatedEventType  = "chatUpdated"
+	messagesEventType     = "messages"
+	chatMessagesEventType = "chatMessages"
+	typingEventType       = "typing"
+	completionEventType   = "completion"
+	readEventType         = "read"
+	closeMessageEventType = "closeMessage"
+)
+
+// WithEventSubscriber adds a subscriber to the events published to the pages, besides the SSE server, such
+// as another transport or a fan-out to other instances.
+func WithEventSubscriber(subscriber EventSubscriber) MainOption {
+	return func(m *Main) {
+		m.events.subscribers = append(m.events.subscribers, subscriber)
+	}
+}
+
+// HandleEvent implements EventSubscriber.
+func (f EventSubscriberFunc) HandleEvent(ctx context.Context, event UIEvent) error {
+	return f(ctx, event)
+}
+
+// publish publishes an event of eventType with data to the subscribers of topics. The errors of the
+// subscribers are joined, every subscriber receiving the event.
+func (m *Main) publish(ctx context.Context, eventType, data string, topics ...string) error {
+	event := UIEvent{Type: eventType, Data: data, Topics: topics}
+	var errs []error
+	for _, s := range m.events.subscribers {
+		if err := s.HandleEvent(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HandleEvent implements EventSubscriber.
+func (s sseSubscriber) HandleEvent(_ context.Context, event UIEvent) error {
+	msg := sse.Message{Type: sse.Type(event.Type)}
+	msg.AppendData(event.Data)
+	return s.server.Publish(&msg, event.Topics...)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/logging"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// GenerationExporter represents the interface for exporting the completed generations to observability
+// tools. The implementations should not block the caller, as the generations are exported from the chat
+// processing.
+type GenerationExporter interface {
+	ExportGeneration(ctx context.Context, generation models.Generation)
+}
+
+// modelNamer is implemented by the LLMs that report the name of their model.
+type modelNamer interface {
+	Model() string
+}
+
+// WithGenerationExporter exports every completed generation to the given exporter. It can be given
+// multiple times to export to multiple exporters.
+func WithGenerationExporter(exporter GenerationExporter) MainOption {
+	return func(m *Main) {
+		m.exporters = append(m.exporters, exporter)
+	}
+}
+
+func (m *Main) exportGeneration(
+	ctx context.Context,
+	chatID string,
+	llm LLM,
+	messages []models.Message,
+	response models.Message,
+	startedAt time.Time,
+	err error,
+) {
+	if len(m.exporters) == 0 {
+		return
+	}
+
+	prompt := messages[:len(messages)-1]
+	g := models.Generation{
+		ID:           logging.GenerationID(ctx),
+		ChatID:       chatID,
+		Prompt:       prompt,
+		Response:     response,
+		StartedAt:    startedAt,
+		FinishedAt:   time.Now(),
+		InputTokens:  estimateTokens(prompt),
+		OutputTokens: estimateTokens([]models.Message{response}),
+	}
+	// The ID is carried by the context of the generation, a new one is used if it's missing.
+	if g.ID == "" {
+		g.ID = uuid.New().String()
+	}
+	if mn, ok := llm.(modelNamer); ok {
+		g.Model = mn.Model()
+	}
+	if err != nil {
+		g.Error = err.Error()
+	}
+
+	for _, e := range m.exporters {
+		e.ExportGeneration(ctx, g)
+	}
+}
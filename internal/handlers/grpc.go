@@ -0,0 +1,402 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	mcpwebuiv1 "github.com/MegaGrindStone/mcp-web-ui/api/gen/mcpwebui/v1"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/logging"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// chatService is the gRPC ChatService of the chat API, sharing its methods with the JSON handlers.
+type chatService struct {
+	mcpwebuiv1.UnimplementedChatServiceServer
+
+	main *Main
+}
+
+// grpcCall is a call of the ChatService, authenticated by chatService.call.
+type grpcCall struct {
+	// ctx is the context of the call, carrying its request ID.
+	ctx    context.Context
+	userID string
+	// authenticated reports whether the user is identified by an API token or the user header, rather than
+	// being the default user.
+	authenticated bool
+}
+
+// ChatService returns the gRPC ChatService of the chat API, to register on a gRPC server. The calls are
+// authenticated like the requests of APIAuth, by an API token in their "authorization" metadata, or the
+// user header of WithUserHeader in their metadata, and their users are granted the permissions of their
+// role in WithAccess like the requests of AccessControl.
+func (m *Main) ChatService() mcpwebuiv1.ChatServiceServer {
+	return &chatService{main: m}
+}
+
+// call authenticates the call of ctx, and checks that the role of its user grants perms.
+func (s *chatService) call(ctx context.Context, perms ...permission) (grpcCall, error) {
+	m := s.main
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := firstMetadata(md, requestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		id = uuid.New().String()
+	}
+	ctx = logging.WithRequestID(ctx, id)
+	if err := grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, id)); err != nil {
+		m.logger.DebugContext(ctx, "Failed to set request ID header", slog.String(errLoggerKey, err.Error()))
+	}
+
+	c := grpcCall{ctx: ctx, userID: defaultUserID}
+	auth := firstMetadata(md, "authorization")
+	switch {
+	case auth != "":
+		userID, err := s.tokenUser(ctx, md, auth)
+		if err != nil {
+			return grpcCall{}, err
+		}
+		c.userID, c.authenticated = userID, true
+	case m.requireAPITokens:
+		return grpcCall{}, status.Error(codes.Unauthenticated, "API token is required")
+	case m.userHeader != "" && firstMetadata(md, m.userHeader) != "":
+		c.userID, c.authenticated = firstMetadata(md, m.userHeader), true
+	}
+
+	for _, p := range perms {
+		if m.roleAllows(c.userID, p) {
+			continue
+		}
+		method, _ := grpc.Method(ctx)
+		m.logger.WarnContext(ctx, "Access denied", slog.String("userID", c.userID), slog.String("method", method))
+		return grpcCall{}, status.Errorf(codes.PermissionDenied, "The %s role isn't allowed to %s",
+			m.userRole(c.userID), permissionActions[p])
+	}
+	return c, nil
+}
+
+// tokenUser returns the user of the API token of the authorization metadata auth, counting the invalid
+// tokens in the lockout of the client like APIAuth.
+func (s *chatService) tokenUser(ctx context.Context, md metadata.MD, auth string) (string, error) {
+	m := s.main
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+	ip := m.forwardedClientIP(remoteAddr, md.Get("x-forwarded-for"))
+	if retryAfter, locked := m.lockedOut(ip); locked {
+		return "", status.Errorf(codes.ResourceExhausted, "Too many failed authentications, retry in %s", retryAfter)
+	}
+
+	method, _ := grpc.Method(ctx)
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || !strings.HasPrefix(token, apiTokenPrefix) {
+		m.recordAuthFailure(ctx, ip, method, "Invalid Authorization header")
+		return "", status.Error(codes.Unauthenticated, "Invalid authorization metadata, expected a Bearer API token")
+	}
+	t, err := m.store.APITokenByHash(ctx, hashAPIToken(token))
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to get API token", slog.String(errLoggerKey, err.Error()))
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if t.ID == "" {
+		m.recordAuthFailure(ctx, ip, method, "Invalid API token "+token[:min(len(token), apiTokenShownPrefix)]+"…")
+		return "", status.Error(codes.Unauthenticated, "Invalid API token")
+	}
+	return t.UserID, nil
+}
+
+func (s *chatService) ListChats(
+	ctx context.Context,
+	_ *mcpwebuiv1.ListChatsRequest,
+) (*mcpwebuiv1.ListChatsResponse, error) {
+	c, err := s.call(ctx)
+	if err != nil {
+		return nil, err
+	}
+	chats, err := s.main.apiChats(c.ctx, c.userID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	res := &mcpwebuiv1.ListChatsResponse{Chats: make([]*mcpwebuiv1.Chat, len(chats))}
+	for i, chat := range chats {
+		res.Chats[i] = newGRPCChat(newAPIChat(chat))
+	}
+	return res, nil
+}
+
+func (s *chatService) CreateChat(ctx context.Context, req *mcpwebuiv1.CreateChatRequest) (*mcpwebuiv1.Chat, error) {
+	c, err := s.call(ctx, permChat)
+	if err != nil {
+		return nil, err
+	}
+	chat, err := s.main.createAPIChat(c.ctx, c.userID, apiCreateChatRequest{
+		Title:        req.GetTitle(),
+		Tags:         req.GetTags(),
+		SystemPrompt: req.GetSystemPrompt(),
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return newGRPCChat(newAPIChat(chat)), nil
+}
+
+func (s *chatService) ListMessages(
+	ctx context.Context,
+	req *mcpwebuiv1.ListMessagesRequest,
+) (*mcpwebuiv1.ListMessagesResponse, error) {
+	c, err := s.call(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var since time.Time
+	if req.GetSince() != nil {
+		since = req.GetSince().AsTime()
+	}
+	messages, httpStatus, err := s.main.apiMessages(c.ctx, c.userID, req.GetChatId(), since)
+	if err != nil {
+		return nil, grpcError(httpStatus, err)
+	}
+	res := &mcpwebuiv1.ListMessagesResponse{Messages: make([]*mcpwebuiv1.Message, len(messages))}
+	for i, msg := range messages {
+		res.Messages[i] = newGRPCMessage(newAPIMessage(msg))
+	}
+	return res, nil
+}
+
+func (s *chatService) SendMessage(
+	req *mcpwebuiv1.SendMessageRequest,
+	stream grpc.ServerStreamingServer[mcpwebuiv1.SendMessageResponse],
+) error {
+	m := s.main
+	c, err := s.call(stream.Context(), permChat)
+	if err != nil {
+		return err
+	}
+	g, httpStatus, err := m.startAPIMessage(c.ctx, c.userID, req.GetChatId(), apiSendMessageRequest{
+		Text:           req.GetText(),
+		ResponseSchema: req.GetResponseSchema(),
+	})
+	if err != nil {
+		return grpcError(httpStatus, err)
+	}
+
+	if err := grpc.SetHeader(c.ctx, metadata.Pairs(generationIDHeader, logging.GenerationID(g.ctx))); err != nil {
+		m.logger.DebugContext(c.ctx, "Failed to set generation ID header", slog.String(errLoggerKey, err.Error()))
+	}
+	send := func(res *mcpwebuiv1.SendMessageResponse) {
+		// The client may have gone away, but the generation goes on to keep the chat consistent.
+		if err := stream.Send(res); err != nil {
+			m.logger.DebugContext(c.ctx, "Failed to send API response", slog.String(errLoggerKey, err.Error()))
+		}
+	}
+
+	aiMsg, err := m.runAPIGeneration(g, func(content models.Content) {
+		send(&mcpwebuiv1.SendMessageResponse{
+			Response: &mcpwebuiv1.SendMessageResponse_Chunk{Chunk: newGRPCContent(newAPIContent(content))},
+		})
+	})
+	if err != nil {
+		send(&mcpwebuiv1.SendMessageResponse{Response: &mcpwebuiv1.SendMessageResponse_Error{Error: err.Error()}})
+		return nil
+	}
+	send(&mcpwebuiv1.SendMessageResponse{
+		Response: &mcpwebuiv1.SendMessageResponse_Message{Message: newGRPCMessage(newAPIMessage(aiMsg))},
+	})
+	return nil
+}
+
+func (s *chatService) ListTools(
+	ctx context.Context,
+	_ *mcpwebuiv1.ListToolsRequest,
+) (*mcpwebuiv1.ListToolsResponse, error) {
+	if _, err := s.call(ctx); err != nil {
+		return nil, err
+	}
+	tools := s.main.capabilities().tools
+	res := &mcpwebuiv1.ListToolsResponse{Tools: make([]*mcpwebuiv1.Tool, len(tools))}
+	for i, tool := range tools {
+		t := newAPITool(tool)
+		res.Tools[i] = &mcpwebuiv1.Tool{Name: t.Name, Description: t.Description, InputSchema: t.InputSchema}
+	}
+	return res, nil
+}
+
+func (s *chatService) CreateBatch(ctx context.Context, req *mcpwebuiv1.CreateBatchRequest) (*mcpwebuiv1.Batch, error) {
+	c, err := s.call(ctx, permChat)
+	if err != nil {
+		return nil, err
+	}
+	inputs := make([]map[string]string, len(req.GetInputs()))
+	for i, input := range req.GetInputs() {
+		inputs[i] = input.GetValues()
+	}
+	b, httpStatus, err := s.main.createAPIBatch(c.ctx, c.userID, req.GetName(), req.GetTemplate(), inputs)
+	if err != nil {
+		return nil, grpcError(httpStatus, err)
+	}
+	return newGRPCBatch(newAPIBatch(b)), nil
+}
+
+func (s *chatService) GetBatch(ctx context.Context, req *mcpwebuiv1.GetBatchRequest) (*mcpwebuiv1.Batch, error) {
+	c, err := s.call(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.main.batches.get(c.userID, req.GetBatchId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "batch not found")
+	}
+	return newGRPCBatch(newAPIBatch(b)), nil
+}
+
+func (s *chatService) CaptureContent(
+	ctx context.Context,
+	req *mcpwebuiv1.CaptureContentRequest,
+) (*mcpwebuiv1.CaptureContentResponse, error) {
+	c, err := s.call(ctx, permChat)
+	if err != nil {
+		return nil, err
+	}
+	if !c.authenticated {
+		return nil, status.Error(codes.Unauthenticated, "An API token or the user header is required")
+	}
+	res, httpStatus, err := s.main.captureContent(c.ctx, c.userID, apiCaptureRequest{
+		URL:    req.GetUrl(),
+		Text:   req.GetText(),
+		Title:  req.GetTitle(),
+		Prompt: req.GetPrompt(),
+		ChatID: req.GetChatId(),
+	})
+	if err != nil {
+		return nil, grpcError(httpStatus, err)
+	}
+	return &mcpwebuiv1.CaptureContentResponse{
+		ChatId:     res.ChatID,
+		MessageId:  res.MessageID,
+		ResponseId: res.ResponseID,
+	}, nil
+}
+
+// grpcError returns err with the gRPC code of the HTTP status the JSON handlers respond with.
+func grpcError(httpStatus int, err error) error {
+	code := codes.Internal
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, err.Error())
+}
+
+// firstMetadata returns the first value of the metadata of key, matched case-insensitively like the HTTP
+// headers, or an empty string.
+func firstMetadata(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// The functions below convert the JSON types of the chat API into their messages of the proto file, so both
+// transports return the same fields.
+
+func newGRPCChat(c apiChat) *mcpwebuiv1.Chat {
+	return &mcpwebuiv1.Chat{
+		Id:           c.ID,
+		Title:        c.Title,
+		Language:     c.Language,
+		Members:      c.Members,
+		Tags:         c.Tags,
+		SystemPrompt: c.SystemPrompt,
+	}
+}
+
+func newGRPCContent(c apiContent) *mcpwebuiv1.Content {
+	return &mcpwebuiv1.Content{
+		Type:               c.Type,
+		Text:               c.Text,
+		ToolName:           c.ToolName,
+		ToolInput:          c.ToolInput,
+		ToolResult:         c.ToolResult,
+		CallToolId:         c.CallToolID,
+		CallToolFailed:     c.CallToolFailed,
+		SuspiciousPatterns: c.SuspiciousPatterns,
+		ToolNote:           c.ToolNote,
+		Structured:         c.Structured,
+		SchemaViolations:   c.SchemaViolations,
+	}
+}
+
+func newGRPCMessage(msg apiMessage) *mcpwebuiv1.Message {
+	res := &mcpwebuiv1.Message{
+		Id:           msg.ID,
+		Role:         msg.Role,
+		Contents:     make([]*mcpwebuiv1.Content, len(msg.Contents)),
+		Timestamp:    timestamppb.New(msg.Timestamp),
+		FinishReason: msg.FinishReason,
+		Interruption: msg.Interruption,
+		ParentId:     msg.ParentID,
+		UserId:       msg.UserID,
+	}
+	for i, c := range msg.Contents {
+		res.Contents[i] = newGRPCContent(c)
+	}
+	if s := msg.Stats; s != nil {
+		res.Stats = &mcpwebuiv1.MessageStats{
+			TimeToFirstTokenMs: grpcInt32(s.TimeToFirstTokenMs),
+			OutputTokens:       grpcInt32(int64(s.OutputTokens)),
+			TokensPerSecond:    s.TokensPerSecond,
+		}
+	}
+	return res
+}
+
+func newGRPCBatch(b apiBatch) *mcpwebuiv1.Batch {
+	res := &mcpwebuiv1.Batch{
+		Id:        b.ID,
+		Name:      b.Name,
+		Template:  b.Template,
+		Columns:   b.Columns,
+		CreatedAt: timestamppb.New(b.CreatedAt),
+		Finished:  b.Finished,
+		Rows:      make([]*mcpwebuiv1.BatchRow, len(b.Rows)),
+	}
+	for i, row := range b.Rows {
+		res.Rows[i] = &mcpwebuiv1.BatchRow{
+			Row:    grpcInt32(int64(row.Row)),
+			Inputs: row.Inputs,
+			Prompt: row.Prompt,
+			Status: row.Status,
+			Output: row.Output,
+			Error:  row.Error,
+		}
+	}
+	return res
+}
+
+// grpcInt32 returns v as an int32, capped at its bounds.
+func grpcInt32(v int64) int32 {
+	if v > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	if v < math.MinInt32 {
+		return math.MinInt32
+	}
+	return int32(v)
+}
@@ -0,0 +1,186 @@
+package handlers_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	mcpwebuiv1 "github.com/MegaGrindStone/mcp-web-ui/api/gen/mcpwebui/v1"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/handlers"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const grpcTestToken = "mwu_alice-token"
+
+func newGRPCClient(t *testing.T, main *handlers.Main) mcpwebuiv1.ChatServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	mcpwebuiv1.RegisterChatServiceServer(srv, main.ChatService())
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return mcpwebuiv1.NewChatServiceClient(conn)
+}
+
+func grpcContext(pairs ...string) context.Context {
+	return metadata.NewOutgoingContext(context.Background(), metadata.Pairs(pairs...))
+}
+
+func TestChatService(t *testing.T) {
+	sum := sha256.Sum256([]byte(grpcTestToken))
+	store := &mockStore{
+		chats: []models.Chat{
+			{ID: "1", Title: "Alice Chat", UserID: "alice"},
+			{ID: "2", Title: "Bob Chat", UserID: "bob"},
+		},
+		messages: map[string][]models.Message{},
+		tokens:   []models.APIToken{{ID: "t1", UserID: "alice", Hash: hex.EncodeToString(sum[:])}},
+	}
+	llm := &mockLLM{responses: []string{"AI ", "response"}}
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-User"),
+		handlers.WithAccess(handlers.Access{Roles: map[string]handlers.UserRole{"carol": handlers.UserRoleViewer}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newGRPCClient(t, main)
+	alice := grpcContext("authorization", "Bearer "+grpcTestToken)
+
+	chats, err := client.ListChats(alice, &mcpwebuiv1.ListChatsRequest{})
+	if err != nil {
+		t.Fatalf("ListChats() error = %v", err)
+	}
+	if len(chats.GetChats()) != 1 || chats.GetChats()[0].GetId() != "1" {
+		t.Errorf("ListChats() = %v, want only the chat of alice", chats.GetChats())
+	}
+
+	codeTests := []struct {
+		name string
+		ctx  context.Context
+		req  *mcpwebuiv1.SendMessageRequest
+		want codes.Code
+	}{
+		{"invalid token", grpcContext("authorization", "Bearer mwu_invalid"),
+			&mcpwebuiv1.SendMessageRequest{ChatId: "1", Text: "Hello"}, codes.Unauthenticated},
+		{"viewer", grpcContext("x-user", "carol"),
+			&mcpwebuiv1.SendMessageRequest{ChatId: "1", Text: "Hello"}, codes.PermissionDenied},
+		{"chat of another user", alice, &mcpwebuiv1.SendMessageRequest{ChatId: "2", Text: "Hello"}, codes.NotFound},
+		{"missing text", alice, &mcpwebuiv1.SendMessageRequest{ChatId: "1"}, codes.InvalidArgument},
+	}
+	for _, tt := range codeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := client.SendMessage(tt.ctx, tt.req)
+			if err == nil {
+				_, err = stream.Recv()
+			}
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("SendMessage() error = %v, want code %s", err, tt.want)
+			}
+		})
+	}
+
+	stream, err := client.SendMessage(alice, &mcpwebuiv1.SendMessageRequest{ChatId: "1", Text: "Hello"})
+	if err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	var chunks []string
+	var final *mcpwebuiv1.Message
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("SendMessage() receive error = %v", err)
+		}
+		switch r := res.GetResponse().(type) {
+		case *mcpwebuiv1.SendMessageResponse_Chunk:
+			chunks = append(chunks, r.Chunk.GetText())
+		case *mcpwebuiv1.SendMessageResponse_Message:
+			final = r.Message
+		case *mcpwebuiv1.SendMessageResponse_Error:
+			t.Fatalf("SendMessage() generation error = %s", r.Error)
+		}
+	}
+	if len(chunks) != 2 || chunks[0] != "AI " || chunks[1] != "response" {
+		t.Errorf("SendMessage() chunks = %q, want the pieces of the response", chunks)
+	}
+	if final.GetRole() != "assistant" || len(final.GetContents()) != 1 ||
+		final.GetContents()[0].GetText() != "AI response" {
+		t.Errorf("SendMessage() message = %v, want the complete assistant message", final)
+	}
+	if header, err := stream.Header(); err != nil || len(header.Get("x-generation-id")) == 0 {
+		t.Errorf("SendMessage() header = %v, %v, want the generation ID", header, err)
+	}
+
+	messages, err := client.ListMessages(alice, &mcpwebuiv1.ListMessagesRequest{ChatId: "1"})
+	if err != nil {
+		t.Fatalf("ListMessages() error = %v", err)
+	}
+	if ms := messages.GetMessages(); len(ms) != 2 || ms[0].GetRole() != "user" || ms[0].GetUserId() != "alice" ||
+		ms[1].GetRole() != "assistant" {
+		t.Errorf("ListMessages() = %v, want the message of alice and the response", ms)
+	}
+
+	_, err = client.CaptureContent(context.Background(), &mcpwebuiv1.CaptureContentRequest{Text: "Selected"})
+	if got := status.Code(err); got != codes.Unauthenticated {
+		t.Errorf("CaptureContent() without a user error = %v, want code %s", err, codes.Unauthenticated)
+	}
+	_, err = client.GetBatch(alice, &mcpwebuiv1.GetBatchRequest{BatchId: "unknown"})
+	if got := status.Code(err); got != codes.NotFound {
+		t.Errorf("GetBatch() of an unknown batch error = %v, want code %s", err, codes.NotFound)
+	}
+}
+
+func TestChatServiceLockout(t *testing.T) {
+	store := &mockStore{}
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithRequiredAPITokens(), handlers.WithLockout(handlers.Lockout{MaxFailures: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newGRPCClient(t, main)
+
+	if _, err := client.ListChats(context.Background(), &mcpwebuiv1.ListChatsRequest{}); status.Code(err) !=
+		codes.Unauthenticated {
+		t.Errorf("ListChats() without a token error = %v, want code %s", err, codes.Unauthenticated)
+	}
+	invalid := grpcContext("authorization", "Bearer mwu_invalid")
+	for range 2 {
+		if _, err := client.ListChats(invalid, &mcpwebuiv1.ListChatsRequest{}); status.Code(err) !=
+			codes.Unauthenticated {
+			t.Errorf("ListChats() with an invalid token error = %v, want code %s", err, codes.Unauthenticated)
+		}
+	}
+	if _, err := client.ListChats(invalid, &mcpwebuiv1.ListChatsRequest{}); status.Code(err) !=
+		codes.ResourceExhausted {
+		t.Errorf("ListChats() of a locked out client error = %v, want code %s", err, codes.ResourceExhausted)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.audit) != 3 {
+		t.Errorf("audit entries = %d, want the 2 failures and the lockout", len(store.audit))
+	}
+}
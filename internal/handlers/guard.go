@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// ToolResultGuard configures the scan of the tool results for prompt injections, the instructions planted in
+// the data returned by the tools, like a web page or an email, to hijack the LLM.
+type ToolResultGuard struct {
+	// Enabled wraps every tool result in an untrusted data envelope when it's sent to the LLM, and flags
+	// the results containing instruction-like text in the UI.
+	Enabled bool
+	// Patterns are additional regular expressions of instruction-like text, matched case-insensitively
+	// besides the built-in ones.
+	Patterns []string
+}
+
+type guardPattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// builtinGuardPatterns are the instruction-like patterns commonly found in prompt injections.
+var builtinGuardPatterns = []guardPattern{
+	{
+		name: "ignore previous instructions",
+		re: regexp.MustCompile(`(?i)\b(?:ignore|disregard|forget|override)\s+(?:all\s+|any\s+)?(?:the\s+|your\s+)?` +
+			`(?:previous|prior|above|earlier|preceding|original)\s+(?:instructions|prompts?|rules|directions)`),
+	},
+	{
+		name: "role reassignment",
+		re:   regexp.MustCompile(`(?i)\b(?:you\s+are\s+now|from\s+now\s+on,?\s+you|pretend\s+to\s+be|act\s+as\s+if\s+you)\b`),
+	},
+	{
+		name: "system prompt",
+		re: regexp.MustCompile(`(?i)\b(?:reveal|print|show|repeat|output|leak)\s+(?:me\s+)?(?:your|the)\s+` +
+			`(?:system\s+prompt|instructions|hidden\s+prompt)`),
+	},
+	{
+		name: "fake conversation markup",
+		re: regexp.MustCompile(`(?im)(?:<\|im_start\|>|<\|system\|>|\[/?(?:system|inst)\]|` +
+			`^\s*#{1,3}\s*system\b|^\s*system\s*:)`),
+	},
+	{
+		name: "new instructions",
+		re:   regexp.MustCompile(`(?i)\b(?:new|updated|important)\s+instructions\s*:`),
+	},
+	{
+		name: "hidden from user",
+		re: regexp.MustCompile(`(?i)\b(?:do\s+not|don't|never)\s+` +
+			`(?:tell|inform|mention\s+(?:this\s+)?to|show)\s+the\s+user\b`),
+	},
+}
+
+// WithToolResultGuard scans the tool results for prompt injections. NewMain returns an error if any of the
+// additional patterns is an invalid regular expression.
+func WithToolResultGuard(guard ToolResultGuard) MainOption {
+	return func(m *Main) {
+		m.toolResultGuard = guard
+	}
+}
+
+func (m *Main) parseToolResultGuard() error {
+	if !m.toolResultGuard.Enabled {
+		return nil
+	}
+	m.guardPatterns = slices.Clone(builtinGuardPatterns)
+	for _, p := range m.toolResultGuard.Patterns {
+		re, err := regexp.Compile("(?im)" + p)
+		if err != nil {
+			return fmt.Errorf("invalid tool result guard pattern %q: %w", p, err)
+		}
+		m.guardPatterns = append(m.guardPatterns, guardPattern{name: p, re: re})
+	}
+	return nil
+}
+
+// guardToolResult marks content, a tool result of toolName, as untrusted and records the instruction-like
+// patterns found in it, if the guard is enabled.
+func (m *Main) guardToolResult(ctx context.Context, toolName string, content *models.Content) {
+	if !m.toolResultGuard.Enabled {
+		return
+	}
+	content.Untrusted = true
+
+	text := toolResultText(content.ToolResult)
+	for _, p := range m.guardPatterns {
+		if p.re.MatchString(text) {
+			content.SuspiciousPatterns = append(content.SuspiciousPatterns, p.name)
+		}
+	}
+	if len(content.SuspiciousPatterns) > 0 {
+		m.logger.WarnContext(ctx, "Suspicious tool result",
+			slog.String("toolName", toolName),
+			slog.String("patterns", strings.Join(content.SuspiciousPatterns, ", ")))
+	}
+}
+
+// toolResultText returns the strings in the JSON of a tool result one per line, so the patterns match the
+// text as the LLM reads it rather than its JSON escapes. The result is returned as is if it isn't JSON.
+func toolResultText(result json.RawMessage) string {
+	var v any
+	if err := json.Unmarshal(result, &v); err != nil {
+		return string(result)
+	}
+	var sb strings.Builder
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case string:
+			sb.WriteString(v)
+			sb.WriteString("\n")
+		case []any:
+			for _, e := range v {
+				walk(e)
+			}
+		case map[string]any:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(v)
+	return sb.String()
+}
@@ -11,93 +11,123 @@ import (
 )
 
 type homePageData struct {
-	Chats         []chat
+	Chats         chatListPage
 	Messages      []message
 	CurrentChatID string
+	Parameters    chatParameters
+	Mounts        chatMounts
+	Members       chatMembers
+	Observer      chatObserver
+	Share         chatShare
+
+	CompareEnabled bool
 
 	Servers   []mcp.Info
 	Tools     []mcp.Tool
 	Resources []mcp.Resource
 	Prompts   []mcp.Prompt
+
+	ResourceTemplates []resourceTemplate
+
+	Welcome welcomeView
+
+	// Threaded shows the replies of the threads under the messages they reply to, instead of in their order.
+	Threaded bool
+	// ReadOnly hides the chat form from the users whose role doesn't let them send messages.
+	ReadOnly bool
+	// BudgetAlerts are the banners of the budgets of the LLM providers that crossed a threshold.
+	BudgetAlerts []string
 }
 
-// HandleHome renders the home page template with chat and message data. It displays a list of available
-// chats and, if a chat_id query parameter is provided, shows the messages for the selected chat.
+// HandleHome renders the home page template with chat and message data. It displays the first pages of the
+// list of available chats, down to the selected one, and, if a chat_id query parameter is provided, shows the
+// messages for the selected chat, with the replies of its threads under the messages they reply to if the view
+// query parameter is "threaded".
 // The handler retrieves chat and message data from the store and prepares it for template rendering.
-func (m Main) HandleHome(w http.ResponseWriter, r *http.Request) {
+func (m *Main) HandleHome(w http.ResponseWriter, r *http.Request) {
 	cs, err := m.store.Chats(r.Context())
 	if err != nil {
-		m.logger.Error("Failed to get chats", slog.String(errLoggerKey, err.Error()))
+		m.logger.ErrorContext(r.Context(), "Failed to get chats", slog.String(errLoggerKey, err.Error()))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	// We transform the store's chat data into our view-specific chat structs
-	// to avoid exposing internal implementation details to the template
-	chats := make([]chat, len(cs))
-	for i := range cs {
-		chats[i] = chat{
-			ID:     cs[i].ID,
-			Title:  cs[i].Title,
-			Active: false,
-		}
-	}
+	cs = m.visibleChats(r, cs)
 
 	currentChatID := ""
+	threaded := r.URL.Query().Get("view") == threadedViewQuery
 	var messages []message
+	var parameters chatParameters
+	var mounts chatMounts
+	var members chatMembers
+	var observer chatObserver
+	var share chatShare
+	var current models.Chat
 	if r.URL.Query().Get("chat_id") != "" {
 		currentChatID = r.URL.Query().Get("chat_id")
+		if !m.authorizeChat(w, r, currentChatID) {
+			return
+		}
 
-		// We find and mark the currently selected chat as active for UI highlighting
-		idx := slices.IndexFunc(chats, func(c chat) bool {
+		// We find the currently selected chat, marked as active for UI highlighting in the chat list
+		idx := slices.IndexFunc(cs, func(c models.Chat) bool {
 			return c.ID == currentChatID
 		})
 		if idx >= 0 {
-			chats[idx].Active = true
+			parameters = m.newChatParameters(cs[idx])
+			mounts = m.newChatMounts(currentChatID, cs[idx].MountedResources)
+			members = newChatMembers(cs[idx], m.userID(r))
+			observer = newChatObserver(cs[idx], m.userID(r))
+			share = newChatShare(cs[idx], m.userID(r))
+			current = cs[idx]
 		}
 
 		// We fetch and transform messages for the selected chat,
 		// setting initial streaming state to "ended" for all messages
 		ms, err := m.store.Messages(r.Context(), currentChatID)
 		if err != nil {
-			m.logger.Error("Failed to get messages", slog.String(errLoggerKey, err.Error()))
+			m.logger.ErrorContext(r.Context(), "Failed to get messages", slog.String(errLoggerKey, err.Error()))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		messages = make([]message, len(ms))
-		for i := range ms {
-			rc, err := models.RenderContents(ms[i].Contents)
-			if err != nil {
-				m.logger.Error("Failed to render contents",
-					slog.String("message", fmt.Sprintf("%+v", ms[i])),
-					slog.String(errLoggerKey, err.Error()))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			m.logger.Debug("Render contents",
-				slog.String("origMsg", fmt.Sprintf("%+v", ms[i].Contents)),
-				slog.String("renderedMsg", rc))
-			messages[i] = message{
-				ID:             ms[i].ID,
-				Role:           string(ms[i].Role),
-				Content:        rc,
-				Timestamp:      ms[i].Timestamp,
-				StreamingState: "ended",
-			}
+		if messages, err = m.messageViews(r, current, ms, threaded); err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to render messages", slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Only the owner's views retry the title, so the other readers of a visible chat don't queue it.
+		if idx >= 0 && chatOwner(current, m.userID(r)) {
+			m.retryChatTitle(r.Context(), current, ms)
 		}
 	}
+	// The chat list is paginated, its first page listing the current chat.
+	chats := newChatListPage(cs, m.firstChatListPageSize(cs, currentChatID), currentChatID)
+	caps := m.capabilities()
 	data := homePageData{
-		Chats:         chats,
-		Messages:      messages,
-		CurrentChatID: currentChatID,
-		Servers:       m.servers,
-		Tools:         m.tools,
-		Resources:     m.resources,
-		Prompts:       m.prompts,
+		Chats:          chats,
+		Messages:       messages,
+		CurrentChatID:  currentChatID,
+		Parameters:     parameters,
+		Mounts:         mounts,
+		Members:        members,
+		Observer:       observer,
+		Share:          share,
+		CompareEnabled: m.compareLLM != nil,
+		ReadOnly:       !m.allowed(r, permChat),
+		Servers:        caps.servers,
+		Tools:          caps.tools,
+		Resources:      caps.resources,
+		Prompts:        caps.prompts,
+
+		ResourceTemplates: newResourceTemplates(caps.resourceTemplates),
+
+		Welcome: m.newWelcomeView(caps.tools),
+
+		Threaded:     threaded,
+		BudgetAlerts: m.budgetAlerts(r.Context()),
 	}
 
-	if err := m.templates.ExecuteTemplate(w, "home.html", data); err != nil {
-		m.logger.Error("Failed to execute home template", slog.String(errLoggerKey, err.Error()))
+	if err := m.renderPage(w, "home.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute home template", slog.String(errLoggerKey, err.Error()))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -105,6 +135,39 @@ func (m Main) HandleHome(w http.ResponseWriter, r *http.Request) {
 
 // HandleSSE serves Server-Sent Events (SSE) requests by delegating to the underlying SSE server.
 // This endpoint enables real-time updates for the client.
-func (m Main) HandleSSE(w http.ResponseWriter, r *http.Request) {
+func (m *Main) HandleSSE(w http.ResponseWriter, r *http.Request) {
 	m.sseSrv.ServeHTTP(w, r)
 }
+
+// messageViews returns the views of ms, the messages of the chat c shown to the user of r, with the replies
+// of the threads under the messages they reply to if threaded is true. The messages are ended, as they're
+// shown before any response is streamed.
+func (m *Main) messageViews(r *http.Request, c models.Chat, ms []models.Message, threaded bool) ([]message, error) {
+	ms = withoutDrafts(ms)
+	messages := make([]message, len(ms))
+	loc := userLocation(r)
+	for i := range ms {
+		rc, err := models.RenderContents(ms[i].Contents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render contents of message %s: %w", ms[i].ID, err)
+		}
+		m.logger.DebugContext(r.Context(), "Render contents",
+			slog.String("origMsg", fmt.Sprintf("%+v", ms[i].Contents)),
+			slog.String("renderedMsg", rc))
+		messages[i] = message{
+			ID:             ms[i].ID,
+			Role:           string(ms[i].Role),
+			Content:        rc,
+			Timestamp:      ms[i].Timestamp.In(loc),
+			Stats:          formatStats(ms[i].Stats),
+			LengthLimited:  ms[i].LengthLimited,
+			Truncated:      ms[i].FinishReason == models.FinishReasonLength,
+			FinishNote:     finishNote(ms[i].FinishReason),
+			Interruption:   ms[i].Interruption,
+			Sender:         chatMessageSender(c, ms[i]),
+			Inspectable:    len(ms[i].Requests) > 0,
+			StreamingState: "ended",
+		}
+	}
+	return withThreads(messages, ms, threaded), nil
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyKeys remembers the idempotency keys of the chat requests, so a message posted again by a client
+// that didn't get the response, like the offline queue of the PWA, isn't added to the chat twice.
+type idempotencyKeys struct {
+	mu    sync.Mutex
+	items map[string]time.Time
+}
+
+// idempotencyClaim is the claim of a request on its idempotency key. The key is released when the request
+// fails before it's processed, so the client can retry it.
+type idempotencyClaim struct {
+	keys *idempotencyKeys
+	key  string
+	kept bool
+}
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotencyKeyTTL is how long a processed key is remembered, which bounds how long a message can stay
+	// in the offline queue of the PWA without risking a duplicate.
+	idempotencyKeyTTL = 24 * time.Hour
+)
+
+// claimIdempotencyKey claims the idempotency key of r, from the Idempotency-Key header or the
+// idempotency_key form field. It responds with 204 No Content and returns false if the key was already
+// claimed by a previous request of the user. The requests without a key are never considered duplicates.
+func (m *Main) claimIdempotencyKey(w http.ResponseWriter, r *http.Request, userID string) (*idempotencyClaim, bool) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		key = r.FormValue("idempotency_key")
+	}
+	if key == "" {
+		return &idempotencyClaim{kept: true}, true
+	}
+
+	claim := &idempotencyClaim{keys: m.idempotencyKeys, key: userID + "\x00" + key}
+	if !m.idempotencyKeys.claim(claim.key, time.Now()) {
+		m.logger.InfoContext(r.Context(), "Ignored duplicate chat request", slog.String("idempotencyKey", key))
+		w.WriteHeader(http.StatusNoContent)
+		return nil, false
+	}
+	return claim, true
+}
+
+func (k *idempotencyKeys) claim(key string, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for item, expiresAt := range k.items {
+		if now.After(expiresAt) {
+			delete(k.items, item)
+		}
+	}
+	if _, ok := k.items[key]; ok {
+		return false
+	}
+	k.items[key] = now.Add(idempotencyKeyTTL)
+	return true
+}
+
+// keep keeps the key claimed once the request is processed.
+func (c *idempotencyClaim) keep() {
+	c.kept = true
+}
+
+// release releases the key if the request wasn't processed.
+func (c *idempotencyClaim) release() {
+	if c.kept {
+		return
+	}
+	c.keys.mu.Lock()
+	defer c.keys.mu.Unlock()
+	delete(c.keys.items, c.key)
+}
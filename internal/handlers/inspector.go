@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// messageContext is the view of the requests sent to the LLM provider for an assistant message in the
+// message_context template.
+type messageContext struct {
+	MessageID string
+	Requests  []providerRequest
+	// Providers are the LLM providers the turns are replayed with.
+	Providers []replayProvider
+}
+
+// providerRequest is a request sent to the LLM provider, split into the sections of its body, each indented
+// as JSON. System is empty for the providers taking the system prompt as a message.
+type providerRequest struct {
+	Turn       int
+	Size       int
+	System     string
+	Messages   string
+	Tools      string
+	Parameters string
+}
+
+// WithDebugMode records the bodies of the requests sent to the LLM providers with the responses they
+// generate, the final messages, system prompt, tool definitions and parameters of every turn, which the
+// users inspect under the responses. The bodies are stored with the messages, growing the store with the
+// whole history of the chats at every turn, and they show the system prompt and the tools to the users.
+func WithDebugMode() MainOption {
+	return func(m *Main) {
+		m.debugMode = true
+	}
+}
+
+// recordRequests returns a copy of ctx recording the requests sent to the LLM provider in the Requests of
+// aiMsg, in the debug mode, and ctx otherwise. The requests are recorded as the LLM is called, so they're saved
+// with the contents streamed after them.
+func (m *Main) recordRequests(ctx context.Context, aiMsg *models.Message) context.Context {
+	if !m.debugMode {
+		return ctx
+	}
+	return models.WithRequestRecorder(ctx, func(body json.RawMessage) {
+		aiMsg.Requests = append(aiMsg.Requests, body)
+	})
+}
+
+// HandleMessageContext renders the requests sent to the LLM provider for the assistant message of the
+// message_id query parameter in the chat of chat_id, recorded in the debug mode, with the message_context
+// template. It responds with 404 Not Found if the message has no recorded requests.
+func (m *Main) HandleMessageContext(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chatID := r.URL.Query().Get("chat_id")
+	if _, err := m.findUserChat(r, chatID); err != nil {
+		if errors.Is(err, errChatNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		m.logger.ErrorContext(r.Context(), "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	messages, err := m.store.Messages(r.Context(), chatID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get messages",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	messageID := r.URL.Query().Get("message_id")
+	idx := slices.IndexFunc(messages, func(msg models.Message) bool {
+		return msg.ID == messageID && len(msg.Requests) > 0
+	})
+	if idx < 0 {
+		http.Error(w, "Message context not found", http.StatusNotFound)
+		return
+	}
+
+	view := messageContext{MessageID: messageID, Providers: m.replayProviders()}
+	for i, body := range messages[idx].Requests {
+		view.Requests = append(view.Requests, newProviderRequest(i+1, body))
+	}
+	if err := m.templates.ExecuteTemplate(w, "message_context", view); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute message_context template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// newProviderRequest splits body into the system prompt, the messages, the tools and the other fields of the
+// request, its parameters. A body that isn't a JSON object is shown whole as its parameters.
+func newProviderRequest(turn int, body json.RawMessage) providerRequest {
+	req := providerRequest{Turn: turn, Size: len(body)}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		req.Parameters = indentJSON(body)
+		return req
+	}
+	// The system prompt of the providers taking it as a string is shown as it's written.
+	if err := json.Unmarshal(fields["system"], &req.System); err != nil {
+		req.System = requestSection(fields["system"])
+	}
+	req.Messages = requestSection(fields["messages"])
+	req.Tools = requestSection(fields["tools"])
+	params := maps.Clone(fields)
+	for _, key := range []string{"system", "messages", "tools"} {
+		delete(params, key)
+	}
+	// The map is marshaled with its keys sorted.
+	if b, err := json.Marshal(params); err == nil {
+		req.Parameters = indentJSON(b)
+	}
+	return req
+}
+
+// requestSection returns the field of a request body indented, or an empty string if it's missing or null.
+func requestSection(data json.RawMessage) string {
+	if len(data) == 0 || string(data) == "null" {
+		return ""
+	}
+	return indentJSON(data)
+}
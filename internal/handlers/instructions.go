@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"iter"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// ServerInstructions collects the instructions the MCP servers return when they're initialized, telling how
+// to use their tools, and appends the ones of the allowed servers to the system prompt. The go-mcp client
+// doesn't expose them, so they're read from the initialize responses: the transports of the servers are
+// wrapped with Transport before creating their clients.
+type ServerInstructions struct {
+	// allowed are the names of the servers whose instructions are appended to the system prompt, every
+	// server if it's empty.
+	allowed []string
+
+	mu           sync.Mutex
+	servers      []string
+	instructions map[string]string
+}
+
+// serverInstructionsView is the instructions of a server in the tools page, Injected reporting whether
+// they're appended to the system prompt.
+type serverInstructionsView struct {
+	Server       string
+	Instructions string
+	Injected     bool
+}
+
+type instructionsTransport struct {
+	collector *ServerInstructions
+	server    string
+	transport mcp.ClientTransport
+}
+
+type instructionsSession struct {
+	mcp.Session
+	collector *ServerInstructions
+	server    string
+
+	// initializeID is the ID of the initialize request sent in the session, whose response carries the
+	// instructions.
+	initializeID *string
+}
+
+const methodInitialize = "initialize"
+
+// NewServerInstructions creates a ServerInstructions appending the instructions of the servers named in
+// allowed to the system prompt, or of every server if allowed is empty.
+func NewServerInstructions(allowed []string) *ServerInstructions {
+	return &ServerInstructions{
+		allowed:      allowed,
+		instructions: make(map[string]string),
+	}
+}
+
+// WithServerInstructions appends the instructions of the MCP servers collected by instructions to the
+// system prompt of the generations, and shows them in the tools page.
+func WithServerInstructions(instructions *ServerInstructions) MainOption {
+	return func(m *Main) {
+		m.serverInstructions = instructions
+	}
+}
+
+// Transport wraps the transport of the MCP server named server, to collect the instructions of its
+// initialize responses.
+func (s *ServerInstructions) Transport(server string, transport mcp.ClientTransport) mcp.ClientTransport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !slices.Contains(s.servers, server) {
+		s.servers = append(s.servers, server)
+	}
+	return instructionsTransport{collector: s, server: server, transport: transport}
+}
+
+func (t instructionsTransport) StartSession(ctx context.Context) (mcp.Session, error) {
+	session, err := t.transport.StartSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return instructionsSession{
+		Session:      session,
+		collector:    t.collector,
+		server:       t.server,
+		initializeID: new(string),
+	}, nil
+}
+
+func (s instructionsSession) Send(ctx context.Context, msg mcp.JSONRPCMessage) error {
+	if msg.Method == methodInitialize {
+		s.collector.mu.Lock()
+		*s.initializeID = string(msg.ID)
+		s.collector.mu.Unlock()
+	}
+	return s.Session.Send(ctx, msg)
+}
+
+func (s instructionsSession) Messages() iter.Seq[mcp.JSONRPCMessage] {
+	return func(yield func(mcp.JSONRPCMessage) bool) {
+		for msg := range s.Session.Messages() {
+			if msg.Method == "" && msg.ID != "" && msg.Result != nil {
+				s.collector.record(s.server, s.initializeID, msg)
+			}
+			if !yield(msg) {
+				return
+			}
+		}
+	}
+}
+
+// record keeps the instructions of msg if it's the response of the initialize request of initializeID,
+// replacing the ones of the previous sessions of server.
+func (s *ServerInstructions) record(server string, initializeID *string, msg mcp.JSONRPCMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if *initializeID == "" || *initializeID != string(msg.ID) {
+		return
+	}
+	*initializeID = ""
+
+	var result struct {
+		Instructions string `json:"instructions"`
+	}
+	if err := json.Unmarshal(msg.Result, &result); err != nil {
+		return
+	}
+	s.instructions[server] = strings.TrimSpace(result.Instructions)
+}
+
+func (s *ServerInstructions) allows(server string) bool {
+	return len(s.allowed) == 0 || slices.Contains(s.allowed, server)
+}
+
+// views returns the instructions of the servers that returned some, in the order their transports were
+// wrapped.
+func (s *ServerInstructions) views() []serverInstructionsView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var views []serverInstructionsView
+	for _, server := range s.servers {
+		if s.instructions[server] == "" {
+			continue
+		}
+		views = append(views, serverInstructionsView{
+			Server:       server,
+			Instructions: s.instructions[server],
+			Injected:     s.allows(server),
+		})
+	}
+	return views
+}
+
+// withServerInstructions returns a copy of ctx carrying the instructions of the allowed MCP servers in the
+// system prompt, or ctx as is if there are none.
+func (m *Main) withServerInstructions(ctx context.Context) context.Context {
+	if m.serverInstructions == nil {
+		return ctx
+	}
+
+	var sb strings.Builder
+	for _, view := range m.serverInstructions.views() {
+		if !view.Injected {
+			continue
+		}
+		if sb.Len() == 0 {
+			sb.WriteString("The MCP servers providing the tools give the following instructions to use them.\n")
+		}
+		sb.WriteString("\nInstructions of the " + view.Server + " server:\n" + view.Instructions + "\n")
+	}
+	if sb.Len() == 0 {
+		return ctx
+	}
+	return models.WithSystemPrompt(ctx, strings.TrimSuffix(sb.String(), "\n"))
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// interruptGeneration records genErr as the interruption of the generation of aiMsg, keeping its partial
+// text instead of replacing it with the error, and publishes it with the button to resume it. It returns
+// the interrupted message.
+func (m *Main) interruptGeneration(
+	ctx context.Context,
+	aiMsg models.Message,
+	stats *streamStats,
+	genErr error,
+	save func(models.Message) error,
+) models.Message {
+	aiMsg.Interruption = genErr.Error()
+	aiMsg.Stats = stats.stats(aiMsg)
+	if err := save(aiMsg); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to update message", slog.String(errLoggerKey, err.Error()))
+	}
+	m.publishStats(ctx, aiMsg)
+	return aiMsg
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// KeyRotation re-instantiates the services of the LLM providers with a new API key, which the administrators
+// set at runtime from the /admin/keys page, without a restart. A nil function disables the rotation of the
+// key of its provider, like the providers without an API key.
+type KeyRotation struct {
+	LLM            func(apiKey string) (LLM, error)
+	TitleGenerator func(apiKey string) (TitleGenerator, error)
+	CompareLLM     func(apiKey string) (LLM, error)
+}
+
+// rotatingProvider holds the current instance of a provider whose API key is rotated. The generations started
+// before a rotation keep the instance they started with until they end.
+type rotatingProvider[T any] struct {
+	current atomic.Pointer[T]
+
+	mu        sync.Mutex
+	rotatedAt time.Time
+}
+
+// rotatingLLM is an LLM whose provider is replaced when its API key is rotated.
+type rotatingLLM struct {
+	*rotatingProvider[LLM]
+}
+
+// rotatingTitleGenerator is a TitleGenerator whose provider is replaced when its API key is rotated.
+type rotatingTitleGenerator struct {
+	*rotatingProvider[TitleGenerator]
+}
+
+// keyProvider is a provider whose API key is rotated, in the keys page.
+type keyProvider struct {
+	Name      string
+	Label     string
+	Model     string
+	RotatedAt time.Time
+}
+
+type keysPageData struct {
+	Providers []keyProvider
+	// Rotated is the label of the provider whose key was just rotated.
+	Rotated string
+	Error   string
+}
+
+const (
+	providerLLM            = "llm"
+	providerTitleGenerator = "titleGenerator"
+	providerCompareLLM     = "compareLLM"
+)
+
+// WithKeyRotation enables the rotation of the API keys of the LLM providers at runtime, from the /admin/keys
+// page. The new key is validated by the setup check of the provider re-instantiated with it, a call to its
+// API, before it replaces the current provider. The rotated keys are kept in memory only.
+func WithKeyRotation(rotation KeyRotation) MainOption {
+	return func(m *Main) {
+		m.keyRotation = rotation
+	}
+}
+
+// setupKeyRotation wraps the providers whose key is rotated. It must be called before the LLMs are wrapped by
+// the middlewares, after the setup checkers and the token counter are taken from them.
+func (m *Main) setupKeyRotation() {
+	if m.keyRotation.LLM != nil && m.llm != nil {
+		m.rotatingLLM = newRotatingLLM(m.llm)
+		m.llm = m.rotatingLLM
+		if m.tokenCounter != nil {
+			m.tokenCounter = m.rotatingLLM
+		}
+		if m.llmSetup != nil {
+			m.llmSetup = m.rotatingLLM
+		}
+	}
+	if m.keyRotation.CompareLLM != nil && m.compareLLM != nil {
+		m.rotatingCompareLLM = newRotatingLLM(m.compareLLM)
+		m.compareLLM = m.rotatingCompareLLM
+		if m.compareLLMSetup != nil {
+			m.compareLLMSetup = m.rotatingCompareLLM
+		}
+	}
+	if m.keyRotation.TitleGenerator != nil && m.titleGenerator != nil {
+		m.rotatingTitleGenerator = rotatingTitleGenerator{newRotatingProvider(m.titleGenerator)}
+		m.titleGenerator = m.rotatingTitleGenerator
+	}
+}
+
+// HandleKeys renders the page of the providers whose API key is rotated on GET, and rotates the key of the
+// provider of the "provider" form field to the "api_key" one on POST, rendering the page with the result.
+func (m *Main) HandleKeys(w http.ResponseWriter, r *http.Request) {
+	var data keysPageData
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		name := r.FormValue("provider")
+		apiKey := strings.TrimSpace(r.FormValue("api_key"))
+		if err := m.rotateKey(r.Context(), name, apiKey); err != nil {
+			m.logger.WarnContext(r.Context(), "Failed to rotate API key",
+				slog.String("provider", name),
+				slog.String(errLoggerKey, err.Error()))
+			data.Error = err.Error()
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			break
+		}
+		m.logger.InfoContext(r.Context(), "Rotated API key", slog.String("provider", name))
+		m.addAuthEvent(r.Context(), m.clientIP(r), m.userID(r), models.AuditActionKeyRotation,
+			"API key of the "+providerLabel(name)+" rotated")
+		data.Rotated = providerLabel(name)
+	default:
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	loc := userLocation(r)
+	for _, p := range m.keyProviders() {
+		p.RotatedAt = p.RotatedAt.In(loc)
+		data.Providers = append(data.Providers, p)
+	}
+	if err := m.renderPage(w, "keys.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute keys template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// rotateKey re-instantiates the provider of name with apiKey, and replaces the current one if its setup check
+// passes with the new key.
+func (m *Main) rotateKey(ctx context.Context, name, apiKey string) error {
+	if apiKey == "" {
+		return errors.New("API key is required")
+	}
+	switch {
+	case name == providerLLM && m.rotatingLLM.rotatingProvider != nil:
+		return rotate(ctx, m.rotatingLLM.rotatingProvider, m.keyRotation.LLM, apiKey)
+	case name == providerCompareLLM && m.rotatingCompareLLM.rotatingProvider != nil:
+		return rotate(ctx, m.rotatingCompareLLM.rotatingProvider, m.keyRotation.CompareLLM, apiKey)
+	case name == providerTitleGenerator && m.rotatingTitleGenerator.rotatingProvider != nil:
+		return rotate(ctx, m.rotatingTitleGenerator.rotatingProvider, m.keyRotation.TitleGenerator, apiKey)
+	}
+	return fmt.Errorf("the API key of provider %q isn't rotated", name)
+}
+
+func (m *Main) keyProviders() []keyProvider {
+	var providers []keyProvider
+	add := func(name string, model string, rotatedAt time.Time) {
+		providers = append(providers, keyProvider{
+			Name:      name,
+			Label:     providerLabel(name),
+			Model:     model,
+			RotatedAt: rotatedAt,
+		})
+	}
+	if p := m.rotatingLLM; p.rotatingProvider != nil {
+		add(providerLLM, p.Model(), p.lastRotation())
+	}
+	if p := m.rotatingTitleGenerator; p.rotatingProvider != nil {
+		add(providerTitleGenerator, p.Model(), p.lastRotation())
+	}
+	if p := m.rotatingCompareLLM; p.rotatingProvider != nil {
+		add(providerCompareLLM, p.Model(), p.lastRotation())
+	}
+	return providers
+}
+
+func providerLabel(name string) string {
+	switch name {
+	case providerLLM:
+		return "LLM"
+	case providerTitleGenerator:
+		return "title generator"
+	case providerCompareLLM:
+		return "compare LLM"
+	}
+	return name
+}
+
+func newRotatingProvider[T any](provider T) *rotatingProvider[T] {
+	p := &rotatingProvider[T]{}
+	p.current.Store(&provider)
+	return p
+}
+
+func newRotatingLLM(llm LLM) rotatingLLM {
+	return rotatingLLM{newRotatingProvider(llm)}
+}
+
+// rotate re-instantiates the provider of p with apiKey by newProvider, checks its setup, and replaces the
+// current provider with it.
+func rotate[T any](
+	ctx context.Context,
+	p *rotatingProvider[T],
+	newProvider func(string) (T, error),
+	apiKey string,
+) error {
+	provider, err := newProvider(apiKey)
+	if err != nil {
+		return fmt.Errorf("failed to create the provider: %w", err)
+	}
+	checker, ok := any(provider).(setupChecker)
+	if !ok {
+		return errors.New("the provider can't validate its API key")
+	}
+	if err := checker.CheckSetup(ctx); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current.Store(&provider)
+	p.rotatedAt = time.Now()
+	return nil
+}
+
+func (p *rotatingProvider[T]) load() T {
+	return *p.current.Load()
+}
+
+// lastRotation returns the time of the last rotation of the key, zero if it wasn't rotated.
+func (p *rotatingProvider[T]) lastRotation() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rotatedAt
+}
+
+// Model returns the model of the current provider.
+func (p *rotatingProvider[T]) Model() string {
+	return modelName(p.load())
+}
+
+// CheckSetup checks the setup of the current provider, if it checks it.
+func (p *rotatingProvider[T]) CheckSetup(ctx context.Context) error {
+	if checker, ok := any(p.load()).(setupChecker); ok {
+		return checker.CheckSetup(ctx)
+	}
+	return nil
+}
+
+// Chat implements LLM with the current provider.
+func (r rotatingLLM) Chat(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+) iter.Seq2[models.Content, error] {
+	return r.load().Chat(ctx, messages, tools)
+}
+
+// CountTokens counts the tokens with the current provider, if it counts them.
+func (r rotatingLLM) CountTokens(ctx context.Context, messages []models.Message, tools []mcp.Tool) int {
+	if counter, ok := r.load().(tokenCounter); ok {
+		return counter.CountTokens(ctx, messages, tools)
+	}
+	return 0
+}
+
+// GenerateTitle implements TitleGenerator with the current provider.
+func (r rotatingTitleGenerator) GenerateTitle(ctx context.Context, message, language string) (string, error) {
+	return r.load().GenerateTitle(ctx, message, language)
+}
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// chatLanguage is a programming language detected in the code of the chats, with the Bootstrap icon of its
+// label in the chat list.
+type chatLanguage struct {
+	name string
+	icon string
+	// aliases are the info strings of the fenced code blocks of the language, lowercased.
+	aliases []string
+	// signature matches the code of the language in the fenced code blocks without info string.
+	signature *regexp.Regexp
+}
+
+// minLanguageCodeLines is the number of lines of code of a chat in its dominant language for the chat to be
+// labeled with it, so that a one-line snippet doesn't label a chat that isn't about code.
+const minLanguageCodeLines = 3
+
+// chatLanguages are the languages the chats are labeled with, in the order of precedence of their
+// signatures and of the ties.
+var chatLanguages = []chatLanguage{
+	{
+		name:      "Go",
+		icon:      "bi-code-slash",
+		aliases:   []string{"go", "golang"},
+		signature: regexp.MustCompile(`(?m)^package \w+$|^func (\(\w+ \*?\w+\) )?\w+\(|:= `),
+	},
+	{
+		name:      "Rust",
+		icon:      "bi-gear",
+		aliases:   []string{"rust", "rs"},
+		signature: regexp.MustCompile(`(?m)^\s*(pub )?fn \w+|let mut |^use \w+::`),
+	},
+	{
+		name:      "Python",
+		icon:      "bi-filetype-py",
+		aliases:   []string{"python", "py", "python3"},
+		signature: regexp.MustCompile(`(?m)^\s*def \w+\(.*\):$|^\s*(from \w+ )?import \w+$|^\s*print\(`),
+	},
+	{
+		name:      "TypeScript",
+		icon:      "bi-filetype-tsx",
+		aliases:   []string{"typescript", "ts", "tsx"},
+		signature: regexp.MustCompile(`(?m)^\s*(export )?(interface|type) \w+|: (string|number|boolean)[;,)=]`),
+	},
+	{
+		name:      "JavaScript",
+		icon:      "bi-filetype-js",
+		aliases:   []string{"javascript", "js", "jsx", "mjs", "node"},
+		signature: regexp.MustCompile(`(?m)^\s*(const|let) \w+ = |=> \{|console\.log\(|require\(`),
+	},
+	{
+		name:      "Java",
+		icon:      "bi-filetype-java",
+		aliases:   []string{"java"},
+		signature: regexp.MustCompile(`public (static )?(class|void) |System\.out\.`),
+	},
+	{
+		name:      "C#",
+		icon:      "bi-filetype-cs",
+		aliases:   []string{"csharp", "cs", "c#"},
+		signature: regexp.MustCompile(`(?m)^using System|Console\.Write`),
+	},
+	{
+		name:      "C++",
+		icon:      "bi-code-slash",
+		aliases:   []string{"cpp", "c++", "cc", "hpp"},
+		signature: regexp.MustCompile(`std::|(?m)^#include <\w+>$`),
+	},
+	{
+		name:      "C",
+		icon:      "bi-code-slash",
+		aliases:   []string{"c", "h"},
+		signature: regexp.MustCompile(`(?m)^#include <\w+\.h>$|printf\(`),
+	},
+	{
+		name:      "Ruby",
+		icon:      "bi-filetype-rb",
+		aliases:   []string{"ruby", "rb"},
+		signature: regexp.MustCompile(`(?m)^\s*(require|puts) [\'"]|^\s*def \w+$`),
+	},
+	{
+		name:      "PHP",
+		icon:      "bi-filetype-php",
+		aliases:   []string{"php"},
+		signature: regexp.MustCompile(`<\?php`),
+	},
+	{
+		name:      "SQL",
+		icon:      "bi-filetype-sql",
+		aliases:   []string{"sql", "postgresql", "mysql", "sqlite"},
+		signature: regexp.MustCompile(`(?im)^\s*(select .+ from|insert into|create table|update \w+ set)\b`),
+	},
+	{
+		name:      "Shell",
+		icon:      "bi-terminal",
+		aliases:   []string{"sh", "bash", "shell", "zsh", "console", "shellsession"},
+		signature: regexp.MustCompile(`(?m)^#!/bin/\w*sh|^\$ `),
+	},
+	{
+		name:    "PowerShell",
+		icon:    "bi-terminal",
+		aliases: []string{"powershell", "ps1", "pwsh"},
+	},
+	{
+		name:      "HTML",
+		icon:      "bi-filetype-html",
+		aliases:   []string{"html", "htm"},
+		signature: regexp.MustCompile(`(?i)<(!doctype html|html|head|body|div)\b`),
+	},
+	{
+		name:    "CSS",
+		icon:    "bi-filetype-css",
+		aliases: []string{"css", "scss", "sass", "less"},
+	},
+	{
+		name:    "JSON",
+		icon:    "bi-filetype-json",
+		aliases: []string{"json", "jsonc"},
+	},
+	{
+		name:    "YAML",
+		icon:    "bi-filetype-yml",
+		aliases: []string{"yaml", "yml"},
+	},
+	{
+		name:    "Markdown",
+		icon:    "bi-filetype-md",
+		aliases: []string{"markdown", "md"},
+	},
+	{
+		name:      "Dockerfile",
+		icon:      "bi-box-seam",
+		aliases:   []string{"dockerfile", "docker"},
+		signature: regexp.MustCompile(`(?m)^FROM \S+|^RUN `),
+	},
+}
+
+// fencedCodePattern matches the fenced code blocks of the markdown texts, with their info string and code.
+var fencedCodePattern = regexp.MustCompile("(?ms)^[ \t]*```[ \t]*([^\\s`]*)[^\n]*\n(.*?)^[ \t]*```")
+
+// detectLanguage returns the dominant programming language of the code of messages, the one of the most
+// lines of their fenced code blocks, or an empty string if they don't have enough code in a known
+// language. The language of a block is given by its info string, or guessed from its code without it.
+func detectLanguage(messages []models.Message) string {
+	lines := make([]int, len(chatLanguages))
+	for _, msg := range messages {
+		for _, content := range msg.Contents {
+			if content.Type != models.ContentTypeText {
+				continue
+			}
+			for _, block := range fencedCodePattern.FindAllStringSubmatch(content.Text, -1) {
+				if idx := blockLanguage(block[1], block[2]); idx >= 0 {
+					lines[idx] += strings.Count(strings.TrimSpace(block[2]), "\n") + 1
+				}
+			}
+		}
+	}
+
+	dominant := -1
+	for i, n := range lines {
+		if n >= minLanguageCodeLines && (dominant < 0 || n > lines[dominant]) {
+			dominant = i
+		}
+	}
+	if dominant < 0 {
+		return ""
+	}
+	return chatLanguages[dominant].name
+}
+
+// blockLanguage returns the index in chatLanguages of the language of a fenced code block with info and
+// code, or -1 if it's unknown.
+func blockLanguage(info, code string) int {
+	if info = strings.ToLower(info); info != "" {
+		for i, lang := range chatLanguages {
+			for _, alias := range lang.aliases {
+				if info == alias {
+					return i
+				}
+			}
+		}
+		return -1
+	}
+	for i, lang := range chatLanguages {
+		if lang.signature != nil && lang.signature.MatchString(code) {
+			return i
+		}
+	}
+	return -1
+}
+
+// LanguageIcon returns the Bootstrap icon of the label of the chat's language in the chat list.
+func (c chat) LanguageIcon() string {
+	for _, lang := range chatLanguages {
+		if lang.name == c.Language {
+			return lang.icon
+		}
+	}
+	return "bi-code-slash"
+}
+
+// updateChatLanguage labels the chat of chatID with the dominant language of messages, publishing the chat
+// list if the label changed. The label of a chat without enough code is left as is.
+func (m *Main) updateChatLanguage(ctx context.Context, chatID string, messages []models.Message) {
+	language := detectLanguage(messages)
+	if language == "" {
+		return
+	}
+	c, err := m.findChat(ctx, chatID)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		return
+	}
+	if c.Language == language {
+		return
+	}
+	c.Language = language
+	if err := m.store.UpdateChat(ctx, c); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to update chat language", slog.String(errLoggerKey, err.Error()))
+		return
+	}
+	if err := m.publishChat(ctx, chatID, chatUpdatedEventType); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to publish chat", slog.String(errLoggerKey, err.Error()))
+	}
+}
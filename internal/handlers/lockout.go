@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// Lockout configures the brute-force protection of WithLockout.
+type Lockout struct {
+	// MaxFailures is the number of failed authentications of a client within Window locking it out, 5 if zero.
+	MaxFailures int
+	// Window is the period the failures are counted over, 15 minutes if zero.
+	Window time.Duration
+	// Duration is how long a client is locked out, 15 minutes if zero.
+	Duration time.Duration
+}
+
+// authFailures tracks the failed authentications of the clients, by their IP address, and their lockouts.
+type authFailures struct {
+	mu    sync.Mutex
+	items map[string]*authFailure
+}
+
+type authFailure struct {
+	times       []time.Time
+	lockedUntil time.Time
+}
+
+// lockoutView is a locked out client in the authentication page.
+type lockoutView struct {
+	IP          string
+	LockedUntil time.Time
+}
+
+type authPageData struct {
+	Lockouts []lockoutView
+	Events   []models.AuditEntry
+}
+
+const (
+	defaultLockoutMaxFailures = 5
+	defaultLockoutWindow      = 15 * time.Minute
+	defaultLockoutDuration    = 15 * time.Minute
+	// maxAuthEvents is the number of the latest authentication events shown in the authentication page.
+	maxAuthEvents = 200
+	// maxLockoutClients is the number of the clients whose failures are tracked, which bounds the memory of
+	// the lockout when many clients fail, like a distributed attack.
+	maxLockoutClients = 10000
+)
+
+// WithLockout locks out the clients, by their IP address, after repeated failed authentications with an
+// invalid API token: their requests with an API token are refused with 429 Too Many Requests until the
+// lockout ends or an administrator lifts it. NewMain returns an error if a field is negative.
+func WithLockout(lockout Lockout) MainOption {
+	return func(m *Main) {
+		m.lockout = lockout
+		m.lockoutEnabled = true
+	}
+}
+
+func (m *Main) parseLockout() error {
+	if !m.lockoutEnabled {
+		return nil
+	}
+	if m.lockout.MaxFailures < 0 || m.lockout.Window < 0 || m.lockout.Duration < 0 {
+		return errors.New("the max failures, window and duration of the lockout must not be negative")
+	}
+	if m.lockout.MaxFailures == 0 {
+		m.lockout.MaxFailures = defaultLockoutMaxFailures
+	}
+	if m.lockout.Window == 0 {
+		m.lockout.Window = defaultLockoutWindow
+	}
+	if m.lockout.Duration == 0 {
+		m.lockout.Duration = defaultLockoutDuration
+	}
+	return nil
+}
+
+// checkLockout responds with 429 Too Many Requests and returns false if the client of r is locked out.
+func (m *Main) checkLockout(w http.ResponseWriter, r *http.Request) bool {
+	retryAfter, locked := m.lockedOut(m.clientIP(r))
+	if !locked {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	m.writeAPIError(w, http.StatusTooManyRequests,
+		fmt.Sprintf("Too many failed authentications, retry in %s", retryAfter))
+	return false
+}
+
+// lockedOut reports whether the client of ip is locked out, with the time until its lockout ends.
+func (m *Main) lockedOut(ip string) (time.Duration, bool) {
+	if !m.lockoutEnabled {
+		return 0, false
+	}
+	lockedUntil, locked := m.authFailures.locked(ip, time.Now())
+	if !locked {
+		return 0, false
+	}
+	return time.Until(lockedUntil).Round(time.Second), true
+}
+
+// authFailed records a failed authentication of the client of r, and locks it out if it failed too many
+// times.
+func (m *Main) authFailed(r *http.Request, details string) {
+	m.recordAuthFailure(r.Context(), m.clientIP(r), r.URL.Path, details)
+}
+
+// recordAuthFailure records a failed authentication of the client of ip on path, and locks it out if it
+// failed too many times.
+func (m *Main) recordAuthFailure(ctx context.Context, ip, path, details string) {
+	m.logger.WarnContext(ctx, "Failed authentication", slog.String("ip", ip), slog.String("path", path))
+	m.addAuthEvent(ctx, ip, "", models.AuditActionAuthFailure, details)
+	if !m.lockoutEnabled {
+		return
+	}
+	if lockedUntil, locked := m.authFailures.fail(ip, time.Now(), m.lockout); locked {
+		m.logger.WarnContext(ctx, "Client locked out", slog.String("ip", ip))
+		m.addAuthEvent(ctx, ip, "", models.AuditActionAuthLockout,
+			fmt.Sprintf("%d failed authentications, locked out until %s", m.lockout.MaxFailures,
+				lockedUntil.Format(time.RFC3339)))
+	}
+}
+
+// addAuthEvent records an authentication event in the audit log. The failures are logged only, as they
+// don't fail the request.
+func (m *Main) addAuthEvent(ctx context.Context, ip, userID string, action models.AuditAction, details string) {
+	err := m.store.AddAuditEntry(ctx, models.AuditEntry{
+		ID:      uuid.New().String(),
+		UserID:  userID,
+		Action:  action,
+		Details: details,
+		IP:      ip,
+		Time:    time.Now(),
+	})
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to add authentication event", slog.String(errLoggerKey, err.Error()))
+	}
+}
+
+// HandleAuthLog renders the authentication page of the administrators, with the clients locked out and the
+// latest authentication events of the audit log, the newest first.
+func (m *Main) HandleAuthLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries, err := m.store.AuditEntries(r.Context())
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get audit entries", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	loc := userLocation(r)
+	var data authPageData
+	for _, entry := range entries {
+		if !strings.HasPrefix(string(entry.Action), "auth.") {
+			continue
+		}
+		if len(data.Events) == maxAuthEvents {
+			break
+		}
+		entry.Time = entry.Time.In(loc)
+		data.Events = append(data.Events, entry)
+	}
+	for _, lockout := range m.authFailures.lockouts(time.Now()) {
+		lockout.LockedUntil = lockout.LockedUntil.In(loc)
+		data.Lockouts = append(data.Lockouts, lockout)
+	}
+
+	if err := m.renderPage(w, "auth.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute auth template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleAuthUnlock lifts the lockout of the client of the "ip" form field, and redirects back to the
+// authentication page.
+func (m *Main) HandleAuthUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := r.FormValue("ip")
+	if m.authFailures.unlock(ip, time.Now()) {
+		m.addAuthEvent(r.Context(), ip, m.userID(r), models.AuditActionAuthUnlock, "Lockout lifted")
+	}
+	http.Redirect(w, r, "/admin/auth", http.StatusSeeOther)
+}
+
+// locked returns the end of the lockout of ip, if it's locked out at now.
+func (f *authFailures) locked(ip string, now time.Time) (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	failure, ok := f.items[ip]
+	if !ok || !now.Before(failure.lockedUntil) {
+		return time.Time{}, false
+	}
+	return failure.lockedUntil, true
+}
+
+// fail records a failure of ip at now, and returns the end of its lockout if the failure locks it out. The
+// clients without any failure within the window of the lockout are forgotten, and so is the least recently
+// failing client once maxLockoutClients clients are tracked, the locked out clients last.
+func (f *authFailures) fail(ip string, now time.Time, lockout Lockout) (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	expired := func(t time.Time) bool { return now.Sub(t) > lockout.Window }
+	for item, failure := range f.items {
+		failure.times = slices.DeleteFunc(failure.times, expired)
+		if len(failure.times) == 0 && !now.Before(failure.lockedUntil) {
+			delete(f.items, item)
+		}
+	}
+
+	failure, ok := f.items[ip]
+	if !ok {
+		if len(f.items) >= maxLockoutClients {
+			f.evict(now)
+		}
+		failure = &authFailure{}
+		f.items[ip] = failure
+	}
+	failure.times = append(failure.times, now)
+	if len(failure.times) < lockout.MaxFailures {
+		return time.Time{}, false
+	}
+	failure.times = nil
+	failure.lockedUntil = now.Add(lockout.Duration)
+	return failure.lockedUntil, true
+}
+
+// evict forgets the client not locked out at now whose last failure is the oldest, or the client whose
+// lockout ends first if they're all locked out.
+func (f *authFailures) evict(now time.Time) {
+	var oldest string
+	var oldestFailure *authFailure
+	for ip, failure := range f.items {
+		if oldestFailure == nil || failure.evictedBefore(oldestFailure, now) {
+			oldest, oldestFailure = ip, failure
+		}
+	}
+	delete(f.items, oldest)
+}
+
+// evictedBefore reports whether the failure is evicted before other at now.
+func (a *authFailure) evictedBefore(other *authFailure, now time.Time) bool {
+	locked, otherLocked := now.Before(a.lockedUntil), now.Before(other.lockedUntil)
+	switch {
+	case locked != otherLocked:
+		return otherLocked
+	case locked:
+		return a.lockedUntil.Before(other.lockedUntil)
+	default:
+		return a.times[len(a.times)-1].Before(other.times[len(other.times)-1])
+	}
+}
+
+// unlock lifts the lockout of ip, and reports whether it was locked out at now.
+func (f *authFailures) unlock(ip string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	failure, ok := f.items[ip]
+	if !ok || !now.Before(failure.lockedUntil) {
+		return false
+	}
+	delete(f.items, ip)
+	return true
+}
+
+// lockouts returns the clients locked out at now, the latest lockout first.
+func (f *authFailures) lockouts(now time.Time) []lockoutView {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var res []lockoutView
+	for ip, failure := range f.items {
+		if now.Before(failure.lockedUntil) {
+			res = append(res, lockoutView{IP: ip, LockedUntil: failure.lockedUntil})
+		}
+	}
+	slices.SortFunc(res, func(a, b lockoutView) int { return b.LockedUntil.Compare(a.LockedUntil) })
+	return res
+}
@@ -3,13 +3,16 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/fs"
 	"iter"
 	"log/slog"
-	"text/template"
+	"net/http"
+	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/MegaGrindStone/go-mcp"
-	mcpwebui "github.com/MegaGrindStone/mcp-web-ui"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
 	"github.com/tmaxmax/go-sse"
 )
@@ -20,156 +23,418 @@ type LLM interface {
 	Chat(ctx context.Context, messages []models.Message, tools []mcp.Tool) iter.Seq2[models.Content, error]
 }
 
-// TitleGenerator represents a title generator interface that generates a title for a given message.
+// TitleGenerator represents a title generator interface that generates a title for a given message. The
+// language is the English name of the language the title is written in, like French, or empty if it's unknown,
+// the title prompt deciding it.
 type TitleGenerator interface {
-	GenerateTitle(ctx context.Context, message string) (string, error)
+	GenerateTitle(ctx context.Context, message, language string) (string, error)
+}
+
+// Notifier represents the interface for delivering chat events to external systems. The implementations
+// should not block the caller, as the events are emitted from the chat processing.
+type Notifier interface {
+	Notify(ctx context.Context, event models.Event)
 }
 
 // Store defines the interface for managing chat and message persistence. It provides methods for
-// creating, reading, and updating chats and their associated messages. The interface supports both
-// atomic operations and bulk retrieval of chats and messages.
+// creating, reading, updating, and deleting chats and their associated messages. The interface supports both
+// atomic operations and bulk retrieval of chats and messages, and CopyChat copies a chat with its messages
+// under new IDs. MessagePath retrieves the transcript of a message of a thread, its ancestors and itself. It
+// also maintains the daily usage counters of the users, where AddUsage increments the counters of the given
+// usage's user and day, the daily spends of the LLM providers, where AddSpend increments the spend of the
+// given spend's provider and day, the state and run history of the scheduled prompts, and the hashed API
+// tokens, browser sessions, memories and read receipts of the users. DeleteChat deletes the read receipts of the
+// chat as well, and DeleteUserData deletes the usage, API tokens, sessions, memories and read receipts of a
+// user, which are recorded with the audit entries. The cached states of the MCP servers are kept too.
 type Store interface {
 	Chats(ctx context.Context) ([]models.Chat, error)
 	AddChat(ctx context.Context, chat models.Chat) (string, error)
 	UpdateChat(ctx context.Context, chat models.Chat) error
+	DeleteChat(ctx context.Context, chatID string) error
+	CopyChat(ctx context.Context, chatID string, chat models.Chat) (string, error)
 
 	Messages(ctx context.Context, chatID string) ([]models.Message, error)
+	MessagesSince(ctx context.Context, chatID string, since time.Time) ([]models.Message, error)
+	MessagePath(ctx context.Context, chatID, messageID string) ([]models.Message, error)
 	AddMessage(ctx context.Context, chatID string, message models.Message) (string, error)
 	UpdateMessage(ctx context.Context, chatID string, message models.Message) error
+	ChatStats(ctx context.Context, chatID string) (models.ChatStats, error)
+
+	Schedules(ctx context.Context) ([]models.Schedule, error)
+	SaveSchedule(ctx context.Context, schedule models.Schedule) error
+	ScheduleRuns(ctx context.Context, scheduleName string) ([]models.ScheduleRun, error)
+	AddScheduleRun(ctx context.Context, run models.ScheduleRun) error
+
+	Memories(ctx context.Context, userID string) ([]models.Memory, error)
+	SaveMemory(ctx context.Context, memory models.Memory) error
+	DeleteMemory(ctx context.Context, userID, memoryID string) error
+
+	ReadReceipts(ctx context.Context, userID string) ([]models.ReadReceipt, error)
+	SaveReadReceipt(ctx context.Context, receipt models.ReadReceipt) error
+
+	APITokens(ctx context.Context, userID string) ([]models.APIToken, error)
+	APITokenByHash(ctx context.Context, hash string) (models.APIToken, error)
+	AddAPIToken(ctx context.Context, token models.APIToken) error
+	DeleteAPIToken(ctx context.Context, userID, tokenID string) error
+
+	Sessions(ctx context.Context, userID string) ([]models.Session, error)
+	SessionByHash(ctx context.Context, hash string) (models.Session, error)
+	SaveSession(ctx context.Context, session models.Session) error
+	DeleteSession(ctx context.Context, userID, sessionID string) error
+
+	Usage(ctx context.Context, userID, day string) (models.Usage, error)
+	Usages(ctx context.Context, day string) ([]models.Usage, error)
+	UserUsages(ctx context.Context, userID string) ([]models.Usage, error)
+	AddUsage(ctx context.Context, usage models.Usage) error
+
+	Spends(ctx context.Context, provider, month string) ([]models.Spend, error)
+	AddSpend(ctx context.Context, spend models.Spend) error
+
+	DeleteUserData(ctx context.Context, userID string) error
+
+	AuditEntries(ctx context.Context) ([]models.AuditEntry, error)
+	AddAuditEntry(ctx context.Context, entry models.AuditEntry) error
+
+	MCPServerStates(ctx context.Context) ([]models.MCPServerState, error)
+	SaveMCPServerState(ctx context.Context, state models.MCPServerState) error
 }
 
 // Main handles the core functionality of the chat application, managing server-sent events,
-// HTML templates, and interactions between the LLM and Store components.
+// HTML templates, and interactions between the LLM and Store components. Its methods are safe for concurrent
+// use, it must not be copied after NewMain.
 type Main struct {
-	sseSrv    *sse.Server
-	templates *template.Template
+	sseSrv           *sse.Server
+	sseKeepAlive     SSEKeepAlive
+	sseAuthorization bool
+	events           eventBus
+	messageTopics    *messageTopics
+	pastedImages     *pastedImages
+	templateFS       fs.FS
+	templateReload   bool
+	templates        *templateSet
+	welcome          Welcome
 
 	llm            LLM
+	compareLLM     LLM
+	llmMiddlewares []LLMMiddleware
+	tokenCounter   tokenCounter
+	// parameterValidator validates the chat parameters for the LLM, before it's wrapped by the middlewares.
+	parameterValidator parameterValidator
+	// llmSetup and compareLLMSetup check the setup of the LLMs, before they're wrapped by the middlewares.
+	llmSetup        setupChecker
+	compareLLMSetup setupChecker
+	// keyRotation re-instantiates the providers held by the rotating ones, set if their key is rotated.
+	keyRotation            KeyRotation
+	rotatingLLM            rotatingLLM
+	rotatingCompareLLM     rotatingLLM
+	rotatingTitleGenerator rotatingTitleGenerator
+	inputPrice             float64
+	budgets                map[string]Budget
+	// spendMu serializes the spend records, to notify the crossed budget thresholds once.
+	spendMu        sync.Mutex
 	titleGenerator TitleGenerator
 	store          Store
+	// storeBackend is the store before its calls are bounded by storeTimeout, for its optional interfaces.
+	storeBackend Store
+	storeTimeout time.Duration
+
+	comparisons     *comparisons
+	idempotencyKeys *idempotencyKeys
+	authFailures    *authFailures
+
+	userHeader       string
+	requireAPITokens bool
+	quotas           Quotas
+	security         Security
+	access           Access
+	accessControl    bool
+	sessions         Sessions
+	lockout          Lockout
+	lockoutEnabled   bool
+	trustedProxies   []string
+	proxyPrefixes    []netip.Prefix
+	cors             CORS
+	capture          Capture
+
+	notifier  Notifier
+	exporters []GenerationExporter
+
+	toolResultGuard  ToolResultGuard
+	guardPatterns    []guardPattern
+	toolFailureLimit int
+	toolCache        ToolCache
+	toolOverrides    map[string]ToolOverride
+	toolResults      *toolResults
+	mountedResources *mountedResources
+	memoryEnabled    bool
+	responseLimit    ResponseLimit
+	debugMode        bool
+
+	batchRunner Batches
+	batches     *batches
+	batchQueue  chan batchJob
+
+	titleGeneration TitleGeneration
+	titleQueue      chan titleJob
+	queuedTitles    *queuedTitles
+
+	chatListPageSize int
+
+	evalSuite string
+	evals     *evals
+
+	scheduledPrompts []ScheduledPrompt
+	schedules        []scheduledPrompt
+	retention        Retention
+	maintenance      Maintenance
+	maintenanceCron  cronSchedule
+	backup           Backup
+	backupCron       cronSchedule
 
-	mcpClients []*mcp.Client
+	bridges     []Bridge
+	bridgeLocks *bridgeLocks
 
-	servers   []mcp.Info
-	tools     []mcp.Tool
-	resources []mcp.Resource
-	prompts   []mcp.Prompt
+	backgroundDone chan struct{}
+	stopBackground func()
 
-	toolsMap map[string]int // Map of tool names to mcpClients index.
-	logger   *slog.Logger
+	mcpClients         []*mcp.Client
+	traffic            *TrafficInspector
+	serverInstructions *ServerInstructions
+
+	// capsMu guards caps, which is replaced as a whole by RefreshCapabilities while the requests are served.
+	capsMu    sync.RWMutex
+	caps      capabilities
+	capsCache CapabilitiesCache
+
+	logger *slog.Logger
 }
 
+// MainOption configures the optional features of Main.
+type MainOption func(*Main)
+
 const (
 	chatsSSETopic = "chats"
 	errLoggerKey  = "err"
 )
 
 // NewMain creates a new Main instance with the provided LLM and Store implementations. It initializes
-// the SSE server with default configurations and parses the required HTML templates from the embedded
-// filesystem. The SSE server is configured to handle both default events and chat-specific topics.
+// the SSE server with default configurations and parses the required HTML templates from the filesystem
+// given by WithTemplateFS. The SSE server is configured to handle both default events and chat-specific
+// topics.
 func NewMain(
 	llm LLM,
 	titleGen TitleGenerator,
 	store Store,
 	mcpClients []*mcp.Client,
 	logger *slog.Logger,
-) (Main, error) {
-	// We parse templates from three distinct directories to separate layout, pages, and partial views
-	tmpl, err := template.ParseFS(
-		mcpwebui.TemplateFS,
-		"templates/layout/*.html",
-		"templates/pages/*.html",
-		"templates/partials/*.html",
-	)
+	options ...MainOption,
+) (*Main, error) {
+	m := &Main{
+		sseSrv:          &sse.Server{},
+		llm:             llm,
+		titleGenerator:  titleGen,
+		store:           store,
+		mcpClients:      mcpClients,
+		logger:          logger.With(slog.String("module", "main")),
+		comparisons:     &comparisons{items: make(map[string]*comparison)},
+		idempotencyKeys: &idempotencyKeys{items: make(map[string]time.Time)},
+		authFailures:    &authFailures{items: make(map[string]*authFailure)},
+		messageTopics:   &messageTopics{items: make(map[string]messageTopic)},
+		pastedImages:    &pastedImages{items: make(map[string]pastedImage)},
+		bridgeLocks:     &bridgeLocks{items: make(map[string]*bridgeLock)},
+
+		mountedResources: &mountedResources{items: make(map[string]mountedResource)},
+		evals:            &evals{},
+	}
+	m.sseSrv.OnSession = m.onSSESession
+	m.events.subscribers = []EventSubscriber{sseSubscriber{server: m.sseSrv}}
+	for _, opt := range options {
+		opt(m)
+	}
+	m.tokenCounter, _ = m.llm.(tokenCounter)
+	m.parameterValidator, _ = m.llm.(parameterValidator)
+	m.llmSetup, _ = m.llm.(setupChecker)
+	m.compareLLMSetup, _ = m.compareLLM.(setupChecker)
+	m.setupKeyRotation()
+	m.llm = wrapLLM(m.llm, m.llmMiddlewares)
+	m.compareLLM = wrapLLM(m.compareLLM, m.llmMiddlewares)
+	m.llm = m.budgetLLM(providerLLM, m.llm)
+	m.compareLLM = m.budgetLLM(providerCompareLLM, m.compareLLM)
+	if err := m.parseStoreTimeout(); err != nil {
+		return nil, err
+	}
+
+	if m.templateFS == nil {
+		return nil, fmt.Errorf("template filesystem is required")
+	}
+	var err error
+	if m.templates, err = newTemplateSet(m.templateFS, m.templateReload); err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %w", err)
+	}
+
+	if m.schedules, err = parseSchedules(m.scheduledPrompts); err != nil {
+		return nil, err
+	}
+	if err := m.parseMaintenance(); err != nil {
+		return nil, err
+	}
+	if err := m.parseBackup(); err != nil {
+		return nil, err
+	}
+	if err := m.parseToolResultGuard(); err != nil {
+		return nil, err
+	}
+	if err := m.parseCORS(); err != nil {
+		return nil, err
+	}
+	if err := m.parseAccess(); err != nil {
+		return nil, err
+	}
+	if err := m.parseSessions(); err != nil {
+		return nil, err
+	}
+	if err := m.parseLockout(); err != nil {
+		return nil, err
+	}
+	if err := m.parseTrustedProxies(); err != nil {
+		return nil, err
+	}
+	if err := m.parseBudgets(); err != nil {
+		return nil, err
+	}
+	if err := m.parseCapture(); err != nil {
+		return nil, err
+	}
+	if err := m.parseBridges(); err != nil {
+		return nil, err
+	}
+	if err := m.parseWelcome(); err != nil {
+		return nil, err
+	}
+	m.parseSSEKeepAlive()
+	m.parseToolFailureLimit()
+	m.parseToolCache()
+	if err := m.parseResponseLimit(); err != nil {
+		return nil, err
+	}
+	if err := m.parseToolOverrides(); err != nil {
+		return nil, err
+	}
+	m.parseBatches()
+	if err := m.parseTitleGeneration(); err != nil {
+		return nil, err
+	}
+	if err := m.parseChatListPageSize(); err != nil {
+		return nil, err
+	}
+	staleServers, err := m.parseCapabilities()
 	if err != nil {
-		return Main{}, err
-	}
-
-	servers := make([]mcp.Info, len(mcpClients))
-	tools := make([]mcp.Tool, 0, len(mcpClients))
-	resources := make([]mcp.Resource, 0, len(mcpClients))
-	prompts := make([]mcp.Prompt, 0, len(mcpClients))
-	tm := make(map[string]int)
-	for i := range mcpClients {
-		servers[i] = mcpClients[i].ServerInfo()
-		serverName := servers[i].Name
-
-		var ts []mcp.Tool
-		if mcpClients[i].ToolServerSupported() {
-			listTools, err := mcpClients[i].ListTools(context.Background(), mcp.ListToolsParams{})
-			if err != nil {
-				return Main{}, fmt.Errorf("failed to list tools from server %s: %w", serverName, err)
-			}
-			ts = listTools.Tools
-			for _, tool := range ts {
-				tm[tool.Name] = i
-			}
-		}
-
-		var rs []mcp.Resource
-		if mcpClients[i].ResourceServerSupported() {
-			listResources, err := mcpClients[i].ListResources(context.Background(), mcp.ListResourcesParams{})
-			if err != nil {
-				return Main{}, fmt.Errorf("failed to list resources from server %s: %w", serverName, err)
-			}
-			rs = listResources.Resources
-		}
-
-		var ps []mcp.Prompt
-		if mcpClients[i].PromptServerSupported() {
-			listPrompts, err := mcpClients[i].ListPrompts(context.Background(), mcp.ListPromptsParams{})
-			if err != nil {
-				return Main{}, fmt.Errorf("failed to list prompts from server %s: %w", serverName, err)
-			}
-			ps = listPrompts.Prompts
-		}
-
-		tools = append(tools, ts...)
-		resources = append(resources, rs...)
-		prompts = append(prompts, ps...)
-	}
-
-	return Main{
-		sseSrv: &sse.Server{
-			OnSession: func(s *sse.Session) (sse.Subscription, bool) {
-				// We start with default topics that all clients should subscribe to
-				topics := []string{sse.DefaultTopic, chatsSSETopic}
-
-				// We create a message-specific topic if the client requests updates for a particular message
-				messageID := s.Req.URL.Query().Get("message_id")
-				if messageID != "" {
-					topics = append(topics, messageIDTopic(messageID))
-				}
-
-				return sse.Subscription{
-					Client:      s,
-					LastEventID: s.LastEventID,
-					Topics:      topics,
-				}, true
-			},
-		},
-		templates:      tmpl,
-		llm:            llm,
-		titleGenerator: titleGen,
-		store:          store,
-		mcpClients:     mcpClients,
-		toolsMap:       tm,
-		logger:         logger.With(slog.String("module", "main")),
-		servers:        servers,
-		tools:          tools,
-		resources:      resources,
-		prompts:        prompts,
-	}, nil
+		return nil, err
+	}
+	backgroundDone := make(chan struct{})
+	m.backgroundDone = backgroundDone
+	m.stopBackground = sync.OnceFunc(func() { close(backgroundDone) })
+	if len(m.schedules) > 0 {
+		go m.runScheduler()
+	}
+	if m.retention.enabled() {
+		go m.runJanitor()
+	}
+	if m.maintenance.Cron != "" {
+		go m.runMaintenanceScheduler()
+	}
+	if m.backup.Destination != nil && m.backup.Cron != "" {
+		go m.runBackupScheduler()
+	}
+	if m.sseKeepAlive.Interval > 0 {
+		go m.runSSEKeepAlive()
+	}
+	for range m.batchRunner.Concurrency {
+		go m.runBatchWorker()
+	}
+	for range m.titleGeneration.Concurrency {
+		go m.runTitleWorker()
+	}
+	for _, b := range m.bridges {
+		go m.runBridge(b)
+	}
+	if len(staleServers) > 0 {
+		go m.revalidateCapabilities(staleServers)
+	}
+
+	return m, nil
+}
+
+// WithTemplateFS sets the filesystem the HTML templates are parsed from, which must contain the
+// templates/layout, templates/pages and templates/partials directories of this repository. It's required,
+// the templates embedded in the root package are the default of the public API.
+func WithTemplateFS(fsys fs.FS) MainOption {
+	return func(m *Main) {
+		m.templateFS = fsys
+	}
+}
+
+// WithTemplateReload makes Main parse the templates again on every render, so the changes of the
+// templates on disk are visible without restarting the server. It's meant for the development of the
+// templates, as the parsing is expensive.
+func WithTemplateReload() MainOption {
+	return func(m *Main) {
+		m.templateReload = true
+	}
+}
+
+// WithCompareLLM enables the compare mode, where a single user message is answered by both the main LLM
+// and the given llm, and the user picks which response continues the chat.
+func WithCompareLLM(llm LLM) MainOption {
+	return func(m *Main) {
+		m.compareLLM = llm
+	}
+}
+
+func (m *Main) renderPage(w io.Writer, name string, data any) error {
+	return m.templates.ExecutePage(w, name, data)
+}
+
+// WithNotifier sets the notifier that receives the chat events, such as chat creation and completion of
+// the assistant responses.
+func WithNotifier(notifier Notifier) MainOption {
+	return func(m *Main) {
+		m.notifier = notifier
+	}
+}
+
+func (m *Main) notify(ctx context.Context, event models.Event) {
+	if m.notifier == nil {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	m.notifier.Notify(ctx, event)
+}
+
+// renderError renders the error_alert template with the given status code. The HX-Retarget and HX-Reswap
+// headers direct htmx to show the alert in the page's alerts container, instead of the request's target.
+func (m *Main) renderError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("HX-Retarget", "#alerts")
+	w.Header().Set("HX-Reswap", "beforeend")
+	w.WriteHeader(status)
+	if err := m.templates.ExecuteTemplate(w, "error_alert", msg); err != nil {
+		m.logger.Error("Failed to execute error_alert template", slog.String(errLoggerKey, err.Error()))
+	}
 }
 
 func messageIDTopic(messageID string) string {
 	return fmt.Sprintf("message-%s", messageID)
 }
 
-// Shutdown gracefully terminates the Main instance's SSE server. It broadcasts a close message to all
-// connected clients and waits up to 5 seconds for connections to terminate. After the timeout, any
-// remaining connections are forcefully closed.
-func (m Main) Shutdown(ctx context.Context) error {
+// Shutdown stops the scheduler, the janitor, the maintenance, the SSE keep-alive and the batch workers,
+// and gracefully terminates the Main instance's SSE server. It broadcasts a close message to all connected
+// clients and waits up to 5 seconds for connections to terminate. After the timeout, any remaining
+// connections are forcefully closed.
+func (m *Main) Shutdown(ctx context.Context) error {
+	m.stopBackground()
+
 	e := &sse.Message{Type: sse.Type("closeChat")}
 	// We create a close event that complies with SSE spec requiring data
 	e.AppendData("bye")
@@ -1,19 +1,38 @@
 package handlers_test
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"iter"
 	"log/slog"
+	"maps"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/MegaGrindStone/go-mcp"
+	mcpwebui "github.com/MegaGrindStone/mcp-web-ui"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/handlers"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
 )
 
 type mockLLM struct {
@@ -21,17 +40,96 @@ type mockLLM struct {
 	err       error
 }
 
+// mockTokenCountingLLM counts 1000 tokens per message.
+type mockTokenCountingLLM struct {
+	mockLLM
+}
+
 type mockStore struct {
-	chats    []models.Chat
-	messages map[string][]models.Message
-	err      error
+	// mu guards the fields below, as the chats are generated in the background.
+	mu        sync.Mutex
+	chats     []models.Chat
+	messages  map[string][]models.Message
+	usages    []models.Usage
+	tokens    []models.APIToken
+	sessions  []models.Session
+	memories  []models.Memory
+	receipts  []models.ReadReceipt
+	audit     []models.AuditEntry
+	spends    []models.Spend
+	schedules []models.Schedule
+	servers   []models.MCPServerState
+	err       error
+}
+
+type mockExporter struct {
+	generations []models.Generation
+}
+
+// mockTitleGenerator records the number of titles generated at the same time.
+type mockTitleGenerator struct {
+	mu        sync.Mutex
+	calls     int
+	active    int
+	maxActive int
+	// languages are the languages of the titles by their message.
+	languages map[string]string
+	// err fails the generation of the titles, like a title generator that is down.
+	err error
+}
+
+type mockNotifier struct {
+	mu     sync.Mutex
+	events []models.Event
+}
+
+type mockMaintainerStore struct {
+	*mockStore
+	integrityErr error
+	compacted    bool
+}
+
+type mockSnapshotStore struct {
+	*mockStore
+	data string
+}
+
+// stalledStore is a store whose chats are never read, like a store on a stalled disk.
+type stalledStore struct {
+	*mockStore
+}
+
+// flakyStore is a store whose updates of the messages fail until failures updates failed.
+type flakyStore struct {
+	*mockStore
+	mu       sync.Mutex
+	failures int
+}
+
+// usageCountingStore counts the usages added, which a comparison adds once its user message is stored and
+// once each of its candidates is generated.
+type usageCountingStore struct {
+	*mockStore
+	added atomic.Int32
+}
+
+type mockBackupDestination struct {
+	files map[string][]byte
+}
+
+// mockBridge receives the messages sent to incoming, and sends its final replies to replies.
+type mockBridge struct {
+	incoming chan models.BridgeMessage
+	replies  chan models.BridgeReply
 }
 
+var templates = handlers.WithTemplateFS(mcpwebui.TemplateFS)
+
 func TestNewMain(t *testing.T) {
 	llm := &mockLLM{}
 	store := &mockStore{}
 
-	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default())
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
 	if err != nil {
 		t.Fatalf("NewMain() error = %v", err)
 	}
@@ -57,7 +155,7 @@ func TestHandleHome(t *testing.T) {
 		},
 	}
 
-	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default())
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -100,13 +198,200 @@ func TestHandleHome(t *testing.T) {
 	}
 }
 
+func TestWelcome(t *testing.T) {
+	llm := &mockLLM{}
+	store := &mockStore{messages: map[string][]models.Message{}}
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithWelcome(handlers.Welcome{
+			Message: "Ask about <the docs>.",
+			Suggestions: []handlers.WelcomeSuggestion{
+				{Prompt: `Explain "MCP" in one paragraph.`},
+				{Label: "Read my files", Prompt: "List my files.", Tools: []string{"list_files"}},
+			},
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	main.HandleHome(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "Hello there!") || !strings.Contains(body, "Ask about &lt;the docs&gt;.") {
+		t.Errorf("HandleHome() body doesn't contain the default title and the escaped message")
+	}
+	if !strings.Contains(body, `name="message" value="Explain &#34;MCP&#34; in one paragraph."`) {
+		t.Errorf("HandleHome() body doesn't contain the suggestion sending its prompt")
+	}
+	if strings.Contains(body, "Read my files") {
+		t.Errorf("HandleHome() body contains the suggestion of a tool that isn't connected")
+	}
+
+	if _, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates, handlers.WithWelcome(
+		handlers.Welcome{Suggestions: []handlers.WelcomeSuggestion{{Label: "Empty"}}})); err == nil {
+		t.Error("NewMain() with a suggestion without prompt should return an error")
+	}
+}
+
+func TestChatList(t *testing.T) {
+	store := &mockStore{messages: map[string][]models.Message{}}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		store.chats = append(store.chats, models.Chat{ID: id, Title: "Chat " + id})
+	}
+	var (
+		mu     sync.Mutex
+		events []handlers.UIEvent
+	)
+	subscriber := handlers.EventSubscriberFunc(func(_ context.Context, event handlers.UIEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+		return nil
+	})
+	llm := &mockLLM{responses: []string{"AI response"}}
+	main, err := handlers.NewMain(llm, &mockTitleGenerator{}, store, nil, slog.Default(), templates,
+		handlers.WithChatListPageSize(2), handlers.WithEventSubscriber(subscriber))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Shutdown(context.Background()) }()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", main.HandleHome)
+	mux.HandleFunc("/chats/list", main.HandleChatList)
+	mux.HandleFunc("/api/v1/chats", main.HandleAPIChats)
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+
+	tests := []struct {
+		name     string
+		url      string
+		wantIDs  []string
+		wantNext string
+	}{
+		{"first page", "/", []string{"a", "b"}, "/chats/list?after=b"},
+		{"pages down to the active chat", "/?chat_id=c", []string{"a", "b", "c", "d"}, "/chats/list?after=d&amp;chat_id=c"},
+		{"next page", "/chats/list?after=b", []string{"c", "d"}, "/chats/list?after=d"},
+		{"last page", "/chats/list?after=d", []string{"e"}, ""},
+		{"unknown chat", "/chats/list?after=z", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			body := w.Body.String()
+			var ids []string
+			for _, id := range []string{"a", "b", "c", "d", "e"} {
+				if strings.Contains(body, `data-chat-id="`+id+`"`) {
+					ids = append(ids, id)
+				}
+			}
+			if w.Code != http.StatusOK || !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("status = %d, chats = %v, want %d, %v", w.Code, ids, http.StatusOK, tt.wantIDs)
+			}
+			if gotMore := strings.Contains(body, "Load more chats"); gotMore != (tt.wantNext != "") ||
+				!strings.Contains(body, tt.wantNext) {
+				t.Errorf("body doesn't load the next page with %q", tt.wantNext)
+			}
+		})
+	}
+
+	// The new chats and their generated titles are published alone, rather than the chat list.
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/chats", strings.NewReader(`{}`)))
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	body := strings.NewReader(`{"text": "Hello"}`)
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost,
+		"/api/v1/chats/"+created.ID+"/messages", body))
+	published := func(eventType, want string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.ContainsFunc(events, func(event handlers.UIEvent) bool {
+			return event.Type == eventType && strings.Count(event.Data, "data-chat-id") == 1 &&
+				strings.Contains(event.Data, want)
+		})
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if published("chatUpdated", "Generated title") {
+			break
+		}
+	}
+	added, updated := published("chatAdded", created.ID), published("chatUpdated", "Generated title")
+	mu.Lock()
+	listed := slices.ContainsFunc(events, func(event handlers.UIEvent) bool { return event.Type == "chats" })
+	mu.Unlock()
+	if listed || !added || !updated {
+		t.Errorf("chat list published = %t, chat added = %t, title updated = %t, want the chat alone published",
+			listed, added, updated)
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{"1": {
+			{ID: "1", Role: models.RoleUser, Timestamp: time.Date(2024, 3, 10, 22, 30, 0, 0, time.UTC)},
+			{ID: "2", Role: models.RoleAssistant, Timestamp: time.Date(2024, 3, 10, 22, 31, 0, 0, time.UTC)},
+			{ID: "3", Role: models.RoleUser, Timestamp: time.Now().UTC()},
+		}},
+	}
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hint := func(timezone string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/settings/timezone",
+			strings.NewReader(url.Values{"timezone": {timezone}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		main.HandleTimezone(w, req)
+		return w
+	}
+	if w := hint("Mars/Olympus"); w.Code != http.StatusBadRequest {
+		t.Errorf("HandleTimezone() of an unknown timezone status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	w := hint("Europe/Paris")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("HandleTimezone() status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != "Europe/Paris" {
+		t.Fatalf("HandleTimezone() cookies = %v, want the timezone", cookies)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/?chat_id=1", nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	main.HandleHome(w, req)
+	body := w.Body.String()
+	// The messages are rendered an hour ahead of UTC, in the timezone of the user.
+	for _, want := range []string{
+		`datetime="2024-03-10T23:30:00+01:00"`,
+		">23:30</time>",
+		">23:31</time>",
+		"Sunday, 10 March 2024",
+		"Today",
+		">just now</time>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("HandleHome() body doesn't contain %q", want)
+		}
+	}
+	if n := strings.Count(body, `class="day-separator`); n != 2 {
+		t.Errorf("HandleHome() body has %d day separators, want 2", n)
+	}
+}
+
 func TestHandleChats(t *testing.T) {
 	llm := &mockLLM{responses: []string{"AI response"}}
 	store := &mockStore{
 		messages: map[string][]models.Message{},
 	}
 
-	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default())
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -161,66 +446,4916 @@ func TestHandleChats(t *testing.T) {
 	}
 }
 
-func (m mockLLM) Chat(_ context.Context, _ []models.Message, _ []mcp.Tool) iter.Seq2[models.Content, error] {
-	return func(yield func(models.Content, error) bool) {
-		if m.err != nil {
-			yield(models.Content{}, m.err)
-			return
-		}
-		for _, resp := range m.responses {
-			if !yield(models.Content{
-				Type: models.ContentTypeText,
-				Text: resp,
-			}, nil) {
-				return
+func TestHandleChatsIdempotency(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI response"}}
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		form       string
+		header     string
+		wantStatus int
+	}{
+		{
+			name:       "First request",
+			form:       "message=Hello&chat_id=1&idempotency_key=key-1",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Duplicate in form",
+			form:       "message=Hello&chat_id=1&idempotency_key=key-1",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "Duplicate in header",
+			form:       "message=Hello&chat_id=1",
+			header:     "key-1",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "New key",
+			form:       "message=Hello&chat_id=1",
+			header:     "key-2",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader(tt.form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.header != "" {
+				req.Header.Set("Idempotency-Key", tt.header)
+			}
+			w := httptest.NewRecorder()
+
+			main.HandleChats(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("HandleChats() status = %v, want %v", w.Code, tt.wantStatus)
 			}
+		})
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	userMessages := 0
+	for _, msg := range store.messages["1"] {
+		if msg.Role == models.RoleUser {
+			userMessages++
 		}
 	}
+	if userMessages != 2 {
+		t.Errorf("stored user messages = %d, want 2", userMessages)
+	}
 }
 
-func (m mockLLM) GenerateTitle(_ context.Context, _ string) (string, error) {
-	return "Test Chat", nil
-}
+func TestHandleChatsQuota(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI response"}}
+	store := &mockStore{
+		messages: map[string][]models.Message{},
+	}
 
-func (m *mockStore) Chats(_ context.Context) ([]models.Chat, error) {
-	if m.err != nil {
-		return nil, m.err
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-Forwarded-User"),
+		handlers.WithQuotas(handlers.Quotas{
+			Users: map[string]handlers.Quota{
+				"alice": {MessagesPerDay: 1},
+			},
+		}))
+	if err != nil {
+		t.Fatal(err)
 	}
-	return m.chats, nil
-}
 
-func (m *mockStore) AddChat(_ context.Context, chat models.Chat) (string, error) {
-	if m.err != nil {
-		return "", m.err
+	tests := []struct {
+		name       string
+		user       string
+		wantStatus int
+	}{
+		{
+			name:       "Within quota",
+			user:       "alice",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Quota exceeded",
+			user:       "alice",
+			wantStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:       "Unlimited user",
+			user:       "bob",
+			wantStatus: http.StatusOK,
+		},
 	}
-	m.chats = append(m.chats, chat)
-	return chat.ID, nil
-}
 
-func (m *mockStore) UpdateChat(_ context.Context, chat models.Chat) error {
-	idx := slices.IndexFunc(m.chats, func(c models.Chat) bool { return c.ID == chat.ID })
-	if idx == -1 {
-		return fmt.Errorf("chat not found")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/chat", strings.NewReader("message=Hello&chat_id=1"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-Forwarded-User", tt.user)
+			w := httptest.NewRecorder()
+
+			main.HandleChats(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("HandleChats() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
 	}
-	m.chats[idx] = chat
-	return m.err
 }
 
-func (m *mockStore) Messages(_ context.Context, chatID string) ([]models.Message, error) {
-	if m.err != nil {
-		return nil, m.err
+func TestHandleCompare(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI response"}}
+	store := &mockStore{
+		chats: []models.Chat{
+			{ID: "1", Title: "Test Chat"},
+		},
+		messages: map[string][]models.Message{},
 	}
-	return m.messages[chatID], nil
-}
 
-func (m *mockStore) AddMessage(_ context.Context, chatID string, msg models.Message) (string, error) {
-	if m.err != nil {
-		return "", m.err
+	withoutCompare, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCompare, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithCompareLLM(&mockLLM{responses: []string{"Other response"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		main       *handlers.Main
+		method     string
+		message    string
+		chatID     string
+		wantStatus int
+	}{
+		{
+			name:       "Invalid method",
+			main:       withCompare,
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "Compare not configured",
+			main:       withoutCompare,
+			method:     http.MethodPost,
+			message:    "Hello",
+			chatID:     "1",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Missing chat",
+			main:       withCompare,
+			method:     http.MethodPost,
+			message:    "Hello",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Existing chat",
+			main:       withCompare,
+			method:     http.MethodPost,
+			message:    "Hello",
+			chatID:     "1",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := strings.NewReader(
+				"message=" + tt.message + "&chat_id=" + tt.chatID,
+			)
+			req := httptest.NewRequest(tt.method, "/compare", form)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+
+			tt.main.HandleCompare(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("HandleCompare() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
 	}
-	m.messages[chatID] = append(m.messages[chatID], msg)
-	return msg.ID, nil
 }
 
-func (m *mockStore) UpdateMessage(_ context.Context, _ string, _ models.Message) error {
-	return m.err
+func TestHandleCompareChoice(t *testing.T) {
+	store := &usageCountingStore{mockStore: &mockStore{
+		chats: []models.Chat{
+			{ID: "1", Title: "Test Chat", UserID: "alice"},
+			{ID: "2", Title: "Collaborative Chat", UserID: "bob", Members: []string{"alice"}},
+		},
+		messages: map[string][]models.Message{},
+	}}
+	llm := &mockLLM{responses: []string{"AI response"}}
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithCompareLLM(&mockLLM{responses: []string{"Other response"}}),
+		handlers.WithUserHeader("X-User"), handlers.WithAccess(handlers.Access{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareIDRe := regexp.MustCompile(`id="compare-([^"]+)"`)
+	compareIn := func(chatID string) string {
+		t.Helper()
+		// The user message and both candidates of the comparison add a usage.
+		want := store.added.Load() + 3
+		req := httptest.NewRequest(http.MethodPost, "/compare", strings.NewReader("message=Hello&chat_id="+chatID))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-User", "alice")
+		w := httptest.NewRecorder()
+		main.HandleCompare(w, req)
+		match := compareIDRe.FindStringSubmatch(w.Body.String())
+		if w.Code != http.StatusOK || match == nil {
+			t.Fatalf("HandleCompare() status = %v, body = %q", w.Code, w.Body.String())
+		}
+		for deadline := time.Now().Add(5 * time.Second); store.added.Load() < want; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("the candidates of the comparison aren't generated")
+			}
+		}
+		return match[1]
+	}
+	compare := func() string {
+		t.Helper()
+		return compareIn("1")
+	}
+	chooseAs := func(user, compareID string, choice int) *httptest.ResponseRecorder {
+		form := fmt.Sprintf("compare_id=%s&choice=%d", compareID, choice)
+		req := httptest.NewRequest(http.MethodPost, "/compare/choose", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		main.HandleCompareChoice(w, req)
+		return w
+	}
+	choose := func(compareID string, choice int) *httptest.ResponseRecorder {
+		return chooseAs("alice", compareID, choice)
+	}
+
+	if w := choose("unknown", 0); w.Code != http.StatusNotFound {
+		t.Errorf("HandleCompareChoice() of an unknown comparison status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+	if w := choose(compare(), 2); w.Code != http.StatusBadRequest {
+		t.Errorf("HandleCompareChoice() of an invalid choice status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+
+	// The comparisons never picked are dropped once the chat moves on to a new comparison.
+	abandoned := compare()
+	picked := compare()
+	if w := choose(abandoned, 0); w.Code != http.StatusNotFound {
+		t.Errorf("HandleCompareChoice() of a comparison the chat moved on from status = %v, want %v", w.Code,
+			http.StatusNotFound)
+	}
+	w := choose(picked, 1)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Other response") {
+		t.Errorf("HandleCompareChoice() status = %v, body = %q, want the picked response", w.Code, w.Body.String())
+	}
+	if w := choose(picked, 0); w.Code != http.StatusNotFound {
+		t.Errorf("HandleCompareChoice() of a picked comparison status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+
+	// Only the user who started a comparison picks its candidate, while they still see its chat.
+	other := compare()
+	if w := chooseAs("bob", other, 0); w.Code != http.StatusNotFound {
+		t.Errorf("HandleCompareChoice() of the comparison of another user status = %v, want %v", w.Code,
+			http.StatusNotFound)
+	}
+	if w := choose(other, 0); w.Code != http.StatusOK {
+		t.Errorf("HandleCompareChoice() after another user status = %v, want %v", w.Code, http.StatusOK)
+	}
+	left := compareIn("2")
+	store.mu.Lock()
+	store.chats[1].Members = nil
+	store.mu.Unlock()
+	if w := choose(left, 0); w.Code != http.StatusNotFound {
+		t.Errorf("HandleCompareChoice() in a chat the user left status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if n := len(store.messages["2"]); n != 1 {
+		t.Errorf("messages of the chat the user left = %d, want only the user message", n)
+	}
+}
+
+func TestHandleSchedules(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI response"}}
+	store := &mockStore{
+		messages: map[string][]models.Message{},
+	}
+
+	_, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithSchedules([]handlers.ScheduledPrompt{
+			{Name: "Invalid", Cron: "0 25 * * *", Prompt: "Hello"},
+		}))
+	if err == nil {
+		t.Fatal("NewMain() expected error for invalid cron expression")
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithSchedules([]handlers.ScheduledPrompt{
+			{Name: "Morning briefing", Cron: "0 8 * * 1-5", Prompt: "Hello"},
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Shutdown(context.Background()) }()
+
+	req := httptest.NewRequest(http.MethodGet, "/schedules", nil)
+	w := httptest.NewRecorder()
+	main.HandleSchedules(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("HandleSchedules() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), "Morning briefing") {
+		t.Error("HandleSchedules() response doesn't contain the schedule")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/schedules/run", strings.NewReader("name=Unknown"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	main.HandleScheduleRun(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("HandleScheduleRun() status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestScheduleReview(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI response"}}
+	store := &mockStore{messages: map[string][]models.Message{}}
+	notifier := &mockNotifier{}
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithSchedules([]handlers.ScheduledPrompt{
+			{Name: "Briefing", Cron: "0 8 * * 1-5", Prompt: "Hello", Review: true},
+		}),
+		handlers.WithNotifier(notifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Shutdown(context.Background()) }()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/schedules", main.HandleSchedules)
+	mux.HandleFunc("/schedules/run", main.HandleScheduleRun)
+	mux.HandleFunc("/schedules/review", main.HandleScheduleReview)
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+
+	post := func(path, form string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	events := func(eventType models.EventType) []models.Event {
+		notifier.mu.Lock()
+		defer notifier.mu.Unlock()
+		var res []models.Event
+		for _, e := range notifier.events {
+			if e.Type == eventType {
+				res = append(res, e)
+			}
+		}
+		return res
+	}
+	listMessages := func(chatID string) string {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/chats/"+chatID+"/messages", nil))
+		return w.Body.String()
+	}
+
+	post("/schedules/run", "name=Briefing")
+	for deadline := time.Now().Add(5 * time.Second); len(events(models.EventScheduleCompleted)) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the scheduled prompt didn't complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	run := events(models.EventScheduleCompleted)[0]
+	if len(events(models.EventGenerationCompleted)) != 0 {
+		t.Error("the completion of the draft was notified before its review")
+	}
+	if body := listMessages(run.ChatID); strings.Contains(body, "AI response") {
+		t.Errorf("ListMessages() body = %s, want the draft hidden", body)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/schedules", nil))
+	if !strings.Contains(w.Body.String(), "AI response") || !strings.Contains(w.Body.String(), "Approve") {
+		t.Errorf("HandleSchedules() doesn't show the draft")
+	}
+
+	if w := post("/schedules/review", "action=approve&chat_id="+run.ChatID+"&message_id=unknown"); w.Code !=
+		http.StatusNotFound {
+		t.Errorf("review of an unknown draft status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+	w = post("/schedules/review", "action=approve&chat_id="+run.ChatID+"&message_id="+run.MessageID)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("approval status = %v, want %v", w.Code, http.StatusSeeOther)
+	}
+	if completed := events(models.EventGenerationCompleted); len(completed) != 1 ||
+		completed[0].Data["approvedBy"] != "default" {
+		t.Errorf("completion events after the approval = %+v, want the approved draft", completed)
+	}
+	if body := listMessages(run.ChatID); !strings.Contains(body, "AI response") {
+		t.Errorf("ListMessages() body = %s, want the approved draft", body)
+	}
+	if w := post("/schedules/review", "action=reject&chat_id="+run.ChatID+"&message_id="+run.MessageID); w.Code !=
+		http.StatusNotFound {
+		t.Errorf("review of an approved draft status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandleAPIMessages(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI ", "response"}}
+	store := &mockStore{
+		chats: []models.Chat{
+			{ID: "1", Title: "Test Chat"},
+		},
+		messages: map[string][]models.Message{},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+
+	tests := []struct {
+		name       string
+		chatID     string
+		body       string
+		wantStatus int
+		wantBody   []string
+	}{
+		{
+			name:       "Missing text",
+			chatID:     "1",
+			body:       `{}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Unknown chat",
+			chatID:     "2",
+			body:       `{"text":"Hello"}`,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Streamed response",
+			chatID:     "1",
+			body:       `{"text":"Hello"}`,
+			wantStatus: http.StatusOK,
+			wantBody: []string{
+				`{"chunk":{"type":"text","text":"AI "}}`,
+				`{"chunk":{"type":"text","text":"response"}}`,
+				`"contents":[{"type":"text","text":"AI response"}]`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/"+tt.chatID+"/messages",
+				strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("HandleAPIMessages() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("HandleAPIMessages() body = %s, want to contain %s", w.Body.String(), want)
+				}
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/chats/1/messages", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	var res struct {
+		Messages []struct {
+			Role string `json:"role"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Messages) != 2 || res.Messages[0].Role != "user" || res.Messages[1].Role != "assistant" {
+		t.Errorf("HandleAPIMessages() list = %+v, want the user and assistant messages", res.Messages)
+	}
+
+	since := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/chats/1/messages?since="+since, nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"role"`) {
+		t.Errorf("HandleAPIMessages() list since = %d %s, want no messages", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleAPICapture(t *testing.T) {
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><head><title>Page Title</title><script>var menu;</script></head><body>
+<nav>Menu</nav><article><h1>Heading</h1><p>Article   text.</p></article><footer>Footer</footer></body></html>`)
+	}))
+	defer page.Close()
+
+	llm := &mockLLM{responses: []string{"AI response"}}
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-User"), handlers.WithCapture(handlers.Capture{Client: page.Client()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture := func(body, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/capture", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+		w := httptest.NewRecorder()
+		main.HandleAPICapture(w, req)
+		return w
+	}
+	userText := func(chatID, messageID string) string {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		for _, msg := range store.messages[chatID] {
+			if msg.ID == messageID {
+				return msg.Contents[0].Text
+			}
+		}
+		return ""
+	}
+
+	if w := capture(`{"url":"`+page.URL+`"}`, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("HandleAPICapture() without user status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := capture(`{"url":"file:///etc/passwd"}`, "alice"); w.Code != http.StatusBadRequest {
+		t.Errorf("HandleAPICapture() with a file URL status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w := capture(`{"url":"`+page.URL+`"}`, "alice")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("HandleAPICapture() status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body.String())
+	}
+	var res struct {
+		ChatID    string `json:"chatId"`
+		MessageID string `json:"messageId"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	text := userText(res.ChatID, res.MessageID)
+	if !strings.Contains(text, "Summarize this page.") || !strings.Contains(text, "Heading\nArticle text.") {
+		t.Errorf("captured message = %q, want the summary request and the article", text)
+	}
+	if strings.Contains(text, "Menu") || strings.Contains(text, "Footer") || strings.Contains(text, "var menu") {
+		t.Errorf("captured message = %q, want the page without its navigation, footer and scripts", text)
+	}
+	store.mu.Lock()
+	if chat := store.chats[len(store.chats)-1]; chat.Title != "Page Title" || chat.UserID != "alice" {
+		t.Errorf("captured chat = %+v, want the title of the page and the user", chat)
+	}
+	store.mu.Unlock()
+
+	w = capture(`{"text":"Selected text","prompt":"Explain it","chatId":"1"}`, "alice")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("HandleAPICapture() with text status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body.String())
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if text := userText("1", res.MessageID); res.ChatID != "1" ||
+		!strings.HasPrefix(text, "Explain it") || !strings.Contains(text, "Selected text") {
+		t.Errorf("captured message of chat %s = %q, want the prompt and the selected text in chat 1", res.ChatID, text)
+	}
+}
+
+func TestSecure(t *testing.T) {
+	llm := &mockLLM{}
+	store := &mockStore{}
+
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := main.Secure(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name        string
+		method      string
+		cookie      string
+		header      string
+		contentType string
+		wantStatus  int
+	}{
+		{
+			name:       "Safe method",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Missing token",
+			method:     http.MethodPost,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Mismatched token",
+			method:     http.MethodPost,
+			cookie:     "token",
+			header:     "other",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Matching token",
+			method:     http.MethodPost,
+			cookie:     "token",
+			header:     "token",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:        "JSON request",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			wantStatus:  http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/chats", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "mcpwebui_csrf", Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set("X-CSRF-Token", tt.header)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Secure() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if w.Header().Get("X-Frame-Options") != "DENY" {
+				t.Errorf("Secure() X-Frame-Options = %q, want DENY", w.Header().Get("X-Frame-Options"))
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	llm := &mockLLM{}
+	main, err := handlers.NewMain(llm, llm, &mockStore{}, nil, slog.Default(), templates,
+		handlers.WithCORS(handlers.CORS{AllowedOrigins: []string{"https://app.example.com"}, MaxAge: time.Minute}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := main.CORS(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		origin     string
+		wantStatus int
+		wantOrigin string
+	}{
+		{"preflight", http.MethodOptions, "/api/v1/chats", "https://app.example.com", http.StatusNoContent,
+			"https://app.example.com"},
+		{"denied preflight", http.MethodOptions, "/api/v1/chats", "https://evil.example.com", http.StatusForbidden, ""},
+		{"request", http.MethodPost, "/api/v1/chats", "https://app.example.com", http.StatusOK, "https://app.example.com"},
+		{"sse", http.MethodGet, "/sse/chats", "https://app.example.com", http.StatusOK, "https://app.example.com"},
+		{"page", http.MethodGet, "/", "https://app.example.com", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.method == http.MethodOptions {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if tt.name == "preflight" && w.Header().Get("Access-Control-Max-Age") != "60" {
+				t.Errorf("Access-Control-Max-Age = %q, want 60", w.Header().Get("Access-Control-Max-Age"))
+			}
+		})
+	}
+
+	_, err = handlers.NewMain(llm, llm, &mockStore{}, nil, slog.Default(), templates,
+		handlers.WithCORS(handlers.CORS{AllowedOrigins: []string{"*"}, AllowCredentials: true}))
+	if err == nil {
+		t.Error("NewMain() with the credentials allowed for any origin succeeded, want an error")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	llm := &mockLLM{}
+	store := &mockStore{}
+
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := main.RequestID(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Header().Get("X-Request-ID") == "" {
+		t.Error("RequestID() didn't set the X-Request-ID header")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-ID", "proxy-id")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Header().Get("X-Request-ID"); got != "proxy-id" {
+		t.Errorf("RequestID() X-Request-ID = %q, want %q", got, "proxy-id")
+	}
+}
+
+func TestHandlePurge(t *testing.T) {
+	llm := &mockLLM{}
+	now := time.Now()
+	store := &mockStore{
+		chats: []models.Chat{{ID: "3-new"}, {ID: "2-recent"}, {ID: "1-old"}},
+		messages: map[string][]models.Message{
+			"3-new":    {{ID: "m3", Role: models.RoleUser, Timestamp: now}},
+			"2-recent": {{ID: "m2", Role: models.RoleUser, Timestamp: now.AddDate(0, 0, -1)}},
+			"1-old":    {{ID: "m1", Role: models.RoleUser, Timestamp: now.AddDate(0, 0, -40)}},
+		},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/admin/purge", nil)
+	w := httptest.NewRecorder()
+	main.HandlePurge(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("HandlePurge() without retention status = %v, want %v", w.Code, http.StatusConflict)
+	}
+
+	archiveDir := t.TempDir()
+	main, err = handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithRetention(handlers.Retention{RetainDays: 30, MaxChats: 1, ArchiveDir: archiveDir}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Shutdown(context.Background()) }()
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/purge", nil)
+	w = httptest.NewRecorder()
+	main.HandlePurge(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandlePurge() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	var res struct {
+		DeletedChats  int `json:"deletedChats"`
+		ArchivedChats int `json:"archivedChats"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.DeletedChats != 2 || res.ArchivedChats != 2 {
+		t.Errorf("HandlePurge() = %+v, want 2 deleted and 2 archived chats", res)
+	}
+	if len(store.chats) != 1 || store.chats[0].ID != "3-new" {
+		t.Errorf("HandlePurge() remaining chats = %v, want only 3-new", store.chats)
+	}
+	if _, err := os.Stat(filepath.Join(archiveDir, "1-old.json")); err != nil {
+		t.Errorf("HandlePurge() didn't archive the old chat: %v", err)
+	}
+}
+
+func TestHandleMaintenance(t *testing.T) {
+	llm := &mockLLM{}
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1"}},
+		messages: map[string][]models.Message{
+			"1":      {},
+			"orphan": {},
+		},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/admin/maintenance", nil)
+	w := httptest.NewRecorder()
+	main.HandleMaintenance(w, req)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("HandleMaintenance() without maintainer status = %v, want %v", w.Code, http.StatusNotImplemented)
+	}
+
+	_, err = handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithMaintenance(handlers.Maintenance{Cron: "0 3 * * *"}))
+	if err == nil {
+		t.Error("NewMain() expected error for maintenance of a store without maintainer")
+	}
+
+	tests := []struct {
+		name          string
+		integrityErr  error
+		wantOrphans   int
+		wantCompacted bool
+	}{
+		{
+			name:          "Healthy store",
+			wantOrphans:   1,
+			wantCompacted: true,
+		},
+		{
+			name:         "Corrupted store",
+			integrityErr: fmt.Errorf("page 3: unreachable unfreed"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := &mockMaintainerStore{
+				mockStore: &mockStore{
+					chats:    slices.Clone(store.chats),
+					messages: maps.Clone(store.messages),
+				},
+				integrityErr: tt.integrityErr,
+			}
+			main, err := handlers.NewMain(llm, llm, ms, nil, slog.Default(), templates,
+				handlers.WithMaintenance(handlers.Maintenance{Cron: "0 3 * * *"}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = main.Shutdown(context.Background()) }()
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/maintenance", nil)
+			w := httptest.NewRecorder()
+			main.HandleMaintenance(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("HandleMaintenance() status = %v, want %v", w.Code, http.StatusOK)
+			}
+
+			var res struct {
+				IntegrityError  string `json:"integrityError"`
+				OrphanedBuckets int    `json:"orphanedBuckets"`
+				Compacted       bool   `json:"compacted"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if (res.IntegrityError != "") != (tt.integrityErr != nil) {
+				t.Errorf("HandleMaintenance() integrityError = %q, want error %v", res.IntegrityError, tt.integrityErr)
+			}
+			if res.OrphanedBuckets != tt.wantOrphans {
+				t.Errorf("HandleMaintenance() orphanedBuckets = %d, want %d", res.OrphanedBuckets, tt.wantOrphans)
+			}
+			if res.Compacted != tt.wantCompacted || ms.compacted != tt.wantCompacted {
+				t.Errorf("HandleMaintenance() compacted = %v, want %v", res.Compacted, tt.wantCompacted)
+			}
+		})
+	}
+}
+
+func TestHandleBackup(t *testing.T) {
+	llm := &mockLLM{}
+	store := &mockSnapshotStore{mockStore: &mockStore{}, data: "snapshot"}
+	dest := &mockBackupDestination{files: map[string][]byte{
+		"mcpwebui-20240101T000000Z.db.gz": nil,
+		"mcpwebui-20240102T000000Z.db.gz": nil,
+		"notes.txt":                       nil,
+	}}
+
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/admin/backup", nil)
+	w := httptest.NewRecorder()
+	main.HandleBackup(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("HandleBackup() without backup status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+
+	_, err = handlers.NewMain(llm, llm, &mockStore{}, nil, slog.Default(), templates,
+		handlers.WithBackup(handlers.Backup{Destination: dest}))
+	if err == nil {
+		t.Error("NewMain() expected error for backup of a store without snapshots")
+	}
+	_, err = handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithBackup(handlers.Backup{Cron: "daily", Destination: dest}))
+	if err == nil {
+		t.Error("NewMain() expected error for invalid backup cron expression")
+	}
+
+	main, err = handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithBackup(handlers.Backup{Cron: "0 2 * * *", Destination: dest, Keep: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Shutdown(context.Background()) }()
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/backup", nil)
+	w = httptest.NewRecorder()
+	main.HandleBackup(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleBackup() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	var res struct {
+		Name    string   `json:"name"`
+		Size    int64    `json:"size"`
+		Deleted []string `json:"deleted"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^mcpwebui-\d{8}T\d{6}Z\.db\.gz$`).MatchString(res.Name) {
+		t.Errorf("HandleBackup() name = %q, want a timestamped backup name", res.Name)
+	}
+	if res.Size != int64(len(dest.files[res.Name])) {
+		t.Errorf("HandleBackup() size = %d, want %d", res.Size, len(dest.files[res.Name]))
+	}
+	if !slices.Equal(res.Deleted, []string{"mcpwebui-20240101T000000Z.db.gz"}) {
+		t.Errorf("HandleBackup() deleted = %v, want the oldest backup", res.Deleted)
+	}
+	if _, ok := dest.files["notes.txt"]; !ok {
+		t.Error("HandleBackup() deleted a file that isn't a backup")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(dest.files[res.Name]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != store.data {
+		t.Errorf("HandleBackup() backup content = %q, want %q", data, store.data)
+	}
+}
+
+func TestStoreTimeout(t *testing.T) {
+	store := stalledStore{mockStore: &mockStore{}}
+	main, err := handlers.NewMain(&mockLLM{}, &mockTitleGenerator{}, store, nil, slog.Default(), templates,
+		handlers.WithStoreTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Shutdown(context.Background()) }()
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	main.HandleAPIChats(w, httptest.NewRequest(http.MethodGet, "/api/v1/chats", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(w.Body.String(), context.DeadlineExceeded.Error()) {
+		t.Errorf("body = %q, want the deadline error", w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("request took %s, want it to fail after the store timeout", elapsed)
+	}
+
+	if _, err := handlers.NewMain(&mockLLM{}, &mockTitleGenerator{}, &mockStore{}, nil, slog.Default(), templates,
+		handlers.WithStoreTimeout(-time.Second)); err == nil {
+		t.Error("NewMain with a negative store timeout succeeded, want an error")
+	}
+}
+
+func TestMessageWriteRetries(t *testing.T) {
+	store := &flakyStore{
+		mockStore: &mockStore{chats: []models.Chat{{ID: "1"}}, messages: map[string][]models.Message{}},
+		failures:  3,
+	}
+	main, err := handlers.NewMain(&mockLLM{responses: []string{"AI response"}}, &mockTitleGenerator{}, store, nil,
+		slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Shutdown(context.Background()) }()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+
+	body := strings.NewReader(`{"text": "Hello"}`)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/chats/1/messages", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), `"error"`) {
+		t.Errorf("response = %s, want no error", w.Body.String())
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.failures != 0 {
+		t.Errorf("remaining failures = %d, want 0", store.failures)
+	}
+	store.mockStore.mu.Lock()
+	defer store.mockStore.mu.Unlock()
+	messages := store.messages["1"]
+	if len(messages) != 2 || len(messages[1].Contents) == 0 || messages[1].Contents[0].Text != "AI response" {
+		t.Errorf("messages = %+v, want the saved response", messages)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	llm := &mockLLM{}
+	store := &mockStore{}
+
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-User"), handlers.WithRequiredAPITokens())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/settings/tokens", strings.NewReader("name=backup-job"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-User", "alice")
+	w := httptest.NewRecorder()
+	main.HandleTokens(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleTokens() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	if len(store.tokens) != 1 || store.tokens[0].UserID != "alice" {
+		t.Fatalf("HandleTokens() stored tokens = %+v, want a token of alice", store.tokens)
+	}
+	token := regexp.MustCompile(`mwu_[A-Za-z0-9_-]+`).FindString(w.Body.String())
+	if token == "" || strings.Contains(store.tokens[0].Hash, token) {
+		t.Fatalf("HandleTokens() should show the new token once and store only its hash")
+	}
+
+	// The tokens page lists the tokens of the request's user, which is alice only if the token identified it.
+	handler := main.APIAuth(http.HandlerFunc(main.HandleTokens))
+
+	tests := []struct {
+		name       string
+		auth       string
+		wantStatus int
+	}{
+		{name: "Missing token", wantStatus: http.StatusUnauthorized},
+		{name: "Invalid token", auth: "Bearer mwu_invalid", wantStatus: http.StatusUnauthorized},
+		{name: "Valid token", auth: "Bearer " + token, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/chats", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("APIAuth() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), "backup-job") {
+				t.Error("APIAuth() didn't identify the request as the token's user")
+			}
+		})
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/settings/tokens/revoke",
+		strings.NewReader("id="+store.tokens[0].ID))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-User", "alice")
+	w = httptest.NewRecorder()
+	main.HandleTokenRevoke(w, req)
+	if slices.ContainsFunc(store.tokens, func(t models.APIToken) bool { return t.Name == "backup-job" }) {
+		t.Error("HandleTokenRevoke() didn't delete the token")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	store := &mockStore{}
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithLockout(handlers.Lockout{MaxFailures: 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := main.APIAuth(http.HandlerFunc(main.HandleAPIChats))
+
+	serveFrom := func(remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/chats", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Bearer mwu_invalid")
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	serve := func(ip string) *httptest.ResponseRecorder {
+		return serveFrom(ip+":1234", "")
+	}
+
+	for range 3 {
+		if w := serve("203.0.113.7"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %v, want %v", w.Code, http.StatusUnauthorized)
+		}
+	}
+	w := serve("203.0.113.7")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("status of the locked out client = %v, want %v with Retry-After", w.Code,
+			http.StatusTooManyRequests)
+	}
+	if w := serve("203.0.113.8"); w.Code != http.StatusUnauthorized {
+		t.Errorf("status of another client = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+
+	var actions []models.AuditAction
+	for _, entry := range store.audit {
+		if entry.IP == "203.0.113.7" {
+			actions = append(actions, entry.Action)
+		}
+	}
+	want := []models.AuditAction{
+		models.AuditActionAuthFailure, models.AuditActionAuthFailure, models.AuditActionAuthFailure,
+		models.AuditActionAuthLockout,
+	}
+	if !slices.Equal(actions, want) {
+		t.Errorf("audit actions = %v, want %v", actions, want)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/auth", nil)
+	w = httptest.NewRecorder()
+	main.HandleAuthLog(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "203.0.113.7") || !strings.Contains(body, "auth.lockout") {
+		t.Errorf("authentication page doesn't show the lockout: %s", body)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/auth/unlock", strings.NewReader("ip=203.0.113.7"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	main.HandleAuthUnlock(httptest.NewRecorder(), req)
+	if w := serve("203.0.113.7"); w.Code != http.StatusUnauthorized {
+		t.Errorf("status after the unlock = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+
+	// The X-Forwarded-For header of a client that isn't a trusted proxy is ignored: changing it doesn't
+	// escape the lockout, and sending the address of another client doesn't lock it out.
+	for i := range 3 {
+		serveFrom("198.51.100.9:1234", fmt.Sprintf("192.0.2.%d", i))
+	}
+	if w := serveFrom("198.51.100.9:1234", "192.0.2.99"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("status of the client spoofing X-Forwarded-For = %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+	for range 3 {
+		serveFrom("198.51.100.10:1234", "203.0.113.8")
+	}
+	if w := serve("203.0.113.8"); w.Code != http.StatusUnauthorized {
+		t.Errorf("status of the client whose address is spoofed = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestLockoutTrackedClients(t *testing.T) {
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, &mockStore{}, nil, slog.Default(), templates,
+		handlers.WithLockout(handlers.Lockout{MaxFailures: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := main.APIAuth(http.HandlerFunc(main.HandleAPIChats))
+	serve := func(i int) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/chats", nil)
+		req.RemoteAddr = fmt.Sprintf("10.%d.%d.%d:1234", i>>16&0xff, i>>8&0xff, i&0xff)
+		req.Header.Set("Authorization", "Bearer mwu_invalid")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The locked out client is kept, while the first failure of the least recently failing client is
+	// forgotten once the failures of 10,000 clients are tracked.
+	serve(0)
+	serve(0)
+	for i := 1; i <= 10000; i++ {
+		serve(i)
+	}
+	if code := serve(0); code != http.StatusTooManyRequests {
+		t.Errorf("status of the locked out client = %v, want %v", code, http.StatusTooManyRequests)
+	}
+	serve(1)
+	if code := serve(1); code != http.StatusUnauthorized {
+		t.Errorf("status of the forgotten client = %v, want %v", code, http.StatusUnauthorized)
+	}
+	if code := serve(10000); code != http.StatusUnauthorized {
+		t.Errorf("status of the client failing the second time = %v, want %v", code, http.StatusUnauthorized)
+	}
+	if code := serve(10000); code != http.StatusTooManyRequests {
+		t.Errorf("status of the client locked out = %v, want %v", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	if _, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, &mockStore{}, nil, slog.Default(), templates,
+		handlers.WithTrustedProxies([]string{"10.0.0.0/33"})); err == nil {
+		t.Error("NewMain() expected error for an invalid trusted proxy range")
+	}
+
+	store := &mockStore{}
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithLockout(handlers.Lockout{MaxFailures: 2}),
+		handlers.WithTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := main.APIAuth(http.HandlerFunc(main.HandleAPIChats))
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		want         string
+	}{
+		{"direct client", "198.51.100.1:1234", "203.0.113.1", "198.51.100.1"},
+		{"trusted proxy", "10.1.2.3:1234", "203.0.113.2", "203.0.113.2"},
+		{"chain of trusted proxies", "10.1.2.3:1234", "203.0.113.3, 192.0.2.1", "203.0.113.3"},
+		{"address spoofed before the proxy", "10.1.2.3:1234", "203.0.113.99, 203.0.113.4", "203.0.113.4"},
+		{"trusted proxy without header", "10.1.2.3:1234", "", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/chats", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("Authorization", "Bearer mwu_invalid")
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			store.mu.Lock()
+			got := store.audit[len(store.audit)-1].IP
+			store.mu.Unlock()
+			if got != tt.want {
+				t.Errorf("client IP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// mockKeyedLLM accepts the API keys starting with "valid" in its setup check.
+type mockKeyedLLM struct {
+	mockLLM
+	apiKey string
+}
+
+func (m mockKeyedLLM) CheckSetup(_ context.Context) error {
+	if !strings.HasPrefix(m.apiKey, "valid") {
+		return &models.SetupError{Problem: "The API key is rejected"}
+	}
+	return nil
+}
+
+func TestKeyRotation(t *testing.T) {
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	llm := mockKeyedLLM{mockLLM: mockLLM{responses: []string{"Old key"}}, apiKey: "valid-old"}
+	rotation := handlers.KeyRotation{LLM: func(apiKey string) (handlers.LLM, error) {
+		return mockKeyedLLM{mockLLM: mockLLM{responses: []string{"New key"}}, apiKey: apiKey}, nil
+	}}
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithKeyRotation(rotation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+	mux.HandleFunc("/admin/keys", main.HandleKeys)
+
+	rotate := func(provider, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/keys",
+			strings.NewReader("provider="+provider+"&api_key="+apiKey))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	chat := func() string {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/1/messages", strings.NewReader(`{"text":"Hello"}`))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	if w := rotate("llm", "invalid"); w.Code != http.StatusUnprocessableEntity ||
+		!strings.Contains(w.Body.String(), "The API key is rejected") {
+		t.Errorf("rotation with a rejected key status = %v, want %v with the error", w.Code,
+			http.StatusUnprocessableEntity)
+	}
+	if body := chat(); !strings.Contains(body, "Old key") {
+		t.Errorf("response after the rejected rotation = %s, want the previous provider", body)
+	}
+	if w := rotate("titleGenerator", "valid-new"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("rotation of a provider without rotation status = %v, want %v", w.Code,
+			http.StatusUnprocessableEntity)
+	}
+
+	if w := rotate("llm", "valid-new"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "was rotated") {
+		t.Fatalf("rotation status = %v, want %v with the confirmation", w.Code, http.StatusOK)
+	}
+	if body := chat(); !strings.Contains(body, "New key") {
+		t.Errorf("response after the rotation = %s, want the new provider", body)
+	}
+	if len(store.audit) != 1 || store.audit[0].Action != models.AuditActionKeyRotation {
+		t.Errorf("audit entries = %+v, want the rotation", store.audit)
+	}
+}
+
+func TestBudgets(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI response"}}
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	notifier := &mockNotifier{}
+	// Every token costs 1, so the first response exhausts the daily budget.
+	budgets := map[string]handlers.Budget{
+		"llm": {InputPerMillionTokens: 1e6, OutputPerMillionTokens: 1e6, Daily: 1, HardStop: true},
+	}
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithBudgets(budgets), handlers.WithNotifier(notifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", main.HandleHome)
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+
+	chat := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/1/messages", strings.NewReader(`{"text":"Hello"}`))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := chat(); w.Code != http.StatusOK {
+		t.Fatalf("first message status = %v, want %v", w.Code, http.StatusOK)
+	}
+	if len(store.spends) != 1 || store.spends[0].Provider != "llm" || store.spends[0].Cost <= 1 {
+		t.Errorf("spends = %+v, want the spend of the response", store.spends)
+	}
+	var thresholds []float64
+	for _, event := range notifier.events {
+		if event.Type == models.EventBudgetThreshold {
+			thresholds = append(thresholds, event.Data["threshold"].(float64))
+		}
+	}
+	if want := []float64{0.8, 1}; !slices.Equal(thresholds, want) {
+		t.Errorf("notified thresholds = %v, want %v", thresholds, want)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(w.Body.String(), "The daily budget of the LLM is") {
+		t.Errorf("home page doesn't show the budget banner")
+	}
+
+	if w := chat(); w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "exhausted") {
+		t.Errorf("message after the exhausted budget status = %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+	if len(store.spends) != 1 {
+		t.Errorf("spends after the refused message = %d, want 1", len(store.spends))
+	}
+}
+
+func TestTitleGeneration(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI response"}}
+	store := &mockStore{
+		chats: []models.Chat{
+			{ID: "1"}, {ID: "2"}, {ID: "3"}, {ID: "4"},
+			{ID: "5", Title: "Explicit title"},
+		},
+		messages: map[string][]models.Message{},
+	}
+	titleGen := &mockTitleGenerator{}
+	main, err := handlers.NewMain(llm, titleGen, store, nil, slog.Default(), templates,
+		handlers.WithTitleGeneration(handlers.TitleGeneration{Concurrency: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Shutdown(context.Background()) }()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+
+	for _, chatID := range []string{"1", "2", "3", "4", "5"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/"+chatID+"/messages",
+			strings.NewReader(`{"text":"Hello"}`))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	titled := func() int {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		n := 0
+		for _, c := range store.chats {
+			if c.Title == "Generated title" {
+				n++
+			}
+		}
+		return n
+	}
+	for deadline := time.Now().Add(5 * time.Second); titled() < 4; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("chats with a generated title = %d, want 4", titled())
+		}
+	}
+	titleGen.mu.Lock()
+	defer titleGen.mu.Unlock()
+	if titleGen.calls != 4 || titleGen.maxActive != 1 {
+		t.Errorf("GenerateTitle() called %d times, %d at the same time, want 4 times, 1 at a time",
+			titleGen.calls, titleGen.maxActive)
+	}
+	if chats, _ := store.Chats(context.Background()); chats[4].Title != "Explicit title" {
+		t.Errorf("title of the chat created with a title = %q, want it kept", chats[4].Title)
+	}
+}
+
+func TestTitleLanguage(t *testing.T) {
+	messages := map[string]string{
+		"Comment est-ce que je peux lire un fichier avec Go ?": "French",
+		"¿Cómo puedo leer un archivo en Go?":                   "Spanish",
+		"Wie kann ich eine Datei mit Go lesen?":                "German",
+		"What is the best way to read a file in Go?":           "English",
+		"Goでファイルを読むにはどうすればいいですか？":                              "Japanese",
+		"如何用Go读取文件？":                                           "Chinese",
+		"Как прочитать файл в Go?":                             "Russian",
+		"Hi": "",
+		"Fix this please\n```go\nfunc main() {\n\tfmt.Println(\"le la les\")\n}\n```": "English",
+	}
+	for _, forced := range []string{"", "Italian"} {
+		store := &mockStore{messages: map[string][]models.Message{}}
+		titleGen := &mockTitleGenerator{}
+		main, err := handlers.NewMain(&mockLLM{responses: []string{"AI response"}}, titleGen, store, nil,
+			slog.Default(), templates, handlers.WithTitleGeneration(handlers.TitleGeneration{Language: forced}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+		i := 0
+		for message := range messages {
+			i++
+			chatID := fmt.Sprint(i)
+			store.mu.Lock()
+			store.chats = append(store.chats, models.Chat{ID: chatID})
+			store.mu.Unlock()
+			body, _ := json.Marshal(map[string]string{"text": message})
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/"+chatID+"/messages", bytes.NewReader(body))
+			mux.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		generated := func() int {
+			titleGen.mu.Lock()
+			defer titleGen.mu.Unlock()
+			return titleGen.calls
+		}
+		for deadline := time.Now().Add(5 * time.Second); generated() < len(messages); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("generated titles = %d, want %d", generated(), len(messages))
+			}
+		}
+		_ = main.Shutdown(context.Background())
+
+		titleGen.mu.Lock()
+		for message, want := range messages {
+			if forced != "" {
+				want = forced
+			}
+			if got, ok := titleGen.languages[message]; !ok || got != want {
+				t.Errorf("GenerateTitle(%q) language = %q, want %q", message, got, want)
+			}
+		}
+		titleGen.mu.Unlock()
+	}
+}
+
+func TestTitleHeuristic(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{message: "How do I read a file in Go, line by line?", want: "How do I read a…"},
+		{message: "## Explain goroutines.", want: "Explain goroutines"},
+		{message: "```go\nfunc main() {}\n```", want: ""},
+	}
+	store := &mockStore{messages: map[string][]models.Message{}}
+	titleGen := &mockTitleGenerator{}
+	main, err := handlers.NewMain(&mockLLM{responses: []string{"AI response"}}, titleGen, store, nil,
+		slog.Default(), templates, handlers.WithTitleGeneration(handlers.TitleGeneration{
+			Heuristic:      true,
+			HeuristicWords: 5,
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Shutdown(context.Background()) }()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+	titles := func() map[string]string {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		titles := make(map[string]string)
+		for _, c := range store.chats {
+			titles[c.ID] = c.Title
+		}
+		return titles
+	}
+
+	for i, tt := range tests {
+		chatID := fmt.Sprint(i)
+		store.mu.Lock()
+		store.chats = append(store.chats, models.Chat{ID: chatID})
+		store.mu.Unlock()
+		body, _ := json.Marshal(map[string]string{"text": tt.message})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/"+chatID+"/messages", bytes.NewReader(body))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for tt.want != "" && titles()[chatID] != tt.want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := titles()[chatID]; got != tt.want {
+			t.Errorf("title of %q = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+
+	titleGen.mu.Lock()
+	defer titleGen.mu.Unlock()
+	if titleGen.calls != 0 {
+		t.Errorf("title generator calls = %d, want 0", titleGen.calls)
+	}
+}
+
+func TestTitleFallback(t *testing.T) {
+	store := &mockStore{chats: []models.Chat{{ID: "1"}}, messages: map[string][]models.Message{}}
+	titleGen := &mockTitleGenerator{err: errors.New("title generator is down")}
+	main, err := handlers.NewMain(&mockLLM{responses: []string{"AI response"}}, titleGen, store, nil,
+		slog.Default(), templates, handlers.WithTitleGeneration(handlers.TitleGeneration{RetryBackoff: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Shutdown(context.Background()) }()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", main.HandleHome)
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+	waitTitle := func(want string, fallback bool) {
+		t.Helper()
+		var got models.Chat
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			store.mu.Lock()
+			got = store.chats[0]
+			store.mu.Unlock()
+			if got.Title == want && got.TitleFallback == fallback {
+				return
+			}
+		}
+		t.Fatalf("title = %q, fallback = %t, want %q, %t", got.Title, got.TitleFallback, want, fallback)
+	}
+
+	body := strings.NewReader(`{"text": "Summarize the quarterly sales report for the board"}`)
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/chats/1/messages", body))
+	waitTitle("Summarize the quarterly sales report for…", true)
+
+	titleGen.mu.Lock()
+	titleGen.err = nil
+	titleGen.mu.Unlock()
+	// The chat is opened until its title is generated again, as the failed generation may still be finishing,
+	// which leaves the chat queued for a moment after its fallback title is written.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?chat_id=1", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		store.mu.Lock()
+		generated := store.chats[0].Title == "Generated title"
+		store.mu.Unlock()
+		if generated || time.Now().After(deadline) {
+			break
+		}
+	}
+	waitTitle("Generated title", false)
+
+	// A generated title isn't generated again.
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?chat_id=1", nil))
+	time.Sleep(50 * time.Millisecond)
+	titleGen.mu.Lock()
+	defer titleGen.mu.Unlock()
+	if titleGen.calls != 2 {
+		t.Errorf("title generator calls = %d, want 2", titleGen.calls)
+	}
+}
+
+func TestTitleRetry(t *testing.T) {
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Summarize the report", TitleFallback: true, UserID: "alice",
+			Members: []string{"bob"}}},
+		messages: map[string][]models.Message{"1": {{
+			ID:       "m1",
+			Role:     models.RoleUser,
+			Contents: []models.Content{{Type: models.ContentTypeText, Text: "Summarize the report"}},
+		}}},
+	}
+	titleGen := &mockTitleGenerator{err: errors.New("title generator is down")}
+	main, err := handlers.NewMain(&mockLLM{}, titleGen, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-User"), handlers.WithTitleGeneration(handlers.TitleGeneration{RetryBackoff: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Shutdown(context.Background()) }()
+	view := func(userID string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/?chat_id=1", nil)
+		req.Header.Set("X-User", userID)
+		w := httptest.NewRecorder()
+		main.HandleHome(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status of the view of %s = %d, want %d", userID, w.Code, http.StatusOK)
+		}
+	}
+	calls := func() int {
+		titleGen.mu.Lock()
+		defer titleGen.mu.Unlock()
+		return titleGen.calls
+	}
+
+	// The views of a member don't retry the title of the chat.
+	view("bob")
+	time.Sleep(50 * time.Millisecond)
+	if got := calls(); got != 0 {
+		t.Errorf("title generator calls after the view of a member = %d, want 0", got)
+	}
+
+	view("alice")
+	for deadline := time.Now().Add(5 * time.Second); calls() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the view of the owner doesn't retry the title")
+		}
+	}
+	// The failed retry waits for its backoff, however many times the chat is opened.
+	time.Sleep(50 * time.Millisecond)
+	for range 3 {
+		view("alice")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := calls(); got != 1 {
+		t.Errorf("title generator calls during the backoff = %d, want 1", got)
+	}
+}
+
+func TestNewChatOptions(t *testing.T) {
+	var systemPrompt string
+	llm := handlers.LLMFunc(func(
+		ctx context.Context, _ []models.Message, _ []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		systemPrompt = models.SystemPrompt(ctx, "Configured prompt")
+		return mockLLM{responses: []string{"AI response"}}.Chat(ctx, nil, nil)
+	})
+	store := &mockStore{messages: map[string][]models.Message{}}
+	titleGen := &mockTitleGenerator{}
+	main, err := handlers.NewMain(llm, titleGen, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chats", main.HandleChats)
+	mux.HandleFunc("/api/v1/chats", main.HandleAPIChats)
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/chats", strings.NewReader(
+		`{"title":"Release notes","tags":["docs"," release ","docs",""],"systemPrompt":"Answer in French."}`))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var created struct {
+		ID           string   `json:"id"`
+		Title        string   `json:"title"`
+		Tags         []string `json:"tags"`
+		SystemPrompt string   `json:"systemPrompt"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusCreated || created.Title != "Release notes" ||
+		!slices.Equal(created.Tags, []string{"docs", "release"}) || created.SystemPrompt != "Answer in French." {
+		t.Fatalf("CreateChat() status = %v, chat = %+v, want the chat with its options", w.Code, created)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/chats/"+created.ID+"/messages",
+		strings.NewReader(`{"text":"Hello"}`))
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	if systemPrompt != "Answer in French." {
+		t.Errorf("system prompt = %q, want the override of the chat", systemPrompt)
+	}
+
+	form := strings.NewReader("message=Hello&title=From+the+form&tags=a,+b&system_prompt=Be+brief.")
+	req = httptest.NewRequest(http.MethodPost, "/chats", form)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	store.mu.Lock()
+	chats := slices.Clone(store.chats)
+	store.mu.Unlock()
+	if len(chats) != 2 || chats[1].Title != "From the form" || !slices.Equal(chats[1].Tags, []string{"a", "b"}) ||
+		chats[1].SystemPrompt != "Be brief." {
+		t.Errorf("chats = %+v, want the chat of the form with its options", chats)
+	}
+	titleGen.mu.Lock()
+	defer titleGen.mu.Unlock()
+	if titleGen.calls != 0 {
+		t.Errorf("GenerateTitle() called %d times, want 0 for the chats created with a title", titleGen.calls)
+	}
+}
+
+func TestRichPaste(t *testing.T) {
+	store := &mockStore{messages: map[string][]models.Message{}}
+	main, err := handlers.NewMain(&mockLLM{responses: []string{"AI response"}}, &mockTitleGenerator{}, store, nil,
+		slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(data []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("image", "pasted.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fw.Write(data)
+		_ = mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/attachments/images", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		main.HandleImageUpload(w, req)
+		return w
+	}
+	send := func(imageID string) *httptest.ResponseRecorder {
+		form := url.Values{"message": {"What is this?"}, "image": {imageID}}
+		req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		main.HandleChats(w, req)
+		return w
+	}
+
+	if w := upload([]byte("just some text")); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("HandleImageUpload() status = %v, want %v for a text file", w.Code, http.StatusUnsupportedMediaType)
+	}
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+	w := upload(png)
+	match := regexp.MustCompile(`name="image" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if w.Code != http.StatusOK || match == nil || !strings.Contains(w.Body.String(), "data:image/png;base64,") {
+		t.Fatalf("HandleImageUpload() status = %v, body = %s, want the image attachment", w.Code, w.Body.String())
+	}
+
+	if w := send(match[1]); w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	store.mu.Lock()
+	var userMsg models.Message
+	for _, msgs := range store.messages {
+		userMsg = msgs[0]
+	}
+	store.mu.Unlock()
+	if len(userMsg.Contents) != 2 || userMsg.Contents[1].Type != models.ContentTypeImage ||
+		userMsg.Contents[1].MediaType != "image/png" || !bytes.Equal(userMsg.Contents[1].Data, png) {
+		t.Errorf("user message contents = %+v, want the text and the pasted image", userMsg.Contents)
+	}
+	if w := send(match[1]); w.Code != http.StatusBadRequest {
+		t.Errorf("HandleChats() status = %v, want %v for an image already sent", w.Code, http.StatusBadRequest)
+	}
+
+	for _, tt := range []struct {
+		name string
+		code string
+		want string
+	}{
+		{
+			name: "Go code",
+			code: "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(1)\n}\n",
+			want: "```go\npackage main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(1)\n}\n```\n",
+		},
+		{
+			name: "JSON",
+			code: "{\n  \"a\": 1,\n  \"b\": 2,\n  \"c\": 3\n}",
+			want: "```json\n{\n  \"a\": 1,\n  \"b\": 2,\n  \"c\": 3\n}\n```\n",
+		},
+		{name: "short code", code: "x := 1", want: "x := 1"},
+		{name: "prose", code: "one\ntwo\nthree\nfour\nfive", want: "one\ntwo\nthree\nfour\nfive"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"code": {tt.code}}
+			req := httptest.NewRequest(http.MethodPost, "/attachments/code", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			main.HandleCodePaste(w, req)
+			if w.Body.String() != tt.want {
+				t.Errorf("HandleCodePaste() = %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestToolCallDelta(t *testing.T) {
+	llm := handlers.LLMFunc(func(context.Context, []models.Message, []mcp.Tool) iter.Seq2[models.Content, error] {
+		return func(yield func(models.Content, error) bool) {
+			for _, input := range []string{`{"query": "wea`, `{"query": "weather in Paris"`} {
+				delta := models.Content{Type: models.ContentTypeCallToolDelta, ToolName: "search", ToolInput: []byte(input)}
+				if !yield(delta, nil) {
+					return
+				}
+			}
+			yield(models.Content{Type: models.ContentTypeText, Text: "Done"}, nil)
+		}
+	})
+	var (
+		mu  sync.Mutex
+		out int
+	)
+	counted := handlers.TokenCountingMiddleware(func(_ context.Context, _, outputTokens int) {
+		mu.Lock()
+		defer mu.Unlock()
+		out = outputTokens
+	})(llm)
+	store := &mockStore{messages: map[string][]models.Message{}}
+	main, err := handlers.NewMain(counted, &mockTitleGenerator{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chat has a title, so its title isn't generated along the response.
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Weather?&title=Weather"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	main.HandleChats(httptest.NewRecorder(), req)
+
+	var aiMsg models.Message
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		store.mu.Lock()
+		for _, msgs := range store.messages {
+			aiMsg = msgs[len(msgs)-1]
+		}
+		store.mu.Unlock()
+		mu.Lock()
+		done := aiMsg.Stats != nil && out != 0
+		mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("AI message = %+v, want the generation completed", aiMsg)
+		}
+	}
+	for _, ct := range aiMsg.Contents {
+		if ct.Type == models.ContentTypeCallToolDelta {
+			t.Errorf("AI message contents = %+v, want the partial tool inputs not saved", aiMsg.Contents)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if out != 1 {
+		t.Errorf("counted %d output tokens, want 1 for the text only", out)
+	}
+}
+
+func TestDebugMode(t *testing.T) {
+	llm := handlers.LLMFunc(func(ctx context.Context, _ []models.Message, _ []mcp.Tool) iter.Seq2[models.Content, error] {
+		return func(yield func(models.Content, error) bool) {
+			models.RecordRequest(ctx, []byte(`{"model":"test","system":"Be brief.","messages":[{"role":"user"}]}`))
+			yield(models.Content{Type: models.ContentTypeText, Text: "Hi"}, nil)
+		}
+	})
+
+	for _, debug := range []bool{false, true} {
+		store := &mockStore{
+			chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+			messages: map[string][]models.Message{},
+		}
+		opts := []handlers.MainOption{templates}
+		if debug {
+			opts = append(opts, handlers.WithDebugMode())
+		}
+		main, err := handlers.NewMain(llm, &mockTitleGenerator{}, store, nil, slog.Default(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+		mux.HandleFunc("/chats/context", main.HandleMessageContext)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/1/messages", strings.NewReader(`{"text":"Hello"}`))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+
+		store.mu.Lock()
+		aiMsg := store.messages["1"][len(store.messages["1"])-1]
+		store.mu.Unlock()
+		if !debug {
+			if len(aiMsg.Requests) != 0 {
+				t.Errorf("requests = %s, want none without the debug mode", aiMsg.Requests)
+			}
+			continue
+		}
+		if len(aiMsg.Requests) != 1 {
+			t.Fatalf("requests = %s, want the request of the turn", aiMsg.Requests)
+		}
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/chats/context?chat_id=1&message_id="+aiMsg.ID, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("context status = %d, want %d", w.Code, http.StatusOK)
+		}
+		for _, want := range []string{"Be brief.", "&#34;role&#34;: &#34;user&#34;", "&#34;model&#34;: &#34;test&#34;"} {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("context = %s, want %q", w.Body.String(), want)
+			}
+		}
+
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/chats/context?chat_id=1&message_id=unknown", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("unknown message status = %d, want %d", w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestTurnReplay(t *testing.T) {
+	isToolResult := func(c models.Content) bool { return c.Type == models.ContentTypeToolResult }
+	llm := handlers.LLMFunc(func(
+		ctx context.Context, msgs []models.Message, _ []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		return func(yield func(models.Content, error) bool) {
+			models.RecordRequest(ctx, []byte(`{"messages":[]}`))
+			if slices.ContainsFunc(msgs[len(msgs)-1].Contents, isToolResult) {
+				yield(models.Content{Type: models.ContentTypeText, Text: "Sunny"}, nil)
+				return
+			}
+			yield(models.Content{Type: models.ContentTypeCallTool, ToolName: "weather", ToolInput: []byte(`{}`)}, nil)
+		}
+	})
+	var replayed []models.Message
+	compareLLM := handlers.LLMFunc(func(
+		_ context.Context, msgs []models.Message, _ []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		replayed = msgs
+		return func(yield func(models.Content, error) bool) {
+			yield(models.Content{Type: models.ContentTypeText, Text: "Cloudy"}, nil)
+		}
+	})
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, &mockTitleGenerator{}, store, nil, slog.Default(), templates,
+		handlers.WithDebugMode(), handlers.WithCompareLLM(compareLLM))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+	mux.HandleFunc("/chats/replay", main.HandleTurnReplay)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/1/messages", strings.NewReader(`{"text":"Weather?"}`))
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	store.mu.Lock()
+	messages := slices.Clone(store.messages["1"])
+	store.mu.Unlock()
+	aiMsg := messages[len(messages)-1]
+	if len(aiMsg.Requests) != 2 {
+		t.Fatalf("requests = %s, want the 2 turns around the tool call", aiMsg.Requests)
+	}
+
+	replay := func(turn, provider string) *httptest.ResponseRecorder {
+		form := url.Values{"chat_id": {"1"}, "message_id": {aiMsg.ID}, "turn": {turn}, "provider": {provider}}
+		req := httptest.NewRequest(http.MethodPost, "/chats/replay", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	w := replay("2", "compareLLM")
+	if w.Code != http.StatusOK {
+		t.Fatalf("replay status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	for _, want := range []string{"Sunny", "Cloudy"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("replay = %s, want %q", w.Body.String(), want)
+		}
+	}
+	last := replayed[len(replayed)-1]
+	isTurnOutput := func(c models.Content) bool { return c.Text == "Sunny" }
+	if !slices.ContainsFunc(last.Contents, isToolResult) || slices.ContainsFunc(last.Contents, isTurnOutput) {
+		t.Errorf("replayed message = %+v, want the contents before the second turn", last.Contents)
+	}
+
+	store.mu.Lock()
+	if got := store.messages["1"]; len(got) != len(messages) || len(got[len(got)-1].Contents) != len(aiMsg.Contents) {
+		t.Errorf("messages = %+v, want the chat unchanged by the replay", got)
+	}
+	store.mu.Unlock()
+
+	if w := replay("3", "compareLLM"); w.Code != http.StatusBadRequest {
+		t.Errorf("unrecorded turn status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := replay("1", "unknown"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown provider status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGenerationExporter(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI ", "response"}}
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	exporter := &mockExporter{}
+
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithGenerationExporter(exporter))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/1/messages", strings.NewReader(`{"text":"Hello"}`))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if len(exporter.generations) != 1 {
+		t.Fatalf("ExportGeneration() called %d times, want 1", len(exporter.generations))
+	}
+	g := exporter.generations[0]
+	if g.ID == "" || g.ChatID != "1" {
+		t.Errorf("ExportGeneration() generation ID = %q, chat ID = %q, want an ID and chat 1", g.ID, g.ChatID)
+	}
+	if len(g.Prompt) != 1 || g.Prompt[0].Contents[0].Text != "Hello" {
+		t.Errorf("ExportGeneration() prompt = %+v, want the user message", g.Prompt)
+	}
+	if text, _ := models.RenderContents(g.Response.Contents); !strings.Contains(text, "AI response") {
+		t.Errorf("ExportGeneration() response = %q, want to contain %q", text, "AI response")
+	}
+	if g.OutputTokens == 0 || g.FinishedAt.Before(g.StartedAt) || g.Error != "" {
+		t.Errorf("ExportGeneration() generation = %+v, want tokens, latency and no error", g)
+	}
+}
+
+func TestLLMMiddleware(t *testing.T) {
+	collect := func(llm handlers.LLM, messages []models.Message) (string, error) {
+		var sb strings.Builder
+		for content, err := range llm.Chat(context.Background(), messages, nil) {
+			if err != nil {
+				return sb.String(), err
+			}
+			sb.WriteString(content.Text)
+		}
+		return sb.String(), nil
+	}
+	userMessage := []models.Message{{
+		Role:     models.RoleUser,
+		Contents: []models.Content{{Type: models.ContentTypeText, Text: "Hello"}},
+	}}
+
+	t.Run("Order", func(t *testing.T) {
+		var calls []string
+		trace := func(name string) handlers.LLMMiddleware {
+			return func(next handlers.LLM) handlers.LLM {
+				return handlers.LLMFunc(func(
+					ctx context.Context, messages []models.Message, tools []mcp.Tool,
+				) iter.Seq2[models.Content, error] {
+					calls = append(calls, name)
+					return next.Chat(ctx, messages, tools)
+				})
+			}
+		}
+		llm := &mockLLM{responses: []string{"AI response"}}
+		store := &mockStore{chats: []models.Chat{{ID: "1"}}, messages: map[string][]models.Message{}}
+		main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+			handlers.WithLLMMiddleware(trace("first"), trace("second")), handlers.WithLLMMiddleware(trace("third")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/1/messages", strings.NewReader(`{"text":"Hello"}`))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+
+		if want := []string{"first", "second", "third"}; !slices.Equal(calls, want) {
+			t.Errorf("middlewares called in order %v, want %v", calls, want)
+		}
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		attempts := 0
+		flaky := handlers.LLMFunc(func(
+			_ context.Context, _ []models.Message, _ []mcp.Tool,
+		) iter.Seq2[models.Content, error] {
+			attempts++
+			if attempts < 3 {
+				return mockLLM{err: fmt.Errorf("unavailable")}.Chat(context.Background(), nil, nil)
+			}
+			return mockLLM{responses: []string{"OK"}}.Chat(context.Background(), nil, nil)
+		})
+
+		got, err := collect(handlers.RetryMiddleware(2, time.Millisecond)(flaky), userMessage)
+		if err != nil || got != "OK" || attempts != 3 {
+			t.Errorf("Chat() = %q, %v after %d attempts, want %q after 3 attempts", got, err, attempts, "OK")
+		}
+
+		attempts = 0
+		if _, err := collect(handlers.RetryMiddleware(1, time.Millisecond)(flaky), userMessage); err == nil {
+			t.Errorf("Chat() error = nil after %d attempts, want the last error", attempts)
+		}
+	})
+
+	t.Run("TokenCounting", func(t *testing.T) {
+		var in, out int
+		llm := handlers.TokenCountingMiddleware(func(_ context.Context, inputTokens, outputTokens int) {
+			in, out = inputTokens, outputTokens
+		})(&mockLLM{responses: []string{"AI ", "response"}})
+
+		if _, err := collect(llm, userMessage); err != nil {
+			t.Fatal(err)
+		}
+		if in == 0 || out == 0 {
+			t.Errorf("counted %d input and %d output tokens, want both counted", in, out)
+		}
+	})
+
+	t.Run("ProfanityFilter", func(t *testing.T) {
+		llm := handlers.ProfanityFilterMiddleware([]string{"darn"})(
+			&mockLLM{responses: []string{"Well, Da", "rn it, ", "darned darn"}})
+
+		got, err := collect(llm, userMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "Well, **** it, darned ****"; got != want {
+			t.Errorf("Chat() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("CurrentDate", func(t *testing.T) {
+		var got []models.Message
+		capture := handlers.LLMFunc(func(
+			_ context.Context, messages []models.Message, _ []mcp.Tool,
+		) iter.Seq2[models.Content, error] {
+			got = messages
+			return mockLLM{}.Chat(context.Background(), nil, nil)
+		})
+		now := func() time.Time { return time.Date(2025, time.March, 7, 10, 0, 0, 0, time.UTC) }
+
+		if _, err := collect(handlers.CurrentDateMiddleware(now)(capture), userMessage); err != nil {
+			t.Fatal(err)
+		}
+		if want := "Current date: Friday, 7 March 2025.\n\nHello"; got[0].Contents[0].Text != want {
+			t.Errorf("Chat() message = %q, want %q", got[0].Contents[0].Text, want)
+		}
+		if userMessage[0].Contents[0].Text != "Hello" {
+			t.Errorf("Chat() modified the given message to %q", userMessage[0].Contents[0].Text)
+		}
+	})
+}
+
+func TestHandleChatParameters(t *testing.T) {
+	var got models.ChatParameters
+	llm := handlers.LLMFunc(func(
+		ctx context.Context, _ []models.Message, _ []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		got = models.ChatParametersFromContext(ctx)
+		return mockLLM{responses: []string{"AI response"}}.Chat(ctx, nil, nil)
+	})
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, mockLLM{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"chat_id": {"1"}, "temperature": {"3"}}
+	req := httptest.NewRequest(http.MethodPost, "/chats/parameters", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	main.HandleChatParameters(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("HandleChatParameters() status = %v, want %v for an invalid temperature", w.Code, http.StatusBadRequest)
+	}
+
+	form = url.Values{"chat_id": {"1"}, "temperature": {"0.3"}, "max_tokens": {"100"}, "top_p": {""}}
+	req = httptest.NewRequest(http.MethodPost, "/chats/parameters", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	main.HandleChatParameters(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `value="0.3"`) {
+		t.Fatalf("HandleChatParameters() status = %v, body = %s, want the saved parameters", w.Code, w.Body.String())
+	}
+	if p := store.chats[0].Parameters; p.Temperature == nil || *p.Temperature != 0.3 || p.MaxTokens == nil ||
+		*p.MaxTokens != 100 || p.TopP != nil || store.chats[0].Title != "Test Chat" {
+		t.Errorf("HandleChatParameters() stored chat = %+v, want temperature 0.3 and max tokens 100", store.chats[0])
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/chats/1/messages", strings.NewReader(`{"text":"Hello"}`))
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	if got.Temperature == nil || *got.Temperature != 0.3 || got.MaxTokens == nil || *got.MaxTokens != 100 {
+		t.Errorf("LLM chat parameters = %+v, want the parameters of the chat", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/?chat_id=1", nil)
+	w = httptest.NewRecorder()
+	main.HandleHome(w, req)
+	if !strings.Contains(w.Body.String(), `name="max_tokens"`) || !strings.Contains(w.Body.String(), `value="100"`) {
+		t.Errorf("HandleHome() body doesn't contain the parameters of the chat")
+	}
+}
+
+// noLogitBiasLLM is an LLM refusing the logit bias, like the providers whose API doesn't take it.
+type noLogitBiasLLM struct {
+	mockLLM
+}
+
+func (noLogitBiasLLM) ValidateParameters(params models.ChatParameters) error {
+	if len(params.LogitBias) > 0 {
+		return errors.New("the provider doesn't support the logit_bias parameter")
+	}
+	return nil
+}
+
+func TestChatStopAndLogitBias(t *testing.T) {
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}, {ID: "2", Title: "Other Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(mockLLM{}, mockLLM{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(main *handlers.Main, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/chats/parameters", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		main.HandleChatParameters(w, req)
+		return w
+	}
+
+	for _, bias := range []string{"50256", "50256: -101", "token: 5", "-1: 5"} {
+		if w := post(main, url.Values{"chat_id": {"1"}, "logit_bias": {bias}}); w.Code != http.StatusBadRequest {
+			t.Errorf("HandleChatParameters(logit_bias %q) status = %v, want %v", bias, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	form := url.Values{
+		"chat_id":    {"1"},
+		"stop":       {"END\r\n\\n\\n\r\n\r\n"},
+		"logit_bias": {"50256: -100\n 42 : 7\n"},
+	}
+	w := post(main, form)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChatParameters() status = %v, body = %s, want the saved parameters", w.Code, w.Body.String())
+	}
+	p := store.chats[0].Parameters
+	if !slices.Equal(p.Stop, []string{"END", "\n\n"}) || len(p.LogitBias) != 2 || p.LogitBias["50256"] != -100 ||
+		p.LogitBias["42"] != 7 {
+		t.Errorf("HandleChatParameters() stored parameters = %+v, want the stop sequences and the logit bias", p)
+	}
+	for _, want := range []string{"END\n\\n\\n</textarea>", "42: 7\n50256: -100</textarea>", "<details"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("HandleChatParameters() body doesn't contain %q", want)
+		}
+	}
+
+	main, err = handlers.NewMain(noLogitBiasLLM{}, mockLLM{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := post(main, url.Values{"chat_id": {"2"}, "logit_bias": {"42: 7"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("HandleChatParameters() status = %v, want %v for a parameter the LLM refuses", w.Code,
+			http.StatusBadRequest)
+	}
+	if store.chats[1].Parameters.LogitBias != nil {
+		t.Errorf("HandleChatParameters() stored the refused logit bias")
+	}
+}
+
+func TestStructuredOutput(t *testing.T) {
+	// The LLM keeps the response schema it's given, and answers with a fenced JSON value.
+	var schema json.RawMessage
+	var systemPrompt string
+	llm := handlers.LLMFunc(func(
+		ctx context.Context, _ []models.Message, _ []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		schema = models.ResponseSchemaFromContext(ctx)
+		systemPrompt = models.SystemPrompt(ctx, "")
+		return mockLLM{responses: []string{"```json\n{\"name\":\"Ada\",\"age\":\"old\"}\n```"}}.Chat(ctx, nil, nil)
+	})
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}, {ID: "2", Title: "Free Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, mockLLM{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const personSchema = `{"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "integer"}}}`
+	for _, tt := range []struct {
+		schema     string
+		wantStatus int
+	}{
+		{schema: `{"type":`, wantStatus: http.StatusBadRequest},
+		{schema: `["object"]`, wantStatus: http.StatusBadRequest},
+		{schema: personSchema, wantStatus: http.StatusOK},
+	} {
+		form := url.Values{"chat_id": {"1"}, "response_schema": {tt.schema}}
+		req := httptest.NewRequest(http.MethodPost, "/chats/parameters", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		main.HandleChatParameters(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("HandleChatParameters(%s) status = %v, want %v", tt.schema, w.Code, tt.wantStatus)
+		}
+	}
+	const compactSchema = `{"type":"object","properties":{"name":{"type":"string"},"age":{"type":"integer"}}}`
+	if got := string(store.chats[0].ResponseSchema); got != compactSchema {
+		t.Fatalf("HandleChatParameters() stored response schema = %s, want %s", got, compactSchema)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+	send := func(chatID, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/"+chatID+"/messages", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	msg := lastAPIMessage(t, send("1", `{"text":"Who?"}`).Body)
+	if string(schema) != compactSchema || !strings.Contains(systemPrompt, compactSchema) {
+		t.Errorf("LLM response schema = %s, system prompt = %q, want the schema of the chat", schema, systemPrompt)
+	}
+	wantViolations := []string{"response.age: expected integer, got string"}
+	if c := msg.Contents[0]; !c.Structured || !slices.Equal(c.SchemaViolations, wantViolations) {
+		t.Errorf("HandleAPIMessages() content = %+v, want a structured output violating the schema", c)
+	}
+	msgs, err := store.Messages(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := models.RenderContents(msgs[len(msgs)-1].Contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rendered, "doesn't match the response schema") ||
+		!strings.Contains(rendered, "response.age: expected integer, got string") {
+		t.Errorf("RenderContents() = %s, want the schema violations highlighted", rendered)
+	}
+
+	// The request's schema applies to the chat without one, only for its response.
+	if w := send("2", `{"text":"Who?","responseSchema":"[]"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("HandleAPIMessages() status = %v, want %v for an invalid schema", w.Code, http.StatusBadRequest)
+	}
+	msg = lastAPIMessage(t, send("2", `{"text":"Who?","responseSchema":"{\"type\":\"object\"}"}`).Body)
+	if string(schema) != `{"type":"object"}` || !msg.Contents[0].Structured || len(msg.Contents[0].SchemaViolations) > 0 {
+		t.Errorf("HandleAPIMessages() content = %+v, want a structured output following the request's schema",
+			msg.Contents[0])
+	}
+	lastAPIMessage(t, send("2", `{"text":"Who?"}`).Body)
+	if schema != nil {
+		t.Errorf("LLM response schema = %s, want none for a free text response", schema)
+	}
+}
+
+func TestMessageStats(t *testing.T) {
+	llm := handlers.LLMFunc(func(
+		_ context.Context, _ []models.Message, _ []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		return func(yield func(models.Content, error) bool) {
+			time.Sleep(20 * time.Millisecond)
+			for _, text := range []string{"Hello ", "from ", "the AI"} {
+				if !yield(models.Content{Type: models.ContentTypeText, Text: text}, nil) {
+					return
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	})
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, mockLLM{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/1/messages", strings.NewReader(`{"text":"Hello"}`))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	var res struct {
+		Message *struct {
+			Stats *struct {
+				TimeToFirstTokenMs int64   `json:"timeToFirstTokenMs"`
+				OutputTokens       int     `json:"outputTokens"`
+				TokensPerSecond    float64 `json:"tokensPerSecond"`
+			} `json:"stats"`
+		} `json:"message"`
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Message == nil || res.Message.Stats == nil {
+		t.Fatalf("HandleAPIMessages() last response = %s, want the message with its stats", lines[len(lines)-1])
+	}
+	stats := res.Message.Stats
+	if stats.TimeToFirstTokenMs < 20 || stats.OutputTokens == 0 || stats.TokensPerSecond <= 0 {
+		t.Errorf("HandleAPIMessages() stats = %+v, want a time to first token of at least 20ms, tokens and a rate",
+			*stats)
+	}
+
+	if stored := store.messages["1"][1].Stats; stored == nil || stored.OutputTokens != stats.OutputTokens {
+		t.Errorf("stored message stats = %+v, want %+v", stored, *stats)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/?chat_id=1", nil)
+	w = httptest.NewRecorder()
+	main.HandleHome(w, req)
+	if !strings.Contains(w.Body.String(), "TTFT ") || !strings.Contains(w.Body.String(), "tokens/s") {
+		t.Errorf("HandleHome() body doesn't contain the stats line of the assistant message")
+	}
+}
+
+func TestSSEKeepAlive(t *testing.T) {
+	llm := &mockLLM{}
+	main, err := handlers.NewMain(llm, llm, &mockStore{}, nil, slog.Default(), templates,
+		handlers.WithSSEKeepAlive(handlers.SSEKeepAlive{Interval: 10 * time.Millisecond, Retry: 2 * time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(main.HandleSSE))
+	defer srv.Close()
+	defer func() {
+		if err := main.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/sse/chats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	scanner := bufio.NewScanner(res.Body)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if scanner.Text() == ": keep-alive" {
+			break
+		}
+	}
+	if !slices.Contains(lines, ": keep-alive") {
+		t.Fatalf("SSE stream = %q, want a keep-alive comment", lines)
+	}
+	if lines[0] != "retry: 2000" {
+		t.Errorf("SSE stream starts with %q, want the retry hint", lines[0])
+	}
+}
+
+func TestSSEAuthorization(t *testing.T) {
+	release := make(chan struct{})
+	llm := handlers.LLMFunc(func(context.Context, []models.Message, []mcp.Tool) iter.Seq2[models.Content, error] {
+		return func(yield func(models.Content, error) bool) {
+			<-release
+			yield(models.Content{Type: models.ContentTypeText, Text: "AI response"}, nil)
+		}
+	})
+	store := &mockStore{
+		chats: []models.Chat{
+			{ID: "1", Title: "Test Chat", UserID: "alice"},
+			{ID: "3", Title: "Collaborative Chat", UserID: "alice", Members: []string{"carol"}},
+		},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, &mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-User"), handlers.WithSSEAuthorization(),
+		handlers.WithAccess(handlers.Access{Roles: map[string]handlers.UserRole{"dave": handlers.UserRoleAdmin}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(main.HandleSSE))
+	defer srv.Close()
+	defer func() {
+		if err := main.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	form := strings.NewReader("message=Hello&chat_id=1")
+	chatReq := httptest.NewRequest(http.MethodPost, "/chats", form)
+	chatReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	chatReq.Header.Set("X-User", "alice")
+	w := httptest.NewRecorder()
+	main.HandleChats(w, chatReq)
+	defer close(release)
+	match := regexp.MustCompile(`message_id=([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if match == nil {
+		t.Fatalf("HandleChats() body = %q, want the stream of the response", w.Body.String())
+	}
+
+	tests := []struct {
+		name string
+		path string
+		user string
+		want int
+	}{
+		{"chats without user", "/sse/chats", "", http.StatusForbidden},
+		{"chats", "/sse/chats", "alice", http.StatusOK},
+		{"own response", "/sse/messages?message_id=" + match[1], "alice", http.StatusOK},
+		{"response of another user", "/sse/messages?message_id=" + match[1], "bob", http.StatusForbidden},
+		{"unknown response", "/sse/messages?message_id=unknown", "alice", http.StatusForbidden},
+		{"own chat", "/sse/messages?chat_id=1", "alice", http.StatusOK},
+		{"chat of another user", "/sse/messages?chat_id=1", "bob", http.StatusForbidden},
+		{"chat of another user as an admin", "/sse/messages?chat_id=1", "dave", http.StatusOK},
+		{"collaborative chat of a member", "/sse/messages?chat_id=3", "carol", http.StatusOK},
+		{"collaborative chat of another user", "/sse/messages?chat_id=3", "bob", http.StatusForbidden},
+		{"unknown chat", "/sse/messages?chat_id=2", "alice", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.user != "" {
+				req.Header.Set("X-User", tt.user)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatCompletionEvent(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI response"}}
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(main.HandleSSE))
+	defer srv.Close()
+	defer func() {
+		if err := main.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/sse/chats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	form := strings.NewReader("message=Hello&chat_id=1")
+	chatReq := httptest.NewRequest(http.MethodPost, "/chats", form)
+	chatReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	main.HandleChats(httptest.NewRecorder(), chatReq)
+
+	scanner := bufio.NewScanner(res.Body)
+	completion := false
+	for scanner.Scan() {
+		if scanner.Text() == "event: completion" {
+			completion = true
+			continue
+		}
+		if completion && strings.HasPrefix(scanner.Text(), "data: ") {
+			var got struct {
+				ChatID  string `json:"chatId"`
+				Title   string `json:"title"`
+				Preview string `json:"preview"`
+				Failed  bool   `json:"failed"`
+			}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ChatID != "1" || got.Title != "Test Chat" || got.Preview != "AI response" || got.Failed {
+				t.Errorf("completion = %+v, want the completion of chat 1 with its response", got)
+			}
+			return
+		}
+	}
+	t.Fatalf("SSE stream ended without a completion event: %v", scanner.Err())
+}
+
+func TestEventSubscriber(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI ", "response"}}
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	var (
+		mu     sync.Mutex
+		events []handlers.UIEvent
+	)
+	subscriber := handlers.EventSubscriberFunc(func(_ context.Context, event handlers.UIEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+		return nil
+	})
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates,
+		handlers.WithEventSubscriber(subscriber))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/1/messages", strings.NewReader(`{"text":"Hello"}`))
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	mu.Lock()
+	defer mu.Unlock()
+	var streamed, closed bool
+	for _, event := range events {
+		if len(event.Topics) != 1 || !strings.HasPrefix(event.Topics[0], "message-") {
+			continue
+		}
+		switch event.Type {
+		case "messages":
+			streamed = streamed || strings.Contains(event.Data, "AI response")
+		case "closeMessage":
+			closed = true
+		}
+	}
+	if !streamed || !closed {
+		t.Errorf("events = %+v, want the streamed response and the close of its topic", events)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI ", "response"}}
+	store := &mockStore{messages: map[string][]models.Message{}}
+	bridge := &mockBridge{incoming: make(chan models.BridgeMessage), replies: make(chan models.BridgeReply)}
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates, handlers.WithBridges(bridge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Shutdown(context.Background()) }()
+
+	send := func(text string) models.BridgeReply {
+		t.Helper()
+		bridge.incoming <- models.BridgeMessage{Conversation: "42", User: "7", Text: text}
+		select {
+		case reply := <-bridge.replies:
+			return reply
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no reply to %q", text)
+			return models.BridgeReply{}
+		}
+	}
+	bridgeChats := func() []models.Chat {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		var chats []models.Chat
+		for _, c := range store.chats {
+			if c.BridgeConversation == "test:42" {
+				chats = append(chats, c)
+			}
+		}
+		return chats
+	}
+	// The titles are generated in the background, the chat being read again after.
+	waitTitles := func() {
+		for range 100 {
+			store.mu.Lock()
+			titled := !slices.ContainsFunc(store.chats, func(c models.Chat) bool { return c.Title == "" })
+			store.mu.Unlock()
+			if titled {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if reply := send("Hello"); reply.Conversation != "42" || reply.Text != "AI response" {
+		t.Errorf("reply = %+v, want the response in the conversation", reply)
+	}
+	waitTitles()
+	chats := bridgeChats()
+	if len(chats) != 1 || chats[0].UserID != "test:7" {
+		t.Fatalf("chats of the conversation = %+v, want a chat of the user of the bridge", chats)
+	}
+	chatID := chats[0].ID
+
+	send("Again")
+	store.mu.Lock()
+	messages := len(store.messages[chatID])
+	store.mu.Unlock()
+	if messages != 4 {
+		t.Errorf("chat has %d messages, want both messages and their responses", messages)
+	}
+
+	if reply := send("/new"); !strings.Contains(reply.Text, "new chat") {
+		t.Errorf("reply to /new = %q, want the new chat confirmed", reply.Text)
+	}
+	send("Hi")
+	waitTitles()
+	if chats := bridgeChats(); len(chats) != 1 || chats[0].ID == chatID {
+		t.Errorf("chats of the conversation after /new = %+v, want a new chat", chats)
+	}
+}
+
+func TestChatSync(t *testing.T) {
+	llm := &mockLLM{responses: []string{"AI response"}}
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(main.HandleSSE))
+	defer srv.Close()
+	defer func() {
+		if err := main.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/sse/messages?chat_id=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	post := func(handler http.HandlerFunc, form string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+	if code := post(main.HandleChats, "message=Hello&chat_id=1"); code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", code, http.StatusOK)
+	}
+	if code := post(main.HandleTyping, "chat_id=1&client_id=client-1"); code != http.StatusNoContent {
+		t.Fatalf("HandleTyping() status = %v, want %v", code, http.StatusNoContent)
+	}
+	if code := post(main.HandleTyping, "chat_id=1"); code != http.StatusBadRequest {
+		t.Errorf("HandleTyping() without client ID status = %v, want %v", code, http.StatusBadRequest)
+	}
+
+	store.mu.Lock()
+	wantIDs := []string{store.messages["1"][0].ID, store.messages["1"][1].ID}
+	store.mu.Unlock()
+
+	scanner := bufio.NewScanner(res.Body)
+	var event string
+	var gotMessages bool
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			event = strings.TrimPrefix(line, "event: ")
+			continue
+		}
+		switch {
+		case event == "chatMessages" && strings.HasPrefix(line, "data: "):
+			for _, id := range wantIDs {
+				if strings.Contains(line, `id="message-`+id+`"`) {
+					gotMessages = true
+				}
+			}
+		case event == "typing" && strings.HasPrefix(line, "data: "):
+			if !gotMessages {
+				t.Errorf("chatMessages events don't contain the messages %v", wantIDs)
+			}
+			if !strings.Contains(line, `"clientId":"client-1"`) {
+				t.Errorf("typing event = %s, want the client ID", line)
+			}
+			return
+		}
+	}
+	t.Fatalf("SSE stream ended without a typing event: %v", scanner.Err())
+}
+
+func TestBatch(t *testing.T) {
+	// The LLM answers with the prompt it's given, and fails on the prompts about Atlantis.
+	llm := handlers.LLMFunc(func(
+		ctx context.Context, messages []models.Message, _ []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		prompt := messages[len(messages)-2].Contents[0].Text
+		if strings.Contains(prompt, "Atlantis") {
+			return mockLLM{err: errors.New("unknown country")}.Chat(ctx, nil, nil)
+		}
+		return mockLLM{responses: []string{"Answer to: ", prompt}}.Chat(ctx, nil, nil)
+	})
+	store := &mockStore{messages: map[string][]models.Message{}}
+	main, err := handlers.NewMain(llm, mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithBatches(handlers.Batches{MaxRows: 3}), handlers.WithUserHeader("X-User"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := main.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	upload := func(template, inputs string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		_ = mw.WriteField("name", "Capitals")
+		_ = mw.WriteField("template", template)
+		fw, err := mw.CreateFormFile("inputs", "inputs.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fw.Write([]byte(inputs))
+		_ = mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/batches", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		main.HandleBatches(w, req)
+		return w
+	}
+
+	for _, tt := range []struct {
+		name     string
+		template string
+		inputs   string
+	}{
+		{name: "unknown column", template: "Capital of {{city}}?", inputs: "country\nFrance\n"},
+		{name: "no rows", template: "Capital of {{country}}?", inputs: "country\n"},
+		{name: "too many rows", template: "Capital of {{country}}?", inputs: "country\nA\nB\nC\nD\n"},
+		{name: "ragged rows", template: "Capital of {{country}}?", inputs: "country,lang\nFrance\n"},
+	} {
+		if w := upload(tt.template, tt.inputs); w.Code != http.StatusBadRequest {
+			t.Errorf("HandleBatches(%s) status = %v, want %v", tt.name, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	w := upload("Capital of {{ country }} in {{lang}}?", "\ufeffcountry,lang\nFrance,French\nAtlantis,Greek\n")
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("HandleBatches() status = %v, want %v: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	batchID := strings.TrimPrefix(w.Header().Get("Location"), "/batches?id=")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/batches/{batchID}", main.HandleAPIBatch)
+	type batchRow struct {
+		Row    int               `json:"row"`
+		Inputs map[string]string `json:"inputs"`
+		Prompt string            `json:"prompt"`
+		Status string            `json:"status"`
+		Output string            `json:"output"`
+		Error  string            `json:"error"`
+	}
+	var b struct {
+		Columns  []string   `json:"columns"`
+		Finished bool       `json:"finished"`
+		Rows     []batchRow `json:"rows"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); !b.Finished; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("HandleAPIBatch() batch = %+v, want it finished", b)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/batches/"+batchID, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("HandleAPIBatch() status = %v, want %v", w.Code, http.StatusOK)
+		}
+		if err := json.NewDecoder(w.Body).Decode(&b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []batchRow{
+		{
+			Row:    1,
+			Inputs: map[string]string{"country": "France", "lang": "French"},
+			Prompt: "Capital of France in French?",
+			Status: "done",
+			Output: "Answer to: Capital of France in French?",
+		},
+		{
+			Row:    2,
+			Inputs: map[string]string{"country": "Atlantis", "lang": "Greek"},
+			Prompt: "Capital of Atlantis in Greek?",
+			Status: "failed",
+			Error:  "error from llm provider: unknown country",
+		},
+	}
+	if !slices.Equal(b.Columns, []string{"country", "lang"}) || len(b.Rows) != len(want) {
+		t.Fatalf("HandleAPIBatch() batch = %+v, want the rows %+v", b, want)
+	}
+	for i, row := range b.Rows {
+		if row.Row != want[i].Row || !maps.Equal(row.Inputs, want[i].Inputs) || row.Prompt != want[i].Prompt ||
+			row.Status != want[i].Status || row.Output != want[i].Output || row.Error != want[i].Error {
+			t.Errorf("HandleAPIBatch() row = %+v, want %+v", row, want[i])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	main.HandleBatches(w, httptest.NewRequest(http.MethodGet, "/batches?id="+batchID, nil))
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "Capitals") ||
+		!strings.Contains(body, "Answer to: Capital of France in French?") || strings.Contains(body, "hx-trigger") {
+		t.Errorf("HandleBatches() status = %v, body = %s, want the finished batch", w.Code, body)
+	}
+
+	w = httptest.NewRecorder()
+	main.HandleBatchResults(w, httptest.NewRequest(http.MethodGet, "/batches/results?id="+batchID, nil))
+	wantCSV := "country,lang,prompt,status,output,error\n" +
+		"France,French,Capital of France in French?,done,Answer to: Capital of France in French?,\n" +
+		"Atlantis,Greek,Capital of Atlantis in Greek?,failed,,error from llm provider: unknown country\n"
+	if w.Body.String() != wantCSV {
+		t.Errorf("HandleBatchResults(csv) = %q, want %q", w.Body.String(), wantCSV)
+	}
+
+	w = httptest.NewRecorder()
+	main.HandleBatchResults(w, httptest.NewRequest(http.MethodGet, "/batches/results?id="+batchID+"&format=jsonl", nil))
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 2 ||
+		!strings.Contains(lines[1], `"status":"failed"`) {
+		t.Errorf("HandleBatchResults(jsonl) = %s, want a line per row", w.Body)
+	}
+
+	// The batches are only visible to their users.
+	req := httptest.NewRequest(http.MethodGet, "/batches/results?id="+batchID, nil)
+	req.Header.Set("X-User", "mallory")
+	w = httptest.NewRecorder()
+	main.HandleBatchResults(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("HandleBatchResults() of another user status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestEvalSuite(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		suite string
+	}{
+		{name: "no cases", suite: "cases: []"},
+		{name: "no input", suite: "cases:\n  - name: empty"},
+		{
+			name:  "two checks",
+			suite: "cases:\n  - name: a\n    input: hi\n    assertions:\n      - contains: a\n        matches: b",
+		},
+		{name: "bad pattern", suite: "cases:\n  - name: a\n    input: hi\n    assertions:\n      - matches: \"(\""},
+	} {
+		if _, err := handlers.ParseEvalSuite(strings.NewReader(tt.suite)); err == nil {
+			t.Errorf("ParseEvalSuite(%s) error = nil, want an error", tt.name)
+		}
+	}
+
+	suite := filepath.Join(t.TempDir(), "evals.yaml")
+	err := os.WriteFile(suite, []byte(`cases:
+  - name: greeting
+    input: Say hello
+    assertions:
+      - contains: Hello
+      - notContains: Goodbye
+      - matches: "(?i)^hello"
+  - name: farewell
+    input: Say goodbye
+    assertions:
+      - contains: Goodbye
+      - toolCalled: get_weather
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &mockLLM{responses: []string{"Hello there!"}}
+	store := &mockStore{messages: map[string][]models.Message{}}
+	main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates, handlers.WithEvalSuite(suite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	main.HandleEvals(w, httptest.NewRequest(http.MethodPost, "/admin/evals", nil))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("HandleEvals() status = %v, want %v", w.Code, http.StatusSeeOther)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		w = httptest.NewRecorder()
+		main.HandleEvals(w, httptest.NewRequest(http.MethodGet, "/admin/evals", nil))
+		if body := w.Body.String(); strings.Contains(body, "1 / 2 passed") {
+			if !strings.Contains(body, "tool get_weather isn&#39;t called") || !strings.Contains(body, "Hello there!") {
+				t.Errorf("HandleEvals() body = %s, want the failures and the transcripts", body)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("HandleEvals() body = %s, want the report of the run", w.Body)
+		}
+	}
+
+	report, err := main.RunEvalSuite(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != 2 || !report.Results[0].Passed || report.Results[1].Passed {
+		t.Fatalf("RunEvalSuite() results = %+v, want the first case to pass only", report.Results)
+	}
+	wantFailures := []string{`response doesn't contain "Goodbye"`, "tool get_weather isn't called"}
+	if got := report.Results[1].Failures; !slices.Equal(got, wantFailures) {
+		t.Errorf("RunEvalSuite() failures = %v, want %v", got, wantFailures)
+	}
+	if got := report.Results[1].Transcript.Contents[0].Text; got != "Hello there!" {
+		t.Errorf("RunEvalSuite() transcript = %q, want the response", got)
+	}
+}
+
+func TestHandleChatEstimate(t *testing.T) {
+	store := &mockStore{messages: map[string][]models.Message{
+		"chat1": {
+			{ID: "1", Role: models.RoleUser, Contents: []models.Content{{Type: models.ContentTypeText, Text: "Hi"}}},
+			{ID: "2", Role: models.RoleAssistant, Contents: []models.Content{{Type: models.ContentTypeText, Text: "Hello"}}},
+		},
+	}}
+
+	tests := []struct {
+		name  string
+		llm   handlers.LLM
+		price float64
+		form  url.Values
+		want  string
+	}{
+		{
+			name:  "provider tokenizer",
+			llm:   mockTokenCountingLLM{},
+			price: 3,
+			form:  url.Values{"chat_id": {"chat1"}, "message": {"How are you?"}},
+			want:  "~4000 input tokens &middot; ~0.0120",
+		},
+		{
+			name: "estimate",
+			llm:  mockLLM{},
+			form: url.Values{"message": {"abcdefgh"}},
+			want: "~2 input tokens",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			main, err := handlers.NewMain(tt.llm, mockLLM{}, store, nil, slog.Default(), templates,
+				handlers.WithInputPrice(tt.price))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/chats/estimate", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			main.HandleChatEstimate(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("HandleChatEstimate() status = %v, want %v", w.Code, http.StatusOK)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("HandleChatEstimate() body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatLanguage(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{
+			name:     "info string",
+			response: "Here it is:\n\n```go\nfunc main() {\n\tfmt.Println(\"hi\")\n}\n```\n\n```sh\ngo run .\n```",
+			want:     "Go",
+		},
+		{
+			name:     "signature",
+			response: "```\ndef greet(name):\n    return name\n\nprint(greet(\"hi\"))\n```",
+			want:     "Python",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := &mockLLM{responses: []string{tt.response}}
+			store := &mockStore{
+				chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+				messages: map[string][]models.Message{},
+			}
+			main, err := handlers.NewMain(llm, llm, store, nil, slog.Default(), templates)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Hello&chat_id=1"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			main.HandleChats(httptest.NewRecorder(), req)
+
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				store.mu.Lock()
+				got := store.chats[0].Language
+				store.mu.Unlock()
+				if got == tt.want {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("chat language = %q, want %q", got, tt.want)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			main.HandleHome(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if !strings.Contains(w.Body.String(), "Mostly "+tt.want+" code") {
+				t.Errorf("HandleHome() body = %s, want the language label of the chat", w.Body)
+			}
+		})
+	}
+}
+
+func TestReadReceipts(t *testing.T) {
+	text := []models.Content{{Type: models.ContentTypeText, Text: "Hi"}}
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1"}, {ID: "2"}},
+		messages: map[string][]models.Message{
+			"1": {
+				{ID: "u1", Role: models.RoleUser, Contents: text},
+				{ID: "a1", Role: models.RoleAssistant, Contents: text},
+				{ID: "u2", Role: models.RoleUser, Contents: text},
+				{ID: "a2", Role: models.RoleAssistant, Contents: text},
+			},
+			"2": {
+				{ID: "u3", Role: models.RoleUser, Contents: text},
+				{ID: "a3", Role: models.RoleAssistant},
+			},
+		},
+	}
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-User"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unread := func(user string) map[string]int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/chats/unread", nil)
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		main.HandleChatUnread(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("HandleChatUnread() status = %v, want %v", w.Code, http.StatusOK)
+		}
+		var counts map[string]int
+		if err := json.Unmarshal(w.Body.Bytes(), &counts); err != nil {
+			t.Fatal(err)
+		}
+		return counts
+	}
+	read := func(user string, form url.Values) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/chats/read", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		main.HandleChatRead(w, req)
+		return w.Code
+	}
+
+	// The response being generated in chat 2 isn't unread yet.
+	if got, want := unread("alice"), map[string]int{"1": 2}; !maps.Equal(got, want) {
+		t.Errorf("unread counts = %v, want %v", got, want)
+	}
+	if code := read("alice", url.Values{"chat_id": {"1"}, "message_id": {"a1"}}); code != http.StatusNoContent {
+		t.Fatalf("HandleChatRead() status = %v, want %v", code, http.StatusNoContent)
+	}
+	if got, want := unread("alice"), map[string]int{"1": 1}; !maps.Equal(got, want) {
+		t.Errorf("unread counts = %v, want %v", got, want)
+	}
+	if code := read("alice", url.Values{"chat_id": {"1"}}); code != http.StatusNoContent {
+		t.Fatalf("HandleChatRead() status = %v, want %v", code, http.StatusNoContent)
+	}
+	if got := unread("alice"); len(got) != 0 {
+		t.Errorf("unread counts = %v, want none", got)
+	}
+	if got, want := unread("bob"), map[string]int{"1": 2}; !maps.Equal(got, want) {
+		t.Errorf("unread counts of another user = %v, want %v", got, want)
+	}
+
+	store.mu.Lock()
+	store.messages["1"] = append(store.messages["1"], models.Message{ID: "a4", Role: models.RoleAssistant, Contents: text})
+	store.mu.Unlock()
+	if got, want := unread("alice"), map[string]int{"1": 1}; !maps.Equal(got, want) {
+		t.Errorf("unread counts after a new response = %v, want %v", got, want)
+	}
+
+	if code := read("alice", url.Values{"chat_id": {"1"}, "message_id": {"missing"}}); code != http.StatusNotFound {
+		t.Errorf("HandleChatRead() status = %v, want %v", code, http.StatusNotFound)
+	}
+	if code := read("alice", url.Values{}); code != http.StatusBadRequest {
+		t.Errorf("HandleChatRead() status = %v, want %v", code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleChatInfo(t *testing.T) {
+	created := time.Date(2024, 3, 10, 9, 0, 0, 0, time.UTC)
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{"1": {
+			{
+				ID:        "1",
+				Role:      models.RoleUser,
+				Contents:  []models.Content{{Type: models.ContentTypeText, Text: "Add one and two"}},
+				Timestamp: created,
+			},
+			{
+				ID:   "2",
+				Role: models.RoleAssistant,
+				Contents: []models.Content{
+					{Type: models.ContentTypeCallTool, ToolName: "add", ToolInput: json.RawMessage(`{"a":1,"b":2}`)},
+					{Type: models.ContentTypeToolResult, ToolResult: json.RawMessage(`"timeout"`), CallToolFailed: true},
+					{Type: models.ContentTypeText, Text: "The tool timed out."},
+				},
+				Timestamp: created.Add(time.Minute),
+				Stats:     &models.MessageStats{OutputTokens: 5},
+			},
+		}},
+	}
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/chats/info?chat_id=1", nil)
+	req.AddCookie(&http.Cookie{Name: "mcpwebui_tz", Value: "UTC"})
+	w := httptest.NewRecorder()
+	main.HandleChatInfo(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChatInfo() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	// The transcript is 15+13+9+19 = 56 characters, so the generation used 14 tokens.
+	for _, want := range []string{
+		"2 (1 user, 1 assistant)",
+		"1 (1 failed)",
+		"<dd class=\"col-7 mb-1\">8</dd>",
+		"56 characters, ~14 tokens",
+		"~14 (5 generated)",
+		"2024-03-10 09:00",
+		"2024-03-10 09:01",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("HandleChatInfo() body doesn't contain %q", want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	main.HandleChatInfo(w, httptest.NewRequest(http.MethodGet, "/chats/info?chat_id=2", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("HandleChatInfo() of an unknown chat status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandleChatDuplicate(t *testing.T) {
+	text := []models.Content{{Type: models.ContentTypeText, Text: "Hi"}}
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Test Chat", MountedResources: []string{"file:///notes.txt"}}},
+		messages: map[string][]models.Message{
+			"1": {
+				{ID: "u1", Role: models.RoleUser, Contents: text},
+				{ID: "a1", Role: models.RoleAssistant, Contents: text},
+			},
+		},
+	}
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	duplicate := func(chatID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/chats/duplicate", strings.NewReader("chat_id="+chatID))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		main.HandleChatDuplicate(w, req)
+		return w
+	}
+
+	if w := duplicate("missing"); w.Code != http.StatusNotFound {
+		t.Errorf("HandleChatDuplicate() status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+
+	w := duplicate("1")
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("HandleChatDuplicate() status = %v, want %v", w.Code, http.StatusSeeOther)
+	}
+	if len(store.chats) != 2 {
+		t.Fatalf("chats = %+v, want the chat and its copy", store.chats)
+	}
+	copied := store.chats[1]
+	if w.Header().Get("Location") != "/?chat_id="+copied.ID {
+		t.Errorf("HandleChatDuplicate() location = %q, want the copy", w.Header().Get("Location"))
+	}
+	if copied.Title != "Copy of Test Chat" || !slices.Equal(copied.MountedResources, store.chats[0].MountedResources) {
+		t.Errorf("copy = %+v, want the settings of the chat with a new title", copied)
+	}
+	messages := store.messages[copied.ID]
+	if len(messages) != 2 || messages[1].Contents[0].Text != "Hi" || messages[1].ID == "a1" {
+		t.Errorf("messages of the copy = %+v, want the messages of the chat with new IDs", messages)
+	}
+	if len(store.receipts) != 1 || store.receipts[0].MessageID != messages[1].ID {
+		t.Errorf("read receipts = %+v, want the copy read up to its last message", store.receipts)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	sent := make(chan []string, 1)
+	llm := handlers.LLMFunc(func(
+		ctx context.Context, messages []models.Message, _ []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		var texts []string
+		for _, msg := range messages {
+			if msg.Role == models.RoleUser {
+				texts = append(texts, msg.Contents[0].Text)
+			}
+		}
+		sent <- texts
+		return mockLLM{responses: []string{"Side answer"}}.Chat(ctx, nil, nil)
+	})
+	text := func(s string) []models.Content { return []models.Content{{Type: models.ContentTypeText, Text: s}} }
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{"1": {
+			{ID: "u1", Role: models.RoleUser, Contents: text("First question")},
+			{ID: "a1", Role: models.RoleAssistant, Contents: text("First answer")},
+			{ID: "u2", Role: models.RoleUser, Contents: text("Second question")},
+			{ID: "a2", Role: models.RoleAssistant, Contents: text("Second answer")},
+		}},
+	}
+	main, err := handlers.NewMain(llm, mockLLM{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(parentID string) *httptest.ResponseRecorder {
+		form := url.Values{"chat_id": {"1"}, "message": {"Side question"}, "parent_id": {parentID}}
+		req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		main.HandleChats(w, req)
+		return w
+	}
+
+	if w := send("missing"); w.Code != http.StatusNotFound {
+		t.Errorf("HandleChats() status = %v, want %v for a reply to an unknown message", w.Code, http.StatusNotFound)
+	}
+
+	w := send("a1")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "First answer") {
+		t.Fatalf("HandleChats() status = %v, body = %s, want the reply to the message", w.Code, w.Body)
+	}
+	select {
+	case got := <-sent:
+		if want := []string{"First question", "Side question"}; !slices.Equal(got, want) {
+			t.Errorf("LLM user messages = %q, want the path of the reply %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("LLM wasn't called")
+	}
+
+	store.mu.Lock()
+	messages := slices.Clone(store.messages["1"])
+	store.mu.Unlock()
+	if len(messages) != 6 || messages[4].ParentID != "a1" || messages[5].ParentID != messages[4].ID {
+		t.Fatalf("messages = %+v, want the reply to a1 and its response in its thread", messages)
+	}
+
+	for _, tt := range []struct {
+		query string
+		first string
+	}{
+		{query: "", first: "Second question"},
+		{query: "&view=threaded", first: "Side question"},
+	} {
+		w := httptest.NewRecorder()
+		main.HandleHome(w, httptest.NewRequest(http.MethodGet, "/?chat_id=1"+tt.query, nil))
+		body := w.Body.String()
+		side, second := strings.Index(body, "Side question"), strings.Index(body, "Second question")
+		if side < 0 || second < 0 || (tt.first == "Side question") != (side < second) {
+			t.Errorf("HandleHome(%q) body doesn't show %q first", tt.query, tt.first)
+		}
+		if !strings.Contains(body, `href="#message-a1"`) {
+			t.Errorf("HandleHome(%q) body doesn't link the reply to its parent", tt.query)
+		}
+	}
+}
+
+func TestCollaborativeChat(t *testing.T) {
+	type request struct {
+		text         string
+		systemPrompt string
+	}
+	sent := make(chan request, 1)
+	llm := handlers.LLMFunc(func(
+		ctx context.Context, messages []models.Message, _ []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		sent <- request{text: messages[0].Contents[0].Text, systemPrompt: models.SystemPrompt(ctx, "")}
+		return mockLLM{responses: []string{"Hi Bob"}}.Chat(ctx, nil, nil)
+	})
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat", UserID: "alice"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-User"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(handler http.HandlerFunc, user string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	invite := url.Values{"chat_id": {"1"}, "user_id": {"bob"}}
+	if w := post(main.HandleChatMembers, "bob", invite); w.Code != http.StatusForbidden {
+		t.Errorf("HandleChatMembers() status = %v, want %v for a user who didn't create the chat", w.Code,
+			http.StatusForbidden)
+	}
+	if w := post(main.HandleChatMembers, "alice", invite); w.Code != http.StatusOK ||
+		!slices.Equal(store.chats[0].Members, []string{"bob"}) {
+		t.Fatalf("HandleChatMembers() status = %v, members = %v, want bob invited", w.Code, store.chats[0].Members)
+	}
+
+	if w := post(main.HandleChats, "bob", url.Values{"chat_id": {"1"}, "message": {"Hello"}}); w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	select {
+	case got := <-sent:
+		if got.text != "[bob] Hello" || !strings.Contains(got.systemPrompt, "alice, bob") {
+			t.Errorf("LLM request = %+v, want the message labelled with its sender and the participants", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("LLM wasn't called")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/?chat_id=1", nil)
+	req.Header.Set("X-User", "alice")
+	w := httptest.NewRecorder()
+	main.HandleHome(w, req)
+	if !strings.Contains(w.Body.String(), `<small class="message-sender text-muted me-2">bob</small>`) {
+		t.Errorf("HandleHome() body doesn't show the sender of the message")
+	}
+
+	leave := url.Values{"chat_id": {"1"}, "user_id": {"bob"}, "action": {"remove"}}
+	if w := post(main.HandleChatMembers, "bob", leave); w.Code != http.StatusOK || len(store.chats[0].Members) != 0 {
+		t.Errorf("HandleChatMembers() status = %v, members = %v, want bob left", w.Code, store.chats[0].Members)
+	}
+}
+
+func TestObserver(t *testing.T) {
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Test Chat", UserID: "alice"}},
+		messages: map[string][]models.Message{
+			"1": {{ID: "m1", Role: models.RoleUser, Contents: []models.Content{
+				{Type: models.ContentTypeText, Text: "How do I reset it?"},
+			}}},
+		},
+	}
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-User"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/observe/{token}", main.HandleObserve)
+
+	share := func(user, action string) *httptest.ResponseRecorder {
+		form := url.Values{"chat_id": {"1"}, "action": {action}}
+		req := httptest.NewRequest(http.MethodPost, "/chats/observer", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		main.HandleChatObserver(w, req)
+		return w
+	}
+	observe := func(method, link string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, link, nil))
+		return w
+	}
+
+	if w := share("bob", ""); w.Code != http.StatusForbidden {
+		t.Errorf("HandleChatObserver() status = %v, want %v for a user who didn't create the chat", w.Code,
+			http.StatusForbidden)
+	}
+	if w := share("alice", ""); w.Code != http.StatusOK || store.chats[0].ObserverToken == "" {
+		t.Fatalf("HandleChatObserver() status = %v, want the observer link created", w.Code)
+	}
+	link := "/observe/" + store.chats[0].ObserverToken
+
+	w := observe(http.MethodGet, link)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleObserve() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "How do I reset it?") || strings.Contains(body, "chat-form-chatbox") {
+		t.Errorf("HandleObserve() body = %s, want the messages without the chat form", body)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != store.chats[0].ObserverToken || cookies[0].Path != "/sse" {
+		t.Errorf("HandleObserve() cookies = %v, want the observer cookie of the SSE connections", cookies)
+	}
+	if w := observe(http.MethodPost, link); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("HandleObserve() POST status = %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	}
+	if w := observe(http.MethodGet, "/observe/unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("HandleObserve() status = %v, want %v for an unknown link", w.Code, http.StatusNotFound)
+	}
+
+	if w := share("alice", "revoke"); w.Code != http.StatusOK || store.chats[0].ObserverToken != "" {
+		t.Fatalf("HandleChatObserver() revoke status = %v, want the observer link revoked", w.Code)
+	}
+	if w := observe(http.MethodGet, link); w.Code != http.StatusNotFound {
+		t.Errorf("HandleObserve() status = %v, want %v for a revoked link", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestShare(t *testing.T) {
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Test Chat", UserID: "alice"}},
+		messages: map[string][]models.Message{
+			"1": {{ID: "m1", Role: models.RoleUser, Contents: []models.Content{
+				{Type: models.ContentTypeText, Text: "How do I reset it?"},
+			}}},
+		},
+	}
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-User"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/share/{token}", main.HandleShare)
+
+	share := func(user string, form url.Values) *httptest.ResponseRecorder {
+		form.Set("chat_id", "1")
+		req := httptest.NewRequest(http.MethodPost, "/chats/share", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		main.HandleChatShare(w, req)
+		return w
+	}
+	read := func(link string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, link, nil))
+		return w
+	}
+
+	if w := share("bob", url.Values{}); w.Code != http.StatusForbidden {
+		t.Errorf("HandleChatShare() status = %v, want %v for a user who didn't create the chat", w.Code,
+			http.StatusForbidden)
+	}
+	if w := share("alice", url.Values{}); w.Code != http.StatusOK || store.chats[0].Share == nil {
+		t.Fatalf("HandleChatShare() status = %v, want the share link created", w.Code)
+	}
+	plainLink := "/share/" + store.chats[0].Share.Token
+	w := read(plainLink)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "How do I reset it?") {
+		t.Errorf("HandleShare() status = %v, body = %s, want the transcript", w.Code, w.Body.String())
+	}
+
+	// The transcript encrypted in the browser is the payload of the page, without the plaintext.
+	req := httptest.NewRequest(http.MethodGet, "/chats/share?chat_id=1", nil)
+	req.Header.Set("X-User", "alice")
+	w = httptest.NewRecorder()
+	main.HandleChatShare(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "How do I reset it?") {
+		t.Fatalf("HandleChatShare() GET status = %v, want the transcript to encrypt", w.Code)
+	}
+	if w := share("alice", url.Values{"ciphertext": {"not base64"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("HandleChatShare() status = %v, want %v for an invalid ciphertext", w.Code, http.StatusBadRequest)
+	}
+	ciphertext := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x42}, 64))
+	if w := share("alice", url.Values{"ciphertext": {ciphertext}}); w.Code != http.StatusOK ||
+		!store.chats[0].Share.Encrypted {
+		t.Fatalf("HandleChatShare() status = %v, want the encrypted share link created", w.Code)
+	}
+	if w := read(plainLink); w.Code != http.StatusNotFound {
+		t.Errorf("HandleShare() status = %v, want %v for a replaced link", w.Code, http.StatusNotFound)
+	}
+	link := "/share/" + store.chats[0].Share.Token
+	w = read(link)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, ciphertext) || strings.Contains(body, "How do I reset it?") ||
+		strings.Contains(body, "Test Chat") {
+		t.Errorf("HandleShare() status = %v, body = %s, want the ciphertext only", w.Code, body)
+	}
+
+	if w := share("alice", url.Values{"action": {"revoke"}}); w.Code != http.StatusOK || store.chats[0].Share != nil {
+		t.Fatalf("HandleChatShare() revoke status = %v, want the share link revoked", w.Code)
+	}
+	if w := read(link); w.Code != http.StatusNotFound {
+		t.Errorf("HandleShare() status = %v, want %v for a revoked link", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	store := &mockStore{
+		chats: []models.Chat{
+			{ID: "1", Title: "Alice Chat", UserID: "alice"},
+			{ID: "2", Title: "Bob Chat", UserID: "bob"},
+		},
+		messages: map[string][]models.Message{},
+	}
+	access := handlers.Access{Roles: map[string]handlers.UserRole{
+		"alice": handlers.UserRoleAdmin,
+		"vic":   handlers.UserRoleViewer,
+	}}
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-User"), handlers.WithAccess(access))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", main.HandleHome)
+	mux.HandleFunc("/chats", main.HandleChats)
+	mux.HandleFunc("/chats/info", main.HandleChatInfo)
+	mux.HandleFunc("/admin/usage", main.HandleUsage)
+	mux.HandleFunc("/api/v1/chats", main.HandleAPIChats)
+	handler := main.AccessControl(mux)
+
+	serve := func(method, target, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader("message=Hello"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		user   string
+		want   int
+	}{
+		{"viewer sends a message", http.MethodPost, "/chats", "vic", http.StatusForbidden},
+		{"member opens an admin page", http.MethodGet, "/admin/usage", "bob", http.StatusForbidden},
+		{"admin opens an admin page", http.MethodGet, "/admin/usage", "alice", http.StatusOK},
+		{"member opens the chat of another user", http.MethodGet, "/?chat_id=1", "bob", http.StatusNotFound},
+		{"member opens the info of another user's chat", http.MethodGet, "/chats/info?chat_id=1", "bob",
+			http.StatusNotFound},
+		{"member opens their chat", http.MethodGet, "/?chat_id=2", "bob", http.StatusOK},
+		{"admin opens the chat of another user", http.MethodGet, "/?chat_id=2", "alice", http.StatusOK},
+		{"member sends a message to another user's chat", http.MethodPost, "/chats?chat_id=1", "bob",
+			http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(tt.method, tt.target, tt.user); w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+
+	body := serve(http.MethodGet, "/", "bob").Body.String()
+	if !strings.Contains(body, "Bob Chat") || strings.Contains(body, "Alice Chat") {
+		t.Errorf("HandleHome() chat list doesn't only show the chats of the member")
+	}
+	if body := serve(http.MethodGet, "/", "vic").Body.String(); !strings.Contains(body, "chat-read-only") {
+		t.Errorf("HandleHome() shows the message form to a viewer")
+	}
+	if body := serve(http.MethodGet, "/api/v1/chats", "bob").Body.String(); strings.Contains(body, "Alice Chat") {
+		t.Errorf("HandleAPIChats() body = %s, want only the chats of the member", body)
+	}
+
+	_, err = handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithAccess(handlers.Access{DefaultRole: "owner"}))
+	if err == nil {
+		t.Error("NewMain() error = nil, want an error for an unknown role")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	store := &mockStore{messages: map[string][]models.Message{}}
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-User"), handlers.WithSessions(handlers.Sessions{Enabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", main.HandleHome)
+	mux.HandleFunc("/settings/sessions", main.HandleSessions)
+	mux.HandleFunc("/settings/sessions/revoke", main.HandleSessionRevoke)
+	handler := main.Sessions(mux)
+
+	serve := func(method, target, user string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("X-User", user)
+		req.Header.Set("User-Agent", "TestBrowser/1.0")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(http.MethodGet, "/", "alice")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "mcpwebui_session" {
+		t.Fatalf("cookies = %v, want the session cookie", cookies)
+	}
+	cookie := cookies[0]
+	if len(store.sessions) != 1 || store.sessions[0].UserID != "alice" || store.sessions[0].Hash == cookie.Value {
+		t.Fatalf("sessions = %+v, want a session of alice storing the hash of the cookie", store.sessions)
+	}
+
+	body := serve(http.MethodGet, "/settings/sessions", "alice", cookie).Body.String()
+	if !strings.Contains(body, "TestBrowser/1.0") || !strings.Contains(body, "This browser") {
+		t.Errorf("sessions page doesn't list the current session: %s", body)
+	}
+	if w := serve(http.MethodGet, "/", "bob", cookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("status of another user = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+
+	w = serve(http.MethodGet, "/", "alice")
+	cookie = w.Result().Cookies()[0]
+	revoke := httptest.NewRequest(http.MethodPost, "/settings/sessions/revoke",
+		strings.NewReader("id="+store.sessions[0].ID))
+	revoke.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	revoke.Header.Set("X-User", "alice")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, revoke)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("revoke status = %v, want %v", w.Code, http.StatusSeeOther)
+	}
+	if len(store.sessions) != 0 {
+		t.Errorf("sessions = %+v, want none after the revoke", store.sessions)
+	}
+	w = serve(http.MethodGet, "/", "alice", cookie)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status of the revoked session = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].MaxAge >= 0 {
+		t.Errorf("cookies = %v, want the session cookie cleared", c)
+	}
+}
+
+func TestUserData(t *testing.T) {
+	text := []models.Content{{Type: models.ContentTypeText, Text: "Hi"}}
+	store := &mockStore{
+		chats: []models.Chat{
+			{ID: "1", Title: "Alice Chat", UserID: "alice"},
+			{ID: "2", Title: "Bob Chat", UserID: "bob"},
+		},
+		messages: map[string][]models.Message{
+			"1": {{ID: "m1", Role: models.RoleUser, Contents: text}},
+			"2": {{ID: "m2", Role: models.RoleUser, Contents: text}},
+		},
+		memories: []models.Memory{
+			{ID: "f1", UserID: "alice", Text: "Likes Go"},
+			{ID: "f2", UserID: "bob", Text: "Likes Rust"},
+		},
+		tokens:   []models.APIToken{{ID: "t1", UserID: "alice", Hash: "secret"}},
+		usages:   []models.Usage{{UserID: "alice", Day: "2024-01-01", Messages: 3}},
+		receipts: []models.ReadReceipt{{UserID: "alice", ChatID: "2", MessageID: "m2"}},
+	}
+	main, err := handlers.NewMain(&mockLLM{}, &mockLLM{}, store, nil, slog.Default(), templates,
+		handlers.WithUserHeader("X-User"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/settings/data", nil)
+	req.Header.Set("X-User", "alice")
+	w := httptest.NewRecorder()
+	main.HandleUserData(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "1 chats you created") {
+		t.Errorf("HandleUserData() status = %v, body = %s, want the data of the user", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/settings/data/export", nil)
+	req.Header.Set("X-User", "alice")
+	w = httptest.NewRecorder()
+	main.HandleUserDataExport(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleUserDataExport() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(data)
+	}
+	if _, ok := files["chats/2.json"]; ok || !strings.Contains(files["chats/1.json"], "Alice Chat") {
+		t.Errorf("exported chats = %v, want only the chats of the user", slices.Collect(maps.Keys(files)))
+	}
+	if !strings.Contains(files["memories.json"], "Likes Go") || strings.Contains(files["memories.json"], "Rust") {
+		t.Errorf("exported memories = %s, want the memories of the user", files["memories.json"])
+	}
+	if strings.Contains(files["api_tokens.json"], "secret") {
+		t.Errorf("exported API tokens = %s, want them without their hashes", files["api_tokens.json"])
+	}
+
+	erase := func(confirm string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/settings/data/erase", strings.NewReader("confirm="+confirm))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-User", "alice")
+		w := httptest.NewRecorder()
+		main.HandleUserDataErase(w, req)
+		return w
+	}
+	if w := erase("yes"); w.Code != http.StatusBadRequest || len(store.chats) != 2 {
+		t.Errorf("HandleUserDataErase() without confirmation status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+	if w := erase("erase"); w.Code != http.StatusSeeOther {
+		t.Fatalf("HandleUserDataErase() status = %v, want %v", w.Code, http.StatusSeeOther)
+	}
+	if len(store.chats) != 1 || store.chats[0].ID != "2" || len(store.messages["2"]) != 1 {
+		t.Errorf("chats = %+v, want only the chats of the other users", store.chats)
+	}
+	if len(store.memories) != 1 || len(store.tokens) != 0 || len(store.usages) != 0 || len(store.receipts) != 0 {
+		t.Errorf("store = %+v, want the data of the user erased", store)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/audit", nil)
+	w = httptest.NewRecorder()
+	main.HandleAudit(w, req)
+	var entries []models.AuditEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Action != models.AuditActionUserErase ||
+		entries[1].Action != models.AuditActionUserExport || entries[0].UserID != "alice" {
+		t.Errorf("audit entries = %+v, want the erasure and the export of the user", entries)
+	}
+}
+
+func (m mockLLM) Chat(_ context.Context, _ []models.Message, _ []mcp.Tool) iter.Seq2[models.Content, error] {
+	return func(yield func(models.Content, error) bool) {
+		if m.err != nil {
+			yield(models.Content{}, m.err)
+			return
+		}
+		for _, resp := range m.responses {
+			if !yield(models.Content{
+				Type: models.ContentTypeText,
+				Text: resp,
+			}, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (m mockTokenCountingLLM) CountTokens(_ context.Context, messages []models.Message, _ []mcp.Tool) int {
+	return 1000 * len(messages)
+}
+
+func (m mockLLM) GenerateTitle(_ context.Context, _, _ string) (string, error) {
+	return "Test Chat", nil
+}
+
+func (m *mockStore) Chats(_ context.Context) ([]models.Chat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	// The chats are cloned like a real store, as UpdateChat replaces them in place.
+	return slices.Clone(m.chats), nil
+}
+
+func (m *mockStore) AddChat(_ context.Context, chat models.Chat) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return "", m.err
+	}
+	m.chats = append(m.chats, chat)
+	return chat.ID, nil
+}
+
+func (m *mockStore) CopyChat(_ context.Context, chatID string, chat models.Chat) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return "", m.err
+	}
+	m.chats = append(m.chats, chat)
+	newIDs := make(map[string]string)
+	for _, msg := range m.messages[chatID] {
+		newIDs[msg.ID] = uuid.New().String()
+		msg.ID = newIDs[msg.ID]
+		if msg.ParentID != "" {
+			msg.ParentID = newIDs[msg.ParentID]
+		}
+		msg.Contents = slices.Clone(msg.Contents)
+		m.messages[chat.ID] = append(m.messages[chat.ID], msg)
+	}
+	return chat.ID, nil
+}
+
+func (m *mockStore) UpdateChat(_ context.Context, chat models.Chat) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	idx := slices.IndexFunc(m.chats, func(c models.Chat) bool { return c.ID == chat.ID })
+	if idx == -1 {
+		return fmt.Errorf("chat not found")
+	}
+	m.chats[idx] = chat
+	return m.err
+}
+
+func (m *mockStore) DeleteChat(_ context.Context, chatID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	m.chats = slices.DeleteFunc(m.chats, func(c models.Chat) bool { return c.ID == chatID })
+	delete(m.messages, chatID)
+	m.receipts = slices.DeleteFunc(m.receipts, func(r models.ReadReceipt) bool { return r.ChatID == chatID })
+	return nil
+}
+
+func (m *mockStore) Messages(_ context.Context, chatID string) ([]models.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	// The messages are cloned like a real store, as UpdateMessage replaces them in place.
+	return slices.Clone(m.messages[chatID]), nil
+}
+
+func (m *mockStore) MessagePath(_ context.Context, chatID, messageID string) ([]models.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	path := models.MessagePath(m.messages[chatID], messageID)
+	if path == nil {
+		return nil, fmt.Errorf("message %s not found", messageID)
+	}
+	return slices.Clone(path), nil
+}
+
+func (m *mockStore) ChatStats(_ context.Context, chatID string) (models.ChatStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return models.ChatStats{}, m.err
+	}
+	var stats models.ChatStats
+	for _, msg := range m.messages[chatID] {
+		stats.Add(msg)
+	}
+	return stats, nil
+}
+
+func (m *mockStore) MessagesSince(_ context.Context, chatID string, since time.Time) ([]models.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	var msgs []models.Message
+	for _, msg := range m.messages[chatID] {
+		if !msg.Timestamp.Before(since) {
+			msgs = append(msgs, msg)
+		}
+	}
+	slices.SortStableFunc(msgs, func(a, b models.Message) int { return a.Timestamp.Compare(b.Timestamp) })
+	return msgs, nil
+}
+
+func (m *mockStore) AddMessage(_ context.Context, chatID string, msg models.Message) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return "", m.err
+	}
+	m.messages[chatID] = append(m.messages[chatID], msg)
+	return msg.ID, nil
+}
+
+func (m *mockStore) UpdateMessage(_ context.Context, chatID string, msg models.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	idx := slices.IndexFunc(m.messages[chatID], func(mm models.Message) bool { return mm.ID == msg.ID })
+	if idx >= 0 {
+		m.messages[chatID][idx] = msg
+	}
+	return nil
+}
+
+func (m *mockStore) APITokens(_ context.Context, userID string) ([]models.APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	var tokens []models.APIToken
+	for _, t := range m.tokens {
+		if t.UserID == userID {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+func (m *mockStore) APITokenByHash(_ context.Context, hash string) (models.APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return models.APIToken{}, m.err
+	}
+	for _, t := range m.tokens {
+		if t.Hash == hash {
+			return t, nil
+		}
+	}
+	return models.APIToken{}, nil
+}
+
+func (m *mockStore) AddAPIToken(_ context.Context, token models.APIToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	m.tokens = append(m.tokens, token)
+	return nil
+}
+
+func (m *mockStore) DeleteAPIToken(_ context.Context, userID, tokenID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	m.tokens = slices.DeleteFunc(m.tokens, func(t models.APIToken) bool {
+		return t.ID == tokenID && t.UserID == userID
+	})
+	return nil
+}
+
+func (m *mockStore) Sessions(_ context.Context, userID string) ([]models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	var sessions []models.Session
+	for _, s := range m.sessions {
+		if s.UserID == userID {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *mockStore) SessionByHash(_ context.Context, hash string) (models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return models.Session{}, m.err
+	}
+	for _, s := range m.sessions {
+		if s.Hash == hash {
+			return s, nil
+		}
+	}
+	return models.Session{}, nil
+}
+
+func (m *mockStore) SaveSession(_ context.Context, session models.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	idx := slices.IndexFunc(m.sessions, func(s models.Session) bool { return s.Hash == session.Hash })
+	if idx < 0 {
+		m.sessions = append(m.sessions, session)
+		return nil
+	}
+	m.sessions[idx] = session
+	return nil
+}
+
+func (m *mockStore) DeleteSession(_ context.Context, userID, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	m.sessions = slices.DeleteFunc(m.sessions, func(s models.Session) bool {
+		return s.ID == sessionID && s.UserID == userID
+	})
+	return nil
+}
+
+func (m *mockStore) Memories(_ context.Context, userID string) ([]models.Memory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	var memories []models.Memory
+	for _, mem := range m.memories {
+		if mem.UserID == userID {
+			memories = append(memories, mem)
+		}
+	}
+	return memories, nil
+}
+
+func (m *mockStore) SaveMemory(_ context.Context, memory models.Memory) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	idx := slices.IndexFunc(m.memories, func(mem models.Memory) bool {
+		return mem.ID == memory.ID && mem.UserID == memory.UserID
+	})
+	if idx < 0 {
+		m.memories = append(m.memories, memory)
+		return nil
+	}
+	m.memories[idx] = memory
+	return nil
+}
+
+func (m *mockStore) DeleteMemory(_ context.Context, userID, memoryID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	m.memories = slices.DeleteFunc(m.memories, func(mem models.Memory) bool {
+		return mem.ID == memoryID && mem.UserID == userID
+	})
+	return nil
+}
+
+func (m *mockStore) ReadReceipts(_ context.Context, userID string) ([]models.ReadReceipt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	var receipts []models.ReadReceipt
+	for _, r := range m.receipts {
+		if r.UserID == userID {
+			receipts = append(receipts, r)
+		}
+	}
+	return receipts, nil
+}
+
+func (m *mockStore) SaveReadReceipt(_ context.Context, receipt models.ReadReceipt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	idx := slices.IndexFunc(m.receipts, func(r models.ReadReceipt) bool {
+		return r.UserID == receipt.UserID && r.ChatID == receipt.ChatID
+	})
+	if idx < 0 {
+		m.receipts = append(m.receipts, receipt)
+		return nil
+	}
+	m.receipts[idx] = receipt
+	return nil
+}
+
+func (m *mockStore) Usage(_ context.Context, userID, day string) (models.Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return models.Usage{}, m.err
+	}
+	for _, u := range m.usages {
+		if u.UserID == userID && u.Day == day {
+			return u, nil
+		}
+	}
+	return models.Usage{UserID: userID, Day: day}, nil
+}
+
+func (m *mockStore) Usages(_ context.Context, day string) ([]models.Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	var usages []models.Usage
+	for _, u := range m.usages {
+		if u.Day == day {
+			usages = append(usages, u)
+		}
+	}
+	return usages, nil
+}
+
+func (m *mockStore) AddUsage(_ context.Context, usage models.Usage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	for i, u := range m.usages {
+		if u.UserID == usage.UserID && u.Day == usage.Day {
+			m.usages[i].Messages += usage.Messages
+			m.usages[i].Tokens += usage.Tokens
+			return nil
+		}
+	}
+	m.usages = append(m.usages, usage)
+	return nil
+}
+
+func (m *mockStore) Spends(_ context.Context, provider, month string) ([]models.Spend, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	var spends []models.Spend
+	for _, s := range m.spends {
+		if s.Provider == provider && strings.HasPrefix(s.Day, month+"-") {
+			spends = append(spends, s)
+		}
+	}
+	return spends, nil
+}
+
+func (m *mockStore) AddSpend(_ context.Context, spend models.Spend) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	for i, s := range m.spends {
+		if s.Provider == spend.Provider && s.Day == spend.Day {
+			m.spends[i].InputTokens += spend.InputTokens
+			m.spends[i].OutputTokens += spend.OutputTokens
+			m.spends[i].Cost += spend.Cost
+			return nil
+		}
+	}
+	m.spends = append(m.spends, spend)
+	return nil
+}
+
+func (m *mockStore) UserUsages(_ context.Context, userID string) ([]models.Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	var usages []models.Usage
+	for _, u := range m.usages {
+		if u.UserID == userID {
+			usages = append(usages, u)
+		}
+	}
+	return usages, nil
+}
+
+func (m *mockStore) DeleteUserData(_ context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	m.usages = slices.DeleteFunc(m.usages, func(u models.Usage) bool { return u.UserID == userID })
+	m.tokens = slices.DeleteFunc(m.tokens, func(t models.APIToken) bool { return t.UserID == userID })
+	m.sessions = slices.DeleteFunc(m.sessions, func(s models.Session) bool { return s.UserID == userID })
+	m.memories = slices.DeleteFunc(m.memories, func(mem models.Memory) bool { return mem.UserID == userID })
+	m.receipts = slices.DeleteFunc(m.receipts, func(r models.ReadReceipt) bool { return r.UserID == userID })
+	return nil
+}
+
+func (m *mockStore) AuditEntries(_ context.Context) ([]models.AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	entries := slices.Clone(m.audit)
+	slices.Reverse(entries)
+	return entries, nil
+}
+
+func (m *mockStore) AddAuditEntry(_ context.Context, entry models.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	m.audit = append(m.audit, entry)
+	return nil
+}
+
+func (m *mockStore) MCPServerStates(_ context.Context) ([]models.MCPServerState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	return slices.Clone(m.servers), nil
+}
+
+func (m *mockStore) SaveMCPServerState(_ context.Context, state models.MCPServerState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	idx := slices.IndexFunc(m.servers, func(s models.MCPServerState) bool { return s.Key == state.Key })
+	if idx < 0 {
+		m.servers = append(m.servers, state)
+		return nil
+	}
+	m.servers[idx] = state
+	return nil
+}
+
+func (m *mockStore) Schedules(_ context.Context) ([]models.Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Clone(m.schedules), m.err
+}
+
+func (m *mockStore) SaveSchedule(_ context.Context, schedule models.Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	m.schedules = slices.DeleteFunc(m.schedules, func(s models.Schedule) bool { return s.Name == schedule.Name })
+	m.schedules = append(m.schedules, schedule)
+	return nil
+}
+
+func (m *mockStore) ScheduleRuns(_ context.Context, _ string) ([]models.ScheduleRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return nil, m.err
+}
+
+func (m *mockStore) AddScheduleRun(_ context.Context, _ models.ScheduleRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err
+}
+
+func (m *mockMaintainerStore) Compact(_ context.Context) error {
+	m.compacted = true
+	return nil
+}
+
+func (m *mockMaintainerStore) CheckIntegrity(_ context.Context) error {
+	return m.integrityErr
+}
+
+func (m *mockMaintainerStore) DeleteOrphanedMessages(_ context.Context) (int, error) {
+	deleted := 0
+	for chatID := range m.messages {
+		if !slices.ContainsFunc(m.chats, func(c models.Chat) bool { return c.ID == chatID }) {
+			delete(m.messages, chatID)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *mockSnapshotStore) Snapshot(_ context.Context, w io.Writer) error {
+	_, err := io.WriteString(w, m.data)
+	return err
+}
+
+func (s *usageCountingStore) AddUsage(ctx context.Context, usage models.Usage) error {
+	defer s.added.Add(1)
+	return s.mockStore.AddUsage(ctx, usage)
+}
+
+func (s stalledStore) Chats(ctx context.Context) ([]models.Chat, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *flakyStore) UpdateMessage(ctx context.Context, chatID string, msg models.Message) error {
+	s.mu.Lock()
+	if s.failures > 0 {
+		s.failures--
+		s.mu.Unlock()
+		return errors.New("disk I/O error")
+	}
+	s.mu.Unlock()
+	return s.mockStore.UpdateMessage(ctx, chatID, msg)
+}
+
+func (m *mockBackupDestination) Put(_ context.Context, name string, r io.Reader, _ int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.files[name] = data
+	return nil
+}
+
+func (m *mockBackupDestination) List(_ context.Context) ([]string, error) {
+	return slices.Collect(maps.Keys(m.files)), nil
+}
+
+func (m *mockBackupDestination) Delete(_ context.Context, name string) error {
+	delete(m.files, name)
+	return nil
+}
+
+func (m *mockExporter) ExportGeneration(_ context.Context, g models.Generation) {
+	m.generations = append(m.generations, g)
+}
+
+func (m *mockTitleGenerator) GenerateTitle(_ context.Context, message, language string) (string, error) {
+	m.mu.Lock()
+	m.active++
+	m.maxActive = max(m.maxActive, m.active)
+	m.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+	m.calls++
+	if m.languages == nil {
+		m.languages = make(map[string]string)
+	}
+	m.languages[message] = language
+	if m.err != nil {
+		return "", m.err
+	}
+	return "Generated title", nil
+}
+
+func (m *mockNotifier) Notify(_ context.Context, event models.Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+}
+
+func (m *mockBridge) Name() string {
+	return "test"
+}
+
+func (m *mockBridge) Receive(ctx context.Context) ([]models.BridgeMessage, error) {
+	select {
+	case msg := <-m.incoming:
+		return []models.BridgeMessage{msg}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (m *mockBridge) Reply(_ context.Context, reply models.BridgeReply) (string, error) {
+	if reply.Final {
+		m.replies <- reply
+	}
+	return "reply", nil
+}
+
+func TestResponseLimit(t *testing.T) {
+	// Every response streams 80 characters, the limit of 10 tokens stopping it after 40 of them.
+	var systemPrompt string
+	llm := handlers.LLMFunc(func(
+		ctx context.Context, _ []models.Message, _ []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		systemPrompt = models.SystemPrompt(ctx, "")
+		chunk := strings.Repeat("a", 20)
+		return mockLLM{responses: []string{chunk, chunk, chunk, chunk}}.Chat(ctx, nil, nil)
+	})
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, mockLLM{}, store, nil, slog.Default(),
+		templates, handlers.WithResponseLimit(handlers.ResponseLimit{Tokens: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// waitLimited waits for the response of the chat to be stopped at the limit, and returns it.
+	waitLimited := func() models.Message {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			msgs, _ := store.Messages(context.Background(), "1")
+			if len(msgs) > 0 && msgs[len(msgs)-1].LengthLimited {
+				return msgs[len(msgs)-1]
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("messages = %+v, want the response stopped at the limit", msgs)
+			}
+		}
+	}
+	continueMessage := func(messageID string) *httptest.ResponseRecorder {
+		form := url.Values{"chat_id": {"1"}, "message_id": {messageID}}
+		req := httptest.NewRequest(http.MethodPost, "/chats/continue", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		main.HandleContinue(w, req)
+		return w
+	}
+
+	form := url.Values{"chat_id": {"1"}, "message": {"Tell me a story"}}
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	main.HandleChats(httptest.NewRecorder(), req)
+
+	aiMsg := waitLimited()
+	if got := aiMsg.Contents[0].Text; len(got) != 40 {
+		t.Errorf("response text length = %d, want 40", len(got))
+	}
+
+	w := httptest.NewRecorder()
+	main.HandleHome(w, httptest.NewRequest(http.MethodGet, "/?chat_id=1", nil))
+	if !strings.Contains(w.Body.String(), "Continue generating") {
+		t.Errorf("HandleHome() body doesn't contain the button to continue the response")
+	}
+
+	if w := continueMessage("unknown"); w.Code != http.StatusConflict {
+		t.Errorf("HandleContinue() of an unknown message status = %v, want %v", w.Code, http.StatusConflict)
+	}
+
+	// The continuation appends to the same message, with another budget of tokens.
+	if w := continueMessage(aiMsg.ID); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), aiMsg.ID) {
+		t.Fatalf("HandleContinue() status = %v, body = %s, want the continued message", w.Code, w.Body)
+	}
+	aiMsg = waitLimited()
+	var text strings.Builder
+	for _, c := range aiMsg.Contents {
+		text.WriteString(c.Text)
+	}
+	if got := text.Len(); got != 80 {
+		t.Errorf("continued response text length = %d, want 80", got)
+	}
+	if !strings.Contains(systemPrompt, "Continue it exactly where it stopped") {
+		t.Errorf("system prompt = %q, want the instructions to continue the response", systemPrompt)
+	}
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	// The first response is truncated by the LLM at its maximum tokens, the second one finishes it.
+	var calls atomic.Int32
+	llm := handlers.LLMFunc(func(
+		context.Context, []models.Message, []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		return func(yield func(models.Content, error) bool) {
+			if calls.Add(1) > 1 {
+				yield(models.Content{Type: models.ContentTypeText, Text: " a time"}, nil)
+				return
+			}
+			if yield(models.Content{Type: models.ContentTypeText, Text: "Once upon"}, nil) {
+				yield(models.Content{Type: models.ContentTypeFinish, FinishReason: models.FinishReasonLength}, nil)
+			}
+		}
+	})
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, mockLLM{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	textOf := func(msg models.Message) string {
+		var text strings.Builder
+		for _, c := range msg.Contents {
+			text.WriteString(c.Text)
+		}
+		return text.String()
+	}
+	// waitResponse waits for the response of the chat to be generated with text, and returns it.
+	waitResponse := func(text string) models.Message {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			msgs, _ := store.Messages(context.Background(), "1")
+			if len(msgs) > 0 && msgs[len(msgs)-1].Stats != nil && textOf(msgs[len(msgs)-1]) == text {
+				return msgs[len(msgs)-1]
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("messages = %+v, want the response %q", msgs, text)
+			}
+		}
+	}
+
+	form := url.Values{"chat_id": {"1"}, "message": {"Tell me a story"}}
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	main.HandleChats(httptest.NewRecorder(), req)
+
+	aiMsg := waitResponse("Once upon")
+	if aiMsg.FinishReason != models.FinishReasonLength {
+		t.Errorf("response FinishReason = %q, want %q", aiMsg.FinishReason, models.FinishReasonLength)
+	}
+
+	w := httptest.NewRecorder()
+	main.HandleHome(w, httptest.NewRequest(http.MethodGet, "/?chat_id=1", nil))
+	if body := w.Body.String(); !strings.Contains(body, "maximum output tokens") ||
+		!strings.Contains(body, "Continue generating") {
+		t.Errorf("HandleHome() body doesn't contain the button to continue the truncated response")
+	}
+
+	form = url.Values{"chat_id": {"1"}, "message_id": {aiMsg.ID}}
+	req = httptest.NewRequest(http.MethodPost, "/chats/continue", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	main.HandleContinue(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleContinue() status = %v, body = %s, want %v", w.Code, w.Body, http.StatusOK)
+	}
+
+	// The continuation is appended to the text of the truncated response.
+	aiMsg = waitResponse("Once upon a time")
+	if len(aiMsg.Contents) != 1 {
+		t.Errorf("continued response contents = %+v, want a single text", aiMsg.Contents)
+	}
+	if aiMsg.FinishReason != "" {
+		t.Errorf("continued response FinishReason = %q, want none", aiMsg.FinishReason)
+	}
+}
+
+func TestFinishReason(t *testing.T) {
+	llm := handlers.LLMFunc(func(
+		context.Context, []models.Message, []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		return func(yield func(models.Content, error) bool) {
+			if yield(models.Content{Type: models.ContentTypeText, Text: "I can't help with that."}, nil) {
+				yield(models.Content{Type: models.ContentTypeFinish, FinishReason: models.FinishReasonRefusal}, nil)
+			}
+		}
+	})
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, mockLLM{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/chats/{chatID}/messages", main.HandleAPIMessages)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/chats/1/messages", strings.NewReader(`{"text":"Hello"}`))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	var res struct {
+		Message *struct {
+			FinishReason string `json:"finishReason"`
+		} `json:"message"`
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Message == nil || res.Message.FinishReason != string(models.FinishReasonRefusal) {
+		t.Fatalf("HandleAPIMessages() last response = %s, want the message refused", lines[len(lines)-1])
+	}
+
+	// The refusal is explained under the message, which can't be continued.
+	w = httptest.NewRecorder()
+	main.HandleHome(w, httptest.NewRequest(http.MethodGet, "/?chat_id=1", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "The model refused to respond.") {
+		t.Errorf("HandleHome() body doesn't explain the refusal of the response")
+	}
+	if strings.Contains(body, "Continue generating") {
+		t.Errorf("HandleHome() body contains the button to continue a refused response")
+	}
+}
+
+func TestInterruptedResponse(t *testing.T) {
+	// The first response fails halfway, the second one completes it.
+	var calls atomic.Int32
+	llm := handlers.LLMFunc(func(
+		context.Context, []models.Message, []mcp.Tool,
+	) iter.Seq2[models.Content, error] {
+		return func(yield func(models.Content, error) bool) {
+			if calls.Add(1) > 1 {
+				yield(models.Content{Type: models.ContentTypeText, Text: " a time"}, nil)
+				return
+			}
+			if yield(models.Content{Type: models.ContentTypeText, Text: "Once upon"}, nil) {
+				yield(models.Content{}, errors.New("connection reset by peer"))
+			}
+		}
+	})
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{},
+	}
+	main, err := handlers.NewMain(llm, mockLLM{}, store, nil, slog.Default(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// waitResponse waits for the last message of the chat to satisfy done, and returns it.
+	waitResponse := func(done func(models.Message) bool) models.Message {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			msgs, _ := store.Messages(context.Background(), "1")
+			if len(msgs) > 0 && done(msgs[len(msgs)-1]) {
+				return msgs[len(msgs)-1]
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("messages = %+v, want the response generated", msgs)
+			}
+		}
+	}
+
+	form := url.Values{"chat_id": {"1"}, "message": {"Tell me a story"}}
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	main.HandleChats(httptest.NewRecorder(), req)
+
+	// The partial text is kept with the error.
+	aiMsg := waitResponse(func(msg models.Message) bool { return msg.Interruption != "" })
+	if got := aiMsg.Contents[0].Text; got != "Once upon" {
+		t.Errorf("interrupted response text = %q, want the partial text", got)
+	}
+	if !strings.Contains(aiMsg.Interruption, "connection reset by peer") {
+		t.Errorf("response Interruption = %q, want the error of the provider", aiMsg.Interruption)
+	}
+
+	w := httptest.NewRecorder()
+	main.HandleHome(w, httptest.NewRequest(http.MethodGet, "/?chat_id=1", nil))
+	if body := w.Body.String(); !strings.Contains(body, "Interrupted by an error") || !strings.Contains(body, "Resume") {
+		t.Errorf("HandleHome() body doesn't contain the button to resume the interrupted response")
+	}
+
+	form = url.Values{"chat_id": {"1"}, "message_id": {aiMsg.ID}}
+	req = httptest.NewRequest(http.MethodPost, "/chats/continue", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	main.HandleContinue(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleContinue() status = %v, body = %s, want %v", w.Code, w.Body, http.StatusOK)
+	}
+
+	aiMsg = waitResponse(func(msg models.Message) bool { return msg.Stats != nil && msg.Interruption == "" })
+	if len(aiMsg.Contents) != 1 || aiMsg.Contents[0].Text != "Once upon a time" {
+		t.Errorf("resumed response contents = %+v, want the completed text", aiMsg.Contents)
+	}
 }
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Maintenance schedules the maintenance of the store.
+type Maintenance struct {
+	// Cron is a standard five-field cron expression of the maintenance runs, evaluated in the server's
+	// local time.
+	Cron string
+}
+
+// Maintainer is implemented by the stores that support the maintenance tasks, like the BoltDB store.
+type Maintainer interface {
+	Compactor
+	// CheckIntegrity returns an error describing the inconsistencies of the stored data, if any.
+	CheckIntegrity(ctx context.Context) error
+	// DeleteOrphanedMessages deletes the messages of the chats that no longer exist, and returns the number
+	// of chats whose messages were deleted.
+	DeleteOrphanedMessages(ctx context.Context) (int, error)
+}
+
+type maintenanceResult struct {
+	IntegrityError  string `json:"integrityError,omitempty"`
+	OrphanedBuckets int    `json:"orphanedBuckets"`
+	Compacted       bool   `json:"compacted"`
+}
+
+// WithMaintenance runs the maintenance tasks of the store on the given schedule. NewMain returns an error
+// if the cron expression is invalid, or the store doesn't implement Maintainer.
+func WithMaintenance(maintenance Maintenance) MainOption {
+	return func(m *Main) {
+		m.maintenance = maintenance
+	}
+}
+
+func (m *Main) parseMaintenance() error {
+	if m.maintenance.Cron == "" {
+		return nil
+	}
+	if _, ok := m.storeBackend.(Maintainer); !ok {
+		return fmt.Errorf("store doesn't support maintenance")
+	}
+	c, err := parseCron(m.maintenance.Cron)
+	if err != nil {
+		return fmt.Errorf("invalid cron expression of maintenance: %w", err)
+	}
+	m.maintenanceCron = c
+	return nil
+}
+
+// runMaintenanceScheduler wakes up at the start of every minute and runs the maintenance if its schedule
+// matches it, until Main is shut down.
+func (m *Main) runMaintenanceScheduler() {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-m.backgroundDone:
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		if m.maintenanceCron.matches(next) {
+			ctx := context.Background()
+			if _, err := m.maintain(ctx); err != nil {
+				m.logger.ErrorContext(ctx, "Failed to run maintenance", slog.String(errLoggerKey, err.Error()))
+			}
+		}
+	}
+}
+
+// maintain checks the integrity of the store, then deletes the orphaned messages and compacts it. The
+// store is left untouched if the integrity check fails, as the corrupted data would be copied otherwise.
+func (m *Main) maintain(ctx context.Context) (maintenanceResult, error) {
+	mt, ok := m.storeBackend.(Maintainer)
+	if !ok {
+		return maintenanceResult{}, fmt.Errorf("store doesn't support maintenance")
+	}
+
+	var res maintenanceResult
+	if err := mt.CheckIntegrity(ctx); err != nil {
+		m.logger.ErrorContext(ctx, "Store integrity check failed", slog.String(errLoggerKey, err.Error()))
+		res.IntegrityError = err.Error()
+		return res, nil
+	}
+
+	var err error
+	if res.OrphanedBuckets, err = mt.DeleteOrphanedMessages(ctx); err != nil {
+		return res, fmt.Errorf("failed to delete orphaned messages: %w", err)
+	}
+	if err := mt.Compact(ctx); err != nil {
+		return res, fmt.Errorf("failed to compact store: %w", err)
+	}
+	res.Compacted = true
+
+	m.logger.InfoContext(ctx, "Store maintenance completed", slog.Int("orphanedBuckets", res.OrphanedBuckets))
+	return res, nil
+}
+
+// HandleMaintenance runs the maintenance tasks of the store immediately, and responds with their result
+// as JSON. It responds with 501 Not Implemented if the store doesn't support maintenance.
+func (m *Main) HandleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		m.writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if _, ok := m.storeBackend.(Maintainer); !ok {
+		m.writeAPIError(w, http.StatusNotImplemented, "Store doesn't support maintenance")
+		return
+	}
+
+	res, err := m.maintain(r.Context())
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to run maintenance", slog.String(errLoggerKey, err.Error()))
+		m.writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	m.writeAPIJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// chatMembers is the view of the members of a chat in the chat_members template. Owner is the user who
+// created the chat, and CanManage reports whether UserID, the user of the page, is them, inviting and
+// removing the members.
+type chatMembers struct {
+	ChatID    string
+	Owner     string
+	Members   []string
+	UserID    string
+	CanManage bool
+}
+
+// HandleChatMembers invites a user into a chat, making it a collaborative chat, or removes a member from it.
+// It accepts POST requests with the chat_id and user_id form fields, and the action field, "remove" to remove
+// the member. Only the user who created the chat manages its members, while a member can leave it by
+// removing themselves. It renders the chat_members template.
+func (m *Main) HandleChatMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	memberID := strings.TrimSpace(r.FormValue("user_id"))
+	if memberID == "" {
+		m.renderError(w, http.StatusBadRequest, "User is required")
+		return
+	}
+
+	chatID := r.FormValue("chat_id")
+	c, err := m.findUserChat(r, chatID)
+	if errors.Is(err, errChatNotFound) {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	userID := m.userID(r)
+	remove := r.FormValue("action") == "remove"
+	if !chatOwner(c, userID) && !(remove && memberID == userID) {
+		m.renderError(w, http.StatusForbidden, "Only the user who created the chat manages its members")
+		return
+	}
+	if remove {
+		c.Members = slices.DeleteFunc(slices.Clone(c.Members), func(u string) bool { return u == memberID })
+	} else if !chatOwner(c, memberID) && !slices.Contains(c.Members, memberID) {
+		c.Members = append(c.Members, memberID)
+	}
+
+	if err := m.store.UpdateChat(r.Context(), c); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to update chat members", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := m.templates.ExecuteTemplate(w, "chat_members", newChatMembers(c, userID)); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute chat_members template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func newChatMembers(c models.Chat, userID string) chatMembers {
+	return chatMembers{
+		ChatID:    c.ID,
+		Owner:     chatOwnerID(c),
+		Members:   c.Members,
+		UserID:    userID,
+		CanManage: chatOwner(c, userID),
+	}
+}
+
+// chatOwnerID returns the user who created c. The chats created before the users were recorded, and the
+// ones of the scheduled prompts, belong to the default user.
+func chatOwnerID(c models.Chat) string {
+	if c.UserID == "" {
+		return defaultUserID
+	}
+	return c.UserID
+}
+
+func chatOwner(c models.Chat, userID string) bool {
+	return chatOwnerID(c) == userID
+}
+
+// messageSender returns the sender of msg shown in the chat of chatID, its user if the chat is a
+// collaborative chat.
+func (m *Main) messageSender(ctx context.Context, chatID string, msg models.Message) string {
+	c, err := m.findChat(ctx, chatID)
+	if err != nil {
+		return ""
+	}
+	return chatMessageSender(c, msg)
+}
+
+func chatMessageSender(c models.Chat, msg models.Message) string {
+	if len(c.Members) == 0 {
+		return ""
+	}
+	return msg.UserID
+}
+
+// withSpeakers returns messages with the user messages labelled with their sender, and ctx with the
+// instructions presenting the participants, if the chat of chatID is a collaborative chat. It returns ctx
+// and messages as is otherwise.
+func (m *Main) withSpeakers(
+	ctx context.Context,
+	chatID string,
+	messages []models.Message,
+) (context.Context, []models.Message) {
+	c, err := m.findChat(ctx, chatID)
+	if err != nil || len(c.Members) == 0 {
+		return ctx, messages
+	}
+
+	participants := append([]string{chatOwnerID(c)}, c.Members...)
+	ctx = models.WithSystemPrompt(ctx, fmt.Sprintf("This chat is shared by several users: %s. Every user "+
+		"message starts with the name of its sender in brackets, answer the sender and address the others by "+
+		"their name when it's useful.", strings.Join(participants, ", ")))
+
+	labelled := slices.Clone(messages)
+	for i, msg := range labelled {
+		if msg.Role != models.RoleUser || msg.UserID == "" || len(msg.Contents) == 0 ||
+			msg.Contents[0].Type != models.ContentTypeText {
+			continue
+		}
+		contents := slices.Clone(msg.Contents)
+		contents[0].Text = fmt.Sprintf("[%s] %s", msg.UserID, contents[0].Text)
+		labelled[i].Contents = contents
+	}
+	return ctx, labelled
+}
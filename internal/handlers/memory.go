@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+type memoryPageData struct {
+	Memories []models.Memory
+}
+
+var (
+	errMemoryNotFound     = errors.New("memory not found")
+	errMemoryTextRequired = errors.New("text is required")
+)
+
+// saveMemoryToolName is the name of the built-in tool the LLM calls to remember a fact about the user. It's
+// not offered if an MCP server has a tool of the same name, which takes precedence.
+const saveMemoryToolName = "save_memory"
+
+var saveMemoryTool = mcp.Tool{
+	Name: saveMemoryToolName,
+	Description: "Remember a lasting fact about the user, like their name, preferences or ongoing projects, " +
+		"to know it in the next chats. Don't save the facts only relevant to the current chat.",
+	InputSchema: json.RawMessage(`{"type":"object","properties":{"fact":{"type":"string",` +
+		`"description":"The fact, as a short sentence about the user."}},"required":["fact"]}`),
+}
+
+// WithMemory enables the assistant memory: the facts remembered about the user are given to the LLM in the
+// system prompt of every chat, and the LLM saves new ones with the save_memory tool. The users manage their
+// facts at /settings/memory, and the chats can opt out in their parameters.
+func WithMemory() MainOption {
+	return func(m *Main) {
+		m.memoryEnabled = true
+	}
+}
+
+// HandleMemory renders the memory page of the current user on GET. On POST, it adds the fact of the "text"
+// form field, or replaces the text of the fact given by the "id" field, and redirects back to the page.
+func (m *Main) HandleMemory(w http.ResponseWriter, r *http.Request) {
+	if !m.memoryEnabled {
+		http.Error(w, "Memory is disabled", http.StatusNotFound)
+		return
+	}
+	userID := m.userID(r)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := m.saveUserMemory(r.Context(), userID, r.FormValue("id"), r.FormValue("text")); err != nil {
+			switch {
+			case errors.Is(err, errMemoryTextRequired):
+				http.Error(w, "Text is required", http.StatusBadRequest)
+				return
+			case errors.Is(err, errMemoryNotFound):
+				http.Error(w, "Memory not found", http.StatusNotFound)
+				return
+			}
+			m.logger.ErrorContext(r.Context(), "Failed to save memory", slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/settings/memory", http.StatusSeeOther)
+		return
+	default:
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	memories, err := m.store.Memories(r.Context(), userID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get memories", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := m.renderPage(w, "memory.html", memoryPageData{Memories: memories}); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute memory template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleMemoryDelete deletes the current user's fact given by the "id" form field, and redirects back to the
+// memory page.
+func (m *Main) HandleMemoryDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := m.store.DeleteMemory(r.Context(), m.userID(r), r.FormValue("id")); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to delete memory", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/memory", http.StatusSeeOther)
+}
+
+// saveUserMemory adds a fact of userID with text, or replaces the text of the fact of memoryID if it's not
+// empty.
+func (m *Main) saveUserMemory(ctx context.Context, userID, memoryID, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return errMemoryTextRequired
+	}
+
+	now := time.Now()
+	memory := models.Memory{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		CreatedAt: now,
+	}
+	if memoryID != "" {
+		memories, err := m.store.Memories(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get memories: %w", err)
+		}
+		idx := slices.IndexFunc(memories, func(mem models.Memory) bool { return mem.ID == memoryID })
+		if idx < 0 {
+			return errMemoryNotFound
+		}
+		memory = memories[idx]
+	}
+	memory.Text = text
+	memory.Source = models.MemorySourceUser
+	memory.UpdatedAt = now
+	return m.store.SaveMemory(ctx, memory)
+}
+
+// withMemories returns a copy of ctx carrying the facts remembered about the user of the generation in the
+// system prompt, and whether the memory is active in the chat of chatID. The memory is inactive if it's
+// disabled, or if the chat opted out of it.
+func (m *Main) withMemories(ctx context.Context, chatID string) (context.Context, bool) {
+	if !m.memoryActive(ctx, chatID) {
+		return ctx, false
+	}
+
+	memories, err := m.store.Memories(ctx, generationUser(ctx))
+	if err != nil {
+		// The chat goes on without the memories rather than failing.
+		m.logger.WarnContext(ctx, "Failed to get memories", slog.String(errLoggerKey, err.Error()))
+	}
+
+	var sb strings.Builder
+	if len(memories) > 0 {
+		sb.WriteString("What you remember about the user from the previous chats:\n")
+		for _, memory := range memories {
+			sb.WriteString("- " + memory.Text + "\n")
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString("When the user tells a lasting fact about themselves worth knowing in the next chats, " +
+		"remember it with the " + saveMemoryToolName + " tool.")
+	return models.WithSystemPrompt(ctx, sb.String()), true
+}
+
+func (m *Main) memoryActive(ctx context.Context, chatID string) bool {
+	if !m.memoryEnabled {
+		return false
+	}
+	c, err := m.findChat(ctx, chatID)
+	if err != nil {
+		if !errors.Is(err, errChatNotFound) {
+			m.logger.ErrorContext(ctx, "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		}
+		return false
+	}
+	return !c.MemoryDisabled
+}
+
+// withMemoryTool returns tools with the save_memory tool appended, unless one of them already has its name.
+func withMemoryTool(tools []mcp.Tool) []mcp.Tool {
+	if slices.ContainsFunc(tools, func(t mcp.Tool) bool { return t.Name == saveMemoryToolName }) {
+		return tools
+	}
+	return slices.Concat(tools, []mcp.Tool{saveMemoryTool})
+}
+
+// isMemoryToolCall reports whether a call of the tool of name in the chat of chatID is a call of the built-in
+// save_memory tool.
+func (m *Main) isMemoryToolCall(ctx context.Context, chatID, name string) bool {
+	if name != saveMemoryToolName {
+		return false
+	}
+	if _, ok := m.capabilities().toolsMap[name]; ok {
+		return false
+	}
+	return m.memoryActive(ctx, chatID)
+}
+
+// saveMemory saves the fact of the input of a save_memory call for the user of the generation, and returns
+// the tool result. A fact already remembered isn't saved again.
+func (m *Main) saveMemory(ctx context.Context, input json.RawMessage) (json.RawMessage, bool) {
+	var params struct {
+		Fact string `json:"fact"`
+	}
+	if err := json.Unmarshal(input, &params); err != nil {
+		return callToolError(fmt.Errorf("invalid input: %w", err)), false
+	}
+	fact := strings.TrimSpace(params.Fact)
+	if fact == "" {
+		return callToolError(errors.New("fact is required")), false
+	}
+
+	userID := generationUser(ctx)
+	memories, err := m.store.Memories(ctx, userID)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to get memories", slog.String(errLoggerKey, err.Error()))
+		return callToolError(fmt.Errorf("failed to get memories: %w", err)), false
+	}
+	if slices.ContainsFunc(memories, func(mem models.Memory) bool { return strings.EqualFold(mem.Text, fact) }) {
+		return memoryToolResult("This fact is already remembered."), true
+	}
+
+	now := time.Now()
+	err = m.store.SaveMemory(ctx, models.Memory{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Text:      fact,
+		Source:    models.MemorySourceLLM,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to save memory", slog.String(errLoggerKey, err.Error()))
+		return callToolError(fmt.Errorf("failed to save memory: %w", err)), false
+	}
+	return memoryToolResult("Remembered: " + fact), true
+}
+
+func memoryToolResult(text string) json.RawMessage {
+	res, _ := json.Marshal([]mcp.Content{{Type: mcp.ContentTypeText, Text: text}})
+	return res
+}
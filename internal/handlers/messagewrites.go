@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// messageWrites saves the states of a message being generated, keeping the latest state in memory while the
+// store fails, so that a transient error of the store doesn't abort the generation. The failed write is
+// retried with the next state, once its backoff elapsed, and flush retries it until it succeeds or
+// maxMessageWriteAttempts attempts failed. It's used by a single generation, so it isn't safe for concurrent
+// use.
+type messageWrites struct {
+	// ctx is the context of the generation, for the logs.
+	ctx    context.Context
+	save   func(models.Message) error
+	logger *slog.Logger
+
+	// pending is the latest state of the message that isn't saved yet, nil if the store has the latest one.
+	pending   *models.Message
+	failures  int
+	nextRetry time.Time
+}
+
+const (
+	// minMessageWriteBackoff is the time waited before retrying the first failed write, doubled after every
+	// failure up to maxMessageWriteBackoff.
+	minMessageWriteBackoff = 100 * time.Millisecond
+	maxMessageWriteBackoff = 5 * time.Second
+	// maxMessageWriteAttempts is the number of attempts of flush after which it gives up.
+	maxMessageWriteAttempts = 8
+)
+
+func newMessageWrites(ctx context.Context, save func(models.Message) error, logger *slog.Logger) *messageWrites {
+	return &messageWrites{ctx: ctx, save: save, logger: logger}
+}
+
+// write saves msg, or keeps it in memory if the previous write failed and its backoff didn't elapse yet, or if
+// the write fails. It never fails, the failures being reported by flush.
+func (w *messageWrites) write(msg models.Message) error {
+	if w.pending != nil && time.Now().Before(w.nextRetry) {
+		w.pending = &msg
+		return nil
+	}
+	if err := w.save(msg); err != nil {
+		w.fail(msg, err)
+		return nil
+	}
+	w.pending, w.failures = nil, 0
+	return nil
+}
+
+// flush saves msg, the final state of the message, retrying with backoff while the store fails. It returns the
+// error of the last attempt once maxMessageWriteAttempts attempts failed, or the error of the context of the
+// generation if it's done while waiting for a retry.
+func (w *messageWrites) flush(msg models.Message) error {
+	w.pending = &msg
+	for attempt := 1; ; attempt++ {
+		if wait := time.Until(w.nextRetry); wait > 0 {
+			select {
+			case <-w.ctx.Done():
+				return w.ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		err := w.save(msg)
+		if err == nil {
+			w.pending, w.failures = nil, 0
+			return nil
+		}
+		w.fail(msg, err)
+		if attempt == maxMessageWriteAttempts {
+			// The state is given up, so that it isn't retried again by flushPending.
+			w.pending = nil
+			return err
+		}
+	}
+}
+
+// flushPending saves the state of the message kept in memory, if any, like when the generation is aborted
+// after a failed write, logging the error if it can't be saved.
+func (w *messageWrites) flushPending() {
+	if w.pending == nil {
+		return
+	}
+	if err := w.flush(*w.pending); err != nil {
+		w.logger.ErrorContext(w.ctx, "Failed to update message", slog.String(errLoggerKey, err.Error()))
+	}
+}
+
+func (w *messageWrites) fail(msg models.Message, err error) {
+	w.pending = &msg
+	w.failures++
+	// The shift is capped, as the backoff is capped anyway, so that it doesn't overflow.
+	backoff := min(minMessageWriteBackoff<<min(w.failures-1, 8), maxMessageWriteBackoff)
+	w.nextRetry = time.Now().Add(backoff)
+	w.logger.WarnContext(w.ctx, "Failed to save message, keeping it in memory until the store recovers",
+		slog.String("messageID", msg.ID),
+		slog.Int("failures", w.failures),
+		slog.Duration("retryIn", backoff),
+		slog.String(errLoggerKey, err.Error()))
+}
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// LLMMiddleware wraps an LLM to intercept its chats, such as to log them, retry them or rewrite their
+// messages and responses. The middlewares are registered with WithLLMMiddleware.
+type LLMMiddleware func(LLM) LLM
+
+// LLMFunc is an adapter to use a function as an LLM, to write the middlewares.
+type LLMFunc func(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+) iter.Seq2[models.Content, error]
+
+// namedLLM keeps the model name of an LLM wrapped by the middlewares.
+type namedLLM struct {
+	LLM
+	model string
+}
+
+// Chat implements LLM by calling f.
+func (f LLMFunc) Chat(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+) iter.Seq2[models.Content, error] {
+	return f(ctx, messages, tools)
+}
+
+// WithLLMMiddleware wraps the LLM and the compare LLM with the given middlewares. The first middleware is
+// the outermost, which sees the chats first and the responses last. It can be given multiple times, the
+// middlewares are appended in order.
+func WithLLMMiddleware(middlewares ...LLMMiddleware) MainOption {
+	return func(m *Main) {
+		m.llmMiddlewares = append(m.llmMiddlewares, middlewares...)
+	}
+}
+
+func (n namedLLM) Model() string {
+	return n.model
+}
+
+// wrapLLM applies middlewares to llm, keeping its model name.
+func wrapLLM(llm LLM, middlewares []LLMMiddleware) LLM {
+	if llm == nil || len(middlewares) == 0 {
+		return llm
+	}
+	wrapped := llm
+	for _, mw := range slices.Backward(middlewares) {
+		wrapped = mw(wrapped)
+	}
+	if mn, ok := llm.(modelNamer); ok {
+		return namedLLM{LLM: wrapped, model: mn.Model()}
+	}
+	return wrapped
+}
+
+// LoggingMiddleware logs every chat with its duration, the number of the response chunks and the error, at
+// the debug level if it succeeded and the error level otherwise.
+func LoggingMiddleware(logger *slog.Logger) LLMMiddleware {
+	logger = logger.With(slog.String("module", "llm"))
+	return func(next LLM) LLM {
+		return LLMFunc(func(
+			ctx context.Context, messages []models.Message, tools []mcp.Tool,
+		) iter.Seq2[models.Content, error] {
+			return func(yield func(models.Content, error) bool) {
+				start := time.Now()
+				chunks := 0
+				for content, err := range next.Chat(ctx, messages, tools) {
+					if err != nil {
+						logger.ErrorContext(ctx, "LLM chat failed",
+							slog.Int("messages", len(messages)),
+							slog.Int("chunks", chunks),
+							slog.Duration("duration", time.Since(start)),
+							slog.String(errLoggerKey, err.Error()))
+						yield(content, err)
+						return
+					}
+					chunks++
+					if !yield(content, nil) {
+						return
+					}
+				}
+				logger.DebugContext(ctx, "LLM chat completed",
+					slog.Int("messages", len(messages)),
+					slog.Int("chunks", chunks),
+					slog.Duration("duration", time.Since(start)))
+			}
+		})
+	}
+}
+
+// RetryMiddleware retries the chats failing before their first response chunk up to maxRetries times,
+// waiting backoff before the first retry and doubling it for the next ones. The chats failing after a
+// chunk was streamed aren't retried, as the chunk was already shown to the user.
+func RetryMiddleware(maxRetries int, backoff time.Duration) LLMMiddleware {
+	return func(next LLM) LLM {
+		return LLMFunc(func(
+			ctx context.Context, messages []models.Message, tools []mcp.Tool,
+		) iter.Seq2[models.Content, error] {
+			return func(yield func(models.Content, error) bool) {
+				wait := backoff
+				for attempt := 0; ; attempt++ {
+					streamed := false
+					var chatErr error
+					for content, err := range next.Chat(ctx, messages, tools) {
+						if err != nil {
+							chatErr = err
+							break
+						}
+						streamed = true
+						if !yield(content, nil) {
+							return
+						}
+					}
+					if chatErr == nil {
+						return
+					}
+					if streamed || attempt >= maxRetries || ctx.Err() != nil {
+						yield(models.Content{}, chatErr)
+						return
+					}
+
+					select {
+					case <-ctx.Done():
+						yield(models.Content{}, chatErr)
+						return
+					case <-time.After(wait):
+					}
+					wait *= 2
+				}
+			}
+		})
+	}
+}
+
+// TokenCountingMiddleware calls count with the estimated input and output tokens of every completed chat,
+// such as to export them as metrics. The tokens are estimated from the length of the contents, as the
+// providers don't report them in the same way.
+func TokenCountingMiddleware(count func(ctx context.Context, inputTokens, outputTokens int)) LLMMiddleware {
+	return func(next LLM) LLM {
+		return LLMFunc(func(
+			ctx context.Context, messages []models.Message, tools []mcp.Tool,
+		) iter.Seq2[models.Content, error] {
+			return func(yield func(models.Content, error) bool) {
+				response := models.Message{Role: models.RoleAssistant}
+				defer func() {
+					count(ctx, estimateTokens(messages), estimateTokens([]models.Message{response}))
+				}()
+				for content, err := range next.Chat(ctx, messages, tools) {
+					if err == nil {
+						response.Contents = append(response.Contents, content)
+					}
+					if !yield(content, err) || err != nil {
+						return
+					}
+				}
+			}
+		})
+	}
+}
+
+// ProfanityFilterMiddleware masks the given words in the text of the responses with asterisks, matching
+// them case-insensitively as whole words. The words split across the streamed chunks are masked as well, as
+// the text is streamed up to its last complete word.
+func ProfanityFilterMiddleware(words []string) LLMMiddleware {
+	quoted := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	if len(quoted) == 0 {
+		return func(next LLM) LLM { return next }
+	}
+	re := regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	mask := func(s string) string {
+		return re.ReplaceAllStringFunc(s, func(w string) string {
+			return strings.Repeat("*", len([]rune(w)))
+		})
+	}
+
+	return func(next LLM) LLM {
+		return LLMFunc(func(
+			ctx context.Context, messages []models.Message, tools []mcp.Tool,
+		) iter.Seq2[models.Content, error] {
+			return func(yield func(models.Content, error) bool) {
+				// pending holds the text after the last word boundary, which may be the start of a word.
+				pending := ""
+				flush := func() bool {
+					if pending == "" {
+						return true
+					}
+					text := mask(pending)
+					pending = ""
+					return yield(models.Content{Type: models.ContentTypeText, Text: text}, nil)
+				}
+
+				for content, err := range next.Chat(ctx, messages, tools) {
+					if err != nil || content.Type != models.ContentTypeText {
+						if !flush() || !yield(content, err) || err != nil {
+							return
+						}
+						continue
+					}
+
+					pending += content.Text
+					cut := strings.LastIndexFunc(pending, func(r rune) bool {
+						return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+					})
+					if cut < 0 {
+						continue
+					}
+					_, size := utf8.DecodeRuneInString(pending[cut:])
+					cut += size
+					text := mask(pending[:cut])
+					pending = pending[cut:]
+					if !yield(models.Content{Type: models.ContentTypeText, Text: text}, nil) {
+						return
+					}
+				}
+				flush()
+			}
+		})
+	}
+}
+
+// CurrentDateMiddleware tells the LLM the current date given by now, which defaults to time.Now, by
+// prepending it to the last user message. The stored messages are left untouched.
+func CurrentDateMiddleware(now func() time.Time) LLMMiddleware {
+	if now == nil {
+		now = time.Now
+	}
+	return func(next LLM) LLM {
+		return LLMFunc(func(
+			ctx context.Context, messages []models.Message, tools []mcp.Tool,
+		) iter.Seq2[models.Content, error] {
+			for i, msg := range slices.Backward(messages) {
+				if msg.Role != models.RoleUser || len(msg.Contents) == 0 {
+					continue
+				}
+				contents := slices.Clone(msg.Contents)
+				contents[0].Text = fmt.Sprintf("Current date: %s.\n\n%s", now().Format("Monday, 2 January 2006"),
+					contents[0].Text)
+				msg.Contents = contents
+				messages = slices.Clone(messages)
+				messages[i] = msg
+				break
+			}
+			return next.Chat(ctx, messages, tools)
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// chatMounts is the view of the resources mounted in a chat in the chat_mounts template. Resources are the
+// resources of the MCP servers suggested to mount.
+type chatMounts struct {
+	ChatID    string
+	URIs      []string
+	Resources []mcp.Resource
+}
+
+// mountedResources caches the text of the mounted resources, keyed by their URI, so the chats mounting the
+// same resources don't read them from the MCP servers at every turn.
+type mountedResources struct {
+	mu    sync.Mutex
+	items map[string]mountedResource
+}
+
+type mountedResource struct {
+	text      string
+	expiresAt time.Time
+}
+
+// mountedResourceTTL is how long the text of a mounted resource is cached.
+const mountedResourceTTL = 30 * time.Second
+
+// HandleChatMounts mounts a resource of the MCP servers in a chat, for its current content to be given to
+// the LLM at every turn, or unmounts it. It accepts POST requests with the chat_id and uri form fields, and
+// the action field, "unmount" to unmount the resource. The resource is read before it's mounted, to check
+// it's served. It renders the chat_mounts template.
+func (m *Main) HandleChatMounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	uri := strings.TrimSpace(r.FormValue("uri"))
+	if uri == "" {
+		m.renderError(w, http.StatusBadRequest, "URI is required")
+		return
+	}
+
+	chatID := r.FormValue("chat_id")
+	c, err := m.findUserChat(r, chatID)
+	if errors.Is(err, errChatNotFound) {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.FormValue("action") == "unmount" {
+		c.MountedResources = slices.DeleteFunc(slices.Clone(c.MountedResources), func(u string) bool {
+			return u == uri
+		})
+	} else if !slices.Contains(c.MountedResources, uri) {
+		if _, err := m.mountedResourceText(r.Context(), uri); err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to read mounted resource",
+				slog.String("uri", uri),
+				slog.String(errLoggerKey, err.Error()))
+			m.renderError(w, http.StatusBadGateway, fmt.Sprintf("Failed to mount resource %s: %s", uri, err))
+			return
+		}
+		c.MountedResources = append(c.MountedResources, uri)
+	}
+
+	if err := m.store.UpdateChat(r.Context(), c); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to update chat mounted resources",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := m.templates.ExecuteTemplate(w, "chat_mounts", m.newChatMounts(chatID, c.MountedResources)); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute chat_mounts template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (m *Main) newChatMounts(chatID string, uris []string) chatMounts {
+	return chatMounts{
+		ChatID:    chatID,
+		URIs:      uris,
+		Resources: m.capabilities().resources,
+	}
+}
+
+// withMountedResources returns messages with the current content of the resources mounted in the chat of
+// chatID prepended to the last user message, or messages as is if the chat has none. The resources that
+// can't be read are given with the error instead, for the LLM to know their content is missing.
+func (m *Main) withMountedResources(ctx context.Context, chatID string, messages []models.Message) []models.Message {
+	c, err := m.findChat(ctx, chatID)
+	if err != nil || len(c.MountedResources) == 0 {
+		return messages
+	}
+
+	texts := make([]string, 0, len(c.MountedResources)+1)
+	texts = append(texts, "The current content of the resources mounted in this chat:")
+	for _, uri := range c.MountedResources {
+		text, err := m.mountedResourceText(ctx, uri)
+		if err != nil {
+			m.logger.WarnContext(ctx, "Failed to read mounted resource",
+				slog.String("uri", uri),
+				slog.String(errLoggerKey, err.Error()))
+			text = fmt.Sprintf("[failed to read the resource: %s]", err)
+		}
+		texts = append(texts, fmt.Sprintf("<resource uri=%q>\n%s\n</resource>", uri, text))
+	}
+	mounted := strings.Join(texts, "\n\n")
+
+	for i, msg := range slices.Backward(messages) {
+		if msg.Role != models.RoleUser || len(msg.Contents) == 0 {
+			continue
+		}
+		contents := slices.Clone(msg.Contents)
+		contents[0].Text = mounted + "\n\n" + contents[0].Text
+		msg.Contents = contents
+		messages = slices.Clone(messages)
+		messages[i] = msg
+		break
+	}
+	return messages
+}
+
+// mountedResourceText returns the text of the resource of uri, read from the MCP server serving it unless
+// it was read in the last mountedResourceTTL.
+func (m *Main) mountedResourceText(ctx context.Context, uri string) (string, error) {
+	now := time.Now()
+	if text, ok := m.mountedResources.get(uri, now); ok {
+		return text, nil
+	}
+
+	clientIdx, ok := m.capabilities().resourceClient(uri)
+	if !ok {
+		return "", fmt.Errorf("no MCP server serves resource %s", uri)
+	}
+	res, err := m.mcpClients[clientIdx].ReadResource(ctx, mcp.ReadResourceParams{URI: uri})
+	if err != nil {
+		return "", err
+	}
+	text := resourceText(res.Contents)
+	if text == "" {
+		return "", fmt.Errorf("resource %s has no text content", uri)
+	}
+	m.mountedResources.put(uri, text, now)
+	return text, nil
+}
+
+// resourceClient returns the index of the MCP client of the server serving the resource of uri, either as
+// one of its resources, or as an expansion of one of its resource templates.
+func (caps capabilities) resourceClient(uri string) (int, bool) {
+	if idx, ok := caps.resourcesMap[uri]; ok {
+		return idx, true
+	}
+	for _, t := range caps.resourceTemplates {
+		if matchesURITemplate(t.URITemplate, uri) {
+			return caps.resourceTemplatesMap[t.URITemplate], true
+		}
+	}
+	return 0, false
+}
+
+func (r *mountedResources) get(uri string, now time.Time) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	item, ok := r.items[uri]
+	if !ok || now.After(item.expiresAt) {
+		return "", false
+	}
+	return item.text, true
+}
+
+// put caches the text of the resource of uri, and removes the expired texts.
+func (r *mountedResources) put(uri, text string, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k, item := range r.items {
+		if now.After(item.expiresAt) {
+			delete(r.items, k)
+		}
+	}
+	r.items[uri] = mountedResource{text: text, expiresAt: now.Add(mountedResourceTTL)}
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// chatObserver is the view of the observer link of a chat in the chat_observer template. CanManage reports
+// whether the user of the page created the chat, creating and revoking the link.
+type chatObserver struct {
+	ChatID    string
+	Link      string
+	CanManage bool
+}
+
+type observePageData struct {
+	ChatID   string
+	Title    string
+	Messages []message
+}
+
+// observerCookieName is the name of the cookie holding the token of the observer link opened in the
+// browser, sent with the SSE connections only, which it authorizes to follow the observed chat.
+const observerCookieName = "mcpwebui_observer"
+
+// HandleChatObserver creates the observer link of a chat, letting anyone with the link watch the chat in
+// real time without sending messages, or revokes it. It accepts POST requests with the chat_id form field,
+// and the action field, "revoke" to revoke the link. A new link replaces the previous one. Only the user who
+// created the chat manages its link. It renders the chat_observer template.
+func (m *Main) HandleChatObserver(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c, err := m.findUserChat(r, r.FormValue("chat_id"))
+	if errors.Is(err, errChatNotFound) {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !chatOwner(c, m.userID(r)) {
+		m.renderError(w, http.StatusForbidden, "Only the user who created the chat shares its observer link")
+		return
+	}
+
+	c.ObserverToken = ""
+	if r.FormValue("action") != "revoke" {
+		if c.ObserverToken, err = newObserverToken(); err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to create observer token", slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := m.store.UpdateChat(r.Context(), c); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to update chat observer token",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := m.templates.ExecuteTemplate(w, "chat_observer", newChatObserver(c, m.userID(r))); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute chat_observer template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleObserve renders the read-only page of the chat of the observer link of the token path value, which
+// shows its messages and streams the new ones and their responses, without any form to change the chat. It
+// sets the cookie authorizing the SSE connections of the page. It responds with 404 Not Found if the link
+// doesn't exist or was revoked.
+func (m *Main) HandleObserve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.PathValue("token")
+	c, err := m.observedChat(r.Context(), token)
+	if errors.Is(err, errChatNotFound) {
+		http.Error(w, "Observer link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ms, err := m.store.Messages(r.Context(), c.ID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get messages", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	messages, err := m.messageViews(r, c, ms, false)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to render messages", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     observerCookieName,
+		Value:    token,
+		Path:     "/sse",
+		HttpOnly: true,
+		Secure:   m.security.SecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	data := observePageData{ChatID: c.ID, Title: c.Title, Messages: messages}
+	if err := m.renderPage(w, "observe.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute observe template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func newChatObserver(c models.Chat, userID string) chatObserver {
+	view := chatObserver{ChatID: c.ID, CanManage: chatOwner(c, userID)}
+	if c.ObserverToken != "" {
+		view.Link = "/observe/" + c.ObserverToken
+	}
+	return view
+}
+
+func newObserverToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// observedChat returns the chat of the observer link of token, or errChatNotFound if there's none.
+func (m *Main) observedChat(ctx context.Context, token string) (models.Chat, error) {
+	if token == "" {
+		return models.Chat{}, errChatNotFound
+	}
+	chats, err := m.store.Chats(ctx)
+	if err != nil {
+		return models.Chat{}, err
+	}
+	idx := slices.IndexFunc(chats, func(c models.Chat) bool {
+		return subtle.ConstantTimeCompare([]byte(c.ObserverToken), []byte(token)) == 1
+	})
+	if idx < 0 {
+		return models.Chat{}, errChatNotFound
+	}
+	return chats[idx], nil
+}
+
+// observerTopic returns the topic of the SSE connection of r, if it's the connection of an observer following
+// the chat of its observer link, or one of the responses of the chat.
+func (m *Main) observerTopic(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(observerCookieName)
+	if err != nil {
+		return "", false
+	}
+	c, err := m.observedChat(r.Context(), cookie.Value)
+	if err != nil {
+		return "", false
+	}
+
+	query := r.URL.Query()
+	if messageID := query.Get("message_id"); messageID != "" {
+		m.messageTopics.mu.Lock()
+		topic, ok := m.messageTopics.items[messageID]
+		m.messageTopics.mu.Unlock()
+		return messageIDTopic(messageID), ok && topic.chatID == c.ID
+	}
+	return chatMessagesTopic(c.ID), query.Get("chat_id") == c.ID
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// setupChecker is implemented by the LLMs and the title generators checking their setup at runtime, like the
+// built-in providers checking their API key and their model. The problems are returned as a
+// *models.SetupError, with the hint to fix them.
+type setupChecker interface {
+	CheckSetup(ctx context.Context) error
+}
+
+type onboardingCheck struct {
+	Name   string
+	Status string
+	Detail string
+	Hint   string
+}
+
+type onboardingPageData struct {
+	Checks []onboardingCheck
+	Issues int
+}
+
+const (
+	onboardingStatusOK      = "ok"
+	onboardingStatusWarning = "warning"
+	onboardingStatusError   = "error"
+	onboardingStatusSkipped = "skipped"
+
+	// onboardingCheckTimeout bounds every check, so a server that doesn't respond is reported as failing
+	// instead of blocking the page.
+	onboardingCheckTimeout = 10 * time.Second
+)
+
+// HandleOnboarding renders the onboarding page, which checks the setup by probing the LLMs, the MCP servers
+// and the store, and lists the problems found with the hints to fix them.
+func (m *Main) HandleOnboarding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := onboardingPageData{Checks: m.onboardingChecks(r.Context())}
+	for _, c := range data.Checks {
+		if c.Status == onboardingStatusError || c.Status == onboardingStatusWarning {
+			data.Issues++
+		}
+	}
+
+	if err := m.renderPage(w, "onboarding.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute onboarding template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// onboardingChecks runs the checks of the setup concurrently, and returns their results in a stable order.
+func (m *Main) onboardingChecks(ctx context.Context) []onboardingCheck {
+	checks := []func(context.Context) onboardingCheck{
+		func(ctx context.Context) onboardingCheck {
+			return llmSetupCheck(ctx, "LLM", m.llmSetup, modelName(m.llm))
+		},
+	}
+	if m.compareLLM != nil {
+		checks = append(checks, func(ctx context.Context) onboardingCheck {
+			return llmSetupCheck(ctx, "Compare LLM", m.compareLLMSetup, modelName(m.compareLLM))
+		})
+	}
+	// The heuristic titles don't call the title generator.
+	if !m.titleGeneration.Heuristic {
+		titleSetup, _ := m.titleGenerator.(setupChecker)
+		checks = append(checks, func(ctx context.Context) onboardingCheck {
+			return llmSetupCheck(ctx, "Title generator", titleSetup, modelName(m.titleGenerator))
+		})
+	}
+	checks = append(checks, m.storeCheck)
+	if len(m.mcpClients) == 0 {
+		checks = append(checks, func(context.Context) onboardingCheck {
+			return onboardingCheck{
+				Name:   "MCP servers",
+				Status: onboardingStatusWarning,
+				Detail: "No MCP server is configured, so the assistant has no tools.",
+				Hint:   "Add the servers to the mcpSSEServers or mcpStdIOServers sections of the configuration.",
+			}
+		})
+	}
+	for i := range m.mcpClients {
+		checks = append(checks, func(ctx context.Context) onboardingCheck { return m.mcpServerCheck(ctx, i) })
+	}
+
+	results := make([]onboardingCheck, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, onboardingCheckTimeout)
+			defer cancel()
+			results[i] = check(ctx)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// llmSetupCheck checks the setup of the LLM or title generator named name with checker, which is nil if it
+// can't be checked.
+func llmSetupCheck(ctx context.Context, name string, checker setupChecker, model string) onboardingCheck {
+	if model != "" {
+		name = fmt.Sprintf("%s (%s)", name, model)
+	}
+	if checker == nil {
+		return onboardingCheck{
+			Name:   name,
+			Status: onboardingStatusSkipped,
+			Detail: "The provider can't be checked, send a message to try it.",
+		}
+	}
+
+	err := checker.CheckSetup(ctx)
+	if err == nil {
+		return onboardingCheck{Name: name, Status: onboardingStatusOK, Detail: "The provider is reachable."}
+	}
+	var setupErr *models.SetupError
+	if errors.As(err, &setupErr) {
+		return onboardingCheck{
+			Name:   name,
+			Status: onboardingStatusError,
+			Detail: setupErr.Problem,
+			Hint:   setupErr.Hint,
+		}
+	}
+	return onboardingCheck{
+		Name:   name,
+		Status: onboardingStatusError,
+		Detail: err.Error(),
+		Hint:   "Check the llm section of the configuration, and the status of the provider.",
+	}
+}
+
+// modelName returns the name of the model of v, if it reports it.
+func modelName(v any) string {
+	if mn, ok := v.(modelNamer); ok {
+		return mn.Model()
+	}
+	return ""
+}
+
+func (m *Main) storeCheck(ctx context.Context) onboardingCheck {
+	chats, err := m.store.Chats(ctx)
+	if err != nil {
+		return onboardingCheck{
+			Name:   "Store",
+			Status: onboardingStatusError,
+			Detail: fmt.Sprintf("The chats can't be read: %s", err),
+			Hint:   "Check the store section of the configuration, and that its database is reachable.",
+		}
+	}
+	return onboardingCheck{
+		Name:   "Store",
+		Status: onboardingStatusOK,
+		Detail: fmt.Sprintf("%d chats stored.", len(chats)),
+	}
+}
+
+// mcpServerCheck checks the MCP server of index i is connected, and still responds by listing its
+// capabilities again.
+func (m *Main) mcpServerCheck(ctx context.Context, i int) onboardingCheck {
+	cli := m.mcpClients[i]
+	info := cli.ServerInfo()
+	// The servers failing to connect at the start are kept unconnected, without a name.
+	if info.Name == "" {
+		return onboardingCheck{
+			Name:   fmt.Sprintf("MCP server #%d", i+1),
+			Status: onboardingStatusError,
+			Detail: "The server failed to connect at the start.",
+			Hint: "Check the command and the arguments, or the URL, of the server in the mcpStdIOServers or " +
+				"mcpSSEServers sections, and the errors logged at the start, then restart the web UI.",
+		}
+	}
+
+	name := fmt.Sprintf("MCP server %s %s", info.Name, info.Version)
+	sc, err := listServerCapabilities(ctx, cli)
+	if err != nil {
+		return onboardingCheck{
+			Name:   name,
+			Status: onboardingStatusError,
+			Detail: fmt.Sprintf("The server doesn't respond: %s", err),
+			Hint:   "Check the server is still running and its logs, then restart the web UI to reconnect it.",
+		}
+	}
+	check := onboardingCheck{
+		Name:   name,
+		Status: onboardingStatusOK,
+		Detail: fmt.Sprintf("%d tools, %d resources, %d resource templates and %d prompts offered.",
+			len(sc.Tools), len(sc.Resources), len(sc.ResourceTemplates), len(sc.Prompts)),
+	}
+	if !sc.ToolsSupported && !sc.ResourcesSupported && !sc.PromptsSupported {
+		check.Status = onboardingStatusWarning
+		check.Detail = "The server offers no tools, resources or prompts."
+		check.Hint = "Check the server is the one intended, and its own configuration."
+	}
+	return check
+}
@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// chatParameters is the view of the parameters of a chat in the chat_parameters template, with the unset
+// parameters as empty strings.
+type chatParameters struct {
+	ChatID string
+
+	Temperature string
+	TopP        string
+	TopK        string
+	MaxTokens   string
+	Seed        string
+	// Stop are the stop sequences, one per line with their newlines and tabs escaped, and LogitBias the
+	// lines of the token IDs and their bias.
+	Stop      string
+	LogitBias string
+
+	// MemoryEnabled shows the memory switch, checked if Memory is true.
+	MemoryEnabled bool
+	Memory        bool
+
+	// ResponseSchema is the indented JSON schema of the structured output, empty for free text.
+	ResponseSchema string
+
+	Saved bool
+}
+
+// parameterValidator is implemented by the LLM providers refusing some of the chat parameters, like the
+// parameters their API doesn't take.
+type parameterValidator interface {
+	ValidateParameters(params models.ChatParameters) error
+}
+
+var errChatNotFound = errors.New("chat not found")
+
+var (
+	// stopUnescaper and stopEscaper unescape the newlines, tabs and backslashes of the stop sequences of the
+	// form, one per line, and escape them back.
+	stopUnescaper = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\\`, `\`)
+	stopEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\t", `\t`)
+)
+
+// HandleChatParameters saves the LLM parameters of a chat, overriding the configured parameters of the LLM in
+// its next generations. It accepts POST requests with the chat_id, temperature, top_p, top_k, max_tokens,
+// seed, stop and logit_bias form fields, where an empty field keeps the configured value, the memory field, to
+// keep the chat in the assistant memory if it's enabled, and the response_schema field with the JSON schema of
+// the structured output of the chat, empty for free text responses. The stop field has a stop sequence per
+// line, with \n and \t for the newlines and tabs, and the logit_bias field a token ID and its bias per line,
+// like "50256: -100". The parameters the LLM provider doesn't take are refused. It renders the
+// chat_parameters template.
+func (m *Main) HandleChatParameters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params, err := parseChatParameters(r)
+	if err == nil && m.parameterValidator != nil {
+		err = m.parameterValidator.ValidateParameters(params)
+	}
+	if err != nil {
+		m.renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	responseSchema, err := parseResponseSchema(r.FormValue("response_schema"))
+	if err != nil {
+		m.renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chatID := r.FormValue("chat_id")
+	c, err := m.findUserChat(r, chatID)
+	if errors.Is(err, errChatNotFound) {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.Parameters = params
+	c.ResponseSchema = responseSchema
+	if m.memoryEnabled {
+		c.MemoryDisabled = r.FormValue("memory") == ""
+	}
+	if err := m.store.UpdateChat(r.Context(), c); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to update chat parameters", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	view := m.newChatParameters(c)
+	view.Saved = true
+	if err := m.templates.ExecuteTemplate(w, "chat_parameters", view); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// findChat returns the chat of chatID, or errChatNotFound if it doesn't exist.
+func (m *Main) findChat(ctx context.Context, chatID string) (models.Chat, error) {
+	chats, err := m.store.Chats(ctx)
+	if err != nil {
+		return models.Chat{}, fmt.Errorf("failed to get chats: %w", err)
+	}
+	idx := slices.IndexFunc(chats, func(c models.Chat) bool { return c.ID == chatID })
+	if idx < 0 {
+		return models.Chat{}, errChatNotFound
+	}
+	return chats[idx], nil
+}
+
+// withChatParameters returns a copy of ctx carrying the parameters and the system prompt override of the chat
+// of chatID, which the LLM providers apply to their requests. The configured parameters are used if the chat
+// can't be read.
+func (m *Main) withChatParameters(ctx context.Context, chatID string) context.Context {
+	c, err := m.findChat(ctx, chatID)
+	if err != nil {
+		if !errors.Is(err, errChatNotFound) {
+			m.logger.ErrorContext(ctx, "Failed to get chat parameters", slog.String(errLoggerKey, err.Error()))
+		}
+		return ctx
+	}
+	if c.SystemPrompt != "" {
+		ctx = models.WithSystemPromptOverride(ctx, c.SystemPrompt)
+	}
+	if c.Parameters.IsZero() {
+		return ctx
+	}
+	return models.WithChatParameters(ctx, c.Parameters)
+}
+
+// parameterForm parses the optional parameters of a form, keeping the first error.
+type parameterForm struct {
+	r   *http.Request
+	err error
+}
+
+func parseChatParameters(r *http.Request) (models.ChatParameters, error) {
+	f := &parameterForm{r: r}
+	params := models.ChatParameters{
+		Temperature: f.floatValue("temperature", 0, 2),
+		TopP:        f.floatValue("top_p", 0, 1),
+		TopK:        f.intValue("top_k", 1),
+		MaxTokens:   f.intValue("max_tokens", 1),
+		Seed:        f.intValue("seed", 0),
+		Stop:        f.stopValue("stop"),
+		LogitBias:   f.logitBiasValue("logit_bias"),
+	}
+	return params, f.err
+}
+
+// floatValue returns the value of the field name, which must be between low and high, or nil if it's empty.
+func (f *parameterForm) floatValue(name string, low, high float32) *float32 {
+	value := strings.TrimSpace(f.r.FormValue(name))
+	if value == "" || f.err != nil {
+		return nil
+	}
+	v, err := strconv.ParseFloat(value, 32)
+	if err != nil || float32(v) < low || float32(v) > high {
+		f.err = fmt.Errorf("%s must be a number between %g and %g", name, low, high)
+		return nil
+	}
+	p := float32(v)
+	return &p
+}
+
+// intValue returns the value of the field name, which must be at least low, or nil if it's empty.
+func (f *parameterForm) intValue(name string, low int) *int {
+	value := strings.TrimSpace(f.r.FormValue(name))
+	if value == "" || f.err != nil {
+		return nil
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil || v < low {
+		f.err = fmt.Errorf("%s must be an integer of at least %d", name, low)
+		return nil
+	}
+	return &v
+}
+
+// stopValue returns the stop sequences of the lines of the field name, unescaped, or nil if it's empty. The
+// spaces of the lines are kept, as they're part of the sequences.
+func (f *parameterForm) stopValue(name string) []string {
+	if f.err != nil {
+		return nil
+	}
+	var stop []string
+	for _, line := range strings.Split(f.r.FormValue(name), "\n") {
+		if line = strings.TrimSuffix(line, "\r"); line != "" {
+			stop = append(stop, stopUnescaper.Replace(line))
+		}
+	}
+	return stop
+}
+
+// logitBiasValue returns the bias of the token IDs of the lines of the field name, like "50256: -100", or nil
+// if it's empty.
+func (f *parameterForm) logitBiasValue(name string) map[string]int {
+	value := strings.TrimSpace(f.r.FormValue(name))
+	if value == "" || f.err != nil {
+		return nil
+	}
+	bias := make(map[string]int)
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		token, b, _ := strings.Cut(line, ":")
+		id, err := strconv.Atoi(strings.TrimSpace(token))
+		v, bErr := strconv.Atoi(strings.TrimSpace(b))
+		if err != nil || bErr != nil || id < 0 || v < -100 || v > 100 {
+			f.err = fmt.Errorf("%s must have a token ID and a bias between -100 and 100 per line, like 50256: -100",
+				name)
+			return nil
+		}
+		bias[strconv.Itoa(id)] = v
+	}
+	return bias
+}
+
+// stopText returns the stop sequences as the lines of the stop field, escaped.
+func stopText(stop []string) string {
+	lines := make([]string, len(stop))
+	for i, s := range stop {
+		lines[i] = stopEscaper.Replace(s)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// logitBiasText returns the bias of the token IDs as the lines of the logit_bias field, by token ID.
+func logitBiasText(bias map[string]int) string {
+	tokens := slices.SortedFunc(maps.Keys(bias), func(a, b string) int {
+		idA, _ := strconv.Atoi(a)
+		idB, _ := strconv.Atoi(b)
+		return idA - idB
+	})
+	lines := make([]string, len(tokens))
+	for i, token := range tokens {
+		lines[i] = fmt.Sprintf("%s: %d", token, bias[token])
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (m *Main) newChatParameters(c models.Chat) chatParameters {
+	params := c.Parameters
+	view := chatParameters{
+		ResponseSchema: indentJSON(c.ResponseSchema),
+		ChatID:         c.ID,
+		Stop:           stopText(params.Stop),
+		LogitBias:      logitBiasText(params.LogitBias),
+		MemoryEnabled:  m.memoryEnabled,
+		Memory:         !c.MemoryDisabled,
+	}
+	if params.Temperature != nil {
+		view.Temperature = strconv.FormatFloat(float64(*params.Temperature), 'g', -1, 32)
+	}
+	if params.TopP != nil {
+		view.TopP = strconv.FormatFloat(float64(*params.TopP), 'g', -1, 32)
+	}
+	if params.TopK != nil {
+		view.TopK = strconv.Itoa(*params.TopK)
+	}
+	if params.MaxTokens != nil {
+		view.MaxTokens = strconv.Itoa(*params.MaxTokens)
+	}
+	if params.Seed != nil {
+		view.Seed = strconv.Itoa(*params.Seed)
+	}
+	return view
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// pastedImages holds the images pasted into the chat forms, uploaded before their message is sent, by their ID.
+type pastedImages struct {
+	mu    sync.Mutex
+	items map[string]pastedImage
+}
+
+type pastedImage struct {
+	userID     string
+	mediaType  string
+	data       []byte
+	uploadedAt time.Time
+}
+
+// imageAttachment is the view of a pasted image in the image_attachment template.
+type imageAttachment struct {
+	ID      string
+	DataURL string
+}
+
+const (
+	// maxPastedImageSize is the maximum size of a pasted image.
+	maxPastedImageSize = 5 << 20
+	// pastedImageTTL is how long a pasted image waits for its message, as long as a message can stay in the
+	// offline queue of the PWA.
+	pastedImageTTL = idempotencyKeyTTL
+	// minFencedPasteLines is the number of lines of a pasted text for it to be fenced as code, so that a
+	// pasted snippet stays inline.
+	minFencedPasteLines = 5
+)
+
+// pastedImageTypes are the media types of the images accepted by the LLM providers with vision.
+var pastedImageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// HandleImageUpload uploads an image pasted into a chat form, from the "image" file of a multipart POST
+// request, and renders the image_attachment template, whose hidden "image" field attaches the image to the
+// message of the form. The image must be a PNG, JPEG, GIF or WebP image of at most 5 MB, whose type is
+// detected from its bytes. It's kept in memory until its message is sent, for 24 hours at most.
+func (m *Main) HandleImageUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The limit leaves room for the other parts of the multipart form.
+	r.Body = http.MaxBytesReader(w, r.Body, maxPastedImageSize+1<<20)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		m.renderError(w, http.StatusBadRequest, fmt.Sprintf("Failed to read the image: %s", err))
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxPastedImageSize+1))
+	if err != nil {
+		m.renderError(w, http.StatusBadRequest, fmt.Sprintf("Failed to read the image: %s", err))
+		return
+	}
+	if len(data) > maxPastedImageSize {
+		m.renderError(w, http.StatusRequestEntityTooLarge, "The image is larger than 5 MB")
+		return
+	}
+	mediaType := http.DetectContentType(data)
+	if !slices.Contains(pastedImageTypes, mediaType) {
+		m.renderError(w, http.StatusUnsupportedMediaType, "Only PNG, JPEG, GIF and WebP images are attached")
+		return
+	}
+
+	id := uuid.New().String()
+	m.pastedImages.add(id, pastedImage{
+		userID:     m.userID(r),
+		mediaType:  mediaType,
+		data:       data,
+		uploadedAt: time.Now(),
+	})
+	m.logger.InfoContext(r.Context(), "Uploaded pasted image",
+		slog.String("imageID", id),
+		slog.String("mediaType", mediaType),
+		slog.Int("size", len(data)))
+
+	image := models.Content{Type: models.ContentTypeImage, MediaType: mediaType, Data: data}
+	attachment := imageAttachment{ID: id, DataURL: image.DataURL()}
+	if err := m.templates.ExecuteTemplate(w, "image_attachment", attachment); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute image_attachment template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleCodePaste returns the text of the "code" form field of a POST request, pasted into a chat form, fenced
+// as a markdown code block if it's code of at least 5 lines, with the info string of its detected language.
+// The other texts, and the ones already fenced, are returned as they are, as text/plain.
+func (m *Main) HandleCodePaste(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, fencePastedCode(r.FormValue("code")))
+}
+
+// fencePastedCode returns text fenced as a code block if it's code of at least minFencedPasteLines lines in a
+// known language, or JSON, and text otherwise.
+func fencePastedCode(text string) string {
+	code := strings.Trim(text, "\r\n")
+	if strings.Count(code, "\n")+1 < minFencedPasteLines || strings.Contains(code, "```") {
+		return text
+	}
+	info := ""
+	if idx := blockLanguage("", code); idx >= 0 {
+		info = chatLanguages[idx].aliases[0]
+	} else if trimmed := strings.TrimSpace(code); (strings.HasPrefix(trimmed, "{") ||
+		strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		info = "json"
+	}
+	if info == "" {
+		return text
+	}
+	return "```" + info + "\n" + code + "\n```\n"
+}
+
+// userContents returns the contents of the user message of r, its text msg with the sources of its resource
+// attachments, followed by the images attached by its "image" form fields, uploaded by userID, which are taken
+// out of the pasted images. It responds with 400 Bad Request and returns false if an image is unknown, like an
+// image that expired.
+func (m *Main) userContents(
+	w http.ResponseWriter,
+	r *http.Request,
+	userID, msg string,
+	attachments []string,
+) ([]models.Content, bool) {
+	contents := []models.Content{{
+		Type:    models.ContentTypeText,
+		Text:    msg,
+		Sources: m.capabilities().attachmentSources(attachments),
+	}}
+	for _, id := range r.PostForm["image"] {
+		image, ok := m.pastedImages.take(id, userID, time.Now())
+		if !ok {
+			m.renderError(w, http.StatusBadRequest, "An attached image expired, paste it again")
+			return nil, false
+		}
+		contents = append(contents, models.Content{
+			Type:      models.ContentTypeImage,
+			MediaType: image.mediaType,
+			Data:      image.data,
+		})
+	}
+	return contents, true
+}
+
+// add records image by id, forgetting the expired images.
+func (p *pastedImages) add(id string, image pastedImage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for item, pasted := range p.items {
+		if image.uploadedAt.Sub(pasted.uploadedAt) > pastedImageTTL {
+			delete(p.items, item)
+		}
+	}
+	p.items[id] = image
+}
+
+// take removes and returns the image of id uploaded by userID, if it didn't expire at now.
+func (p *pastedImages) take(id, userID string, now time.Time) (pastedImage, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	image, ok := p.items[id]
+	if !ok || image.userID != userID || now.Sub(image.uploadedAt) > pastedImageTTL {
+		return pastedImage{}, false
+	}
+	delete(p.items, id)
+	return image, true
+}
@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+)
+
+type toolsPageData struct {
+	Tools        []toolView
+	Instructions []serverInstructionsView
+	// CanRefresh reports whether the role of the user lets them list the capabilities of the MCP servers
+	// again.
+	CanRefresh bool
+}
+
+// toolView is a tool of the MCP servers in the tools page, with the form fields generated from its input
+// schema. The tools whose schema has no properties are given a single field for the raw JSON arguments.
+// ServerName is the name of the tool on its server if it's renamed.
+type toolView struct {
+	Name        string
+	ServerName  string
+	Description string
+	Fields      []toolField
+}
+
+// toolField is a property of the input schema of a tool. Its Kind is the type of the property, one of
+// "string", "number", "integer" and "boolean", or "json" for the objects, arrays and untyped properties,
+// which are given as JSON.
+type toolField struct {
+	Name        string
+	Kind        string
+	Description string
+	Enum        []string
+	Required    bool
+}
+
+// toolCallView is the result of a tool invocation in the tool_result template.
+type toolCallView struct {
+	Tool      string
+	Arguments string
+	Result    string
+	Succeeded bool
+	Duration  time.Duration
+}
+
+// toolSchema is the part of the JSON schema of a tool's input the forms are generated from.
+type toolSchema struct {
+	Properties map[string]struct {
+		Type        any    `json:"type"`
+		Description string `json:"description"`
+		Enum        []any  `json:"enum"`
+	} `json:"properties"`
+	Required []string `json:"required"`
+}
+
+// HandleTools renders the tools page, where every tool of the MCP servers can be called with a form
+// generated from its input schema, independently of the chats, to inspect its raw result. It also shows the
+// instructions of the MCP servers, and whether they're appended to the system prompt.
+func (m *Main) HandleTools(w http.ResponseWriter, r *http.Request) {
+	caps := m.capabilities()
+	tools := caps.tools
+	data := toolsPageData{
+		Tools:      make([]toolView, len(tools)),
+		CanRefresh: m.allowed(r, permManageServers),
+	}
+	if m.serverInstructions != nil {
+		data.Instructions = m.serverInstructions.views()
+	}
+	for i, tool := range tools {
+		data.Tools[i] = toolView{
+			Name:        tool.Name,
+			ServerName:  caps.toolNames[tool.Name],
+			Description: tool.Description,
+			Fields:      toolFields(tool.InputSchema),
+		}
+	}
+
+	if err := m.renderPage(w, "tools.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute tools template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleToolsRefresh lists the tools, resources and prompts of the MCP servers again, like
+// RefreshCapabilities, and redirects to the tools page. It accepts POST requests.
+func (m *Main) HandleToolsRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := m.RefreshCapabilities(r.Context()); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to refresh capabilities", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, "/tools", http.StatusSeeOther)
+}
+
+// HandleToolCall calls a tool of the MCP servers with the arguments of the tools page's form, and renders
+// its raw result with the tool_result template. It accepts POST requests with the tool form field, and
+// either an arg_<name> field for every property of the tool's input schema, or the arguments field with the
+// arguments as a JSON object.
+func (m *Main) HandleToolCall(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("tool")
+	caps := m.capabilities()
+	idx := slices.IndexFunc(caps.tools, func(t mcp.Tool) bool { return t.Name == name })
+	if idx < 0 {
+		m.renderError(w, http.StatusNotFound, fmt.Sprintf("Tool %s not found", name))
+		return
+	}
+
+	args, err := toolArguments(r, toolFields(caps.tools[idx].InputSchema))
+	if err != nil {
+		m.renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	startedAt := time.Now()
+	res, succeeded := m.callTool(r.Context(), mcp.CallToolParams{Name: name, Arguments: args})
+	view := toolCallView{
+		Tool:      name,
+		Arguments: indentJSON(args),
+		Result:    indentJSON(res),
+		Succeeded: succeeded,
+		Duration:  time.Since(startedAt).Round(time.Millisecond),
+	}
+	if err := m.templates.ExecuteTemplate(w, "tool_result", view); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute tool_result template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// toolFields returns the form fields of the properties of a tool's input schema, sorted by name, or nil if
+// the schema has no properties or can't be parsed.
+func toolFields(inputSchema json.RawMessage) []toolField {
+	var schema toolSchema
+	if err := json.Unmarshal(inputSchema, &schema); err != nil {
+		return nil
+	}
+
+	fields := make([]toolField, 0, len(schema.Properties))
+	for _, name := range slices.Sorted(maps.Keys(schema.Properties)) {
+		prop := schema.Properties[name]
+		field := toolField{
+			Name:        name,
+			Kind:        "json",
+			Description: prop.Description,
+			Required:    slices.Contains(schema.Required, name),
+		}
+		switch t := prop.Type.(type) {
+		case string:
+			field.Kind = toolFieldKind(t)
+		case []any:
+			// A nullable property has a type like ["string", "null"].
+			for _, v := range t {
+				if s, ok := v.(string); ok && s != "null" {
+					field.Kind = toolFieldKind(s)
+					break
+				}
+			}
+		}
+		if field.Kind == "string" {
+			for _, v := range prop.Enum {
+				if s, ok := v.(string); ok {
+					field.Enum = append(field.Enum, s)
+				}
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func toolFieldKind(schemaType string) string {
+	switch schemaType {
+	case "string", "number", "integer", "boolean":
+		return schemaType
+	default:
+		return "json"
+	}
+}
+
+// toolArguments builds the JSON arguments of a tool call from the form fields of the tool. The empty
+// fields are omitted, except the required booleans, which are unchecked.
+func toolArguments(r *http.Request, fields []toolField) (json.RawMessage, error) {
+	if len(fields) == 0 {
+		raw := r.FormValue("arguments")
+		if raw == "" {
+			return json.RawMessage("{}"), nil
+		}
+		var args map[string]any
+		if err := json.Unmarshal([]byte(raw), &args); err != nil {
+			return nil, fmt.Errorf("arguments must be a JSON object: %w", err)
+		}
+		return json.RawMessage(raw), nil
+	}
+
+	args := make(map[string]any, len(fields))
+	for _, f := range fields {
+		value := r.FormValue("arg_" + f.Name)
+		if f.Kind == "boolean" {
+			if value != "" || f.Required {
+				args[f.Name] = value != ""
+			}
+			continue
+		}
+		if value == "" {
+			if f.Required {
+				return nil, fmt.Errorf("argument %s is required", f.Name)
+			}
+			continue
+		}
+
+		var err error
+		switch f.Kind {
+		case "number":
+			args[f.Name], err = strconv.ParseFloat(value, 64)
+		case "integer":
+			args[f.Name], err = strconv.ParseInt(value, 10, 64)
+		case "json":
+			if !json.Valid([]byte(value)) {
+				err = errors.New("invalid JSON")
+			}
+			args[f.Name] = json.RawMessage(value)
+		default:
+			args[f.Name] = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument %s: %w", f.Name, err)
+		}
+	}
+	return json.Marshal(args)
+}
+
+// indentJSON returns the indented data, or data as is if it isn't valid JSON.
+func indentJSON(data json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return string(data)
+	}
+	return buf.String()
+}
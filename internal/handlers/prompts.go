@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/MegaGrindStone/go-mcp"
+)
+
+// HandlePromptAttach gets a prompt of the MCP servers, to attach it to the next message like a resource. It
+// accepts POST requests with the prompt form field and an arg_<name> field for every argument of the
+// prompt, and renders the resource_attachment template with the text of the prompt's messages.
+func (m *Main) HandlePromptAttach(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("prompt")
+	caps := m.capabilities()
+	clientIdx, ok := caps.promptsMap[name]
+	if !ok {
+		m.renderError(w, http.StatusNotFound, "Prompt not found")
+		return
+	}
+
+	args := make(map[string]string)
+	for _, p := range caps.prompts {
+		if p.Name != name {
+			continue
+		}
+		for _, arg := range p.Arguments {
+			value := r.FormValue("arg_" + arg.Name)
+			if value == "" && arg.Required {
+				m.renderError(w, http.StatusBadRequest, fmt.Sprintf("Argument %s is required", arg.Name))
+				return
+			}
+			if value != "" {
+				args[arg.Name] = value
+			}
+		}
+	}
+
+	res, err := m.mcpClients[clientIdx].GetPrompt(r.Context(), mcp.GetPromptParams{Name: name, Arguments: args})
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get prompt",
+			slog.String("prompt", name),
+			slog.String(errLoggerKey, err.Error()))
+		m.renderError(w, http.StatusBadGateway, fmt.Sprintf("Failed to get prompt %s: %s", name, err))
+		return
+	}
+	text := promptText(res.Messages)
+	if text == "" {
+		m.renderError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Prompt %s has no text content", name))
+		return
+	}
+
+	attachment := resourceAttachment{
+		Name:    name,
+		Content: fmt.Sprintf("<prompt name=%q>\n%s\n</prompt>", name, text),
+	}
+	if err := m.templates.ExecuteTemplate(w, "resource_attachment", attachment); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute resource_attachment template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// promptText joins the text of the messages of a prompt, including the text of their embedded resources.
+// The roles of the messages are dropped, as the prompt is attached to a user message.
+func promptText(messages []mcp.PromptMessage) string {
+	texts := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		switch {
+		case msg.Content.Text != "":
+			texts = append(texts, msg.Content.Text)
+		case msg.Content.Resource != nil:
+			if text := resourceText([]mcp.ResourceContents{*msg.Content.Resource}); text != "" {
+				texts = append(texts, text)
+			}
+		}
+	}
+	return strings.Join(texts, "\n\n")
+}
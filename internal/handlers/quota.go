@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// Quota limits the daily consumption of a user. A zero value of a field means the consumption it
+// represents is unlimited.
+type Quota struct {
+	MessagesPerDay int
+	TokensPerDay   int
+}
+
+// Quotas contains the quota applied to every user, and the per-user quotas that override it.
+type Quotas struct {
+	Default Quota
+	Users   map[string]Quota
+}
+
+type usagePageData struct {
+	Day    string
+	Usages []usageRow
+}
+
+type usageRow struct {
+	models.Usage
+	Quota Quota
+}
+
+// WithQuotas enables the enforcement of the given usage quotas in HandleChats and HandleCompare.
+func WithQuotas(quotas Quotas) MainOption {
+	return func(m *Main) {
+		m.quotas = quotas
+	}
+}
+
+func (q Quotas) quota(userID string) Quota {
+	if quota, ok := q.Users[userID]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// estimateTokens estimates the number of tokens of the messages, using the common approximation of four
+// characters per token, as not all LLM providers report the token usage of their responses.
+func estimateTokens(messages []models.Message) int {
+	chars := 0
+	for _, msg := range messages {
+		for _, ct := range msg.Contents {
+			// The partial inputs of a tool call streamed by an LLM are counted once, with the complete call.
+			if ct.Type == models.ContentTypeCallToolDelta {
+				continue
+			}
+			chars += len(ct.Text) + len(ct.ToolInput) + len(ct.ToolResult)
+		}
+	}
+	return (chars + 3) / 4
+}
+
+// exceededQuota returns the reason why the user is not allowed to send another message today, or an empty
+// string if the user is still within the quota. The exhausted budget of the LLM with a hard stop refuses the
+// messages of every user.
+func (m *Main) exceededQuota(ctx context.Context, userID string) (string, error) {
+	if reason, err := m.exhaustedBudget(ctx, providerLLM); err != nil || reason != "" {
+		return reason, err
+	}
+
+	quota := m.quotas.quota(userID)
+	if quota.MessagesPerDay == 0 && quota.TokensPerDay == 0 {
+		return "", nil
+	}
+
+	usage, err := m.store.Usage(ctx, userID, usageDay(time.Now()))
+	if err != nil {
+		return "", fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	if quota.MessagesPerDay > 0 && usage.Messages >= quota.MessagesPerDay {
+		return fmt.Sprintf("You have reached your daily quota of %d messages.", quota.MessagesPerDay), nil
+	}
+	if quota.TokensPerDay > 0 && usage.Tokens >= quota.TokensPerDay {
+		return fmt.Sprintf("You have reached your daily quota of %d tokens.", quota.TokensPerDay), nil
+	}
+	return "", nil
+}
+
+func (m *Main) recordUsage(ctx context.Context, userID string, messages, tokens int) {
+	usage := models.Usage{
+		UserID:   userID,
+		Day:      usageDay(time.Now()),
+		Messages: messages,
+		Tokens:   tokens,
+	}
+	if err := m.store.AddUsage(ctx, usage); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to add usage",
+			slog.String("usage", fmt.Sprintf("%+v", usage)),
+			slog.String(errLoggerKey, err.Error()))
+	}
+}
+
+// HandleUsage renders the usage page, showing the consumption of every user in the day given by the
+// "day" query parameter (in the "2006-01-02" format), or today if it's not provided, alongside their quotas.
+func (m *Main) HandleUsage(w http.ResponseWriter, r *http.Request) {
+	day := r.URL.Query().Get("day")
+	if day == "" {
+		day = usageDay(time.Now())
+	}
+	if _, err := time.Parse("2006-01-02", day); err != nil {
+		m.logger.ErrorContext(r.Context(), "Invalid day", slog.String("day", day))
+		http.Error(w, "Invalid day", http.StatusBadRequest)
+		return
+	}
+
+	usages, err := m.store.Usages(r.Context(), day)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get usages", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := usagePageData{
+		Day:    day,
+		Usages: make([]usageRow, len(usages)),
+	}
+	for i, usage := range usages {
+		data.Usages[i] = usageRow{
+			Usage: usage,
+			Quota: m.quotas.quota(usage.UserID),
+		}
+	}
+
+	if err := m.renderPage(w, "usage.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute usage template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// checkQuota responds with an error and returns false if the user has exceeded the quota.
+func (m *Main) checkQuota(w http.ResponseWriter, r *http.Request, userID string) bool {
+	reason, err := m.exceededQuota(r.Context(), userID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to check quota", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if reason != "" {
+		m.logger.WarnContext(r.Context(), "Quota exceeded", slog.String("userID", userID), slog.String("reason", reason))
+		m.renderError(w, http.StatusTooManyRequests, reason)
+		return false
+	}
+	return true
+}
+
+// quotaStatus returns the error of the exceeded quota of userID, with its status, or nil if the user can go on.
+func (m *Main) quotaStatus(ctx context.Context, userID string) (int, error) {
+	reason, err := m.exceededQuota(ctx, userID)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to check quota", slog.String(errLoggerKey, err.Error()))
+		return http.StatusInternalServerError, err
+	}
+	if reason != "" {
+		m.logger.WarnContext(ctx, "Quota exceeded", slog.String("userID", userID), slog.String("reason", reason))
+		return http.StatusTooManyRequests, errors.New(reason)
+	}
+	return 0, nil
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// readEvent is the event published to the topic of a user when the user reads a chat, so the chat lists of
+// the user's other pages and devices refresh their unread counts.
+type readEvent struct {
+	ChatID string `json:"chatId"`
+}
+
+func userTopic(userID string) string {
+	return "user-" + userID
+}
+
+// HandleChatRead marks the chat of the "chat_id" form field as read by the user up to the message of the
+// optional "message_id" field, or up to its last message, and notifies the chat lists of the user.
+func (m *Main) HandleChatRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chatID := r.FormValue("chat_id")
+	if chatID == "" {
+		m.logger.ErrorContext(r.Context(), "Chat ID is required")
+		http.Error(w, "Chat ID is required", http.StatusBadRequest)
+		return
+	}
+	if !m.authorizeChat(w, r, chatID) {
+		return
+	}
+	messages, err := m.store.Messages(r.Context(), chatID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get messages",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	messageID := r.FormValue("message_id")
+	if messageID == "" && len(messages) > 0 {
+		messageID = messages[len(messages)-1].ID
+	}
+	if !slices.ContainsFunc(messages, func(msg models.Message) bool { return msg.ID == messageID }) {
+		m.logger.ErrorContext(r.Context(), "Message not found",
+			slog.String("chatID", chatID),
+			slog.String("messageID", messageID))
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	userID := m.userID(r)
+	receipt := models.ReadReceipt{UserID: userID, ChatID: chatID, MessageID: messageID, ReadAt: time.Now()}
+	if err := m.store.SaveReadReceipt(r.Context(), receipt); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to save read receipt", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := m.publishRead(r.Context(), userID, chatID); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to publish read event", slog.String(errLoggerKey, err.Error()))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleChatUnread responds with the number of unread responses of the chats of the user, as a JSON object
+// keyed by the IDs of the chats with unread responses.
+func (m *Main) HandleChatUnread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	counts, err := m.unreadCounts(r.Context(), m.userID(r))
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to count unread responses", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(counts); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to encode unread counts", slog.String(errLoggerKey, err.Error()))
+	}
+}
+
+// unreadCounts returns the number of unread responses of the chats of userID, the assistant messages after
+// the last message the user read, omitting the chats without any. The responses of a chat the user never
+// read are all unread. If the last read message was deleted, the responses started after it was read are
+// unread.
+func (m *Main) unreadCounts(ctx context.Context, userID string) (map[string]int, error) {
+	chats, err := m.store.Chats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chats: %w", err)
+	}
+	receipts, err := m.store.ReadReceipts(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get read receipts: %w", err)
+	}
+	lastRead := make(map[string]models.ReadReceipt, len(receipts))
+	for _, receipt := range receipts {
+		lastRead[receipt.ChatID] = receipt
+	}
+
+	counts := make(map[string]int)
+	for _, c := range chats {
+		messages, err := m.store.Messages(ctx, c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get messages of chat %s: %w", c.ID, err)
+		}
+		receipt, read := lastRead[c.ID]
+		start := 0
+		if read {
+			start = slices.IndexFunc(messages, func(msg models.Message) bool { return msg.ID == receipt.MessageID }) + 1
+		}
+		for _, msg := range messages[start:] {
+			if msg.Role != models.RoleAssistant || len(msg.Contents) == 0 || msg.Draft {
+				continue
+			}
+			if read && start == 0 && !msg.Timestamp.After(receipt.ReadAt) {
+				continue
+			}
+			counts[c.ID]++
+		}
+	}
+	return counts, nil
+}
+
+func (m *Main) publishRead(ctx context.Context, userID, chatID string) error {
+	data, err := json.Marshal(readEvent{ChatID: chatID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal read event: %w", err)
+	}
+	return m.publish(ctx, readEventType, string(data), userTopic(userID))
+}
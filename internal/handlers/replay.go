@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// replayProvider is an LLM provider a turn is replayed with, in the message_context template.
+type replayProvider struct {
+	Name  string
+	Label string
+}
+
+// turnReplay is the view of a turn replayed with another provider in the message_replay template, next to
+// the original output of the turn.
+type turnReplay struct {
+	Turn     int
+	Provider string
+	Original string
+	Replay   string
+	Error    string
+}
+
+// HandleTurnReplay replays a turn of an assistant message recorded in the debug mode with an LLM provider,
+// and renders its output next to the original one with the message_replay template. It accepts POST
+// requests with the chat_id, message_id, turn and provider form fields, provider being "llm" or
+// "compareLLM". The provider is given the history of the turn, the messages before the message and its
+// contents before the turn, with the tools and the parameters of the chat, under its own system prompt. The
+// turn isn't continued: its tool calls are shown but not called, and nothing is saved in the chat.
+func (m *Main) HandleTurnReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	llm, label := m.replayLLM(r.FormValue("provider"))
+	if llm == nil {
+		m.renderError(w, http.StatusBadRequest, "The provider isn't configured")
+		return
+	}
+	chatID := r.FormValue("chat_id")
+	if !m.authorizeChat(w, r, chatID) {
+		return
+	}
+	userID := m.userID(r)
+	if !m.checkQuota(w, r, userID) {
+		return
+	}
+	history, err := m.store.MessagePath(r.Context(), chatID, r.FormValue("message_id"))
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get messages",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	aiMsg := history[len(history)-1]
+	turn, err := strconv.Atoi(r.FormValue("turn"))
+	if err != nil || turn < 1 || turn > len(aiMsg.Requests) {
+		m.renderError(w, http.StatusBadRequest, "The turn wasn't recorded")
+		return
+	}
+
+	input, output := turnContents(aiMsg.Contents, turn)
+	view := turnReplay{Turn: turn, Provider: label}
+	if view.Original, err = models.RenderContents(output); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to render contents", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The turn starts with an empty text, like in generate.
+	if len(input) == 0 || input[len(input)-1].Type != models.ContentTypeText {
+		input = append(input, models.Content{Type: models.ContentTypeText})
+	}
+	aiMsg.Contents = input
+	history[len(history)-1] = aiMsg
+	ctx, req := m.generationRequest(r.Context(), chatID, history)
+	replay := models.Message{Role: models.RoleAssistant}
+	for content, err := range llm.Chat(ctx, req.messages, req.tools) {
+		if err != nil {
+			view.Error = err.Error()
+			break
+		}
+		replay.Contents = appendReplayContent(replay.Contents, content)
+	}
+	m.recordUsage(r.Context(), userID, 0, estimateTokens(req.messages)+estimateTokens([]models.Message{replay}))
+	m.logger.InfoContext(r.Context(), "Replayed turn",
+		slog.String("chatID", chatID),
+		slog.String("messageID", aiMsg.ID),
+		slog.Int("turn", turn),
+		slog.String("provider", r.FormValue("provider")))
+
+	if view.Replay, err = models.RenderContents(replay.Contents); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to render contents", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := m.templates.ExecuteTemplate(w, "message_replay", view); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute message_replay template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// replayProviders returns the configured LLM providers the turns are replayed with.
+func (m *Main) replayProviders() []replayProvider {
+	var providers []replayProvider
+	for _, name := range []string{providerLLM, providerCompareLLM} {
+		if llm, label := m.replayLLM(name); llm != nil {
+			providers = append(providers, replayProvider{Name: name, Label: label})
+		}
+	}
+	return providers
+}
+
+// replayLLM returns the LLM of the provider of name, with its label naming its model, or nil if it isn't
+// configured.
+func (m *Main) replayLLM(name string) (LLM, string) {
+	var llm LLM
+	switch name {
+	case providerLLM:
+		llm = m.llm
+	case providerCompareLLM:
+		llm = m.compareLLM
+	}
+	if llm == nil {
+		return nil, ""
+	}
+	label := providerLabel(name)
+	if model := modelName(llm); model != "" {
+		label = fmt.Sprintf("%s (%s)", label, model)
+	}
+	return llm, label
+}
+
+// turnContents splits the contents of an assistant message into the input of its turn, the contents
+// generated by the previous turns with the results of their tool calls, and the output of the turn, up to the
+// result of its tool call. The turns after the last tool call, like the ones of a continued message, all get
+// the contents after it.
+func turnContents(contents []models.Content, turn int) (input, output []models.Content) {
+	start := 0
+	for i := 1; i < turn; i++ {
+		idx := slices.IndexFunc(contents[start:], func(c models.Content) bool {
+			return c.Type == models.ContentTypeToolResult
+		})
+		if idx < 0 {
+			break
+		}
+		start += idx + 1
+	}
+	end := len(contents)
+	if idx := slices.IndexFunc(contents[start:], func(c models.Content) bool {
+		return c.Type == models.ContentTypeToolResult
+	}); idx >= 0 {
+		end = start + idx
+	}
+	return slices.Clone(contents[:start]), contents[start:end]
+}
+
+// appendReplayContent appends content streamed by the LLM to contents, the texts being joined and the other
+// chunks, like the previews of the tool calls, dropped.
+func appendReplayContent(contents []models.Content, content models.Content) []models.Content {
+	switch content.Type {
+	case models.ContentTypeText:
+		if n := len(contents); n > 0 && contents[n-1].Type == models.ContentTypeText {
+			contents[n-1].Text += content.Text
+			return contents
+		}
+		return append(contents, content)
+	case models.ContentTypeCallTool:
+		return append(contents, content)
+	}
+	return contents
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/logging"
+	"github.com/google/uuid"
+)
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	generationIDHeader = "X-Generation-ID"
+
+	maxRequestIDLength = 128
+)
+
+// RequestID is a middleware that assigns an ID to every request, carried by the request's context for
+// the log records, and returned in the X-Request-ID response header. The ID given by a reverse proxy in
+// the X-Request-ID request header is kept, so the log records can be correlated with the proxy's.
+//
+// The requests that start a generation return its ID in the X-Generation-ID response header as well, as
+// the generation outlives the request.
+func (m *Main) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
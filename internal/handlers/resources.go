@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/MegaGrindStone/go-mcp"
+)
+
+// resourceTemplate is the view of a resource template of the MCP servers in the home page, with the
+// variables of its URI template to fill in.
+type resourceTemplate struct {
+	Name        string
+	Description string
+	URITemplate string
+	Variables   []string
+}
+
+// resourceAttachment is the view of a read resource in the resource_attachment template. Its content is
+// posted back with the message it's attached to.
+type resourceAttachment struct {
+	Name    string
+	URI     string
+	Content string
+}
+
+// uriTemplateOperator is how an expression of a URI template is expanded, per its operator, as described in
+// section 3.2.1 of RFC 6570.
+type uriTemplateOperator struct {
+	first         string
+	sep           string
+	named         bool
+	ifEmpty       string
+	allowReserved bool
+}
+
+var uriTemplateOperators = map[byte]uriTemplateOperator{
+	'+': {sep: ",", allowReserved: true},
+	'#': {first: "#", sep: ",", allowReserved: true},
+	'.': {first: ".", sep: "."},
+	'/': {first: "/", sep: "/"},
+	';': {first: ";", sep: ";", named: true},
+	'?': {first: "?", sep: "&", named: true, ifEmpty: "="},
+	'&': {first: "&", sep: "&", named: true, ifEmpty: "="},
+}
+
+// HandleResourceAttach reads a resource of a resource template of the MCP servers, to attach it to the next
+// message. It accepts POST requests with the uri_template form field and a var_<name> field for every
+// variable of the template, and renders the resource_attachment template, which adds the resource's text to
+// the message form.
+func (m *Main) HandleResourceAttach(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	uriTemplate := r.FormValue("uri_template")
+	caps := m.capabilities()
+	clientIdx, ok := caps.resourceTemplatesMap[uriTemplate]
+	if !ok {
+		m.renderError(w, http.StatusNotFound, "Resource template not found")
+		return
+	}
+	var name string
+	for _, t := range caps.resourceTemplates {
+		if t.URITemplate == uriTemplate {
+			name = t.Name
+		}
+	}
+
+	vars := make(map[string]string)
+	for _, v := range uriTemplateVariables(uriTemplate) {
+		value := r.FormValue("var_" + v)
+		if value == "" {
+			m.renderError(w, http.StatusBadRequest, fmt.Sprintf("Variable %s is required", v))
+			return
+		}
+		vars[v] = value
+	}
+	uri := expandURITemplate(uriTemplate, vars)
+
+	res, err := m.mcpClients[clientIdx].ReadResource(r.Context(), mcp.ReadResourceParams{URI: uri})
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to read resource",
+			slog.String("uri", uri),
+			slog.String(errLoggerKey, err.Error()))
+		m.renderError(w, http.StatusBadGateway, fmt.Sprintf("Failed to read resource %s: %s", uri, err))
+		return
+	}
+	text := resourceText(res.Contents)
+	if text == "" {
+		m.renderError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Resource %s has no text content", uri))
+		return
+	}
+
+	attachment := resourceAttachment{
+		Name:    name,
+		URI:     uri,
+		Content: fmt.Sprintf("<resource uri=%q>\n%s\n</resource>", uri, text),
+	}
+	if err := m.templates.ExecuteTemplate(w, "resource_attachment", attachment); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute resource_attachment template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// withAttachments appends the attached resources to the text of a message.
+func withAttachments(msg string, attachments []string) string {
+	if len(attachments) == 0 {
+		return msg
+	}
+	return strings.Join(append([]string{msg}, attachments...), "\n\n")
+}
+
+// resourceText joins the text contents of a resource. The binary contents are only mentioned, as the
+// messages only hold text.
+func resourceText(contents []mcp.ResourceContents) string {
+	texts := make([]string, 0, len(contents))
+	for _, c := range contents {
+		switch {
+		case c.Text != "":
+			texts = append(texts, c.Text)
+		case c.Blob != "":
+			texts = append(texts, fmt.Sprintf("[binary content of %s omitted]", c.MimeType))
+		}
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+func newResourceTemplates(templates []mcp.ResourceTemplate) []resourceTemplate {
+	res := make([]resourceTemplate, len(templates))
+	for i, t := range templates {
+		res[i] = resourceTemplate{
+			Name:        t.Name,
+			Description: t.Description,
+			URITemplate: t.URITemplate,
+			Variables:   uriTemplateVariables(t.URITemplate),
+		}
+	}
+	return res
+}
+
+// uriTemplateVariables returns the names of the variables of a URI template, in the order they first appear.
+func uriTemplateVariables(tmpl string) []string {
+	var vars []string
+	seen := make(map[string]bool)
+	for _, expr := range uriTemplateExpressions(tmpl) {
+		_, specs := parseURITemplateExpression(expr)
+		for _, spec := range specs {
+			name, _ := parseURITemplateVarSpec(spec)
+			if !seen[name] {
+				seen[name] = true
+				vars = append(vars, name)
+			}
+		}
+	}
+	return vars
+}
+
+// expandURITemplate expands a URI template of RFC 6570 with the string values of vars, up to level 3 and
+// the prefix modifier of level 4. The variables missing from vars are undefined, and expand to nothing.
+func expandURITemplate(tmpl string, vars map[string]string) string {
+	var sb strings.Builder
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			break
+		}
+		sb.WriteString(tmpl[:start])
+		sb.WriteString(expandURITemplateExpression(tmpl[start+1:start+end], vars))
+		tmpl = tmpl[start+end+1:]
+	}
+	sb.WriteString(tmpl)
+	return sb.String()
+}
+
+// matchesURITemplate reports whether uri may be an expansion of a URI template, its expressions matching any
+// text.
+func matchesURITemplate(tmpl, uri string) bool {
+	var sb strings.Builder
+	sb.WriteByte('^')
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			break
+		}
+		sb.WriteString(regexp.QuoteMeta(tmpl[:start]))
+		sb.WriteString(".*")
+		tmpl = tmpl[start+end+1:]
+	}
+	sb.WriteString(regexp.QuoteMeta(tmpl))
+	sb.WriteByte('$')
+	return regexp.MustCompile(sb.String()).MatchString(uri)
+}
+
+func expandURITemplateExpression(expr string, vars map[string]string) string {
+	op, specs := parseURITemplateExpression(expr)
+	var sb strings.Builder
+	first := true
+	for _, spec := range specs {
+		name, prefix := parseURITemplateVarSpec(spec)
+		value, ok := vars[name]
+		if !ok {
+			continue
+		}
+		if runes := []rune(value); prefix > 0 && len(runes) > prefix {
+			value = string(runes[:prefix])
+		}
+
+		if first {
+			sb.WriteString(op.first)
+			first = false
+		} else {
+			sb.WriteString(op.sep)
+		}
+		if op.named {
+			sb.WriteString(name)
+			if value == "" {
+				sb.WriteString(op.ifEmpty)
+				continue
+			}
+			sb.WriteByte('=')
+		}
+		sb.WriteString(encodeURITemplateValue(value, op.allowReserved))
+	}
+	return sb.String()
+}
+
+// uriTemplateExpressions returns the expressions of a URI template, without their braces.
+func uriTemplateExpressions(tmpl string) []string {
+	var exprs []string
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			return exprs
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			return exprs
+		}
+		exprs = append(exprs, tmpl[start+1:start+end])
+		tmpl = tmpl[start+end+1:]
+	}
+}
+
+func parseURITemplateExpression(expr string) (uriTemplateOperator, []string) {
+	op := uriTemplateOperator{sep: ","}
+	if expr != "" {
+		if o, ok := uriTemplateOperators[expr[0]]; ok {
+			op = o
+			expr = expr[1:]
+		}
+	}
+	return op, strings.Split(expr, ",")
+}
+
+// parseURITemplateVarSpec returns the name of the variable of a varspec, and the length of its prefix
+// modifier, or 0 if it has none. The explode modifier is ignored, as the values are strings.
+func parseURITemplateVarSpec(spec string) (string, int) {
+	spec = strings.TrimSuffix(spec, "*")
+	name, prefix, ok := strings.Cut(spec, ":")
+	if !ok {
+		return name, 0
+	}
+	n, err := strconv.Atoi(prefix)
+	if err != nil {
+		return name, 0
+	}
+	return name, n
+}
+
+// encodeURITemplateValue percent-encodes the characters of value other than the unreserved ones, and the
+// reserved ones if allowReserved is true.
+func encodeURITemplateValue(value string, allowReserved bool) string {
+	const hex = "0123456789ABCDEF"
+	var sb strings.Builder
+	for i := range len(value) {
+		c := value[i]
+		if isURIUnreserved(c) || (allowReserved && (strings.IndexByte(":/?#[]@!$&'()*+,;=%", c) >= 0)) {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte(hex[c>>4])
+		sb.WriteByte(hex[c&0x0F])
+	}
+	return sb.String()
+}
+
+func isURIUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
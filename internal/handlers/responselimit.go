@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// ResponseLimit configures the soft limit of the length of the responses in the chats. The length of a
+// response is shown while it's streamed, and its generation is stopped once it reaches the limit, the user
+// choosing whether to continue it.
+type ResponseLimit struct {
+	// Tokens is the estimated number of tokens of the text generated by the LLM after which the generation is
+	// stopped. Zero disables the limit.
+	Tokens int
+}
+
+// responseLimitKey is the context key marking the generations of the chats, whose responses are limited.
+type responseLimitKey struct{}
+
+// responseLimit measures the text of a generation against ResponseLimit.
+type responseLimit struct {
+	tokens int
+	// startChars is the length of the text of the message before the generation, as a continued message
+	// has its previous text.
+	startChars int
+}
+
+const continueInstructions = "Your previous response was interrupted. Continue it exactly where it stopped, " +
+	"without repeating it nor acknowledging the interruption."
+
+// WithResponseLimit stops the generation of the responses in the chats at a soft limit of their length,
+// with a button to continue them.
+func WithResponseLimit(limit ResponseLimit) MainOption {
+	return func(m *Main) {
+		m.responseLimit = limit
+	}
+}
+
+func (m *Main) parseResponseLimit() error {
+	if m.responseLimit.Tokens < 0 {
+		return errors.New("the tokens of the response limit must not be negative")
+	}
+	return nil
+}
+
+// withResponseLimit returns a copy of ctx whose generations are limited by ResponseLimit.
+func withResponseLimit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, responseLimitKey{}, true)
+}
+
+// newResponseLimit returns the limit of the generation of aiMsg with ctx, and whether it's limited. The
+// structured responses aren't, as a truncated JSON value is invalid.
+func (m *Main) newResponseLimit(ctx context.Context, aiMsg models.Message, structured bool) (responseLimit, bool) {
+	limited, _ := ctx.Value(responseLimitKey{}).(bool)
+	if !limited || m.responseLimit.Tokens == 0 || structured {
+		return responseLimit{}, false
+	}
+	return responseLimit{tokens: m.responseLimit.Tokens, startChars: textLength(aiMsg.Contents)}, true
+}
+
+// chars returns the length of the text generated in aiMsg.
+func (l responseLimit) chars(aiMsg models.Message) int {
+	return textLength(aiMsg.Contents) - l.startChars
+}
+
+// reached reports whether the text generated in aiMsg reached the limit, its tokens being estimated like
+// the ones of the message stats.
+func (l responseLimit) reached(aiMsg models.Message) bool {
+	return (l.chars(aiMsg)+3)/4 >= l.tokens
+}
+
+// indicator returns the line showing the length of the text generated in aiMsg while it's streamed.
+func (l responseLimit) indicator(aiMsg models.Message) string {
+	chars := l.chars(aiMsg)
+	return fmt.Sprintf("%d chars · ~%d / %d tokens", chars, (chars+3)/4, l.tokens)
+}
+
+func textLength(contents []models.Content) int {
+	length := 0
+	for _, ct := range contents {
+		length += len(ct.Text)
+	}
+	return length
+}
+
+// HandleContinue continues the generation of an assistant message stopped at the soft limit of the
+// response length, truncated by the LLM at its maximum output tokens, or interrupted by an error, the
+// continuation being appended to its last text. It accepts POST requests with the "chat_id" and "message_id"
+// form fields, the message having to be the last one of the chat, and renders the message streaming its
+// continuation.
+func (m *Main) HandleContinue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chatID, messageID := r.FormValue("chat_id"), r.FormValue("message_id")
+	if !m.authorizeChat(w, r, chatID) {
+		return
+	}
+	messages, err := m.store.Messages(r.Context(), chatID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get messages", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(messages) == 0 || messages[len(messages)-1].ID != messageID {
+		http.Error(w, "Message isn't the last one of the chat", http.StatusConflict)
+		return
+	}
+	aiMsg := messages[len(messages)-1]
+	if !aiMsg.LengthLimited && aiMsg.FinishReason != models.FinishReasonLength && aiMsg.Interruption == "" {
+		http.Error(w, "Message wasn't stopped before the end of its response", http.StatusConflict)
+		return
+	}
+
+	userID := m.userID(r)
+	if !m.checkQuota(w, r, userID) {
+		return
+	}
+
+	aiMsg.LengthLimited = false
+	aiMsg.FinishReason = ""
+	aiMsg.Interruption = ""
+	aiMsg.Stats = nil
+	if err := m.store.UpdateMessage(r.Context(), chatID, aiMsg); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to update message", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The message may be a reply of a thread, continued with its transcript only.
+	messages = models.MessagePath(messages, aiMsg.ID)
+	messages[len(messages)-1] = aiMsg
+
+	genCtx := models.WithSystemPrompt(m.generationContext(r.Context(), userID), continueInstructions)
+	m.claimMessageTopic(chatID, aiMsg.ID, userID)
+	go func() {
+		// The error is already logged and published to the client by the generation.
+		_ = m.chat(genCtx, userID, chatID, messages)
+	}()
+
+	content, err := models.RenderContents(aiMsg.Contents)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to render contents", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = m.templates.ExecuteTemplate(w, "ai_message", message{
+		ID:             aiMsg.ID,
+		Role:           string(aiMsg.Role),
+		Content:        content,
+		Timestamp:      aiMsg.Timestamp.In(userLocation(r)),
+		StreamingState: "loading",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// renderLength returns the length indicator of aiMsg, swapped out of band in its stats line with the rendered
+// contents streamed.
+func (m *Main) renderLength(limit responseLimit, aiMsg models.Message) (string, error) {
+	var sb strings.Builder
+	if err := m.templates.ExecuteTemplate(&sb, "message_stats", message{
+		ID:    aiMsg.ID,
+		Stats: limit.indicator(aiMsg),
+	}); err != nil {
+		return "", fmt.Errorf("failed to execute message_stats template: %w", err)
+	}
+	return sb.String(), nil
+}
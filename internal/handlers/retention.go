@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// Retention limits how long and how many chats are kept. A chat's age is the time of its last message.
+// A zero value of a limit means it's disabled.
+type Retention struct {
+	// RetainDays deletes the chats without any message in the last RetainDays days.
+	RetainDays int
+	// MaxChats deletes the least recently active chats beyond the first MaxChats.
+	MaxChats int
+	// ArchiveDir is the directory the chats are written to as JSON files before they are deleted. The chats
+	// are deleted without archiving if it's empty.
+	ArchiveDir string
+}
+
+// Compactor is implemented by the stores that can reclaim the space left by the deleted chats, like the
+// BoltDB store. The stores that don't implement it are not compacted after a purge.
+type Compactor interface {
+	Compact(ctx context.Context) error
+}
+
+type purgeResult struct {
+	DeletedChats  int `json:"deletedChats"`
+	ArchivedChats int `json:"archivedChats"`
+}
+
+type archivedChat struct {
+	Chat     models.Chat      `json:"chat"`
+	Messages []models.Message `json:"messages"`
+}
+
+const (
+	// retentionStartDelay delays the first purge of the janitor, to not compete with the start of the server.
+	retentionStartDelay = time.Minute
+	// retentionInterval is the interval between the purges of the janitor.
+	retentionInterval = time.Hour
+)
+
+// WithRetention enables the janitor, purging the chats beyond the given retention shortly after the start
+// and then every hour, and HandlePurge.
+func WithRetention(retention Retention) MainOption {
+	return func(m *Main) {
+		m.retention = retention
+	}
+}
+
+func (r Retention) enabled() bool {
+	return r.RetainDays > 0 || r.MaxChats > 0
+}
+
+// runJanitor purges the chats beyond the retention periodically, until Main is shut down.
+func (m *Main) runJanitor() {
+	wait := retentionStartDelay
+	for {
+		select {
+		case <-m.backgroundDone:
+			return
+		case <-time.After(wait):
+		}
+		wait = retentionInterval
+
+		ctx := context.Background()
+		if _, err := m.purge(ctx); err != nil {
+			m.logger.ErrorContext(ctx, "Failed to purge chats", slog.String(errLoggerKey, err.Error()))
+		}
+	}
+}
+
+// purge archives and deletes the chats beyond the retention, then compacts the store if any chat was
+// deleted.
+func (m *Main) purge(ctx context.Context) (purgeResult, error) {
+	expired, err := m.expiredChats(ctx, time.Now())
+	if err != nil {
+		return purgeResult{}, err
+	}
+
+	var res purgeResult
+	for _, c := range expired {
+		if m.retention.ArchiveDir != "" {
+			if err := m.archiveChat(ctx, c); err != nil {
+				return res, err
+			}
+			res.ArchivedChats++
+		}
+		if err := m.store.DeleteChat(ctx, c.ID); err != nil {
+			return res, fmt.Errorf("failed to delete chat %s: %w", c.ID, err)
+		}
+		res.DeletedChats++
+	}
+	if res.DeletedChats == 0 {
+		return res, nil
+	}
+
+	m.logger.InfoContext(ctx, "Purged chats",
+		slog.Int("deleted", res.DeletedChats),
+		slog.Int("archived", res.ArchivedChats))
+
+	if err := m.publishChats(ctx); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to publish chats", slog.String(errLoggerKey, err.Error()))
+	}
+
+	if c, ok := m.storeBackend.(Compactor); ok {
+		if err := c.Compact(ctx); err != nil {
+			return res, fmt.Errorf("failed to compact store: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// expiredChats returns the chats beyond the retention at now. The chats without messages are just
+// created, so they are considered active at now.
+func (m *Main) expiredChats(ctx context.Context, now time.Time) ([]models.Chat, error) {
+	chats, err := m.store.Chats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chats: %w", err)
+	}
+
+	type activity struct {
+		chat         models.Chat
+		lastActivity time.Time
+	}
+	activities := make([]activity, len(chats))
+	for i, c := range chats {
+		msgs, err := m.store.Messages(ctx, c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get messages of chat %s: %w", c.ID, err)
+		}
+		last := now
+		if len(msgs) > 0 {
+			last = msgs[len(msgs)-1].Timestamp
+		}
+		activities[i] = activity{chat: c, lastActivity: last}
+	}
+	slices.SortStableFunc(activities, func(a, b activity) int {
+		return b.lastActivity.Compare(a.lastActivity)
+	})
+
+	cutoff := now.AddDate(0, 0, -m.retention.RetainDays)
+	var expired []models.Chat
+	for i, a := range activities {
+		beyondMax := m.retention.MaxChats > 0 && i >= m.retention.MaxChats
+		tooOld := m.retention.RetainDays > 0 && a.lastActivity.Before(cutoff)
+		if beyondMax || tooOld {
+			expired = append(expired, a.chat)
+		}
+	}
+	return expired, nil
+}
+
+func (m *Main) archiveChat(ctx context.Context, c models.Chat) error {
+	msgs, err := m.store.Messages(ctx, c.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get messages of chat %s: %w", c.ID, err)
+	}
+
+	if err := os.MkdirAll(m.retention.ArchiveDir, 0700); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	data, err := json.MarshalIndent(archivedChat{Chat: c, Messages: msgs}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal chat %s: %w", c.ID, err)
+	}
+	path := filepath.Join(m.retention.ArchiveDir, filepath.Base(c.ID)+".json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write archive of chat %s: %w", c.ID, err)
+	}
+	return nil
+}
+
+// HandlePurge purges the chats beyond the retention immediately, without waiting for the janitor, and
+// responds with the number of deleted and archived chats as JSON. It responds with 409 Conflict if no
+// retention is configured.
+func (m *Main) HandlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		m.writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !m.retention.enabled() {
+		m.writeAPIError(w, http.StatusConflict, "Retention is not configured")
+		return
+	}
+
+	res, err := m.purge(r.Context())
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to purge chats", slog.String(errLoggerKey, err.Error()))
+		m.writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	m.writeAPIJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// ScheduledPrompt is a prompt sent automatically on a cron schedule. The responses of all runs of a
+// scheduled prompt are written into a single chat designated to it, that is created on the first run.
+type ScheduledPrompt struct {
+	Name string
+	// Cron is a standard five-field cron expression, evaluated in the server's local time.
+	Cron   string
+	Prompt string
+	// Review generates the responses as drafts, hidden from the chat and not notified until they're approved
+	// on the schedules page.
+	Review bool
+}
+
+type scheduledPrompt struct {
+	ScheduledPrompt
+	cron cronSchedule
+}
+
+type schedulesPageData struct {
+	Schedules []scheduleView
+}
+
+type scheduleView struct {
+	ScheduledPrompt
+	ChatID  string
+	NextRun time.Time
+	Runs    []models.ScheduleRun
+	// Drafts are the responses of the schedule awaiting their review, the oldest first.
+	Drafts []draftView
+}
+
+const (
+	// schedulerUserID is the user ID the usage of the scheduled prompts is recorded to.
+	schedulerUserID = "scheduler"
+
+	maxScheduleRunsShown = 20
+)
+
+// WithSchedules enables the scheduler, sending the given prompts on their schedules. NewMain returns an
+// error if any of the prompts has an invalid cron expression or a duplicated name.
+func WithSchedules(schedules []ScheduledPrompt) MainOption {
+	return func(m *Main) {
+		m.scheduledPrompts = schedules
+	}
+}
+
+func parseSchedules(schedules []ScheduledPrompt) ([]scheduledPrompt, error) {
+	parsed := make([]scheduledPrompt, 0, len(schedules))
+	for _, sp := range schedules {
+		if sp.Name == "" || sp.Prompt == "" {
+			return nil, fmt.Errorf("schedule name and prompt are required")
+		}
+		// The name is used as the key prefix of the run history in the store.
+		if strings.Contains(sp.Name, "/") {
+			return nil, fmt.Errorf("schedule name %s must not contain '/'", sp.Name)
+		}
+		if slices.ContainsFunc(parsed, func(p scheduledPrompt) bool { return p.Name == sp.Name }) {
+			return nil, fmt.Errorf("duplicated schedule name %s", sp.Name)
+		}
+		c, err := parseCron(sp.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression of schedule %s: %w", sp.Name, err)
+		}
+		parsed = append(parsed, scheduledPrompt{ScheduledPrompt: sp, cron: c})
+	}
+	return parsed, nil
+}
+
+// runScheduler wakes up at the start of every minute and runs the scheduled prompts matching it, until
+// the scheduler is stopped.
+func (m *Main) runScheduler() {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-m.backgroundDone:
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		for _, sp := range m.schedules {
+			if sp.cron.matches(next) {
+				go m.runSchedule(m.generationContext(context.Background(), schedulerUserID), sp.ScheduledPrompt)
+			}
+		}
+	}
+}
+
+func (m *Main) runSchedule(ctx context.Context, sp ScheduledPrompt) {
+	run := models.ScheduleRun{
+		ScheduleName: sp.Name,
+		StartedAt:    time.Now(),
+	}
+
+	m.logger.InfoContext(ctx, "Running scheduled prompt", slog.String("schedule", sp.Name))
+
+	err := m.sendScheduledPrompt(ctx, sp, &run)
+	run.FinishedAt = time.Now()
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to run scheduled prompt",
+			slog.String("schedule", sp.Name),
+			slog.String(errLoggerKey, err.Error()))
+		run.Error = err.Error()
+	}
+
+	if err := m.store.AddScheduleRun(ctx, run); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to add schedule run",
+			slog.String("run", fmt.Sprintf("%+v", run)),
+			slog.String(errLoggerKey, err.Error()))
+	}
+
+	m.notify(ctx, models.Event{
+		Type:      models.EventScheduleCompleted,
+		ChatID:    run.ChatID,
+		MessageID: run.MessageID,
+		Data: map[string]any{
+			"schedule": sp.Name,
+			"error":    run.Error,
+			"draft":    sp.Review,
+		},
+	})
+}
+
+func (m *Main) sendScheduledPrompt(ctx context.Context, sp ScheduledPrompt, run *models.ScheduleRun) error {
+	chatID, err := m.scheduleChat(ctx, sp)
+	if err != nil {
+		return err
+	}
+	run.ChatID = chatID
+
+	um := models.Message{
+		ID:   uuid.New().String(),
+		Role: models.RoleUser,
+		Contents: []models.Content{
+			{
+				Type: models.ContentTypeText,
+				Text: sp.Prompt,
+			},
+		},
+		Timestamp: time.Now(),
+	}
+	if _, err := m.store.AddMessage(ctx, chatID, um); err != nil {
+		return fmt.Errorf("failed to add user message: %w", err)
+	}
+	m.recordUsage(ctx, schedulerUserID, 1, 0)
+
+	am := models.Message{
+		ID:        uuid.New().String(),
+		Role:      models.RoleAssistant,
+		Timestamp: time.Now(),
+		Draft:     sp.Review,
+	}
+	aiMsgID, err := m.store.AddMessage(ctx, chatID, am)
+	if err != nil {
+		return fmt.Errorf("failed to add AI message: %w", err)
+	}
+	run.MessageID = aiMsgID
+
+	messages, err := m.store.MessagePath(ctx, chatID, aiMsgID)
+	if err != nil {
+		return fmt.Errorf("failed to get messages: %w", err)
+	}
+
+	return m.chat(ctx, schedulerUserID, chatID, messages)
+}
+
+// scheduleChat returns the chat designated to the scheduled prompt, creating it if it doesn't exist yet
+// or it's no longer available.
+func (m *Main) scheduleChat(ctx context.Context, sp ScheduledPrompt) (string, error) {
+	schedules, err := m.store.Schedules(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get schedules: %w", err)
+	}
+	idx := slices.IndexFunc(schedules, func(s models.Schedule) bool { return s.Name == sp.Name })
+	if idx >= 0 && schedules[idx].ChatID != "" {
+		chats, err := m.store.Chats(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get chats: %w", err)
+		}
+		if slices.ContainsFunc(chats, func(c models.Chat) bool { return c.ID == schedules[idx].ChatID }) {
+			return schedules[idx].ChatID, nil
+		}
+	}
+
+	chatID, err := m.newChat(ctx, models.Chat{Title: sp.Name})
+	if err != nil {
+		return "", err
+	}
+	if err := m.store.SaveSchedule(ctx, models.Schedule{Name: sp.Name, ChatID: chatID}); err != nil {
+		return "", fmt.Errorf("failed to save schedule: %w", err)
+	}
+
+	return chatID, nil
+}
+
+// HandleSchedules renders the schedules page, showing every scheduled prompt with its next run time and
+// its recent run history.
+func (m *Main) HandleSchedules(w http.ResponseWriter, r *http.Request) {
+	saved, err := m.store.Schedules(r.Context())
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get schedules", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := schedulesPageData{
+		Schedules: make([]scheduleView, len(m.schedules)),
+	}
+	now := time.Now()
+	for i, sp := range m.schedules {
+		runs, err := m.store.ScheduleRuns(r.Context(), sp.Name)
+		if err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to get schedule runs",
+				slog.String("schedule", sp.Name),
+				slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(runs) > maxScheduleRunsShown {
+			runs = runs[:maxScheduleRunsShown]
+		}
+
+		view := scheduleView{
+			ScheduledPrompt: sp.ScheduledPrompt,
+			NextRun:         sp.cron.next(now),
+			Runs:            runs,
+		}
+		if idx := slices.IndexFunc(saved, func(s models.Schedule) bool { return s.Name == sp.Name }); idx >= 0 {
+			view.ChatID = saved[idx].ChatID
+		}
+		if view.ChatID != "" {
+			if view.Drafts, err = m.drafts(r, view.ChatID); err != nil {
+				m.logger.ErrorContext(r.Context(), "Failed to get drafts",
+					slog.String("schedule", sp.Name),
+					slog.String(errLoggerKey, err.Error()))
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		data.Schedules[i] = view
+	}
+
+	if err := m.renderPage(w, "schedules.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute schedules template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleScheduleRun runs the scheduled prompt given by the "name" form field immediately, regardless of its
+// schedule, and redirects back to the schedules page. The run happens in the background.
+func (m *Main) HandleScheduleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("name")
+	idx := slices.IndexFunc(m.schedules, func(sp scheduledPrompt) bool { return sp.Name == name })
+	if idx < 0 {
+		m.logger.ErrorContext(r.Context(), "Schedule not found", slog.String("name", name))
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+
+	go m.runSchedule(m.generationContext(r.Context(), schedulerUserID), m.schedules[idx].ScheduledPrompt)
+
+	http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Security configures the protections applied by the Secure middleware.
+type Security struct {
+	// ContentSecurityPolicy is sent as the Content-Security-Policy header if it's not empty. The
+	// templates use inline scripts and load assets from CDNs, which the policy must allow.
+	ContentSecurityPolicy string
+	// FrameOptions is sent as the X-Frame-Options header, it defaults to DENY.
+	FrameOptions string
+	// SecureCookies marks the cookies set by the server as Secure, which should be enabled when the UI is
+	// served over HTTPS.
+	SecureCookies bool
+	// DisableCSRF disables the CSRF protection, e.g. when another layer in front of the UI provides it.
+	DisableCSRF bool
+}
+
+const (
+	csrfCookieName = "mcpwebui_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+
+	defaultFrameOptions = "DENY"
+)
+
+// WithSecurity configures the Secure middleware.
+func WithSecurity(security Security) MainOption {
+	return func(m *Main) {
+		m.security = security
+	}
+}
+
+// Secure is a middleware that sets the security headers on every response, and protects the
+// state-changing requests from cross-site request forgery with the double-submit cookie pattern: every
+// client gets a random token in a cookie, and the requests other than GET, HEAD and OPTIONS must send the
+// same token in the X-CSRF-Token header or the csrf_token form field. The base layout does that for
+// every htmx request and form.
+//
+// Requests with a JSON body are exempted, as browsers can't send them cross-site without a CORS
+// preflight, which keeps the chat API usable by non-browser clients.
+func (m *Main) Secure(next http.Handler) http.Handler {
+	frameOptions := m.security.FrameOptions
+	if frameOptions == "" {
+		frameOptions = defaultFrameOptions
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Frame-Options", frameOptions)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "same-origin")
+		if m.security.ContentSecurityPolicy != "" {
+			h.Set("Content-Security-Policy", m.security.ContentSecurityPolicy)
+		}
+
+		if m.security.DisableCSRF {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var cookieToken string
+		if c, err := r.Cookie(csrfCookieName); err == nil {
+			cookieToken = c.Value
+		}
+		if cookieToken == "" {
+			token, err := newCSRFToken()
+			if err != nil {
+				m.logger.ErrorContext(r.Context(), "Failed to generate CSRF token", slog.String(errLoggerKey, err.Error()))
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// The cookie is readable by the scripts, as the page has to send it back in the header.
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    token,
+				Path:     "/",
+				Secure:   m.security.SecureCookies,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The browsers never send the Authorization header on their own, so the requests with an API token
+		// can't be forged.
+		if strings.HasPrefix(r.URL.Path, "/api/") && r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.Header.Get(csrfHeaderName)
+		if token == "" {
+			token = r.PostFormValue(csrfFormField)
+		}
+		if cookieToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cookieToken)) != 1 {
+			m.logger.WarnContext(r.Context(), "Invalid CSRF token",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path))
+			m.renderError(w, http.StatusForbidden, "Invalid CSRF token, please reload the page.")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
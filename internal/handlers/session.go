@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// Sessions configures the browser sessions of WithSessions.
+type Sessions struct {
+	Enabled bool
+	// IdleTimeout ends the sessions without any request for this long. It's 30 days if zero.
+	IdleTimeout time.Duration
+}
+
+type sessionsPageData struct {
+	Sessions []sessionView
+}
+
+// sessionView is a session in the sessions page, Current being the session of the browser showing the page.
+type sessionView struct {
+	models.Session
+	Current bool
+}
+
+type sessionIDKey struct{}
+
+const (
+	sessionCookieName         = "mcpwebui_session"
+	defaultSessionIdleTimeout = 30 * 24 * time.Hour
+	// sessionActivityInterval is the minimum interval between the updates of the last activity of a session,
+	// which would write to the store on every request otherwise.
+	sessionActivityInterval = time.Minute
+)
+
+// WithSessions records the browser sessions of the users, validated by the Sessions middleware on every
+// request, and listed at /settings/sessions where the users revoke them. NewMain returns an error if the
+// idle timeout is negative.
+func WithSessions(sessions Sessions) MainOption {
+	return func(m *Main) {
+		m.sessions = sessions
+	}
+}
+
+func (m *Main) parseSessions() error {
+	if m.sessions.IdleTimeout < 0 {
+		return errors.New("the idle timeout of the sessions must not be negative")
+	}
+	if m.sessions.IdleTimeout == 0 {
+		m.sessions.IdleTimeout = defaultSessionIdleTimeout
+	}
+	return nil
+}
+
+// Sessions is a middleware validating the browser session of every request, held by a cookie, if
+// WithSessions is set. A browser without a session starts one with its first page. The requests of a
+// session that was revoked, expired after its idle timeout or belongs to another user are refused with 401
+// Unauthorized, and its cookie is cleared, so the browser starts a new session when the page is reloaded.
+// The static assets, the chat API authenticated by its tokens, the observer pages and the shared chats have no
+// session, as the SSE connections without a session, like the ones of the observers.
+func (m *Main) Sessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.sessions.Enabled || !sessionRoute(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/sse/") {
+				session, err := m.startSession(w, r)
+				if err != nil {
+					m.logger.ErrorContext(r.Context(), "Failed to start session", slog.String(errLoggerKey, err.Error()))
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				r = r.WithContext(context.WithValue(r.Context(), sessionIDKey{}, session.ID))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, err := m.store.SessionByHash(r.Context(), hashAPIToken(cookie.Value))
+		if err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to get session", slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if session.ID == "" || session.UserID != m.userID(r) ||
+			time.Since(session.LastActiveAt) > m.sessions.IdleTimeout {
+			m.endSession(w, r, session)
+			return
+		}
+
+		ip, userAgent := m.clientIP(r), r.UserAgent()
+		if time.Since(session.LastActiveAt) >= sessionActivityInterval || session.IP != ip ||
+			session.UserAgent != userAgent {
+			session.IP, session.UserAgent, session.LastActiveAt = ip, userAgent, time.Now()
+			if err := m.store.SaveSession(r.Context(), session); err != nil {
+				m.logger.ErrorContext(r.Context(), "Failed to update session activity",
+					slog.String(errLoggerKey, err.Error()))
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionIDKey{}, session.ID)))
+	})
+}
+
+func sessionRoute(r *http.Request) bool {
+	for _, prefix := range []string{"/static/", "/api/", "/observe/", "/share/"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	}
+	return r.URL.Path != "/sw.js"
+}
+
+// startSession records a new session of the user of r, and sets its cookie.
+func (m *Main) startSession(w http.ResponseWriter, r *http.Request) (models.Session, error) {
+	token, err := newAPIToken()
+	if err != nil {
+		return models.Session{}, err
+	}
+	now := time.Now()
+	session := models.Session{
+		ID:           uuid.New().String(),
+		UserID:       m.userID(r),
+		Hash:         hashAPIToken(token),
+		IP:           m.clientIP(r),
+		UserAgent:    r.UserAgent(),
+		CreatedAt:    now,
+		LastActiveAt: now,
+	}
+	if err := m.store.SaveSession(r.Context(), session); err != nil {
+		return models.Session{}, err
+	}
+	m.setSessionCookie(w, token, int(m.sessions.IdleTimeout.Seconds()))
+	m.addAuthEvent(r.Context(), session.IP, session.UserID, models.AuditActionAuthLogin, session.UserAgent)
+	return session, nil
+}
+
+// endSession refuses the request of an ended session, deleting it if it's still stored, and clears its
+// cookie.
+func (m *Main) endSession(w http.ResponseWriter, r *http.Request, session models.Session) {
+	if session.ID != "" {
+		if err := m.store.DeleteSession(r.Context(), session.UserID, session.ID); err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to delete ended session", slog.String(errLoggerKey, err.Error()))
+		}
+	}
+	m.setSessionCookie(w, "", -1)
+
+	const msg = "Your session has ended, reload the page to start a new one"
+	if r.Header.Get("HX-Request") != "" {
+		m.renderError(w, http.StatusUnauthorized, msg)
+		return
+	}
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+func (m *Main) setSessionCookie(w http.ResponseWriter, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   m.security.SecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// HandleSessions renders the page of the active browser sessions of the current user, with their IP
+// address, browser and last activity, from which they're revoked.
+func (m *Main) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !m.sessions.Enabled {
+		http.Error(w, "Sessions are disabled", http.StatusNotFound)
+		return
+	}
+
+	sessions, err := m.store.Sessions(r.Context(), m.userID(r))
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get sessions", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sessions = slices.DeleteFunc(sessions, func(s models.Session) bool {
+		return time.Since(s.LastActiveAt) > m.sessions.IdleTimeout
+	})
+
+	currentID, _ := r.Context().Value(sessionIDKey{}).(string)
+	loc := userLocation(r)
+	var data sessionsPageData
+	for _, s := range slices.Backward(sessions) {
+		s.CreatedAt, s.LastActiveAt = s.CreatedAt.In(loc), s.LastActiveAt.In(loc)
+		data.Sessions = append(data.Sessions, sessionView{Session: s, Current: s.ID == currentID})
+	}
+	if err := m.renderPage(w, "sessions.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute sessions template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleSessionRevoke revokes the current user's browser session given by the "id" form field, whose next
+// request is refused, and redirects back to the sessions page. Revoking the session of the current browser
+// clears its cookie, so it starts a new session.
+func (m *Main) HandleSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !m.sessions.Enabled {
+		http.Error(w, "Sessions are disabled", http.StatusNotFound)
+		return
+	}
+
+	sessionID := r.FormValue("id")
+	if err := m.store.DeleteSession(r.Context(), m.userID(r), sessionID); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to delete session", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.addAuthEvent(r.Context(), m.clientIP(r), m.userID(r), models.AuditActionAuthRevoke, "Session "+sessionID)
+	if currentID, _ := r.Context().Value(sessionIDKey{}).(string); currentID == sessionID {
+		m.setSessionCookie(w, "", -1)
+	}
+
+	http.Redirect(w, r, "/settings/sessions", http.StatusSeeOther)
+}
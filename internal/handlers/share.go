@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// chatShare is the view of the share link of a chat in the chat_share template. CanManage reports whether
+// the user of the page created the chat, creating and revoking the link.
+type chatShare struct {
+	ChatID    string
+	Link      string
+	Encrypted bool
+	CanManage bool
+}
+
+type sharePageData struct {
+	// Title is the title of the shared chat, empty if it's encrypted, as the title isn't.
+	Title      string
+	Transcript string
+	Encrypted  bool
+	CreatedAt  time.Time
+}
+
+// encryptedTranscriptOverhead is the length of the salt, the IV and the AES-GCM tag of an encrypted transcript,
+// the minimum length of the payload sent by the browser.
+const encryptedTranscriptOverhead = 16 + 12 + 16
+
+// HandleChatShare shares a snapshot of a chat by a public link, letting anyone with the link read its
+// transcript at the time it was shared, or revokes the link. It accepts POST requests with the chat_id form
+// field, and the action field, "revoke" to revoke the link. The optional "ciphertext" field is the transcript
+// encrypted in the browser with a passphrase, the server storing and serving the ciphertext only. A new link
+// replaces the previous one. Only the user who created the chat manages its link. It renders the chat_share
+// template.
+//
+// GET requests with the chat_id query parameter render the transcript of the chat, which the browser
+// encrypts before sending it back.
+func (m *Main) HandleChatShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c, err := m.findUserChat(r, r.FormValue("chat_id"))
+	if errors.Is(err, errChatNotFound) {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !chatOwner(c, m.userID(r)) {
+		m.renderError(w, http.StatusForbidden, "Only the user who created the chat shares it")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		transcript, err := m.renderTranscript(r, c)
+		if err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to render transcript", slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write([]byte(transcript))
+		return
+	}
+
+	c.Share = nil
+	if r.FormValue("action") != "revoke" {
+		if c.Share, err = m.createChatShare(r, c); err != nil {
+			m.renderError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err := m.store.UpdateChat(r.Context(), c); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to update chat share", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.logger.InfoContext(r.Context(), "Updated chat share",
+		slog.String("chatID", c.ID),
+		slog.Bool("shared", c.Share != nil))
+
+	if err := m.templates.ExecuteTemplate(w, "chat_share", newChatShare(c, m.userID(r))); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute chat_share template",
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleShare renders the public page of the shared chat of the token path value. An encrypted transcript
+// is served as is, with the form decrypting it in the browser with its passphrase. It responds with 404 Not
+// Found if the link doesn't exist or was revoked.
+func (m *Main) HandleShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c, err := m.sharedChat(r.Context(), r.PathValue("token"))
+	if errors.Is(err, errChatNotFound) {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get chat", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := sharePageData{
+		Transcript: c.Share.Transcript,
+		Encrypted:  c.Share.Encrypted,
+		CreatedAt:  c.Share.CreatedAt.In(userLocation(r)),
+	}
+	if !c.Share.Encrypted {
+		data.Title = c.Title
+	}
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := m.renderPage(w, "share.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute share template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// createChatShare returns a new share of c with the ciphertext of the form of r, or its transcript rendered now
+// if the form has none.
+func (m *Main) createChatShare(r *http.Request, c models.Chat) (*models.ChatShare, error) {
+	token, err := newObserverToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create share token: %w", err)
+	}
+	share := &models.ChatShare{Token: token, CreatedAt: time.Now()}
+	if ciphertext := r.FormValue("ciphertext"); ciphertext != "" {
+		payload, err := base64.StdEncoding.DecodeString(ciphertext)
+		if err != nil || len(payload) <= encryptedTranscriptOverhead {
+			return nil, errors.New("the encrypted transcript is invalid")
+		}
+		share.Transcript, share.Encrypted = ciphertext, true
+		return share, nil
+	}
+	if share.Transcript, err = m.renderTranscript(r, c); err != nil {
+		return nil, fmt.Errorf("failed to render transcript: %w", err)
+	}
+	return share, nil
+}
+
+// renderTranscript renders the messages of c with the shared_transcript template, as they're shown in the
+// chat.
+func (m *Main) renderTranscript(r *http.Request, c models.Chat) (string, error) {
+	ms, err := m.store.Messages(r.Context(), c.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get messages: %w", err)
+	}
+	messages, err := m.messageViews(r, c, ms, false)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := m.templates.ExecuteTemplate(&buf, "shared_transcript", messages); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func newChatShare(c models.Chat, userID string) chatShare {
+	view := chatShare{ChatID: c.ID, CanManage: chatOwner(c, userID)}
+	if c.Share != nil {
+		view.Link = "/share/" + c.Share.Token
+		view.Encrypted = c.Share.Encrypted
+	}
+	return view
+}
+
+// sharedChat returns the chat of the share link of token, or errChatNotFound if there's none.
+func (m *Main) sharedChat(ctx context.Context, token string) (models.Chat, error) {
+	if token == "" {
+		return models.Chat{}, errChatNotFound
+	}
+	chats, err := m.store.Chats(ctx)
+	if err != nil {
+		return models.Chat{}, err
+	}
+	idx := slices.IndexFunc(chats, func(c models.Chat) bool {
+		return c.Share != nil && subtle.ConstantTimeCompare([]byte(c.Share.Token), []byte(token)) == 1
+	})
+	if idx < 0 {
+		return models.Chat{}, errChatNotFound
+	}
+	return chats[idx], nil
+}
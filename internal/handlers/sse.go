@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tmaxmax/go-sse"
+)
+
+// SSEKeepAlive configures the keep-alive of the SSE connections, which keeps the idle connections from being
+// dropped by the proxies in front of the server, like nginx or Cloudflare, and tells the browsers how fast
+// to reconnect when they are dropped anyway.
+type SSEKeepAlive struct {
+	// Interval is the interval between the heartbeat comments sent to every connection. It defaults to
+	// 15 seconds, a negative value disables the heartbeats.
+	Interval time.Duration
+	// Retry is the reconnection delay hinted to the browsers when they connect. The browsers use their own
+	// default, around 3 seconds, if it's zero.
+	Retry time.Duration
+}
+
+// messageTopics are the users and chats the message topics of the responses being generated belong to, keyed
+// by the IDs of the messages.
+type messageTopics struct {
+	mu    sync.Mutex
+	items map[string]messageTopic
+}
+
+type messageTopic struct {
+	userID string
+	chatID string
+}
+
+// defaultSSEKeepAliveInterval is below the 60 seconds read timeout of nginx and the 100 seconds idle timeout
+// of Cloudflare.
+const defaultSSEKeepAliveInterval = 15 * time.Second
+
+// WithSSEKeepAlive overrides the default keep-alive of the SSE connections.
+func WithSSEKeepAlive(keepAlive SSEKeepAlive) MainOption {
+	return func(m *Main) {
+		m.sseKeepAlive = keepAlive
+	}
+}
+
+// WithSSEProvider sets the provider of the SSE server, which publishes the events to the connected clients.
+// The events are only published to the clients connected to this instance by default, while a provider
+// fanning them out, like a RedisSSEProvider, lets several replicas run behind a load balancer.
+func WithSSEProvider(provider sse.Provider) MainOption {
+	return func(m *Main) {
+		m.sseSrv.Provider = provider
+	}
+}
+
+// WithSSEAuthorization authorizes the topics of the SSE connections. The connections must identify their user
+// with the header of WithUserHeader, if it's set. The stream of a response is only given to the user who sent
+// its message, while it's generated, and the updates of a chat to the connections of its creator or its
+// participants.
+func WithSSEAuthorization() MainOption {
+	return func(m *Main) {
+		m.sseAuthorization = true
+	}
+}
+
+func (m *Main) parseSSEKeepAlive() {
+	if m.sseKeepAlive.Interval == 0 {
+		m.sseKeepAlive.Interval = defaultSSEKeepAliveInterval
+	}
+}
+
+// onSSESession subscribes a new SSE connection to its topics, after authorizing them and sending it the retry
+// hint. The response is flushed right away, so the client knows the connection is open before the first
+// message.
+func (m *Main) onSSESession(s *sse.Session) (sse.Subscription, bool) {
+	if !m.authorizeSSE(s.Req) || !m.sseChatVisible(s.Req) {
+		m.logger.WarnContext(s.Req.Context(), "Unauthorized SSE topics", slog.String("query", s.Req.URL.RawQuery))
+		http.Error(s.Res, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return sse.Subscription{}, false
+	}
+	if m.sseKeepAlive.Retry > 0 {
+		if err := s.Send(&sse.Message{Retry: m.sseKeepAlive.Retry}); err != nil {
+			m.logger.WarnContext(s.Req.Context(), "Failed to send SSE retry hint", slog.String(errLoggerKey, err.Error()))
+			return sse.Subscription{}, false
+		}
+	}
+	if err := s.Flush(); err != nil {
+		m.logger.WarnContext(s.Req.Context(), "Failed to flush SSE session", slog.String(errLoggerKey, err.Error()))
+		return sse.Subscription{}, false
+	}
+
+	// The observers only follow the chat of their observer link, without the chat list.
+	if topic, ok := m.observerTopic(s.Req); ok {
+		return sse.Subscription{
+			Client:      sseClient{session: s},
+			LastEventID: s.LastEventID,
+			Topics:      []string{sse.DefaultTopic, topic},
+		}, true
+	}
+
+	// We start with default topics that all clients should subscribe to. The users who don't see all the
+	// chats get the list of their chats on their user topic instead of the chat list.
+	topics := []string{sse.DefaultTopic}
+	if m.allowed(s.Req, permViewChats) {
+		topics = append(topics, chatsSSETopic)
+	}
+
+	// We create a message-specific topic if the client requests updates for a particular message, and a
+	// chat-specific one if it shows a chat. The other clients list the chats and are notified when their
+	// generations complete, and when their user reads a chat. The chats created afterwards are only in the
+	// chat list, until the client reconnects.
+	query := s.Req.URL.Query()
+	switch {
+	case query.Get("message_id") != "":
+		topics = append(topics, messageIDTopic(query.Get("message_id")))
+	case query.Get("chat_id") != "":
+		topics = append(topics, chatMessagesTopic(query.Get("chat_id")))
+	default:
+		topics = append(topics, m.chatTopics(s.Req)...)
+		topics = append(topics, userTopic(m.userID(s.Req)))
+	}
+
+	return sse.Subscription{
+		Client:      sseClient{session: s},
+		LastEventID: s.LastEventID,
+		Topics:      topics,
+	}, true
+}
+
+// sseClient writes the messages to an SSE session, ignoring the write errors. The go-sse provider removes the
+// subscription of a client failing to write, which races with the removal of the subscription when the
+// session's request is done and panics when both happen. The subscriptions are only removed when the
+// requests are done instead, which follows shortly the closing of their connection.
+type sseClient struct {
+	session *sse.Session
+}
+
+func (c sseClient) Send(msg *sse.Message) error {
+	_ = c.session.Send(msg)
+	return nil
+}
+
+func (c sseClient) Flush() error {
+	_ = c.session.Flush()
+	return nil
+}
+
+// runSSEKeepAlive publishes a heartbeat comment to every SSE connection at the keep-alive interval, until
+// Main is shut down. The comments are ignored by the browsers, but keep the connections from being idle.
+func (m *Main) runSSEKeepAlive() {
+	ticker := time.NewTicker(m.sseKeepAlive.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.backgroundDone:
+			return
+		case <-ticker.C:
+		}
+
+		var msg sse.Message
+		msg.AppendComment("keep-alive")
+		if err := m.sseSrv.Publish(&msg, sse.DefaultTopic); err != nil {
+			m.logger.Warn("Failed to publish SSE keep-alive", slog.String(errLoggerKey, err.Error()))
+		}
+	}
+}
+
+// authorizeSSE reports whether the SSE connection of r is authorized to subscribe to its topics, always if
+// WithSSEAuthorization isn't set. The observers are authorized to follow the chat of their observer link,
+// without the user header.
+func (m *Main) authorizeSSE(r *http.Request) bool {
+	if !m.sseAuthorization {
+		return true
+	}
+	if _, ok := m.observerTopic(r); ok {
+		return true
+	}
+	if m.userHeader != "" && r.Header.Get(m.userHeader) == "" {
+		return false
+	}
+	query := r.URL.Query()
+	switch {
+	case query.Get("message_id") != "":
+		m.messageTopics.mu.Lock()
+		topic, ok := m.messageTopics.items[query.Get("message_id")]
+		m.messageTopics.mu.Unlock()
+		if !ok {
+			return false
+		}
+		if topic.userID == m.userID(r) {
+			return true
+		}
+		// The responses of a collaborative chat are streamed to all its participants.
+		c, err := m.findChat(r.Context(), topic.chatID)
+		return err == nil && len(c.Members) > 0 && c.Participant(m.userID(r))
+	case query.Get("chat_id") != "":
+		c, err := m.findChat(r.Context(), query.Get("chat_id"))
+		if err != nil {
+			return false
+		}
+		// The updates of a chat are given to its creator, the participants of a collaborative chat, and the
+		// users of WithAccess allowed to view the chats of the others.
+		userID := m.userID(r)
+		return chatOwner(c, userID) || (len(c.Members) > 0 && c.Participant(userID)) ||
+			(m.accessControl && m.roleAllows(userID, permViewChats))
+	}
+	return true
+}
+
+// claimMessageTopic gives the message topic of messageID, of the chat of chatID, to userID, until the
+// generation of the message ends. It must be called before the message is rendered for the user's page,
+// which subscribes to it.
+func (m *Main) claimMessageTopic(chatID, messageID, userID string) {
+	m.messageTopics.mu.Lock()
+	defer m.messageTopics.mu.Unlock()
+	m.messageTopics.items[messageID] = messageTopic{userID: userID, chatID: chatID}
+}
+
+func (m *Main) releaseMessageTopic(messageID string) {
+	m.messageTopics.mu.Lock()
+	defer m.messageTopics.mu.Unlock()
+	delete(m.messageTopics.items, messageID)
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// streamStats measures the latency of a generation as the chunks of its LLM turns are streamed.
+type streamStats struct {
+	startedAt  time.Time
+	firstChunk time.Time
+	// turnStart is the time of the first chunk of the current turn, zero until it's streamed.
+	turnStart time.Time
+	lastChunk time.Time
+	streaming time.Duration
+}
+
+func newStreamStats(startedAt time.Time) *streamStats {
+	return &streamStats{startedAt: startedAt}
+}
+
+// chunk records a chunk streamed by the LLM.
+func (s *streamStats) chunk() {
+	now := time.Now()
+	if s.firstChunk.IsZero() {
+		s.firstChunk = now
+	}
+	if s.turnStart.IsZero() {
+		s.turnStart = now
+	}
+	s.lastChunk = now
+}
+
+// endTurn records the end of an LLM turn, so the time spent calling the tool before the next turn isn't
+// counted as streaming.
+func (s *streamStats) endTurn() {
+	if s.turnStart.IsZero() {
+		return
+	}
+	s.streaming += s.lastChunk.Sub(s.turnStart)
+	s.turnStart = time.Time{}
+}
+
+// stats returns the statistics of the generated msg, or nil if no chunk was streamed.
+func (s *streamStats) stats(msg models.Message) *models.MessageStats {
+	if s.firstChunk.IsZero() {
+		return nil
+	}
+	chars := 0
+	for _, ct := range msg.Contents {
+		chars += len(ct.Text) + len(ct.ToolInput)
+	}
+	stats := &models.MessageStats{
+		TimeToFirstToken: s.firstChunk.Sub(s.startedAt),
+		OutputTokens:     (chars + 3) / 4,
+	}
+	if s.streaming > 0 {
+		stats.TokensPerSecond = float64(stats.OutputTokens) / s.streaming.Seconds()
+	}
+	return stats
+}
+
+// formatStats returns the stats line shown under an assistant message, or an empty string if stats is nil.
+func formatStats(stats *models.MessageStats) string {
+	if stats == nil {
+		return ""
+	}
+	parts := []string{"TTFT " + stats.TimeToFirstToken.Round(time.Millisecond).String()}
+	if stats.TokensPerSecond > 0 {
+		parts = append(parts, fmt.Sprintf("%.1f tokens/s", stats.TokensPerSecond))
+	}
+	parts = append(parts, fmt.Sprintf("%d tokens", stats.OutputTokens))
+	return strings.Join(parts, " · ")
+}
+
+// finishNote returns the note shown under an assistant message the LLM ended for reason, or an empty string
+// if it's the natural end of the message.
+func finishNote(reason models.FinishReason) string {
+	switch reason {
+	case "", models.FinishReasonStop:
+		return ""
+	case models.FinishReasonLength:
+		return "Stopped at the maximum output tokens of the model."
+	case models.FinishReasonToolUse:
+		return "Stopped to call a tool."
+	case models.FinishReasonContentFilter:
+		return "Stopped by the content filter of the provider."
+	case models.FinishReasonRefusal:
+		return "The model refused to respond."
+	default:
+		return fmt.Sprintf("Stopped by the provider: %s.", reason)
+	}
+}
+
+// publishStats publishes the final content of aiMsg with its stats line, swapped out of band under the
+// message with the note of its finish reason and the button to continue it if it was stopped at the length
+// limit or at the maximum output tokens, as the stats are only known once the generation completes.
+func (m *Main) publishStats(ctx context.Context, aiMsg models.Message) {
+	rc, err := models.RenderContents(aiMsg.Contents)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to render contents", slog.String(errLoggerKey, err.Error()))
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(rc)
+	if err := m.templates.ExecuteTemplate(&sb, "message_stats", message{
+		ID:            aiMsg.ID,
+		Stats:         formatStats(aiMsg.Stats),
+		LengthLimited: aiMsg.LengthLimited,
+		Truncated:     aiMsg.FinishReason == models.FinishReasonLength,
+		FinishNote:    finishNote(aiMsg.FinishReason),
+		Interruption:  aiMsg.Interruption,
+		Inspectable:   len(aiMsg.Requests) > 0,
+	}); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to execute message_stats template", slog.String(errLoggerKey, err.Error()))
+		return
+	}
+
+	if err := m.publish(ctx, messagesEventType, sb.String(), messageIDTopic(aiMsg.ID)); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to publish message stats", slog.String(errLoggerKey, err.Error()))
+	}
+}
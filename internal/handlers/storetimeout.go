@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// timeoutStore is a Store whose calls fail once they take longer than timeout, so a stalled store, like one
+// on a slow disk, doesn't hang the requests and the generations. The store must honor the cancellation of the
+// context of its calls.
+type timeoutStore struct {
+	Store
+	timeout time.Duration
+}
+
+// defaultStoreTimeout is the time a call to the store takes at most by default.
+const defaultStoreTimeout = 30 * time.Second
+
+// WithStoreTimeout sets the time a call to the store takes at most, 30 seconds by default. The maintenance,
+// the backups and the compaction of the store aren't bounded by it. NewMain returns an error if it's negative.
+func WithStoreTimeout(timeout time.Duration) MainOption {
+	return func(m *Main) {
+		m.storeTimeout = timeout
+	}
+}
+
+// parseStoreTimeout bounds the calls to the store by the timeout, keeping the store as it is for its optional
+// interfaces.
+func (m *Main) parseStoreTimeout() error {
+	if m.storeTimeout < 0 {
+		return errors.New("the store timeout must not be negative")
+	}
+	if m.storeTimeout == 0 {
+		m.storeTimeout = defaultStoreTimeout
+	}
+	m.storeBackend = m.store
+	m.store = timeoutStore{Store: m.store, timeout: m.storeTimeout}
+	return nil
+}
+
+func (s timeoutStore) Chats(ctx context.Context) ([]models.Chat, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Chats(ctx)
+}
+
+func (s timeoutStore) AddChat(ctx context.Context, chat models.Chat) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.AddChat(ctx, chat)
+}
+
+func (s timeoutStore) UpdateChat(ctx context.Context, chat models.Chat) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.UpdateChat(ctx, chat)
+}
+
+func (s timeoutStore) DeleteChat(ctx context.Context, chatID string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.DeleteChat(ctx, chatID)
+}
+
+func (s timeoutStore) CopyChat(ctx context.Context, chatID string, chat models.Chat) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.CopyChat(ctx, chatID, chat)
+}
+
+func (s timeoutStore) Messages(ctx context.Context, chatID string) ([]models.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Messages(ctx, chatID)
+}
+
+func (s timeoutStore) MessagesSince(ctx context.Context, chatID string, since time.Time) ([]models.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.MessagesSince(ctx, chatID, since)
+}
+
+func (s timeoutStore) MessagePath(ctx context.Context, chatID, messageID string) ([]models.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.MessagePath(ctx, chatID, messageID)
+}
+
+func (s timeoutStore) AddMessage(ctx context.Context, chatID string, message models.Message) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.AddMessage(ctx, chatID, message)
+}
+
+func (s timeoutStore) UpdateMessage(ctx context.Context, chatID string, message models.Message) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.UpdateMessage(ctx, chatID, message)
+}
+
+func (s timeoutStore) ChatStats(ctx context.Context, chatID string) (models.ChatStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.ChatStats(ctx, chatID)
+}
+
+func (s timeoutStore) Schedules(ctx context.Context) ([]models.Schedule, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Schedules(ctx)
+}
+
+func (s timeoutStore) SaveSchedule(ctx context.Context, schedule models.Schedule) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.SaveSchedule(ctx, schedule)
+}
+
+func (s timeoutStore) ScheduleRuns(ctx context.Context, scheduleName string) ([]models.ScheduleRun, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.ScheduleRuns(ctx, scheduleName)
+}
+
+func (s timeoutStore) AddScheduleRun(ctx context.Context, run models.ScheduleRun) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.AddScheduleRun(ctx, run)
+}
+
+func (s timeoutStore) Memories(ctx context.Context, userID string) ([]models.Memory, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Memories(ctx, userID)
+}
+
+func (s timeoutStore) SaveMemory(ctx context.Context, memory models.Memory) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.SaveMemory(ctx, memory)
+}
+
+func (s timeoutStore) DeleteMemory(ctx context.Context, userID, memoryID string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.DeleteMemory(ctx, userID, memoryID)
+}
+
+func (s timeoutStore) ReadReceipts(ctx context.Context, userID string) ([]models.ReadReceipt, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.ReadReceipts(ctx, userID)
+}
+
+func (s timeoutStore) SaveReadReceipt(ctx context.Context, receipt models.ReadReceipt) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.SaveReadReceipt(ctx, receipt)
+}
+
+func (s timeoutStore) APITokens(ctx context.Context, userID string) ([]models.APIToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.APITokens(ctx, userID)
+}
+
+func (s timeoutStore) APITokenByHash(ctx context.Context, hash string) (models.APIToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.APITokenByHash(ctx, hash)
+}
+
+func (s timeoutStore) AddAPIToken(ctx context.Context, token models.APIToken) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.AddAPIToken(ctx, token)
+}
+
+func (s timeoutStore) DeleteAPIToken(ctx context.Context, userID, tokenID string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.DeleteAPIToken(ctx, userID, tokenID)
+}
+
+func (s timeoutStore) Sessions(ctx context.Context, userID string) ([]models.Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Sessions(ctx, userID)
+}
+
+func (s timeoutStore) SessionByHash(ctx context.Context, hash string) (models.Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.SessionByHash(ctx, hash)
+}
+
+func (s timeoutStore) SaveSession(ctx context.Context, session models.Session) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.SaveSession(ctx, session)
+}
+
+func (s timeoutStore) DeleteSession(ctx context.Context, userID, sessionID string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.DeleteSession(ctx, userID, sessionID)
+}
+
+func (s timeoutStore) Usage(ctx context.Context, userID, day string) (models.Usage, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Usage(ctx, userID, day)
+}
+
+func (s timeoutStore) Usages(ctx context.Context, day string) ([]models.Usage, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Usages(ctx, day)
+}
+
+func (s timeoutStore) UserUsages(ctx context.Context, userID string) ([]models.Usage, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.UserUsages(ctx, userID)
+}
+
+func (s timeoutStore) AddUsage(ctx context.Context, usage models.Usage) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.AddUsage(ctx, usage)
+}
+
+func (s timeoutStore) Spends(ctx context.Context, provider, month string) ([]models.Spend, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.Spends(ctx, provider, month)
+}
+
+func (s timeoutStore) AddSpend(ctx context.Context, spend models.Spend) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.AddSpend(ctx, spend)
+}
+
+func (s timeoutStore) DeleteUserData(ctx context.Context, userID string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.DeleteUserData(ctx, userID)
+}
+
+func (s timeoutStore) AuditEntries(ctx context.Context) ([]models.AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.AuditEntries(ctx)
+}
+
+func (s timeoutStore) AddAuditEntry(ctx context.Context, entry models.AuditEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.AddAuditEntry(ctx, entry)
+}
+
+func (s timeoutStore) MCPServerStates(ctx context.Context) ([]models.MCPServerState, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.MCPServerStates(ctx)
+}
+
+func (s timeoutStore) SaveMCPServerState(ctx context.Context, state models.MCPServerState) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Store.SaveMCPServerState(ctx, state)
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// parseResponseSchema parses the response schema of a chat or a request, returning it compacted, or nil if
+// it's empty. The schema must be a JSON object.
+func parseResponseSchema(schema string) (json.RawMessage, error) {
+	schema = strings.TrimSpace(schema)
+	if schema == "" {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(schema)); err != nil {
+		return nil, fmt.Errorf("response schema is not valid JSON: %w", err)
+	}
+	if !strings.HasPrefix(buf.String(), "{") {
+		return nil, errors.New("response schema must be a JSON object")
+	}
+	return buf.Bytes(), nil
+}
+
+// withResponseSchema returns a copy of ctx carrying the response schema of the generation, and the schema,
+// nil if the response is free text. The schema already carried by ctx, given by the request, takes
+// precedence over the one of the chat of chatID. The LLM is also told to follow the schema in the system
+// prompt, for the providers without structured output.
+func (m *Main) withResponseSchema(ctx context.Context, chatID string) (context.Context, json.RawMessage) {
+	schema := models.ResponseSchemaFromContext(ctx)
+	if schema == nil {
+		if c, err := m.findChat(ctx, chatID); err == nil {
+			schema = c.ResponseSchema
+		}
+	}
+	if schema == nil {
+		return ctx, nil
+	}
+
+	ctx = models.WithResponseSchema(ctx, schema)
+	ctx = models.WithSystemPrompt(ctx, "Respond only with a JSON value following this JSON schema, without "+
+		"any other text:\n"+string(schema))
+	return ctx, schema
+}
+
+// markStructuredOutput marks the last text of contents as the structured output of the response, with its
+// violations of schema.
+func markStructuredOutput(contents []models.Content, schema json.RawMessage) {
+	for i := len(contents) - 1; i >= 0; i-- {
+		if contents[i].Type != models.ContentTypeText || strings.TrimSpace(contents[i].Text) == "" {
+			continue
+		}
+		contents[i].Structured = true
+		contents[i].SchemaViolations = validateStructuredOutput(schema, contents[i].Text)
+		return
+	}
+}
+
+// validateStructuredOutput returns the violations of schema by the JSON value of text, checked like the tool
+// inputs.
+func validateStructuredOutput(schema json.RawMessage, text string) []string {
+	var value any
+	if err := json.Unmarshal([]byte(models.StructuredOutputJSON(text)), &value); err != nil {
+		return []string{fmt.Sprintf("response is not valid JSON: %s", err)}
+	}
+	var s inputSchema
+	if json.Unmarshal(schema, &s) != nil {
+		return nil
+	}
+	return s.validate("response", value)
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// typing is the event published to the messages topic of a chat while a user types a message in it.
+type typing struct {
+	// ClientID identifies the page the user types in, which ignores its own events.
+	ClientID string `json:"clientId"`
+	UserID   string `json:"userId,omitempty"`
+}
+
+func chatMessagesTopic(chatID string) string {
+	return "chat-messages-" + chatID
+}
+
+// HandleTyping publishes that the user is typing a message in a chat to the other pages showing the chat.
+// It accepts POST requests with the chat_id and client_id form fields, the latter identifying the page of the
+// user, and responds with 204 No Content. The pages send it periodically while the user types.
+func (m *Main) HandleTyping(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chatID := r.FormValue("chat_id")
+	clientID := r.FormValue("client_id")
+	if chatID == "" || clientID == "" {
+		m.logger.ErrorContext(r.Context(), "Chat ID and client ID are required")
+		http.Error(w, "Chat ID and client ID are required", http.StatusBadRequest)
+		return
+	}
+	if !m.authorizeChat(w, r, chatID) {
+		return
+	}
+
+	data, err := json.Marshal(typing{ClientID: clientID, UserID: m.userID(r)})
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to marshal typing", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := m.publish(r.Context(), typingEventType, string(data), chatMessagesTopic(chatID)); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to publish typing", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publishChatMessages publishes the new user message and the placeholder of its response to the messages
+// topic of the chat, so the other pages showing the chat add them and stream the response as well. The pages
+// skip the messages they already show, like the page the message was sent from. The times are rendered in
+// the timezone of the server, as the topic isn't tied to a request.
+func (m *Main) publishChatMessages(ctx context.Context, chatID string, userMsg, aiMsg models.Message) {
+	userContent, err := models.RenderContents(userMsg.Contents)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "Failed to render contents", slog.String(errLoggerKey, err.Error()))
+		return
+	}
+
+	var sb strings.Builder
+	if err := m.templates.ExecuteTemplate(&sb, "user_message", message{
+		ID:             userMsg.ID,
+		Role:           string(userMsg.Role),
+		Content:        userContent,
+		Timestamp:      userMsg.Timestamp.Local(),
+		ParentID:       userMsg.ParentID,
+		Sender:         m.messageSender(ctx, chatID, userMsg),
+		StreamingState: "ended",
+	}); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to execute user_message template", slog.String(errLoggerKey, err.Error()))
+		return
+	}
+	if err := m.templates.ExecuteTemplate(&sb, "ai_message", message{
+		ID:             aiMsg.ID,
+		Role:           string(aiMsg.Role),
+		Timestamp:      aiMsg.Timestamp.Local(),
+		ParentID:       aiMsg.ParentID,
+		StreamingState: "loading",
+	}); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to execute ai_message template", slog.String(errLoggerKey, err.Error()))
+		return
+	}
+
+	if err := m.publish(ctx, chatMessagesEventType, sb.String(), chatMessagesTopic(chatID)); err != nil {
+		m.logger.ErrorContext(ctx, "Failed to publish chat messages", slog.String(errLoggerKey, err.Error()))
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+	"text/template"
+)
+
+// templateFuncs are the functions of the templates. The times are formatted in their location, which is the
+// timezone of the user.
+var templateFuncs = template.FuncMap{
+	"relativeTime": relativeTime,
+	"dayLabel":     dayLabel,
+}
+
+// templateSet holds the parsed templates: the layout and partials in a single template set, and every
+// page in its own copy of that set, keyed by the page's file name. Every page defines its own "content"
+// block for the layout, so they can't share a single set without overriding each other's blocks.
+type templateSet struct {
+	fsys   fs.FS
+	reload bool
+
+	mu     sync.RWMutex
+	layout *template.Template
+	pages  map[string]*template.Template
+}
+
+func newTemplateSet(fsys fs.FS, reload bool) (*templateSet, error) {
+	ts := &templateSet{
+		fsys:   fsys,
+		reload: reload,
+	}
+	if err := ts.parse(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+func (ts *templateSet) parse() error {
+	// We parse templates from three distinct directories to separate layout, pages, and partial views
+	layout, err := template.New("layout").Funcs(templateFuncs).ParseFS(
+		ts.fsys,
+		"templates/layout/*.html",
+		"templates/partials/*.html",
+	)
+	if err != nil {
+		return err
+	}
+
+	pageFiles, err := fs.Glob(ts.fsys, "templates/pages/*.html")
+	if err != nil {
+		return err
+	}
+	pages := make(map[string]*template.Template, len(pageFiles))
+	for _, pageFile := range pageFiles {
+		page, err := layout.Clone()
+		if err != nil {
+			return err
+		}
+		if page, err = page.ParseFS(ts.fsys, pageFile); err != nil {
+			return err
+		}
+		pages[path.Base(pageFile)] = page
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.layout = layout
+	ts.pages = pages
+	return nil
+}
+
+// current returns the latest templates, parsing them again first if the reload is enabled.
+func (ts *templateSet) current() (*template.Template, map[string]*template.Template, error) {
+	if ts.reload {
+		if err := ts.parse(); err != nil {
+			return nil, nil, fmt.Errorf("failed to reload templates: %w", err)
+		}
+	}
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.layout, ts.pages, nil
+}
+
+// ExecuteTemplate applies the layout or partial template with the given name to data.
+func (ts *templateSet) ExecuteTemplate(w io.Writer, name string, data any) error {
+	layout, _, err := ts.current()
+	if err != nil {
+		return err
+	}
+	return layout.ExecuteTemplate(w, name, data)
+}
+
+// ExecutePage applies the page with the given file name to data.
+func (ts *templateSet) ExecutePage(w io.Writer, name string, data any) error {
+	_, pages, err := ts.current()
+	if err != nil {
+		return err
+	}
+	page, ok := pages[name]
+	if !ok {
+		return fmt.Errorf("page %s is not found", name)
+	}
+	return page.ExecuteTemplate(w, name, data)
+}
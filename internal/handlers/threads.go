@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+const (
+	// replyExcerptLength is the maximum length in characters of the excerpt of the message a reply replies
+	// to, shown above the reply.
+	replyExcerptLength = 80
+
+	// threadedViewQuery is the value of the view query parameter of the home page showing the replies of the
+	// threads under the messages they reply to.
+	threadedViewQuery = "threaded"
+)
+
+// replyParent returns the message of the chat of chatID the message sent by r replies to, given by its
+// "parent_id" form field, or a zero message if it's not set. It writes the error response and returns false
+// if the message doesn't exist.
+func (m *Main) replyParent(w http.ResponseWriter, r *http.Request, chatID string) (models.Message, bool) {
+	parentID := r.FormValue("parent_id")
+	if parentID == "" {
+		return models.Message{}, true
+	}
+	if chatID == "" {
+		http.Error(w, "A reply requires the chat of the message it replies to", http.StatusBadRequest)
+		return models.Message{}, false
+	}
+
+	messages, err := m.store.Messages(r.Context(), chatID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get messages",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return models.Message{}, false
+	}
+	idx := slices.IndexFunc(messages, func(msg models.Message) bool { return msg.ID == parentID })
+	if idx < 0 {
+		http.Error(w, fmt.Sprintf("Message %s not found in the chat", parentID), http.StatusNotFound)
+		return models.Message{}, false
+	}
+	return messages[idx], true
+}
+
+// replyExcerpt returns the beginning of the text of msg, shown above its replies.
+func replyExcerpt(msg models.Message) string {
+	var parts []string
+	for _, ct := range msg.Contents {
+		if ct.Type == models.ContentTypeText {
+			parts = append(parts, ct.Text)
+		}
+	}
+	excerpt := strings.Join(strings.Fields(strings.Join(parts, " ")), " ")
+	if runes := []rune(excerpt); len(runes) > replyExcerptLength {
+		excerpt = string(runes[:replyExcerptLength-1]) + "…"
+	}
+	return excerpt
+}
+
+// withThreads sets the replies of views, the views of messages in their order, and reorders them for the
+// threaded view if threaded is true.
+func withThreads(views []message, messages []models.Message, threaded bool) []message {
+	byID := make(map[string]int, len(messages))
+	for i, msg := range messages {
+		byID[msg.ID] = i
+	}
+	for i, msg := range messages {
+		if msg.ParentID == "" {
+			continue
+		}
+		views[i].ParentID = msg.ParentID
+		if p, ok := byID[msg.ParentID]; ok {
+			views[i].ReplyTo = replyExcerpt(messages[p])
+		}
+	}
+	if !threaded {
+		return views
+	}
+
+	ordered := make([]message, 0, len(views))
+	for _, t := range threadOrder(messages) {
+		view := views[t.index]
+		view.Depth = t.depth
+		ordered = append(ordered, view)
+	}
+	return ordered
+}
+
+type threadPosition struct {
+	index int
+	depth int
+}
+
+// threadOrder returns the positions of messages, in their order, in the threaded view: every message of
+// the main line is followed by the threads replying to it, depth first. The first reply to a message of a
+// thread continues the thread at its depth, while the other replies, and the replies to the main line,
+// start threads one level deeper. The replies whose parent is missing are kept in the main line.
+func threadOrder(messages []models.Message) []threadPosition {
+	byID := make(map[string]int, len(messages))
+	for i, msg := range messages {
+		byID[msg.ID] = i
+	}
+	replies := make(map[int][]int)
+	var roots []int
+	for i, msg := range messages {
+		// A parent precedes its replies, which rules out cycles.
+		if p, ok := byID[msg.ParentID]; ok && p < i {
+			replies[p] = append(replies[p], i)
+			continue
+		}
+		roots = append(roots, i)
+	}
+
+	order := make([]threadPosition, 0, len(messages))
+	var visit func(i, depth int)
+	visit = func(i, depth int) {
+		order = append(order, threadPosition{index: i, depth: depth})
+		for n, reply := range replies[i] {
+			if depth == 0 || n > 0 {
+				visit(reply, depth+1)
+				continue
+			}
+			visit(reply, depth)
+		}
+	}
+	for _, i := range roots {
+		visit(i, 0)
+	}
+	return order
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// timezoneCookieName is the name of the cookie holding the timezone of the user, an IANA name like
+	// Europe/Paris, hinted by their browser.
+	timezoneCookieName = "mcpwebui_tz"
+	timezoneCookieAge  = 365 * 24 * time.Hour
+)
+
+// HandleTimezone stores the timezone hinted by the browser in the timezone form value, in a cookie read by
+// the pages rendering the times. It responds with 204 No Content, or 400 Bad Request if the timezone isn't
+// known.
+func (m *Main) HandleTimezone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("timezone")
+	if _, err := time.LoadLocation(name); err != nil || name == "" || name == "Local" {
+		http.Error(w, fmt.Sprintf("Unknown timezone %q", name), http.StatusBadRequest)
+		return
+	}
+	// The cookie is readable by the scripts, which hint the timezone again only when it changes.
+	http.SetCookie(w, &http.Cookie{
+		Name:     timezoneCookieName,
+		Value:    name,
+		Path:     "/",
+		MaxAge:   int(timezoneCookieAge.Seconds()),
+		Secure:   m.security.SecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userLocation returns the timezone of the user of r, from the cookie set by HandleTimezone, or the timezone
+// of the server if it's not set yet.
+func userLocation(r *http.Request) *time.Location {
+	c, err := r.Cookie(timezoneCookieName)
+	if err != nil {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(c.Value)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// relativeTime formats t, in the timezone of the user, relatively to now within the last hour, like "2 min
+// ago", and as the time of the day otherwise, the day being given by the day separators of the transcript.
+func relativeTime(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%d min ago", int(d.Minutes()))
+	}
+	return t.Format("15:04")
+}
+
+// dayLabel returns the day of t, in the timezone of the user, for the day separators of the transcript.
+func dayLabel(t time.Time) string {
+	now := time.Now().In(t.Location())
+	switch {
+	case sameDay(t, now):
+		return "Today"
+	case sameDay(t, now.AddDate(0, 0, -1)):
+		return "Yesterday"
+	case t.Year() == now.Year():
+		return t.Format("Monday, 2 January")
+	}
+	return t.Format("Monday, 2 January 2006")
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// TitleGeneration configures the queue of the generation of the titles of the new chats, which caps the
+// calls to the TitleGenerator when many chats are created at once, like through the chat API.
+type TitleGeneration struct {
+	// Concurrency is the number of titles generated at the same time. It defaults to 2.
+	Concurrency int
+	// QueueSize is the number of titles waiting to be generated, beyond which the new chats keep their
+	// default title. It defaults to 100.
+	QueueSize int
+	// Language is the language the titles are written in, like French, which forces it for every chat.
+	// Without it, the language of the first message of a chat is detected, its title being written in it.
+	Language string
+	// Heuristic derives the titles from the first words of the first message of the chats, without calling
+	// the TitleGenerator, so that the messages aren't sent to another model for their titles.
+	Heuristic bool
+	// HeuristicWords is the number of words of the heuristic titles. It defaults to 6.
+	HeuristicWords int
+	// RetryBackoff is the time after a failed generation of the title of a chat before opening the chat
+	// generates it again, doubled after every failure of the chat up to an hour. It defaults to a minute.
+	RetryBackoff time.Duration
+}
+
+// titleJob is the generation of the title of a chat from its first message, queued for the workers.
+type titleJob struct {
+	ctx     context.Context
+	chatID  string
+	message string
+}
+
+// queuedTitles holds the chats whose title is queued or being generated, so a chat is queued once, and the
+// backoff of the chats whose title generation failed, so opening them doesn't queue it on every page view
+// while the title generator is down.
+type queuedTitles struct {
+	mu      sync.Mutex
+	items   map[string]struct{}
+	retries map[string]titleRetry
+}
+
+// titleRetry is the backoff of the generation of the title of a chat after its failures.
+type titleRetry struct {
+	failures int
+	next     time.Time
+}
+
+// spokenLanguage is a language of the messages written in the Latin script, detected by its common words
+// and its letters.
+type spokenLanguage struct {
+	name  string
+	words []string
+	// letters are the letters of the language the others rarely have.
+	letters string
+}
+
+const (
+	defaultTitleConcurrency  = 2
+	defaultTitleQueueSize    = 100
+	defaultHeuristicWords    = 6
+	defaultTitleRetryBackoff = time.Minute
+	maxTitleRetryBackoff     = time.Hour
+	// minSpokenLanguageScore is the score of the detected language of a message, its common words and its
+	// letters, below which it's unknown, as in the messages too short to tell.
+	minSpokenLanguageScore = 2
+)
+
+// spokenLanguages are the languages of the Latin script detected in the first messages of the chats.
+var spokenLanguages = []spokenLanguage{
+	{
+		name: "English",
+		words: []string{"the", "and", "is", "are", "what", "how", "you", "with", "this", "that", "for", "can",
+			"please", "of", "to", "my", "it", "why", "does", "do"},
+	},
+	{
+		name: "French",
+		words: []string{"le", "la", "les", "des", "est", "et", "un", "une", "que", "pour", "avec", "je", "vous",
+			"comment", "pas", "dans", "sur", "ce", "qui", "du", "mon", "quel", "quelle", "peux", "tu"},
+		letters: "çàèêëîïôœù",
+	},
+	{
+		name: "Spanish",
+		words: []string{"el", "los", "las", "es", "y", "que", "para", "con", "por", "como", "una", "del", "qué",
+			"cómo", "puedes", "estoy", "pero", "mi", "se", "hola", "está", "cuál"},
+		letters: "ñ¿¡",
+	},
+	{
+		name: "German",
+		words: []string{"der", "die", "das", "und", "ist", "ich", "nicht", "mit", "wie", "ein", "eine", "für",
+			"auf", "sie", "es", "zu", "den", "was", "kann", "bitte", "mein", "kannst", "du"},
+		letters: "ßäöü",
+	},
+	{
+		name: "Italian",
+		words: []string{"il", "lo", "gli", "è", "e", "che", "per", "con", "come", "una", "sono", "non", "di",
+			"della", "questo", "mi", "puoi", "ciao", "cosa", "perché"},
+		letters: "ìò",
+	},
+	{
+		name: "Portuguese",
+		words: []string{"o", "os", "as", "é", "e", "que", "para", "com", "como", "uma", "não", "você", "do",
+			"da", "em", "um", "isso", "por", "olá", "meu"},
+		letters: "ãõ",
+	},
+	{
+		name: "Dutch",
+		words: []string{"de", "het", "een", "en", "is", "van", "ik", "niet", "met", "wat", "hoe", "je", "dat",
+			"voor", "op", "zijn", "kun", "mijn"},
+	},
+	{
+		name: "Indonesian",
+		words: []string{"yang", "dan", "di", "ini", "itu", "dengan", "untuk", "tidak", "apa", "bagaimana", "saya",
+			"anda", "ke", "dari", "bisa", "tolong"},
+	},
+	{
+		name:    "Turkish",
+		words:   []string{"bir", "ve", "bu", "ne", "nasıl", "için", "ile", "mi", "ben", "değil", "da", "çok", "bana"},
+		letters: "ğşı",
+	},
+	{
+		name: "Polish",
+		words: []string{"i", "w", "nie", "jest", "się", "na", "to", "jak", "że", "co", "z", "do", "czy", "mam",
+			"proszę", "mój"},
+		letters: "łżśćąęń",
+	},
+}
+
+// WithTitleGeneration configures the queue of the generation of the titles. Without it, the queue uses its
+// defaults. NewMain returns an error if a number is negative.
+func WithTitleGeneration(t TitleGeneration) MainOption {
+	return func(m *Main) {
+		m.titleGeneration = t
+	}
+}
+
+func (m *Main) parseTitleGeneration() error {
+	if m.titleGeneration.Concurrency < 0 || m.titleGeneration.QueueSize < 0 || m.titleGeneration.HeuristicWords < 0 ||
+		m.titleGeneration.RetryBackoff < 0 {
+		return errors.New("the concurrency, the queue size, the heuristic words and the retry backoff of the " +
+			"title generation must not be negative")
+	}
+	if m.titleGeneration.Concurrency == 0 {
+		m.titleGeneration.Concurrency = defaultTitleConcurrency
+	}
+	if m.titleGeneration.QueueSize == 0 {
+		m.titleGeneration.QueueSize = defaultTitleQueueSize
+	}
+	if m.titleGeneration.HeuristicWords == 0 {
+		m.titleGeneration.HeuristicWords = defaultHeuristicWords
+	}
+	if m.titleGeneration.RetryBackoff == 0 {
+		m.titleGeneration.RetryBackoff = defaultTitleRetryBackoff
+	}
+	m.titleQueue = make(chan titleJob, m.titleGeneration.QueueSize)
+	m.queuedTitles = &queuedTitles{items: make(map[string]struct{}), retries: make(map[string]titleRetry)}
+	return nil
+}
+
+// titleLanguage returns the language the title of a chat with the first message is written in, the configured
+// one, or the detected language of the message.
+func (m *Main) titleLanguage(message string) string {
+	if m.titleGeneration.Language != "" {
+		return m.titleGeneration.Language
+	}
+	return detectSpokenLanguage(message)
+}
+
+// heuristicTitle returns the first words of the text of message, without its code blocks and its markdown
+// markers, as a title of at most words words, or an empty string if the message has no text.
+func heuristicTitle(message string, words int) string {
+	fields := strings.Fields(fencedCodePattern.ReplaceAllString(message, ""))
+	title := make([]string, 0, words)
+	truncated := false
+	for _, field := range fields {
+		if field = strings.Trim(field, "#*_`>"); field == "" {
+			continue
+		}
+		if len(title) == words {
+			truncated = true
+			break
+		}
+		title = append(title, field)
+	}
+	text := strings.TrimRight(strings.Join(title, " "), ",;:.")
+	if truncated && text != "" {
+		text += "…"
+	}
+	return text
+}
+
+// detectSpokenLanguage returns the English name of the language of the text of message, without its code
+// blocks, or an empty string if it's unknown. The languages of the other scripts than the Latin one are
+// detected by their script, the ones of the Latin script by their common words and letters.
+func detectSpokenLanguage(message string) string {
+	text := strings.ToLower(fencedCodePattern.ReplaceAllString(message, ""))
+	if language := scriptLanguage(text); language != "" {
+		return language
+	}
+
+	words := strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) })
+	best, bestScore, tie := "", 0, false
+	for _, lang := range spokenLanguages {
+		score := 0
+		for _, word := range words {
+			if slices.Contains(lang.words, word) {
+				score++
+			}
+		}
+		if lang.letters != "" && strings.ContainsAny(text, lang.letters) {
+			score += minSpokenLanguageScore
+		}
+		switch {
+		case score > bestScore:
+			best, bestScore, tie = lang.name, score, false
+		case score == bestScore:
+			tie = true
+		}
+	}
+	if bestScore < minSpokenLanguageScore || tie {
+		return ""
+	}
+	return best
+}
+
+// scriptLanguage returns the language of the dominant script of the letters of text, or an empty string if
+// it's the Latin script, shared by many languages, or there are no letters.
+func scriptLanguage(text string) string {
+	counts := make(map[string]int)
+	kana := false
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana = true
+			counts["Japanese"]++
+		case unicode.Is(unicode.Han, r):
+			counts["Chinese"]++
+		case unicode.Is(unicode.Hangul, r):
+			counts["Korean"]++
+		case unicode.Is(unicode.Cyrillic, r):
+			counts["Russian"]++
+		case unicode.Is(unicode.Arabic, r):
+			counts["Arabic"]++
+		case unicode.Is(unicode.Hebrew, r):
+			counts["Hebrew"]++
+		case unicode.Is(unicode.Greek, r):
+			counts["Greek"]++
+		case unicode.Is(unicode.Thai, r):
+			counts["Thai"]++
+		case unicode.Is(unicode.Devanagari, r):
+			counts["Hindi"]++
+		case unicode.Is(unicode.Latin, r):
+			counts[""]++
+		}
+	}
+	// The Japanese texts mix the kanji with the kana.
+	if kana {
+		counts["Japanese"] += counts["Chinese"]
+		delete(counts, "Chinese")
+	}
+	if counts["Russian"] > 0 && strings.ContainsAny(text, "іїєґ") {
+		counts["Ukrainian"], counts["Russian"] = counts["Russian"], 0
+	}
+	dominant := ""
+	for language, n := range counts {
+		if n > counts[dominant] || (n == counts[dominant] && language < dominant) {
+			dominant = language
+		}
+	}
+	return dominant
+}
+
+// queueChatTitle queues the generation of the title of the chat from message, unless the chat was created
+// with a title, its title was generated, or it's already queued. The title isn't generated if the queue is
+// full, rather than blocking the request, and the chat keeps its default title. The job keeps the values of
+// ctx, but not its cancellation.
+func (m *Main) queueChatTitle(ctx context.Context, chatID, message string) {
+	if c, err := m.findChat(ctx, chatID); err == nil && c.Title != "" && !c.TitleFallback {
+		return
+	}
+	if !m.queuedTitles.add(chatID) {
+		return
+	}
+	select {
+	case m.titleQueue <- titleJob{ctx: context.WithoutCancel(ctx), chatID: chatID, message: message}:
+	default:
+		m.queuedTitles.remove(chatID)
+		m.logger.WarnContext(ctx, "Title generation queue is full, skipping the title of the chat",
+			slog.String("chatID", chatID))
+	}
+}
+
+// retryChatTitle queues the generation of the title of c, opened by its owner with its messages, if its
+// generation failed, like when the title generator was down, the chat keeping its fallback or default title.
+// After a failure, the generation waits for the backoff of the chat.
+func (m *Main) retryChatTitle(ctx context.Context, c models.Chat, messages []models.Message) {
+	if c.Title != "" && !c.TitleFallback {
+		return
+	}
+	if !m.queuedTitles.retryDue(c.ID, time.Now()) {
+		return
+	}
+	idx := slices.IndexFunc(messages, func(msg models.Message) bool { return msg.Role == models.RoleUser })
+	if idx < 0 {
+		return
+	}
+	var text strings.Builder
+	for _, ct := range messages[idx].Contents {
+		if ct.Type == models.ContentTypeText {
+			text.WriteString(ct.Text)
+		}
+	}
+	if text.Len() > 0 {
+		m.queueChatTitle(ctx, c.ID, text.String())
+	}
+}
+
+// runTitleWorker generates the queued titles one at a time, until the background work is stopped.
+func (m *Main) runTitleWorker() {
+	for {
+		select {
+		case <-m.backgroundDone:
+			return
+		case job := <-m.titleQueue:
+			m.generateChatTitle(job.ctx, job.chatID, job.message)
+			m.queuedTitles.remove(job.chatID)
+		}
+	}
+}
+
+// add records chatID as queued, and reports whether it wasn't already.
+func (q *queuedTitles) add(chatID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.items[chatID]; ok {
+		return false
+	}
+	q.items[chatID] = struct{}{}
+	return true
+}
+
+func (q *queuedTitles) remove(chatID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.items, chatID)
+}
+
+// retryDue reports whether the backoff of the title generation of chatID elapsed at now, or it didn't fail.
+func (q *queuedTitles) retryDue(chatID string, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	retry, ok := q.retries[chatID]
+	return !ok || !now.Before(retry.next)
+}
+
+// fail records a failed title generation of chatID at now, and returns the backoff before its next retry,
+// backoff doubled after every failure up to maxTitleRetryBackoff. The chats whose backoff elapsed long ago,
+// like the deleted ones, are forgotten, so the retries are only kept for the recent failures.
+func (q *queuedTitles) fail(chatID string, now time.Time, backoff time.Duration) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for id, retry := range q.retries {
+		if now.Sub(retry.next) > maxTitleRetryBackoff {
+			delete(q.retries, id)
+		}
+	}
+	retry := q.retries[chatID]
+	retry.failures++
+	// The shift is capped, as the backoff is capped anyway, so that it doesn't overflow.
+	backoff = min(min(backoff, maxTitleRetryBackoff)<<min(retry.failures-1, 20), maxTitleRetryBackoff)
+	retry.next = now.Add(backoff)
+	q.retries[chatID] = retry
+	return backoff
+}
+
+// succeed forgets the failures of the title generation of chatID.
+func (q *queuedTitles) succeed(chatID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.retries, chatID)
+}
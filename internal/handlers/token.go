@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+type tokensPageData struct {
+	Tokens []models.APIToken
+	// NewToken is the token just created, shown once as only its hash is stored.
+	NewToken string
+}
+
+type apiTokenUserKey struct{}
+
+const (
+	apiTokenPrefix = "mwu_"
+	// apiTokenShownPrefix is the length of the beginning of a token stored in plain, to help the user
+	// recognize it.
+	apiTokenShownPrefix = len(apiTokenPrefix) + 6
+)
+
+// WithRequiredAPITokens makes the API routes under /api/ reject the requests without a valid API token.
+// Without it, the requests without the Authorization header are identified as the other requests.
+func WithRequiredAPITokens() MainOption {
+	return func(m *Main) {
+		m.requireAPITokens = true
+	}
+}
+
+func newAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIAuth authenticates the requests to the API routes under /api/ with the API token in their
+// "Authorization: Bearer" header, and identifies them as the token's user. The requests with an invalid
+// token are rejected with 401 Unauthorized, as the requests without a token if WithRequiredAPITokens is
+// set. The other routes are passed through, as the tokens are only meant for the API.
+func (m *Main) APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if auth == "" {
+			if m.requireAPITokens {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				m.writeAPIError(w, http.StatusUnauthorized, "API token is required")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !m.checkLockout(w, r) {
+			return
+		}
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok || !strings.HasPrefix(token, apiTokenPrefix) {
+			m.authFailed(r, "Invalid Authorization header")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			m.writeAPIError(w, http.StatusUnauthorized, "Invalid Authorization header, expected a Bearer API token")
+			return
+		}
+		t, err := m.store.APITokenByHash(r.Context(), hashAPIToken(token))
+		if err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to get API token", slog.String(errLoggerKey, err.Error()))
+			m.writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if t.ID == "" {
+			m.authFailed(r, "Invalid API token "+token[:min(len(token), apiTokenShownPrefix)]+"…")
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			m.writeAPIError(w, http.StatusUnauthorized, "Invalid API token")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenUserKey{}, t.UserID)))
+	})
+}
+
+// HandleTokens renders the API tokens page of the current user on GET, and creates a token named by the
+// "name" form field on POST, rendering the page with the new token shown once.
+func (m *Main) HandleTokens(w http.ResponseWriter, r *http.Request) {
+	userID := m.userID(r)
+	var data tokensPageData
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
+		token, err := newAPIToken()
+		if err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to generate API token", slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = m.store.AddAPIToken(r.Context(), models.APIToken{
+			ID:        uuid.New().String(),
+			UserID:    userID,
+			Name:      name,
+			Hash:      hashAPIToken(token),
+			Prefix:    token[:apiTokenShownPrefix],
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			m.logger.ErrorContext(r.Context(), "Failed to add API token", slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.NewToken = token
+	default:
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokens, err := m.store.APITokens(r.Context(), userID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get API tokens", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Tokens = tokens
+
+	// The page may contain a new token, which must not be kept by any cache.
+	w.Header().Set("Cache-Control", "no-store")
+	if err := m.renderPage(w, "tokens.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute tokens template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleTokenRevoke revokes the current user's API token given by the "id" form field, and redirects back
+// to the API tokens page.
+func (m *Main) HandleTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := m.store.DeleteAPIToken(r.Context(), m.userID(r), r.FormValue("id")); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to delete API token", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/tokens", http.StatusSeeOther)
+}
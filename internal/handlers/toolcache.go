@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ToolCache configures the cache of the results of the idempotent tools, like a weather lookup, so the
+// identical calls repeated in the chats are answered without calling the MCP servers again.
+type ToolCache struct {
+	// Tools are the names of the tools whose results are cached. The other tools are always called.
+	Tools []string
+	// TTL is how long a result is cached. It defaults to 5 minutes.
+	TTL time.Duration
+}
+
+// toolResults holds the cached results of the tool calls, keyed by the tool name and the hash of the input.
+type toolResults struct {
+	mu    sync.Mutex
+	items map[string]cachedToolResult
+}
+
+type cachedToolResult struct {
+	result    json.RawMessage
+	expiresAt time.Time
+}
+
+const defaultToolCacheTTL = 5 * time.Minute
+
+// WithToolCache caches the successful results of the given tools.
+func WithToolCache(cache ToolCache) MainOption {
+	return func(m *Main) {
+		m.toolCache = cache
+	}
+}
+
+func (m *Main) parseToolCache() {
+	if m.toolCache.TTL == 0 {
+		m.toolCache.TTL = defaultToolCacheTTL
+	}
+	m.toolResults = &toolResults{items: make(map[string]cachedToolResult)}
+}
+
+// toolCacheKey returns the key of the cached result of a call of tool with input, or false if the tool's
+// results aren't cached. The input is normalized first, so the inputs differing only in their formatting or
+// the order of their properties share their result.
+func (m *Main) toolCacheKey(tool string, input json.RawMessage) (string, bool) {
+	if !slices.Contains(m.toolCache.Tools, tool) {
+		return "", false
+	}
+
+	var value any
+	if len(input) > 0 && json.Unmarshal(input, &value) == nil {
+		if normalized, err := json.Marshal(value); err == nil {
+			input = normalized
+		}
+	}
+	hash := sha256.Sum256(input)
+	return tool + "\x00" + hex.EncodeToString(hash[:]), true
+}
+
+func (r *toolResults) get(key string, now time.Time) (json.RawMessage, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	item, ok := r.items[key]
+	if !ok || now.After(item.expiresAt) {
+		return nil, false
+	}
+	return item.result, true
+}
+
+// put caches result under key until now plus ttl, and removes the expired results.
+func (r *toolResults) put(key string, result json.RawMessage, now time.Time, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k, item := range r.items {
+		if now.After(item.expiresAt) {
+			delete(r.items, k)
+		}
+	}
+	r.items[key] = cachedToolResult{result: result, expiresAt: now.Add(ttl)}
+}
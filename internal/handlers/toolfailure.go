@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// defaultToolFailureLimit is the number of consecutive failures of a tool in a generation after which the
+// LLM is told to stop calling it.
+const defaultToolFailureLimit = 3
+
+// WithToolFailureLimit overrides the number of consecutive failures of a tool in a generation after which
+// the LLM is told to stop calling it, which keeps the LLMs from retrying a broken tool endlessly. A negative
+// limit disables it.
+func WithToolFailureLimit(limit int) MainOption {
+	return func(m *Main) {
+		m.toolFailureLimit = limit
+	}
+}
+
+func (m *Main) parseToolFailureLimit() {
+	if m.toolFailureLimit == 0 {
+		m.toolFailureLimit = defaultToolFailureLimit
+	}
+}
+
+// trackToolFailure counts the consecutive failures of the tool called for result in failures, which holds
+// the counts of the current generation, and adds a note to result telling the LLM to stop calling the tool
+// once its failures reach the limit. A successful call resets the count.
+func (m *Main) trackToolFailure(ctx context.Context, toolName string, result *models.Content, failures map[string]int) {
+	if !result.CallToolFailed {
+		delete(failures, toolName)
+		return
+	}
+	failures[toolName]++
+	if m.toolFailureLimit < 0 || failures[toolName] < m.toolFailureLimit {
+		return
+	}
+
+	m.logger.WarnContext(ctx, "Tool failed repeatedly",
+		slog.String("toolName", toolName),
+		slog.Int("failures", failures[toolName]))
+	result.ToolNote = fmt.Sprintf("The tool %s failed %d times in a row. Stop calling it, and answer without it, "+
+		"telling the user that the tool isn't working.", toolName, failures[toolName])
+}
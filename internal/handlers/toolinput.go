@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// inputSchema is the subset of JSON Schema the tool inputs are validated against before calling the tools:
+// the types, the properties of the objects, the items of the arrays, the enums, and the bounds of the
+// numbers, strings and arrays. The other keywords, like $ref or anyOf, aren't checked, and are left to the
+// MCP servers.
+type inputSchema struct {
+	Type                 any                     `json:"type"`
+	Properties           map[string]*inputSchema `json:"properties"`
+	Required             []string                `json:"required"`
+	AdditionalProperties json.RawMessage         `json:"additionalProperties"`
+	Items                json.RawMessage         `json:"items"`
+	Enum                 []any                   `json:"enum"`
+	Minimum              *float64                `json:"minimum"`
+	Maximum              *float64                `json:"maximum"`
+	MinLength            *int                    `json:"minLength"`
+	MaxLength            *int                    `json:"maxLength"`
+	MinItems             *int                    `json:"minItems"`
+	MaxItems             *int                    `json:"maxItems"`
+	Pattern              string                  `json:"pattern"`
+}
+
+// toolInputError is the error of a tool input not matching the tool's input schema. Its message lists every
+// violation, for the LLM to correct the input and call the tool again.
+type toolInputError struct {
+	tool       string
+	violations []string
+}
+
+func (e toolInputError) Error() string {
+	return fmt.Sprintf("the input of tool %s doesn't match its input schema, fix it and call the tool again:\n- %s",
+		e.tool, strings.Join(e.violations, "\n- "))
+}
+
+// validateToolInput checks the input of a tool call against the tool's input schema, and returns a
+// toolInputError listing the violations if it doesn't match. The schemas that can't be parsed accept any
+// input.
+func validateToolInput(tool string, schema, input json.RawMessage) error {
+	var s inputSchema
+	if json.Unmarshal(schema, &s) != nil {
+		return nil
+	}
+
+	var value any
+	if len(input) == 0 {
+		value = map[string]any{}
+	} else if err := json.Unmarshal(input, &value); err != nil {
+		return toolInputError{tool: tool, violations: []string{fmt.Sprintf("input is not valid JSON: %s", err)}}
+	}
+
+	if violations := s.validate("input", value); len(violations) > 0 {
+		return toolInputError{tool: tool, violations: violations}
+	}
+	return nil
+}
+
+// validate returns the violations of the schema by the value at path.
+func (s *inputSchema) validate(path string, value any) []string {
+	if types := s.types(); len(types) > 0 && !slices.ContainsFunc(types, func(t string) bool {
+		return jsonTypeMatches(t, value)
+	}) {
+		return []string{fmt.Sprintf("%s: expected %s, got %s", path, strings.Join(types, " or "), jsonTypeOf(value))}
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return reflect.DeepEqual(e, value) }) {
+		return []string{fmt.Sprintf("%s: must be one of %s", path, jsonString(s.Enum))}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		return s.validateObject(path, v)
+	case []any:
+		return s.validateArray(path, v)
+	case string:
+		return s.validateString(path, v)
+	case float64:
+		return s.validateNumber(path, v)
+	}
+	return nil
+}
+
+func (s *inputSchema) validateObject(path string, value map[string]any) []string {
+	var violations []string
+	for _, name := range s.Required {
+		if _, ok := value[name]; !ok {
+			violations = append(violations, fmt.Sprintf("%s.%s: required property is missing", path, name))
+		}
+	}
+
+	var additional *inputSchema
+	additionalAllowed := true
+	// The additional properties are either allowed or not, or must match a schema.
+	if len(s.AdditionalProperties) > 0 && json.Unmarshal(s.AdditionalProperties, &additionalAllowed) != nil {
+		additionalAllowed = true
+		if json.Unmarshal(s.AdditionalProperties, &additional) != nil {
+			additional = nil
+		}
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(value)) {
+		propPath := path + "." + k
+		if prop, ok := s.Properties[k]; ok && prop != nil {
+			violations = append(violations, prop.validate(propPath, value[k])...)
+			continue
+		}
+		if !additionalAllowed {
+			violations = append(violations, fmt.Sprintf("%s: unknown property", propPath))
+			continue
+		}
+		if additional != nil {
+			violations = append(violations, additional.validate(propPath, value[k])...)
+		}
+	}
+	return violations
+}
+
+func (s *inputSchema) validateArray(path string, value []any) []string {
+	var violations []string
+	if s.MinItems != nil && len(value) < *s.MinItems {
+		violations = append(violations, fmt.Sprintf("%s: must have at least %d items", path, *s.MinItems))
+	}
+	if s.MaxItems != nil && len(value) > *s.MaxItems {
+		violations = append(violations, fmt.Sprintf("%s: must have at most %d items", path, *s.MaxItems))
+	}
+
+	// The items may also be an array of schemas, for tuples, which isn't checked.
+	var items *inputSchema
+	if len(s.Items) == 0 || json.Unmarshal(s.Items, &items) != nil || items == nil {
+		return violations
+	}
+	for i, item := range value {
+		violations = append(violations, items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+	}
+	return violations
+}
+
+func (s *inputSchema) validateString(path, value string) []string {
+	var violations []string
+	length := len([]rune(value))
+	if s.MinLength != nil && length < *s.MinLength {
+		violations = append(violations, fmt.Sprintf("%s: must be at least %d characters long", path, *s.MinLength))
+	}
+	if s.MaxLength != nil && length > *s.MaxLength {
+		violations = append(violations, fmt.Sprintf("%s: must be at most %d characters long", path, *s.MaxLength))
+	}
+	// The patterns Go's regexp doesn't support, like the lookarounds, aren't checked.
+	if s.Pattern != "" {
+		if re, err := regexp.Compile(s.Pattern); err == nil && !re.MatchString(value) {
+			violations = append(violations, fmt.Sprintf("%s: must match the pattern %s", path, s.Pattern))
+		}
+	}
+	return violations
+}
+
+func (s *inputSchema) validateNumber(path string, value float64) []string {
+	var violations []string
+	if s.Minimum != nil && value < *s.Minimum {
+		violations = append(violations, fmt.Sprintf("%s: must be at least %v", path, *s.Minimum))
+	}
+	if s.Maximum != nil && value > *s.Maximum {
+		violations = append(violations, fmt.Sprintf("%s: must be at most %v", path, *s.Maximum))
+	}
+	return violations
+}
+
+// types returns the types allowed by the schema, or nil if it allows any type.
+func (s *inputSchema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		types := make([]string, 0, len(t))
+		for _, v := range t {
+			if str, ok := v.(string); ok {
+				types = append(types, str)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func jsonTypeMatches(schemaType string, value any) bool {
+	switch schemaType {
+	case "integer":
+		v, ok := value.(float64)
+		return ok && v == math.Trunc(v)
+	case "number", "string", "boolean", "object", "array", "null":
+		return jsonTypeOf(value) == schemaType
+	}
+	// The unknown types aren't checked.
+	return true
+}
+
+func jsonTypeOf(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func jsonString(value any) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
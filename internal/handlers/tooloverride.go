@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+
+	"github.com/MegaGrindStone/go-mcp"
+)
+
+// ToolOverride replaces the name or the description of a tool of the MCP servers as it's presented to the
+// LLM, in the chats and the API, as many servers ship terse descriptions hurting the tool selection. The
+// calls of a renamed tool are dispatched to its server with its real name.
+type ToolOverride struct {
+	// Name is the name the tool is presented with, instead of its real name if it's not empty. It must not be
+	// the name of another tool. The other settings naming tools, like ToolCache, use this name.
+	Name string
+	// Description replaces the description of the tool if it's not empty.
+	Description string
+}
+
+// toolNamePattern matches the tool names accepted by all the LLM providers.
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// WithToolOverrides overrides the names and the descriptions of the tools of the MCP servers, keyed by their
+// real names.
+func WithToolOverrides(overrides map[string]ToolOverride) MainOption {
+	return func(m *Main) {
+		m.toolOverrides = overrides
+	}
+}
+
+func (m *Main) parseToolOverrides() error {
+	aliases := make(map[string]string)
+	for _, tool := range slices.Sorted(maps.Keys(m.toolOverrides)) {
+		alias := m.toolOverrides[tool].Name
+		if alias == "" {
+			continue
+		}
+		if !toolNamePattern.MatchString(alias) {
+			return fmt.Errorf("invalid name %q of tool %s: only letters, digits, _ and - are allowed, "+
+				"up to 64 characters", alias, tool)
+		}
+		if other, ok := aliases[alias]; ok {
+			return fmt.Errorf("tools %s and %s are both renamed %s", other, tool, alias)
+		}
+		aliases[alias] = tool
+	}
+	return nil
+}
+
+// overrideTool returns tool as it's presented to the LLM with overrides, and whether it's renamed.
+func overrideTool(tool mcp.Tool, overrides map[string]ToolOverride) (mcp.Tool, bool) {
+	override, ok := overrides[tool.Name]
+	if !ok {
+		return tool, false
+	}
+	if override.Description != "" {
+		tool.Description = override.Description
+	}
+	if override.Name == "" || override.Name == tool.Name {
+		return tool, false
+	}
+	tool.Name = override.Name
+	return tool, true
+}
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"iter"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+)
+
+// TrafficInspector records the JSON-RPC messages exchanged with the MCP servers, to debug the protocol issues
+// with the third-party servers. The messages of every server are kept in a ring buffer, the oldest ones
+// being dropped once it's full. The transports of the servers are wrapped with Transport before creating
+// their clients.
+type TrafficInspector struct {
+	capacity int
+
+	mu      sync.Mutex
+	servers []string
+	rings   map[string]*trafficRing
+}
+
+// trafficRing is the ring buffer of the messages of a server. The methods of the requests are remembered
+// until their responses, for the responses to be filtered by method too.
+type trafficRing struct {
+	entries []trafficEntry
+	next    int
+	full    bool
+	// pending are the methods of the requests waiting for a response, keyed by the direction of the
+	// request and its ID.
+	pending map[string]string
+}
+
+// trafficEntry is a message recorded by TrafficInspector. Direction is "sent" for the messages sent to the
+// server, and "received" for the ones received from it.
+type trafficEntry struct {
+	Time      time.Time
+	Server    string
+	Direction string
+	Method    string
+	ID        string
+	IsError   bool
+	Payload   string
+}
+
+type trafficTransport struct {
+	inspector *TrafficInspector
+	server    string
+	transport mcp.ClientTransport
+}
+
+type trafficSession struct {
+	mcp.Session
+	inspector *TrafficInspector
+	server    string
+}
+
+type trafficPageData struct {
+	Servers []string
+	Methods []string
+	Server  string
+	Method  string
+	Entries []trafficEntry
+}
+
+const (
+	defaultTrafficCapacity = 500
+
+	trafficSent     = "sent"
+	trafficReceived = "received"
+)
+
+// NewTrafficInspector creates a TrafficInspector keeping the last capacity messages of every server, or 500
+// if capacity isn't positive.
+func NewTrafficInspector(capacity int) *TrafficInspector {
+	if capacity <= 0 {
+		capacity = defaultTrafficCapacity
+	}
+	return &TrafficInspector{
+		capacity: capacity,
+		rings:    make(map[string]*trafficRing),
+	}
+}
+
+// WithTrafficInspector shows the messages recorded by inspector at /admin/traffic.
+func WithTrafficInspector(inspector *TrafficInspector) MainOption {
+	return func(m *Main) {
+		m.traffic = inspector
+	}
+}
+
+// Transport wraps the transport of the MCP server named server, to record the messages of its sessions.
+func (t *TrafficInspector) Transport(server string, transport mcp.ClientTransport) mcp.ClientTransport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.rings[server]; !ok {
+		t.servers = append(t.servers, server)
+		t.rings[server] = &trafficRing{
+			entries: make([]trafficEntry, t.capacity),
+			pending: make(map[string]string),
+		}
+	}
+	return trafficTransport{inspector: t, server: server, transport: transport}
+}
+
+func (t trafficTransport) StartSession(ctx context.Context) (mcp.Session, error) {
+	session, err := t.transport.StartSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return trafficSession{Session: session, inspector: t.inspector, server: t.server}, nil
+}
+
+func (s trafficSession) Send(ctx context.Context, msg mcp.JSONRPCMessage) error {
+	s.inspector.record(s.server, trafficSent, msg)
+	return s.Session.Send(ctx, msg)
+}
+
+func (s trafficSession) Messages() iter.Seq[mcp.JSONRPCMessage] {
+	return func(yield func(mcp.JSONRPCMessage) bool) {
+		for msg := range s.Session.Messages() {
+			s.inspector.record(s.server, trafficReceived, msg)
+			if !yield(msg) {
+				return
+			}
+		}
+	}
+}
+
+func (t *TrafficInspector) record(server, direction string, msg mcp.JSONRPCMessage) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		payload = []byte(err.Error())
+	}
+	entry := trafficEntry{
+		Time:      time.Now(),
+		Server:    server,
+		Direction: direction,
+		Method:    msg.Method,
+		ID:        string(msg.ID),
+		IsError:   msg.Error != nil,
+		Payload:   indentJSON(payload),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ring := t.rings[server]
+	if entry.ID != "" {
+		if entry.Method != "" {
+			ring.pending[direction+entry.ID] = entry.Method
+		} else {
+			// The response goes in the other direction than its request.
+			requestDirection := trafficSent
+			if direction == trafficSent {
+				requestDirection = trafficReceived
+			}
+			entry.Method = ring.pending[requestDirection+entry.ID]
+			delete(ring.pending, requestDirection+entry.ID)
+		}
+	}
+
+	ring.entries[ring.next] = entry
+	ring.next = (ring.next + 1) % len(ring.entries)
+	if ring.next == 0 {
+		ring.full = true
+	}
+}
+
+// entries returns the recorded messages of server, or of every server if it's empty, with method, or any
+// method if it's empty, the newest first. It also returns the methods of all the recorded messages.
+func (t *TrafficInspector) entries(server, method string) ([]trafficEntry, []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var entries []trafficEntry
+	var methods []string
+	for name, ring := range t.rings {
+		count := ring.next
+		if ring.full {
+			count = len(ring.entries)
+		}
+		for i := range count {
+			entry := ring.entries[(ring.next-1-i+len(ring.entries))%len(ring.entries)]
+			if entry.Method != "" && !slices.Contains(methods, entry.Method) {
+				methods = append(methods, entry.Method)
+			}
+			if (server == "" || server == name) && (method == "" || method == entry.Method) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	slices.SortStableFunc(entries, func(a, b trafficEntry) int { return b.Time.Compare(a.Time) })
+	slices.Sort(methods)
+	return entries, methods
+}
+
+// WriteJSON writes the recorded messages of every server to w as a JSON array, the oldest first.
+func (t *TrafficInspector) WriteJSON(w io.Writer) error {
+	entries, _ := t.entries("", "")
+	if entries == nil {
+		entries = []trafficEntry{}
+	}
+	slices.Reverse(entries)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+// HandleTraffic renders the traffic page with the messages recorded by the traffic inspector, filtered by
+// the server and method query parameters.
+func (m *Main) HandleTraffic(w http.ResponseWriter, r *http.Request) {
+	if m.traffic == nil {
+		http.Error(w, "Traffic inspector is disabled", http.StatusNotFound)
+		return
+	}
+
+	data := trafficPageData{
+		Server: r.URL.Query().Get("server"),
+		Method: r.URL.Query().Get("method"),
+	}
+	data.Entries, data.Methods = m.traffic.entries(data.Server, data.Method)
+	m.traffic.mu.Lock()
+	data.Servers = slices.Clone(m.traffic.servers)
+	m.traffic.mu.Unlock()
+
+	if err := m.renderPage(w, "traffic.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute traffic template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import "net/http"
+
+// defaultUserID is the user ID of requests without any user identity, which is the case for the
+// single-user installations.
+const defaultUserID = "default"
+
+// generationUserKey is the context key of the user a generation is made on behalf of.
+type generationUserKey struct{}
+
+// WithUserHeader makes Main identify the user of a request by the given header. The header is expected to
+// be set by a trusted authenticating reverse proxy in front of the application (e.g. X-Forwarded-User of
+// oauth2-proxy), requests without the header are treated as the default user.
+func WithUserHeader(header string) MainOption {
+	return func(m *Main) {
+		m.userHeader = header
+	}
+}
+
+// userID returns the user of the request, which is the user of its API token if it's authenticated by
+// APIAuth, or the user given by the header of WithUserHeader otherwise.
+func (m *Main) userID(r *http.Request) string {
+	if userID, ok := r.Context().Value(apiTokenUserKey{}).(string); ok {
+		return userID
+	}
+	if m.userHeader == "" {
+		return defaultUserID
+	}
+	if userID := r.Header.Get(m.userHeader); userID != "" {
+		return userID
+	}
+	return defaultUserID
+}
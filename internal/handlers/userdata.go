@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+type userDataPageData struct {
+	UserID    string
+	Chats     int
+	Memories  int
+	APITokens int
+}
+
+type userEraseResult struct {
+	chats   int
+	batches int
+}
+
+// userDataEraseConfirmation is the value of the "confirm" form field required to erase the data of a user,
+// typed by the user to avoid erasing it by mistake.
+const userDataEraseConfirmation = "erase"
+
+// HandleUserData renders the page of the current user's data, from which it's exported or erased.
+func (m *Main) HandleUserData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := m.userID(r)
+
+	chats, err := m.userChats(r.Context(), userID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get chats", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	memories, err := m.store.Memories(r.Context(), userID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get memories", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tokens, err := m.store.APITokens(r.Context(), userID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get API tokens", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := userDataPageData{
+		UserID:    userID,
+		Chats:     len(chats),
+		Memories:  len(memories),
+		APITokens: len(tokens),
+	}
+	if err := m.renderPage(w, "data.html", data); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to execute data template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleUserDataExport responds with all the data of the current user as a zip archive: the chats the user
+// created with their messages, the memories, API tokens without their hashes, read receipts, usage and
+// batches. The export is recorded in the audit entries.
+func (m *Main) HandleUserDataExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := m.userID(r)
+
+	// The archive is built before responding, for its errors to be reported with the status code.
+	var buf bytes.Buffer
+	chats, err := m.exportUserData(r.Context(), userID, &buf)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to export user data", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := m.addAuditEntry(r.Context(), userID, models.AuditActionUserExport,
+		fmt.Sprintf("%d chats", chats)); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to add audit entry", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="mcpwebui-data.zip"`)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// HandleUserDataErase permanently erases all the data of the current user: the chats the user created
+// with their messages, the memories, API tokens, read receipts, usage and batches. The "confirm" form field
+// must be "erase". The erasure is recorded in the audit entries, and the user redirected to the home page.
+func (m *Main) HandleUserDataErase(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.FormValue("confirm") != userDataEraseConfirmation {
+		http.Error(w, fmt.Sprintf("Type %q to confirm the erasure", userDataEraseConfirmation), http.StatusBadRequest)
+		return
+	}
+	userID := m.userID(r)
+
+	res, err := m.eraseUserData(r.Context(), userID)
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to erase user data", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := m.addAuditEntry(r.Context(), userID, models.AuditActionUserErase,
+		fmt.Sprintf("%d chats, %d batches", res.chats, res.batches)); err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to add audit entry", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// HandleAudit responds with the audit entries as JSON, the newest first.
+func (m *Main) HandleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.ErrorContext(r.Context(), "Method not allowed", slog.String("method", r.Method))
+		m.writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	entries, err := m.store.AuditEntries(r.Context())
+	if err != nil {
+		m.logger.ErrorContext(r.Context(), "Failed to get audit entries", slog.String(errLoggerKey, err.Error()))
+		m.writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []models.AuditEntry{}
+	}
+	m.writeAPIJSON(w, http.StatusOK, entries)
+}
+
+// userChats returns the chats created by userID.
+func (m *Main) userChats(ctx context.Context, userID string) ([]models.Chat, error) {
+	chats, err := m.store.Chats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chats: %w", err)
+	}
+	var res []models.Chat
+	for _, c := range chats {
+		if c.UserID == userID {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+// exportUserData writes the data of userID to buf as a zip archive, with a JSON file per chat under the
+// chats directory, and returns the number of chats.
+func (m *Main) exportUserData(ctx context.Context, userID string, buf *bytes.Buffer) (int, error) {
+	chats, err := m.userChats(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	memories, err := m.store.Memories(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get memories: %w", err)
+	}
+	tokens, err := m.store.APITokens(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get API tokens: %w", err)
+	}
+	sessions, err := m.store.Sessions(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get sessions: %w", err)
+	}
+	// The hashes are only used to authenticate the tokens and the sessions, they aren't data of the user.
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+	for i := range sessions {
+		sessions[i].Hash = ""
+	}
+	receipts, err := m.store.ReadReceipts(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get read receipts: %w", err)
+	}
+	usages, err := m.store.UserUsages(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	files := map[string]any{
+		"memories.json":      memories,
+		"api_tokens.json":    tokens,
+		"sessions.json":      sessions,
+		"read_receipts.json": receipts,
+		"usage.json":         usages,
+		"batches.json":       m.batches.list(userID),
+	}
+	for _, c := range chats {
+		msgs, err := m.store.Messages(ctx, c.ID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get messages of chat %s: %w", c.ID, err)
+		}
+		files[path.Join("chats", path.Base(c.ID)+".json")] = archivedChat{Chat: c, Messages: msgs}
+	}
+
+	zw := zip.NewWriter(buf)
+	for name, v := range files {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return 0, fmt.Errorf("failed to create %s: %w", name, err)
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			return 0, fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close archive: %w", err)
+	}
+	return len(chats), nil
+}
+
+// eraseUserData deletes the chats created by userID and the other data of the user, then publishes the chat
+// list.
+func (m *Main) eraseUserData(ctx context.Context, userID string) (userEraseResult, error) {
+	chats, err := m.userChats(ctx, userID)
+	if err != nil {
+		return userEraseResult{}, err
+	}
+
+	var res userEraseResult
+	for _, c := range chats {
+		if err := m.store.DeleteChat(ctx, c.ID); err != nil {
+			return res, fmt.Errorf("failed to delete chat %s: %w", c.ID, err)
+		}
+		res.chats++
+	}
+	if err := m.store.DeleteUserData(ctx, userID); err != nil {
+		return res, fmt.Errorf("failed to delete user data: %w", err)
+	}
+	res.batches = m.batches.deleteUser(userID)
+
+	if res.chats > 0 {
+		if err := m.publishChats(ctx); err != nil {
+			m.logger.ErrorContext(ctx, "Failed to publish chats", slog.String(errLoggerKey, err.Error()))
+		}
+	}
+	m.logger.InfoContext(ctx, "User data erased",
+		slog.String("userID", userID),
+		slog.Int("chats", res.chats),
+		slog.Int("batches", res.batches))
+	return res, nil
+}
+
+func (m *Main) addAuditEntry(ctx context.Context, userID string, action models.AuditAction, details string) error {
+	return m.store.AddAuditEntry(ctx, models.AuditEntry{
+		ID:      uuid.New().String(),
+		UserID:  userID,
+		Action:  action,
+		Details: details,
+		Time:    time.Now(),
+	})
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/MegaGrindStone/go-mcp"
+)
+
+// Welcome configures the welcome card shown in the empty chat state, before the first message of a chat.
+type Welcome struct {
+	// Title is the heading of the card, "Hello there!" if it's empty.
+	Title string
+	// Message is the text under the title, like what the assistant is for.
+	Message string
+	// Suggestions are the prompts offered as buttons, sending them as the first message of a new chat when
+	// clicked.
+	Suggestions []WelcomeSuggestion
+	// ShowTools lists the tools of the connected MCP servers in the card, with their descriptions.
+	ShowTools bool
+}
+
+// WelcomeSuggestion is a suggested prompt of the welcome card.
+type WelcomeSuggestion struct {
+	// Label is the text of the button, the prompt if it's empty.
+	Label  string
+	Prompt string
+	// Tools are the tools the prompt needs. The suggestion is hidden while any of them isn't offered by the
+	// connected MCP servers.
+	Tools []string
+}
+
+type welcomeView struct {
+	Title       string
+	Message     string
+	Suggestions []WelcomeSuggestion
+	Tools       []mcp.Tool
+}
+
+const defaultWelcomeTitle = "Hello there!"
+
+// WithWelcome configures the welcome card of the empty chat state.
+func WithWelcome(welcome Welcome) MainOption {
+	return func(m *Main) {
+		m.welcome = welcome
+	}
+}
+
+func (m *Main) parseWelcome() error {
+	if m.welcome.Title == "" {
+		m.welcome.Title = defaultWelcomeTitle
+	}
+	for i, s := range m.welcome.Suggestions {
+		if s.Prompt == "" {
+			return errors.New("the prompts of the welcome suggestions are required")
+		}
+		if s.Label == "" {
+			m.welcome.Suggestions[i].Label = s.Prompt
+		}
+	}
+	return nil
+}
+
+// newWelcomeView returns the welcome card with the suggestions whose tools are all offered by tools.
+func (m *Main) newWelcomeView(tools []mcp.Tool) welcomeView {
+	view := welcomeView{Title: m.welcome.Title, Message: m.welcome.Message}
+	for _, s := range m.welcome.Suggestions {
+		if slices.ContainsFunc(s.Tools, func(name string) bool {
+			return !slices.ContainsFunc(tools, func(t mcp.Tool) bool { return t.Name == name })
+		}) {
+			continue
+		}
+		view.Suggestions = append(view.Suggestions, s)
+	}
+	if m.welcome.ShowTools {
+		view.Tools = tools
+	}
+	return view
+}
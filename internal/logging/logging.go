@@ -0,0 +1,78 @@
+// Package logging correlates the log records of a single request or generation, by carrying their IDs in
+// the context and adding them to the records logged with that context.
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	generationIDKey
+)
+
+// Attribute keys of the IDs in the log records.
+const (
+	RequestIDKey    = "requestID"
+	GenerationIDKey = "generationID"
+)
+
+// WithRequestID returns a copy of ctx carrying the given request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID carried by ctx, or an empty string if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithGenerationID returns a copy of ctx carrying the given generation ID.
+func WithGenerationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, generationIDKey, id)
+}
+
+// GenerationID returns the generation ID carried by ctx, or an empty string if there is none.
+func GenerationID(ctx context.Context) string {
+	id, _ := ctx.Value(generationIDKey).(string)
+	return id
+}
+
+// Handler is a slog.Handler adding the request and generation IDs carried by the context to the records.
+// The IDs are only added to the records logged with a context, e.g. with slog.Logger.InfoContext.
+type Handler struct {
+	slog.Handler
+}
+
+// NewHandler wraps h with a Handler, unless it's already one.
+func NewHandler(h slog.Handler) slog.Handler {
+	if _, ok := h.(Handler); ok {
+		return h
+	}
+	return Handler{Handler: h}
+}
+
+// Handle implements slog.Handler.
+func (h Handler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String(RequestIDKey, id))
+	}
+	if id := GenerationID(ctx); id != "" {
+		r.AddAttrs(slog.String(GenerationIDKey, id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return Handler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup implements slog.Handler.
+func (h Handler) WithGroup(name string) slog.Handler {
+	return Handler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// AuditEntry records an action on the data of a user for the administrators, like its export or its
+// erasure, or an authentication event. The entries are kept after the data of the user is erased.
+type AuditEntry struct {
+	ID     string
+	UserID string
+	Action AuditAction
+	// Details describes the data the action was applied to, like the number of erased chats.
+	Details string
+	// IP is the address of the client of the authentication events.
+	IP   string
+	Time time.Time
+}
+
+// AuditAction is the action recorded by an audit entry.
+type AuditAction string
+
+const (
+	// AuditActionUserExport is the action of the export of the data of a user.
+	AuditActionUserExport AuditAction = "user.export"
+	// AuditActionUserErase is the action of the erasure of the data of a user.
+	AuditActionUserErase AuditAction = "user.erase"
+	// AuditActionAuthLogin is the action of the start of a browser session.
+	AuditActionAuthLogin AuditAction = "auth.login"
+	// AuditActionAuthRevoke is the action of the revocation of a browser session.
+	AuditActionAuthRevoke AuditAction = "auth.revoke"
+	// AuditActionAuthFailure is the action of a failed authentication, with an invalid API token.
+	AuditActionAuthFailure AuditAction = "auth.failure"
+	// AuditActionAuthLockout is the action of the lockout of a client after repeated failed authentications.
+	AuditActionAuthLockout AuditAction = "auth.lockout"
+	// AuditActionAuthUnlock is the action of the lift of a lockout by an administrator.
+	AuditActionAuthUnlock AuditAction = "auth.unlock"
+	// AuditActionKeyRotation is the action of the rotation of the API key of an LLM provider.
+	AuditActionKeyRotation AuditAction = "auth.key_rotation"
+)
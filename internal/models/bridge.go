@@ -0,0 +1,22 @@
+package models
+
+// BridgeMessage is a message of an external conversation, like a Telegram chat, received by a bridge to the
+// chats.
+type BridgeMessage struct {
+	// Conversation identifies the external conversation within its bridge.
+	Conversation string
+	// User identifies the sender within the bridge.
+	User string
+	Text string
+}
+
+// BridgeReply is the reply to a BridgeMessage, sent back to its conversation by the bridge. The reply is
+// updated as the response is streamed, its last update being Final.
+type BridgeReply struct {
+	Conversation string
+	// ID identifies the message of the reply within the bridge, as returned by its first update. It's empty
+	// until the reply is sent.
+	ID    string
+	Text  string
+	Final bool
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	stdhtml "html"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Source is the provenance of a document given to the LLM along the messages, like a resource of the MCP
+// servers attached to a message or mounted in a chat.
+type Source struct {
+	URI string
+	// Name is the name of the resource, empty if it isn't known.
+	Name string
+	// URL is where the source is opened from its citations.
+	URL string
+}
+
+// citationPattern matches the citations of the sources in a text, like [1], which refer to the sources by
+// their position, starting from 1.
+var citationPattern = regexp.MustCompile(`\[(\d+)\]`)
+
+// renderCitations returns text with the citations of sources replaced by the links to the sources, and adds
+// the numbers of the cited sources to cited. The citations in the fenced code blocks, and the ones following
+// a word or a bracket, like the indexes in a[1], are kept as is.
+func renderCitations(text string, sources []Source, cited map[int]Source) string {
+	if len(sources) == 0 {
+		return text
+	}
+
+	lines := strings.SplitAfter(text, "\n")
+	inCode := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			continue
+		}
+		lines[i] = replaceCitations(line, sources, cited)
+	}
+	return strings.Join(lines, "")
+}
+
+func replaceCitations(line string, sources []Source, cited map[int]Source) string {
+	var sb strings.Builder
+	last := 0
+	for _, match := range citationPattern.FindAllStringSubmatchIndex(line, -1) {
+		start, end := match[0], match[1]
+		n, err := strconv.Atoi(line[match[2]:match[3]])
+		if err != nil || n < 1 || n > len(sources) || (start > 0 && isCitationPrefix(line[start-1])) {
+			continue
+		}
+		source := sources[n-1]
+		cited[n] = source
+		sb.WriteString(line[last:start])
+		sb.WriteString(`<sup class="citation"><a href="` + stdhtml.EscapeString(source.URL) + `" title="` +
+			stdhtml.EscapeString(source.URI) + `" target="_blank" rel="noopener">[` + strconv.Itoa(n) + `]</a></sup>`)
+		last = end
+	}
+	sb.WriteString(line[last:])
+	return sb.String()
+}
+
+func isCitationPrefix(c byte) bool {
+	return c == '_' || c == ']' || c == '[' || c == '`' ||
+		('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// renderSources renders the list of the cited sources, in the order of their numbers.
+func renderSources(cited map[int]Source) string {
+	if len(cited) == 0 {
+		return ""
+	}
+	numbers := make([]int, 0, len(cited))
+	for n := range cited {
+		numbers = append(numbers, n)
+	}
+	slices.Sort(numbers)
+
+	var sb strings.Builder
+	sb.WriteString("\n\n<ol class=\"citations small text-muted\">\n")
+	for _, n := range numbers {
+		source := cited[n]
+		label := source.URI
+		if source.Name != "" {
+			label = source.Name + ": " + source.URI
+		}
+		sb.WriteString(`<li value="` + strconv.Itoa(n) + `"><a href="` + stdhtml.EscapeString(source.URL) +
+			`" target="_blank" rel="noopener">` + stdhtml.EscapeString(label) + "</a></li>\n")
+	}
+	sb.WriteString("</ol>\n")
+	return sb.String()
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Event represents a notable activity in the chat system, that is delivered to the external systems
+// interested in it, such as webhooks.
+type Event struct {
+	Type      EventType      `json:"type"`
+	ChatID    string         `json:"chatId"`
+	MessageID string         `json:"messageId,omitempty"`
+	Timestamp time.Time      `json:"timestamp"`
+	Data      map[string]any `json:"data,omitempty"`
+}
+
+// EventType represents the type of an Event.
+type EventType string
+
+const (
+	// EventChatCreated is emitted when a new chat is created.
+	EventChatCreated EventType = "chat.created"
+	// EventGenerationCompleted is emitted when the assistant finishes responding to a message. The Data
+	// contains the response text under the "text" key.
+	EventGenerationCompleted EventType = "generation.completed"
+	// EventGenerationFailed is emitted when the assistant response is aborted due to an error. The Data
+	// contains the error message under the "error" key.
+	EventGenerationFailed EventType = "generation.failed"
+	// EventToolCallFailed is emitted when a tool call requested by the assistant fails. The Data contains
+	// the tool name under the "toolName" key, and the tool result under the "result" key.
+	EventToolCallFailed EventType = "tool_call.failed"
+	// EventScheduleCompleted is emitted when a run of a scheduled prompt finishes. The Data contains the
+	// schedule name under the "schedule" key, and the error message of a failed run under the "error" key.
+	EventScheduleCompleted EventType = "schedule.completed"
+	// EventBudgetThreshold is emitted when the spend of an LLM provider crosses a threshold of its budget. The
+	// Data contains the provider under the "provider" key, the "daily" or "monthly" period under the "period"
+	// key, the crossed fraction of the limit under the "threshold" key, and the "spent" and "limit" amounts.
+	EventBudgetThreshold EventType = "budget.threshold"
+)
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// Generation represents a completed generation of an assistant message, exported to the observability
+// tools with its prompt, response, latency and token usage.
+type Generation struct {
+	// ID is the generation ID, the same as the one in the log records of the generation.
+	ID     string
+	ChatID string
+	// Model is the name of the model, it's empty if the LLM doesn't report it.
+	Model string
+	// Prompt is the messages sent to the LLM, without the assistant message being generated.
+	Prompt []Message
+	// Response is the generated assistant message, including the tool calls and their results.
+	Response   Message
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// InputTokens and OutputTokens are the estimated numbers of tokens of the prompt and the response.
+	InputTokens  int
+	OutputTokens int
+	// Error is the reason the generation failed, it's empty if the generation succeeded.
+	Error string
+}
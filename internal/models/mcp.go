@@ -0,0 +1,21 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// MCPServerState is the state of an MCP server kept across the restarts, so its capabilities are offered
+// right after a restart, before the server lists them again.
+type MCPServerState struct {
+	// Key identifies the server among the configured ones.
+	Key     string
+	Name    string
+	Version string
+	// Capabilities is the JSON of the capabilities negotiated with the server, and of the tools, resources,
+	// resource templates and prompts it listed.
+	Capabilities json.RawMessage
+	// ETag is the hash of Capabilities, telling whether they changed when they're listed again.
+	ETag     string
+	ListedAt time.Time
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Memory is a fact about a user remembered across the chats, given to the LLM in the system prompt. It's
+// either saved by the LLM, when the user tells something worth remembering, or added by the user.
+type Memory struct {
+	ID     string
+	UserID string
+	Text   string
+	Source MemorySource
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// MemorySource is who saved a memory.
+type MemorySource string
+
+const (
+	// MemorySourceLLM is the source of the memories saved by the LLM.
+	MemorySourceLLM MemorySource = "llm"
+	// MemorySourceUser is the source of the memories added or edited by the user.
+	MemorySourceUser MemorySource = "user"
+)
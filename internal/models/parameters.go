@@ -0,0 +1,92 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// ChatParameters are the LLM parameters set on a chat, overriding the parameters configured for the LLM. The
+// nil fields keep the configured values.
+type ChatParameters struct {
+	Temperature *float32
+	TopP        *float32
+	TopK        *int
+	// MaxTokens is the maximum number of tokens of a response.
+	MaxTokens *int
+	Seed      *int
+	// Stop are the sequences stopping the generation of a response, nil to keep the configured ones.
+	Stop []string
+	// LogitBias biases the likelihood of the tokens, keyed by their ID in the tokenizer of the model, from -100
+	// to 100. It's nil to keep the configured bias.
+	LogitBias map[string]int
+}
+
+type chatParametersKey struct{}
+
+type systemPromptKey struct{}
+
+type systemPromptOverrideKey struct{}
+
+type responseSchemaKey struct{}
+
+// WithChatParameters returns a copy of ctx carrying params, which the LLM providers apply to the requests made
+// with it.
+func WithChatParameters(ctx context.Context, params ChatParameters) context.Context {
+	return context.WithValue(ctx, chatParametersKey{}, params)
+}
+
+// ChatParametersFromContext returns the chat parameters carried by ctx, or the zero value if there are none.
+func ChatParametersFromContext(ctx context.Context) ChatParameters {
+	params, _ := ctx.Value(chatParametersKey{}).(ChatParameters)
+	return params
+}
+
+// IsZero reports whether p overrides none of the parameters.
+func (p ChatParameters) IsZero() bool {
+	return p.Temperature == nil && p.TopP == nil && p.TopK == nil && p.MaxTokens == nil && p.Seed == nil &&
+		p.Stop == nil && p.LogitBias == nil
+}
+
+// WithSystemPrompt returns a copy of ctx carrying instructions the LLM providers append to their configured
+// system prompt, after the ones already carried by ctx.
+func WithSystemPrompt(ctx context.Context, instructions string) context.Context {
+	if prev, ok := ctx.Value(systemPromptKey{}).(string); ok {
+		instructions = prev + "\n\n" + instructions
+	}
+	return context.WithValue(ctx, systemPromptKey{}, instructions)
+}
+
+// WithSystemPromptOverride returns a copy of ctx carrying the system prompt replacing the configured one of the
+// LLM providers, the instructions carried by ctx being still appended to it.
+func WithSystemPromptOverride(ctx context.Context, prompt string) context.Context {
+	return context.WithValue(ctx, systemPromptOverrideKey{}, prompt)
+}
+
+// SystemPrompt returns the configured system prompt, or the one overriding it carried by ctx, with the
+// instructions carried by ctx appended.
+func SystemPrompt(ctx context.Context, configured string) string {
+	if override, ok := ctx.Value(systemPromptOverrideKey{}).(string); ok {
+		configured = override
+	}
+	instructions, _ := ctx.Value(systemPromptKey{}).(string)
+	switch {
+	case instructions == "":
+		return configured
+	case configured == "":
+		return instructions
+	default:
+		return configured + "\n\n" + instructions
+	}
+}
+
+// WithResponseSchema returns a copy of ctx carrying the JSON schema the response must follow, which the LLM
+// providers supporting the structured output set as the format of the response.
+func WithResponseSchema(ctx context.Context, schema json.RawMessage) context.Context {
+	return context.WithValue(ctx, responseSchemaKey{}, schema)
+}
+
+// ResponseSchemaFromContext returns the JSON schema of the response carried by ctx, or nil if there is none.
+func ResponseSchemaFromContext(ctx context.Context) json.RawMessage {
+	schema, _ := ctx.Value(responseSchemaKey{}).(json.RawMessage)
+	return schema
+}
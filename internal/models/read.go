@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// ReadReceipt is the last message of a chat read by a user. The assistant messages after it are unread.
+type ReadReceipt struct {
+	UserID    string
+	ChatID    string
+	MessageID string
+	ReadAt    time.Time
+}
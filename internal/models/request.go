@@ -0,0 +1,22 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+)
+
+type requestRecorderKey struct{}
+
+// WithRequestRecorder returns a copy of ctx carrying record, which the LLM providers call with the body of
+// every request they send to generate a response with it, exactly as it's sent.
+func WithRequestRecorder(ctx context.Context, record func(body json.RawMessage)) context.Context {
+	return context.WithValue(ctx, requestRecorderKey{}, record)
+}
+
+// RecordRequest gives a copy of body to the request recorder carried by ctx, if there's one.
+func RecordRequest(ctx context.Context, body []byte) {
+	if record, ok := ctx.Value(requestRecorderKey{}).(func(json.RawMessage)); ok {
+		record(slices.Clone(body))
+	}
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Schedule represents the persisted state of a scheduled prompt. The schedule itself is defined in the
+// configuration, while the store keeps the chat designated to receive the results of its runs.
+type Schedule struct {
+	Name   string
+	ChatID string
+}
+
+// ScheduleRun represents a single run of a scheduled prompt, recorded for the run history.
+type ScheduleRun struct {
+	ScheduleName string
+	ChatID       string
+	MessageID    string
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	// Error is the reason of the failed run, it's empty if the run succeeded.
+	Error string
+}
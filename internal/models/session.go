@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Session represents a browser session of a user, started by the first request of the browser and held by
+// a cookie. Only the hash of the cookie's token is stored, like the API tokens. IP and UserAgent are the
+// ones of the last request of the session.
+type Session struct {
+	ID     string
+	UserID string
+	// Hash is the hex-encoded SHA-256 hash of the token of the session's cookie.
+	Hash         string
+	IP           string
+	UserAgent    string
+	CreatedAt    time.Time
+	LastActiveAt time.Time
+}
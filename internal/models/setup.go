@@ -0,0 +1,13 @@
+package models
+
+// SetupError is a problem of the setup found by a runtime check, like a missing API key or a model that
+// isn't available, with the hint to fix it shown on the onboarding page.
+type SetupError struct {
+	Problem string
+	// Hint is the action fixing the problem, like the configuration to set or the command to run.
+	Hint string
+}
+
+func (e *SetupError) Error() string {
+	return e.Problem
+}
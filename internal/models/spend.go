@@ -0,0 +1,15 @@
+package models
+
+// Spend represents the consumption of an LLM provider within a single day, with its cost in the currency of
+// its prices. It's used to enforce the spend budgets of the providers.
+type Spend struct {
+	// Provider is the role of the LLM provider, like "llm" or "compareLLM".
+	Provider string
+	// Day is the date of the spend in the "2006-01-02" format, in UTC.
+	Day string
+
+	// InputTokens and OutputTokens are the estimated numbers of tokens sent to and received from the provider.
+	InputTokens  int
+	OutputTokens int
+	Cost         float64
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// StructuredOutputJSON returns the JSON value of a structured output text, without the code fence the LLMs
+// sometimes wrap it in.
+func StructuredOutputJSON(text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "```") {
+		return text
+	}
+	_, text, _ = strings.Cut(text, "\n")
+	text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	return strings.TrimSpace(text)
+}
+
+// renderStructuredOutput renders the structured output of c as formatted JSON, preceded by its schema
+// violations.
+func renderStructuredOutput(c Content) string {
+	var sb strings.Builder
+	if len(c.SchemaViolations) > 0 {
+		sb.WriteString("> ❌ **The response doesn't match the response schema:**\n")
+		for _, v := range c.SchemaViolations {
+			sb.WriteString(fmt.Sprintf("> - `%s`\n", strings.ReplaceAll(v, "`", "'")))
+		}
+		sb.WriteString("\n")
+	}
+
+	value := StructuredOutputJSON(c.Text)
+	var prettyJSON bytes.Buffer
+	if err := json.Indent(&prettyJSON, []byte(value), "", "  "); err == nil {
+		value = prettyJSON.String()
+	}
+	sb.WriteString(fmt.Sprintf("```json\n%s\n```\n", value))
+	return sb.String()
+}
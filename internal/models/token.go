@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// APIToken represents a personal access token of a user for the JSON API. Only the hash of the token is
+// stored, the token itself is shown once to the user when it's created.
+type APIToken struct {
+	ID     string
+	UserID string
+	Name   string
+	// Hash is the hex-encoded SHA-256 hash of the token.
+	Hash string
+	// Prefix is the beginning of the token, shown to help the user recognize it.
+	Prefix    string
+	CreatedAt time.Time
+}
@@ -0,0 +1,13 @@
+package models
+
+// Usage represents the consumption of a user within a single day. It's used to enforce the usage quotas,
+// and to report the consumption to the administrators.
+type Usage struct {
+	UserID string
+	// Day is the date of the usage in the "2006-01-02" format, in UTC.
+	Day string
+
+	Messages int
+	// Tokens is the estimated number of tokens sent to and received from the LLM.
+	Tokens int
+}
@@ -0,0 +1,40 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// fromKeyring reads the password of the given service and account from the OS keyring, with the
+// secret-tool command of libsecret on Linux and the security command on macOS.
+func fromKeyring(ctx context.Context, ref string) (string, error) {
+	service, account, ok := strings.Cut(ref, "/")
+	if !ok || service == "" || account == "" {
+		return "", fmt.Errorf("keyring reference requires a service and an account, e.g. keyring://service/account")
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		cmd = exec.CommandContext(ctx, "secret-tool", "lookup", "service", service, "account", account)
+	case "darwin":
+		cmd = exec.CommandContext(ctx, "security", "find-generic-password", "-s", service, "-a", account, "-w")
+	default:
+		return "", fmt.Errorf("keyring is not supported on %s", runtime.GOOS)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s: %w: %s", cmd.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	if len(out) == 0 {
+		return "", fmt.Errorf("keyring entry not found")
+	}
+	return string(out), nil
+}
@@ -0,0 +1,105 @@
+// Package secrets resolves the secret references of the configuration, so the secrets like the API keys
+// of the LLM providers can be kept in an external secret store instead of the configuration file.
+//
+// A reference is a URL whose scheme selects the store:
+//
+//	env://NAME                        environment variable NAME
+//	file:///path/to/secret            content of the file
+//	systemd://name                    systemd credential name, from $CREDENTIALS_DIRECTORY
+//	vault://secret/data/app#field     field of a HashiCorp Vault secret, from $VAULT_ADDR with $VAULT_TOKEN
+//	aws-sm://secret-id#field          AWS Secrets Manager secret, the field is optional for JSON secrets
+//	keyring://service/account         OS keyring entry, via secret-tool on Linux and security on macOS
+//
+// The surrounding whitespace of the resolved secrets is trimmed.
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Resolve returns the secret referenced by ref.
+func Resolve(ctx context.Context, ref string) (string, error) {
+	scheme, rest, ok := strings.Cut(ref, "://")
+	if !ok {
+		return "", fmt.Errorf("invalid secret reference %q, expected <scheme>://<path>", ref)
+	}
+
+	var secret string
+	var err error
+	switch scheme {
+	case "env":
+		secret, err = fromEnv(rest)
+	case "file":
+		secret, err = fromFile(rest)
+	case "systemd":
+		secret, err = fromSystemd(rest)
+	case "vault":
+		secret, err = fromVault(ctx, rest)
+	case "aws-sm":
+		secret, err = fromAWSSecretsManager(ctx, rest)
+	case "keyring":
+		secret, err = fromKeyring(ctx, rest)
+	default:
+		return "", fmt.Errorf("unknown secret store %q of reference %q", scheme, ref)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve secret %q: %w", ref, err)
+	}
+
+	return strings.TrimSpace(secret), nil
+}
+
+func fromEnv(name string) (string, error) {
+	secret, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return secret, nil
+}
+
+func fromFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func fromSystemd(name string) (string, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", fmt.Errorf("CREDENTIALS_DIRECTORY is not set, the service must be started with LoadCredential")
+	}
+	// The credential names are plain file names, a separator would escape the credentials directory.
+	if name == "" || strings.ContainsRune(name, '/') {
+		return "", fmt.Errorf("invalid credential name %q", name)
+	}
+	return fromFile(filepath.Join(dir, name))
+}
+
+// jsonField returns the field of the JSON object data, used for the secret stores that hold multiple
+// values in a single secret.
+func jsonField(data []byte, field string) (string, error) {
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", fmt.Errorf("failed to decode secret as JSON object: %w", err)
+	}
+	v, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("field %s not found in secret", field)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("field %s of secret is not a string", field)
+	}
+	return s, nil
+}
@@ -1,14 +1,16 @@
 package services
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"iter"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
 
 	"github.com/MegaGrindStone/go-mcp"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
@@ -26,6 +28,8 @@ type Anthropic struct {
 	params LLMParameters
 
 	client *http.Client
+
+	logger *slog.Logger
 }
 
 type anthropicChatRequest struct {
@@ -62,10 +66,20 @@ type anthropicMessageContent struct {
 	ToolUseID string          `json:"tool_use_id,omitempty"`
 	Content   json.RawMessage `json:"content,omitempty"`
 	IsError   bool            `json:"is_error,omitempty"`
+
+	// For image type.
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      []byte `json:"data"`
 }
 
 type anthropicContentBlockStart struct {
 	Type         string
+	Index        int `json:"index"`
 	ContentBlock struct {
 		Type  string          `json:"type"`
 		ID    string          `json:"id"`
@@ -76,6 +90,7 @@ type anthropicContentBlockStart struct {
 
 type anthropicContentBlockDelta struct {
 	Type  string `json:"type"`
+	Index int    `json:"index"`
 	Delta struct {
 		Type        string `json:"type"`
 		Text        string `json:"text"`
@@ -83,6 +98,13 @@ type anthropicContentBlockDelta struct {
 	} `json:"delta"`
 }
 
+type anthropicMessageDelta struct {
+	Type  string `json:"type"`
+	Delta struct {
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+}
+
 type anthropicError struct {
 	Type  string `json:"type"`
 	Error struct {
@@ -104,14 +126,22 @@ const (
 // NewAnthropic creates a new Anthropic instance with the specified API key, model name, and maximum
 // token limit. It initializes an HTTP client for API communication and returns a configured Anthropic
 // instance ready for chat interactions.
-func NewAnthropic(apiKey, model, systemPrompt string, maxTokens int, params LLMParameters) Anthropic {
+func NewAnthropic(
+	apiKey, model, systemPrompt string,
+	maxTokens int,
+	params LLMParameters,
+	logger *slog.Logger,
+	options ...ProviderOption,
+) Anthropic {
+	opts := newProviderOptions(options)
 	return Anthropic{
 		apiKey:       apiKey,
 		model:        model,
 		maxTokens:    maxTokens,
 		systemPrompt: systemPrompt,
 		params:       params,
-		client:       &http.Client{},
+		client:       opts.httpClient,
+		logger:       logger.With(slog.String("module", "anthropic")),
 	}
 }
 
@@ -123,90 +153,79 @@ func (a Anthropic) Chat(
 	messages []models.Message,
 	tools []mcp.Tool,
 ) iter.Seq2[models.Content, error] {
-	return func(yield func(models.Content, error) bool) {
+	return streamChat(ctx, a.logger, a.Capabilities(), func(s *chatStream) {
 		resp, err := a.doRequest(ctx, messages, tools, true)
 		if err != nil {
-			if errors.Is(err, context.Canceled) {
-				return
+			if !errors.Is(err, context.Canceled) {
+				s.fail(fmt.Errorf("error sending request: %w", err))
 			}
-			yield(models.Content{}, fmt.Errorf("error sending request: %w", err))
 			return
 		}
 		defer resp.Body.Close()
 
-		isToolUse := false
-		inputJSON := ""
-		toolContent := models.Content{
-			Type: models.ContentTypeCallTool,
-		}
-		for ev, err := range sse.Read(resp.Body, nil) {
-			if err != nil {
-				yield(models.Content{}, fmt.Errorf("error reading response: %w", err))
-				return
-			}
+		s.readEvents(resp.Body, func(ev sse.Event) bool {
 			switch ev.Type {
 			case "error":
 				var e anthropicError
-				if err := json.Unmarshal([]byte(ev.Data), &e); err != nil {
-					yield(models.Content{}, fmt.Errorf("error unmarshaling error: %w", err))
-					return
+				if !s.decode(ev, &e, "error") {
+					return false
 				}
-				yield(models.Content{}, fmt.Errorf("anthropic error %s: %s", e.Error.Type, e.Error.Message))
-				return
+				s.fail(fmt.Errorf("anthropic error %s: %s", e.Error.Type, e.Error.Message))
+				return false
 			case "message_stop":
-				return
+				return false
+			case "message_delta":
+				var res anthropicMessageDelta
+				if !s.decode(ev, &res, "message delta") {
+					return false
+				}
+				s.finish(anthropicFinishReason(res.Delta.StopReason))
 			case "content_block_start":
 				var res anthropicContentBlockStart
-				if err := json.Unmarshal([]byte(ev.Data), &res); err != nil {
-					yield(models.Content{}, fmt.Errorf("error unmarshaling block start: %w", err))
-					return
+				if !s.decode(ev, &res, "block start") {
+					return false
 				}
-				if res.ContentBlock.Type != "tool_use" {
-					continue
+				if res.ContentBlock.Type == "tool_use" {
+					return s.toolCallDelta(res.Index, res.ContentBlock.ID, res.ContentBlock.Name, "")
 				}
-				isToolUse = true
-				toolContent.ToolName = res.ContentBlock.Name
-				toolContent.CallToolID = res.ContentBlock.ID
 			case "content_block_delta":
 				var res anthropicContentBlockDelta
-				if err := json.Unmarshal([]byte(ev.Data), &res); err != nil {
-					yield(models.Content{}, fmt.Errorf("error unmarshaling block delta: %w", err))
-					return
-				}
-				if isToolUse {
-					inputJSON += res.Delta.PartialJSON
-					continue
-				}
-				if !yield(models.Content{
-					Type: models.ContentTypeText,
-					Text: res.Delta.Text,
-				}, nil) {
-					return
-				}
-			case "content_block_stop":
-				if !isToolUse {
-					continue
+				if !s.decode(ev, &res, "block delta") {
+					return false
 				}
-
-				if inputJSON == "" {
-					inputJSON = "{}"
-				}
-				toolContent.ToolInput = json.RawMessage(inputJSON)
-				if !yield(toolContent, nil) {
-					return
+				if res.Delta.Type == "input_json_delta" {
+					return s.toolCallDelta(res.Index, "", "", res.Delta.PartialJSON)
 				}
-				isToolUse = false
-				inputJSON = ""
-			default:
+				return s.text(res.Delta.Text)
 			}
-		}
+			return true
+		})
+	})
+}
+
+// anthropicFinishReason normalizes the stop reason of an Anthropic response.
+func anthropicFinishReason(reason string) models.FinishReason {
+	switch reason {
+	case "":
+		return ""
+	case "end_turn", "stop_sequence":
+		return models.FinishReasonStop
+	case "max_tokens":
+		return models.FinishReasonLength
+	case "tool_use":
+		return models.FinishReasonToolUse
+	case "refusal":
+		return models.FinishReasonRefusal
+	default:
+		return models.FinishReason(reason)
 	}
 }
 
 // GenerateTitle generates a title for a given message using the Anthropic API. It sends a single message to the
 // Anthropic API and returns the first response content as the title. The context can be used to cancel ongoing
-// requests.
-func (a Anthropic) GenerateTitle(ctx context.Context, message string) (string, error) {
+// requests. The title is written in language, if it isn't empty.
+func (a Anthropic) GenerateTitle(ctx context.Context, message, language string) (string, error) {
+	ctx = withTitleLanguage(ctx, language)
 	messages := []models.Message{
 		{
 			Role: "user",
@@ -224,11 +243,6 @@ func (a Anthropic) GenerateTitle(ctx context.Context, message string) (string, e
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
-	}
-
 	var msg anthropicMessage
 	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
 		return "", fmt.Errorf("error decoding response: %w", err)
@@ -250,18 +264,11 @@ func (a Anthropic) doRequest(
 	msgs := make([]anthropicMessage, 0, len(messages))
 	for _, msg := range messages {
 		if msg.Role == models.RoleUser {
-			if len(msg.Contents) != 1 {
-				return nil, fmt.Errorf("user message should only contain one content, got %d", len(msg.Contents))
+			contents, err := anthropicUserContents(msg)
+			if err != nil {
+				return nil, err
 			}
-			msgs = append(msgs, anthropicMessage{
-				Role: string(msg.Role),
-				Content: []anthropicMessageContent{
-					{
-						Type: "text",
-						Text: msg.Contents[0].Text,
-					},
-				},
-			})
+			msgs = append(msgs, anthropicMessage{Role: string(msg.Role), Content: contents})
 			continue
 		}
 
@@ -289,21 +296,30 @@ func (a Anthropic) doRequest(
 				})
 				contents = make([]anthropicMessageContent, 0, len(msg.Contents))
 			case models.ContentTypeToolResult:
+				result, err := anthropicToolResult(ct)
+				if err != nil {
+					return nil, err
+				}
 				msgs = append(msgs, anthropicMessage{
-					Role: "user",
-					Content: []anthropicMessageContent{
-						{
-							Type:      "tool_result",
-							ToolUseID: ct.CallToolID,
-							IsError:   ct.CallToolFailed,
-							Content:   ct.ToolResult,
-						},
-					},
+					Role:    "user",
+					Content: []anthropicMessageContent{result},
 				})
 			}
 		}
+		if len(contents) > 0 {
+			msgs = append(msgs, anthropicMessage{
+				Role:    string(msg.Role),
+				Content: contents,
+			})
+		}
+	}
+	// The text of a response being continued is the last message, which must not end with whitespace.
+	if last := len(msgs) - 1; last >= 0 && msgs[last].Role == string(models.RoleAssistant) {
+		lastContent := &msgs[last].Content[len(msgs[last].Content)-1]
+		lastContent.Text = strings.TrimRightFunc(lastContent.Text, unicode.IsSpace)
 	}
 
+	tools = chatTools(tools, a.Capabilities())
 	aTools := make([]anthropicTool, len(tools))
 	for i, tool := range tools {
 		aTools[i] = anthropicTool{
@@ -313,43 +329,152 @@ func (a Anthropic) doRequest(
 		}
 	}
 
+	params := a.params.withChat(ctx)
+	maxTokens := a.maxTokens
+	if params.MaxTokens != nil {
+		maxTokens = *params.MaxTokens
+	}
+
 	reqBody := anthropicChatRequest{
 		Model:     a.model,
 		Messages:  msgs,
-		System:    a.systemPrompt,
-		MaxTokens: a.maxTokens,
+		System:    models.SystemPrompt(ctx, a.systemPrompt),
+		MaxTokens: maxTokens,
 		Tools:     aTools,
 		Stream:    stream,
 
-		StopSequences: a.params.Stop,
-		Temperature:   a.params.Temperature,
-		TopK:          a.params.TopK,
-		TopP:          a.params.TopP,
+		StopSequences: params.Stop,
+		Temperature:   params.Temperature,
+		TopK:          params.TopK,
+		TopP:          params.TopP,
 	}
 
-	jsonBody, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("error marshaling request: %w", err)
+	return postJSON(ctx, a.client, a.logger, anthropicAPIEndpoint+"/messages", map[string]string{
+		"x-api-key":         a.apiKey,
+		"anthropic-version": "2023-06-01",
+	}, reqBody)
+}
+
+// anthropicUserContents returns the contents of a user message as the content blocks of a single message, in
+// their order, like its texts, the images attached to it and the resources injected into it. The empty texts
+// are skipped, as the API refuses them, but the message must keep a content.
+func anthropicUserContents(msg models.Message) ([]anthropicMessageContent, error) {
+	contents := make([]anthropicMessageContent, 0, len(msg.Contents))
+	for _, ct := range msg.Contents {
+		switch ct.Type {
+		case models.ContentTypeText:
+			if ct.Text != "" {
+				contents = append(contents, anthropicMessageContent{Type: "text", Text: ct.Text})
+			}
+		case models.ContentTypeImage:
+			contents = append(contents, anthropicMessageContent{
+				Type:   "image",
+				Source: &anthropicImageSource{Type: "base64", MediaType: ct.MediaType, Data: ct.Data},
+			})
+		case models.ContentTypeToolResult:
+			result, err := anthropicToolResult(ct)
+			if err != nil {
+				return nil, err
+			}
+			contents = append(contents, result)
+		default:
+			return nil, fmt.Errorf("user message should only contain texts, images and tool results, got %s", ct.Type)
+		}
+	}
+	if len(contents) == 0 {
+		return nil, errors.New("user message should have a content")
 	}
+	return contents, nil
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
-		anthropicAPIEndpoint+"/messages", bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
+// anthropicToolResult returns the tool_result content block of a tool result.
+func anthropicToolResult(ct models.Content) (anthropicMessageContent, error) {
+	result := ct.ToolResult
+	if ct.Untrusted || ct.ToolNote != "" {
+		// The envelope and the note are plain text, which is accepted as the content of a tool result as well.
+		var err error
+		if result, err = json.Marshal(ct.LLMToolResult()); err != nil {
+			return anthropicMessageContent{}, fmt.Errorf("failed to marshal tool result: %w", err)
+		}
 	}
+	return anthropicMessageContent{
+		Type:      "tool_result",
+		ToolUseID: ct.CallToolID,
+		IsError:   ct.CallToolFailed,
+		Content:   result,
+	}, nil
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", a.apiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
+// ValidateParameters checks the parameters of a chat against the Anthropic API, which takes neither a seed nor
+// a logit bias, and refuses the stop sequences made of whitespace only.
+func (a Anthropic) ValidateParameters(params models.ChatParameters) error {
+	if params.Seed != nil {
+		return unsupportedParameter("Anthropic", "seed")
+	}
+	if params.LogitBias != nil {
+		return unsupportedParameter("Anthropic", "logit bias")
+	}
+	for _, stop := range params.Stop {
+		if strings.TrimSpace(stop) == "" {
+			return errors.New("the stop sequences of Anthropic must not be whitespace only")
+		}
+	}
+	return nil
+}
+
+// Capabilities returns the features of the Anthropic API, which takes the system prompt apart from the
+// messages.
+func (a Anthropic) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{Tools: true, Vision: true}
+}
+
+// Model returns the name of the model the Anthropic instance chats with.
+func (a Anthropic) Model() string {
+	return a.model
+}
+
+// CountTokens approximates the number of input tokens of a chat request of messages and tools with the
+// tokenizer of the Claude models, the system prompt of ctx and the one Anthropic adds for the tools included.
+func (a Anthropic) CountTokens(ctx context.Context, messages []models.Message, tools []mcp.Tool) int {
+	tokens := approxRequestTokens(models.SystemPrompt(ctx, a.systemPrompt), messages, tools, anthropicCharsPerToken)
+	if len(tools) > 0 {
+		tokens += anthropicToolUseTokens
+	}
+	return tokens
+}
 
-	resp, err := a.client.Do(req)
+// CheckSetup checks the API key and the model, by retrieving the model from the Anthropic API.
+func (a Anthropic) CheckSetup(ctx context.Context) error {
+	if a.apiKey == "" {
+		return &models.SetupError{
+			Problem: "The Anthropic API key is missing",
+			Hint:    "Set the apiKey of the llm section, or the ANTHROPIC_API_KEY environment variable.",
+		}
+	}
+	status, err := probeStatus(ctx, a.client, anthropicAPIEndpoint+"/models/"+url.PathEscape(a.model),
+		map[string]string{
+			"x-api-key":         a.apiKey,
+			"anthropic-version": "2023-06-01",
+		})
 	if err != nil {
-		return nil, err
+		return &models.SetupError{
+			Problem: fmt.Sprintf("The Anthropic API isn't reachable: %s", err),
+			Hint:    "Check the network access of the server to api.anthropic.com, and the egress section.",
+		}
 	}
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status code: %d, body: %s, request: %s", resp.StatusCode, string(body), jsonBody)
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &models.SetupError{
+			Problem: "The Anthropic API key is rejected",
+			Hint:    "Create a new key in the Anthropic Console, and set it as the apiKey of the llm section.",
+		}
+	case http.StatusNotFound:
+		return &models.SetupError{
+			Problem: fmt.Sprintf("The Anthropic model %s doesn't exist", a.model),
+			Hint:    "Set the model of the llm section to one of the models listed in the Anthropic documentation.",
+		}
 	}
-
-	return resp, nil
+	return fmt.Errorf("unexpected status code from the Anthropic API: %d", status)
 }
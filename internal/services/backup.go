@@ -0,0 +1,317 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LocalBackupDestination stores the backups of the store as files of a local directory.
+type LocalBackupDestination struct {
+	dir string
+}
+
+// S3BackupConfig configures an S3BackupDestination.
+type S3BackupConfig struct {
+	// Endpoint is the URL of the S3-compatible service, like https://s3.us-east-1.amazonaws.com, or the one
+	// of MinIO or Cloudflare R2. The bucket is addressed in the path of the requests.
+	Endpoint string
+	// Region is the region the requests are signed for, "us-east-1" if empty, which most of the
+	// S3-compatible services accept.
+	Region string
+	Bucket string
+	// Prefix is prepended to the names of the backups to get their object keys, like "backups/".
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is the token of the temporary credentials, if they are.
+	SessionToken string
+}
+
+// S3BackupDestination stores the backups of the store as objects of an S3-compatible bucket, with requests
+// signed with AWS Signature Version 4.
+type S3BackupDestination struct {
+	cfg    S3BackupConfig
+	client *http.Client
+}
+
+// s3UnsignedPayload is the payload hash of the signed requests, whose bodies aren't hashed as the backups
+// are streamed.
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// NewLocalBackupDestination creates a LocalBackupDestination writing to dir, which is created if it doesn't
+// exist.
+func NewLocalBackupDestination(dir string) (LocalBackupDestination, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return LocalBackupDestination{}, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	return LocalBackupDestination{dir: dir}, nil
+}
+
+// Put writes r to the file name, through a temporary file renamed once complete, so a failed backup
+// doesn't leave a truncated file.
+func (l LocalBackupDestination) Put(_ context.Context, name string, r io.Reader, _ int64) error {
+	f, err := os.CreateTemp(l.dir, "."+name+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("failed to write backup file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("failed to close backup file: %w", err)
+	}
+	if err := os.Rename(f.Name(), filepath.Join(l.dir, name)); err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("failed to rename backup file: %w", err)
+	}
+	return nil
+}
+
+// List returns the names of the files of the directory, except the temporary files of Put.
+func (l LocalBackupDestination) List(context.Context) ([]string, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// Delete removes the file name. Deleting a file that doesn't exist is not an error.
+func (l LocalBackupDestination) Delete(_ context.Context, name string) error {
+	if err := os.Remove(filepath.Join(l.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete backup file: %w", err)
+	}
+	return nil
+}
+
+// NewS3BackupDestination creates an S3BackupDestination of the bucket of cfg. The endpoint, the bucket and
+// the credentials are required.
+func NewS3BackupDestination(cfg S3BackupConfig) (S3BackupDestination, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" || cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return S3BackupDestination{}, errors.New("endpoint, bucket, access key ID and secret access key are required")
+	}
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return S3BackupDestination{}, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return S3BackupDestination{cfg: cfg, client: &http.Client{Timeout: 30 * time.Minute}}, nil
+}
+
+// Put uploads r as the object of name, with a single PutObject request.
+func (s S3BackupDestination) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	req, err := s.request(ctx, http.MethodPut, s.cfg.Prefix+name, nil, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/gzip")
+	_, err = s.do(req)
+	return err
+}
+
+// List returns the names of the objects under the prefix, without it.
+func (s S3BackupDestination) List(ctx context.Context) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.request(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		body, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var res struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(body, &res); err != nil {
+			return nil, fmt.Errorf("failed to decode list of objects: %w", err)
+		}
+		for _, c := range res.Contents {
+			// The objects in the "subdirectories" of the prefix aren't backups.
+			if name := strings.TrimPrefix(c.Key, s.cfg.Prefix); !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// Delete deletes the object of name. Deleting an object that doesn't exist is not an error.
+func (s S3BackupDestination) Delete(ctx context.Context, name string) error {
+	req, err := s.request(ctx, http.MethodDelete, s.cfg.Prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	_, err = s.do(req)
+	return err
+}
+
+// request creates a signed request of the object of key, or of the bucket if key is empty.
+func (s S3BackupDestination) request(
+	ctx context.Context,
+	method, key string,
+	query url.Values,
+	body io.Reader,
+) (*http.Request, error) {
+	path := "/" + s3URIEncode(s.cfg.Bucket, false)
+	if key != "" {
+		path += "/" + s3URIEncode(key, true)
+	}
+	rawQuery := s3CanonicalQuery(query)
+	u := s.cfg.Endpoint + path
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	s.sign(req, path, rawQuery, time.Now().UTC())
+	return req, nil
+}
+
+func (s S3BackupDestination) do(req *http.Request) ([]byte, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, body[:min(len(body), 1024)])
+	}
+	return body, nil
+}
+
+// sign signs req with AWS Signature Version 4 for the S3 service, its canonical URI being path and its
+// canonical query string rawQuery.
+func (s S3BackupDestination) sign(req *http.Request, path, rawQuery string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.cfg.SessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+	slices.Sort(signedHeaders)
+
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		rawQuery,
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hash[:])}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+s.cfg.SecretAccessKey), date)
+	key = s3HMAC(key, s.cfg.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// s3URIEncode encodes s like the canonical requests of AWS Signature Version 4, escaping every byte but the
+// unreserved characters, and the slashes if keepSlash is false.
+func s3URIEncode(s string, keepSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			sb.WriteByte(b)
+		case b == '/' && keepSlash:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+// s3CanonicalQuery returns the query string of query sorted and encoded like the canonical requests.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3URIEncode(k, false)+"="+s3URIEncode(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -1,15 +1,16 @@
 package services
 
 import (
-	"cmp"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"slices"
-	"strconv"
-	"strings"
+	"time"
 
 	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -17,24 +18,59 @@ import (
 // messages. It provides atomic operations for managing chat histories and their associated messages
 // through a key-value storage model.
 type BoltDB struct {
-	db *bolt.DB
+	db *boltConn
+
+	encryptionKey []byte
+	cipher        boltCipher
 }
 
+// BoltDBOption configures the optional features of BoltDB.
+type BoltDBOption func(*BoltDB)
+
 // NewBoltDB creates a new BoltDB instance with the specified file path. It initializes the database
 // with required buckets and returns an error if the database cannot be opened or initialized. The
 // database file is created with 0600 permissions if it doesn't exist.
-func NewBoltDB(path string) (BoltDB, error) {
+func NewBoltDB(path string, options ...BoltDBOption) (BoltDB, error) {
+	b := BoltDB{}
+	for _, opt := range options {
+		opt(&b)
+	}
+
+	var err error
+	if b.cipher, err = newBoltCipher(b.encryptionKey); err != nil {
+		return BoltDB{}, err
+	}
+
 	db, err := bolt.Open(path, 0600, nil)
 	if err != nil {
 		return BoltDB{}, fmt.Errorf("failed to open bolt db: %w", err)
 	}
+	b.db = &boltConn{db: db, path: path}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("chats"))
-		return err
+	err = b.db.Update(context.Background(), func(tx *bolt.Tx) error {
+		buckets := []string{
+			"chats", "usages", "schedules", "schedule-runs", "api-tokens", "sessions", "memories", "read-receipts",
+			"audit", "mcp-servers", "spends",
+		}
+		for _, bucket := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		if err := b.cipher.migrateSchema(tx, path); err != nil {
+			return fmt.Errorf("failed to migrate schema: %w", err)
+		}
+		if b.cipher.aead != nil {
+			return b.cipher.encryptRecords(tx)
+		}
+		return nil
 	})
+	if err != nil {
+		_ = db.Close()
+		return BoltDB{}, err
+	}
 
-	return BoltDB{db: db}, err
+	return b, nil
 }
 
 func messageBucketName(chatID string) []byte {
@@ -43,114 +79,176 @@ func messageBucketName(chatID string) []byte {
 
 // Chats retrieves all stored chat records from the database in reverse chronological order. It
 // returns a slice of Chat models or an error if the database operation fails.
-func (b BoltDB) Chats(context.Context) ([]models.Chat, error) {
+func (b BoltDB) Chats(ctx context.Context) ([]models.Chat, error) {
+	c := b.cipher
 	var chats []models.Chat
-	err := b.db.View(func(tx *bolt.Tx) error {
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("chats"))
 		if b == nil {
 			return nil
 		}
 
-		return b.ForEach(func(_, v []byte) error {
+		cur := b.Cursor()
+		for k, v := cur.Last(); k != nil; k, v = cur.Prev() {
 			var chat models.Chat
-			if err := json.Unmarshal(v, &chat); err != nil {
+			if err := c.unmarshal([]byte("chats"), k, v, &chat); err != nil {
 				return fmt.Errorf("failed to unmarshal chat: %w", err)
 			}
 			chats = append(chats, chat)
-			return nil
-		})
+		}
+		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	slices.SortFunc(chats, func(a, b models.Chat) int {
-		aID := 0
-		bID := 0
-
-		aIDArr := strings.Split(a.ID, "-")
-		if len(aIDArr) > 1 {
-			aID, _ = strconv.Atoi(aIDArr[0])
-		}
-		bIDArr := strings.Split(b.ID, "-")
-		if len(bIDArr) > 1 {
-			bID, _ = strconv.Atoi(bIDArr[0])
-		}
-
-		return cmp.Compare(bID, aID)
-	})
 	return chats, nil
 }
 
 // AddChat stores a new chat record in the database and creates an associated message bucket. It
 // generates a unique ID for the chat by combining a sequence number with the chat's original ID,
 // and returns the new ID or an error if the operation fails.
-func (b BoltDB) AddChat(_ context.Context, chat models.Chat) (string, error) {
+func (b BoltDB) AddChat(ctx context.Context, chat models.Chat) (string, error) {
 	var newID string
-	err := b.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("chats"))
-		if b == nil {
-			return nil
-		}
+	err := b.db.Update(ctx, func(tx *bolt.Tx) error {
+		var err error
+		newID, err = b.addChat(tx, chat)
+		return err
+	})
 
-		idPrefix, err := b.NextSequence()
-		if err != nil {
-			return fmt.Errorf("failed to get next sequence: %w", err)
-		}
-		newID = fmt.Sprintf("%d-%s", idPrefix, chat.ID)
-		chat.ID = newID
+	if err != nil {
+		return "", err
+	}
+	return newID, nil
+}
 
-		_, err = tx.CreateBucketIfNotExists(messageBucketName(chat.ID))
-		if err != nil {
-			return fmt.Errorf("failed to create message bucket: %w", err)
+// CopyChat stores a new chat like AddChat, with a copy of the messages of the chat of chatID, in a single
+// transaction. The copied messages get new IDs, and keep their order, timestamps and threads. It returns
+// the ID of the new chat, or an error if the chat of chatID doesn't exist.
+func (b BoltDB) CopyChat(ctx context.Context, chatID string, chat models.Chat) (string, error) {
+	c := b.cipher
+	var newID string
+	err := b.db.Update(ctx, func(tx *bolt.Tx) error {
+		src := tx.Bucket(messageBucketName(chatID))
+		if src == nil {
+			return fmt.Errorf("chat %s not found", chatID)
 		}
 
-		v, err := json.Marshal(chat)
+		var err error
+		newID, err = b.addChat(tx, chat)
 		if err != nil {
-			return fmt.Errorf("failed to marshal chat: %w", err)
+			return err
 		}
+		dst := tx.Bucket(messageBucketName(newID))
+		if dst == nil {
+			return nil
+		}
+
+		newIDs := make(map[string]string)
+		return src.ForEach(func(k, v []byte) error {
+			var message models.Message
+			if err := c.unmarshal(messageBucketName(chatID), k, v, &message); err != nil {
+				return fmt.Errorf("failed to unmarshal message: %w", err)
+			}
+			idPrefix, err := dst.NextSequence()
+			if err != nil {
+				return fmt.Errorf("failed to get next sequence: %w", err)
+			}
+			// The IDs of the messages are unique across the chats, as they name the SSE topics of the messages.
+			newIDs[message.ID] = fmt.Sprintf("%d-%s", idPrefix, uuid.New().String())
+			message.ID = newIDs[message.ID]
+			// A parent precedes its replies.
+			if message.ParentID != "" {
+				message.ParentID = newIDs[message.ParentID]
+			}
 
-		return b.Put([]byte(newID), v)
+			key := recordKey(message.ID)
+			v, err = c.marshal(messageBucketName(newID), key, message)
+			if err != nil {
+				return fmt.Errorf("failed to marshal message: %w", err)
+			}
+			if err := dst.Put(key, v); err != nil {
+				return err
+			}
+			return putTimestamp(tx, newID, message.Timestamp, key)
+		})
 	})
 
-	return newID, err
+	if err != nil {
+		return "", err
+	}
+	return newID, nil
+}
+
+// addChat stores chat with a new ID in tx, with its message buckets, and returns the new ID.
+func (b BoltDB) addChat(tx *bolt.Tx, chat models.Chat) (string, error) {
+	chats := tx.Bucket([]byte("chats"))
+	if chats == nil {
+		return "", nil
+	}
+
+	idPrefix, err := chats.NextSequence()
+	if err != nil {
+		return "", fmt.Errorf("failed to get next sequence: %w", err)
+	}
+	chat.ID = fmt.Sprintf("%d-%s", idPrefix, chat.ID)
+
+	_, err = tx.CreateBucketIfNotExists(messageBucketName(chat.ID))
+	if err != nil {
+		return "", fmt.Errorf("failed to create message bucket: %w", err)
+	}
+	_, err = tx.CreateBucketIfNotExists(timestampsBucket(chat.ID))
+	if err != nil {
+		return "", fmt.Errorf("failed to create timestamps bucket: %w", err)
+	}
+
+	key := recordKey(chat.ID)
+	v, err := b.cipher.marshal([]byte("chats"), key, chat)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal chat: %w", err)
+	}
+
+	return chat.ID, chats.Put(key, v)
 }
 
 // UpdateChat modifies an existing chat record in the database. If the chat doesn't exist, the
 // operation is silently ignored. Returns an error if the marshaling or database operation fails.
-func (b BoltDB) UpdateChat(_ context.Context, chat models.Chat) error {
-	return b.db.Update(func(tx *bolt.Tx) error {
+func (b BoltDB) UpdateChat(ctx context.Context, chat models.Chat) error {
+	c := b.cipher
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("chats"))
 		if b == nil {
 			return nil
 		}
 
-		v := b.Get([]byte(chat.ID))
+		key := recordKey(chat.ID)
+		v := b.Get(key)
 		if v == nil {
 			return nil
 		}
 
-		v, err := json.Marshal(chat)
+		v, err := c.marshal([]byte("chats"), key, chat)
 		if err != nil {
 			return fmt.Errorf("failed to marshal chat: %w", err)
 		}
 
-		return b.Put([]byte(chat.ID), v)
+		return b.Put(key, v)
 	})
 }
 
 // Messages retrieves all messages associated with the specified chat ID. It returns the messages
-// in their stored order or an error if the database operation fails.
-func (b BoltDB) Messages(_ context.Context, chatID string) ([]models.Message, error) {
+// in the order they were added or an error if the database operation fails.
+func (b BoltDB) Messages(ctx context.Context, chatID string) ([]models.Message, error) {
+	c := b.cipher
 	var messages []models.Message
-	err := b.db.View(func(tx *bolt.Tx) error {
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(messageBucketName(chatID))
 		if b == nil {
 			return nil
 		}
 
-		return b.ForEach(func(_, v []byte) error {
+		return b.ForEach(func(k, v []byte) error {
 			var message models.Message
-			if err := json.Unmarshal(v, &message); err != nil {
+			if err := c.unmarshal(messageBucketName(chatID), k, v, &message); err != nil {
 				return fmt.Errorf("failed to unmarshal message: %w", err)
 			}
 			messages = append(messages, message)
@@ -160,30 +258,90 @@ func (b BoltDB) Messages(_ context.Context, chatID string) ([]models.Message, er
 	if err != nil {
 		return nil, err
 	}
-	slices.SortFunc(messages, func(a, b models.Message) int {
-		aID := 0
-		bID := 0
+	return messages, nil
+}
+
+// MessagePath retrieves the path of the message of messageID in the specified chat, the transcript of the
+// message: its ancestors, from the main line of the chat and its thread, and the message itself. It returns
+// an error if the message doesn't exist.
+func (b BoltDB) MessagePath(ctx context.Context, chatID, messageID string) ([]models.Message, error) {
+	messages, err := b.Messages(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	path := models.MessagePath(messages, messageID)
+	if path == nil {
+		return nil, fmt.Errorf("message %s not found", messageID)
+	}
+	return path, nil
+}
 
-		aIDArr := strings.Split(a.ID, "-")
-		if len(aIDArr) > 1 {
-			aID, _ = strconv.Atoi(aIDArr[0])
+// ChatStats aggregates the statistics of the messages of the specified chat, in a single read transaction
+// without keeping the messages. The stats of a chat that doesn't exist are empty.
+func (b BoltDB) ChatStats(ctx context.Context, chatID string) (models.ChatStats, error) {
+	c := b.cipher
+	var stats models.ChatStats
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(messageBucketName(chatID))
+		if b == nil {
+			return nil
 		}
-		bIDArr := strings.Split(b.ID, "-")
-		if len(bIDArr) > 1 {
-			bID, _ = strconv.Atoi(bIDArr[0])
+
+		return b.ForEach(func(k, v []byte) error {
+			var message models.Message
+			if err := c.unmarshal(messageBucketName(chatID), k, v, &message); err != nil {
+				return fmt.Errorf("failed to unmarshal message: %w", err)
+			}
+			stats.Add(message)
+			return nil
+		})
+	})
+	if err != nil {
+		return models.ChatStats{}, err
+	}
+	return stats, nil
+}
+
+// MessagesSince retrieves the messages of the specified chat with a timestamp at or after since, sorted
+// by their timestamps, using the timestamps index of the chat.
+func (b BoltDB) MessagesSince(ctx context.Context, chatID string, since time.Time) ([]models.Message, error) {
+	c := b.cipher
+	var messages []models.Message
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(messageBucketName(chatID))
+		index := tx.Bucket(timestampsBucket(chatID))
+		if b == nil || index == nil {
+			return nil
 		}
 
-		return cmp.Compare(aID, bID)
+		cur := index.Cursor()
+		for k, _ := cur.Seek(timestampSeekKey(since)); k != nil; k, _ = cur.Next() {
+			v := b.Get(k[8:])
+			if v == nil {
+				continue
+			}
+			var message models.Message
+			if err := c.unmarshal(messageBucketName(chatID), k[8:], v, &message); err != nil {
+				return fmt.Errorf("failed to unmarshal message: %w", err)
+			}
+			messages = append(messages, message)
+		}
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 	return messages, nil
 }
 
 // AddMessage stores a new message in the specified chat's message bucket. It generates a unique
 // ID for the message by combining a sequence number with the message's original ID, and returns
-// the new ID or an error if the operation fails.
-func (b BoltDB) AddMessage(_ context.Context, chatID string, message models.Message) (string, error) {
+// the new ID or an error if the operation fails. The timestamp of the message is stored in UTC.
+func (b BoltDB) AddMessage(ctx context.Context, chatID string, message models.Message) (string, error) {
+	message.Timestamp = message.Timestamp.UTC()
+	c := b.cipher
 	var newID string
-	err := b.db.Update(func(tx *bolt.Tx) error {
+	err := b.db.Update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(messageBucketName(chatID))
 		if b == nil {
 			return nil
@@ -196,34 +354,853 @@ func (b BoltDB) AddMessage(_ context.Context, chatID string, message models.Mess
 		newID = fmt.Sprintf("%d-%s", idPrefix, message.ID)
 		message.ID = fmt.Sprintf("%d-%s", idPrefix, message.ID)
 
-		v, err := json.Marshal(message)
+		key := recordKey(newID)
+		v, err := c.marshal(messageBucketName(chatID), key, message)
 		if err != nil {
 			return fmt.Errorf("failed to marshal message: %w", err)
 		}
 
-		return b.Put([]byte(newID), v)
+		if err := b.Put(key, v); err != nil {
+			return err
+		}
+		return putTimestamp(tx, chatID, message.Timestamp, key)
 	})
 
-	return newID, err
+	if err != nil {
+		return "", err
+	}
+	return newID, nil
 }
 
 // UpdateMessage modifies an existing message in the specified chat's message bucket. If the
 // message doesn't exist, the operation is silently ignored. Returns an error if the marshaling
 // or database operation fails.
-func (b BoltDB) UpdateMessage(_ context.Context, chatID string, message models.Message) error {
-	return b.db.Update(func(tx *bolt.Tx) error {
+func (b BoltDB) UpdateMessage(ctx context.Context, chatID string, message models.Message) error {
+	message.Timestamp = message.Timestamp.UTC()
+	c := b.cipher
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(messageBucketName(chatID))
 		if b == nil {
 			return nil
 		}
 
-		msgID := message.ID
+		key := recordKey(message.ID)
+		if old := b.Get(key); old != nil {
+			var oldMessage models.Message
+			if err := c.unmarshal(messageBucketName(chatID), key, old, &oldMessage); err != nil {
+				return fmt.Errorf("failed to unmarshal message: %w", err)
+			}
+			if err := deleteTimestamp(tx, chatID, oldMessage.Timestamp, key); err != nil {
+				return err
+			}
+		}
 
-		v, err := json.Marshal(message)
+		v, err := c.marshal(messageBucketName(chatID), key, message)
 		if err != nil {
 			return fmt.Errorf("failed to marshal message: %w", err)
 		}
 
-		return b.Put([]byte(msgID), v)
+		if err := b.Put(key, v); err != nil {
+			return err
+		}
+		return putTimestamp(tx, chatID, message.Timestamp, key)
+	})
+}
+
+// DeleteChat removes the chat record, all of its messages and the read receipts of the chat. Deleting a
+// chat that doesn't exist is not an error.
+func (b BoltDB) DeleteChat(ctx context.Context, chatID string) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(messageBucketName(chatID)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return fmt.Errorf("failed to delete message bucket: %w", err)
+		}
+		if err := tx.DeleteBucket(timestampsBucket(chatID)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return fmt.Errorf("failed to delete timestamps bucket: %w", err)
+		}
+		if err := deleteReadReceipts(tx, chatID); err != nil {
+			return err
+		}
+
+		b := tx.Bucket([]byte("chats"))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(recordKey(chatID))
+	})
+}
+
+func usageKey(userID, day string) []byte {
+	return []byte(fmt.Sprintf("%s/%s", day, userID))
+}
+
+// Usage retrieves the usage counters of the specified user in the specified day. It returns an empty
+// usage if the user has no usage recorded in that day.
+func (b BoltDB) Usage(ctx context.Context, userID, day string) (models.Usage, error) {
+	usage := models.Usage{
+		UserID: userID,
+		Day:    day,
+	}
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("usages"))
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get(usageKey(userID, day))
+		if v == nil {
+			return nil
+		}
+
+		if err := json.Unmarshal(v, &usage); err != nil {
+			return fmt.Errorf("failed to unmarshal usage: %w", err)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return models.Usage{}, err
+	}
+	return usage, nil
+}
+
+// Usages retrieves the usage counters of all users in the specified day, sorted by the user ID.
+func (b BoltDB) Usages(ctx context.Context, day string) ([]models.Usage, error) {
+	var usages []models.Usage
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("usages"))
+		if b == nil {
+			return nil
+		}
+
+		prefix := []byte(day + "/")
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var usage models.Usage
+			if err := json.Unmarshal(v, &usage); err != nil {
+				return fmt.Errorf("failed to unmarshal usage: %w", err)
+			}
+			usages = append(usages, usage)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return usages, nil
+}
+
+// UserUsages retrieves the usage counters of the specified user in all the days, sorted by the day.
+func (b BoltDB) UserUsages(ctx context.Context, userID string) ([]models.Usage, error) {
+	var usages []models.Usage
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("usages"))
+		if b == nil {
+			return nil
+		}
+
+		suffix := []byte("/" + userID)
+		return b.ForEach(func(k, v []byte) error {
+			if !bytes.HasSuffix(k, suffix) {
+				return nil
+			}
+			var usage models.Usage
+			if err := json.Unmarshal(v, &usage); err != nil {
+				return fmt.Errorf("failed to unmarshal usage: %w", err)
+			}
+			// The IDs of the users may contain the separator of the keys.
+			if usage.UserID == userID {
+				usages = append(usages, usage)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return usages, nil
+}
+
+// AddUsage increments the usage counters of the usage's user and day by the counters of the given usage,
+// in a single transaction.
+func (b BoltDB) AddUsage(ctx context.Context, usage models.Usage) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("usages"))
+		if b == nil {
+			return nil
+		}
+
+		key := usageKey(usage.UserID, usage.Day)
+		current := models.Usage{
+			UserID: usage.UserID,
+			Day:    usage.Day,
+		}
+		if v := b.Get(key); v != nil {
+			if err := json.Unmarshal(v, &current); err != nil {
+				return fmt.Errorf("failed to unmarshal usage: %w", err)
+			}
+		}
+		current.Messages += usage.Messages
+		current.Tokens += usage.Tokens
+
+		v, err := json.Marshal(current)
+		if err != nil {
+			return fmt.Errorf("failed to marshal usage: %w", err)
+		}
+
+		return b.Put(key, v)
+	})
+}
+
+// Spends retrieves the daily spends of the specified provider in the specified month, in the "2006-01"
+// format, sorted by the day.
+func (b BoltDB) Spends(ctx context.Context, provider, month string) ([]models.Spend, error) {
+	var spends []models.Spend
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("spends"))
+		if b == nil {
+			return nil
+		}
+
+		prefix := []byte(provider + "/" + month + "-")
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var spend models.Spend
+			if err := json.Unmarshal(v, &spend); err != nil {
+				return fmt.Errorf("failed to unmarshal spend: %w", err)
+			}
+			spends = append(spends, spend)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return spends, nil
+}
+
+// AddSpend increments the spend of the specified provider in the specified day by the given tokens and cost.
+func (b BoltDB) AddSpend(ctx context.Context, spend models.Spend) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("spends"))
+		if b == nil {
+			return nil
+		}
+
+		key := []byte(spend.Provider + "/" + spend.Day)
+		current := models.Spend{
+			Provider: spend.Provider,
+			Day:      spend.Day,
+		}
+		if v := b.Get(key); v != nil {
+			if err := json.Unmarshal(v, &current); err != nil {
+				return fmt.Errorf("failed to unmarshal spend: %w", err)
+			}
+		}
+		current.InputTokens += spend.InputTokens
+		current.OutputTokens += spend.OutputTokens
+		current.Cost += spend.Cost
+
+		v, err := json.Marshal(current)
+		if err != nil {
+			return fmt.Errorf("failed to marshal spend: %w", err)
+		}
+
+		return b.Put(key, v)
+	})
+}
+
+// Schedules retrieves the persisted state of all scheduled prompts.
+func (b BoltDB) Schedules(ctx context.Context) ([]models.Schedule, error) {
+	var schedules []models.Schedule
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("schedules"))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(_, v []byte) error {
+			var schedule models.Schedule
+			if err := json.Unmarshal(v, &schedule); err != nil {
+				return fmt.Errorf("failed to unmarshal schedule: %w", err)
+			}
+			schedules = append(schedules, schedule)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// SaveSchedule stores the state of a scheduled prompt, replacing the existing state with the same name.
+func (b BoltDB) SaveSchedule(ctx context.Context, schedule models.Schedule) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("schedules"))
+		if b == nil {
+			return nil
+		}
+
+		v, err := json.Marshal(schedule)
+		if err != nil {
+			return fmt.Errorf("failed to marshal schedule: %w", err)
+		}
+
+		return b.Put([]byte(schedule.Name), v)
+	})
+}
+
+// ScheduleRuns retrieves the run history of the specified scheduled prompt, most recent first.
+func (b BoltDB) ScheduleRuns(ctx context.Context, scheduleName string) ([]models.ScheduleRun, error) {
+	var runs []models.ScheduleRun
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("schedule-runs"))
+		if b == nil {
+			return nil
+		}
+
+		prefix := []byte(scheduleName + "/")
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var run models.ScheduleRun
+			if err := json.Unmarshal(v, &run); err != nil {
+				return fmt.Errorf("failed to unmarshal schedule run: %w", err)
+			}
+			runs = append(runs, run)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Reverse(runs)
+	return runs, nil
+}
+
+// AddScheduleRun appends a run to the run history of its scheduled prompt.
+func (b BoltDB) AddScheduleRun(ctx context.Context, run models.ScheduleRun) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("schedule-runs"))
+		if b == nil {
+			return nil
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return fmt.Errorf("failed to get next sequence: %w", err)
+		}
+
+		v, err := json.Marshal(run)
+		if err != nil {
+			return fmt.Errorf("failed to marshal schedule run: %w", err)
+		}
+
+		// The sequence is zero-padded, so the runs of a schedule are iterated in the order they were added.
+		return b.Put([]byte(fmt.Sprintf("%s/%020d", run.ScheduleName, seq)), v)
+	})
+}
+
+// APITokens retrieves the API tokens of the specified user, in the order they were created.
+func (b BoltDB) APITokens(ctx context.Context, userID string) ([]models.APIToken, error) {
+	var tokens []models.APIToken
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("api-tokens"))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(_, v []byte) error {
+			var token models.APIToken
+			if err := json.Unmarshal(v, &token); err != nil {
+				return fmt.Errorf("failed to unmarshal api token: %w", err)
+			}
+			if token.UserID == userID {
+				tokens = append(tokens, token)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(tokens, func(a, b models.APIToken) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return tokens, nil
+}
+
+// APITokenByHash retrieves the API token with the specified hash. It returns a zero APIToken if there is
+// no such token.
+func (b BoltDB) APITokenByHash(ctx context.Context, hash string) (models.APIToken, error) {
+	var token models.APIToken
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("api-tokens"))
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get([]byte(hash))
+		if v == nil {
+			return nil
+		}
+		if err := json.Unmarshal(v, &token); err != nil {
+			return fmt.Errorf("failed to unmarshal api token: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return models.APIToken{}, err
+	}
+	return token, nil
+}
+
+// AddAPIToken stores a new API token, keyed by its hash.
+func (b BoltDB) AddAPIToken(ctx context.Context, token models.APIToken) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("api-tokens"))
+		if b == nil {
+			return nil
+		}
+
+		v, err := json.Marshal(token)
+		if err != nil {
+			return fmt.Errorf("failed to marshal api token: %w", err)
+		}
+
+		return b.Put([]byte(token.Hash), v)
+	})
+}
+
+// DeleteAPIToken removes the API token with the specified ID, if it belongs to the specified user.
+// Deleting a token that doesn't exist is not an error.
+func (b BoltDB) DeleteAPIToken(ctx context.Context, userID, tokenID string) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("api-tokens"))
+		if b == nil {
+			return nil
+		}
+
+		var hash []byte
+		err := b.ForEach(func(k, v []byte) error {
+			var token models.APIToken
+			if err := json.Unmarshal(v, &token); err != nil {
+				return fmt.Errorf("failed to unmarshal api token: %w", err)
+			}
+			if token.ID == tokenID && token.UserID == userID {
+				hash = bytes.Clone(k)
+			}
+			return nil
+		})
+		if err != nil || hash == nil {
+			return err
+		}
+		return b.Delete(hash)
+	})
+}
+
+// Sessions retrieves the browser sessions of the specified user, in the order they were created.
+func (b BoltDB) Sessions(ctx context.Context, userID string) ([]models.Session, error) {
+	var sessions []models.Session
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("sessions"))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(_, v []byte) error {
+			var session models.Session
+			if err := json.Unmarshal(v, &session); err != nil {
+				return fmt.Errorf("failed to unmarshal session: %w", err)
+			}
+			if session.UserID == userID {
+				sessions = append(sessions, session)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(sessions, func(a, b models.Session) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return sessions, nil
+}
+
+// SessionByHash retrieves the browser session with the specified hash. It returns a zero Session if there is
+// no such session.
+func (b BoltDB) SessionByHash(ctx context.Context, hash string) (models.Session, error) {
+	var session models.Session
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("sessions"))
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get([]byte(hash))
+		if v == nil {
+			return nil
+		}
+		if err := json.Unmarshal(v, &session); err != nil {
+			return fmt.Errorf("failed to unmarshal session: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return models.Session{}, err
+	}
+	return session, nil
+}
+
+// SaveSession stores a browser session, keyed by its hash, replacing the session with the same hash if
+// there is one.
+func (b BoltDB) SaveSession(ctx context.Context, session models.Session) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("sessions"))
+		if b == nil {
+			return nil
+		}
+
+		v, err := json.Marshal(session)
+		if err != nil {
+			return fmt.Errorf("failed to marshal session: %w", err)
+		}
+
+		return b.Put([]byte(session.Hash), v)
+	})
+}
+
+// DeleteSession removes the browser session with the specified ID, if it belongs to the specified user.
+// Deleting a session that doesn't exist is not an error.
+func (b BoltDB) DeleteSession(ctx context.Context, userID, sessionID string) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("sessions"))
+		if b == nil {
+			return nil
+		}
+
+		var hash []byte
+		err := b.ForEach(func(k, v []byte) error {
+			var session models.Session
+			if err := json.Unmarshal(v, &session); err != nil {
+				return fmt.Errorf("failed to unmarshal session: %w", err)
+			}
+			if session.ID == sessionID && session.UserID == userID {
+				hash = bytes.Clone(k)
+			}
+			return nil
+		})
+		if err != nil || hash == nil {
+			return err
+		}
+		return b.Delete(hash)
+	})
+}
+
+func memoryKey(userID, memoryID string) []byte {
+	return []byte(userID + "/" + memoryID)
+}
+
+// Memories retrieves the memories of the specified user, in the order they were created.
+func (b BoltDB) Memories(ctx context.Context, userID string) ([]models.Memory, error) {
+	c := b.cipher
+	var memories []models.Memory
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("memories"))
+		if b == nil {
+			return nil
+		}
+
+		prefix := memoryKey(userID, "")
+		cur := b.Cursor()
+		for k, v := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			var memory models.Memory
+			if err := c.unmarshal([]byte("memories"), k, v, &memory); err != nil {
+				return fmt.Errorf("failed to unmarshal memory: %w", err)
+			}
+			// The IDs of the users may contain the separator of the keys.
+			if memory.UserID == userID {
+				memories = append(memories, memory)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(memories, func(a, b models.Memory) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return memories, nil
+}
+
+// SaveMemory stores a memory, replacing the memory of its user with the same ID if there is one.
+func (b BoltDB) SaveMemory(ctx context.Context, memory models.Memory) error {
+	c := b.cipher
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("memories"))
+		if b == nil {
+			return nil
+		}
+
+		key := memoryKey(memory.UserID, memory.ID)
+		v, err := c.marshal([]byte("memories"), key, memory)
+		if err != nil {
+			return fmt.Errorf("failed to marshal memory: %w", err)
+		}
+		return b.Put(key, v)
+	})
+}
+
+// DeleteMemory removes the memory with the specified ID of the specified user. Deleting a memory that
+// doesn't exist is not an error.
+func (b BoltDB) DeleteMemory(ctx context.Context, userID, memoryID string) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("memories"))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(memoryKey(userID, memoryID))
+	})
+}
+
+func readReceiptKey(userID, chatID string) []byte {
+	return []byte(userID + "/" + chatID)
+}
+
+// deleteReadReceipts removes the read receipts of all the users for the chat of chatID.
+func deleteReadReceipts(tx *bolt.Tx, chatID string) error {
+	b := tx.Bucket([]byte("read-receipts"))
+	if b == nil {
+		return nil
+	}
+
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if !bytes.HasSuffix(k, []byte("/"+chatID)) {
+			return nil
+		}
+		var receipt models.ReadReceipt
+		if err := json.Unmarshal(v, &receipt); err != nil {
+			return fmt.Errorf("failed to unmarshal read receipt: %w", err)
+		}
+		if receipt.ChatID == chatID {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The keys are deleted after the iteration, as deleting them while iterating skips some.
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return fmt.Errorf("failed to delete read receipt: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReadReceipts retrieves the read receipts of the specified user, one per chat the user has read.
+func (b BoltDB) ReadReceipts(ctx context.Context, userID string) ([]models.ReadReceipt, error) {
+	var receipts []models.ReadReceipt
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("read-receipts"))
+		if b == nil {
+			return nil
+		}
+
+		prefix := readReceiptKey(userID, "")
+		cur := b.Cursor()
+		for k, v := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			var receipt models.ReadReceipt
+			if err := json.Unmarshal(v, &receipt); err != nil {
+				return fmt.Errorf("failed to unmarshal read receipt: %w", err)
+			}
+			// The IDs of the users may contain the separator of the keys.
+			if receipt.UserID == userID {
+				receipts = append(receipts, receipt)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+// SaveReadReceipt stores a read receipt, replacing the receipt of its user for its chat if there is one.
+func (b BoltDB) SaveReadReceipt(ctx context.Context, receipt models.ReadReceipt) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("read-receipts"))
+		if b == nil {
+			return nil
+		}
+
+		v, err := json.Marshal(receipt)
+		if err != nil {
+			return fmt.Errorf("failed to marshal read receipt: %w", err)
+		}
+		return b.Put(readReceiptKey(receipt.UserID, receipt.ChatID), v)
+	})
+}
+
+// DeleteUserData removes the usage counters, API tokens, sessions, memories and read receipts of the
+// specified user, in a single transaction. The chats of the user are deleted with DeleteChat.
+func (b BoltDB) DeleteUserData(ctx context.Context, userID string) error {
+	c := b.cipher
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		decoders := map[string]func(k, v []byte) (string, error){
+			"usages": func(_, v []byte) (string, error) {
+				var usage models.Usage
+				err := json.Unmarshal(v, &usage)
+				return usage.UserID, err
+			},
+			"api-tokens": func(_, v []byte) (string, error) {
+				var token models.APIToken
+				err := json.Unmarshal(v, &token)
+				return token.UserID, err
+			},
+			"sessions": func(_, v []byte) (string, error) {
+				var session models.Session
+				err := json.Unmarshal(v, &session)
+				return session.UserID, err
+			},
+			"memories": func(k, v []byte) (string, error) {
+				var memory models.Memory
+				err := c.unmarshal([]byte("memories"), k, v, &memory)
+				return memory.UserID, err
+			},
+			"read-receipts": func(_, v []byte) (string, error) {
+				var receipt models.ReadReceipt
+				err := json.Unmarshal(v, &receipt)
+				return receipt.UserID, err
+			},
+		}
+		for name, decode := range decoders {
+			if err := deleteUserRecords(tx.Bucket([]byte(name)), userID, decode); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// deleteUserRecords removes the records of bucket whose user, given by decode, is userID.
+func deleteUserRecords(bucket *bolt.Bucket, userID string, decode func(k, v []byte) (string, error)) error {
+	if bucket == nil {
+		return nil
+	}
+
+	var keys [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		recordUserID, err := decode(k, v)
+		if err != nil {
+			return err
+		}
+		if recordUserID == userID {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The keys are deleted after the iteration, as deleting them while iterating skips some.
+	for _, k := range keys {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuditEntries retrieves all the audit entries, the newest first.
+func (b BoltDB) AuditEntries(ctx context.Context) ([]models.AuditEntry, error) {
+	var entries []models.AuditEntry
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("audit"))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var entry models.AuditEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("failed to unmarshal audit entry: %w", err)
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// AddAuditEntry stores a new audit entry after the existing ones.
+func (b BoltDB) AddAuditEntry(ctx context.Context, entry models.AuditEntry) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("audit"))
+		if b == nil {
+			return nil
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return fmt.Errorf("failed to get next sequence: %w", err)
+		}
+		v, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal audit entry: %w", err)
+		}
+		// The sequence is zero-padded, so the entries are iterated in the order they were added.
+		return b.Put([]byte(fmt.Sprintf("%020d", seq)), v)
+	})
+}
+
+// MCPServerStates retrieves the states of all the MCP servers, sorted by their key.
+func (b BoltDB) MCPServerStates(ctx context.Context) ([]models.MCPServerState, error) {
+	var states []models.MCPServerState
+	err := b.db.View(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("mcp-servers"))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(_, v []byte) error {
+			var state models.MCPServerState
+			if err := json.Unmarshal(v, &state); err != nil {
+				return fmt.Errorf("failed to unmarshal mcp server state: %w", err)
+			}
+			states = append(states, state)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// SaveMCPServerState stores the state of an MCP server, replacing the state with the same key if there is one.
+func (b BoltDB) SaveMCPServerState(ctx context.Context, state models.MCPServerState) error {
+	return b.db.Update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("mcp-servers"))
+		if b == nil {
+			return nil
+		}
+
+		v, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("failed to marshal mcp server state: %w", err)
+		}
+		return b.Put([]byte(state.Key), v)
 	})
 }
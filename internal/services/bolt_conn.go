@@ -0,0 +1,62 @@
+package services
+
+import (
+	"context"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltConn is the BoltDB database shared by the copies of BoltDB. The database is reopened by Compact,
+// so the transactions hold the read lock to keep it open while they run.
+type boltConn struct {
+	mu   sync.RWMutex
+	db   *bolt.DB
+	path string
+}
+
+// View runs fn in a read transaction, returning the error of ctx if it's done first, like when a slow disk
+// stalls the transaction past the deadline of ctx.
+func (c *boltConn) View(ctx context.Context, fn func(*bolt.Tx) error) error {
+	return c.run(ctx, func() error { return c.db.View(withTxContext(ctx, fn)) })
+}
+
+// Update runs fn in a read-write transaction, returning the error of ctx if it's done first. The transaction
+// is rolled back if ctx is done before fn returns, but a transaction whose ctx is done while it's committed may
+// still be committed.
+func (c *boltConn) Update(ctx context.Context, fn func(*bolt.Tx) error) error {
+	return c.run(ctx, func() error { return c.db.Update(withTxContext(ctx, fn)) })
+}
+
+// run runs tx in its own goroutine, so that the caller returns once ctx is done, while tx finishes in the
+// background. The callers don't read the results of their transaction if it returns an error.
+func (c *boltConn) run(ctx context.Context, tx func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		done <- tx()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withTxContext returns fn, failing the transaction if ctx is done before it starts or by the time fn returns.
+func withTxContext(ctx context.Context, fn func(*bolt.Tx) error) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+}
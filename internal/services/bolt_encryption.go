@@ -0,0 +1,163 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltCipher marshals the chat, message and memory records to JSON, sealed with AES-GCM if the encryption
+// is enabled. The sealed records are marked with a prefix, so the plaintext records written before the
+// encryption was enabled are still readable. The bucket and key of a record are authenticated with it, so a
+// sealed record copied to another key, chat or user doesn't decrypt.
+type boltCipher struct {
+	aead cipher.AEAD
+}
+
+var (
+	encryptedRecordPrefix = []byte("enc2:")
+	// legacyEncryptedRecordPrefix marks the records sealed without their bucket and key, which are still
+	// readable, and are sealed again with them when BoltDB is opened or the records are updated.
+	legacyEncryptedRecordPrefix = []byte("enc1:")
+)
+
+// WithBoltDBEncryptionKey enables the encryption at rest of the chat, message and memory records with
+// AES-GCM, using the given 16, 24 or 32 bytes key for AES-128, AES-192 or AES-256. The existing plaintext
+// records are encrypted when the database is opened.
+func WithBoltDBEncryptionKey(key []byte) BoltDBOption {
+	return func(b *BoltDB) {
+		b.encryptionKey = key
+	}
+}
+
+func newBoltCipher(key []byte) (boltCipher, error) {
+	if len(key) == 0 {
+		return boltCipher{}, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return boltCipher{}, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return boltCipher{}, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return boltCipher{aead: aead}, nil
+}
+
+// recordAAD returns the additional data a record of key in bucket is sealed with.
+func recordAAD(bucket, key []byte) []byte {
+	aad := make([]byte, 0, len(bucket)+1+len(key))
+	aad = append(aad, bucket...)
+	aad = append(aad, 0)
+	return append(aad, key...)
+}
+
+// marshal returns the record of v stored under key in bucket.
+func (c boltCipher) marshal(bucket, key []byte, v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if c.aead == nil {
+		return data, nil
+	}
+	return c.seal(recordAAD(bucket, key), data)
+}
+
+// unmarshal parses the record data stored under key in bucket into v.
+func (c boltCipher) unmarshal(bucket, key, data []byte, v any) error {
+	data, err := c.plaintext(bucket, key, data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// plaintext returns the JSON of the record data stored under key in bucket.
+func (c boltCipher) plaintext(bucket, key, data []byte) ([]byte, error) {
+	var aad []byte
+	switch {
+	case bytes.HasPrefix(data, encryptedRecordPrefix):
+		aad = recordAAD(bucket, key)
+	case bytes.HasPrefix(data, legacyEncryptedRecordPrefix):
+	default:
+		return data, nil
+	}
+	if c.aead == nil {
+		return nil, errors.New("record is encrypted, but no encryption key is configured")
+	}
+	return c.open(aad, data)
+}
+
+func (c boltCipher) seal(aad, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	out := make([]byte, 0, len(encryptedRecordPrefix)+len(nonce)+len(plaintext)+c.aead.Overhead())
+	out = append(out, encryptedRecordPrefix...)
+	out = append(out, nonce...)
+	return c.aead.Seal(out, nonce, plaintext, aad), nil
+}
+
+func (c boltCipher) open(aad, data []byte) ([]byte, error) {
+	// Both prefixes have the same length.
+	data = data[len(encryptedRecordPrefix):]
+	if len(data) < c.aead.NonceSize() {
+		return nil, errors.New("encrypted record is too short")
+	}
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt record, the encryption key may be wrong or the record moved: %w", err)
+	}
+	return plaintext, nil
+}
+
+// encryptRecords seals the chat, message and memory records that are still stored in plaintext, or sealed
+// without their bucket and key.
+func (c boltCipher) encryptRecords(tx *bolt.Tx) error {
+	return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+		if string(name) != "chats" && string(name) != "memories" && !strings.HasPrefix(string(name), "chat-") {
+			return nil
+		}
+
+		// The bucket can't be modified while iterating it, so the records are collected first.
+		plaintexts := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			if bytes.HasPrefix(v, encryptedRecordPrefix) {
+				return nil
+			}
+			plaintext, err := c.plaintext(name, k, v)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt record %s of bucket %s: %w", k, name, err)
+			}
+			plaintexts[string(k)] = bytes.Clone(plaintext)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, v := range plaintexts {
+			sealed, err := c.seal(recordAAD(name, []byte(k)), v)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(k), sealed); err != nil {
+				return fmt.Errorf("failed to put encrypted record: %w", err)
+			}
+		}
+		return nil
+	})
+}
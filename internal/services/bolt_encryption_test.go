@@ -0,0 +1,224 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	testEncryptionKey  = []byte("0123456789abcdef0123456789abcdef")
+	otherEncryptionKey = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func TestBoltCipher(t *testing.T) {
+	c, err := newBoltCipher(testEncryptionKey)
+	if err != nil {
+		t.Fatalf("newBoltCipher() error = %v", err)
+	}
+	other, err := newBoltCipher(otherEncryptionKey)
+	if err != nil {
+		t.Fatalf("newBoltCipher() error = %v", err)
+	}
+	bucket, key := messageBucketName("1-chat"), recordKey("1-msg")
+	chat := models.Chat{ID: "1-chat", Title: "Secret"}
+
+	data, err := c.marshal(bucket, key, chat)
+	if err != nil {
+		t.Fatalf("marshal() error = %v", err)
+	}
+	if !bytes.HasPrefix(data, encryptedRecordPrefix) || bytes.Contains(data, []byte("Secret")) {
+		t.Errorf("marshal() = %q, want a sealed record", data)
+	}
+	var got models.Chat
+	if err := c.unmarshal(bucket, key, data, &got); err != nil || got.Title != chat.Title {
+		t.Errorf("unmarshal() = %v, %v, want %v", got, err, chat)
+	}
+
+	plaintext, err := json.Marshal(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.unmarshal(bucket, key, plaintext, &got); err != nil || got.Title != chat.Title {
+		t.Errorf("unmarshal() of a plaintext record = %v, %v, want %v", got, err, chat)
+	}
+	if err := c.unmarshal(bucket, key, legacySeal(t, c, plaintext), &got); err != nil || got.Title != chat.Title {
+		t.Errorf("unmarshal() of a legacy sealed record = %v, %v, want %v", got, err, chat)
+	}
+
+	failures := []struct {
+		name   string
+		c      boltCipher
+		bucket []byte
+		key    []byte
+	}{
+		{"wrong key", other, bucket, key},
+		{"missing key", boltCipher{}, bucket, key},
+		{"other record key", c, bucket, recordKey("2-msg")},
+		{"other chat", c, messageBucketName("2-chat"), key},
+		{"other bucket", c, []byte("memories"), key},
+	}
+	for _, tt := range failures {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.unmarshal(tt.bucket, tt.key, data, &got); err == nil {
+				t.Error("unmarshal() should return an error")
+			}
+		})
+	}
+}
+
+func TestBoltDBEncryption(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.db")
+
+	b := openTestBoltDB(t, path, WithBoltDBEncryptionKey(testEncryptionKey))
+	chatID, err := b.AddChat(ctx, models.Chat{ID: "chat", Title: "Secret title"})
+	if err != nil {
+		t.Fatalf("AddChat() error = %v", err)
+	}
+	if _, err := b.AddMessage(ctx, chatID, models.Message{ID: "msg", Role: models.RoleUser}); err != nil {
+		t.Fatalf("AddMessage() error = %v", err)
+	}
+	otherID, err := b.AddChat(ctx, models.Chat{ID: "other", Title: "Other title"})
+	if err != nil {
+		t.Fatalf("AddChat() error = %v", err)
+	}
+	if err := b.SaveMemory(ctx, models.Memory{ID: "m1", UserID: "alice", Text: "Secret memory"}); err != nil {
+		t.Fatalf("SaveMemory() error = %v", err)
+	}
+	chats, err := b.Chats(ctx)
+	if err != nil || len(chats) != 2 || chats[1].Title != "Secret title" {
+		t.Errorf("Chats() = %v, %v, want the decrypted chats", chats, err)
+	}
+	memories, err := b.Memories(ctx, "alice")
+	if err != nil || len(memories) != 1 || memories[0].Text != "Secret memory" {
+		t.Errorf("Memories() = %v, %v, want the decrypted memory", memories, err)
+	}
+	err = b.db.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			return bucket.ForEach(func(k, v []byte) error {
+				if bytes.Contains(v, []byte("Secret")) {
+					t.Errorf("record %s of bucket %s is stored in plaintext: %q", k, name, v)
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.db.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, options := range map[string][]BoltDBOption{
+		"wrong key":   {WithBoltDBEncryptionKey(otherEncryptionKey)},
+		"missing key": nil,
+	} {
+		b := openTestBoltDB(t, path, options...)
+		if _, err := b.Chats(ctx); err == nil {
+			t.Errorf("Chats() with the %s should return an error", name)
+		}
+		if _, err := b.Messages(ctx, chatID); err == nil {
+			t.Errorf("Messages() with the %s should return an error", name)
+		}
+		if err := b.db.db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A sealed message copied to another chat doesn't decrypt.
+	b = openTestBoltDB(t, path, WithBoltDBEncryptionKey(testEncryptionKey))
+	err = b.db.db.Update(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(messageBucketName(chatID)).Cursor().First()
+		return tx.Bucket(messageBucketName(otherID)).Put(k, bytes.Clone(v))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Messages(ctx, otherID); err == nil {
+		t.Error("Messages() of a message copied from another chat should return an error")
+	}
+	if messages, err := b.Messages(ctx, chatID); err != nil || len(messages) != 1 {
+		t.Errorf("Messages() of the original chat = %v, %v, want the message", messages, err)
+	}
+}
+
+func TestBoltDBEncryptionLegacyRecords(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.db")
+	c, err := newBoltCipher(testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The plaintext records written before the encryption was enabled, and the records sealed without their
+	// bucket and key.
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		chats, err := tx.CreateBucket([]byte("chats"))
+		if err != nil {
+			return err
+		}
+		if err := putJSON(chats, string(recordKey("1-plain")), models.Chat{ID: "1-plain", Title: "Plain"}); err != nil {
+			return err
+		}
+		data, err := json.Marshal(models.Chat{ID: "2-legacy", Title: "Legacy"})
+		if err != nil {
+			return err
+		}
+		if err := chats.Put(recordKey("2-legacy"), legacySeal(t, c, data)); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucket(metaBucketName)
+		if err != nil {
+			return err
+		}
+		return meta.Put(schemaVersionKey, []byte(strconv.Itoa(len(boltMigrations))))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := openTestBoltDB(t, path, WithBoltDBEncryptionKey(testEncryptionKey))
+	chats, err := b.Chats(ctx)
+	if err != nil {
+		t.Fatalf("Chats() error = %v", err)
+	}
+	if got := chatIDsOf(chats); len(got) != 2 || got[0] != "2-legacy" || got[1] != "1-plain" {
+		t.Errorf("Chats() = %v, want the legacy and plaintext chats", got)
+	}
+	err = b.db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("chats")).ForEach(func(k, v []byte) error {
+			if !bytes.HasPrefix(v, encryptedRecordPrefix) {
+				t.Errorf("chat %s = %q, want it sealed with its key on open", k, v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// legacySeal seals plaintext like the versions before the records were sealed with their bucket and key.
+func legacySeal(t *testing.T, c boltCipher, plaintext []byte) []byte {
+	t.Helper()
+	sealed, err := c.seal(nil, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(bytes.Clone(legacyEncryptedRecordPrefix), bytes.TrimPrefix(sealed, encryptedRecordPrefix)...)
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+const timestampsBucketName = "timestamps-"
+
+// recordKey returns the bucket key of a chat or message ID. The IDs are prefixed with the sequence number
+// of their bucket, which is zero-padded in the key, so the keys are sorted in the order the records were
+// added, regardless of the number of digits of the sequence.
+func recordKey(id string) []byte {
+	seq, rest, ok := strings.Cut(id, "-")
+	if !ok {
+		return []byte(id)
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return []byte(id)
+	}
+	return []byte(fmt.Sprintf("%020d-%s", n, rest))
+}
+
+func timestampsBucket(chatID string) []byte {
+	return []byte(timestampsBucketName + chatID)
+}
+
+// timestampKey returns the key of a message in the timestamps index of its chat, which is the message's
+// timestamp as big-endian nanoseconds followed by the message's key, so the index is sorted by timestamp,
+// then by the order the messages were added.
+func timestampKey(ts time.Time, msgKey []byte) []byte {
+	return append(timestampSeekKey(ts), msgKey...)
+}
+
+// timestampSeekKey returns the prefix of the timestamps index keys of ts. The timestamps before the Unix
+// epoch, like the zero time, are all indexed as the epoch.
+func timestampSeekKey(ts time.Time) []byte {
+	var nanos uint64
+	if ts.After(time.Unix(0, 0)) {
+		nanos = uint64(ts.UnixNano())
+	}
+	return binary.BigEndian.AppendUint64(nil, nanos)
+}
+
+func putTimestamp(tx *bolt.Tx, chatID string, ts time.Time, msgKey []byte) error {
+	index, err := tx.CreateBucketIfNotExists(timestampsBucket(chatID))
+	if err != nil {
+		return fmt.Errorf("failed to create timestamps bucket: %w", err)
+	}
+	return index.Put(timestampKey(ts, msgKey), nil)
+}
+
+func deleteTimestamp(tx *bolt.Tx, chatID string, ts time.Time, msgKey []byte) error {
+	index := tx.Bucket(timestampsBucket(chatID))
+	if index == nil {
+		return nil
+	}
+	return index.Delete(timestampKey(ts, msgKey))
+}
+
+// rekeyBucket replaces the keys of the bucket's records with their recordKey. The records predate the
+// sealing of the records with their key, so they're moved as they are.
+func rekeyBucket(bucket *bolt.Bucket) error {
+	if bucket == nil {
+		return nil
+	}
+
+	// The bucket can't be modified while iterating it, so the records are collected first.
+	type record struct{ key, value []byte }
+	var stale []record
+	err := bucket.ForEach(func(k, v []byte) error {
+		if !bytes.Equal(k, recordKey(string(k))) {
+			stale = append(stale, record{key: bytes.Clone(k), value: bytes.Clone(v)})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range stale {
+		if err := bucket.Delete(r.key); err != nil {
+			return err
+		}
+		if err := bucket.Put(recordKey(string(r.key)), r.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c boltCipher) indexTimestamps(tx *bolt.Tx, chatID string, msgs *bolt.Bucket) error {
+	index, err := tx.CreateBucketIfNotExists(timestampsBucket(chatID))
+	if err != nil {
+		return err
+	}
+	return msgs.ForEach(func(k, v []byte) error {
+		var message models.Message
+		if err := c.unmarshal(messageBucketName(chatID), k, v, &message); err != nil {
+			return fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		return index.Put(timestampKey(message.Timestamp, k), nil)
+	})
+}
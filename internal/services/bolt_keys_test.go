@@ -0,0 +1,215 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+// recordCount is beyond 9 records, whose unpadded keys sorted the 10th record before the 9th.
+const recordCount = 12
+
+func TestBoltDBRecordOrder(t *testing.T) {
+	ctx := context.Background()
+	b := openTestBoltDB(t, filepath.Join(t.TempDir(), "store.db"))
+
+	var chatIDs []string
+	for i := range recordCount {
+		id, err := b.AddChat(ctx, models.Chat{ID: fmt.Sprintf("chat%d", i), Title: fmt.Sprintf("Chat %d", i)})
+		if err != nil {
+			t.Fatalf("AddChat() error = %v", err)
+		}
+		chatIDs = append(chatIDs, id)
+	}
+	chats, err := b.Chats(ctx)
+	if err != nil {
+		t.Fatalf("Chats() error = %v", err)
+	}
+	slices.Reverse(chatIDs)
+	if got := chatIDsOf(chats); !slices.Equal(got, chatIDs) {
+		t.Errorf("Chats() = %v, want the newest first %v", got, chatIDs)
+	}
+
+	// The messages are added with decreasing timestamps, so the order they were added in and the order of
+	// their timestamps are reversed.
+	chatID := chatIDs[0]
+	base := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	var msgIDs []string
+	for i := range recordCount {
+		id, err := b.AddMessage(ctx, chatID, models.Message{
+			ID:        fmt.Sprintf("msg%d", i),
+			Role:      models.RoleUser,
+			Timestamp: base.Add(time.Duration(recordCount-i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("AddMessage() error = %v", err)
+		}
+		msgIDs = append(msgIDs, id)
+	}
+	messages, err := b.Messages(ctx, chatID)
+	if err != nil {
+		t.Fatalf("Messages() error = %v", err)
+	}
+	if got := messageIDsOf(messages); !slices.Equal(got, msgIDs) {
+		t.Errorf("Messages() = %v, want the order they were added %v", got, msgIDs)
+	}
+
+	since, err := b.MessagesSince(ctx, chatID, base.Add(3*time.Minute))
+	if err != nil {
+		t.Fatalf("MessagesSince() error = %v", err)
+	}
+	want := slices.Clone(msgIDs[:recordCount-2])
+	slices.Reverse(want)
+	if got := messageIDsOf(since); !slices.Equal(got, want) {
+		t.Errorf("MessagesSince() = %v, want the messages from the 3rd minute by timestamp %v", got, want)
+	}
+}
+
+func TestBoltDBRecordKeyMigration(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.db")
+	base := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	// The database of the versions before the schema versioning, with the "<seq>-<uuid>" keys, without the
+	// meta bucket and the timestamps index.
+	legacy, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chatIDs []string
+	err = legacy.Update(func(tx *bolt.Tx) error {
+		chats, err := tx.CreateBucket([]byte("chats"))
+		if err != nil {
+			return err
+		}
+		for i := 1; i <= recordCount; i++ {
+			chat := models.Chat{ID: fmt.Sprintf("%d-chat", i)}
+			if err := putJSON(chats, chat.ID, chat); err != nil {
+				return err
+			}
+			chatIDs = append(chatIDs, chat.ID)
+		}
+		msgs, err := tx.CreateBucket(messageBucketName(chatIDs[0]))
+		if err != nil {
+			return err
+		}
+		for i := 1; i <= recordCount; i++ {
+			msg := models.Message{
+				ID:        fmt.Sprintf("%d-msg", i),
+				Role:      models.RoleUser,
+				Timestamp: base.Add(time.Duration(recordCount-i) * time.Minute),
+			}
+			if err := putJSON(msgs, msg.ID, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := legacy.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := openTestBoltDB(t, path)
+	chats, err := b.Chats(ctx)
+	if err != nil {
+		t.Fatalf("Chats() error = %v", err)
+	}
+	slices.Reverse(chatIDs)
+	if got := chatIDsOf(chats); !slices.Equal(got, chatIDs) {
+		t.Errorf("Chats() after the migration = %v, want the newest first %v", got, chatIDs)
+	}
+	messages, err := b.Messages(ctx, chatIDs[recordCount-1])
+	if err != nil {
+		t.Fatalf("Messages() error = %v", err)
+	}
+	var want []string
+	for i := 1; i <= recordCount; i++ {
+		want = append(want, fmt.Sprintf("%d-msg", i))
+	}
+	if got := messageIDsOf(messages); !slices.Equal(got, want) {
+		t.Errorf("Messages() after the migration = %v, want the order they were added %v", got, want)
+	}
+
+	since, err := b.MessagesSince(ctx, chatIDs[recordCount-1], time.Time{})
+	if err != nil {
+		t.Fatalf("MessagesSince() error = %v", err)
+	}
+	slices.Reverse(want)
+	if got := messageIDsOf(since); !slices.Equal(got, want) {
+		t.Errorf("MessagesSince() after the migration = %v, want the messages by timestamp %v", got, want)
+	}
+
+	err = b.db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("chats")).ForEach(func(k, _ []byte) error {
+			if len(k) != len("00000000000000000001-chat") {
+				t.Errorf("chat key %q isn't zero-padded", k)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordKey(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"9-abc", "00000000000000000009-abc"},
+		{"10-abc", "00000000000000000010-abc"},
+		{"1-a-b", "00000000000000000001-a-b"},
+		{"abc", "abc"},
+		{"x-abc", "x-abc"},
+	}
+	for _, tt := range tests {
+		if got := string(recordKey(tt.id)); got != tt.want {
+			t.Errorf("recordKey(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func openTestBoltDB(t *testing.T, path string, options ...BoltDBOption) BoltDB {
+	t.Helper()
+	b, err := NewBoltDB(path, options...)
+	if err != nil {
+		t.Fatalf("NewBoltDB() error = %v", err)
+	}
+	t.Cleanup(func() { _ = b.db.db.Close() })
+	return b
+}
+
+func putJSON(bucket *bolt.Bucket, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), data)
+}
+
+func chatIDsOf(chats []models.Chat) []string {
+	ids := make([]string, len(chats))
+	for i, c := range chats {
+		ids[i] = c.ID
+	}
+	return ids
+}
+
+func messageIDsOf(messages []models.Message) []string {
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	return ids
+}
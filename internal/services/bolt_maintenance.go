@@ -0,0 +1,122 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactTxMaxSize is the size of the data copied in a single transaction while compacting.
+const compactTxMaxSize = 64 << 20
+
+// The maintenance operations run to completion, ignoring the cancellation of their context, as they're not
+// bounded by the timeouts of the other operations.
+
+// Compact reclaims the free pages left by the deleted records, as BoltDB never shrinks its file. The
+// records are copied into a temporary file that atomically replaces the database file, blocking the other
+// operations until it's done.
+func (b BoltDB) Compact(context.Context) error {
+	c := b.db
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmpPath := c.path + ".compact"
+	dst, err := bolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return fmt.Errorf("failed to open compaction file: %w", err)
+	}
+	if err := bolt.Compact(dst, c.db, compactTxMaxSize); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to compact bolt db: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to close compaction file: %w", err)
+	}
+
+	if err := c.db.Close(); err != nil {
+		return fmt.Errorf("failed to close bolt db: %w", err)
+	}
+	// The database is reopened even if the rename fails, the original file is intact in that case.
+	renameErr := os.Rename(tmpPath, c.path)
+	db, err := bolt.Open(c.path, 0600, nil)
+	if err != nil {
+		return fmt.Errorf("failed to reopen bolt db: %w", err)
+	}
+	c.db = db
+	if renameErr != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace bolt db file: %w", renameErr)
+	}
+	return nil
+}
+
+// CheckIntegrity verifies the consistency of the database pages, returning all the inconsistencies found
+// joined in a single error.
+func (b BoltDB) CheckIntegrity(context.Context) error {
+	var errs []error
+	err := b.db.View(context.Background(), func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			errs = append(errs, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// DeleteOrphanedMessages deletes the message buckets whose chat record no longer exists, e.g. when the
+// record was removed with an external tool, and returns the number of deleted buckets.
+func (b BoltDB) DeleteOrphanedMessages(context.Context) (int, error) {
+	deleted := 0
+	err := b.db.Update(context.Background(), func(tx *bolt.Tx) error {
+		chats := tx.Bucket([]byte("chats"))
+		if chats == nil {
+			return nil
+		}
+
+		// The buckets can't be deleted while iterating them, so the orphans are collected first.
+		var orphans [][]byte
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			chatID, ok := bytes.CutPrefix(name, []byte("chat-"))
+			if !ok {
+				chatID, ok = bytes.CutPrefix(name, []byte(timestampsBucketName))
+			}
+			if ok && chats.Get(recordKey(string(chatID))) == nil {
+				orphans = append(orphans, bytes.Clone(name))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range orphans {
+			if err := tx.DeleteBucket(name); err != nil {
+				return fmt.Errorf("failed to delete bucket %s: %w", name, err)
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// Snapshot writes a consistent copy of the database file to w, in a read transaction, so the other
+// operations continue while it's written. The records of an encrypted store stay encrypted in the copy.
+func (b BoltDB) Snapshot(_ context.Context, w io.Writer) error {
+	return b.db.View(context.Background(), func(tx *bolt.Tx) error {
+		if _, err := tx.WriteTo(w); err != nil {
+			return fmt.Errorf("failed to write snapshot: %w", err)
+		}
+		return nil
+	})
+}
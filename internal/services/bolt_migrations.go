@@ -0,0 +1,100 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltTx is the transaction the BoltDB migrations run in, with the cipher to read and write the encrypted
+// records.
+type boltTx struct {
+	*bolt.Tx
+	cipher boltCipher
+}
+
+var (
+	metaBucketName   = []byte("meta")
+	schemaVersionKey = []byte("schemaVersion")
+)
+
+// boltMigrations are the schema migrations of BoltDB. New migrations are appended with the next version.
+var boltMigrations = []migration[boltTx]{
+	{
+		version:     1,
+		description: "zero-padded record keys and timestamps index",
+		up:          migrateRecordKeys,
+	},
+}
+
+// migrateSchema upgrades the schema of a database written by an older version. If there are migrations
+// to apply to existing data, the database is copied to path.bak-v<version> before, with the version it's
+// upgraded from.
+func (c boltCipher) migrateSchema(tx *bolt.Tx, path string) error {
+	meta, err := tx.CreateBucketIfNotExists(metaBucketName)
+	if err != nil {
+		return err
+	}
+	current := 0
+	if v := meta.Get(schemaVersionKey); v != nil {
+		if current, err = strconv.Atoi(string(v)); err != nil {
+			return fmt.Errorf("invalid schema version %q: %w", v, err)
+		}
+	}
+	if current == len(boltMigrations) {
+		return nil
+	}
+
+	if current < len(boltMigrations) && hasChats(tx) {
+		backupPath := fmt.Sprintf("%s.bak-v%d", path, current)
+		if err := tx.CopyFile(backupPath, 0600); err != nil {
+			return fmt.Errorf("failed to back up database before migration: %w", err)
+		}
+	}
+
+	version, err := runMigrations(boltTx{Tx: tx, cipher: c}, current, boltMigrations)
+	if err != nil {
+		return err
+	}
+	return meta.Put(schemaVersionKey, []byte(strconv.Itoa(version)))
+}
+
+func hasChats(tx *bolt.Tx) bool {
+	chats := tx.Bucket([]byte("chats"))
+	if chats == nil {
+		return false
+	}
+	k, _ := chats.Cursor().First()
+	return k != nil
+}
+
+// migrateRecordKeys replaces the keys of the chats and messages with their zero-padded recordKey, and
+// builds the timestamps index of the messages.
+func migrateRecordKeys(tx boltTx) error {
+	if err := rekeyBucket(tx.Bucket([]byte("chats"))); err != nil {
+		return fmt.Errorf("failed to migrate chat keys: %w", err)
+	}
+
+	var chatIDs []string
+	err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if chatID, ok := bytes.CutPrefix(name, []byte("chat-")); ok {
+			chatIDs = append(chatIDs, string(chatID))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, chatID := range chatIDs {
+		msgs := tx.Bucket(messageBucketName(chatID))
+		if err := rekeyBucket(msgs); err != nil {
+			return fmt.Errorf("failed to migrate message keys of chat %s: %w", chatID, err)
+		}
+		if err := tx.cipher.indexTimestamps(tx.Tx, chatID, msgs); err != nil {
+			return fmt.Errorf("failed to index messages of chat %s: %w", chatID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// CassetteMode is the mode of a Cassette.
+type CassetteMode string
+
+const (
+	// CassetteRecord sends the requests, and records their responses.
+	CassetteRecord CassetteMode = "record"
+	// CassetteReplay replays the recorded responses without sending the requests, failing the requests
+	// that weren't recorded.
+	CassetteReplay CassetteMode = "replay"
+	// CassetteAuto replays the recorded responses, and records the responses of the requests that weren't
+	// recorded yet.
+	CassetteAuto CassetteMode = "auto"
+)
+
+// Cassette is an http.RoundTripper recording the responses of the LLM providers to a directory, and replaying
+// them, so the chats can be run offline and deterministically in tests. The recordings are keyed by the hash
+// of the request's method, URL and body, and are written once the response body has been read completely,
+// which keeps the streamed responses streaming while they are recorded. The request headers, which carry
+// the API keys, aren't part of the key and aren't recorded.
+type Cassette struct {
+	dir       string
+	mode      CassetteMode
+	transport http.RoundTripper
+
+	mu sync.Mutex
+}
+
+// cassetteTransport sends the requests through a Cassette with another transport than its own.
+type cassetteTransport struct {
+	cassette  *Cassette
+	transport http.RoundTripper
+}
+
+type cassetteRecord struct {
+	Request  cassetteRequest  `json:"request"`
+	Response cassetteResponse `json:"response"`
+}
+
+type cassetteRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body"`
+}
+
+type cassetteResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+}
+
+type cassetteBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	done func([]byte) error
+}
+
+// cassetteHeaders are the response headers kept in the recordings.
+var cassetteHeaders = []string{"Content-Type"}
+
+// NewCassette creates a Cassette recording to and replaying from dir, which is created if it doesn't
+// exist. The requests are sent with transport, or http.DefaultTransport if it's nil.
+func NewCassette(dir string, mode CassetteMode, transport http.RoundTripper) (*Cassette, error) {
+	switch mode {
+	case CassetteRecord, CassetteReplay, CassetteAuto:
+	default:
+		return nil, fmt.Errorf("unknown cassette mode: %s", mode)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cassette directory: %w", err)
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Cassette{
+		dir:       dir,
+		mode:      mode,
+		transport: transport,
+	}, nil
+}
+
+// Client returns an http.Client sending its requests through the cassette.
+func (c *Cassette) Client() *http.Client {
+	return &http.Client{Transport: c}
+}
+
+// Wrap returns a copy of client sending its requests through the cassette, which sends them with the
+// transport of client instead of its own.
+func (c *Cassette) Wrap(client *http.Client) *http.Client {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	wrapped := *client
+	wrapped.Transport = cassetteTransport{cassette: c, transport: transport}
+	return &wrapped
+}
+
+// RoundTrip implements http.RoundTripper.
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.roundTrip(req, c.transport)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.cassette.roundTrip(req, t.transport)
+}
+
+func (c *Cassette) roundTrip(req *http.Request, transport http.RoundTripper) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	cr := cassetteRequest{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Body:   string(body),
+	}
+	path := filepath.Join(c.dir, cassetteKey(cr)+".json")
+
+	if c.mode != CassetteRecord {
+		res, err := c.replay(req, path)
+		if err == nil {
+			return res, nil
+		}
+		if c.mode == CassetteReplay || !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to replay %s %s: %w", cr.Method, cr.URL, err)
+		}
+	}
+
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	for _, h := range cassetteHeaders {
+		if v := res.Header.Values(h); len(v) > 0 {
+			header[h] = v
+		}
+	}
+	res.Body = &cassetteBody{
+		ReadCloser: res.Body,
+		done: func(b []byte) error {
+			return c.write(path, cassetteRecord{
+				Request: cr,
+				Response: cassetteResponse{
+					StatusCode: res.StatusCode,
+					Header:     header,
+					Body:       string(b),
+				},
+			})
+		},
+	}
+	return res, nil
+}
+
+func (c *Cassette) replay(req *http.Request, path string) (*http.Response, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec cassetteRecord
+	if err := json.Unmarshal(bs, &rec); err != nil {
+		return nil, fmt.Errorf("failed to parse recording %s: %w", path, err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.Response.StatusCode, http.StatusText(rec.Response.StatusCode)),
+		StatusCode:    rec.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Response.Header,
+		Body:          io.NopCloser(strings.NewReader(rec.Response.Body)),
+		ContentLength: int64(len(rec.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+func (c *Cassette) write(path string, rec cassetteRecord) error {
+	bs, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal recording: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0o600); err != nil {
+		return fmt.Errorf("failed to write recording: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write recording: %w", err)
+	}
+	return nil
+}
+
+func cassetteKey(req cassetteRequest) string {
+	h := sha256.New()
+	h.Write([]byte(req.Method + "\n" + req.URL + "\n"))
+	h.Write([]byte(req.Body))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Read tees the response body into the recording, which is written once the body is read to the end. The
+// responses that aren't read completely, such as the cancelled streams, aren't recorded.
+func (b *cassetteBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if errors.Is(err, io.EOF) && b.done != nil {
+		done := b.done
+		b.done = nil
+		if werr := done(b.buf.Bytes()); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
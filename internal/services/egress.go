@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// EgressPolicy restricts the hosts the HTTP clients of the LLM providers and the SSE MCP servers connect to,
+// for the deployments whose outbound traffic is locked down. It's enforced by the dialer of the clients,
+// which checks the address actually connected to, so a host name resolving to a denied address is denied
+// too. The proxy of a client must be allowed, and the hosts of the requests sent through it are checked
+// before they're sent, by their names only as the proxy resolves them.
+type EgressPolicy struct {
+	hosts       []string
+	prefixes    []netip.Prefix
+	denyPrivate bool
+}
+
+// egressTransport checks the hosts of the requests sent through the proxy of transport.
+type egressTransport struct {
+	policy    *EgressPolicy
+	transport *http.Transport
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ErrEgressDenied is returned when the EgressPolicy denies connecting to a host.
+var ErrEgressDenied = errors.New("denied by the egress policy")
+
+// cgnatPrefix is the shared address space of the carrier-grade NATs, which isn't reported as private by
+// net.IP.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// NewEgressPolicy creates an EgressPolicy allowing the hosts of allowedHosts, every host if it's empty.
+// An allowed host is a host name, a wildcard like *.example.com matching the subdomains of example.com, an IP
+// address or a CIDR range. If denyPrivate is true, the loopback, private, link-local and unspecified
+// addresses are denied, unless they're in an allowed IP address or range.
+func NewEgressPolicy(allowedHosts []string, denyPrivate bool) (*EgressPolicy, error) {
+	p := &EgressPolicy{denyPrivate: denyPrivate}
+	for _, host := range allowedHosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		switch {
+		case host == "":
+			return nil, errors.New("empty allowed host")
+		case strings.Contains(host, "/"):
+			prefix, err := netip.ParsePrefix(host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed range %s: %w", host, err)
+			}
+			p.prefixes = append(p.prefixes, prefix.Masked())
+		default:
+			if addr, err := netip.ParseAddr(host); err == nil {
+				p.prefixes = append(p.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+				continue
+			}
+			if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+				return nil, fmt.Errorf("invalid allowed host %s: only a leading *. wildcard is supported", host)
+			}
+			p.hosts = append(p.hosts, host)
+		}
+	}
+	return p, nil
+}
+
+// WithEgressPolicy restricts the hosts the provider connects to with policy, its HTTP client being
+// replaced by a copy enforcing it.
+func WithEgressPolicy(policy *EgressPolicy) ProviderOption {
+	return func(o *providerOptions) {
+		o.egressPolicy = policy
+	}
+}
+
+// Client returns a copy of client enforcing the policy. The transport of client must be an http.Transport,
+// or a transport of a client created by NewHTTPClient, which dialer is wrapped. Other transports are replaced
+// by a clone of http.DefaultTransport.
+func (p *EgressPolicy) Client(client *http.Client) *http.Client {
+	wrapped := *client
+	wrapped.Transport = p.roundTripper(client.Transport)
+	return &wrapped
+}
+
+func (p *EgressPolicy) roundTripper(rt http.RoundTripper) http.RoundTripper {
+	switch t := rt.(type) {
+	case readTimeoutTransport:
+		t.transport = p.roundTripper(t.transport)
+		return t
+	case egressTransport:
+		// The dialer of t keeps enforcing its own policy.
+		return p.transport(t.transport)
+	case *http.Transport:
+		return p.transport(t)
+	default:
+		return p.transport(http.DefaultTransport.(*http.Transport))
+	}
+}
+
+func (p *EgressPolicy) transport(t *http.Transport) egressTransport {
+	t = t.Clone()
+	dial := dialFunc(t.DialContext)
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = p.dialContext(dial)
+	return egressTransport{policy: p, transport: t}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.transport.Proxy != nil {
+		proxyURL, err := t.transport.Proxy(req)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL != nil {
+			if err := t.policy.checkProxied(req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// dialContext returns dial checking the address it connected to. The connection is closed before anything
+// is sent if the address is denied.
+func (p *EgressPolicy) dialContext(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		remote, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to parse the address of %s: %w", host, err)
+		}
+		if err := p.check(host, remote.Addr().Unmap()); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// check returns ErrEgressDenied if host, connected to at addr, is denied.
+func (p *EgressPolicy) check(host string, addr netip.Addr) error {
+	inPrefixes := p.inPrefixes(addr)
+	if len(p.hosts) > 0 || len(p.prefixes) > 0 {
+		if !inPrefixes && !p.allowsName(host) {
+			return fmt.Errorf("connecting to %s (%s): %w", host, addr, ErrEgressDenied)
+		}
+	}
+	if p.denyPrivate && !inPrefixes && isPrivateAddr(addr) {
+		return fmt.Errorf("connecting to the private address %s of %s: %w", addr, host, ErrEgressDenied)
+	}
+	return nil
+}
+
+// checkProxied returns ErrEgressDenied if host, which is reached through a proxy, is denied.
+func (p *EgressPolicy) checkProxied(host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.check(host, addr.Unmap())
+	}
+	if (len(p.hosts) > 0 || len(p.prefixes) > 0) && !p.allowsName(host) {
+		return fmt.Errorf("connecting to %s through the proxy: %w", host, ErrEgressDenied)
+	}
+	return nil
+}
+
+func (p *EgressPolicy) allowsName(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.hosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+			continue
+		}
+		if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *EgressPolicy) inPrefixes(addr netip.Addr) bool {
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPrivateAddr(addr netip.Addr) bool {
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsUnspecified() || cgnatPrefix.Contains(addr)
+}
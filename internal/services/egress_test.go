@@ -0,0 +1,181 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewEgressPolicy(t *testing.T) {
+	p, err := NewEgressPolicy([]string{
+		" API.OpenAI.com ", "*.example.com", "10.1.2.3", "::ffff:192.0.2.1", "192.168.0.0/16", "10.8.1.7/16",
+	}, true)
+	if err != nil {
+		t.Fatalf("NewEgressPolicy() error = %v", err)
+	}
+	if want := []string{"api.openai.com", "*.example.com"}; !slices.Equal(p.hosts, want) {
+		t.Errorf("hosts = %v, want %v", p.hosts, want)
+	}
+	wantPrefixes := []netip.Prefix{
+		netip.MustParsePrefix("10.1.2.3/32"),
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("10.8.0.0/16"),
+	}
+	if !slices.Equal(p.prefixes, wantPrefixes) {
+		t.Errorf("prefixes = %v, want %v", p.prefixes, wantPrefixes)
+	}
+	if !p.denyPrivate {
+		t.Error("denyPrivate = false, want true")
+	}
+
+	for _, host := range []string{"", "  ", "10.0.0.0/33", "example.com/8", "api.*.com", "**.example.com"} {
+		if _, err := NewEgressPolicy([]string{host}, false); err == nil {
+			t.Errorf("NewEgressPolicy(%q) should return an error", host)
+		}
+	}
+}
+
+func TestEgressPolicyCheck(t *testing.T) {
+	public := netip.MustParseAddr("203.0.113.10")
+	tests := []struct {
+		name        string
+		allowed     []string
+		denyPrivate bool
+		host        string
+		addr        netip.Addr
+		wantDenied  bool
+	}{
+		{"everything allowed", nil, false, "example.org", public, false},
+		{"private allowed", nil, false, "localhost", netip.MustParseAddr("127.0.0.1"), false},
+		{"exact host", []string{"api.example.com"}, false, "api.example.com", public, false},
+		{"exact host case and trailing dot", []string{"api.example.com"}, false, "API.Example.com.", public, false},
+		{"other host", []string{"api.example.com"}, false, "www.example.com", public, true},
+		{"wildcard subdomain", []string{"*.example.com"}, false, "api.example.com", public, false},
+		{"wildcard nested subdomain", []string{"*.example.com"}, false, "a.b.example.com", public, false},
+		{"wildcard apex", []string{"*.example.com"}, false, "example.com", public, true},
+		{"wildcard suffix", []string{"*.example.com"}, false, "badexample.com", public, true},
+		{"allowed address", []string{"203.0.113.10"}, false, "anything.test", public, false},
+		{"allowed range", []string{"203.0.113.0/24"}, false, "anything.test", public, false},
+		{"address out of range", []string{"198.51.100.0/24"}, false, "anything.test", public, true},
+		{"loopback", nil, true, "localhost", netip.MustParseAddr("127.0.0.1"), true},
+		{"ipv6 loopback", nil, true, "localhost", netip.MustParseAddr("::1"), true},
+		{"rfc 1918 10/8", nil, true, "internal", netip.MustParseAddr("10.0.0.5"), true},
+		{"rfc 1918 172.16/12", nil, true, "internal", netip.MustParseAddr("172.20.1.1"), true},
+		{"rfc 1918 192.168/16", nil, true, "internal", netip.MustParseAddr("192.168.1.1"), true},
+		{"metadata service", nil, true, "metadata", netip.MustParseAddr("169.254.169.254"), true},
+		{"cgnat", nil, true, "carrier", netip.MustParseAddr("100.64.0.1"), true},
+		{"unspecified", nil, true, "zero", netip.MustParseAddr("0.0.0.0"), true},
+		{"public with private denied", nil, true, "example.org", public, false},
+		{"private of an allowed host", []string{"internal.test"}, true, "internal.test",
+			netip.MustParseAddr("10.0.0.5"), true},
+		{"private in an allowed range", []string{"10.0.0.0/8"}, true, "internal",
+			netip.MustParseAddr("10.0.0.5"), false},
+		{"allowed loopback address", []string{"127.0.0.1"}, true, "localhost",
+			netip.MustParseAddr("127.0.0.1"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewEgressPolicy(tt.allowed, tt.denyPrivate)
+			if err != nil {
+				t.Fatalf("NewEgressPolicy() error = %v", err)
+			}
+			err = p.check(tt.host, tt.addr)
+			if denied := errors.Is(err, ErrEgressDenied); denied != tt.wantDenied {
+				t.Errorf("check(%q, %s) = %v, want denied %t", tt.host, tt.addr, err, tt.wantDenied)
+			}
+		})
+	}
+}
+
+func TestEgressPolicyCheckProxied(t *testing.T) {
+	p, err := NewEgressPolicy([]string{"*.example.com", "203.0.113.0/24"}, true)
+	if err != nil {
+		t.Fatalf("NewEgressPolicy() error = %v", err)
+	}
+	tests := []struct {
+		host       string
+		wantDenied bool
+	}{
+		{"api.example.com", false},
+		{"example.com", true},
+		{"badexample.com", true},
+		{"203.0.113.10", false},
+		{"198.51.100.1", true},
+		// The names are resolved by the proxy, so only the addresses are checked against denyPrivate.
+		{"10.0.0.5", true},
+	}
+	for _, tt := range tests {
+		err := p.checkProxied(tt.host)
+		if denied := errors.Is(err, ErrEgressDenied); denied != tt.wantDenied {
+			t.Errorf("checkProxied(%q) = %v, want denied %t", tt.host, err, tt.wantDenied)
+		}
+	}
+
+	private, err := NewEgressPolicy(nil, true)
+	if err != nil {
+		t.Fatalf("NewEgressPolicy() error = %v", err)
+	}
+	if err := private.checkProxied("internal.test"); err != nil {
+		t.Errorf("checkProxied() of a name with only the private addresses denied = %v, want allowed", err)
+	}
+	if err := private.checkProxied("127.0.0.1"); !errors.Is(err, ErrEgressDenied) {
+		t.Errorf("checkProxied() of the loopback address = %v, want denied", err)
+	}
+}
+
+func TestEgressPolicyClient(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		requests.Add(1)
+	}))
+	defer srv.Close()
+
+	denied, err := NewEgressPolicy(nil, true)
+	if err != nil {
+		t.Fatalf("NewEgressPolicy() error = %v", err)
+	}
+	if err := egressGet(denied.Client(srv.Client()), srv.URL); !errors.Is(err, ErrEgressDenied) {
+		t.Errorf("GET of the loopback server error = %v, want %v", err, ErrEgressDenied)
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("requests received = %d, want none sent to a denied address", got)
+	}
+
+	allowed, err := NewEgressPolicy([]string{"127.0.0.0/8"}, true)
+	if err != nil {
+		t.Fatalf("NewEgressPolicy() error = %v", err)
+	}
+	if err := egressGet(allowed.Client(srv.Client()), srv.URL); err != nil {
+		t.Errorf("GET of the allowed loopback server error = %v", err)
+	}
+
+	// The hosts of the requests sent through a proxy are checked before they're sent.
+	proxied := srv.Client()
+	proxyURL, _ := url.Parse(srv.URL)
+	proxied.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+	if err := egressGet(allowed.Client(proxied), "http://api.example.com/"); !errors.Is(err, ErrEgressDenied) {
+		t.Errorf("GET through the proxy of a denied host error = %v, want %v", err, ErrEgressDenied)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("requests received = %d, want only the allowed one", got)
+	}
+}
+
+func egressGet(client *http.Client, rawURL string) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
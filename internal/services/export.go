@@ -0,0 +1,97 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+const exportTimeout = 10 * time.Second
+
+// postExport sends the JSON payload of an exported generation to url with the given headers.
+func postExport(ctx context.Context, client *http.Client, url string, headers map[string]string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mcp-web-ui")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	// Drain the body, so the connection can be reused.
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// exportedMessage is the role and the contents of a message, in the shape of the chat messages of the
+// LLM APIs, which is what the observability tools expect.
+type exportedMessage struct {
+	Role      string               `json:"role"`
+	Content   string               `json:"content,omitempty"`
+	ToolCalls []exportedToolCall   `json:"tool_calls,omitempty"`
+	Results   []exportedToolResult `json:"tool_results,omitempty"`
+}
+
+type exportedToolCall struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type exportedToolResult struct {
+	ID     string          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Failed bool            `json:"failed,omitempty"`
+}
+
+func exportMessage(msg models.Message) exportedMessage {
+	em := exportedMessage{Role: string(msg.Role)}
+	for _, c := range msg.Contents {
+		switch c.Type {
+		case models.ContentTypeText:
+			em.Content += c.Text
+		case models.ContentTypeCallTool:
+			em.ToolCalls = append(em.ToolCalls, exportedToolCall{ID: c.CallToolID, Name: c.ToolName, Arguments: c.ToolInput})
+		case models.ContentTypeToolResult:
+			em.Results = append(em.Results, exportedToolResult{
+				ID:     c.CallToolID,
+				Result: c.ToolResult,
+				Failed: c.CallToolFailed,
+			})
+		}
+	}
+	return em
+}
+
+func exportMessages(msgs []models.Message) []exportedMessage {
+	ems := make([]exportedMessage, len(msgs))
+	for i, msg := range msgs {
+		ems[i] = exportMessage(msg)
+	}
+	return ems
+}
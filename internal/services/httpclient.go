@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// HTTPSettings tunes the HTTP client the LLM providers send their requests with. The zero durations take
+// the defaults, so that a wedged connection to a provider fails instead of hanging the generation forever.
+type HTTPSettings struct {
+	// Timeout limits the whole request, including the reading of a streamed response. Zero doesn't limit it,
+	// as the streamed responses of the models can last minutes: the other timeouts catch the wedged ones.
+	Timeout time.Duration
+	// ConnectTimeout limits the connection to the provider, its TLS handshake excluded.
+	ConnectTimeout time.Duration
+	// ResponseHeaderTimeout limits the wait of the response headers once the request is sent.
+	ResponseHeaderTimeout time.Duration
+	// ReadTimeout limits the wait of the next data of a response body, failing a stream that stopped
+	// without ending.
+	ReadTimeout time.Duration
+	// IdleConnTimeout is the time a kept-alive connection stays open without requests.
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost is the number of kept-alive connections to the provider, 2 if it's zero.
+	MaxIdleConnsPerHost int
+	// ProxyURL is the URL of the proxy the requests are sent through. The proxy of the HTTPS_PROXY,
+	// HTTP_PROXY and NO_PROXY environment variables is used if it's empty.
+	ProxyURL string
+	// CAFile is the PEM file of the certificates of the authorities trusted besides the ones of the system,
+	// e.g. for a TLS-intercepting proxy.
+	CAFile string
+}
+
+// readTimeoutTransport fails the responses whose body doesn't receive data for timeout.
+type readTimeoutTransport struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+type readTimeoutBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+const (
+	defaultConnectTimeout        = 30 * time.Second
+	defaultResponseHeaderTimeout = 2 * time.Minute
+	defaultReadTimeout           = 2 * time.Minute
+	defaultIdleConnTimeout       = 90 * time.Second
+)
+
+var errReadTimeout = errors.New("no data received from the provider")
+
+// NewHTTPClient creates the HTTP client of the LLM providers tuned by settings, to be given to them with
+// WithHTTPClient.
+func NewHTTPClient(settings HTTPSettings) (*http.Client, error) {
+	if settings.Timeout < 0 || settings.ConnectTimeout < 0 || settings.ResponseHeaderTimeout < 0 ||
+		settings.ReadTimeout < 0 || settings.IdleConnTimeout < 0 {
+		return nil, errors.New("the timeouts must not be negative")
+	}
+	if settings.MaxIdleConnsPerHost < 0 {
+		return nil, errors.New("the max idle connections per host must not be negative")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   durationOr(settings.ConnectTimeout, defaultConnectTimeout),
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ResponseHeaderTimeout = durationOr(settings.ResponseHeaderTimeout, defaultResponseHeaderTimeout)
+	transport.IdleConnTimeout = durationOr(settings.IdleConnTimeout, defaultIdleConnTimeout)
+	transport.MaxIdleConnsPerHost = settings.MaxIdleConnsPerHost
+
+	if settings.ProxyURL != "" {
+		proxyURL, err := url.Parse(settings.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		if proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy url %q: the scheme and the host are required", settings.ProxyURL)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if settings.CAFile != "" {
+		pem, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ca file %s", settings.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &http.Client{
+		Transport: readTimeoutTransport{
+			transport: transport,
+			timeout:   durationOr(settings.ReadTimeout, defaultReadTimeout),
+		},
+		Timeout: settings.Timeout,
+	}, nil
+}
+
+func durationOr(d, fallback time.Duration) time.Duration {
+	if d == 0 {
+		return fallback
+	}
+	return d
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t readTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	res, err := t.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	body := &readTimeoutBody{
+		ReadCloser: res.Body,
+		ctx:        ctx,
+		cancel:     cancel,
+		timeout:    t.timeout,
+	}
+	body.timer = time.AfterFunc(t.timeout, body.expire)
+	res.Body = body
+	return res, nil
+}
+
+func (b *readTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.timer.Stop()
+		if cause := context.Cause(b.ctx); errors.Is(cause, errReadTimeout) {
+			return n, cause
+		}
+		return n, err
+	}
+	b.timer.Reset(b.timeout)
+	return n, nil
+}
+
+func (b *readTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
+
+func (b *readTimeoutBody) expire() {
+	b.cancel(fmt.Errorf("%w for %s", errReadTimeout, b.timeout))
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// Langfuse implements the GenerationExporter interface by sending the generations to Langfuse, as a trace
+// of the chat turn containing the generation. The exports are asynchronous, so an unavailable Langfuse
+// never blocks the chat.
+type Langfuse struct {
+	host          string
+	authorization string
+
+	client *http.Client
+
+	logger *slog.Logger
+}
+
+type langfuseEvent struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Type      string    `json:"type"`
+	Body      any       `json:"body"`
+}
+
+type langfuseTrace struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	SessionID string            `json:"sessionId"`
+	Timestamp time.Time         `json:"timestamp"`
+	Input     []exportedMessage `json:"input"`
+	Output    exportedMessage   `json:"output"`
+}
+
+type langfuseGeneration struct {
+	ID                  string            `json:"id"`
+	TraceID             string            `json:"traceId"`
+	Name                string            `json:"name"`
+	StartTime           time.Time         `json:"startTime"`
+	EndTime             time.Time         `json:"endTime"`
+	CompletionStartTime *time.Time        `json:"completionStartTime,omitempty"`
+	Model               string            `json:"model,omitempty"`
+	Input               []exportedMessage `json:"input"`
+	Output              exportedMessage   `json:"output"`
+	Usage               langfuseUsage     `json:"usage"`
+	Level               string            `json:"level"`
+	StatusMessage       string            `json:"statusMessage,omitempty"`
+}
+
+type langfuseUsage struct {
+	Input  int    `json:"input"`
+	Output int    `json:"output"`
+	Total  int    `json:"total"`
+	Unit   string `json:"unit"`
+}
+
+// NewLangfuse creates a new Langfuse instance sending the generations to the Langfuse instance at host
+// (e.g. https://cloud.langfuse.com), authenticated with the project's API keys.
+func NewLangfuse(host, publicKey, secretKey string, logger *slog.Logger) Langfuse {
+	return Langfuse{
+		host:          strings.TrimSuffix(host, "/"),
+		authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte(publicKey+":"+secretKey)),
+		client:        &http.Client{Timeout: exportTimeout},
+		logger:        logger.With(slog.String("module", "langfuse")),
+	}
+}
+
+// ExportGeneration sends the generation to Langfuse in the background.
+func (l Langfuse) ExportGeneration(ctx context.Context, g models.Generation) {
+	// The export outlives the caller, but keeps the values of its context for the log records.
+	ctx = context.WithoutCancel(ctx)
+
+	input := exportMessages(g.Prompt)
+	output := exportMessage(g.Response)
+	level := "DEFAULT"
+	if g.Error != "" {
+		level = "ERROR"
+	}
+
+	var completionStart *time.Time
+	if stats := g.Response.Stats; stats != nil {
+		t := g.StartedAt.Add(stats.TimeToFirstToken)
+		completionStart = &t
+	}
+
+	batch := []langfuseEvent{
+		{
+			ID:        uuid.New().String(),
+			Timestamp: g.FinishedAt,
+			Type:      "trace-create",
+			Body: langfuseTrace{
+				ID:        g.ID,
+				Name:      "chat",
+				SessionID: g.ChatID,
+				Timestamp: g.StartedAt,
+				Input:     input,
+				Output:    output,
+			},
+		},
+		{
+			ID:        uuid.New().String(),
+			Timestamp: g.FinishedAt,
+			Type:      "generation-create",
+			Body: langfuseGeneration{
+				ID:                  uuid.New().String(),
+				TraceID:             g.ID,
+				Name:                "generation",
+				StartTime:           g.StartedAt,
+				EndTime:             g.FinishedAt,
+				CompletionStartTime: completionStart,
+				Model:               g.Model,
+				Input:               input,
+				Output:              output,
+				Usage: langfuseUsage{
+					Input:  g.InputTokens,
+					Output: g.OutputTokens,
+					Total:  g.InputTokens + g.OutputTokens,
+					Unit:   "TOKENS",
+				},
+				Level:         level,
+				StatusMessage: g.Error,
+			},
+		},
+	}
+
+	go func() {
+		err := postExport(ctx, l.client, l.host+"/api/public/ingestion",
+			map[string]string{"Authorization": l.authorization},
+			map[string]any{"batch": batch})
+		if err != nil {
+			l.logger.ErrorContext(ctx, "Failed to export generation",
+				slog.String("generationID", g.ID),
+				slog.String("err", err.Error()))
+		}
+	}()
+}
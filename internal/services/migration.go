@@ -0,0 +1,39 @@
+package services
+
+import (
+	"fmt"
+)
+
+// migration upgrades the schema of a store from the previous version to version, within the transaction
+// of type T of the store. The migrations of a store are listed in the order of their versions, starting
+// from version 1, and must never be changed once released, as the stores migrated by them are not
+// migrated again.
+type migration[T any] struct {
+	version     int
+	description string
+	up          func(tx T) error
+}
+
+// runMigrations applies the migrations newer than the current version of the store, in order, within the
+// given transaction, and returns the version of the store after the migrations. The caller is responsible
+// to persist the returned version in the same transaction, so the store is either fully migrated or left
+// untouched.
+func runMigrations[T any](tx T, current int, migrations []migration[T]) (int, error) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return current, fmt.Errorf("migration %q has version %d, want %d", m.description, m.version, i+1)
+		}
+	}
+	if current > len(migrations) {
+		return current, fmt.Errorf("store schema version %d is newer than the supported version %d, "+
+			"it was written by a newer version of the application", current, len(migrations))
+	}
+
+	for _, m := range migrations[current:] {
+		if err := m.up(tx); err != nil {
+			return current, fmt.Errorf("failed to migrate to version %d (%s): %w", m.version, m.description, err)
+		}
+		current = m.version
+	}
+	return current, nil
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRunMigrations(t *testing.T) {
+	var applied []int
+	migrations := make([]migration[*[]int], 3)
+	for i := range migrations {
+		version := i + 1
+		migrations[i] = migration[*[]int]{
+			version:     version,
+			description: "migration " + strconv.Itoa(version),
+			up: func(tx *[]int) error {
+				*tx = append(*tx, version)
+				return nil
+			},
+		}
+	}
+
+	// Every older version is upgraded by the migrations after it, a fresh store by all of them.
+	for current := 0; current <= len(migrations); current++ {
+		applied = nil
+		version, err := runMigrations(&applied, current, migrations)
+		if err != nil {
+			t.Fatalf("runMigrations() from version %d error = %v", current, err)
+		}
+		var want []int
+		for v := current + 1; v <= len(migrations); v++ {
+			want = append(want, v)
+		}
+		if version != len(migrations) || !slices.Equal(applied, want) {
+			t.Errorf("runMigrations() from version %d = %d, applied %v, want %d, %v", current, version, applied,
+				len(migrations), want)
+		}
+	}
+
+	applied = nil
+	if _, err := runMigrations(&applied, len(migrations)+1, migrations); err == nil || len(applied) > 0 {
+		t.Errorf("runMigrations() of a newer store error = %v, applied %v, want it refused", err, applied)
+	}
+
+	failing := slices.Clone(migrations)
+	failing[1].up = func(*[]int) error { return errors.New("boom") }
+	applied = nil
+	version, err := runMigrations(&applied, 0, failing)
+	if err == nil || version != 1 || !slices.Equal(applied, []int{1}) {
+		t.Errorf("runMigrations() with a failing migration = %d, %v, applied %v, want version 1 and an error",
+			version, err, applied)
+	}
+
+	unordered := slices.Clone(migrations)
+	unordered[0], unordered[1] = unordered[1], unordered[0]
+	if _, err := runMigrations(&applied, 0, unordered); err == nil {
+		t.Error("runMigrations() with unordered versions should return an error")
+	}
+}
+
+func TestBoltDBMigrateSchema(t *testing.T) {
+	supported := len(boltMigrations)
+
+	t.Run("fresh database", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "store.db")
+		b := openTestBoltDB(t, path)
+		if got := schemaVersion(t, b.db.db); got != supported {
+			t.Errorf("schema version = %d, want %d", got, supported)
+		}
+		if backups, _ := filepath.Glob(path + ".bak-v*"); len(backups) > 0 {
+			t.Errorf("backups = %v, want none of an empty database", backups)
+		}
+	})
+
+	for from := 0; from < supported; from++ {
+		t.Run("upgrade from version "+strconv.Itoa(from), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "store.db")
+			seedBoltDB(t, path, from)
+			b := openTestBoltDB(t, path)
+			if got := schemaVersion(t, b.db.db); got != supported {
+				t.Errorf("schema version = %d, want %d", got, supported)
+			}
+			backup, err := bolt.Open(path+".bak-v"+strconv.Itoa(from), 0600, nil)
+			if err != nil {
+				t.Fatalf("backup of version %d: %v", from, err)
+			}
+			defer backup.Close()
+			if got := schemaVersion(t, backup); got != from {
+				t.Errorf("schema version of the backup = %d, want %d", got, from)
+			}
+		})
+	}
+
+	t.Run("newer database", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "store.db")
+		seedBoltDB(t, path, supported+1)
+		if b, err := NewBoltDB(path); err == nil {
+			_ = b.db.db.Close()
+			t.Fatal("NewBoltDB() of a database of a newer version should return an error")
+		} else if !strings.Contains(err.Error(), "newer") {
+			t.Errorf("NewBoltDB() error = %v, want the version refused", err)
+		}
+	})
+
+	t.Run("failing migration", func(t *testing.T) {
+		defer func(migrations []migration[boltTx]) { boltMigrations = migrations }(boltMigrations)
+		boltMigrations = append(slices.Clone(boltMigrations), migration[boltTx]{
+			version:     supported + 1,
+			description: "failing",
+			up: func(tx boltTx) error {
+				if _, err := tx.CreateBucket([]byte("partial")); err != nil {
+					return err
+				}
+				return errors.New("boom")
+			},
+		})
+
+		path := filepath.Join(t.TempDir(), "store.db")
+		seedBoltDB(t, path, supported)
+		if b, err := NewBoltDB(path); err == nil {
+			_ = b.db.db.Close()
+			t.Fatal("NewBoltDB() with a failing migration should return an error")
+		}
+		db, err := bolt.Open(path, 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if got := schemaVersion(t, db); got != supported {
+			t.Errorf("schema version after the failed migration = %d, want %d", got, supported)
+		}
+		_ = db.View(func(tx *bolt.Tx) error {
+			if tx.Bucket([]byte("partial")) != nil {
+				t.Error("the changes of the failed migration aren't rolled back")
+			}
+			return nil
+		})
+		if _, err := os.Stat(path + ".bak-v" + strconv.Itoa(supported)); err != nil {
+			t.Errorf("backup before the failed migration: %v", err)
+		}
+	})
+}
+
+// seedBoltDB writes a database of the schema version with a chat, without the meta bucket for version 0,
+// like the databases of the versions before the schema versioning.
+func seedBoltDB(t *testing.T, path string, version int) {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		chats, err := tx.CreateBucket([]byte("chats"))
+		if err != nil {
+			return err
+		}
+		if err := putJSON(chats, "1-chat", models.Chat{ID: "1-chat"}); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(messageBucketName("1-chat")); err != nil {
+			return err
+		}
+		if version == 0 {
+			return nil
+		}
+		meta, err := tx.CreateBucket(metaBucketName)
+		if err != nil {
+			return err
+		}
+		return meta.Put(schemaVersionKey, []byte(strconv.Itoa(version)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func schemaVersion(t *testing.T, db *bolt.DB) int {
+	t.Helper()
+	version := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucketName)
+		if meta == nil || meta.Get(schemaVersionKey) == nil {
+			return nil
+		}
+		var err error
+		version, err = strconv.Atoi(string(meta.Get(schemaVersionKey)))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
@@ -0,0 +1,215 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// Mock provides an implementation of the LLM interface that replays canned responses instead of calling a
+// language model, so the UI, the handlers and the MCP servers can be developed and tested without an API
+// key. A user message without a matching response is echoed back.
+type Mock struct {
+	responses  []MockResponse
+	chunkDelay time.Duration
+
+	logger *slog.Logger
+}
+
+// MockResponse is a canned response of Mock. The response answers the user messages containing Match,
+// case-insensitively, or every user message if Match is empty. The ToolCalls are requested one after
+// another, each after the result of the previous one, before the Text is streamed. A Text containing
+// {{message}} has it replaced by the user message. The FinishReason, if any, ends the Text, like "length" for
+// a response stopped at the maximum output tokens.
+type MockResponse struct {
+	Match        string         `yaml:"match"`
+	ToolCalls    []MockToolCall `yaml:"toolCalls"`
+	Text         string         `yaml:"text"`
+	FinishReason string         `yaml:"finishReason"`
+}
+
+// MockToolCall is a tool call requested by a MockResponse.
+type MockToolCall struct {
+	Name  string         `yaml:"name"`
+	Input map[string]any `yaml:"input"`
+}
+
+const (
+	mockModel       = "mock"
+	mockMessageVar  = "{{message}}"
+	mockTitleWords  = 5
+	mockDefaultText = "Echo: " + mockMessageVar
+)
+
+// NewMock creates a new Mock instance replaying the given responses, which are matched in order. The text
+// of the responses is streamed word by word, waiting chunkDelay between the words.
+func NewMock(responses []MockResponse, chunkDelay time.Duration, logger *slog.Logger) Mock {
+	return Mock{
+		responses:  responses,
+		chunkDelay: chunkDelay,
+		logger:     logger.With(slog.String("module", "mock")),
+	}
+}
+
+// Chat implements the LLM interface by replaying the response matching the last user message. The tool
+// calls of the response are only requested if the tool is in tools, otherwise they are skipped with a
+// warning.
+func (m Mock) Chat(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+) iter.Seq2[models.Content, error] {
+	return func(yield func(models.Content, error) bool) {
+		message, toolResults := mockTurn(messages)
+		res := m.response(message)
+
+		calls := make([]MockToolCall, 0, len(res.ToolCalls))
+		for _, call := range res.ToolCalls {
+			if !mockHasTool(tools, call.Name) {
+				m.logger.WarnContext(ctx, "Skipping the tool call of an unknown tool", slog.String("tool", call.Name))
+				continue
+			}
+			calls = append(calls, call)
+		}
+
+		if toolResults < len(calls) {
+			call := calls[toolResults]
+			input, err := json.Marshal(call.Input)
+			if err != nil {
+				yield(models.Content{}, fmt.Errorf("error marshaling tool input: %w", err))
+				return
+			}
+			if !m.wait(ctx) {
+				return
+			}
+			yield(models.Content{
+				Type:       models.ContentTypeCallTool,
+				ToolName:   call.Name,
+				ToolInput:  input,
+				CallToolID: fmt.Sprintf("mock-%d", toolResults),
+			}, nil)
+			return
+		}
+
+		text := strings.ReplaceAll(res.Text, mockMessageVar, message)
+		for _, chunk := range mockChunks(text) {
+			if !m.wait(ctx) {
+				return
+			}
+			if !yield(models.Content{
+				Type: models.ContentTypeText,
+				Text: chunk,
+			}, nil) {
+				return
+			}
+		}
+		if res.FinishReason != "" {
+			yield(models.Content{Type: models.ContentTypeFinish, FinishReason: models.FinishReason(res.FinishReason)}, nil)
+		}
+	}
+}
+
+// GenerateTitle implements the TitleGenerator interface by returning the first words of the message, in its
+// language.
+func (m Mock) GenerateTitle(_ context.Context, message, _ string) (string, error) {
+	words := strings.Fields(message)
+	if len(words) > mockTitleWords {
+		words = words[:mockTitleWords]
+	}
+	if len(words) == 0 {
+		return "Mock chat", nil
+	}
+	return strings.Join(words, " "), nil
+}
+
+// Capabilities returns the features of the Mock instance, which calls tools.
+func (m Mock) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{Tools: true, SystemRole: SystemRoleSystem}
+}
+
+// Model returns the name of the model the Mock instance reports, which is always mock.
+func (m Mock) Model() string {
+	return mockModel
+}
+
+func (m Mock) response(message string) MockResponse {
+	lower := strings.ToLower(message)
+	for _, res := range m.responses {
+		if strings.Contains(lower, strings.ToLower(res.Match)) {
+			return res
+		}
+	}
+	return MockResponse{Text: mockDefaultText}
+}
+
+// wait sleeps for the chunk delay, and reports whether ctx is still alive afterwards.
+func (m Mock) wait(ctx context.Context) bool {
+	if m.chunkDelay <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(m.chunkDelay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// mockTurn returns the text of the last user message, and the number of tool results the assistant
+// received since.
+func mockTurn(messages []models.Message) (string, int) {
+	toolResults := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg := messages[i]
+		if msg.Role == models.RoleUser {
+			var sb strings.Builder
+			for _, ct := range msg.Contents {
+				sb.WriteString(ct.Text)
+			}
+			return sb.String(), toolResults
+		}
+		for _, ct := range msg.Contents {
+			if ct.Type == models.ContentTypeToolResult {
+				toolResults++
+			}
+		}
+	}
+	return "", toolResults
+}
+
+func mockHasTool(tools []mcp.Tool, name string) bool {
+	for _, tool := range tools {
+		if tool.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mockChunks splits text into chunks of one word each, keeping the whitespace after the word.
+func mockChunks(text string) []string {
+	var chunks []string
+	start := 0
+	inSpace := false
+	for i, r := range text {
+		isSpace := r == ' ' || r == '\n' || r == '\t'
+		if inSpace && !isSpace {
+			chunks = append(chunks, text[start:i])
+			start = i
+		}
+		inSpace = isSpace
+	}
+	if start < len(text) {
+		chunks = append(chunks, text[start:])
+	}
+	return chunks
+}
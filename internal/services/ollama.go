@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"iter"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"slices"
+	"strings"
 
 	"github.com/MegaGrindStone/go-mcp"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
@@ -22,77 +24,96 @@ type Ollama struct {
 	host         string
 	model        string
 	systemPrompt string
+	systemRole   SystemRole
+	// toolEmulation emulates the tool calls for the models without native function calling.
+	toolEmulation bool
 
 	params LLMParameters
 
 	client *api.Client
+	// baseURL and httpClient send the chat requests, whose tools the client can't hold.
+	baseURL    *url.URL
+	httpClient *http.Client
 
 	logger *slog.Logger
 }
 
+// ollamaChatRequest is a chat request of the Ollama API whose tools keep their input schemas as they are, as
+// the tools of the Ollama client only keep the flat properties of the schemas, dropping the nested objects and
+// arrays, the enums of the other types than strings, and the properties of several types.
+type ollamaChatRequest struct {
+	api.ChatRequest
+	Tools []ollamaTool `json:"tools,omitempty"`
+}
+
+type ollamaTool struct {
+	Type     string             `json:"type"`
+	Function ollamaToolFunction `json:"function"`
+}
+
+type ollamaToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// ollamaChatResponse is a line of a streamed chat response, or the error ending the stream.
+type ollamaChatResponse struct {
+	api.ChatResponse
+	Error string `json:"error"`
+}
+
+// emptyToolSchema is the input schema of the tools without one.
+var emptyToolSchema = json.RawMessage(`{"type":"object","properties":{}}`)
+
 // NewOllama creates a new Ollama instance with the specified host URL and model name. The host
 // parameter should be a valid URL pointing to an Ollama server. If the provided host URL is invalid,
 // the function will panic.
-func NewOllama(host, model, systemPrompt string, params LLMParameters, logger *slog.Logger) Ollama {
+func NewOllama(
+	host, model, systemPrompt string,
+	params LLMParameters,
+	logger *slog.Logger,
+	options ...ProviderOption,
+) Ollama {
+	opts := newProviderOptions(options)
 	u, err := url.Parse(host)
 	if err != nil {
 		panic(err)
 	}
 
 	return Ollama{
-		host:         host,
-		model:        model,
-		systemPrompt: systemPrompt,
-		params:       params,
-		client:       api.NewClient(u, &http.Client{}),
-		logger:       logger.With(slog.String("module", "ollama")),
+		host:          host,
+		model:         model,
+		systemPrompt:  systemPrompt,
+		systemRole:    opts.systemRole,
+		toolEmulation: opts.toolEmulation,
+		params:        params,
+		client:        api.NewClient(u, opts.httpClient),
+		baseURL:       u,
+		httpClient:    opts.httpClient,
+		logger:        logger.With(slog.String("module", "ollama")),
 	}
 }
 
-func ollamaMessages(messages []models.Message) ([]api.Message, error) {
-	msgs := make([]api.Message, 0, len(messages))
-	for _, msg := range messages {
-		if msg.Role == models.RoleUser {
-			if len(msg.Contents) != 1 {
-				return nil, fmt.Errorf("user message should only contain one content, got %d", len(msg.Contents))
-			}
-			msgs = append(msgs, api.Message{
-				Role:    string(msg.Role),
-				Content: msg.Contents[0].Text,
-			})
-			continue
+func ollamaMessages(messages []chatMessage) ([]api.Message, error) {
+	msgs := make([]api.Message, len(messages))
+	for i, msg := range messages {
+		msgs[i] = api.Message{
+			Role:    msg.Role,
+			Content: msg.Text,
 		}
-
-		for _, ct := range msg.Contents {
-			switch ct.Type {
-			case models.ContentTypeText:
-				if ct.Text != "" {
-					msgs = append(msgs, api.Message{
-						Role:    string(msg.Role),
-						Content: ct.Text,
-					})
-				}
-			case models.ContentTypeCallTool:
-				args := make(map[string]any)
-				if err := json.Unmarshal(ct.ToolInput, &args); err != nil {
-					return nil, fmt.Errorf("error unmarshaling tool input: %w", err)
-				}
-				msgs = append(msgs, api.Message{
-					Role: string(msg.Role),
-					ToolCalls: []api.ToolCall{
-						{
-							Function: api.ToolCallFunction{
-								Name:      ct.ToolName,
-								Arguments: args,
-							},
-						},
+		if msg.ToolCall != nil {
+			args := make(map[string]any)
+			if err := json.Unmarshal(msg.ToolCall.ToolInput, &args); err != nil {
+				return nil, fmt.Errorf("error unmarshaling tool input: %w", err)
+			}
+			msgs[i].ToolCalls = []api.ToolCall{
+				{
+					Function: api.ToolCallFunction{
+						Name:      msg.ToolCall.ToolName,
+						Arguments: args,
 					},
-				})
-			case models.ContentTypeToolResult:
-				msgs = append(msgs, api.Message{
-					Role:    "tool",
-					Content: string(ct.ToolResult),
-				})
+				},
 			}
 		}
 	}
@@ -108,119 +129,106 @@ func (o Ollama) Chat(
 	messages []models.Message,
 	tools []mcp.Tool,
 ) iter.Seq2[models.Content, error] {
-	return func(yield func(models.Content, error) bool) {
-		msgs, err := ollamaMessages(messages)
+	caps := o.Capabilities()
+	return streamChat(ctx, o.logger, caps, func(s *chatStream) {
+		msgs, err := ollamaMessages(chatMessages(models.SystemPrompt(ctx, o.systemPrompt), messages, tools, caps))
 		if err != nil {
-			yield(models.Content{}, fmt.Errorf("error creating ollama messages: %w", err))
+			s.fail(fmt.Errorf("error creating ollama messages: %w", err))
 			return
 		}
 
-		msgs = slices.Insert(msgs, 0, api.Message{
-			Role:    "system",
-			Content: o.systemPrompt,
-		})
-
-		oTools := make([]api.Tool, len(tools))
-		for i, tool := range tools {
-			var params struct {
-				Type       string   `json:"type"`
-				Required   []string `json:"required"`
-				Properties map[string]struct {
-					Type        string   `json:"type"`
-					Description string   `json:"description"`
-					Enum        []string `json:"enum,omitempty"`
-				} `json:"properties"`
-			}
-			if err := json.Unmarshal([]byte(tool.InputSchema), &params); err != nil {
-				yield(models.Content{}, fmt.Errorf("error unmarshaling tool input schema: %w", err))
+		req := o.chatRequest(ctx, msgs, ollamaTools(chatTools(tools, caps)), true)
+		resp, err := postJSON(ctx, o.httpClient, o.logger, o.baseURL.JoinPath("api", "chat").String(),
+			map[string]string{"Accept": "application/x-ndjson"}, req)
+		if err != nil {
+			s.fail(fmt.Errorf("error sending request: %w", err))
+			return
+		}
+		defer resp.Body.Close()
+
+		// The tool calls aren't streamed in parts, each one is complete, so they're numbered in their order.
+		toolCalls := 0
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var res ollamaChatResponse
+			if err := dec.Decode(&res); errors.Is(err, io.EOF) {
+				return
+			} else if err != nil {
+				s.fail(fmt.Errorf("error decoding response: %w", err))
 				return
 			}
-			oTool := api.Tool{
-				Type: "function",
-				Function: api.ToolFunction{
-					Name:        tool.Name,
-					Description: tool.Description,
-					Parameters:  params,
-				},
-			}
-
-			if err := json.Unmarshal([]byte(tool.InputSchema), &oTool.Function.Parameters); err != nil {
-				yield(models.Content{}, fmt.Errorf("error unmarshaling tool input schema: %w", err))
+			if res.Error != "" {
+				s.fail(fmt.Errorf("error from ollama: %s", res.Error))
 				return
 			}
-			oTools[i] = oTool
-		}
-
-		req := o.chatRequest(msgs, oTools, true)
-
-		reqJSON, err := json.Marshal(req)
-		if err == nil {
-			o.logger.Debug("Request", slog.String("req", string(reqJSON)))
-		}
-
-		ctx, cancel := context.WithCancel(ctx)
-		defer cancel()
-
-		if err := o.client.Chat(ctx, &req, func(res api.ChatResponse) error {
-			if res.Message.Content != "" {
-				if !yield(models.Content{
-					Type: models.ContentTypeText,
-					Text: res.Message.Content,
-				}, nil) {
-					cancel()
-					return nil
-				}
+			if !s.text(res.Message.Content) {
+				return
 			}
-			if len(res.Message.ToolCalls) > 0 {
-				args, err := json.Marshal(res.Message.ToolCalls[0].Function.Arguments)
+			for _, call := range res.Message.ToolCalls {
+				args, err := json.Marshal(call.Function.Arguments)
 				if err != nil {
-					return fmt.Errorf("error marshaling tool arguments: %w", err)
-				}
-				if len(res.Message.ToolCalls) > 1 {
-					o.logger.Warn("Received multiples tool call, but only the first one is supported",
-						slog.Int("count", len(res.Message.ToolCalls)),
-						slog.String("toolCalls", fmt.Sprintf("%+v", res.Message.ToolCalls)),
-					)
-				}
-				if !yield(models.Content{
-					Type:      models.ContentTypeCallTool,
-					ToolName:  res.Message.ToolCalls[0].Function.Name,
-					ToolInput: args,
-				}, nil) {
-					cancel()
+					s.fail(fmt.Errorf("error marshaling tool arguments: %w", err))
+					return
 				}
+				s.toolCallDelta(toolCalls, "", call.Function.Name, string(args))
+				toolCalls++
 			}
-			return nil
-		}); err != nil {
-			if errors.Is(err, context.Canceled) {
-				return
+			if res.Done {
+				s.finish(ollamaFinishReason(res.DoneReason))
 			}
-			yield(models.Content{}, fmt.Errorf("error sending request: %w", err))
-			return
+		}
+	})
+}
+
+// ollamaTools returns the tools of the Ollama API, with their input schemas as they are.
+func ollamaTools(tools []mcp.Tool) []ollamaTool {
+	oTools := make([]ollamaTool, len(tools))
+	for i, tool := range tools {
+		schema := tool.InputSchema
+		if len(schema) == 0 {
+			schema = emptyToolSchema
+		}
+		oTools[i] = ollamaTool{
+			Type: "function",
+			Function: ollamaToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  schema,
+			},
 		}
 	}
+	return oTools
+}
+
+// ollamaFinishReason normalizes the done reason of an Ollama response.
+func ollamaFinishReason(reason string) models.FinishReason {
+	switch reason {
+	case "":
+		return ""
+	case "stop":
+		return models.FinishReasonStop
+	case "length":
+		return models.FinishReasonLength
+	default:
+		return models.FinishReason(reason)
+	}
 }
 
 // GenerateTitle generates a title for a given message using the Ollama API. It sends a single message to the
 // Ollama API and returns the first response content as the title. The context can be used to cancel ongoing
-// requests.
-func (o Ollama) GenerateTitle(ctx context.Context, message string) (string, error) {
-	msgs := []api.Message{
-		{
-			Role:    "system",
-			Content: o.systemPrompt,
-		},
-		{
-			Role:    "user",
-			Content: message,
-		},
+// requests. The title is written in language, if it isn't empty.
+func (o Ollama) GenerateTitle(ctx context.Context, message, language string) (string, error) {
+	ctx = withTitleLanguage(ctx, language)
+	systemPrompt := models.SystemPrompt(ctx, o.systemPrompt)
+	msgs, err := ollamaMessages(chatMessages(systemPrompt, titleMessages(message), nil, o.Capabilities()))
+	if err != nil {
+		return "", fmt.Errorf("error creating ollama messages: %w", err)
 	}
-
-	req := o.chatRequest(msgs, nil, false)
+	req := o.chatRequest(ctx, msgs, nil, false)
 
 	var title string
 
-	if err := o.client.Chat(ctx, &req, func(res api.ChatResponse) error {
+	if err := o.client.Chat(ctx, &req.ChatRequest, func(res api.ChatResponse) error {
 		title = res.Message.Content
 		return nil
 	}); err != nil {
@@ -230,36 +238,98 @@ func (o Ollama) GenerateTitle(ctx context.Context, message string) (string, erro
 	return title, nil
 }
 
-func (o Ollama) chatRequest(messages []api.Message, tools []api.Tool, stream bool) api.ChatRequest {
-	req := api.ChatRequest{
-		Model:    o.model,
-		Messages: messages,
-		Stream:   &stream,
-		Tools:    tools,
+func (o Ollama) chatRequest(
+	ctx context.Context,
+	messages []api.Message,
+	tools []ollamaTool,
+	stream bool,
+) ollamaChatRequest {
+	req := ollamaChatRequest{
+		ChatRequest: api.ChatRequest{
+			Model:    o.model,
+			Messages: messages,
+			Stream:   &stream,
+		},
+		Tools: tools,
 	}
 
+	params := o.params.withChat(ctx)
 	opts := make(map[string]interface{})
 
-	if o.params.Temperature != nil {
-		opts["temperature"] = *o.params.Temperature
+	if params.Temperature != nil {
+		opts["temperature"] = *params.Temperature
+	}
+	if params.Seed != nil {
+		opts["seed"] = *params.Seed
 	}
-	if o.params.Seed != nil {
-		opts["seed"] = *o.params.Seed
+	if params.Stop != nil {
+		opts["stop"] = params.Stop
 	}
-	if o.params.Stop != nil {
-		opts["stop"] = o.params.Stop
+	if params.TopK != nil {
+		opts["top_k"] = *params.TopK
 	}
-	if o.params.TopK != nil {
-		opts["top_k"] = *o.params.TopK
+	if params.TopP != nil {
+		opts["top_p"] = *params.TopP
 	}
-	if o.params.TopP != nil {
-		opts["top_p"] = *o.params.TopP
+	if params.MinP != nil {
+		opts["min_p"] = *params.MinP
 	}
-	if o.params.MinP != nil {
-		opts["min_p"] = *o.params.MinP
+	if params.MaxTokens != nil {
+		opts["num_predict"] = *params.MaxTokens
 	}
 
 	req.Options = opts
+	req.Format = models.ResponseSchemaFromContext(ctx)
 
 	return req
 }
+
+// ValidateParameters checks the parameters of a chat against the Ollama API, which takes no logit bias.
+func (o Ollama) ValidateParameters(params models.ChatParameters) error {
+	if params.LogitBias != nil {
+		return unsupportedParameter("Ollama", "logit bias")
+	}
+	return nil
+}
+
+// Capabilities returns the features of the Ollama API. The images depend on the model, so they aren't
+// reported.
+func (o Ollama) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{Tools: !o.toolEmulation, SystemRole: o.systemRole, ToolEmulation: o.toolEmulation}
+}
+
+// Model returns the name of the model the Ollama instance chats with.
+func (o Ollama) Model() string {
+	return o.model
+}
+
+// CountTokens approximates the number of input tokens of a chat request of messages and tools with an
+// average of the tokenizers of the open models, the system prompt of ctx included.
+func (o Ollama) CountTokens(ctx context.Context, messages []models.Message, tools []mcp.Tool) int {
+	return approxRequestTokens(models.SystemPrompt(ctx, o.systemPrompt), messages, tools, ollamaCharsPerToken)
+}
+
+// CheckSetup checks the Ollama server is reachable and the model is pulled, by listing the local models.
+func (o Ollama) CheckSetup(ctx context.Context) error {
+	res, err := o.client.List(ctx)
+	if err != nil {
+		return &models.SetupError{
+			Problem: fmt.Sprintf("The Ollama server at %s isn't reachable: %s", o.host, err),
+			Hint:    "Start the server with `ollama serve`, or set the host of the llm section to its URL.",
+		}
+	}
+	// The models without a tag are the latest ones.
+	name := o.model
+	if !strings.Contains(name, ":") {
+		name += ":latest"
+	}
+	if slices.ContainsFunc(res.Models, func(m api.ListModelResponse) bool {
+		return m.Name == name || m.Model == name
+	}) {
+		return nil
+	}
+	return &models.SetupError{
+		Problem: fmt.Sprintf("The Ollama model %s isn't pulled", o.model),
+		Hint:    fmt.Sprintf("Run `ollama pull %s` on the Ollama server.", o.model),
+	}
+}
@@ -8,7 +8,7 @@ import (
 	"io"
 	"iter"
 	"log/slog"
-	"slices"
+	"net/http"
 
 	"github.com/MegaGrindStone/go-mcp"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
@@ -17,8 +17,12 @@ import (
 
 // OpenAI provides an implementation of the LLM interface for interacting with OpenAI's language models.
 type OpenAI struct {
+	apiKey       string
 	model        string
 	systemPrompt string
+	systemRole   SystemRole
+	// toolEmulation emulates the tool calls for the models without native function calling.
+	toolEmulation bool
 
 	params LLMParameters
 
@@ -28,63 +32,57 @@ type OpenAI struct {
 }
 
 // NewOpenAI creates a new OpenAI instance with the specified API key, base URL, model name, and system prompt.
-func NewOpenAI(apiKey, model, systemPrompt string, params LLMParameters, logger *slog.Logger) OpenAI {
+func NewOpenAI(
+	apiKey, model, systemPrompt string,
+	params LLMParameters,
+	logger *slog.Logger,
+	options ...ProviderOption,
+) OpenAI {
+	opts := newProviderOptions(options)
+	cfg := goopenai.DefaultConfig(apiKey)
+	cfg.HTTPClient = opts.httpClient
 	return OpenAI{
-		model:        model,
-		systemPrompt: systemPrompt,
-		params:       params,
-		client:       goopenai.NewClient(apiKey),
-		logger:       logger.With(slog.String("module", "openai")),
+		apiKey:        apiKey,
+		model:         model,
+		systemPrompt:  systemPrompt,
+		systemRole:    opts.systemRole,
+		toolEmulation: opts.toolEmulation,
+		params:        params,
+		client:        goopenai.NewClientWithConfig(cfg),
+		logger:        logger.With(slog.String("module", "openai")),
 	}
 }
 
-func openAIMessages(messages []models.Message) ([]goopenai.ChatCompletionMessage, error) {
-	msgs := make([]goopenai.ChatCompletionMessage, 0, len(messages))
-	for _, msg := range messages {
-		if msg.Role == models.RoleUser {
-			if len(msg.Contents) != 1 {
-				return nil, fmt.Errorf("user message should only contain one content, got %d", len(msg.Contents))
+func openAIMessages(messages []chatMessage) []goopenai.ChatCompletionMessage {
+	msgs := make([]goopenai.ChatCompletionMessage, len(messages))
+	for i, msg := range messages {
+		msgs[i] = goopenai.ChatCompletionMessage{
+			Role:       msg.Role,
+			Content:    msg.Text,
+			ToolCallID: msg.ToolCallID,
+		}
+		if msg.Image != nil {
+			msgs[i].MultiContent = []goopenai.ChatMessagePart{
+				{
+					Type:     goopenai.ChatMessagePartTypeImageURL,
+					ImageURL: &goopenai.ChatMessageImageURL{URL: msg.Image.DataURL()},
+				},
 			}
-			msgs = append(msgs, goopenai.ChatCompletionMessage{
-				Role:    string(msg.Role),
-				Content: msg.Contents[0].Text,
-			})
-			continue
 		}
-
-		for _, ct := range msg.Contents {
-			switch ct.Type {
-			case models.ContentTypeText:
-				if ct.Text != "" {
-					msgs = append(msgs, goopenai.ChatCompletionMessage{
-						Role:    string(msg.Role),
-						Content: ct.Text,
-					})
-				}
-			case models.ContentTypeCallTool:
-				msgs = append(msgs, goopenai.ChatCompletionMessage{
-					Role: string(msg.Role),
-					ToolCalls: []goopenai.ToolCall{
-						{
-							Type: "function",
-							ID:   ct.CallToolID,
-							Function: goopenai.FunctionCall{
-								Name:      ct.ToolName,
-								Arguments: string(ct.ToolInput),
-							},
-						},
+		if msg.ToolCall != nil {
+			msgs[i].ToolCalls = []goopenai.ToolCall{
+				{
+					Type: "function",
+					ID:   msg.ToolCall.CallToolID,
+					Function: goopenai.FunctionCall{
+						Name:      msg.ToolCall.ToolName,
+						Arguments: string(msg.ToolCall.ToolInput),
 					},
-				})
-			case models.ContentTypeToolResult:
-				msgs = append(msgs, goopenai.ChatCompletionMessage{
-					Role:       "tool",
-					Content:    string(ct.ToolResult),
-					ToolCallID: ct.CallToolID,
-				})
+				},
 			}
 		}
 	}
-	return msgs, nil
+	return msgs
 }
 
 // Chat is a wrapper around the OpenAI chat completion API.
@@ -93,18 +91,11 @@ func (o OpenAI) Chat(
 	messages []models.Message,
 	tools []mcp.Tool,
 ) iter.Seq2[models.Content, error] {
-	return func(yield func(models.Content, error) bool) {
-		msgs, err := openAIMessages(messages)
-		if err != nil {
-			yield(models.Content{}, fmt.Errorf("error creating ollama messages: %w", err))
-			return
-		}
-
-		msgs = slices.Insert(msgs, 0, goopenai.ChatCompletionMessage{
-			Role:    "system",
-			Content: o.systemPrompt,
-		})
+	caps := o.Capabilities()
+	return streamChat(ctx, o.logger, caps, func(s *chatStream) {
+		msgs := openAIMessages(chatMessages(models.SystemPrompt(ctx, o.systemPrompt), messages, tools, caps))
 
+		tools = chatTools(tools, caps)
 		oTools := make([]goopenai.Tool, len(tools))
 		for i, tool := range tools {
 			oTools[i] = goopenai.Tool{
@@ -117,11 +108,12 @@ func (o OpenAI) Chat(
 			}
 		}
 
-		req := o.chatRequest(msgs, oTools, true)
+		req := o.chatRequest(ctx, msgs, oTools, true)
 
 		reqJSON, err := json.Marshal(req)
 		if err == nil {
-			o.logger.Debug("Request", slog.String("req", string(reqJSON)))
+			o.logger.DebugContext(ctx, "Request", slog.String("req", string(reqJSON)))
+			models.RecordRequest(ctx, reqJSON)
 		}
 
 		ctx, cancel := context.WithCancel(ctx)
@@ -129,84 +121,66 @@ func (o OpenAI) Chat(
 
 		stream, err := o.client.CreateChatCompletionStream(ctx, req)
 		if err != nil {
-			yield(models.Content{}, fmt.Errorf("error sending request: %w", err))
+			s.fail(fmt.Errorf("error sending request: %w", err))
 			return
 		}
+		defer stream.Close()
 
-		toolUse := false
-		toolArgs := ""
-		callToolContent := models.Content{
-			Type: models.ContentTypeCallTool,
-		}
 		for {
 			response, err := stream.Recv()
 			if err != nil {
-				if errors.Is(err, io.EOF) {
-					break
-				}
-				if errors.Is(err, context.Canceled) {
-					return
+				if !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
+					s.fail(fmt.Errorf("error receiving response: %w", err))
 				}
-				yield(models.Content{}, fmt.Errorf("error receiving response: %w", err))
 				return
 			}
-
 			if len(response.Choices) == 0 {
 				continue
 			}
 
-			res := response.Choices[0].Delta
-			if res.Content != "" {
-				if !yield(models.Content{
-					Type: models.ContentTypeText,
-					Text: res.Content,
-				}, nil) {
-					return
-				}
+			choice := response.Choices[0]
+			if !s.text(choice.Delta.Content) || !s.refusal(choice.Delta.Refusal) {
+				return
 			}
-			if len(res.ToolCalls) > 0 {
-				if len(res.ToolCalls) > 1 {
-					o.logger.Warn("Received multiples tool call, but only the first one is supported",
-						slog.Int("count", len(res.ToolCalls)),
-						slog.String("toolCalls", fmt.Sprintf("%+v", res.ToolCalls)),
-					)
-				}
-				toolArgs += res.ToolCalls[0].Function.Arguments
-				if !toolUse {
-					toolUse = true
-					callToolContent.ToolName = res.ToolCalls[0].Function.Name
-					callToolContent.CallToolID = res.ToolCalls[0].ID
-				}
+			if choice.FinishReason != goopenai.FinishReasonNull {
+				s.finish(openAIFinishReason(choice.FinishReason))
 			}
-		}
-		if toolUse {
-			if toolArgs == "" {
-				toolArgs = "{}"
+			for i, call := range choice.Delta.ToolCalls {
+				index := i
+				if call.Index != nil {
+					index = *call.Index
+				}
+				s.toolCallDelta(index, call.ID, call.Function.Name, call.Function.Arguments)
 			}
-			o.logger.Debug("Call Tool",
-				slog.String("name", callToolContent.ToolName),
-				slog.String("args", toolArgs),
-			)
-			callToolContent.ToolInput = json.RawMessage(toolArgs)
-			yield(callToolContent, nil)
 		}
-	}
+	})
 }
 
-// GenerateTitle is a wrapper around the OpenAI chat completion API.
-func (o OpenAI) GenerateTitle(ctx context.Context, message string) (string, error) {
-	msgs := []goopenai.ChatCompletionMessage{
-		{
-			Role:    goopenai.ChatMessageRoleSystem,
-			Content: o.systemPrompt,
-		},
-		{
-			Role:    goopenai.ChatMessageRoleUser,
-			Content: message,
-		},
+// openAIFinishReason normalizes the finish reason of an OpenAI response.
+func openAIFinishReason(reason goopenai.FinishReason) models.FinishReason {
+	switch reason {
+	case "":
+		return ""
+	case goopenai.FinishReasonStop:
+		return models.FinishReasonStop
+	case goopenai.FinishReasonLength:
+		return models.FinishReasonLength
+	case goopenai.FinishReasonToolCalls, goopenai.FinishReasonFunctionCall:
+		return models.FinishReasonToolUse
+	case goopenai.FinishReasonContentFilter:
+		return models.FinishReasonContentFilter
+	default:
+		return models.FinishReason(reason)
 	}
+}
 
-	req := o.chatRequest(msgs, nil, false)
+// GenerateTitle is a wrapper around the OpenAI chat completion API. The title is written in language, if it
+// isn't empty.
+func (o OpenAI) GenerateTitle(ctx context.Context, message, language string) (string, error) {
+	ctx = withTitleLanguage(ctx, language)
+	systemPrompt := models.SystemPrompt(ctx, o.systemPrompt)
+	msgs := openAIMessages(chatMessages(systemPrompt, titleMessages(message), nil, o.Capabilities()))
+	req := o.chatRequest(ctx, msgs, nil, false)
 
 	resp, err := o.client.CreateChatCompletion(ctx, req)
 	if err != nil {
@@ -221,6 +195,7 @@ func (o OpenAI) GenerateTitle(ctx context.Context, message string) (string, erro
 }
 
 func (o OpenAI) chatRequest(
+	ctx context.Context,
 	messages []goopenai.ChatCompletionMessage,
 	tools []goopenai.Tool,
 	stream bool,
@@ -232,33 +207,114 @@ func (o OpenAI) chatRequest(
 		Tools:    tools,
 	}
 
-	if o.params.Temperature != nil {
-		req.Temperature = *o.params.Temperature
+	params := o.params.withChat(ctx)
+
+	if params.Temperature != nil {
+		req.Temperature = *params.Temperature
+	}
+	if params.TopP != nil {
+		req.TopP = *params.TopP
 	}
-	if o.params.TopP != nil {
-		req.TopP = *o.params.TopP
+	if params.Stop != nil {
+		req.Stop = params.Stop
 	}
-	if o.params.Stop != nil {
-		req.Stop = o.params.Stop
+	if params.PresencePenalty != nil {
+		req.PresencePenalty = *params.PresencePenalty
 	}
-	if o.params.PresencePenalty != nil {
-		req.PresencePenalty = *o.params.PresencePenalty
+	if params.Seed != nil {
+		req.Seed = params.Seed
 	}
-	if o.params.Seed != nil {
-		req.Seed = o.params.Seed
+	if params.FrequencyPenalty != nil {
+		req.FrequencyPenalty = *params.FrequencyPenalty
 	}
-	if o.params.FrequencyPenalty != nil {
-		req.FrequencyPenalty = *o.params.FrequencyPenalty
+	if params.LogitBias != nil {
+		req.LogitBias = params.LogitBias
 	}
-	if o.params.LogitBias != nil {
-		req.LogitBias = o.params.LogitBias
+	if params.Logprobs != nil {
+		req.LogProbs = *params.Logprobs
 	}
-	if o.params.Logprobs != nil {
-		req.LogProbs = *o.params.Logprobs
+	if params.TopLogprobs != nil {
+		req.TopLogProbs = *params.TopLogprobs
 	}
-	if o.params.TopLogprobs != nil {
-		req.TopLogProbs = *o.params.TopLogprobs
+	if params.MaxTokens != nil {
+		req.MaxCompletionTokens = *params.MaxTokens
+	}
+	if schema := models.ResponseSchemaFromContext(ctx); schema != nil {
+		req.ResponseFormat = &goopenai.ChatCompletionResponseFormat{
+			Type: goopenai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &goopenai.ChatCompletionResponseFormatJSONSchema{
+				Name:   "response",
+				Schema: schema,
+			},
+		}
 	}
 
 	return req
 }
+
+// ValidateParameters checks the parameters of a chat against the OpenAI API, which takes no top K and at most
+// 4 stop sequences.
+func (o OpenAI) ValidateParameters(params models.ChatParameters) error {
+	if params.TopK != nil {
+		return unsupportedParameter("OpenAI", "top K")
+	}
+	if len(params.Stop) > maxOpenAIStopSequences {
+		return fmt.Errorf("OpenAI takes at most %d stop sequences", maxOpenAIStopSequences)
+	}
+	return nil
+}
+
+// Capabilities returns the features of the OpenAI API.
+func (o OpenAI) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{
+		Tools:         !o.toolEmulation,
+		Vision:        true,
+		SystemRole:    o.systemRole,
+		ToolEmulation: o.toolEmulation,
+	}
+}
+
+// Model returns the name of the model the OpenAI instance chats with.
+func (o OpenAI) Model() string {
+	return o.model
+}
+
+// CountTokens approximates the number of input tokens of a chat request of messages and tools with the
+// tokenizer of the GPT models, the system prompt of ctx included.
+func (o OpenAI) CountTokens(ctx context.Context, messages []models.Message, tools []mcp.Tool) int {
+	return approxRequestTokens(models.SystemPrompt(ctx, o.systemPrompt), messages, tools, openAICharsPerToken)
+}
+
+// CheckSetup checks the API key and the model, by retrieving the model from the OpenAI API.
+func (o OpenAI) CheckSetup(ctx context.Context) error {
+	if o.apiKey == "" {
+		return &models.SetupError{
+			Problem: "The OpenAI API key is missing",
+			Hint:    "Set the apiKey of the llm section, or the OPENAI_API_KEY environment variable.",
+		}
+	}
+	_, err := o.client.GetModel(ctx, o.model)
+	if err == nil {
+		return nil
+	}
+	var apiErr *goopenai.APIError
+	if !errors.As(err, &apiErr) {
+		return &models.SetupError{
+			Problem: fmt.Sprintf("The OpenAI API isn't reachable: %s", err),
+			Hint:    "Check the network access of the server to api.openai.com, and the egress section.",
+		}
+	}
+	switch apiErr.HTTPStatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &models.SetupError{
+			Problem: "The OpenAI API key is rejected",
+			Hint:    "Create a new key in the OpenAI dashboard, and set it as the apiKey of the llm section.",
+		}
+	case http.StatusNotFound:
+		return &models.SetupError{
+			Problem: fmt.Sprintf("The OpenAI model %s doesn't exist", o.model),
+			Hint:    "Set the model of the llm section to one of the models available to the key.",
+		}
+	}
+	return fmt.Errorf("failed to retrieve the model: %w", err)
+}
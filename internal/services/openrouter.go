@@ -1,16 +1,14 @@
 package services
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"iter"
 	"log/slog"
 	"net/http"
-	"slices"
+	"strings"
 
 	"github.com/MegaGrindStone/go-mcp"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
@@ -22,6 +20,9 @@ type OpenRouter struct {
 	apiKey       string
 	model        string
 	systemPrompt string
+	systemRole   SystemRole
+	// toolEmulation emulates the tool calls for the models without native function calling.
+	toolEmulation bool
 
 	params LLMParameters
 
@@ -51,6 +52,18 @@ type openRouterChatRequest struct {
 	TopLogprobs       *int           `json:"top_logprobs,omitempty"`
 	Stop              []string       `json:"stop,omitempty"`
 	IncludeReasoning  *bool          `json:"include_reasoning,omitempty"`
+
+	ResponseFormat *openRouterResponseFormat `json:"response_format,omitempty"`
+}
+
+type openRouterResponseFormat struct {
+	Type       string               `json:"type"`
+	JSONSchema openRouterJSONSchema `json:"json_schema"`
+}
+
+type openRouterJSONSchema struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
 }
 
 type openRouterMessage struct {
@@ -58,9 +71,12 @@ type openRouterMessage struct {
 	Content    string                `json:"content,omitempty"`
 	ToolCalls  []openRouterToolCalls `json:"tool_calls,omitempty"`
 	ToolCallID string                `json:"tool_call_id,omitempty"`
+	Refusal    string                `json:"refusal,omitempty"`
 }
 
 type openRouterToolCalls struct {
+	// Index is the position of the tool call in the response, given by the streamed parts of the tool calls.
+	Index    int                        `json:"index,omitempty"`
 	ID       string                     `json:"id"`
 	Type     string                     `json:"type"`
 	Function openRouterToolCallFunction `json:"function"`
@@ -115,14 +131,22 @@ const (
 )
 
 // NewOpenRouter creates a new OpenRouter instance with the specified API key, model name, and system prompt.
-func NewOpenRouter(apiKey, model, systemPrompt string, params LLMParameters, logger *slog.Logger) OpenRouter {
+func NewOpenRouter(
+	apiKey, model, systemPrompt string,
+	params LLMParameters,
+	logger *slog.Logger,
+	options ...ProviderOption,
+) OpenRouter {
+	opts := newProviderOptions(options)
 	return OpenRouter{
-		apiKey:       apiKey,
-		model:        model,
-		systemPrompt: systemPrompt,
-		params:       params,
-		client:       &http.Client{},
-		logger:       logger.With(slog.String("module", "openrouter")),
+		apiKey:        apiKey,
+		model:         model,
+		systemPrompt:  systemPrompt,
+		systemRole:    opts.systemRole,
+		toolEmulation: opts.toolEmulation,
+		params:        params,
+		client:        opts.httpClient,
+		logger:        logger.With(slog.String("module", "openrouter")),
 	}
 }
 
@@ -134,126 +158,80 @@ func (o OpenRouter) Chat(
 	messages []models.Message,
 	tools []mcp.Tool,
 ) iter.Seq2[models.Content, error] {
-	return func(yield func(models.Content, error) bool) {
+	return streamChat(ctx, o.logger, o.Capabilities(), func(s *chatStream) {
 		resp, err := o.doRequest(ctx, messages, tools, true)
 		if err != nil {
-			if errors.Is(err, context.Canceled) {
-				return
+			if !errors.Is(err, context.Canceled) {
+				s.fail(fmt.Errorf("error sending request: %w", err))
 			}
-			yield(models.Content{}, fmt.Errorf("error sending request: %w", err))
 			return
 		}
 		defer resp.Body.Close()
 
-		toolUse := false
-		toolArgs := ""
-		callToolContent := models.Content{
-			Type: models.ContentTypeCallTool,
-		}
-		for ev, err := range sse.Read(resp.Body, nil) {
-			if err != nil {
-				yield(models.Content{}, fmt.Errorf("error reading response: %w", err))
-				return
-			}
-
-			o.logger.Debug("Received event",
-				slog.String("event", ev.Data),
-			)
-
+		s.readEvents(resp.Body, func(ev sse.Event) bool {
 			if ev.Data == "[DONE]" {
-				break
+				return false
 			}
 
 			// Before we try to unmarshall response to the expected format, we try to unmarshall it to
 			// the streaming error format.
 			var resErr openRouterStreamingErrorResponse
-			if err := json.Unmarshal([]byte(ev.Data), &resErr); err == nil {
-				if resErr.Error.Code != 0 {
-					o.logger.Error("Received streaming error response",
-						slog.String("error", fmt.Sprintf("%+v", resErr)),
-					)
-					yield(models.Content{}, fmt.Errorf("openrouter error: %+v", resErr.Error))
-					return
-				}
+			if err := json.Unmarshal([]byte(ev.Data), &resErr); err == nil && resErr.Error.Code != 0 {
+				o.logger.ErrorContext(ctx, "Received streaming error response",
+					slog.String("error", fmt.Sprintf("%+v", resErr)),
+				)
+				s.fail(fmt.Errorf("openrouter error: %+v", resErr.Error))
+				return false
 			}
 
 			var res openRouterStreamingResponse
-			if err := json.Unmarshal([]byte(ev.Data), &res); err != nil {
-				yield(models.Content{}, fmt.Errorf("error unmarshaling response: %w", err))
-				return
+			if !s.decode(ev, &res, "response") {
+				return false
 			}
-
 			if len(res.Choices) == 0 {
-				continue
+				return true
 			}
 
 			choice := res.Choices[0]
-
-			if len(choice.Delta.ToolCalls) > 0 {
-				if len(choice.Delta.ToolCalls) > 1 {
-					o.logger.Warn("Received multiples tool call, but only the first one is supported",
-						slog.Int("count", len(choice.Delta.ToolCalls)),
-						slog.String("toolCalls", fmt.Sprintf("%+v", choice.Delta.ToolCalls)),
-					)
-				}
-				toolArgs += choice.Delta.ToolCalls[0].Function.Arguments
-				if !toolUse {
-					toolUse = true
-					callToolContent.ToolName = choice.Delta.ToolCalls[0].Function.Name
-					callToolContent.CallToolID = choice.Delta.ToolCalls[0].ID
-				}
+			s.finish(openRouterFinishReason(choice.FinishReason))
+			for _, call := range choice.Delta.ToolCalls {
+				s.toolCallDelta(call.Index, call.ID, call.Function.Name, call.Function.Arguments)
 			}
+			return s.text(choice.Delta.Content) && s.refusal(choice.Delta.Refusal)
+		})
+	})
+}
 
-			if choice.Delta.Content != "" {
-				if !yield(models.Content{
-					Type: models.ContentTypeText,
-					Text: choice.Delta.Content,
-				}, nil) {
-					break
-				}
-			}
-		}
-		if toolUse {
-			if toolArgs == "" {
-				toolArgs = "{}"
-			}
-			o.logger.Debug("Call Tool",
-				slog.String("name", callToolContent.ToolName),
-				slog.String("args", toolArgs),
-			)
-			callToolContent.ToolInput = json.RawMessage(toolArgs)
-			yield(callToolContent, nil)
-		}
+// openRouterFinishReason normalizes the finish reason of an OpenRouter response, which follows the OpenAI
+// ones whatever the model.
+func openRouterFinishReason(reason string) models.FinishReason {
+	switch reason {
+	case "":
+		return ""
+	case "stop":
+		return models.FinishReasonStop
+	case "length":
+		return models.FinishReasonLength
+	case "tool_calls", "function_call":
+		return models.FinishReasonToolUse
+	case "content_filter":
+		return models.FinishReasonContentFilter
+	default:
+		return models.FinishReason(reason)
 	}
 }
 
 // GenerateTitle generates a title for a given message using the OpenRouter API. It sends a single message to the
 // OpenRouter API and returns the first response content as the title. The context can be used to cancel ongoing
-// requests.
-func (o OpenRouter) GenerateTitle(ctx context.Context, message string) (string, error) {
-	msgs := []models.Message{
-		{
-			Role: models.RoleUser,
-			Contents: []models.Content{
-				{
-					Type: models.ContentTypeText,
-					Text: message,
-				},
-			},
-		},
-	}
-
-	resp, err := o.doRequest(ctx, msgs, nil, false)
+// requests. The title is written in language, if it isn't empty.
+func (o OpenRouter) GenerateTitle(ctx context.Context, message, language string) (string, error) {
+	ctx = withTitleLanguage(ctx, language)
+	resp, err := o.doRequest(ctx, titleMessages(message), nil, false)
 	if err != nil {
 		return "", fmt.Errorf("error sending request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
-	}
-
 	var res openRouterResponse
 	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
 		return "", fmt.Errorf("error decoding response: %w", err)
@@ -272,45 +250,30 @@ func (o OpenRouter) doRequest(
 	tools []mcp.Tool,
 	stream bool,
 ) (*http.Response, error) {
-	msgs := make([]openRouterMessage, 0, len(messages))
-	for _, msg := range messages {
-		for _, ct := range msg.Contents {
-			switch ct.Type {
-			case models.ContentTypeText:
-				if ct.Text != "" {
-					msgs = append(msgs, openRouterMessage{
-						Role:    string(msg.Role),
-						Content: ct.Text,
-					})
-				}
-			case models.ContentTypeCallTool:
-				msgs = append(msgs, openRouterMessage{
-					Role: "assistant",
-					ToolCalls: []openRouterToolCalls{
-						{
-							ID:   ct.CallToolID,
-							Type: "function",
-							Function: openRouterToolCallFunction{
-								Name:      ct.ToolName,
-								Arguments: string(ct.ToolInput),
-							},
-						},
+	caps := o.Capabilities()
+	chatMsgs := chatMessages(models.SystemPrompt(ctx, o.systemPrompt), messages, tools, caps)
+	msgs := make([]openRouterMessage, len(chatMsgs))
+	for i, msg := range chatMsgs {
+		msgs[i] = openRouterMessage{
+			Role:       msg.Role,
+			Content:    msg.Text,
+			ToolCallID: msg.ToolCallID,
+		}
+		if msg.ToolCall != nil {
+			msgs[i].ToolCalls = []openRouterToolCalls{
+				{
+					ID:   msg.ToolCall.CallToolID,
+					Type: "function",
+					Function: openRouterToolCallFunction{
+						Name:      msg.ToolCall.ToolName,
+						Arguments: string(msg.ToolCall.ToolInput),
 					},
-				})
-			case models.ContentTypeToolResult:
-				msgs = append(msgs, openRouterMessage{
-					Role:       "tool",
-					ToolCallID: ct.CallToolID,
-					Content:    string(ct.ToolResult),
-				})
+				},
 			}
 		}
 	}
-	msgs = slices.Insert(msgs, 0, openRouterMessage{
-		Role:    "system",
-		Content: o.systemPrompt,
-	})
 
+	tools = chatTools(tools, caps)
 	oTools := make([]openRouterTool, len(tools))
 	for i, tool := range tools {
 		parameters := tool.InputSchema
@@ -337,55 +300,106 @@ func (o OpenRouter) doRequest(
 		}
 	}
 
+	params := o.params.withChat(ctx)
 	reqBody := openRouterChatRequest{
 		Model:    o.model,
 		Messages: msgs,
 		Stream:   stream,
 		Tools:    oTools,
 
-		Temperature:       o.params.Temperature,
-		TopP:              o.params.TopP,
-		TopK:              o.params.TopK,
-		FrequencyPenalty:  o.params.FrequencyPenalty,
-		PresencePenalty:   o.params.PresencePenalty,
-		RepetitionPenalty: o.params.RepetitionPenalty,
-		MinP:              o.params.MinP,
-		TopA:              o.params.TopA,
-		Seed:              o.params.Seed,
-		MaxTokens:         o.params.MaxTokens,
-		LogitBias:         o.params.LogitBias,
-		Logprobs:          o.params.Logprobs,
-		TopLogprobs:       o.params.TopLogprobs,
-		Stop:              o.params.Stop,
-		IncludeReasoning:  o.params.IncludeReasoning,
+		Temperature:       params.Temperature,
+		TopP:              params.TopP,
+		TopK:              params.TopK,
+		FrequencyPenalty:  params.FrequencyPenalty,
+		PresencePenalty:   params.PresencePenalty,
+		RepetitionPenalty: params.RepetitionPenalty,
+		MinP:              params.MinP,
+		TopA:              params.TopA,
+		Seed:              params.Seed,
+		MaxTokens:         params.MaxTokens,
+		LogitBias:         params.LogitBias,
+		Logprobs:          params.Logprobs,
+		TopLogprobs:       params.TopLogprobs,
+		Stop:              params.Stop,
+		IncludeReasoning:  params.IncludeReasoning,
 	}
-
-	jsonBody, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("error marshaling request: %w", err)
+	if schema := models.ResponseSchemaFromContext(ctx); schema != nil {
+		reqBody.ResponseFormat = &openRouterResponseFormat{
+			Type:       "json_schema",
+			JSONSchema: openRouterJSONSchema{Name: "response", Schema: schema},
+		}
 	}
 
-	o.logger.Debug("Request Body", slog.String("body", string(jsonBody)))
+	return postJSON(ctx, o.client, o.logger, openRouterAPIEndpoint+"/chat/completions", map[string]string{
+		"Authorization": "Bearer " + o.apiKey,
+		"HTTP-Referer":  "https://github.com/MegaGrindStone/mcp-web-ui/",
+		"X-Title":       "MCP Web UI",
+	}, reqBody)
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
-		openRouterAPIEndpoint+"/chat/completions", bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
-	}
+// Capabilities returns the features of the OpenRouter API. The images depend on the model, so they aren't
+// reported.
+func (o OpenRouter) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{Tools: !o.toolEmulation, SystemRole: o.systemRole, ToolEmulation: o.toolEmulation}
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+o.apiKey)
-	req.Header.Set("HTTP-Referer", "https://github.com/MegaGrindStone/mcp-web-ui/")
-	req.Header.Set("X-Title", "MCP Web UI")
+// Model returns the name of the model the OpenRouter instance chats with.
+func (o OpenRouter) Model() string {
+	return o.model
+}
 
-	resp, err := o.client.Do(req)
+// CountTokens approximates the number of input tokens of a chat request of messages and tools with the
+// tokenizer of the provider of the model, given by the prefix of its name, the system prompt of ctx
+// included.
+func (o OpenRouter) CountTokens(ctx context.Context, messages []models.Message, tools []mcp.Tool) int {
+	charsPerToken := openAICharsPerToken
+	if strings.HasPrefix(o.model, "anthropic/") {
+		charsPerToken = anthropicCharsPerToken
+	}
+	return approxRequestTokens(models.SystemPrompt(ctx, o.systemPrompt), messages, tools, charsPerToken)
+}
+
+// CheckSetup checks the API key, by retrieving the key from the OpenRouter API, and the model, by retrieving
+// its endpoints.
+func (o OpenRouter) CheckSetup(ctx context.Context) error {
+	if o.apiKey == "" {
+		return &models.SetupError{
+			Problem: "The OpenRouter API key is missing",
+			Hint:    "Set the apiKey of the llm section, or the OPENROUTER_API_KEY environment variable.",
+		}
+	}
+	headers := map[string]string{"Authorization": "Bearer " + o.apiKey}
+	status, err := probeStatus(ctx, o.client, openRouterAPIEndpoint+"/key", headers)
 	if err != nil {
-		return nil, err
+		return &models.SetupError{
+			Problem: fmt.Sprintf("The OpenRouter API isn't reachable: %s", err),
+			Hint:    "Check the network access of the server to openrouter.ai, and the egress section.",
+		}
 	}
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status code: %d, body: %s, request: %s", resp.StatusCode, string(body), jsonBody)
+	switch status {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &models.SetupError{
+			Problem: "The OpenRouter API key is rejected",
+			Hint:    "Create a new key in the OpenRouter settings, and set it as the apiKey of the llm section.",
+		}
+	default:
+		return fmt.Errorf("unexpected status code from the OpenRouter API: %d", status)
 	}
 
-	return resp, nil
+	// The model names are paths, like anthropic/claude-3.5-sonnet.
+	status, err = probeStatus(ctx, o.client, openRouterAPIEndpoint+"/models/"+o.model+"/endpoints", headers)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve the model: %w", err)
+	}
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return &models.SetupError{
+			Problem: fmt.Sprintf("The OpenRouter model %s doesn't exist", o.model),
+			Hint:    "Set the model of the llm section to the ID of a model listed at openrouter.ai/models.",
+		}
+	}
+	return fmt.Errorf("unexpected status code from the OpenRouter API: %d", status)
 }
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// OTLP implements the GenerationExporter interface by sending the generations as spans following the
+// OpenTelemetry semantic conventions for generative AI, to an OTLP/HTTP traces endpoint with the JSON
+// encoding, like the ones of OpenLLMetry-compatible backends. The exports are asynchronous, so an
+// unavailable endpoint never blocks the chat.
+type OTLP struct {
+	endpoint string
+	headers  map[string]string
+
+	client *http.Client
+
+	logger *slog.Logger
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Events            []otlpEvent     `json:"events"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindClient  = 3
+	otlpStatusCodeOK    = 1
+	otlpStatusCodeError = 2
+)
+
+// NewOTLP creates a new OTLP instance sending the generations to the given OTLP/HTTP traces endpoint
+// (e.g. http://localhost:4318/v1/traces), with the given headers, e.g. for the authentication.
+func NewOTLP(endpoint string, headers map[string]string, logger *slog.Logger) OTLP {
+	return OTLP{
+		endpoint: endpoint,
+		headers:  headers,
+		client:   &http.Client{Timeout: exportTimeout},
+		logger:   logger.With(slog.String("module", "otlp")),
+	}
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func otlpDouble(key string, value float64) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{DoubleValue: &value}}
+}
+
+func otlpInt(key string, value int) otlpAttribute {
+	s := strconv.Itoa(value)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+// ExportGeneration sends the generation to the endpoint in the background.
+func (o OTLP) ExportGeneration(ctx context.Context, g models.Generation) {
+	// The export outlives the caller, but keeps the values of its context for the log records.
+	ctx = context.WithoutCancel(ctx)
+
+	spanID := make([]byte, 8)
+	_, _ = rand.Read(spanID)
+
+	start := strconv.FormatInt(g.StartedAt.UnixNano(), 10)
+	end := strconv.FormatInt(g.FinishedAt.UnixNano(), 10)
+
+	var events []otlpEvent
+	for _, msg := range g.Prompt {
+		content, _ := json.Marshal(exportMessage(msg))
+		events = append(events, otlpEvent{
+			TimeUnixNano: start,
+			Name:         "gen_ai." + string(msg.Role) + ".message",
+			Attributes:   []otlpAttribute{otlpString("content", string(content))},
+		})
+	}
+	choice, _ := json.Marshal(exportMessage(g.Response))
+	events = append(events, otlpEvent{
+		TimeUnixNano: end,
+		Name:         "gen_ai.choice",
+		Attributes:   []otlpAttribute{otlpString("content", string(choice))},
+	})
+
+	status := otlpStatus{Code: otlpStatusCodeOK}
+	if g.Error != "" {
+		status = otlpStatus{Code: otlpStatusCodeError, Message: g.Error}
+	}
+
+	span := otlpSpan{
+		// The generation ID is a UUID, whose 16 bytes are a valid trace ID.
+		TraceID:           strings.ReplaceAll(g.ID, "-", ""),
+		SpanID:            hex.EncodeToString(spanID),
+		Name:              strings.TrimSpace("chat " + g.Model),
+		Kind:              otlpSpanKindClient,
+		StartTimeUnixNano: start,
+		EndTimeUnixNano:   end,
+		Attributes: []otlpAttribute{
+			otlpString("gen_ai.operation.name", "chat"),
+			otlpString("gen_ai.request.model", g.Model),
+			otlpString("gen_ai.conversation.id", g.ChatID),
+			otlpInt("gen_ai.usage.input_tokens", g.InputTokens),
+			otlpInt("gen_ai.usage.output_tokens", g.OutputTokens),
+		},
+		Events: events,
+		Status: status,
+	}
+	if stats := g.Response.Stats; stats != nil {
+		// The time to first token is named after the metric of the GenAI semantic conventions.
+		span.Attributes = append(span.Attributes,
+			otlpDouble("gen_ai.server.time_to_first_token", stats.TimeToFirstToken.Seconds()),
+			otlpDouble("gen_ai.server.tokens_per_second", stats.TokensPerSecond))
+	}
+
+	payload := map[string]any{
+		"resourceSpans": []any{
+			map[string]any{
+				"resource": map[string]any{
+					"attributes": []otlpAttribute{otlpString("service.name", "mcp-web-ui")},
+				},
+				"scopeSpans": []any{
+					map[string]any{
+						"scope": map[string]any{"name": "mcp-web-ui"},
+						"spans": []otlpSpan{span},
+					},
+				},
+			},
+		},
+	}
+
+	go func() {
+		if err := postExport(ctx, o.client, o.endpoint, o.headers, payload); err != nil {
+			o.logger.ErrorContext(ctx, "Failed to export generation",
+				slog.String("generationID", g.ID),
+				slog.String("err", err.Error()))
+		}
+	}()
+}
@@ -1,5 +1,11 @@
 package services
 
+import (
+	"context"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
 // LLMParameters contains the optional configuration parameters for LLM services.
 //
 // Not all parameters are supported by all LLM providers. The parameters are documented in the
@@ -25,3 +31,30 @@ type LLMParameters struct {
 	Stop              []string       `yaml:"stop"`
 	IncludeReasoning  *bool          `yaml:"includeReasoning"`
 }
+
+// withChat returns p overridden by the chat parameters carried by ctx.
+func (p LLMParameters) withChat(ctx context.Context) LLMParameters {
+	c := models.ChatParametersFromContext(ctx)
+	if c.Temperature != nil {
+		p.Temperature = c.Temperature
+	}
+	if c.TopP != nil {
+		p.TopP = c.TopP
+	}
+	if c.TopK != nil {
+		p.TopK = c.TopK
+	}
+	if c.MaxTokens != nil {
+		p.MaxTokens = c.MaxTokens
+	}
+	if c.Seed != nil {
+		p.Seed = c.Seed
+	}
+	if c.Stop != nil {
+		p.Stop = c.Stop
+	}
+	if c.LogitBias != nil {
+		p.LogitBias = c.LogitBias
+	}
+	return p
+}
@@ -0,0 +1,445 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/tmaxmax/go-sse"
+)
+
+// ProviderOption configures the optional features of the LLM providers.
+type ProviderOption func(*providerOptions)
+
+type providerOptions struct {
+	httpClient   *http.Client
+	egressPolicy *EgressPolicy
+	cassette     *Cassette
+	systemRole   SystemRole
+	// toolEmulation emulates the tool calls in the text of the messages.
+	toolEmulation bool
+}
+
+// SystemRole is the placement of the system prompt in the messages sent to a chat completion API, for the
+// models refusing the messages of the system role.
+type SystemRole string
+
+const (
+	// SystemRoleSystem sends the system prompt as a message of the system role, the default.
+	SystemRoleSystem SystemRole = "system"
+	// SystemRoleDeveloper sends the system prompt as a message of the developer role, like the OpenAI
+	// reasoning models take it.
+	SystemRoleDeveloper SystemRole = "developer"
+	// SystemRolePrepend prepends the system prompt to the first user message, for the models taking no
+	// instructions apart.
+	SystemRolePrepend SystemRole = "prepend-to-user"
+)
+
+// ProviderCapabilities are the features of the API of an LLM provider, which the shared provider core
+// adapts the requests to.
+type ProviderCapabilities struct {
+	// Tools reports whether the provider calls tools. The tools aren't sent to the providers without it.
+	Tools bool
+	// ToolEmulation reports whether the tool calls are emulated, the tools being described in the system
+	// prompt and called in the text of the responses, for the models without native function calling. The
+	// providers emulating the tool calls don't have Tools.
+	ToolEmulation bool
+	// Vision reports whether the provider accepts images in the messages, for the callers offering them.
+	Vision bool
+	// SystemRole is the placement of the system prompt, a message of the system or the developer role, or
+	// prepended to the first user message. It's empty for the providers taking the system prompt apart.
+	SystemRole SystemRole
+}
+
+// maxOpenAIStopSequences is the number of stop sequences taken by the OpenAI API.
+const maxOpenAIStopSequences = 4
+
+// unsupportedParameter returns the error of a chat parameter the API of provider doesn't take.
+func unsupportedParameter(provider, name string) error {
+	return fmt.Errorf("%s doesn't support the %s parameter", provider, name)
+}
+
+// chatMessage is a message of the chat completion APIs, which holds a single text, tool call, tool result
+// or image, unlike models.Message.
+type chatMessage struct {
+	Role string
+	// Text is the text of the message, or the result of a tool result message.
+	Text string
+	// ToolCall is the tool call of an assistant message, nil for the other messages.
+	ToolCall *models.Content
+	// ToolCallID is the ID of the tool call a tool result message answers.
+	ToolCallID string
+	// Image is the image of a user message, nil for the other messages.
+	Image *models.Content
+}
+
+// chatStream is the state of a response streamed by a provider. The text is yielded as it's streamed,
+// while the tool call and the finish reason are accumulated and yielded once the response ends, the partial
+// input of the tool call being yielded as it's streamed too. Only the
+// first tool call of a response is supported, the others are ignored.
+type chatStream struct {
+	ctx    context.Context
+	yield  func(models.Content, error) bool
+	logger *slog.Logger
+	// stopped reports whether the consumer stopped the stream or an error ended it, nothing being yielded
+	// after.
+	stopped bool
+
+	toolUse   bool
+	toolIndex int
+	toolCall  models.Content
+	toolArgs  strings.Builder
+
+	finishReason models.FinishReason
+	refused      bool
+
+	// toolEmulation parses the emulated tool call out of the text, holding the text that may be the start
+	// of a tool call in heldText.
+	toolEmulation bool
+	heldText      string
+}
+
+const roleTool = "tool"
+
+// unseenImageNote replaces the images of the user messages for the providers without Vision, so the LLM knows
+// the user attached something it can't see.
+const unseenImageNote = "[The user attached an image, which can't be shown to this model.]"
+
+// WithHTTPClient sets the HTTP client the provider sends its requests with, such as a client created by
+// NewHTTPClient. The providers use a client created by NewHTTPClient with the default settings otherwise.
+func WithHTTPClient(client *http.Client) ProviderOption {
+	return func(o *providerOptions) {
+		o.httpClient = client
+	}
+}
+
+// WithSystemRole sets the placement of the system prompt of the chat completion APIs, for the models refusing
+// the messages of the system role. It's SystemRoleSystem by default, and the providers taking the system
+// prompt apart ignore it.
+func WithSystemRole(role SystemRole) ProviderOption {
+	return func(o *providerOptions) {
+		o.systemRole = role
+	}
+}
+
+// WithCassette records or replays the requests of the provider with cassette, which sends them with the
+// HTTP client of the provider.
+func WithCassette(cassette *Cassette) ProviderOption {
+	return func(o *providerOptions) {
+		o.cassette = cassette
+	}
+}
+
+func newProviderOptions(options []ProviderOption) providerOptions {
+	var opts providerOptions
+	for _, opt := range options {
+		opt(&opts)
+	}
+	if opts.systemRole == "" {
+		opts.systemRole = SystemRoleSystem
+	}
+	if opts.httpClient == nil {
+		// The default settings are valid.
+		opts.httpClient, _ = NewHTTPClient(HTTPSettings{})
+	}
+	if opts.egressPolicy != nil {
+		opts.httpClient = opts.egressPolicy.Client(opts.httpClient)
+	}
+	if opts.cassette != nil {
+		opts.httpClient = opts.cassette.Wrap(opts.httpClient)
+	}
+	return opts
+}
+
+// chatMessages returns messages as the messages of the chat completion APIs, a message per content. The
+// system prompt is the first message if the provider sends it with the system or the developer role, or is
+// prepended to the first user message otherwise. The images are replaced by a note for the providers without
+// Vision. For the providers emulating the tool calls, tools are described in the system prompt, and the tool
+// calls and their results are written as texts.
+func chatMessages(
+	systemPrompt string,
+	messages []models.Message,
+	tools []mcp.Tool,
+	caps ProviderCapabilities,
+) []chatMessage {
+	if caps.ToolEmulation {
+		systemPrompt = withEmulatedTools(systemPrompt, tools)
+	}
+	msgs := make([]chatMessage, 0, len(messages)+1)
+	systemRole := caps.SystemRole == SystemRoleSystem || caps.SystemRole == SystemRoleDeveloper
+	if systemRole {
+		msgs = append(msgs, chatMessage{Role: string(caps.SystemRole), Text: systemPrompt})
+	}
+	for _, msg := range messages {
+		for _, ct := range msg.Contents {
+			switch ct.Type {
+			case models.ContentTypeText:
+				if ct.Text != "" {
+					msgs = append(msgs, chatMessage{Role: string(msg.Role), Text: ct.Text})
+				}
+			case models.ContentTypeCallTool, models.ContentTypeToolResult:
+				switch {
+				case caps.ToolEmulation:
+					msgs = append(msgs, emulatedToolMessage(ct))
+				case ct.Type == models.ContentTypeCallTool:
+					msgs = append(msgs, chatMessage{Role: string(models.RoleAssistant), ToolCall: &ct})
+				default:
+					msgs = append(msgs, chatMessage{Role: roleTool, Text: ct.LLMToolResult(), ToolCallID: ct.CallToolID})
+				}
+			case models.ContentTypeImage:
+				if caps.Vision {
+					msgs = append(msgs, chatMessage{Role: string(msg.Role), Image: &ct})
+				} else {
+					msgs = append(msgs, chatMessage{Role: string(msg.Role), Text: unseenImageNote})
+				}
+			}
+		}
+	}
+	if systemRole || systemPrompt == "" {
+		return msgs
+	}
+	for i, msg := range msgs {
+		if msg.Role == string(models.RoleUser) {
+			msgs[i].Text = systemPrompt + "\n\n" + msg.Text
+			break
+		}
+	}
+	return msgs
+}
+
+// titleMessages returns the messages of the generation of the title of a chat from its first message.
+func titleMessages(message string) []models.Message {
+	return []models.Message{{
+		Role:     models.RoleUser,
+		Contents: []models.Content{{Type: models.ContentTypeText, Text: message}},
+	}}
+}
+
+// withTitleLanguage returns ctx carrying the instruction to write the title of a chat in language, or ctx if
+// language is empty.
+func withTitleLanguage(ctx context.Context, language string) context.Context {
+	if language == "" {
+		return ctx
+	}
+	return models.WithSystemPrompt(ctx, fmt.Sprintf("Write the title in %s.", language))
+}
+
+// chatTools returns the tools sent to a provider with caps, none if it doesn't call tools.
+func chatTools(tools []mcp.Tool, caps ProviderCapabilities) []mcp.Tool {
+	if !caps.Tools {
+		return nil
+	}
+	return tools
+}
+
+// postJSON sends body as JSON to url with headers, and returns the response if its status is OK. The body is
+// given to the request recorder of ctx.
+func postJSON(
+	ctx context.Context,
+	client *http.Client,
+	logger *slog.Logger,
+	url string,
+	headers map[string]string,
+	body any,
+) (*http.Response, error) {
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	logger.DebugContext(ctx, "Request Body", slog.String("body", string(jsonBody)))
+	models.RecordRequest(ctx, jsonBody)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code: %d, body: %s, request: %s", resp.StatusCode, string(body), jsonBody)
+	}
+	return resp, nil
+}
+
+// probeStatus sends a GET request to url with headers, and returns the status code of the response, for the
+// setup checks of the providers.
+func probeStatus(ctx context.Context, client *http.Client, url string, headers map[string]string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error creating request: %w", err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// streamChat returns the iterator of a response streamed by a provider with caps, which stream runs on a
+// chatStream. The tool call and the finish reason are yielded once stream returns.
+func streamChat(
+	ctx context.Context,
+	logger *slog.Logger,
+	caps ProviderCapabilities,
+	stream func(s *chatStream),
+) iter.Seq2[models.Content, error] {
+	return func(yield func(models.Content, error) bool) {
+		s := &chatStream{ctx: ctx, yield: yield, logger: logger, toolEmulation: caps.ToolEmulation}
+		stream(s)
+		s.end()
+	}
+}
+
+func (s *chatStream) emit(content models.Content, err error) bool {
+	if s.stopped {
+		return false
+	}
+	if !s.yield(content, err) || err != nil {
+		s.stopped = true
+	}
+	return !s.stopped
+}
+
+// fail ends the stream with err.
+func (s *chatStream) fail(err error) {
+	s.emit(models.Content{}, err)
+}
+
+// text yields a text chunk of the response, and reports whether the stream goes on. The emulated tool calls
+// are parsed out of it.
+func (s *chatStream) text(text string) bool {
+	if s.toolEmulation {
+		return s.emulatedText(text)
+	}
+	return s.plainText(text)
+}
+
+// plainText yields a text chunk of the response as it is, and reports whether the stream goes on.
+func (s *chatStream) plainText(text string) bool {
+	if text == "" {
+		return !s.stopped
+	}
+	return s.emit(models.Content{Type: models.ContentTypeText, Text: text}, nil)
+}
+
+// refusal yields a chunk of the refusal of the model, streamed apart from its text by some providers, as
+// text, the response finishing as refused. It reports whether the stream goes on.
+func (s *chatStream) refusal(text string) bool {
+	if text == "" {
+		return !s.stopped
+	}
+	s.refused = true
+	return s.text(text)
+}
+
+// toolCallDelta accumulates a part of the tool call at index of the response. The ID and the name are
+// given by the first part of a tool call, the arguments being concatenated. The arguments accumulated so far
+// are yielded as they're streamed, and the stream goes on if it returns true.
+func (s *chatStream) toolCallDelta(index int, id, name, args string) bool {
+	if !s.toolUse {
+		s.toolUse = true
+		s.toolIndex = index
+		s.toolCall = models.Content{
+			Type:       models.ContentTypeCallTool,
+			ToolName:   name,
+			CallToolID: id,
+		}
+	}
+	if index != s.toolIndex {
+		if name != "" {
+			s.logger.WarnContext(s.ctx, "Received multiples tool call, but only the first one is supported",
+				slog.String("tool", name))
+		}
+		return !s.stopped
+	}
+	if args == "" {
+		return !s.stopped
+	}
+	s.toolArgs.WriteString(args)
+	return s.emit(models.Content{
+		Type:       models.ContentTypeCallToolDelta,
+		ToolName:   s.toolCall.ToolName,
+		CallToolID: s.toolCall.CallToolID,
+		ToolInput:  json.RawMessage(s.toolArgs.String()),
+	}, nil)
+}
+
+// finish records the reason the provider gave for ending the response.
+func (s *chatStream) finish(reason models.FinishReason) {
+	if reason != "" {
+		s.finishReason = reason
+	}
+}
+
+// decode unmarshals the data of the event ev into v, failing the stream if it's invalid.
+func (s *chatStream) decode(ev sse.Event, v any, what string) bool {
+	if err := json.Unmarshal([]byte(ev.Data), v); err != nil {
+		s.fail(fmt.Errorf("error unmarshaling %s: %w", what, err))
+		return false
+	}
+	return true
+}
+
+// readEvents calls handle with the events of the SSE stream of body, until handle returns false or the
+// stream ends. A read error fails the stream.
+func (s *chatStream) readEvents(body io.Reader, handle func(ev sse.Event) bool) {
+	for ev, err := range sse.Read(body, nil) {
+		if err != nil {
+			s.fail(fmt.Errorf("error reading response: %w", err))
+			return
+		}
+		s.logger.DebugContext(s.ctx, "Received event", slog.String("event", ev.Data))
+		if !handle(ev) {
+			return
+		}
+	}
+}
+
+// end yields the tool call of the response, or its finish reason if it has none.
+func (s *chatStream) end() {
+	s.flushEmulatedText()
+	if s.toolUse {
+		args := s.toolArgs.String()
+		if args == "" {
+			args = "{}"
+		}
+		s.logger.DebugContext(s.ctx, "Call Tool",
+			slog.String("name", s.toolCall.ToolName),
+			slog.String("args", args),
+		)
+		s.toolCall.ToolInput = json.RawMessage(args)
+		s.emit(s.toolCall, nil)
+		return
+	}
+	reason := s.finishReason
+	if s.refused {
+		reason = models.FinishReasonRefusal
+	}
+	if reason != "" {
+		s.emit(models.Content{Type: models.ContentTypeFinish, FinishReason: reason}, nil)
+	}
+}
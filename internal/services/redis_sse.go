@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tmaxmax/go-sse"
+)
+
+// RedisSSEProvider is an sse.Provider fanning the SSE events out to the replicas of the web UI through the
+// pub/sub of a Redis server, so the events published by a replica reach the clients connected to the other
+// ones. Every event is published to Redis, and the events received from Redis, the ones of this replica
+// included, are published to the subscribers connected to this replica, which keeps their order.
+type RedisSSEProvider struct {
+	client  *redis.Client
+	channel string
+	logger  *slog.Logger
+
+	local  *sse.Joe
+	pubsub *redis.PubSub
+	done   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// redisSSEEvent is an SSE event as it's published to Redis.
+type redisSSEEvent struct {
+	Topics  []string `json:"topics"`
+	Message string   `json:"message"`
+}
+
+// NewSSEProvider creates the RedisSSEProvider of the replicas sharing the Redis server of r, whose events are
+// published to the "sse" channel under the key prefix of r. It subscribes to the channel until Shutdown.
+func (r Redis) NewSSEProvider(ctx context.Context, logger *slog.Logger) (*RedisSSEProvider, error) {
+	p := &RedisSSEProvider{
+		client:  r.client,
+		channel: r.key("sse"),
+		logger:  logger.With(slog.String("module", "redis-sse")),
+		local:   &sse.Joe{},
+		done:    make(chan struct{}),
+	}
+	p.pubsub = r.client.Subscribe(ctx, p.channel)
+	// The subscription is confirmed before returning, so the events published after are received.
+	if _, err := p.pubsub.Receive(ctx); err != nil {
+		_ = p.pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", p.channel, err)
+	}
+	go p.forward()
+	return p, nil
+}
+
+// Subscribe implements sse.Provider.
+func (p *RedisSSEProvider) Subscribe(ctx context.Context, subscription sse.Subscription) error {
+	return p.local.Subscribe(ctx, subscription)
+}
+
+// Publish implements sse.Provider, publishing message to Redis.
+func (p *RedisSSEProvider) Publish(message *sse.Message, topics []string) error {
+	if len(topics) == 0 {
+		return sse.ErrNoTopic
+	}
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return sse.ErrProviderClosed
+	}
+
+	text, err := message.MarshalText()
+	if err != nil {
+		return fmt.Errorf("failed to marshal sse message: %w", err)
+	}
+	payload, err := json.Marshal(redisSSEEvent{Topics: topics, Message: string(text)})
+	if err != nil {
+		return fmt.Errorf("failed to marshal sse event: %w", err)
+	}
+	if err := p.client.Publish(context.Background(), p.channel, payload).Err(); err != nil {
+		return fmt.Errorf("failed to publish sse event: %w", err)
+	}
+	return nil
+}
+
+// Shutdown implements sse.Provider, unsubscribing from Redis and closing the connections of the subscribers.
+func (p *RedisSSEProvider) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return sse.ErrProviderClosed
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	if err := p.pubsub.Close(); err != nil {
+		p.logger.Warn("Failed to close the subscription", slog.String("err", err.Error()))
+	}
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return p.local.Shutdown(ctx)
+}
+
+// forward publishes the events received from Redis to the local subscribers, until the subscription is
+// closed.
+func (p *RedisSSEProvider) forward() {
+	defer close(p.done)
+
+	for msg := range p.pubsub.Channel() {
+		var event redisSSEEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			p.logger.Warn("Received an invalid sse event", slog.String("err", err.Error()))
+			continue
+		}
+		message := &sse.Message{}
+		if err := message.UnmarshalText([]byte(event.Message)); err != nil {
+			p.logger.Warn("Received an invalid sse message", slog.String("err", err.Error()))
+			continue
+		}
+		if err := p.local.Publish(message, event.Topics); err != nil {
+			p.logger.Warn("Failed to publish sse event", slog.String("err", err.Error()))
+		}
+	}
+}
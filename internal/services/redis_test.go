@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/tmaxmax/go-sse"
+)
+
+func openTestRedis(t *testing.T, mr *miniredis.Miniredis, options ...RedisOption) Redis {
+	t.Helper()
+	r, err := NewRedis(context.Background(), "redis://"+mr.Addr(), options...)
+	if err != nil {
+		t.Fatalf("NewRedis() error = %v", err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+	return r
+}
+
+func TestRedisStoreContract(t *testing.T) {
+	testStoreContract(t, func(t *testing.T) storeBackend {
+		mr := miniredis.RunT(t)
+		return storeBackend{
+			open: func(t *testing.T, key []byte) contractStore {
+				return openTestRedis(t, mr, WithRedisEncryptionKey(key))
+			},
+			values: func(t *testing.T) [][]byte {
+				var values [][]byte
+				for _, k := range mr.Keys() {
+					switch mr.Type(k) {
+					case "hash":
+						fields, err := mr.HKeys(k)
+						if err != nil {
+							t.Fatal(err)
+						}
+						for _, f := range fields {
+							values = append(values, []byte(mr.HGet(k, f)))
+						}
+					case "string":
+						v, err := mr.Get(k)
+						if err != nil {
+							t.Fatal(err)
+						}
+						values = append(values, []byte(v))
+					}
+				}
+				return values
+			},
+		}
+	})
+}
+
+func TestRedisKeyPrefix(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	a := openTestRedis(t, mr, WithRedisKeyPrefix("a:"))
+	b := openTestRedis(t, mr, WithRedisKeyPrefix("b:"))
+
+	if _, err := a.AddChat(ctx, models.Chat{ID: "chat"}); err != nil {
+		t.Fatalf("AddChat() error = %v", err)
+	}
+	if chats, err := b.Chats(ctx); err != nil || len(chats) != 0 {
+		t.Errorf("Chats() of another prefix = %v, %v, want none", chats, err)
+	}
+	if chats, err := a.Chats(ctx); err != nil || len(chats) != 1 {
+		t.Errorf("Chats() = %v, %v, want the chat", chats, err)
+	}
+}
+
+// sseRecorder is an sse.MessageWriter keeping the messages it's sent.
+type sseRecorder struct {
+	mu       sync.Mutex
+	messages []*sse.Message
+}
+
+func (r *sseRecorder) Send(m *sse.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, m)
+	return nil
+}
+
+func (r *sseRecorder) Flush() error {
+	return nil
+}
+
+func (r *sseRecorder) received() []*sse.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.messages
+}
+
+func TestRedisSSEProvider(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	publisher, err := openTestRedis(t, mr).NewSSEProvider(ctx, slog.Default())
+	if err != nil {
+		t.Fatalf("NewSSEProvider() error = %v", err)
+	}
+	subscriber, err := openTestRedis(t, mr).NewSSEProvider(ctx, slog.Default())
+	if err != nil {
+		t.Fatalf("NewSSEProvider() error = %v", err)
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	recorder := &sseRecorder{}
+	done := make(chan error, 1)
+	go func() {
+		done <- subscriber.Subscribe(subCtx, sse.Subscription{Client: recorder, Topics: []string{"chat-1"}})
+	}()
+
+	// The subscription is registered asynchronously, so the event is published until it's received.
+	deadline := time.Now().Add(5 * time.Second)
+	for ; len(recorder.received()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the event published on the other provider isn't received")
+		}
+		other := &sse.Message{}
+		other.AppendData("other")
+		if err := publisher.Publish(other, []string{"chat-2"}); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+		message := &sse.Message{Type: sse.Type("chat")}
+		message.AppendData("hello")
+		if err := publisher.Publish(message, []string{"chat-1"}); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	for _, m := range recorder.received() {
+		if text, _ := m.MarshalText(); string(text) != "event: chat\ndata: hello\n\n" {
+			t.Errorf("received event = %q, want only the events of the subscribed topic", text)
+		}
+	}
+
+	cancel()
+	<-done
+	if err := publisher.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if err := subscriber.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if err := publisher.Publish(&sse.Message{}, []string{"chat-1"}); !errors.Is(err, sse.ErrProviderClosed) {
+		t.Errorf("Publish() after Shutdown() error = %v, want %v", err, sse.ErrProviderClosed)
+	}
+}
@@ -0,0 +1,337 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+// contractStore is the part of the stores the contract tests cover.
+type contractStore interface {
+	Chats(ctx context.Context) ([]models.Chat, error)
+	AddChat(ctx context.Context, chat models.Chat) (string, error)
+	CopyChat(ctx context.Context, chatID string, chat models.Chat) (string, error)
+	Messages(ctx context.Context, chatID string) ([]models.Message, error)
+	MessagesSince(ctx context.Context, chatID string, since time.Time) ([]models.Message, error)
+	AddMessage(ctx context.Context, chatID string, message models.Message) (string, error)
+
+	UserUsages(ctx context.Context, userID string) ([]models.Usage, error)
+	AddUsage(ctx context.Context, usage models.Usage) error
+	APITokens(ctx context.Context, userID string) ([]models.APIToken, error)
+	AddAPIToken(ctx context.Context, token models.APIToken) error
+	Sessions(ctx context.Context, userID string) ([]models.Session, error)
+	SaveSession(ctx context.Context, session models.Session) error
+	Memories(ctx context.Context, userID string) ([]models.Memory, error)
+	SaveMemory(ctx context.Context, memory models.Memory) error
+	ReadReceipts(ctx context.Context, userID string) ([]models.ReadReceipt, error)
+	SaveReadReceipt(ctx context.Context, receipt models.ReadReceipt) error
+	DeleteUserData(ctx context.Context, userID string) error
+}
+
+// storeBackend is the data of a store under the contract tests.
+type storeBackend struct {
+	// open opens the store of the data with the encryption key, closing the store it opened before.
+	open func(t *testing.T, key []byte) contractStore
+	// values returns all the values stored in the data.
+	values func(t *testing.T) [][]byte
+}
+
+// testStoreContract runs the contract tests of the stores, each on the data of a new backend.
+func testStoreContract(t *testing.T, newBackend func(t *testing.T) storeBackend) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, backend storeBackend)
+	}{
+		{"order", testStoreOrder},
+		{"copy chat", testStoreCopyChat},
+		{"delete user data", testStoreDeleteUserData},
+		{"encryption", testStoreEncryption},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newBackend(t))
+		})
+	}
+}
+
+func testStoreOrder(t *testing.T, backend storeBackend) {
+	ctx := context.Background()
+	s := backend.open(t, nil)
+
+	var chatIDs []string
+	for i := range recordCount {
+		id, err := s.AddChat(ctx, models.Chat{ID: fmt.Sprintf("chat%d", i)})
+		if err != nil {
+			t.Fatalf("AddChat() error = %v", err)
+		}
+		chatIDs = append(chatIDs, id)
+	}
+	chats, err := s.Chats(ctx)
+	if err != nil {
+		t.Fatalf("Chats() error = %v", err)
+	}
+	slices.Reverse(chatIDs)
+	if got := chatIDsOf(chats); !slices.Equal(got, chatIDs) {
+		t.Errorf("Chats() = %v, want the newest first %v", got, chatIDs)
+	}
+
+	// The messages are added with decreasing timestamps, so the order they were added in and the order of
+	// their timestamps are reversed.
+	chatID := chatIDs[0]
+	base := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	var msgIDs []string
+	for i := range recordCount {
+		id, err := s.AddMessage(ctx, chatID, models.Message{
+			ID:        fmt.Sprintf("msg%d", i),
+			Role:      models.RoleUser,
+			Timestamp: base.Add(time.Duration(recordCount-i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("AddMessage() error = %v", err)
+		}
+		msgIDs = append(msgIDs, id)
+	}
+	messages, err := s.Messages(ctx, chatID)
+	if err != nil {
+		t.Fatalf("Messages() error = %v", err)
+	}
+	if got := messageIDsOf(messages); !slices.Equal(got, msgIDs) {
+		t.Errorf("Messages() = %v, want the order they were added %v", got, msgIDs)
+	}
+
+	since, err := s.MessagesSince(ctx, chatID, base.Add(3*time.Minute))
+	if err != nil {
+		t.Fatalf("MessagesSince() error = %v", err)
+	}
+	want := slices.Clone(msgIDs[:recordCount-2])
+	slices.Reverse(want)
+	if got := messageIDsOf(since); !slices.Equal(got, want) {
+		t.Errorf("MessagesSince() = %v, want the messages from the 3rd minute by timestamp %v", got, want)
+	}
+}
+
+func testStoreCopyChat(t *testing.T, backend storeBackend) {
+	ctx := context.Background()
+	s := backend.open(t, nil)
+
+	if _, err := s.CopyChat(ctx, "1-missing", models.Chat{ID: "copy"}); err == nil {
+		t.Error("CopyChat() of a chat that doesn't exist should return an error")
+	}
+
+	srcID, err := s.AddChat(ctx, models.Chat{ID: "src", Title: "Source"})
+	if err != nil {
+		t.Fatalf("AddChat() error = %v", err)
+	}
+	base := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	var srcMessages []models.Message
+	for i := range recordCount {
+		message := models.Message{
+			ID:        fmt.Sprintf("msg%d", i),
+			Role:      models.RoleUser,
+			Contents:  []models.Content{{Type: models.ContentTypeText, Text: fmt.Sprintf("Message %d", i)}},
+			Timestamp: base.Add(time.Duration(i) * time.Minute),
+		}
+		// The last message replies to the first one.
+		if i == recordCount-1 {
+			message.ParentID = srcMessages[0].ID
+		}
+		if message.ID, err = s.AddMessage(ctx, srcID, message); err != nil {
+			t.Fatalf("AddMessage() error = %v", err)
+		}
+		srcMessages = append(srcMessages, message)
+	}
+
+	copyID, err := s.CopyChat(ctx, srcID, models.Chat{ID: "copy", Title: "Copy"})
+	if err != nil {
+		t.Fatalf("CopyChat() error = %v", err)
+	}
+	if copyID == srcID {
+		t.Fatalf("CopyChat() = %s, want a new chat", copyID)
+	}
+	copied, err := s.Messages(ctx, copyID)
+	if err != nil {
+		t.Fatalf("Messages() of the copy error = %v", err)
+	}
+	if len(copied) != len(srcMessages) {
+		t.Fatalf("Messages() of the copy = %d messages, want %d", len(copied), len(srcMessages))
+	}
+	for i, message := range copied {
+		src := srcMessages[i]
+		if message.ID == src.ID || message.Contents[0].Text != src.Contents[0].Text ||
+			!message.Timestamp.Equal(src.Timestamp) {
+			t.Errorf("copied message %d = %+v, want a copy of %+v with a new ID", i, message, src)
+		}
+	}
+	if got := copied[recordCount-1].ParentID; got != copied[0].ID {
+		t.Errorf("ParentID of the copied reply = %q, want the copied parent %q", got, copied[0].ID)
+	}
+	since, err := s.MessagesSince(ctx, copyID, base.Add(time.Duration(recordCount-2)*time.Minute))
+	if err != nil || len(since) != 2 {
+		t.Errorf("MessagesSince() of the copy = %d messages, %v, want the last 2", len(since), err)
+	}
+
+	srcAfter, err := s.Messages(ctx, srcID)
+	if err != nil {
+		t.Fatalf("Messages() of the source error = %v", err)
+	}
+	if got, want := messageIDsOf(srcAfter), messageIDsOf(srcMessages); !slices.Equal(got, want) {
+		t.Errorf("Messages() of the source after the copy = %v, want %v", got, want)
+	}
+}
+
+func testStoreDeleteUserData(t *testing.T, backend storeBackend) {
+	ctx := context.Background()
+	s := backend.open(t, nil)
+
+	for _, userID := range []string{"alice", "bob"} {
+		chatID, err := s.AddChat(ctx, models.Chat{ID: "chat", UserID: userID})
+		if err != nil {
+			t.Fatalf("AddChat() error = %v", err)
+		}
+		if err := s.AddUsage(ctx, models.Usage{UserID: userID, Day: "2024-03-10", Messages: 1}); err != nil {
+			t.Fatalf("AddUsage() error = %v", err)
+		}
+		token := models.APIToken{ID: "t-" + userID, UserID: userID, Hash: "token-" + userID}
+		if err := s.AddAPIToken(ctx, token); err != nil {
+			t.Fatalf("AddAPIToken() error = %v", err)
+		}
+		session := models.Session{ID: "s-" + userID, UserID: userID, Hash: "session-" + userID}
+		if err := s.SaveSession(ctx, session); err != nil {
+			t.Fatalf("SaveSession() error = %v", err)
+		}
+		if err := s.SaveMemory(ctx, models.Memory{ID: "m-" + userID, UserID: userID, Text: "Fact"}); err != nil {
+			t.Fatalf("SaveMemory() error = %v", err)
+		}
+		if err := s.SaveReadReceipt(ctx, models.ReadReceipt{UserID: userID, ChatID: chatID}); err != nil {
+			t.Fatalf("SaveReadReceipt() error = %v", err)
+		}
+	}
+
+	if err := s.DeleteUserData(ctx, "alice"); err != nil {
+		t.Fatalf("DeleteUserData() error = %v", err)
+	}
+	for userID, want := range map[string]int{"alice": 0, "bob": 1} {
+		usages, err := s.UserUsages(ctx, userID)
+		if err != nil || len(usages) != want {
+			t.Errorf("UserUsages(%s) = %v, %v, want %d", userID, usages, err, want)
+		}
+		tokens, err := s.APITokens(ctx, userID)
+		if err != nil || len(tokens) != want {
+			t.Errorf("APITokens(%s) = %v, %v, want %d", userID, tokens, err, want)
+		}
+		sessions, err := s.Sessions(ctx, userID)
+		if err != nil || len(sessions) != want {
+			t.Errorf("Sessions(%s) = %v, %v, want %d", userID, sessions, err, want)
+		}
+		memories, err := s.Memories(ctx, userID)
+		if err != nil || len(memories) != want {
+			t.Errorf("Memories(%s) = %v, %v, want %d", userID, memories, err, want)
+		}
+		receipts, err := s.ReadReceipts(ctx, userID)
+		if err != nil || len(receipts) != want {
+			t.Errorf("ReadReceipts(%s) = %v, %v, want %d", userID, receipts, err, want)
+		}
+	}
+	// The chats of the user are deleted with DeleteChat.
+	if chats, err := s.Chats(ctx); err != nil || len(chats) != 2 {
+		t.Errorf("Chats() = %v, %v, want the chats kept", chats, err)
+	}
+}
+
+func testStoreEncryption(t *testing.T, backend storeBackend) {
+	ctx := context.Background()
+	s := backend.open(t, testEncryptionKey)
+
+	chatID, err := s.AddChat(ctx, models.Chat{ID: "chat", Title: "Secret title"})
+	if err != nil {
+		t.Fatalf("AddChat() error = %v", err)
+	}
+	message := models.Message{
+		ID:       "msg",
+		Role:     models.RoleUser,
+		Contents: []models.Content{{Type: models.ContentTypeText, Text: "Secret message"}},
+	}
+	if _, err := s.AddMessage(ctx, chatID, message); err != nil {
+		t.Fatalf("AddMessage() error = %v", err)
+	}
+	if err := s.SaveMemory(ctx, models.Memory{ID: "m1", UserID: "alice", Text: "Secret memory"}); err != nil {
+		t.Fatalf("SaveMemory() error = %v", err)
+	}
+	copyID, err := s.CopyChat(ctx, chatID, models.Chat{ID: "copy", Title: "Secret copy"})
+	if err != nil {
+		t.Fatalf("CopyChat() error = %v", err)
+	}
+
+	for _, v := range backend.values(t) {
+		if bytes.Contains(v, []byte("Secret")) {
+			t.Errorf("value %q is stored in plaintext", v)
+		}
+	}
+	chats, err := s.Chats(ctx)
+	if err != nil || len(chats) != 2 || chats[0].Title != "Secret copy" || chats[1].Title != "Secret title" {
+		t.Errorf("Chats() = %v, %v, want the decrypted chats", chats, err)
+	}
+	for _, id := range []string{chatID, copyID} {
+		messages, err := s.Messages(ctx, id)
+		if err != nil || len(messages) != 1 || messages[0].Contents[0].Text != "Secret message" {
+			t.Errorf("Messages(%s) = %v, %v, want the decrypted message", id, messages, err)
+		}
+	}
+	memories, err := s.Memories(ctx, "alice")
+	if err != nil || len(memories) != 1 || memories[0].Text != "Secret memory" {
+		t.Errorf("Memories() = %v, %v, want the decrypted memory", memories, err)
+	}
+
+	s = backend.open(t, otherEncryptionKey)
+	if _, err := s.Chats(ctx); err == nil {
+		t.Error("Chats() with the wrong key should return an error")
+	}
+	if _, err := s.Messages(ctx, chatID); err == nil {
+		t.Error("Messages() with the wrong key should return an error")
+	}
+	s = backend.open(t, nil)
+	if _, err := s.Memories(ctx, "alice"); err == nil {
+		t.Error("Memories() without a key should return an error")
+	}
+}
+
+func TestBoltDBStoreContract(t *testing.T) {
+	testStoreContract(t, func(t *testing.T) storeBackend {
+		path := filepath.Join(t.TempDir(), "store.db")
+		var current *BoltDB
+		return storeBackend{
+			open: func(t *testing.T, key []byte) contractStore {
+				if current != nil {
+					if err := current.db.db.Close(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				b := openTestBoltDB(t, path, WithBoltDBEncryptionKey(key))
+				current = &b
+				return b
+			},
+			values: func(t *testing.T) [][]byte {
+				var values [][]byte
+				err := current.db.db.View(func(tx *bolt.Tx) error {
+					return tx.ForEach(func(_ []byte, bucket *bolt.Bucket) error {
+						return bucket.ForEach(func(_, v []byte) error {
+							values = append(values, bytes.Clone(v))
+							return nil
+						})
+					})
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return values
+			},
+		}
+	})
+}
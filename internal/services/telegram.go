@@ -0,0 +1,264 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// TelegramConfig configures the Telegram bot of NewTelegramBridge.
+type TelegramConfig struct {
+	// Token is the token of the bot, given by @BotFather.
+	Token string
+	// AllowedUsers are the IDs or the usernames, without the @, of the Telegram users allowed to chat with the
+	// bot, or "*" for any user. The messages of the other users are ignored.
+	AllowedUsers []string
+	// PollTimeout is how long a request for the next messages waits for them, 30 seconds if it's zero.
+	PollTimeout time.Duration
+	// APIURL is the URL of the Bot API, https://api.telegram.org if it's empty, or the one of a local Bot API
+	// server.
+	APIURL string
+}
+
+// TelegramBridge is the bridge of a Telegram bot, whose private and group chats are mapped to the chats of
+// the web UI. It receives the messages with long polling, so the server doesn't need to be reachable by
+// Telegram, and streams the responses by editing its replies. The replies are sent as plain text, as the
+// Markdown of the LLMs isn't always valid for Telegram.
+type TelegramBridge struct {
+	cfg    TelegramConfig
+	client *http.Client
+	// offset is the ID of the next update to receive, only used by Receive, which isn't called concurrently.
+	offset int64
+
+	logger *slog.Logger
+}
+
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	MessageID int64 `json:"message_id"`
+	From      *struct {
+		ID       int64  `json:"id"`
+		Username string `json:"username"`
+	} `json:"from"`
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text string `json:"text"`
+}
+
+const (
+	defaultTelegramAPIURL      = "https://api.telegram.org"
+	defaultTelegramPollTimeout = 30 * time.Second
+
+	// telegramMaxMessageLength is the maximum length in characters of the text of a Telegram message, the
+	// longer replies being split.
+	telegramMaxMessageLength = 4096
+
+	telegramStartCommand = "/start"
+	telegramGreeting     = "Send a message to chat with the assistant, or /new to start a new chat."
+)
+
+// NewTelegramBridge creates the TelegramBridge of the bot of cfg.
+func NewTelegramBridge(cfg TelegramConfig, logger *slog.Logger) (*TelegramBridge, error) {
+	if cfg.Token == "" {
+		return nil, errors.New("bot token is required")
+	}
+	if len(cfg.AllowedUsers) == 0 {
+		return nil, errors.New("allowed users are required, use * to allow any user")
+	}
+	if cfg.APIURL == "" {
+		cfg.APIURL = defaultTelegramAPIURL
+	}
+	if _, err := url.Parse(cfg.APIURL); err != nil {
+		return nil, fmt.Errorf("invalid API URL: %w", err)
+	}
+	cfg.APIURL = strings.TrimSuffix(cfg.APIURL, "/")
+	if cfg.PollTimeout <= 0 {
+		cfg.PollTimeout = defaultTelegramPollTimeout
+	}
+	return &TelegramBridge{
+		cfg: cfg,
+		// The requests for the messages wait for them up to the poll timeout.
+		client: &http.Client{Timeout: cfg.PollTimeout + 30*time.Second},
+		logger: logger.With(slog.String("module", "telegram")),
+	}, nil
+}
+
+// Name implements handlers.Bridge.
+func (t *TelegramBridge) Name() string {
+	return "telegram"
+}
+
+// Receive implements handlers.Bridge, waiting for the next text messages of the allowed users. The /start
+// command sent by Telegram when a user opens the bot is answered with a greeting.
+func (t *TelegramBridge) Receive(ctx context.Context) ([]models.BridgeMessage, error) {
+	params := map[string]any{
+		"offset":          t.offset,
+		"timeout":         int(t.cfg.PollTimeout.Seconds()),
+		"allowed_updates": []string{"message"},
+	}
+	var updates []telegramUpdate
+	if err := t.call(ctx, "getUpdates", params, &updates); err != nil {
+		return nil, err
+	}
+
+	var msgs []models.BridgeMessage
+	for _, u := range updates {
+		t.offset = u.UpdateID + 1
+		m := u.Message
+		if m == nil || m.From == nil || strings.TrimSpace(m.Text) == "" {
+			continue
+		}
+		userID := strconv.FormatInt(m.From.ID, 10)
+		if !t.allowed(userID, m.From.Username) {
+			t.logger.WarnContext(ctx, "Ignored message of a user not allowed",
+				slog.String("userID", userID),
+				slog.String("username", m.From.Username))
+			continue
+		}
+		conversation := strconv.FormatInt(m.Chat.ID, 10)
+		if strings.TrimSpace(m.Text) == telegramStartCommand {
+			if _, err := t.send(ctx, conversation, telegramGreeting); err != nil {
+				t.logger.WarnContext(ctx, "Failed to send greeting", slog.String("err", err.Error()))
+			}
+			continue
+		}
+		msgs = append(msgs, models.BridgeMessage{Conversation: conversation, User: userID, Text: m.Text})
+	}
+	return msgs, nil
+}
+
+// Reply implements handlers.Bridge. The text of the reply is split into several messages if it's longer than
+// the limit of Telegram, the partial replies being cut at the limit.
+func (t *TelegramBridge) Reply(ctx context.Context, reply models.BridgeReply) (string, error) {
+	chunks := splitText(reply.Text, telegramMaxMessageLength)
+	if !reply.Final && len(chunks) > 1 {
+		chunks = chunks[:1]
+	}
+
+	id := reply.ID
+	if id == "" {
+		var err error
+		if id, err = t.send(ctx, reply.Conversation, chunks[0]); err != nil {
+			return "", err
+		}
+	} else if err := t.edit(ctx, reply.Conversation, id, chunks[0]); err != nil {
+		return "", err
+	}
+	for _, chunk := range chunks[1:] {
+		if _, err := t.send(ctx, reply.Conversation, chunk); err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+func (t *TelegramBridge) allowed(userID, username string) bool {
+	return slices.ContainsFunc(t.cfg.AllowedUsers, func(u string) bool {
+		return u == "*" || u == userID || (username != "" && strings.EqualFold(strings.TrimPrefix(u, "@"), username))
+	})
+}
+
+func (t *TelegramBridge) send(ctx context.Context, chatID, text string) (string, error) {
+	var msg telegramMessage
+	if err := t.call(ctx, "sendMessage", map[string]any{"chat_id": chatID, "text": text}, &msg); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(msg.MessageID, 10), nil
+}
+
+func (t *TelegramBridge) edit(ctx context.Context, chatID, messageID, text string) error {
+	params := map[string]any{"chat_id": chatID, "message_id": messageID, "text": text}
+	err := t.call(ctx, "editMessageText", params, nil)
+	// The text of a streamed reply may not change between two updates.
+	if err != nil && strings.Contains(err.Error(), "message is not modified") {
+		return nil
+	}
+	return err
+}
+
+// call calls the method of the Bot API with params, and decodes its result into result, if it's not nil.
+func (t *TelegramBridge) call(ctx context.Context, method string, params map[string]any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s params: %w", method, err)
+	}
+	u := fmt.Sprintf("%s/bot%s/%s", t.cfg.APIURL, t.cfg.Token, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %w", method, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		// The URL of the error contains the token of the bot.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("failed to call %s: %w", method, err)
+	}
+	defer res.Body.Close()
+
+	var tr telegramResponse
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return fmt.Errorf("failed to decode %s response with status %s: %w", method, res.Status, err)
+	}
+	if !tr.OK {
+		return fmt.Errorf("failed to call %s: %s", method, tr.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(tr.Result, result); err != nil {
+		return fmt.Errorf("failed to decode %s result: %w", method, err)
+	}
+	return nil
+}
+
+// splitText splits text into chunks of at most limit characters, preferably at line breaks. It returns a
+// single empty chunk if text is empty.
+func splitText(text string, limit int) []string {
+	runes := []rune(text)
+	var chunks []string
+	for len(runes) > limit {
+		cut := limit
+		if i := lastIndexRune(runes[:limit], '\n'); i > 0 {
+			cut = i + 1
+		}
+		chunks = append(chunks, string(runes[:cut]))
+		runes = runes[cut:]
+	}
+	return append(chunks, string(runes))
+}
+
+func lastIndexRune(runes []rune, r rune) int {
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"math"
+	"unicode"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// The average number of characters of the words per token of the tokenizers of the providers, in English
+// text. The tokenizers themselves aren't bundled, their vocabularies being large or not public.
+const (
+	// openAICharsPerToken is the average of the o200k_base and cl100k_base encodings of the GPT models.
+	openAICharsPerToken = 4.0
+	// anthropicCharsPerToken is the average of the tokenizer of the Claude models, which splits the words
+	// more than the GPT ones.
+	anthropicCharsPerToken = 3.5
+	// ollamaCharsPerToken is an average of the tokenizers of the open models, like Llama, Mistral and Qwen.
+	ollamaCharsPerToken = 3.7
+
+	// messageOverheadTokens is the number of tokens formatting the role and the boundaries of a message.
+	messageOverheadTokens = 4
+	// anthropicToolUseTokens is the number of tokens of the system prompt Anthropic adds to the requests with
+	// tools.
+	anthropicToolUseTokens = 346
+)
+
+// approxTokens approximates the number of tokens of text for a tokenizer averaging charsPerToken characters
+// per token in the words. The runs of Latin letters and digits are split in tokens of charsPerToken
+// characters, the whitespace being merged with the next word like the tokenizers do, and every other
+// character, like a punctuation mark or a CJK character, is a token of its own.
+func approxTokens(text string, charsPerToken float64) int {
+	tokens := 0
+	word := 0
+	flush := func() {
+		tokens += int(math.Ceil(float64(word) / charsPerToken))
+		word = 0
+	}
+	for _, r := range text {
+		switch {
+		case unicode.IsDigit(r) || unicode.In(r, unicode.Latin):
+			word++
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			flush()
+			tokens++
+		}
+	}
+	flush()
+	return tokens
+}
+
+// approxRequestTokens approximates the number of input tokens of a chat request for a tokenizer averaging
+// charsPerToken characters per token: the system prompt, the messages with their tool calls and results,
+// and the definitions of the tools.
+func approxRequestTokens(systemPrompt string, messages []models.Message, tools []mcp.Tool, charsPerToken float64) int {
+	count := func(text string) int {
+		return approxTokens(text, charsPerToken)
+	}
+
+	tokens := count(systemPrompt)
+	for _, msg := range messages {
+		tokens += messageOverheadTokens
+		for _, c := range msg.Contents {
+			tokens += count(c.Text) + count(c.ToolName) + count(string(c.ToolInput)) + count(string(c.ToolResult))
+		}
+	}
+	for _, tool := range tools {
+		tokens += count(tool.Name) + count(tool.Description) + count(string(tool.InputSchema))
+	}
+	return tokens
+}
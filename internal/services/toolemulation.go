@@ -0,0 +1,149 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// emulatedToolCall is a tool call written by a model in the text of its response, between the
+// toolCallOpenTag and toolCallCloseTag tags.
+type emulatedToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+const (
+	toolCallOpenTag  = "<tool_call>"
+	toolCallCloseTag = "</tool_call>"
+)
+
+// emulatedToolsPrompt is the protocol of the emulated tool calls, appended to the system prompt with the
+// tools.
+const emulatedToolsPrompt = `You can use tools to answer. To call a tool, think about which tool helps ` +
+	`and why, then write the call as a JSON object with the name of the tool and its arguments between ` +
+	toolCallOpenTag + ` and ` + toolCallCloseTag + ` tags, and stop writing, like:
+` + toolCallOpenTag + `{"name": "get_weather", "arguments": {"city": "Paris"}}` + toolCallCloseTag + `
+Call one tool at a time. Its result is given in the next message between <tool_result> and </tool_result> ` +
+	`tags, never write it yourself. Once you have the results you need, answer without a tool call.
+
+The tools are:`
+
+// WithToolEmulation emulates the tool calls for the models without native function calling, like the plain
+// local models. The tools are described in the system prompt with a protocol the model follows to call them
+// in the text of its responses, which the provider parses into tool calls, and their results are given back
+// as user messages. The providers calling the tools natively, like Anthropic, ignore it.
+func WithToolEmulation() ProviderOption {
+	return func(o *providerOptions) {
+		o.toolEmulation = true
+	}
+}
+
+// withEmulatedTools returns systemPrompt followed by the protocol of the emulated tool calls and tools, or
+// systemPrompt if there are no tools.
+func withEmulatedTools(systemPrompt string, tools []mcp.Tool) string {
+	if len(tools) == 0 {
+		return systemPrompt
+	}
+	var sb strings.Builder
+	if systemPrompt != "" {
+		sb.WriteString(systemPrompt + "\n\n")
+	}
+	sb.WriteString(emulatedToolsPrompt)
+	for _, tool := range tools {
+		schema := string(tool.InputSchema)
+		if schema == "" {
+			schema = "{}"
+		}
+		fmt.Fprintf(&sb, "\n- %s: %s\n  Arguments JSON schema: %s", tool.Name, tool.Description, schema)
+	}
+	return sb.String()
+}
+
+// emulatedToolMessage returns the tool call or the tool result ct as the text message of the protocol of the
+// emulated tool calls.
+func emulatedToolMessage(ct models.Content) chatMessage {
+	if ct.Type == models.ContentTypeCallTool {
+		call, _ := json.Marshal(emulatedToolCall{Name: ct.ToolName, Arguments: ct.ToolInput})
+		return chatMessage{
+			Role: string(models.RoleAssistant),
+			Text: toolCallOpenTag + string(call) + toolCallCloseTag,
+		}
+	}
+	// The result follows its call, as the tools are called one at a time.
+	tag := "<tool_result>"
+	if ct.CallToolFailed {
+		tag = `<tool_result error="true">`
+	}
+	return chatMessage{
+		Role: string(models.RoleUser),
+		Text: tag + "\n" + ct.LLMToolResult() + "\n</tool_result>",
+	}
+}
+
+// emulatedText parses the emulated tool call out of a text chunk of the response. The text before the tool
+// call is yielded, while the text that may be the start of a tool call is held until the next chunks tell.
+// It reports whether the stream goes on, which it doesn't once a tool call is parsed, as the model is asked to
+// stop writing after it.
+func (s *chatStream) emulatedText(text string) bool {
+	s.heldText += text
+	for {
+		start := strings.Index(s.heldText, toolCallOpenTag)
+		if start < 0 {
+			// The end of the text may be the start of the open tag.
+			keep := 0
+			for n := min(len(toolCallOpenTag)-1, len(s.heldText)); n > 0; n-- {
+				if strings.HasSuffix(s.heldText, toolCallOpenTag[:n]) {
+					keep = n
+					break
+				}
+			}
+			text := s.heldText[:len(s.heldText)-keep]
+			s.heldText = s.heldText[len(text):]
+			return s.plainText(text)
+		}
+		end := strings.Index(s.heldText[start:], toolCallCloseTag)
+		if end < 0 {
+			if !s.plainText(s.heldText[:start]) {
+				return false
+			}
+			s.heldText = s.heldText[start:]
+			return true
+		}
+
+		var call emulatedToolCall
+		body := s.heldText[start+len(toolCallOpenTag) : start+end]
+		if err := json.Unmarshal([]byte(body), &call); err != nil || call.Name == "" {
+			// It isn't a tool call, like the protocol explained by the model, so it's text.
+			text := s.heldText[:start+end+len(toolCallCloseTag)]
+			s.heldText = s.heldText[len(text):]
+			if !s.plainText(text) {
+				return false
+			}
+			continue
+		}
+		if !s.plainText(s.heldText[:start]) {
+			return false
+		}
+		s.heldText = ""
+		args := string(call.Arguments)
+		if args == "" || args == "null" {
+			args = "{}"
+		}
+		s.toolCallDelta(0, "call_"+uuid.NewString(), call.Name, args)
+		return false
+	}
+}
+
+// flushEmulatedText yields the held text, like the start of a tool call the model didn't finish, once the
+// response ends.
+func (s *chatStream) flushEmulatedText() {
+	if s.heldText != "" && !s.toolUse {
+		s.plainText(s.heldText)
+	}
+	s.heldText = ""
+}
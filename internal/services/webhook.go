@@ -0,0 +1,197 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/logging"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// Webhook is a single webhook target, receiving the events it's interested in as JSON POST requests.
+type Webhook struct {
+	URL string
+	// Events filters the events delivered to the webhook, all events are delivered if it's empty.
+	Events []models.EventType
+	// Secret is used to sign the payload with HMAC-SHA256, the signature is sent in the
+	// X-Webhook-Signature header as "sha256=<hex>". The payload is not signed if it's empty.
+	Secret string
+	// MaxRetries is the number of retries after the first failed delivery, with exponential backoff. Only the
+	// network errors and the responses with a 408, 429 or 5xx status are retried.
+	MaxRetries int
+}
+
+// Webhooks implements the Notifier interface by delivering the events to the configured webhooks. The
+// deliveries are asynchronous, so a slow or unavailable webhook target never blocks the chat.
+type Webhooks struct {
+	webhooks []Webhook
+
+	client         *http.Client
+	initialBackoff time.Duration
+
+	// closed is canceled by Close, which abandons the deliveries in progress.
+	closed context.Context
+	close  context.CancelFunc
+
+	logger *slog.Logger
+}
+
+// webhookStatusError is the error of a delivery answered with a status other than 2xx.
+type webhookStatusError struct {
+	code int
+	body string
+}
+
+const (
+	webhookTimeout        = 10 * time.Second
+	webhookInitialBackoff = time.Second
+	// webhookMaxBackoff caps the backoff doubled after every failed delivery, so that the retries of a
+	// large MaxRetries don't wait for hours.
+	webhookMaxBackoff = time.Minute
+)
+
+// errInvalidWebhookRequest is the error of a delivery whose request can't be created, which isn't retried.
+var errInvalidWebhookRequest = errors.New("invalid webhook request")
+
+// NewWebhooks creates a new Webhooks instance delivering the events to the given webhooks.
+func NewWebhooks(webhooks []Webhook, logger *slog.Logger) Webhooks {
+	closed, cancel := context.WithCancel(context.Background())
+	return Webhooks{
+		webhooks:       webhooks,
+		client:         &http.Client{Timeout: webhookTimeout},
+		initialBackoff: webhookInitialBackoff,
+		closed:         closed,
+		close:          cancel,
+		logger:         logger.With(slog.String("module", "webhooks")),
+	}
+}
+
+// Close abandons the deliveries in progress and their retries, like when the server shuts down. The events
+// notified afterwards aren't delivered.
+func (w Webhooks) Close() {
+	w.close()
+}
+
+// Notify delivers the event to every webhook interested in it. It returns immediately, while the deliveries
+// and their retries happen in the background.
+func (w Webhooks) Notify(ctx context.Context, event models.Event) {
+	// The deliveries outlive the caller, but keep the values of its context for the log records.
+	ctx = context.WithoutCancel(ctx)
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		w.logger.ErrorContext(ctx, "Failed to marshal event",
+			slog.String("event", fmt.Sprintf("%+v", event)),
+			slog.String("err", err.Error()))
+		return
+	}
+
+	if w.closed.Err() != nil {
+		return
+	}
+	for _, wh := range w.webhooks {
+		if len(wh.Events) > 0 && !slices.Contains(wh.Events, event.Type) {
+			continue
+		}
+		go w.deliver(ctx, wh, event.Type, payload)
+	}
+}
+
+func (w Webhooks) deliver(ctx context.Context, wh Webhook, eventType models.EventType, payload []byte) {
+	backoff := w.initialBackoff
+	for attempt := 0; ; attempt++ {
+		err := w.post(ctx, wh, eventType, payload)
+		if err == nil {
+			return
+		}
+		if attempt >= wh.MaxRetries || !retryableWebhookError(err) || w.closed.Err() != nil {
+			w.logger.ErrorContext(ctx, "Failed to deliver webhook",
+				slog.String("url", wh.URL),
+				slog.String("event", string(eventType)),
+				slog.Int("attempts", attempt+1),
+				slog.String("err", err.Error()))
+			return
+		}
+		w.logger.WarnContext(ctx, "Retrying webhook delivery",
+			slog.String("url", wh.URL),
+			slog.String("event", string(eventType)),
+			slog.Duration("backoff", backoff),
+			slog.String("err", err.Error()))
+		timer := time.NewTimer(backoff)
+		select {
+		case <-w.closed.Done():
+			timer.Stop()
+			w.logger.WarnContext(ctx, "Abandoned webhook delivery on close",
+				slog.String("url", wh.URL),
+				slog.String("event", string(eventType)))
+			return
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+// retryableWebhookError reports whether a delivery failing with err may succeed if it's retried: the network
+// errors, and the responses with a 408 Request Timeout, 429 Too Many Requests or 5xx status.
+func retryableWebhookError(err error) bool {
+	if errors.Is(err, errInvalidWebhookRequest) {
+		return false
+	}
+	var statusErr *webhookStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code == http.StatusRequestTimeout || statusErr.code == http.StatusTooManyRequests ||
+			statusErr.code >= 500
+	}
+	return true
+}
+
+func (w Webhooks) post(ctx context.Context, wh Webhook, eventType models.EventType, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	// The request in flight is canceled by Close.
+	stop := context.AfterFunc(w.closed, cancel)
+	defer stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidWebhookRequest, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mcp-web-ui")
+	req.Header.Set("X-Webhook-Event", string(eventType))
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	if wh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.Secret))
+		mac.Write(payload)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &webhookStatusError{code: resp.StatusCode, body: string(body)}
+	}
+	return nil
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d, body: %s", e.code, e.body)
+}
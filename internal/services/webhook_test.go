@@ -0,0 +1,171 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// webhookTarget is a webhook server answering the deliveries with status, and sending them to received.
+type webhookTarget struct {
+	*httptest.Server
+
+	attempts atomic.Int32
+	received chan *http.Request
+	bodies   chan []byte
+}
+
+func newWebhookTarget(t *testing.T, status int) *webhookTarget {
+	t.Helper()
+	target := &webhookTarget{
+		received: make(chan *http.Request, 10),
+		bodies:   make(chan []byte, 10),
+	}
+	target.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		target.attempts.Add(1)
+		target.received <- r
+		target.bodies <- body
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(target.Close)
+	return target
+}
+
+func newTestWebhooks(t *testing.T, webhooks ...Webhook) Webhooks {
+	t.Helper()
+	w := NewWebhooks(webhooks, slog.Default())
+	w.initialBackoff = time.Millisecond
+	t.Cleanup(w.Close)
+	return w
+}
+
+func TestWebhooksSignature(t *testing.T) {
+	target := newWebhookTarget(t, http.StatusNoContent)
+	w := newTestWebhooks(t, Webhook{URL: target.URL, Secret: "s3cret"})
+
+	w.Notify(context.Background(), models.Event{Type: models.EventChatCreated, ChatID: "chat1"})
+
+	var r *http.Request
+	select {
+	case r = <-target.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event isn't delivered")
+	}
+	body := <-target.bodies
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if got, want := r.Header.Get("X-Webhook-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("X-Webhook-Signature = %q, want %q", got, want)
+	}
+	if got := r.Header.Get("X-Webhook-Event"); got != string(models.EventChatCreated) {
+		t.Errorf("X-Webhook-Event = %q, want %q", got, models.EventChatCreated)
+	}
+}
+
+func TestWebhooksEventFilter(t *testing.T) {
+	target := newWebhookTarget(t, http.StatusOK)
+	w := newTestWebhooks(t, Webhook{URL: target.URL, Events: []models.EventType{models.EventGenerationFailed}})
+
+	w.Notify(context.Background(), models.Event{Type: models.EventChatCreated, ChatID: "chat1"})
+	w.Notify(context.Background(), models.Event{Type: models.EventGenerationFailed, ChatID: "chat1"})
+
+	select {
+	case r := <-target.received:
+		if got := r.Header.Get("X-Webhook-Event"); got != string(models.EventGenerationFailed) {
+			t.Errorf("delivered event = %q, want only %q", got, models.EventGenerationFailed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event of the filter isn't delivered")
+	}
+	select {
+	case r := <-target.received:
+		t.Errorf("delivered event %q, want it filtered out", r.Header.Get("X-Webhook-Event"))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhooksRetries(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   int32
+	}{
+		{"server error", http.StatusInternalServerError, 3},
+		{"too many requests", http.StatusTooManyRequests, 3},
+		{"request timeout", http.StatusRequestTimeout, 3},
+		{"bad request", http.StatusBadRequest, 1},
+		{"not found", http.StatusNotFound, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newWebhookTarget(t, tt.status)
+			wh := Webhook{URL: target.URL, MaxRetries: 2}
+			w := newTestWebhooks(t, wh)
+
+			w.deliver(context.Background(), wh, models.EventChatCreated, []byte("{}"))
+			if got := target.attempts.Load(); got != tt.want {
+				t.Errorf("attempts = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhooksNetworkErrorRetried(t *testing.T) {
+	target := newWebhookTarget(t, http.StatusOK)
+	url := target.URL
+	target.Close()
+
+	var attempts atomic.Int32
+	wh := Webhook{URL: url, MaxRetries: 2}
+	w := newTestWebhooks(t, wh)
+	w.client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		attempts.Add(1)
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+
+	w.deliver(context.Background(), wh, models.EventChatCreated, []byte("{}"))
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("attempts = %d, want 3", got)
+	}
+}
+
+func TestWebhooksClose(t *testing.T) {
+	target := newWebhookTarget(t, http.StatusServiceUnavailable)
+	wh := Webhook{URL: target.URL, MaxRetries: 5}
+	w := newTestWebhooks(t, wh)
+	w.initialBackoff = time.Hour
+
+	done := make(chan struct{})
+	go func() {
+		w.deliver(context.Background(), wh, models.EventChatCreated, []byte("{}"))
+		close(done)
+	}()
+	<-target.received
+	w.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the retry of the delivery isn't abandoned on close")
+	}
+	if got := target.attempts.Load(); got != 1 {
+		t.Errorf("attempts = %d, want 1", got)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
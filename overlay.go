@@ -0,0 +1,65 @@
+package mcpwebui
+
+import (
+	"errors"
+	"io/fs"
+	"slices"
+	"strings"
+)
+
+// overlayFS overlays upper on the dir directory of base: the files of upper replace the files of base
+// with the same path under dir, and the files only in upper are added to it. The directory listings are
+// merged, so the new files are found by fs.Glob as well.
+type overlayFS struct {
+	base  fs.FS
+	dir   string
+	upper fs.FS
+}
+
+func (o overlayFS) rel(name string) (string, bool) {
+	if name == o.dir {
+		return ".", true
+	}
+	rel, ok := strings.CutPrefix(name, o.dir+"/")
+	return rel, ok
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if rel, ok := o.rel(name); ok {
+		f, err := o.upper.Open(rel)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return o.base.Open(name)
+}
+
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, baseErr := fs.ReadDir(o.base, name)
+
+	rel, ok := o.rel(name)
+	if !ok {
+		return entries, baseErr
+	}
+	upperEntries, err := fs.ReadDir(o.upper, rel)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, baseErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ue := range upperEntries {
+		idx := slices.IndexFunc(entries, func(e fs.DirEntry) bool { return e.Name() == ue.Name() })
+		if idx >= 0 {
+			entries[idx] = ue
+			continue
+		}
+		entries = append(entries, ue)
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
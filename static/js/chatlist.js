@@ -0,0 +1,67 @@
+// Incremental updates of the chat list. The chat list connection receives a chatAdded event with the item of a
+// new chat, listed first, and a chatUpdated event with the item of a renamed or relabeled chat, replaced if its
+// page is loaded, instead of the whole list. The items are rendered by the server without the state of the
+// page, so the chat being read is marked as active here, and the unread badge of a replaced item is kept.
+// The whole list is only published after the changes of many chats, like a purge, with its first page.
+(function() {
+    function currentChatID() {
+        return new URLSearchParams(window.location.search).get('chat_id') ||
+            document.querySelector('#chat-form-chatbox input[name="chat_id"]')?.value || '';
+    }
+
+    function parseItem(html) {
+        const template = document.createElement('template');
+        template.innerHTML = html.trim();
+        return template.content.firstElementChild;
+    }
+
+    function listedItem(list, chatID) {
+        return list.querySelector(`[data-chat-id="${CSS.escape(chatID)}"]`);
+    }
+
+    function markActive(item) {
+        item.classList.toggle('active', item.dataset.chatId === currentChatID());
+    }
+
+    function onChatAdded(event) {
+        const list = document.getElementById('chat-list');
+        const item = parseItem(event.data);
+        if (!list || !item) {
+            return;
+        }
+        listedItem(list, item.dataset.chatId)?.remove();
+        markActive(item);
+        list.prepend(item);
+        htmx.process(item);
+    }
+
+    function onChatUpdated(event) {
+        const list = document.getElementById('chat-list');
+        const item = parseItem(event.data);
+        // The chats of the pages not loaded yet are rendered up to date once they're loaded.
+        const listed = list && item && listedItem(list, item.dataset.chatId);
+        if (!listed) {
+            return;
+        }
+        const badge = listed.querySelector('.unread-badge');
+        if (badge) {
+            item.querySelector('.unread-badge')?.replaceWith(badge);
+        }
+        markActive(item);
+        listed.replaceWith(item);
+        htmx.process(item);
+    }
+
+    document.body.addEventListener('htmx:sseOpen', function(event) {
+        if (event.detail.elt.id === 'chat-list') {
+            event.detail.source.addEventListener('chatAdded', onChatAdded);
+            event.detail.source.addEventListener('chatUpdated', onChatUpdated);
+        }
+    });
+    // The whole list is published without the chat being read.
+    document.body.addEventListener('htmx:sseMessage', function(event) {
+        if (event.detail.elt.id === 'chat-list') {
+            event.detail.elt.querySelectorAll('[data-chat-id]').forEach(markActive);
+        }
+    });
+})();
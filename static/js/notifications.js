@@ -0,0 +1,123 @@
+// Unread counts and browser notifications of the chats. The chat list connection receives a completion
+// event when a generation of a chat finishes: the chat being read is marked as read, and the unread counts
+// of the others are fetched again to badge them in the sidebar. A browser notification is shown when the page
+// is in a background tab or shows another chat. The last read message of every chat is tracked per user on
+// the server, whose read events refresh the counts of the user's other pages and devices.
+(function() {
+    const TITLE = document.title;
+
+    let unread = {};
+
+    function currentChatID() {
+        return new URLSearchParams(window.location.search).get('chat_id') ||
+            document.querySelector('#chat-form-chatbox input[name="chat_id"]')?.value || '';
+    }
+
+    function refreshUnread() {
+        fetch('/chats/unread').then(function(response) {
+            return response.ok ? response.json() : unread;
+        }).then(function(counts) {
+            unread = counts;
+            renderBadges();
+        }).catch(function() {
+            // The counts are refreshed again on the next event.
+        });
+    }
+
+    function markRead(chatID) {
+        if (!chatID) {
+            return;
+        }
+        delete unread[chatID];
+        renderBadges();
+        fetch('/chats/read', {
+            method: 'POST',
+            headers: {'X-CSRF-Token': csrfToken()},
+            body: new URLSearchParams({chat_id: chatID}),
+        }).catch(function() {
+            // The chat is marked as read again when it's opened.
+        });
+    }
+
+    function renderBadge(item) {
+        const badge = item.querySelector('.unread-badge');
+        if (!badge) {
+            return;
+        }
+        const count = unread[item.dataset.chatId] || 0;
+        badge.textContent = count;
+        badge.classList.toggle('d-none', count === 0);
+    }
+
+    function renderBadges() {
+        document.querySelectorAll('#chat-list [data-chat-id]').forEach(renderBadge);
+        const chats = Object.keys(unread).length;
+        document.title = chats > 0 ? `(${chats}) ${TITLE}` : TITLE;
+    }
+
+    function notify(completion) {
+        if (!('Notification' in window) || Notification.permission !== 'granted') {
+            return;
+        }
+        const title = completion.failed ? 'Response failed' : (completion.title || 'New response');
+        const notification = new Notification(title, {
+            body: completion.preview,
+            tag: completion.messageId,
+            icon: '/static/icons/icon.svg',
+        });
+        notification.onclick = function() {
+            window.focus();
+            window.location.href = `/?chat_id=${encodeURIComponent(completion.chatId)}`;
+        };
+    }
+
+    function onCompletion(event) {
+        const completion = JSON.parse(event.data);
+        const reading = completion.chatId === currentChatID();
+        if (reading && !document.hidden) {
+            markRead(completion.chatId);
+        } else {
+            refreshUnread();
+        }
+        if (!reading || document.hidden) {
+            notify(completion);
+        }
+    }
+
+    document.body.addEventListener('htmx:sseOpen', function(event) {
+        if (event.detail.elt.id === 'chat-list') {
+            event.detail.source.addEventListener('completion', onCompletion);
+            event.detail.source.addEventListener('read', refreshUnread);
+        }
+    });
+    // The chat list is rendered again after the changes of many chats, like a purge.
+    document.body.addEventListener('htmx:sseMessage', function(event) {
+        if (event.detail.elt.id === 'chat-list') {
+            renderBadges();
+        }
+    });
+    // The next pages of the chat list are loaded as it's scrolled.
+    document.body.addEventListener('htmx:load', function(event) {
+        const item = event.detail.elt;
+        if (item.dataset?.chatId && item.closest('#chat-list')) {
+            renderBadge(item);
+        }
+    });
+    // The chat read in a background tab is marked as read when the tab is shown.
+    document.addEventListener('visibilitychange', function() {
+        if (!document.hidden && unread[currentChatID()]) {
+            markRead(currentChatID());
+        }
+    });
+
+    // The permission can only be requested in response to the user, so it's requested with the first message.
+    document.addEventListener('submit', function(event) {
+        if (event.target.id?.startsWith('chat-form-') && 'Notification' in window &&
+            Notification.permission === 'default') {
+            Notification.requestPermission();
+        }
+    });
+
+    markRead(currentChatID());
+    refreshUnread();
+})();
@@ -0,0 +1,126 @@
+// Offline queue of the chat messages. Every message posted to /chats gets an idempotency key, and the
+// messages composed while offline, or whose request failed to reach the server, are stored in the local
+// storage with their key. They are posted again when the connection returns, and the server ignores the
+// ones it already received, so a message is never added twice.
+(function() {
+    const QUEUE_KEY = 'mcpwebui-offline-queue';
+
+    function loadQueue() {
+        try {
+            return JSON.parse(localStorage.getItem(QUEUE_KEY)) || [];
+        } catch (err) {
+            return [];
+        }
+    }
+
+    function saveQueue(queue) {
+        localStorage.setItem(QUEUE_KEY, JSON.stringify(queue));
+    }
+
+    function showAlert(text, level) {
+        const alerts = document.getElementById('alerts');
+        if (!alerts) {
+            return;
+        }
+        const alert = document.createElement('div');
+        alert.className = `alert alert-${level} alert-dismissible fade show`;
+        alert.role = 'alert';
+        alert.textContent = text;
+        const close = document.createElement('button');
+        close.type = 'button';
+        close.className = 'btn-close';
+        close.dataset.bsDismiss = 'alert';
+        close.ariaLabel = 'Close';
+        alert.appendChild(close);
+        alerts.appendChild(alert);
+    }
+
+    function isChatRequest(detail) {
+        return detail.verb === 'post' && detail.path === '/chats';
+    }
+
+    function enqueue(parameters) {
+        const queue = loadQueue();
+        if (queue.some((item) => item.idempotency_key === parameters.idempotency_key)) {
+            return;
+        }
+        queue.push({
+            message: parameters.message,
+            chat_id: parameters.chat_id || '',
+            idempotency_key: parameters.idempotency_key,
+        });
+        saveQueue(queue);
+        showAlert('You are offline, the message will be sent when the connection returns.', 'warning');
+    }
+
+    document.body.addEventListener('htmx:configRequest', function(event) {
+        if (!isChatRequest(event.detail)) {
+            return;
+        }
+        if (!event.detail.parameters['idempotency_key']) {
+            event.detail.parameters['idempotency_key'] = crypto.randomUUID();
+        }
+        if (!navigator.onLine) {
+            event.preventDefault();
+            enqueue(event.detail.parameters);
+            event.detail.elt.closest('form')?.reset();
+        }
+    });
+
+    // The request may fail to reach the server even when the browser thinks it's online.
+    document.body.addEventListener('htmx:sendError', function(event) {
+        const config = event.detail.requestConfig;
+        if (config && isChatRequest(config)) {
+            enqueue(config.parameters);
+        }
+    });
+
+    let flushing = false;
+
+    // flush posts the queued messages in order, stopping at the first one that can't reach the server.
+    async function flush() {
+        if (flushing || !navigator.onLine) {
+            return;
+        }
+        flushing = true;
+        let sent = 0;
+        try {
+            let queue = loadQueue();
+            while (queue.length > 0) {
+                const item = queue[0];
+                let response;
+                try {
+                    response = await fetch('/chats', {
+                        method: 'POST',
+                        headers: {
+                            'X-CSRF-Token': csrfToken(),
+                            'Idempotency-Key': item.idempotency_key,
+                        },
+                        body: new URLSearchParams(item),
+                    });
+                } catch (err) {
+                    return;
+                }
+                if (response.status >= 500) {
+                    return;
+                }
+                if (!response.ok) {
+                    showAlert(`A queued message couldn't be sent: ${await response.text()}`, 'danger');
+                } else {
+                    sent++;
+                }
+                queue = loadQueue().filter((queued) => queued.idempotency_key !== item.idempotency_key);
+                saveQueue(queue);
+            }
+        } finally {
+            flushing = false;
+            if (sent > 0) {
+                // The page is reloaded to show the sent messages and stream their responses.
+                window.location.reload();
+            }
+        }
+    }
+
+    window.addEventListener('online', flush);
+    flush();
+})();
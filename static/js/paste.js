@@ -0,0 +1,76 @@
+// Rich paste into the chat forms. The images pasted into a message are uploaded to /attachments/images and
+// attached to its form, and the large pasted code is fenced as a markdown code block by /attachments/code, with
+// the info string of its language. A failed request leaves the paste as the browser would do it.
+(function() {
+    // MIN_CODE_LINES is the number of lines of a pasted text sent to be fenced, like on the server.
+    const MIN_CODE_LINES = 5;
+
+    async function post(url, body) {
+        const response = await fetch(url, {method: 'POST', headers: {'X-CSRF-Token': csrfToken()}, body: body});
+        const text = await response.text();
+        if (!response.ok) {
+            // The errors meant to be shown to the user are rendered as alerts, like for htmx.
+            if (response.headers.get('HX-Retarget') === '#alerts') {
+                document.getElementById('alerts').insertAdjacentHTML('beforeend', text);
+            }
+            throw new Error(`Failed to post to ${url}: ${response.status}`);
+        }
+        return text;
+    }
+
+    function uploadImage(form, file) {
+        const body = new FormData();
+        body.append('image', file);
+        post('/attachments/images', body)
+            .then(function(html) {
+                form.querySelector('#chat-attachments').insertAdjacentHTML('beforeend', html);
+            })
+            .catch(function(err) {
+                console.error(err);
+            });
+    }
+
+    // insideCodeBlock reports whether the cursor of textarea is inside a fenced code block of its text.
+    function insideCodeBlock(textarea) {
+        const before = textarea.value.slice(0, textarea.selectionStart);
+        return (before.match(/```/g) || []).length % 2 === 1;
+    }
+
+    function insertText(textarea, start, end, text) {
+        textarea.focus();
+        textarea.setRangeText(text, start, end, 'end');
+        textarea.dispatchEvent(new Event('input', {bubbles: true}));
+    }
+
+    document.addEventListener('paste', function(event) {
+        const textarea = event.target;
+        if (!(textarea instanceof HTMLTextAreaElement) || textarea.name !== 'message' || !textarea.form) {
+            return;
+        }
+        const images = Array.from(event.clipboardData.files).filter(function(file) {
+            return file.type.startsWith('image/');
+        });
+        if (images.length > 0) {
+            event.preventDefault();
+            images.forEach(function(file) {
+                uploadImage(textarea.form, file);
+            });
+            return;
+        }
+
+        const text = event.clipboardData.getData('text/plain');
+        if (text.trim().split('\n').length < MIN_CODE_LINES || insideCodeBlock(textarea)) {
+            return;
+        }
+        event.preventDefault();
+        const start = textarea.selectionStart;
+        const end = textarea.selectionEnd;
+        post('/attachments/code', new URLSearchParams({code: text}))
+            .catch(function() {
+                return text;
+            })
+            .then(function(pasted) {
+                insertText(textarea, start, end, pasted);
+            });
+    });
+})();
@@ -0,0 +1,106 @@
+// Encryption of the shared chats. The transcript of a chat shared with a passphrase is encrypted in the
+// browser of its author, and decrypted in the browser of its readers, so the server and the proxies in front
+// of it only see the ciphertext: base64 of a 16-byte salt, a 12-byte IV and the AES-GCM ciphertext, with a key
+// derived from the passphrase by PBKDF2-SHA256.
+(function() {
+    const ITERATIONS = 310000;
+    const SALT_LENGTH = 16;
+    const IV_LENGTH = 12;
+
+    async function deriveKey(passphrase, salt, usage) {
+        const material = await crypto.subtle.importKey('raw', new TextEncoder().encode(passphrase), 'PBKDF2',
+            false, ['deriveKey']);
+        return crypto.subtle.deriveKey({name: 'PBKDF2', salt: salt, iterations: ITERATIONS, hash: 'SHA-256'},
+            material, {name: 'AES-GCM', length: 256}, false, [usage]);
+    }
+
+    async function encrypt(plaintext, passphrase) {
+        const salt = crypto.getRandomValues(new Uint8Array(SALT_LENGTH));
+        const iv = crypto.getRandomValues(new Uint8Array(IV_LENGTH));
+        const key = await deriveKey(passphrase, salt, 'encrypt');
+        const ciphertext = await crypto.subtle.encrypt({name: 'AES-GCM', iv: iv}, key,
+            new TextEncoder().encode(plaintext));
+        const payload = new Uint8Array(SALT_LENGTH + IV_LENGTH + ciphertext.byteLength);
+        payload.set(salt);
+        payload.set(iv, SALT_LENGTH);
+        payload.set(new Uint8Array(ciphertext), SALT_LENGTH + IV_LENGTH);
+        let binary = '';
+        payload.forEach(function(b) {
+            binary += String.fromCharCode(b);
+        });
+        return btoa(binary);
+    }
+
+    async function decrypt(encoded, passphrase) {
+        const payload = Uint8Array.from(atob(encoded), function(c) {
+            return c.charCodeAt(0);
+        });
+        const salt = payload.slice(0, SALT_LENGTH);
+        const iv = payload.slice(SALT_LENGTH, SALT_LENGTH + IV_LENGTH);
+        const key = await deriveKey(passphrase, salt, 'decrypt');
+        const plaintext = await crypto.subtle.decrypt({name: 'AES-GCM', iv: iv}, key,
+            payload.slice(SALT_LENGTH + IV_LENGTH));
+        return new TextDecoder().decode(plaintext);
+    }
+
+    // The share form of a chat encrypts its transcript before htmx sends the form, if it has a passphrase.
+    document.body.addEventListener('htmx:confirm', function(event) {
+        const form = event.target.closest('[data-share-form]');
+        if (!form) {
+            return;
+        }
+        const passphrase = form.querySelector('[data-share-passphrase]');
+        const ciphertext = form.querySelector('input[name="ciphertext"]');
+        const revoke = event.detail.triggeringEvent && event.detail.triggeringEvent.submitter &&
+            event.detail.triggeringEvent.submitter.value === 'revoke';
+        ciphertext.value = '';
+        if (!passphrase.value || revoke) {
+            return;
+        }
+        event.preventDefault();
+        const chatID = form.querySelector('input[name="chat_id"]').value;
+        fetch('/chats/share?chat_id=' + encodeURIComponent(chatID))
+            .then(function(response) {
+                if (!response.ok) {
+                    throw new Error('Failed to get the transcript: ' + response.status);
+                }
+                return response.text();
+            })
+            .then(function(transcript) {
+                return encrypt(transcript, passphrase.value);
+            })
+            .then(function(encoded) {
+                ciphertext.value = encoded;
+                passphrase.value = '';
+                event.detail.issueRequest(true);
+            })
+            .catch(function(err) {
+                console.error(err);
+            });
+    });
+
+    // The page of an encrypted shared chat decrypts it with the passphrase of its reader.
+    const decryptForm = document.getElementById('share-decrypt');
+    if (!decryptForm) {
+        return;
+    }
+    decryptForm.addEventListener('submit', function(event) {
+        event.preventDefault();
+        const error = document.getElementById('share-error');
+        const frame = document.getElementById('share-transcript');
+        decrypt(decryptForm.dataset.ciphertext, document.getElementById('share-passphrase').value)
+            .then(function(transcript) {
+                const styles = Array.from(document.querySelectorAll('link[rel="stylesheet"]'), function(link) {
+                    return `<link rel="stylesheet" href="${link.href}">`;
+                }).join('');
+                frame.srcdoc = `<!DOCTYPE html><html data-bs-theme="dark"><head><base target="_blank">${styles}` +
+                    `</head><body class="chat-container observer-view p-3">${transcript}</body></html>`;
+                frame.classList.remove('d-none');
+                decryptForm.classList.add('d-none');
+                error.classList.add('d-none');
+            })
+            .catch(function() {
+                error.classList.remove('d-none');
+            });
+    });
+})();
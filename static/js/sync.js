@@ -0,0 +1,88 @@
+// Sync of the pages showing the same chat. The chatbox connects to the messages topic of its chat, which
+// receives the messages sent to the chat from any page or the chat API, and the typing events of the other
+// pages. The messages already shown, like the ones the page sent itself, are skipped by their IDs.
+(function() {
+    const TYPING_INTERVAL = 2000;
+    const TYPING_TIMEOUT = 4000;
+
+    const clientID = crypto.randomUUID();
+    let typingHideTimer = null;
+    let lastTypingSent = 0;
+
+    // newMessagesHTML returns the HTML of the messages of html that aren't shown yet.
+    function newMessagesHTML(html) {
+        const template = document.createElement('template');
+        template.innerHTML = html;
+        template.content.querySelectorAll('.message[id]').forEach(function(message) {
+            if (document.getElementById(message.id)) {
+                message.remove();
+            }
+        });
+        return template.innerHTML.trim();
+    }
+
+    function scrollToBottom() {
+        const messages = document.getElementById('chat-messages');
+        if (messages) {
+            messages.scrollTop = messages.scrollHeight;
+        }
+    }
+
+    function hideTyping() {
+        document.getElementById('typing-indicator')?.classList.add('d-none');
+    }
+
+    function onChatMessages(event) {
+        hideTyping();
+        const html = newMessagesHTML(event.data);
+        if (html === '') {
+            return;
+        }
+        htmx.swap('#chat-messages', html, {swapStyle: 'beforeend'});
+        scrollToBottom();
+    }
+
+    function onTyping(event) {
+        const typing = JSON.parse(event.data);
+        const indicator = document.getElementById('typing-indicator');
+        if (typing.clientId === clientID || !indicator) {
+            return;
+        }
+        indicator.textContent = `${typing.userId || 'Someone'} is typing…`;
+        indicator.classList.remove('d-none');
+        clearTimeout(typingHideTimer);
+        typingHideTimer = setTimeout(hideTyping, TYPING_TIMEOUT);
+    }
+
+    document.body.addEventListener('htmx:sseOpen', function(event) {
+        if (event.detail.elt.id === 'chat-messages') {
+            event.detail.source.addEventListener('chatMessages', onChatMessages);
+            event.detail.source.addEventListener('typing', onTyping);
+        }
+    });
+
+    // The response of a message may arrive after the message was already added from the messages topic.
+    document.body.addEventListener('htmx:beforeSwap', function(event) {
+        if (event.detail.target.id === 'chat-messages' && event.detail.xhr.status < 400) {
+            event.detail.serverResponse = newMessagesHTML(event.detail.serverResponse);
+        }
+    });
+
+    document.addEventListener('input', function(event) {
+        const form = event.target.closest('#chat-form-chatbox');
+        if (!form || Date.now() - lastTypingSent < TYPING_INTERVAL) {
+            return;
+        }
+        lastTypingSent = Date.now();
+        fetch('/chats/typing', {
+            method: 'POST',
+            headers: {'X-CSRF-Token': csrfToken()},
+            body: new URLSearchParams({
+                chat_id: form.querySelector('input[name="chat_id"]').value,
+                client_id: clientID,
+            }),
+        }).catch(function() {
+            // The typing indicator is best effort.
+        });
+    });
+})();
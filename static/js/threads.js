@@ -0,0 +1,45 @@
+// Replies of the threads. The Reply button of a message sets the parent_id field of the chat form, so the next
+// message sent replies to it, and shows which message it replies to above the form until it's sent or
+// cancelled.
+(function() {
+    const EXCERPT_LENGTH = 80;
+
+    function excerpt(message) {
+        const text = (message?.querySelector('.message-bubble')?.textContent || '').replace(/\s+/g, ' ').trim();
+        return text.length > EXCERPT_LENGTH ? text.slice(0, EXCERPT_LENGTH - 1) + '…' : text;
+    }
+
+    function setReply(messageID) {
+        const input = document.getElementById('chat-parent-id');
+        const banner = document.getElementById('chat-reply');
+        if (!input || !banner) {
+            return;
+        }
+        input.value = messageID;
+        banner.classList.toggle('d-none', messageID === '');
+        banner.classList.toggle('d-flex', messageID !== '');
+        if (messageID !== '') {
+            document.getElementById('chat-reply-excerpt').textContent =
+                excerpt(document.getElementById('message-' + messageID)) || 'an earlier message';
+            document.querySelector('#chat-form-chatbox textarea[name="message"]')?.focus();
+        }
+    }
+
+    document.body.addEventListener('click', function(event) {
+        const reply = event.target.closest('[data-reply-to]');
+        if (reply) {
+            setReply(reply.dataset.replyTo);
+            return;
+        }
+        if (event.target.closest('[data-reply-cancel]')) {
+            setReply('');
+        }
+    });
+
+    // The hidden field isn't cleared by the reset of the form after the message is sent.
+    document.body.addEventListener('htmx:afterRequest', function(event) {
+        if (event.detail.elt.id === 'chat-form-chatbox' && event.detail.successful) {
+            setReply('');
+        }
+    });
+})();
@@ -0,0 +1,38 @@
+// Timezone of the user and relative times of the messages. The server renders the times in the timezone
+// hinted by the browser, stored in a cookie, which is hinted again when it changes, like after travelling.
+// The relative times, like "2 min ago", are refreshed every minute, and turn into the time of the day after
+// an hour, like the ones rendered by the server.
+(function() {
+    const REFRESH_INTERVAL = 60000;
+
+    function hintTimezone() {
+        const timezone = Intl.DateTimeFormat().resolvedOptions().timeZone;
+        const match = document.cookie.match(/(?:^|;\s*)mcpwebui_tz=([^;]+)/);
+        if (!timezone || (match && decodeURIComponent(match[1]) === timezone)) {
+            return;
+        }
+        fetch('/settings/timezone', {
+            method: 'POST',
+            headers: {'X-CSRF-Token': csrfToken()},
+            body: new URLSearchParams({timezone: timezone}),
+        }).catch(function() {
+            // The timezone is hinted again on the next page.
+        });
+    }
+
+    function refreshRelativeTimes() {
+        document.querySelectorAll('time.message-time').forEach(function(time) {
+            const minutes = Math.floor((Date.now() - Date.parse(time.getAttribute('datetime'))) / 60000);
+            if (minutes < 1) {
+                time.textContent = 'just now';
+            } else if (minutes < 60) {
+                time.textContent = `${minutes} min ago`;
+            } else {
+                time.textContent = time.dataset.time;
+            }
+        });
+    }
+
+    hintTimezone();
+    setInterval(refreshRelativeTimes, REFRESH_INTERVAL);
+})();
@@ -0,0 +1,89 @@
+// Service worker of the MCP Web UI PWA. It's served at /sw.js so its scope covers the whole UI.
+//
+// The pages are fetched from the network first and fall back to the last cached copy when offline, and the
+// static assets are served from the cache while they are refreshed in the background. The state-changing
+// requests, the SSE streams, the API, the unread counts, the pages of the chat list and the transcripts to
+// share are never cached: the messages composed while offline are queued by /static/js/offline.js instead.
+
+const CACHE = 'mcpwebui-v9';
+
+const SHELL = [
+    '/',
+    '/static/css/styles.css',
+    '/static/js/offline.js',
+    '/static/js/notifications.js',
+    '/static/js/chatlist.js',
+    '/static/js/sync.js',
+    '/static/js/timezone.js',
+    '/static/js/threads.js',
+    '/static/js/share.js',
+    '/static/js/paste.js',
+    '/static/manifest.json',
+    '/static/icons/icon.svg',
+];
+
+self.addEventListener('install', (event) => {
+    event.waitUntil(caches.open(CACHE).then((cache) => cache.addAll(SHELL)).then(() => self.skipWaiting()));
+});
+
+self.addEventListener('activate', (event) => {
+    event.waitUntil(
+        caches.keys()
+            .then((keys) => Promise.all(keys.filter((key) => key !== CACHE).map((key) => caches.delete(key))))
+            .then(() => self.clients.claim())
+    );
+});
+
+self.addEventListener('fetch', (event) => {
+    const request = event.request;
+    if (request.method !== 'GET') {
+        return;
+    }
+    const url = new URL(request.url);
+    if (url.origin === self.location.origin &&
+        (url.pathname.startsWith('/sse/') || url.pathname.startsWith('/api/') || url.pathname.startsWith('/admin/') ||
+            url.pathname === '/chats/unread' || url.pathname === '/chats/share' || url.pathname === '/chats/context' ||
+            url.pathname === '/chats/list')) {
+        return;
+    }
+
+    if (request.mode === 'navigate') {
+        event.respondWith(networkFirst(request));
+        return;
+    }
+    event.respondWith(staleWhileRevalidate(request, event));
+});
+
+async function networkFirst(request) {
+    const cache = await caches.open(CACHE);
+    try {
+        const response = await fetch(request);
+        if (response.ok) {
+            cache.put(request, response.clone());
+        }
+        return response;
+    } catch (err) {
+        const cached = await cache.match(request) || await cache.match('/');
+        if (cached) {
+            return cached;
+        }
+        throw err;
+    }
+}
+
+async function staleWhileRevalidate(request, event) {
+    const cache = await caches.open(CACHE);
+    const cached = await cache.match(request);
+    const refresh = fetch(request).then((response) => {
+        // The assets of the CDNs are opaque responses, which can be cached but not inspected.
+        if (response.ok || response.type === 'opaque') {
+            cache.put(request, response.clone());
+        }
+        return response;
+    });
+    if (cached) {
+        event.waitUntil(refresh.catch(() => undefined));
+        return cached;
+    }
+    return refresh;
+}
@@ -0,0 +1,165 @@
+package mcpwebui
+
+import (
+	"github.com/MegaGrindStone/mcp-web-ui/internal/handlers"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// The aliases below expose the types needed to implement the injectable dependencies of New, as their
+// definitions live in the internal packages.
+
+type (
+	// LLM represents a large language model that provides chat functionality.
+	LLM = handlers.LLM
+	// TitleGenerator represents a title generator that generates a title for a given message.
+	TitleGenerator = handlers.TitleGenerator
+	// Store defines the persistence of the chats, messages, usages and scheduled prompts.
+	Store = handlers.Store
+	// Notifier delivers the chat events to external systems.
+	Notifier = handlers.Notifier
+	// GenerationExporter exports the completed generations to observability tools.
+	GenerationExporter = handlers.GenerationExporter
+	// EventSubscriber receives the events published to the pages.
+	EventSubscriber = handlers.EventSubscriber
+	// EventSubscriberFunc is an adapter to use a function as an EventSubscriber.
+	EventSubscriberFunc = handlers.EventSubscriberFunc
+	// UIEvent is an update of the pages published to the EventSubscribers.
+	UIEvent = handlers.UIEvent
+	// Bridge connects an external messaging service to the chats.
+	Bridge = handlers.Bridge
+	// BridgeMessage is a message of an external conversation received by a Bridge.
+	BridgeMessage = models.BridgeMessage
+	// BridgeReply is the reply to a BridgeMessage sent back by a Bridge.
+	BridgeReply = models.BridgeReply
+	// LLMMiddleware wraps an LLM to intercept its chats.
+	LLMMiddleware = handlers.LLMMiddleware
+	// LLMFunc is an adapter to use a function as an LLM, to write the middlewares.
+	LLMFunc = handlers.LLMFunc
+
+	// Quota is a set of daily limits, zero means unlimited.
+	Quota = handlers.Quota
+	// Quotas are the default quota and its per-user overrides.
+	Quotas = handlers.Quotas
+	// Security configures the security headers and the CSRF protection.
+	Security = handlers.Security
+	// Access configures the role-based access control of the users.
+	Access = handlers.Access
+	// UserRole is the role of a user, granting them a set of permissions.
+	UserRole = handlers.UserRole
+	// Sessions configures the browser sessions of the users, listed and revoked at /settings/sessions.
+	Sessions = handlers.Sessions
+	// Lockout configures the lockout of the clients after repeated failed authentications.
+	Lockout = handlers.Lockout
+	// KeyRotation re-instantiates the LLM providers with a new API key at runtime.
+	KeyRotation = handlers.KeyRotation
+	// Budget is the daily and monthly spend budget of an LLM provider.
+	Budget = handlers.Budget
+	// CORS configures the cross-origin requests to the chat API and the SSE streams.
+	CORS = handlers.CORS
+	// Capture configures the capture endpoint of the chat API.
+	Capture = handlers.Capture
+	// Welcome configures the welcome card of the empty chat state.
+	Welcome = handlers.Welcome
+	// WelcomeSuggestion is a suggested prompt of the welcome card.
+	WelcomeSuggestion = handlers.WelcomeSuggestion
+	// ToolResultGuard configures the scan of the tool results for prompt injections.
+	ToolResultGuard = handlers.ToolResultGuard
+	// ToolCache configures the cache of the results of the idempotent tools.
+	ToolCache = handlers.ToolCache
+	// ToolOverride replaces the name or the description a tool is presented to the LLM with.
+	ToolOverride = handlers.ToolOverride
+	// CapabilitiesCache configures the cache of the capabilities of the MCP servers.
+	CapabilitiesCache = handlers.CapabilitiesCache
+	// MCPServerState is the cached state of an MCP server.
+	MCPServerState = models.MCPServerState
+	// ResponseLimit configures the soft limit of the length of the responses in the chats.
+	ResponseLimit = handlers.ResponseLimit
+	// Batches configures the batch runner of prompt templates.
+	Batches = handlers.Batches
+	// TitleGeneration configures the queue of the generation of the titles of the new chats.
+	TitleGeneration = handlers.TitleGeneration
+	// EvalReport is the report of a run of the eval suite.
+	EvalReport = handlers.EvalReport
+	// EvalResult is the result of an eval case, with the transcript of its response.
+	EvalResult = handlers.EvalResult
+	// TrafficInspector records the JSON-RPC messages exchanged with the MCP servers.
+	TrafficInspector = handlers.TrafficInspector
+	// ServerInstructions collects the instructions of the MCP servers for the system prompt.
+	ServerInstructions = handlers.ServerInstructions
+	// SSEKeepAlive configures the keep-alive of the SSE connections.
+	SSEKeepAlive = handlers.SSEKeepAlive
+	// Retention limits how long and how many chats are kept.
+	Retention = handlers.Retention
+	// Compactor is implemented by the stores that can reclaim the space left by the deleted chats.
+	Compactor = handlers.Compactor
+	// Maintenance schedules the maintenance of the store.
+	Maintenance = handlers.Maintenance
+	// Maintainer is implemented by the stores that support the maintenance tasks.
+	Maintainer = handlers.Maintainer
+	// Backup schedules the backups of the store.
+	Backup = handlers.Backup
+	// BackupDestination is where the backups of the store are written.
+	BackupDestination = handlers.BackupDestination
+	// Snapshotter is implemented by the stores that can be backed up.
+	Snapshotter = handlers.Snapshotter
+	// ScheduledPrompt is a prompt sent automatically on a cron schedule.
+	ScheduledPrompt = handlers.ScheduledPrompt
+
+	// Chat represents a conversation.
+	Chat = models.Chat
+	// ChatStats are the statistics of the transcript of a chat, aggregated by a Store with ChatStats.Add.
+	ChatStats = models.ChatStats
+	// Message represents an individual message within a chat.
+	Message = models.Message
+	// Content is a message content with its type.
+	Content = models.Content
+	// Role represents the role of a message participant.
+	Role = models.Role
+	// ContentType represents the type of content in messages.
+	ContentType = models.ContentType
+	// Usage is the daily consumption of a user.
+	Usage = models.Usage
+	// Schedule is the state of a scheduled prompt.
+	Schedule = models.Schedule
+	// ScheduleRun is a single run of a scheduled prompt.
+	ScheduleRun = models.ScheduleRun
+	// APIToken is a personal access token of a user for the chat API.
+	APIToken = models.APIToken
+	// AuditEntry records the export or erasure of the data of a user.
+	AuditEntry = models.AuditEntry
+	// Generation is a completed generation exported to the GenerationExporters.
+	Generation = models.Generation
+	// Event is a chat event delivered to the Notifier.
+	Event = models.Event
+	// EventType represents the type of an Event.
+	EventType = models.EventType
+	// SetupError is a problem of the setup found by the CheckSetup method of an LLM, shown on the onboarding
+	// page with its hint.
+	SetupError = models.SetupError
+)
+
+// Message roles and content types.
+const (
+	RoleUser      = models.RoleUser
+	RoleAssistant = models.RoleAssistant
+
+	ContentTypeText       = models.ContentTypeText
+	ContentTypeCallTool   = models.ContentTypeCallTool
+	ContentTypeToolResult = models.ContentTypeToolResult
+)
+
+// Event types.
+const (
+	EventChatCreated         = models.EventChatCreated
+	EventGenerationCompleted = models.EventGenerationCompleted
+	EventGenerationFailed    = models.EventGenerationFailed
+	EventToolCallFailed      = models.EventToolCallFailed
+	EventScheduleCompleted   = models.EventScheduleCompleted
+)
+
+// User roles.
+const (
+	UserRoleAdmin  = handlers.UserRoleAdmin
+	UserRoleMember = handlers.UserRoleMember
+	UserRoleViewer = handlers.UserRoleViewer
+)